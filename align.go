@@ -0,0 +1,68 @@
+package btrfs
+
+import (
+	"os"
+)
+
+// CloneAlignment returns the alignment required for offsets and lengths of ranges passed
+// to CloneRange and Dedupe on the filesystem of the file. See also Info.CloneAlignment.
+func CloneAlignment(f *os.File) (uint64, error) {
+	info, err := iocFsInfo(f)
+	if err != nil {
+		return 0, err
+	}
+	return cloneAlignment(info), nil
+}
+
+func cloneAlignment(info btrfs_ioctl_fs_info_args) uint64 {
+	if info.CloneAlignment != 0 {
+		return uint64(info.CloneAlignment)
+	} else if info.SectorSize != 0 {
+		return uint64(info.SectorSize)
+	}
+	return 4096
+}
+
+// AlignRange returns the largest range inside of n bytes at off that is aligned to a given
+// alignment, as required by CloneRange and Dedupe. The length is zero if there is no such range.
+// When aligning a range of the source, the destination offset must be moved by the same amount.
+func AlignRange(off, n, align uint64) (uint64, uint64) {
+	if align == 0 {
+		return off, n
+	}
+	start := (off + align - 1) / align * align
+	end := (off + n) / align * align
+	if end <= start {
+		return start, 0
+	}
+	return start, end - start
+}
+
+// checkRemapRange checks the alignment of a range to clone or deduplicate. The length
+// may be unaligned if the range ends at the end of the source file (srcSize), or if the kernel
+// shortens the range itself (canShorten). Zero length means the range extends to the end of the source.
+func checkRemapRange(op string, srcOff, dstOff, n, srcSize, align uint64, canShorten bool) error {
+	unaligned := func(v uint64) bool { return v%align != 0 }
+	if unaligned(srcOff) || unaligned(dstOff) ||
+		(n != 0 && unaligned(n) && !canShorten && srcOff+n != srcSize) {
+		return ErrUnalignedRange{Op: op, SrcOff: srcOff, DstOff: dstOff, Len: n, Alignment: align}
+	}
+	return nil
+}
+
+// checkRemapFiles is like checkRemapRange, but gets the alignment and the source size from files.
+func checkRemapFiles(op string, src *os.File, srcOff, dstOff, n uint64, canShorten bool) error {
+	align, err := CloneAlignment(src)
+	if err != nil {
+		return err
+	}
+	var size uint64
+	if n != 0 && !canShorten {
+		st, err := src.Stat()
+		if err != nil {
+			return err
+		}
+		size = uint64(st.Size())
+	}
+	return checkRemapRange(op, srcOff, dstOff, n, size, align, canShorten)
+}
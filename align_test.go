@@ -0,0 +1,47 @@
+package btrfs
+
+import "testing"
+
+func TestAlignRange(t *testing.T) {
+	for _, c := range []struct {
+		off, n, align uint64
+		expOff, expN  uint64
+	}{
+		{0, 8192, 4096, 0, 8192},
+		{100, 8192, 4096, 4096, 4096},
+		{100, 4000, 4096, 4096, 0},
+		{4096, 10000, 4096, 4096, 8192},
+		{5, 10, 0, 5, 10},
+	} {
+		off, n := AlignRange(c.off, c.n, c.align)
+		if off != c.expOff || n != c.expN {
+			t.Errorf("AlignRange(%d, %d, %d) = (%d, %d), expected (%d, %d)",
+				c.off, c.n, c.align, off, n, c.expOff, c.expN)
+		}
+	}
+}
+
+func TestCheckRemapRange(t *testing.T) {
+	for _, c := range []struct {
+		srcOff, dstOff, n, size uint64
+		shorten                 bool
+		ok                      bool
+	}{
+		{0, 0, 8192, 100000, false, true},
+		{0, 0, 0, 100000, false, true},
+		{0, 100, 4096, 100000, false, false},
+		{100, 0, 4096, 100000, false, false},
+		{0, 0, 5000, 100000, false, false},
+		{0, 0, 5000, 5000, false, true},
+		{4096, 0, 5000, 0, true, true},
+	} {
+		err := checkRemapRange("clone", c.srcOff, c.dstOff, c.n, c.size, 4096, c.shorten)
+		if c.ok && err != nil {
+			t.Errorf("%+v: unexpected error: %v", c, err)
+		} else if !c.ok {
+			if e, ok := err.(ErrUnalignedRange); !ok || e.Alignment != 4096 {
+				t.Errorf("%+v: unexpected error: %v", c, err)
+			}
+		}
+	}
+}
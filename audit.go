@@ -0,0 +1,89 @@
+package btrfs
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// AuditRecord describes a single mutating operation performed through FS.
+type AuditRecord struct {
+	Time     time.Time              `json:"time"`  // start of the operation
+	Mount    string                 `json:"mount"` // path the FS was opened at
+	Op       string                 `json:"op"`
+	Args     map[string]interface{} `json:"args,omitempty"`
+	Reason   string                 `json:"reason,omitempty"`   // see WithReason
+	Override bool                   `json:"override,omitempty"` // see WithOverride
+	Duration time.Duration          `json:"duration"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+// AuditFunc is called after each mutating operation.
+type AuditFunc func(rec AuditRecord)
+
+// SetAudit sets a function that is called after each mutating operation (subvolume
+// creation and deletion, snapshots, flag changes, receive, balance, resize, device
+// replace and stats reset). Nil disables auditing.
+//
+// It must be called before the FS is used concurrently.
+func (f *FS) SetAudit(fn AuditFunc) {
+	f.audit = fn
+}
+
+// WithReason returns a copy of the FS that attaches a reason to all audit records.
+// The copy shares the underlying handle with f, thus only one of them should be closed.
+func (f *FS) WithReason(reason string) *FS {
+	c := *f
+	c.reason = reason
+	return &c
+}
+
+// Reason returns a reason set by WithReason.
+func (f *FS) Reason() string {
+	return f.reason
+}
+
+// NewAuditWriter returns an AuditFunc that writes records to w as JSON lines.
+// Records are written sequentially, and write errors are ignored.
+func NewAuditWriter(w io.Writer) AuditFunc {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(rec AuditRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+		_ = enc.Encode(rec)
+	}
+}
+
+// audited runs a mutating operation and records it, if auditing is enabled.
+// Operations blocked by the guard are recorded as well.
+func (f *FS) audited(op string, args map[string]interface{}, fn func() error) error {
+	run := func() error {
+		if err := f.checkGuard(op); err != nil {
+			return err
+		} else if err = f.revalidate(); err != nil {
+			return err
+		}
+		return fn()
+	}
+	if f.audit == nil {
+		return run()
+	}
+	start := time.Now()
+	err := run()
+	rec := AuditRecord{
+		Time:     start,
+		Mount:    f.f.Name(),
+		Op:       op,
+		Args:     args,
+		Reason:   f.reason,
+		Override: f.override,
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	f.audit(rec)
+	return err
+}
@@ -0,0 +1,49 @@
+package btrfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	dir, err := os.Open(os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	var buf bytes.Buffer
+	f := &FS{f: dir}
+	f.SetAudit(NewAuditWriter(&buf))
+
+	if err := f.audited("snapshot", map[string]interface{}{"dst": "snap"}, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	exp := errors.New("failed")
+	if err := f.WithReason("cleanup").audited("delete_subvolume", nil, func() error { return exp }); err != exp {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.Reason() != "" {
+		t.Fatal("reason leaked to the original FS")
+	}
+	dec := json.NewDecoder(&buf)
+	var recs []AuditRecord
+	for dec.More() {
+		var rec AuditRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(recs))
+	}
+	if r := recs[0]; r.Op != "snapshot" || r.Args["dst"] != "snap" || r.Error != "" || r.Mount != dir.Name() {
+		t.Errorf("unexpected record: %+v", r)
+	}
+	if r := recs[1]; r.Op != "delete_subvolume" || r.Reason != "cleanup" || r.Error != "failed" {
+		t.Errorf("unexpected record: %+v", r)
+	}
+}
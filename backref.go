@@ -0,0 +1,132 @@
+package btrfs
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// logicalInoBufSize is the largest buffer accepted by LOGICAL_INO.
+	logicalInoBufSize = 64 * 1024
+	// logicalInoBufSizeMax is the largest buffer accepted by LOGICAL_INO_V2.
+	logicalInoBufSizeMax = 16 * 1024 * 1024
+	// inoPathsBufSize is the buffer size used for INO_PATHS.
+	inoPathsBufSize = 64 * 1024
+)
+
+// ExtentRef is a reference to a data extent from a file in a specific subvolume.
+type ExtentRef struct {
+	Root   uint64 // subvolume (tree) id
+	Inode  uint64 // inode number within the subvolume
+	Offset uint64 // offset in the file where the extent is referenced
+}
+
+// ExtentRefs resolves all the files referencing the data extent at a given logical address.
+//
+// It is useful to find out why the space is still in use after deletions:
+// an extent is only freed when all references listed here are gone.
+// Requires CAP_SYS_ADMIN.
+func (f *FS) ExtentRefs(logical uint64) ([]ExtentRef, error) {
+	return logicalToInodes(f.f, logical)
+}
+
+// InodePaths returns all the paths (hard links) of an inode in a given subvolume.
+// Paths are absolute and reachable from the subvolume this FS was opened at.
+// Requires CAP_SYS_ADMIN.
+func (f *FS) InodePaths(root, inode uint64) ([]string, error) {
+	sub, err := f.subvolMountPath(objectID(root))
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.Open(sub)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	paths, err := inodePaths(dir, inode)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range paths {
+		paths[i] = sub + "/" + p
+	}
+	return paths, nil
+}
+
+func logicalToInodes(f *os.File, logical uint64) ([]ExtentRef, error) {
+	var (
+		buf  = make([]byte, logicalInoBufSize)
+		args btrfs_ioctl_logical_ino_args
+		cont *btrfs_data_container
+	)
+	for {
+		args = btrfs_ioctl_logical_ino_args{
+			Logical: logical,
+			Size:    uint64(len(buf)),
+			Inodes:  uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		}
+		var err error
+		if len(buf) > logicalInoBufSize {
+			err = iocLogicalInoV2(f, &args)
+		} else {
+			err = iocLogicalIno(f, &args)
+		}
+		runtime.KeepAlive(buf)
+		if err != nil {
+			return nil, err
+		}
+		cont = (*btrfs_data_container)(unsafe.Pointer(&buf[0]))
+		if cont.ElemMissed == 0 || len(buf) >= logicalInoBufSizeMax {
+			break
+		}
+		// retry with a larger buffer using v2 of the ioctl
+		n := len(buf) + int(cont.BytesMissing)
+		if n > logicalInoBufSizeMax {
+			n = logicalInoBufSizeMax
+		}
+		buf = make([]byte, n)
+	}
+	const hdr = unsafe.Sizeof(btrfs_data_container{})
+	vals := buf[hdr:]
+	out := make([]ExtentRef, 0, cont.ElemCnt/3)
+	for i := 0; i+2 < int(cont.ElemCnt); i += 3 {
+		out = append(out, ExtentRef{
+			Inode:  order.Uint64(vals[8*i:]),
+			Offset: order.Uint64(vals[8*(i+1):]),
+			Root:   order.Uint64(vals[8*(i+2):]),
+		})
+	}
+	return out, nil
+}
+
+// inodePaths returns paths of an inode relative to the subvolume f belongs to.
+func inodePaths(f *os.File, inode uint64) ([]string, error) {
+	buf := make([]byte, inoPathsBufSize)
+	args := btrfs_ioctl_ino_path_args{
+		Inum:   inode,
+		Size:   uint64(len(buf)),
+		FSPath: uint64(uintptr(unsafe.Pointer(&buf[0]))),
+	}
+	err := iocInoPaths(f, &args)
+	runtime.KeepAlive(buf)
+	if err == syscall.ENOENT {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	cont := (*btrfs_data_container)(unsafe.Pointer(&buf[0]))
+	const hdr = unsafe.Sizeof(btrfs_data_container{})
+	vals := buf[hdr:]
+	out := make([]string, 0, cont.ElemCnt)
+	for i := 0; i < int(cont.ElemCnt); i++ {
+		// offsets are relative to the start of the values array
+		off := order.Uint64(vals[8*i:])
+		if off >= uint64(len(vals)) {
+			break
+		}
+		out = append(out, stringFromBytes(vals[off:]))
+	}
+	return out, nil
+}
@@ -0,0 +1,598 @@
+package btrfs
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Profile is an allocation profile of block groups (also known as RAID level).
+// Profiles can be combined to form a set, which is used in balance filters.
+type Profile uint64
+
+const (
+	ProfileSingle  = Profile(availAllocBitSingle)
+	ProfileDup     = Profile(blockGroupDup)
+	ProfileRaid0   = Profile(blockGroupRaid0)
+	ProfileRaid1   = Profile(blockGroupRaid1)
+	ProfileRaid1C3 = Profile(blockGroupRaid1C3)
+	ProfileRaid1C4 = Profile(blockGroupRaid1C4)
+	ProfileRaid10  = Profile(blockGroupRaid10)
+	ProfileRaid5   = Profile(blockGroupRaid5)
+	ProfileRaid6   = Profile(blockGroupRaid6)
+)
+
+type profileInfo struct {
+	Profile   Profile
+	Name      string
+	DevsMin   int // minimal number of devices
+	NCopies   int // number of copies of each block
+	NParity   int // number of parity stripes
+	Tolerated int // number of device failures that can be tolerated
+}
+
+// profileInfos describes all profiles, as in btrfs_raid_array in the kernel.
+var profileInfos = []profileInfo{
+	{Profile: ProfileSingle, Name: "single", DevsMin: 1, NCopies: 1},
+	{Profile: ProfileDup, Name: "dup", DevsMin: 1, NCopies: 2},
+	{Profile: ProfileRaid0, Name: "raid0", DevsMin: 1, NCopies: 1},
+	{Profile: ProfileRaid1, Name: "raid1", DevsMin: 2, NCopies: 2, Tolerated: 1},
+	{Profile: ProfileRaid1C3, Name: "raid1c3", DevsMin: 3, NCopies: 3, Tolerated: 2},
+	{Profile: ProfileRaid1C4, Name: "raid1c4", DevsMin: 4, NCopies: 4, Tolerated: 3},
+	{Profile: ProfileRaid10, Name: "raid10", DevsMin: 2, NCopies: 2, Tolerated: 1},
+	{Profile: ProfileRaid5, Name: "raid5", DevsMin: 2, NCopies: 1, NParity: 1, Tolerated: 1},
+	{Profile: ProfileRaid6, Name: "raid6", DevsMin: 3, NCopies: 1, NParity: 2, Tolerated: 2},
+}
+
+func (p Profile) info() (profileInfo, bool) {
+	for _, pi := range profileInfos {
+		if pi.Profile == p {
+			return pi, true
+		}
+	}
+	return profileInfo{}, false
+}
+
+// profileOf returns a profile of a block group with given flags.
+func profileOf(bg blockGroup) Profile {
+	if p := bg & _BTRFS_BLOCK_GROUP_PROFILE_MASK; p != 0 {
+		return Profile(p)
+	}
+	return ProfileSingle
+}
+
+// ParseProfile parses a profile name, as used by btrfs-progs (e.g. "raid1").
+func ParseProfile(s string) (Profile, error) {
+	s = strings.ToLower(s)
+	for _, pi := range profileInfos {
+		if pi.Name == s {
+			return pi.Profile, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown profile: %q", s)
+}
+
+func (p Profile) String() string {
+	if p == 0 {
+		return "<nil>"
+	}
+	var out []string
+	for _, pi := range profileInfos {
+		if p&pi.Profile != 0 {
+			out = append(out, pi.Name)
+			p &^= pi.Profile
+		}
+	}
+	if p != 0 {
+		out = append(out, fmt.Sprintf("%#x", uint64(p)))
+	}
+	return strings.Join(out, "|")
+}
+
+// MinDevices returns the minimal number of devices required for the profile.
+func (p Profile) MinDevices() int {
+	pi, _ := p.info()
+	return pi.DevsMin
+}
+
+// Tolerated returns the number of device failures the profile can survive.
+func (p Profile) Tolerated() int {
+	pi, _ := p.info()
+	return pi.Tolerated
+}
+
+// BalanceRange is an inclusive range used in balance filters.
+type BalanceRange struct {
+	Min, Max uint64
+}
+
+// BalanceArgs is a set of balance filters for a single type of block groups.
+// Only block groups matching all the filters are relocated.
+type BalanceArgs struct {
+	Profiles Profile       // only block groups with one of these profiles
+	Usage    *BalanceRange // usage of a block group, in percents
+	DevID    uint64        // only block groups that have a stripe on this device
+	DRange   *BalanceRange // physical range on DevID
+	VRange   *BalanceRange // range of logical addresses
+	Limit    *BalanceRange // number of block groups to process
+	Stripes  *BalanceRange // number of devices a block group spans
+
+	Convert Profile // convert block groups to this profile
+	Soft    bool    // skip block groups that already have the target profile
+}
+
+func (a *BalanceArgs) toRaw() btrfs_balance_args {
+	var (
+		out   btrfs_balance_args
+		flags balanceArgsFlags
+	)
+	if a.Profiles != 0 {
+		flags |= balanceArgsProfiles
+		out.Profiles = uint64(a.Profiles)
+	}
+	if a.Usage != nil {
+		flags |= balanceArgsUsageRange
+		order.PutUint32(out.Usage[:4], uint32(a.Usage.Min))
+		order.PutUint32(out.Usage[4:], uint32(a.Usage.Max))
+	}
+	if a.DevID != 0 {
+		flags |= balanceArgsDevid
+		out.DevID = a.DevID
+	}
+	if a.DRange != nil {
+		flags |= balanceArgsDrange
+		out.PStart, out.PEnd = a.DRange.Min, a.DRange.Max
+	}
+	if a.VRange != nil {
+		flags |= balanceArgsVrange
+		out.VStart, out.VEnd = a.VRange.Min, a.VRange.Max
+	}
+	if a.Limit != nil {
+		flags |= balanceArgsLimitRange
+		order.PutUint32(out.Limit[:4], uint32(a.Limit.Min))
+		order.PutUint32(out.Limit[4:], uint32(a.Limit.Max))
+	}
+	if a.Stripes != nil {
+		flags |= balanceArgsStripesRange
+		out.StripesMin, out.StripesMax = uint32(a.Stripes.Min), uint32(a.Stripes.Max)
+	}
+	if a.Convert != 0 {
+		flags |= balanceArgsConvert
+		out.Target = uint64(a.Convert)
+	}
+	if a.Soft {
+		flags |= balanceArgsSoft
+	}
+	out.Flags = uint64(flags)
+	return out
+}
+
+// ParseBalanceArgs parses balance filters in the format of btrfs-progs, e.g. "usage=50,limit=10"
+// or "convert=raid1,soft". Ranges are given as "min..max", either of the bounds can be omitted;
+// a single value of usage and limit is the maximum. An empty string selects all block groups.
+func ParseBalanceArgs(s string) (*BalanceArgs, error) {
+	a := &BalanceArgs{}
+	if s == "" {
+		return a, nil
+	}
+	for _, f := range strings.Split(s, ",") {
+		name, val := f, ""
+		if i := strings.IndexByte(f, '='); i >= 0 {
+			name, val = f[:i], f[i+1:]
+		}
+		var err error
+		switch name {
+		case "profiles":
+			for _, ps := range strings.Split(val, "|") {
+				p, err := ParseProfile(ps)
+				if err != nil {
+					return nil, err
+				}
+				a.Profiles |= p
+			}
+		case "usage":
+			a.Usage, err = parseBalanceRange(val, 100, true)
+		case "devid":
+			a.DevID, err = strconv.ParseUint(val, 10, 64)
+		case "drange":
+			a.DRange, err = parseBalanceRange(val, math.MaxUint64, false)
+		case "vrange":
+			a.VRange, err = parseBalanceRange(val, math.MaxUint64, false)
+		case "limit":
+			a.Limit, err = parseBalanceRange(val, math.MaxUint32, true)
+		case "stripes":
+			a.Stripes, err = parseBalanceRange(val, math.MaxUint32, false)
+		case "convert":
+			a.Convert, err = ParseProfile(val)
+		case "soft":
+			a.Soft = true
+		default:
+			return nil, fmt.Errorf("unknown balance filter: %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid balance filter %q: %v", f, err)
+		}
+	}
+	if a.Soft && a.Convert == 0 {
+		return nil, fmt.Errorf("soft filter requires convert")
+	}
+	return a, nil
+}
+
+// parseBalanceRange parses a range "min..max". If single is set, a single value is the maximum.
+func parseBalanceRange(s string, max uint64, single bool) (*BalanceRange, error) {
+	i := strings.Index(s, "..")
+	if i < 0 {
+		if !single {
+			return nil, fmt.Errorf("expected a range")
+		}
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &BalanceRange{Max: v}, nil
+	}
+	r := &BalanceRange{Max: max}
+	var err error
+	if min := s[:i]; min != "" {
+		if r.Min, err = strconv.ParseUint(min, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	if s := s[i+2:]; s != "" {
+		if r.Max, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	if r.Min > r.Max {
+		return nil, fmt.Errorf("invalid range: %d > %d", r.Min, r.Max)
+	}
+	return r, nil
+}
+
+// String formats the filters in the format of btrfs-progs, as accepted by ParseBalanceArgs.
+func (a *BalanceArgs) String() string {
+	var out []string
+	rng := func(name string, r *BalanceRange) {
+		if r != nil {
+			out = append(out, fmt.Sprintf("%s=%d..%d", name, r.Min, r.Max))
+		}
+	}
+	if a.Profiles != 0 {
+		out = append(out, "profiles="+a.Profiles.String())
+	}
+	rng("usage", a.Usage)
+	if a.DevID != 0 {
+		out = append(out, fmt.Sprintf("devid=%d", a.DevID))
+	}
+	rng("drange", a.DRange)
+	rng("vrange", a.VRange)
+	rng("limit", a.Limit)
+	rng("stripes", a.Stripes)
+	if a.Convert != 0 {
+		out = append(out, "convert="+a.Convert.String())
+	}
+	if a.Soft {
+		out = append(out, "soft")
+	}
+	return strings.Join(out, ",")
+}
+
+// BalanceOptions controls which block groups are relocated by the balance.
+// Types of block groups without arguments are not processed. If no types are
+// specified, all block groups are relocated.
+type BalanceOptions struct {
+	Data     *BalanceArgs
+	Metadata *BalanceArgs
+	// System block groups are processed with the same arguments as metadata, if not set.
+	System *BalanceArgs
+	// Force is required to reduce the redundancy of metadata and system block groups.
+	Force bool
+	// SkipChecks disables pre-flight checks for conversions.
+	SkipChecks bool
+}
+
+func (o *BalanceOptions) system() *BalanceArgs {
+	if o.System == nil && o.Metadata != nil {
+		return o.Metadata
+	}
+	return o.System
+}
+
+func (o *BalanceOptions) hasConvert() bool {
+	for _, a := range []*BalanceArgs{o.Data, o.Metadata, o.system()} {
+		if a != nil && a.Convert != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *BalanceOptions) toRaw() btrfs_ioctl_balance_args {
+	var (
+		args  btrfs_ioctl_balance_args
+		flags BalanceFlags
+	)
+	if o.Data != nil {
+		flags |= BalanceData
+		args.Data = o.Data.toRaw()
+	}
+	if o.Metadata != nil {
+		flags |= BalanceMetadata
+		args.Meta = o.Metadata.toRaw()
+	}
+	if sys := o.system(); sys != nil {
+		flags |= BalanceSystem
+		args.Sys = sys.toRaw()
+	}
+	if flags == 0 {
+		flags = BalanceMask
+	}
+	if o.Force {
+		flags |= BalanceForce
+	}
+	args.Flags = uint64(flags)
+	return args
+}
+
+// BalanceStart starts a balance with given filters. Conversions are validated before
+// starting the balance, unless opts.SkipChecks is set.
+//
+// This method blocks until the balance finishes, or is paused or cancelled.
+func (f *FS) BalanceStart(opts BalanceOptions) (BalanceProgress, error) {
+	if opts.hasConvert() && !opts.SkipChecks {
+		if err := f.CheckBalanceConvert(opts); err != nil {
+			return BalanceProgress{}, err
+		}
+	}
+	args := opts.toRaw()
+	err := f.audited("balance", map[string]interface{}{"options": opts}, func() error {
+		return iocBalanceV2(f.f, &args)
+	})
+	return args.Stat, err
+}
+
+// BalancePause pauses a running balance and waits until it stops. The balance is kept
+// by the kernel, and can be continued with BalanceResume, also after a remount.
+// It returns syscall.ENOTCONN if no balance is running.
+func (f *FS) BalancePause() error {
+	return f.audited("balance_pause", nil, func() error {
+		return iocBalanceCtl(f.f, _BTRFS_BALANCE_CTL_PAUSE)
+	})
+}
+
+// BalanceCancel cancels a running or paused balance and waits until it stops.
+// Block groups relocated so far are not moved back.
+// It returns syscall.ENOTCONN if there's no balance.
+func (f *FS) BalanceCancel() error {
+	return f.audited("balance_cancel", nil, func() error {
+		return iocBalanceCtl(f.f, _BTRFS_BALANCE_CTL_CANCEL)
+	})
+}
+
+// BalanceResume continues a paused balance with the same filters it was started with.
+// Same as BalanceStart, it blocks until the balance finishes, or is paused or cancelled.
+// It returns syscall.ENOTCONN if there's no paused balance, and syscall.EINPROGRESS
+// if the balance is already running.
+func (f *FS) BalanceResume() (BalanceProgress, error) {
+	args := btrfs_ioctl_balance_args{Flags: uint64(BalanceResume)}
+	err := f.audited("balance_resume", nil, func() error {
+		return iocBalanceV2(f.f, &args)
+	})
+	return args.Stat, err
+}
+
+// Minimal sizes of a chunk that must be allocated to start the conversion.
+const (
+	minDataChunk = 1024 * 1024 * 1024
+	minMetaChunk = 256 * 1024 * 1024
+	minSysChunk  = 32 * 1024 * 1024
+)
+
+// CheckBalanceConvert validates the conversion requested by the balance options against
+// the number of devices, filesystem features and unallocated space.
+// It returns ErrBalancePreflight describing the first problem found.
+func (f *FS) CheckBalanceConvert(opts BalanceOptions) error {
+	feat, err := f.GetFeatures()
+	if err != nil {
+		return err
+	}
+	supported, err := f.GetSupportedFeatures()
+	if err != nil {
+		return err
+	}
+	devs, err := f.Devices()
+	if err != nil {
+		return err
+	}
+	spaces, err := iocSpaceInfo(f.f)
+	if err != nil {
+		return err
+	}
+	var (
+		mixed = feat.Incompatible&FeatureIncompatMixedGroups != 0
+		zoned = feat.Incompatible&FeatureIncompatZoned != 0
+		rst   = feat.Incompatible&FeatureIncompatRaidStripeTree != 0
+
+		total, allocated uint64
+	)
+	for _, d := range devs {
+		total += d.TotalBytes
+		allocated += d.BytesUsed
+	}
+	check := func(typ string, bg blockGroup, a *BalanceArgs, minChunk uint64) error {
+		if a == nil || a.Convert == 0 {
+			return nil
+		}
+		fail := func(format string, args ...interface{}) error {
+			return ErrBalancePreflight{Type: typ, Profile: a.Convert, Reason: fmt.Sprintf(format, args...)}
+		}
+		pi, ok := a.Convert.info()
+		if !ok {
+			return fail("invalid target profile")
+		}
+		if len(devs) < pi.DevsMin {
+			return fail("requires at least %d devices, filesystem has %d", pi.DevsMin, len(devs))
+		}
+		if (pi.Profile == ProfileRaid1C3 || pi.Profile == ProfileRaid1C4) &&
+			feat.Incompatible&FeatureIncompatRAID1C34 == 0 &&
+			supported.Incompatible&FeatureIncompatRAID1C34 == 0 {
+			return fail("not supported by the kernel")
+		}
+		if zoned {
+			if pi.NParity != 0 {
+				return fail("not supported on zoned filesystems")
+			}
+			if bg&blockGroupData != 0 && !rst && pi.Profile != ProfileSingle && pi.Profile != ProfileDup {
+				return fail("data on zoned filesystems requires the raid-stripe-tree feature")
+			}
+		}
+		// estimate the space required after the conversion
+		var used, raw uint64
+		for _, s := range spaces {
+			sbg := s.Flags.BlockGroup()
+			if sbg&bg == 0 || blockGroup(s.Flags)&spaceInfoGlobalRsv != 0 {
+				continue
+			}
+			ratio := uint64(1)
+			if spi, ok := profileOf(sbg).info(); ok {
+				ratio = uint64(spi.NCopies)
+			}
+			used += s.UsedBytes
+			raw += s.TotalBytes * ratio
+		}
+		if lim := total / 10; minChunk > lim {
+			minChunk = lim
+		}
+		free := make([]uint64, len(devs))
+		after := make([]uint64, len(devs))
+		for i, d := range devs {
+			if d.TotalBytes > d.BytesUsed {
+				free[i] = d.TotalBytes - d.BytesUsed
+			}
+			after[i] = free[i]
+			if allocated != 0 {
+				// assume that relocated chunks are spread proportionally to allocated space
+				after[i] += uint64(float64(raw) * float64(d.BytesUsed) / float64(allocated))
+			}
+		}
+		if avail := profileCapacity(pi, free); avail < minChunk {
+			return fail("not enough unallocated space to allocate a new chunk: %d bytes available, %d needed", avail, minChunk)
+		}
+		if avail := profileCapacity(pi, after); avail < used {
+			return fail("not enough space: %d bytes are used, only %d bytes will be available", used, avail)
+		}
+		return nil
+	}
+	if mixed {
+		if err = checkMixedBalance(opts); err != nil {
+			return err
+		}
+	}
+	if err = check("data", blockGroupData, opts.Data, minDataChunk); err != nil {
+		return err
+	}
+	if err = check("metadata", blockGroupMetadata, opts.Metadata, minMetaChunk); err != nil {
+		return err
+	}
+	return check("system", blockGroupSystem, opts.system(), minSysChunk)
+}
+
+// checkMixedBalance checks that data and metadata are balanced together and with the same
+// arguments, as the kernel requires on filesystems with mixed block groups.
+func checkMixedBalance(opts BalanceOptions) error {
+	d, m := opts.Data, opts.Metadata
+	if d == nil && m == nil {
+		return nil
+	} else if d != nil && m != nil && d.toRaw() == m.toRaw() {
+		return nil
+	}
+	e := ErrBalancePreflight{
+		Type:   "data",
+		Reason: "data and metadata must be balanced with the same arguments on filesystems with mixed block groups",
+	}
+	if d != nil {
+		e.Profile = d.Convert
+	} else {
+		e.Type, e.Profile = "metadata", m.Convert
+	}
+	return e
+}
+
+// profileCapacity estimates the amount of logical bytes that can be allocated with
+// a given profile, if devices have specified amount of free space.
+func profileCapacity(pi profileInfo, free []uint64) uint64 {
+	var sum uint64
+	for _, v := range free {
+		sum += v
+	}
+	switch {
+	case pi.Profile == ProfileSingle:
+		return sum
+	case pi.Profile == ProfileDup:
+		return sum / 2
+	case pi.Profile == ProfileRaid0 || pi.NParity != 0:
+		return stripedCapacity(free, pi.DevsMin, pi.NParity)
+	default:
+		return mirroredCapacity(free, pi.NCopies)
+	}
+}
+
+// stripedCapacity estimates the capacity of a profile that stripes each chunk
+// across all devices with free space.
+func stripedCapacity(free []uint64, devsMin, parity int) uint64 {
+	free = append([]uint64{}, free...)
+	var out uint64
+	for {
+		var (
+			n   int
+			min uint64
+		)
+		for _, v := range free {
+			if v == 0 {
+				continue
+			}
+			n++
+			if min == 0 || v < min {
+				min = v
+			}
+		}
+		if n < devsMin || n <= parity {
+			return out
+		}
+		out += min * uint64(n-parity)
+		for i := range free {
+			if free[i] != 0 {
+				free[i] -= min
+			}
+		}
+	}
+}
+
+// mirroredCapacity estimates the capacity of a profile that stores each chunk
+// on ncopies different devices, by simulating the allocator.
+func mirroredCapacity(free []uint64, ncopies int) uint64 {
+	free = append([]uint64{}, free...)
+	var sum uint64
+	for _, v := range free {
+		sum += v
+	}
+	step := sum/4096 + 1
+	var out uint64
+	for len(free) >= ncopies {
+		sort.Slice(free, func(i, j int) bool { return free[i] > free[j] })
+		n := free[ncopies-1]
+		if n == 0 {
+			break
+		} else if n > step {
+			n = step
+		}
+		for i := 0; i < ncopies; i++ {
+			free[i] -= n
+		}
+		out += n
+	}
+	return out
+}
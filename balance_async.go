@@ -0,0 +1,122 @@
+package btrfs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// BalanceStatus returns the progress and the state of the current balance.
+// It returns syscall.ENOTCONN if there's no balance, neither running nor paused.
+func (f *FS) BalanceStatus() (BalanceProgress, BalanceState, error) {
+	if err := f.revalidate(); err != nil {
+		return BalanceProgress{}, 0, err
+	}
+	var args btrfs_ioctl_balance_args
+	if err := iocBalanceProgress(f.f, &args); err != nil {
+		return BalanceProgress{}, 0, err
+	}
+	return args.Stat, BalanceState(args.State), nil
+}
+
+// BalanceProgressFunc is called with the progress of a balance running in the background.
+type BalanceProgressFunc func(p BalanceProgress)
+
+// balanceProgressInterval is the interval between progress reports of BalanceAsync.
+const balanceProgressInterval = time.Second
+
+// BalanceHandle is a balance running in the background, see BalanceAsync.
+type BalanceHandle struct {
+	done chan struct{}
+
+	mu   sync.Mutex
+	last BalanceProgress // progress at the end of the balance
+	err  error
+}
+
+// BalanceAsync starts a balance with given filters in the background and returns immediately.
+// The progress is reported to the callback every second and once more when the balance stops.
+// The callback is called from a separate goroutine and can be nil.
+//
+// If the context is canceled, the balance is canceled as well and Wait returns ctx.Err().
+// Conversions are validated before starting, same as in BalanceStart. It fails if a balance
+// is already running or paused.
+func (f *FS) BalanceAsync(ctx context.Context, opts BalanceOptions, progress BalanceProgressFunc) (*BalanceHandle, error) {
+	if err := f.revalidate(); err != nil {
+		return nil, err
+	}
+	if _, _, err := f.BalanceStatus(); err == nil {
+		return nil, fmt.Errorf("balance: %v", syscall.EINPROGRESS)
+	} else if err != syscall.ENOTCONN {
+		return nil, err
+	}
+	if opts.hasConvert() && !opts.SkipChecks {
+		if err := f.CheckBalanceConvert(opts); err != nil {
+			return nil, err
+		}
+		opts.SkipChecks = true
+	}
+	h := &BalanceHandle{done: make(chan struct{})}
+	var (
+		stopped = make(chan struct{}) // balance ioctl returned
+		polled  = make(chan struct{}) // progress is no longer polled
+	)
+	go func() {
+		defer close(h.done)
+		p, err := f.BalanceStart(opts)
+		close(stopped)
+		if err == syscall.ECANCELED && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		h.mu.Lock()
+		h.last, h.err = p, err
+		h.mu.Unlock()
+		<-polled
+		if progress != nil {
+			progress(p)
+		}
+	}()
+	go func() {
+		defer close(polled)
+		t := time.NewTicker(balanceProgressInterval)
+		defer t.Stop()
+		canceled := ctx.Done()
+		for {
+			select {
+			case <-stopped:
+				return
+			case <-canceled:
+				f.BalanceCancel()
+				canceled = nil
+			case <-t.C:
+				if ctx.Err() != nil {
+					// the kernel might not have started the balance before, retry until it stops
+					f.BalanceCancel()
+					continue
+				} else if progress == nil {
+					continue
+				}
+				if p, _, err := f.BalanceStatus(); err == nil {
+					progress(p)
+				}
+			}
+		}
+	}()
+	return h, nil
+}
+
+// Done returns a channel that is closed when the balance stops.
+func (h *BalanceHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait blocks until the balance stops and returns its final progress and error.
+// A paused balance returns syscall.ECANCELED, same as one canceled by BalanceCancel.
+func (h *BalanceHandle) Wait() (BalanceProgress, error) {
+	<-h.done
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.last, h.err
+}
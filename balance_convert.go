@@ -0,0 +1,98 @@
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// ConvertProfile converts data and metadata block groups to given profiles, e.g. "raid1".
+// An empty profile leaves block groups of that type as they are. System block groups are
+// converted together with metadata. It blocks until the conversion finishes.
+//
+// The target profiles are validated against the number of devices and the free space first,
+// see CheckBalanceConvert. Data and metadata are then converted by separate balances that skip
+// block groups already having the target profile, thus an interrupted conversion can be repeated.
+// On filesystems with mixed block groups both profiles must be the same, and they are converted
+// by a single balance.
+// After each balance, block groups are checked for leftovers with other profiles.
+// Errors are returned as ErrConvert, which names the failed phase.
+//
+// Redundancy of metadata is never reduced, since the kernel requires BalanceOptions.Force for it.
+func (f *FS) ConvertProfile(data, metadata string) error {
+	var (
+		opts BalanceOptions
+		err  error
+	)
+	parse := func(s string) (*BalanceArgs, error) {
+		if s == "" {
+			return nil, nil
+		}
+		p, err := ParseProfile(s)
+		if err != nil {
+			return nil, err
+		}
+		return &BalanceArgs{Convert: p, Soft: true}, nil
+	}
+	if opts.Data, err = parse(data); err != nil {
+		return ErrConvert{Phase: "check", Err: err}
+	} else if opts.Metadata, err = parse(metadata); err != nil {
+		return ErrConvert{Phase: "check", Err: err}
+	} else if opts.Data == nil && opts.Metadata == nil {
+		return ErrConvert{Phase: "check", Err: errors.New("no target profiles")}
+	}
+	if _, _, err = f.BalanceStatus(); err == nil {
+		return ErrConvert{Phase: "check", Err: fmt.Errorf("balance: %v", syscall.EINPROGRESS)}
+	} else if err != syscall.ENOTCONN {
+		return ErrConvert{Phase: "check", Err: err}
+	}
+	if err = f.CheckBalanceConvert(opts); err != nil {
+		return ErrConvert{Phase: "check", Err: err}
+	}
+	type phase struct {
+		name string
+		typ  BlockGroupType
+		opts BalanceOptions
+		args *BalanceArgs
+	}
+	phases := []phase{
+		{"data", BlockGroupData, BalanceOptions{Data: opts.Data}, opts.Data},
+		{"metadata", BlockGroupMetadata | BlockGroupSystem, BalanceOptions{Metadata: opts.Metadata}, opts.Metadata},
+	}
+	feat, err := f.GetFeatures()
+	if err != nil {
+		return ErrConvert{Phase: "check", Err: err}
+	} else if feat.Incompatible&FeatureIncompatMixedGroups != 0 {
+		// the kernel rejects separate data and metadata balances; the check above
+		// made sure that both profiles are the same
+		phases = []phase{{"data", BlockGroupData | BlockGroupMetadata | BlockGroupSystem, opts, opts.Data}}
+	}
+	for _, ph := range phases {
+		if ph.args == nil {
+			continue
+		}
+		ph.opts.SkipChecks = true
+		if _, err = f.BalanceStart(ph.opts); err != nil {
+			return ErrConvert{Phase: ph.name, Err: err}
+		}
+		bgs, err := f.BlockGroups()
+		if err != nil {
+			return ErrConvert{Phase: ph.name, Err: err}
+		}
+		if n := unconverted(bgs, ph.typ, ph.args.Convert); n != 0 {
+			return ErrConvert{Phase: ph.name, Err: fmt.Errorf("%d block groups were not converted to %v", n, ph.args.Convert)}
+		}
+	}
+	return nil
+}
+
+// unconverted returns the number of block groups of given types that don't have the target profile.
+func unconverted(bgs []BlockGroup, typ BlockGroupType, p Profile) int {
+	n := 0
+	for _, bg := range bgs {
+		if bg.Type&typ != 0 && bg.Profile != p {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,128 @@
+package btrfs
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// BalanceEventType is a kind of event reported by MonitorBalance.
+type BalanceEventType int
+
+const (
+	// BalanceEventStarted is reported when a balance appears, including one that was
+	// running or paused when the monitor started, or resumed by the kernel after mount.
+	BalanceEventStarted BalanceEventType = iota
+	BalanceEventProgress
+	BalanceEventPaused
+	BalanceEventResumed
+	// BalanceEventFinished is reported when the balance is gone. Err is syscall.ECANCELED
+	// if it was paused or being canceled at the last poll, otherwise it was completed, failed,
+	// or canceled between the polls; the result is only known to the process that ran it.
+	BalanceEventFinished
+	// BalanceEventError is reported when the state cannot be read. The monitor stops after it.
+	BalanceEventError
+)
+
+func (t BalanceEventType) String() string {
+	switch t {
+	case BalanceEventStarted:
+		return "started"
+	case BalanceEventProgress:
+		return "progress"
+	case BalanceEventPaused:
+		return "paused"
+	case BalanceEventResumed:
+		return "resumed"
+	case BalanceEventFinished:
+		return "finished"
+	case BalanceEventError:
+		return "error"
+	}
+	return fmt.Sprintf("BalanceEventType(%d)", int(t))
+}
+
+// BalanceEvent is a change of the balance state reported by MonitorBalance.
+type BalanceEvent struct {
+	Type     BalanceEventType
+	Progress BalanceProgress // last known progress
+	State    BalanceState
+	Err      error
+}
+
+// BalanceMonitorFunc is called by MonitorBalance for each event.
+type BalanceMonitorFunc func(e BalanceEvent)
+
+// balanceSample is the balance state at some point; found is false if there's no balance.
+type balanceSample struct {
+	found bool
+	p     BalanceProgress
+	state BalanceState
+}
+
+// MonitorBalance polls the balance state at given interval, one second if it's zero, and reports
+// the changes to the callback until the context is canceled. It doesn't start or stop balances,
+// so it can watch the ones started by other processes, e.g. to avoid overlapping maintenance.
+// Progress is reported on each poll while a balance is running.
+//
+// The callback is called from the calling goroutine. It returns ctx.Err() when the context
+// is canceled, or the error that was reported as BalanceEventError.
+func (f *FS) MonitorBalance(ctx context.Context, interval time.Duration, fn BalanceMonitorFunc) error {
+	if interval <= 0 {
+		interval = balanceProgressInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var prev balanceSample
+	for {
+		cur := balanceSample{}
+		p, state, err := f.BalanceStatus()
+		if err == nil {
+			cur = balanceSample{found: true, p: p, state: state}
+		} else if err != syscall.ENOTCONN {
+			fn(BalanceEvent{Type: BalanceEventError, Progress: prev.p, State: prev.state, Err: err})
+			return err
+		}
+		for _, e := range balanceEvents(prev, cur) {
+			fn(e)
+		}
+		prev = cur
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// balanceEvents returns the events describing a change from prev to cur.
+func balanceEvents(prev, cur balanceSample) []BalanceEvent {
+	running := func(s balanceSample) bool {
+		return s.found && s.state&BalanceStateRunning != 0
+	}
+	switch {
+	case !prev.found && !cur.found:
+		return nil
+	case !prev.found:
+		e := []BalanceEvent{{Type: BalanceEventStarted, Progress: cur.p, State: cur.state}}
+		if !running(cur) {
+			e = append(e, BalanceEvent{Type: BalanceEventPaused, Progress: cur.p, State: cur.state})
+		}
+		return e
+	case !cur.found:
+		e := BalanceEvent{Type: BalanceEventFinished, Progress: prev.p, State: prev.state}
+		// a paused balance cannot complete without being resumed first
+		if prev.state&BalanceStateCancelReq != 0 || !running(prev) {
+			e.Err = syscall.ECANCELED
+		}
+		return []BalanceEvent{e}
+	case running(prev) && !running(cur):
+		return []BalanceEvent{{Type: BalanceEventPaused, Progress: cur.p, State: cur.state}}
+	case !running(prev) && running(cur):
+		return []BalanceEvent{{Type: BalanceEventResumed, Progress: cur.p, State: cur.state}}
+	case running(cur):
+		return []BalanceEvent{{Type: BalanceEventProgress, Progress: cur.p, State: cur.state}}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package btrfs
+
+import "sort"
+
+// BalancePlan is an estimate of the work done by a balance, see PlanBalance.
+type BalancePlan struct {
+	// BlockGroups that would be relocated, in the order of relocation (from the highest address).
+	BlockGroups []BlockGroup
+	Length      uint64 // total length of the block groups
+	Used        uint64 // bytes that would be copied
+}
+
+// PlanBalance finds block groups that a balance with given options would relocate, without
+// starting it. Filters are applied to the chunk tree the same way as the kernel does, thus the
+// plan is exact unless the filesystem changes before the balance. Balance takes time proportional
+// to the number of used bytes, which can be compared with a previous balance to estimate it.
+// Requires CAP_SYS_ADMIN.
+func (f *FS) PlanBalance(opts BalanceOptions) (*BalancePlan, error) {
+	chunks, err := f.chunks(blockGroupData | blockGroupMetadata | blockGroupSystem)
+	if err != nil {
+		return nil, err
+	}
+	bgs, err := f.BlockGroups()
+	if err != nil {
+		return nil, err
+	}
+	return planBalance(opts, chunks, bgs), nil
+}
+
+// planBalance applies balance filters to chunks, as should_balance_chunk in the kernel.
+func planBalance(opts BalanceOptions, chunks []chunk, bgs []BlockGroup) *BalancePlan {
+	used := make(map[uint64]uint64, len(bgs))
+	for _, bg := range bgs {
+		used[bg.Start] = bg.Used
+	}
+	// the kernel uses separate limits for each type, and picks arguments by the first matching type
+	args := [3]*BalanceArgs{opts.Data, opts.system(), opts.Metadata}
+	types := [3]blockGroup{blockGroupData, blockGroupSystem, blockGroupMetadata}
+	var sel blockGroup
+	for i, a := range args {
+		if a != nil {
+			sel |= types[i]
+		}
+	}
+	if sel == 0 {
+		sel = blockGroupData | blockGroupMetadata | blockGroupSystem
+	}
+	sorted := make([]chunk, len(chunks))
+	copy(sorted, chunks)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].start > sorted[j].start
+	})
+	var matched [3][]BlockGroup
+	for _, c := range sorted {
+		if c.typ&sel == 0 {
+			continue
+		}
+		i := 0
+		for i < len(types)-1 && c.typ&types[i] == 0 {
+			i++
+		}
+		bg := BlockGroup{
+			Start:   c.start,
+			Length:  c.length,
+			Used:    used[c.start],
+			Type:    BlockGroupType(c.typ & (blockGroupData | blockGroupMetadata | blockGroupSystem)),
+			Profile: profileOf(c.typ),
+		}
+		if a := args[i]; a != nil {
+			if !a.matches(c, bg.Used) {
+				continue
+			} else if a.Limit != nil && uint64(len(matched[i])) >= a.Limit.Max {
+				continue
+			}
+		}
+		matched[i] = append(matched[i], bg)
+	}
+	p := &BalancePlan{}
+	for i, list := range matched {
+		if a := args[i]; a != nil && a.Limit != nil && uint64(len(list)) < a.Limit.Min {
+			continue
+		}
+		p.BlockGroups = append(p.BlockGroups, list...)
+	}
+	sort.Slice(p.BlockGroups, func(i, j int) bool {
+		return p.BlockGroups[i].Start > p.BlockGroups[j].Start
+	})
+	for _, bg := range p.BlockGroups {
+		p.Length += bg.Length
+		p.Used += bg.Used
+	}
+	return p
+}
+
+// matches checks if a chunk passes the filters, except the limit.
+func (a *BalanceArgs) matches(c chunk, used uint64) bool {
+	p := profileOf(c.typ)
+	if a.Profiles != 0 && a.Profiles&p == 0 {
+		return false
+	}
+	if a.Usage != nil && !usageInRange(used, c.length, *a.Usage) {
+		return false
+	}
+	if a.DevID != 0 {
+		found := false
+		for _, s := range c.stripes {
+			found = found || s.devid == a.DevID
+		}
+		if !found {
+			return false
+		}
+		if a.DRange != nil && !c.inDRange(a.DevID, *a.DRange) {
+			return false
+		}
+	}
+	if a.VRange != nil && (c.start >= a.VRange.Max || c.start+c.length <= a.VRange.Min) {
+		return false
+	}
+	if n := uint64(len(c.stripes)); a.Stripes != nil && (n < a.Stripes.Min || n > a.Stripes.Max) {
+		return false
+	}
+	if a.Convert != 0 && a.Soft && p == a.Convert {
+		return false
+	}
+	return true
+}
+
+// inDRange checks if a stripe of the chunk on a device overlaps the physical range.
+func (c *chunk) inDRange(dev uint64, r BalanceRange) bool {
+	pi, _ := profileOf(c.typ).info()
+	n := uint64(len(c.stripes))
+	if pi.NCopies != 0 && n > uint64(pi.NParity) {
+		n = (n - uint64(pi.NParity)) / uint64(pi.NCopies)
+	}
+	if n == 0 {
+		n = 1
+	}
+	length := c.length / n
+	for _, s := range c.stripes {
+		if s.devid == dev && s.offset < r.Max && s.offset+length > r.Min {
+			return true
+		}
+	}
+	return false
+}
+
+// usageInRange checks if a block group is relocated by a "usage=min..max" filter,
+// as implemented by chunk_usage_range_filter in the kernel.
+func usageInRange(used, length uint64, r BalanceRange) bool {
+	min, max := uint64(0), uint64(1)
+	if r.Min != 0 {
+		min = length * r.Min / 100
+	}
+	if r.Max > 100 {
+		max = length
+	} else if r.Max != 0 {
+		max = length * r.Max / 100
+	}
+	return min <= used && used < max
+}
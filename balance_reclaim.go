@@ -0,0 +1,85 @@
+package btrfs
+
+import "context"
+
+// QuickBalanceUsage is the usage filter of QuickBalance, in percent.
+const QuickBalanceUsage = 5
+
+// reclaimSteps are usage filters tried by ReclaimSpace, from the cheapest one.
+var reclaimSteps = []uint64{QuickBalanceUsage, 10, 20, 30, 50, 75}
+
+// UsageBalance returns balance options that relocate data and metadata block groups
+// used less than given percent, same as "-dusage=N -musage=N" in btrfs-progs.
+func UsageBalance(usage uint64) BalanceOptions {
+	return BalanceOptions{
+		Data:     &BalanceArgs{Usage: &BalanceRange{Max: usage}},
+		Metadata: &BalanceArgs{Usage: &BalanceRange{Max: usage}},
+	}
+}
+
+// QuickBalance returns balance options that reclaim nearly empty block groups,
+// the cheapest balance that helps with running out of unallocated space.
+func QuickBalance() BalanceOptions {
+	return UsageBalance(QuickBalanceUsage)
+}
+
+// ReclaimStep is a balance run by ReclaimSpace.
+type ReclaimStep struct {
+	Usage       uint64 // usage filter, in percent
+	Progress    BalanceProgress
+	Unallocated uint64 // unallocated raw space after the balance
+}
+
+// ReclaimResult describes balances run by ReclaimSpace.
+type ReclaimResult struct {
+	Unallocated uint64 // unallocated raw space before the first balance
+	Steps       []ReclaimStep
+}
+
+// Freed returns the unallocated raw space gained by the balances.
+func (r *ReclaimResult) Freed() uint64 {
+	if len(r.Steps) == 0 {
+		return 0
+	}
+	last := r.Steps[len(r.Steps)-1].Unallocated
+	if last < r.Unallocated {
+		return 0
+	}
+	return last - r.Unallocated
+}
+
+// ReclaimSpace runs usage balances with escalating thresholds, starting with QuickBalance,
+// until at least free bytes of raw space become unallocated. If free is zero, all thresholds
+// are tried. The callback is called after each balance and can be nil.
+//
+// The balances are canceled with the context. The result describes the balances that
+// were run, even if an error is returned.
+func (f *FS) ReclaimSpace(ctx context.Context, free uint64, fn func(s ReclaimStep)) (*ReclaimResult, error) {
+	u, err := f.Usage()
+	if err != nil {
+		return nil, err
+	}
+	r := &ReclaimResult{Unallocated: u.TotalUnused}
+	for _, usage := range reclaimSteps {
+		h, err := f.BalanceAsync(ctx, UsageBalance(usage), nil)
+		if err != nil {
+			return r, err
+		}
+		p, err := h.Wait()
+		if err != nil {
+			return r, err
+		}
+		if u, err = f.Usage(); err != nil {
+			return r, err
+		}
+		s := ReclaimStep{Usage: usage, Progress: p, Unallocated: u.TotalUnused}
+		r.Steps = append(r.Steps, s)
+		if fn != nil {
+			fn(s)
+		}
+		if free != 0 && r.Freed() >= free {
+			break
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,171 @@
+package btrfs
+
+import (
+	"fmt"
+	"sort"
+)
+
+// BalanceRecommendation is a minimal set of balance filters that is expected to
+// relieve allocation pressure. See RecommendBalance.
+type BalanceRecommendation struct {
+	Unallocated uint64 // current unallocated raw space
+	Goal        uint64 // desired unallocated raw space
+
+	// Data and Metadata are the recommended filters, nil if the block groups
+	// of this type should not be balanced.
+	Data     *BalanceArgs
+	Metadata *BalanceArgs
+
+	Chunks  int    // number of block groups that will be relocated
+	Reclaim uint64 // estimated raw space that will become unallocated
+	// Sufficient is set if the balance is expected to reach the goal.
+	Sufficient bool
+}
+
+// Needed reports if a balance is recommended at all.
+func (r *BalanceRecommendation) Needed() bool {
+	return r.Data != nil || r.Metadata != nil
+}
+
+// Options returns balance options to run the recommended balance.
+func (r *BalanceRecommendation) Options() BalanceOptions {
+	return BalanceOptions{Data: r.Data, Metadata: r.Metadata}
+}
+
+// Args returns the recommended filters in the format of btrfs-progs, e.g. "-dusage=15".
+func (r *BalanceRecommendation) Args() []string {
+	var out []string
+	if r.Data != nil {
+		out = append(out, fmt.Sprintf("-dusage=%d", r.Data.Usage.Max))
+	}
+	if r.Metadata != nil {
+		out = append(out, fmt.Sprintf("-musage=%d", r.Metadata.Usage.Max))
+	}
+	return out
+}
+
+// usageSteps are usage filter values tried by RecommendBalance, from the cheapest one.
+var usageSteps = []uint64{0, 5, 10, 15, 20, 25, 30, 40, 50, 60, 70, 80, 90}
+
+// RecommendBalance inspects the usage of block groups and unallocated space and
+// returns the smallest usage filters expected to bring unallocated space up to goal.
+// If goal is zero, 5% of the filesystem size (but at least 2 GiB) is used.
+//
+// Data block groups are preferred, since relocating metadata is more expensive.
+// It requires CAP_SYS_ADMIN.
+func (f *FS) RecommendBalance(goal uint64) (*BalanceRecommendation, error) {
+	u, err := f.Usage()
+	if err != nil {
+		return nil, err
+	}
+	bgs, err := f.BlockGroups()
+	if err != nil {
+		return nil, err
+	}
+	if goal == 0 {
+		goal = u.Total / 20
+		if goal < 2*minDataChunk {
+			goal = 2 * minDataChunk
+		}
+	}
+	return recommendBalance(bgs, u, goal), nil
+}
+
+// usageCandidate estimates the effect of a balance with a usage filter.
+type usageCandidate struct {
+	usage   uint64
+	chunks  int
+	reclaim uint64 // raw bytes
+}
+
+// usageCandidates estimates the effect of each usage step on block groups of a given type.
+func usageCandidates(bgs []BlockGroup, typ BlockGroupType, ratio float64) []usageCandidate {
+	var list []BlockGroup
+	for _, bg := range bgs {
+		// mixed block groups are matched by both data and metadata filters
+		if bg.Type&typ != 0 && bg.Type&BlockGroupSystem == 0 {
+			list = append(list, bg)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Usage() < list[j].Usage()
+	})
+	if ratio < 1 {
+		ratio = 1
+	}
+	out := make([]usageCandidate, 0, len(usageSteps))
+	for _, step := range usageSteps {
+		c := usageCandidate{usage: step}
+		var length, used uint64
+		for _, bg := range list {
+			if !matchesUsage(bg, step) {
+				break
+			}
+			c.chunks++
+			length += bg.Length
+			used += bg.Used
+		}
+		if c.chunks == 0 {
+			continue
+		}
+		// used data is compacted into new block groups of the same size
+		avg := length / uint64(c.chunks)
+		if need := (used + avg - 1) / avg * avg; need < length {
+			c.reclaim = uint64(float64(length-need) * ratio)
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// matchesUsage reports if a block group is relocated by a "usage=max" filter,
+// as implemented by chunk_usage_range_filter in the kernel.
+func matchesUsage(bg BlockGroup, max uint64) bool {
+	thresh := uint64(1)
+	if max != 0 {
+		thresh = uint64(float64(bg.Length) * float64(max) / 100)
+	}
+	return bg.Used < thresh
+}
+
+// pickCandidate returns the cheapest candidate that reclaims at least need bytes.
+// If there is no such candidate, the one that reclaims the most is returned.
+func pickCandidate(cands []usageCandidate, need uint64) (usageCandidate, bool) {
+	var best usageCandidate
+	for _, c := range cands {
+		if c.reclaim >= need {
+			return c, true
+		} else if c.reclaim > best.reclaim {
+			best = c
+		}
+	}
+	return best, false
+}
+
+func recommendBalance(bgs []BlockGroup, u UsageInfo, goal uint64) *BalanceRecommendation {
+	r := &BalanceRecommendation{Unallocated: u.TotalUnused, Goal: goal}
+	if u.TotalUnused >= goal {
+		r.Sufficient = true
+		return r
+	}
+	need := goal - u.TotalUnused
+	set := func(c usageCandidate) *BalanceArgs {
+		r.Chunks += c.chunks
+		r.Reclaim += c.reclaim
+		return &BalanceArgs{Usage: &BalanceRange{Min: 0, Max: c.usage}}
+	}
+	data, ok := pickCandidate(usageCandidates(bgs, BlockGroupData, u.DataRatio), need)
+	if data.reclaim != 0 {
+		r.Data = set(data)
+	}
+	if ok {
+		r.Sufficient = true
+		return r
+	}
+	meta, ok := pickCandidate(usageCandidates(bgs, BlockGroupMetadata, u.MetadataRatio), need-r.Reclaim)
+	if meta.reclaim != 0 {
+		r.Metadata = set(meta)
+	}
+	r.Sufficient = ok
+	return r
+}
@@ -0,0 +1,98 @@
+package btrfs
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// BalanceRunState describes whether a balance exists on a filesystem, see FS.BalanceState.
+type BalanceRunState int
+
+const (
+	// BalanceNone means there's no balance on the filesystem.
+	BalanceNone BalanceRunState = iota
+	// BalanceRunning means the balance is running, possibly resumed by the kernel after mount.
+	BalanceRunning
+	// BalancePaused means the balance was paused, or the filesystem was mounted with skip_balance.
+	// It stays paused until BalanceResume or BalanceCancel is called.
+	BalancePaused
+	// BalancePendingResume means an interrupted balance is recorded on disk, but the kernel
+	// has not resumed it yet: the filesystem is mounted read-only. The balance is resumed
+	// when the filesystem is mounted read-write without skip_balance.
+	BalancePendingResume
+)
+
+func (s BalanceRunState) String() string {
+	switch s {
+	case BalanceNone:
+		return "none"
+	case BalanceRunning:
+		return "running"
+	case BalancePaused:
+		return "paused"
+	case BalancePendingResume:
+		return "pending resume"
+	}
+	return fmt.Sprintf("BalanceRunState(%d)", int(s))
+}
+
+// stRdonly is the flag of read-only mounts returned by statfs.
+const stRdonly = 0x1
+
+// BalanceState checks if there's a balance on the filesystem, so that automation does not
+// try to start another one. Besides the state reported by the kernel, it looks for the balance
+// item in the root tree, which keeps an interrupted balance until it's resumed at mount.
+// Requires CAP_SYS_ADMIN.
+func (f *FS) BalanceState() (BalanceRunState, error) {
+	if err := f.revalidate(); err != nil {
+		return BalanceNone, err
+	}
+	_, state, err := f.BalanceStatus()
+	if err != nil && err != syscall.ENOTCONN {
+		return BalanceNone, err
+	}
+	loaded := err == nil
+	if loaded && state&BalanceStateRunning != 0 {
+		return BalanceRunning, nil
+	}
+	_, found, err := firstObjectID(f.f, btrfs_ioctl_search_key{
+		TreeID:      uint64(rootTreeObjectid),
+		MinObjectID: uint64(balanceObjectid),
+		MaxObjectID: uint64(balanceObjectid),
+		MinType:     uint32(balanceItemKey),
+		MaxType:     uint32(balanceItemKey),
+		MaxOffset:   maxUint64,
+		MaxTransID:  maxUint64,
+	})
+	if err != nil {
+		return BalanceNone, err
+	}
+	readOnly := false
+	if loaded {
+		var stfs syscall.Statfs_t
+		if err = syscall.Fstatfs(int(f.f.Fd()), &stfs); err != nil {
+			return BalanceNone, &os.PathError{Op: "statfs", Path: f.f.Name(), Err: err}
+		}
+		readOnly = stfs.Flags&stRdonly != 0
+	}
+	return balanceRunState(state, loaded, found, readOnly), nil
+}
+
+// balanceRunState derives the balance state from the state reported by the kernel, if the
+// balance is loaded, and from the presence of the balance item in the root tree.
+func balanceRunState(state BalanceState, loaded, found, readOnly bool) BalanceRunState {
+	if !loaded {
+		if found {
+			return BalancePendingResume
+		}
+		return BalanceNone
+	} else if state&BalanceStateRunning != 0 {
+		return BalanceRunning
+	}
+	// the kernel loads an interrupted balance as paused until it's resumed at read-write mount
+	if found && readOnly {
+		return BalancePendingResume
+	}
+	return BalancePaused
+}
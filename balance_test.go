@@ -0,0 +1,359 @@
+package btrfs
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+const gib = 1024 * 1024 * 1024
+
+var profileCapacityCases = []struct {
+	profile Profile
+	free    []uint64
+	exp     uint64
+}{
+	{ProfileSingle, []uint64{10 * gib, 5 * gib}, 15 * gib},
+	{ProfileDup, []uint64{10 * gib}, 5 * gib},
+	{ProfileRaid0, []uint64{10 * gib, 5 * gib}, 15 * gib},
+	{ProfileRaid1, []uint64{10 * gib, 5 * gib}, 5 * gib},
+	{ProfileRaid1, []uint64{10 * gib, 5 * gib, 5 * gib}, 10 * gib},
+	{ProfileRaid1C3, []uint64{10 * gib, 10 * gib}, 0},
+	{ProfileRaid5, []uint64{10 * gib, 10 * gib, 10 * gib}, 20 * gib},
+	{ProfileRaid6, []uint64{10 * gib, 10 * gib, 5 * gib}, 5 * gib},
+}
+
+func TestProfileCapacity(t *testing.T) {
+	for _, c := range profileCapacityCases {
+		pi, ok := c.profile.info()
+		if !ok {
+			t.Fatalf("no info for %v", c.profile)
+		}
+		got := profileCapacity(pi, c.free)
+		// mirrored profiles are simulated in steps, allow a small error
+		if got > c.exp || c.exp-got > c.exp/100 {
+			t.Errorf("%v %v: expected %d, got %d", c.profile, c.free, c.exp, got)
+		}
+	}
+}
+
+func TestParseProfile(t *testing.T) {
+	for _, pi := range profileInfos {
+		p, err := ParseProfile(pi.Name)
+		if err != nil {
+			t.Fatal(err)
+		} else if p != pi.Profile {
+			t.Fatalf("%s: unexpected profile: %v", pi.Name, p)
+		} else if s := p.String(); s != pi.Name {
+			t.Fatalf("unexpected name: %q vs %q", s, pi.Name)
+		}
+	}
+	if s := (ProfileRaid1 | ProfileDup).String(); s != "dup|raid1" {
+		t.Fatalf("unexpected name: %q", s)
+	}
+	if _, err := ParseProfile("raid7"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestRecommendBalance(t *testing.T) {
+	var bgs []BlockGroup
+	for i, used := range []uint64{0, gib / 10, gib / 10, gib / 2, gib} {
+		bgs = append(bgs, BlockGroup{
+			Start: uint64(i) * gib, Length: gib, Used: used,
+			Type: BlockGroupData, Profile: ProfileSingle,
+		})
+	}
+	bgs = append(bgs, BlockGroup{Start: 5 * gib, Length: gib / 4, Used: gib / 100, Type: BlockGroupMetadata, Profile: ProfileDup})
+	u := UsageInfo{TotalUnused: gib / 2, DataRatio: 1, MetadataRatio: 2}
+
+	r := recommendBalance(bgs, u, gib/4)
+	if r.Needed() || !r.Sufficient {
+		t.Fatalf("unexpected recommendation: %+v", r)
+	}
+	r = recommendBalance(bgs, u, gib+gib/2)
+	if !r.Sufficient || r.Metadata != nil || r.Data == nil || r.Data.Usage.Max != 0 || r.Chunks != 1 {
+		t.Fatalf("unexpected recommendation: %+v", r)
+	}
+	r = recommendBalance(bgs, u, 2*gib+gib/2)
+	if !r.Sufficient || r.Data == nil || r.Data.Usage.Max != 15 || r.Chunks != 3 {
+		t.Fatalf("unexpected recommendation: %+v", r)
+	}
+	if args := r.Args(); len(args) != 1 || args[0] != "-dusage=15" {
+		t.Fatalf("unexpected args: %q", args)
+	}
+	r = recommendBalance(bgs, u, 10*gib)
+	if r.Sufficient || r.Data == nil || r.Metadata != nil {
+		t.Fatalf("unexpected recommendation: %+v", r)
+	}
+}
+
+func TestParseBalanceArgs(t *testing.T) {
+	for _, c := range []struct {
+		in, out string
+	}{
+		{"", ""},
+		{"usage=50", "usage=0..50"},
+		{"usage=10..", "usage=10..100"},
+		{"profiles=raid1|single,devid=2,limit=5", "profiles=single|raid1,devid=2,limit=0..5"},
+		{"drange=1048576..2097152,stripes=2..4", "drange=1048576..2097152,stripes=2..4"},
+		{"convert=raid1,soft", "convert=raid1,soft"},
+	} {
+		a, err := ParseBalanceArgs(c.in)
+		if err != nil {
+			t.Fatalf("%q: %v", c.in, err)
+		} else if s := a.String(); s != c.out {
+			t.Fatalf("%q: unexpected filters: %q vs %q", c.in, s, c.out)
+		}
+		b, err := ParseBalanceArgs(c.out)
+		if err != nil {
+			t.Fatalf("%q: %v", c.out, err)
+		} else if b.String() != c.out {
+			t.Fatalf("%q: unexpected filters after round trip: %q", c.out, b.String())
+		}
+	}
+	for _, s := range []string{"usage=x", "stripes=2", "usage=50..10", "soft", "convert=raid7", "foo=1"} {
+		if _, err := ParseBalanceArgs(s); err == nil {
+			t.Fatalf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestUnconverted(t *testing.T) {
+	bgs := []BlockGroup{
+		{Type: BlockGroupData, Profile: ProfileRaid1},
+		{Type: BlockGroupData, Profile: ProfileSingle},
+		{Type: BlockGroupMetadata, Profile: ProfileDup},
+		{Type: BlockGroupSystem, Profile: ProfileRaid1},
+		{Type: BlockGroupData | BlockGroupMetadata, Profile: ProfileSingle},
+	}
+	if n := unconverted(bgs, BlockGroupData, ProfileRaid1); n != 2 {
+		t.Fatalf("unexpected data block groups: %d", n)
+	}
+	if n := unconverted(bgs, BlockGroupMetadata|BlockGroupSystem, ProfileRaid1); n != 2 {
+		t.Fatalf("unexpected metadata block groups: %d", n)
+	}
+}
+
+func TestCheckMixedBalance(t *testing.T) {
+	raid1 := &BalanceArgs{Convert: ProfileRaid1, Soft: true}
+	for _, c := range []struct {
+		opts BalanceOptions
+		ok   bool
+	}{
+		{BalanceOptions{}, true},
+		{BalanceOptions{Data: raid1, Metadata: raid1}, true},
+		{BalanceOptions{Data: raid1, Metadata: &BalanceArgs{Convert: ProfileRaid1, Soft: true}}, true},
+		{BalanceOptions{Data: raid1}, false},
+		{BalanceOptions{Metadata: raid1}, false},
+		{BalanceOptions{Data: raid1, Metadata: &BalanceArgs{Convert: ProfileDup, Soft: true}}, false},
+		{BalanceOptions{Data: raid1, Metadata: &BalanceArgs{Convert: ProfileRaid1}}, false},
+		{BalanceOptions{Data: &BalanceArgs{Usage: &BalanceRange{Max: 50}}, Metadata: &BalanceArgs{Usage: &BalanceRange{Max: 50}}}, true},
+	} {
+		err := checkMixedBalance(c.opts)
+		if _, isPreflight := err.(ErrBalancePreflight); c.ok && err != nil {
+			t.Errorf("%+v: unexpected error: %v", c.opts, err)
+		} else if !c.ok && !isPreflight {
+			t.Errorf("%+v: expected a preflight error, got %v", c.opts, err)
+		}
+	}
+}
+
+func TestBalanceControl(t *testing.T) {
+	dir, err := os.Open(os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	defer func(ctl func(*os.File, int32) error, bal func(*os.File, *btrfs_ioctl_balance_args) error) {
+		iocBalanceCtl, iocBalanceV2 = ctl, bal
+	}(iocBalanceCtl, iocBalanceV2)
+	var cmds []int32
+	iocBalanceCtl = func(_ *os.File, cmd int32) error {
+		cmds = append(cmds, cmd)
+		if len(cmds) > 2 {
+			return syscall.ENOTCONN
+		}
+		return nil
+	}
+	var flags uint64
+	iocBalanceV2 = func(_ *os.File, args *btrfs_ioctl_balance_args) error {
+		flags = args.Flags
+		args.Stat.Completed = 3
+		return nil
+	}
+	var ops []string
+	f := &FS{f: dir}
+	f.SetAudit(func(rec AuditRecord) { ops = append(ops, rec.Op) })
+
+	if err = f.BalancePause(); err != nil {
+		t.Fatal(err)
+	} else if err = f.BalanceCancel(); err != nil {
+		t.Fatal(err)
+	} else if err = f.BalanceCancel(); err != syscall.ENOTCONN {
+		t.Fatalf("expected %v, got %v", syscall.ENOTCONN, err)
+	}
+	if exp := []int32{_BTRFS_BALANCE_CTL_PAUSE, _BTRFS_BALANCE_CTL_CANCEL, _BTRFS_BALANCE_CTL_CANCEL}; !reflect.DeepEqual(cmds, exp) {
+		t.Fatalf("unexpected commands: %v", cmds)
+	}
+	p, err := f.BalanceResume()
+	if err != nil {
+		t.Fatal(err)
+	} else if BalanceFlags(flags) != BalanceResume {
+		t.Fatalf("unexpected flags: %#x", flags)
+	} else if p.Completed != 3 {
+		t.Fatalf("unexpected progress: %+v", p)
+	}
+	if exp := []string{"balance_pause", "balance_cancel", "balance_cancel", "balance_resume"}; !reflect.DeepEqual(ops, exp) {
+		t.Fatalf("unexpected audit records: %q", ops)
+	}
+
+	// resume is destructive, thus a reason may be required; pause and cancel are not
+	f.SetGuard(Guard{RequireReason: true})
+	flags = 0
+	if _, err = f.BalanceResume(); !isGuardErr(err) {
+		t.Fatalf("expected guard error, got %v", err)
+	} else if flags != 0 {
+		t.Fatal("balance was resumed")
+	}
+	if err = f.BalancePause(); err != syscall.ENOTCONN {
+		t.Fatalf("expected %v, got %v", syscall.ENOTCONN, err)
+	}
+}
+
+var balanceRunStateCases = []struct {
+	name                    string
+	state                   BalanceState
+	loaded, found, readOnly bool
+	exp                     BalanceRunState
+}{
+	{"none", 0, false, false, false, BalanceNone},
+	{"running", BalanceStateRunning, true, true, false, BalanceRunning},
+	{"running, pause requested", BalanceStateRunning | BalanceStatePauseReq, true, true, false, BalanceRunning},
+	{"paused", 0, true, true, false, BalancePaused},
+	{"paused, read-only without item", 0, true, false, true, BalancePaused},
+	{"read-only mount", 0, true, true, true, BalancePendingResume},
+	{"not loaded", 0, false, true, false, BalancePendingResume},
+	{"not loaded, read-only", 0, false, true, true, BalancePendingResume},
+}
+
+func TestBalanceRunState(t *testing.T) {
+	for _, c := range balanceRunStateCases {
+		if got := balanceRunState(c.state, c.loaded, c.found, c.readOnly); got != c.exp {
+			t.Errorf("%s: expected %v, got %v", c.name, c.exp, got)
+		}
+	}
+}
+
+func TestBalanceEvents(t *testing.T) {
+	var (
+		none    = balanceSample{}
+		running = balanceSample{found: true, p: BalanceProgress{Expected: 10, Completed: 2}, state: BalanceStateRunning}
+		cancel  = balanceSample{found: true, p: BalanceProgress{Expected: 10, Completed: 3}, state: BalanceStateRunning | BalanceStateCancelReq}
+		paused  = balanceSample{found: true, p: BalanceProgress{Expected: 10, Completed: 4}}
+	)
+	for _, c := range []struct {
+		prev, cur balanceSample
+		exp       []BalanceEventType
+		err       error
+	}{
+		{none, none, nil, nil},
+		{none, running, []BalanceEventType{BalanceEventStarted}, nil},
+		{none, paused, []BalanceEventType{BalanceEventStarted, BalanceEventPaused}, nil},
+		{running, running, []BalanceEventType{BalanceEventProgress}, nil},
+		{running, paused, []BalanceEventType{BalanceEventPaused}, nil},
+		{paused, paused, nil, nil},
+		{paused, running, []BalanceEventType{BalanceEventResumed}, nil},
+		{running, none, []BalanceEventType{BalanceEventFinished}, nil},
+		{cancel, none, []BalanceEventType{BalanceEventFinished}, syscall.ECANCELED},
+		{paused, none, []BalanceEventType{BalanceEventFinished}, syscall.ECANCELED},
+	} {
+		events := balanceEvents(c.prev, c.cur)
+		if len(events) != len(c.exp) {
+			t.Fatalf("%+v -> %+v: unexpected events: %+v", c.prev, c.cur, events)
+		}
+		for i, e := range events {
+			if e.Type != c.exp[i] {
+				t.Fatalf("%+v -> %+v: unexpected events: %+v", c.prev, c.cur, events)
+			}
+		}
+		if len(events) != 0 && events[len(events)-1].Err != c.err {
+			t.Fatalf("%+v -> %+v: unexpected error: %v", c.prev, c.cur, events[len(events)-1].Err)
+		}
+	}
+}
+
+func TestReclaimResult(t *testing.T) {
+	if s := QuickBalance().Data.String(); s != "usage=0..5" {
+		t.Fatalf("unexpected filters: %q", s)
+	}
+	r := &ReclaimResult{Unallocated: 2 * gib}
+	if r.Freed() != 0 {
+		t.Fatalf("unexpected freed space: %d", r.Freed())
+	}
+	r.Steps = []ReclaimStep{{Usage: 5, Unallocated: 3 * gib}, {Usage: 10, Unallocated: 5 * gib}}
+	if r.Freed() != 3*gib {
+		t.Fatalf("unexpected freed space: %d", r.Freed())
+	}
+}
+
+func TestPlanBalance(t *testing.T) {
+	var (
+		data1  = blockGroupData
+		meta1  = blockGroupMetadata | blockGroupRaid1
+		sys1   = blockGroupSystem | blockGroupRaid1
+		stripe = func(devs ...uint64) []chunkStripe {
+			var out []chunkStripe
+			for _, d := range devs {
+				out = append(out, chunkStripe{devid: d, offset: d * gib})
+			}
+			return out
+		}
+	)
+	chunks := []chunk{
+		{start: 1 * gib, length: gib, typ: sys1, stripes: stripe(1, 2)},
+		{start: 2 * gib, length: gib, typ: meta1, stripes: stripe(1, 2)},
+		{start: 3 * gib, length: gib, typ: data1, stripes: stripe(1)},
+		{start: 4 * gib, length: gib, typ: data1, stripes: stripe(2)},
+		{start: 5 * gib, length: gib, typ: data1, stripes: stripe(1)},
+	}
+	bgs := []BlockGroup{
+		{Start: 1 * gib, Used: gib / 100},
+		{Start: 2 * gib, Used: gib / 2},
+		{Start: 3 * gib, Used: gib / 10},
+		{Start: 4 * gib, Used: gib / 20},
+		{Start: 5 * gib, Used: gib},
+	}
+	starts := func(p *BalancePlan) []uint64 {
+		var out []uint64
+		for _, bg := range p.BlockGroups {
+			out = append(out, bg.Start/gib)
+		}
+		return out
+	}
+	for _, c := range []struct {
+		opts BalanceOptions
+		exp  []uint64
+	}{
+		{BalanceOptions{}, []uint64{5, 4, 3, 2, 1}},
+		{UsageBalance(20), []uint64{4, 3, 1}},
+		{BalanceOptions{Data: &BalanceArgs{DevID: 1}}, []uint64{5, 3}},
+		{BalanceOptions{Data: &BalanceArgs{Limit: &BalanceRange{Max: 2}}}, []uint64{5, 4}},
+		{BalanceOptions{Data: &BalanceArgs{Limit: &BalanceRange{Min: 4, Max: 5}}}, nil},
+		{BalanceOptions{Data: &BalanceArgs{VRange: &BalanceRange{Min: 3*gib + 1, Max: 4 * gib}}}, []uint64{3}},
+		{BalanceOptions{Metadata: &BalanceArgs{Convert: ProfileRaid1, Soft: true}}, nil},
+		{BalanceOptions{Metadata: &BalanceArgs{Profiles: ProfileRaid1}}, []uint64{2, 1}},
+		{BalanceOptions{System: &BalanceArgs{Stripes: &BalanceRange{Min: 2, Max: 2}}}, []uint64{1}},
+	} {
+		p := planBalance(c.opts, chunks, bgs)
+		if got := starts(p); fmt.Sprint(got) != fmt.Sprint(c.exp) {
+			t.Fatalf("%+v: unexpected block groups: %v vs %v", c.opts, got, c.exp)
+		}
+	}
+	p := planBalance(UsageBalance(20), chunks, bgs)
+	if p.Length != 3*gib || p.Used != gib/20+gib/10+gib/100 {
+		t.Fatalf("unexpected totals: %+v", p)
+	}
+}
@@ -0,0 +1,110 @@
+package btrfs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BlockGroupType is a type of data stored in a block group.
+type BlockGroupType uint64
+
+const (
+	BlockGroupData     = BlockGroupType(blockGroupData)
+	BlockGroupMetadata = BlockGroupType(blockGroupMetadata)
+	BlockGroupSystem   = BlockGroupType(blockGroupSystem)
+)
+
+func (t BlockGroupType) String() string {
+	var out []string
+	for _, v := range []struct {
+		t    BlockGroupType
+		name string
+	}{
+		{BlockGroupData, "data"},
+		{BlockGroupMetadata, "metadata"},
+		{BlockGroupSystem, "system"},
+	} {
+		if t&v.t != 0 {
+			out = append(out, v.name)
+			t &^= v.t
+		}
+	}
+	if t != 0 {
+		out = append(out, fmt.Sprintf("%#x", uint64(t)))
+	}
+	return strings.Join(out, "|")
+}
+
+// BlockGroup describes a single allocated block group (a logical chunk).
+type BlockGroup struct {
+	Start   uint64 // logical address
+	Length  uint64 // logical length
+	Used    uint64 // bytes used in the block group
+	Type    BlockGroupType
+	Profile Profile
+}
+
+// Usage returns the usage of the block group in percents.
+func (bg BlockGroup) Usage() float64 {
+	if bg.Length == 0 {
+		return 0
+	}
+	return float64(bg.Used) / float64(bg.Length) * 100
+}
+
+const (
+	featureCompatROBlockGroupTree = FeatureFlags(1 << 3)
+
+	blockGroupTreeObjectid objectID = 11
+)
+
+// BlockGroups lists all block groups of the filesystem, ordered by their logical address.
+// The scan is parallelized according to SetScanWorkers. It requires CAP_SYS_ADMIN.
+func (f *FS) BlockGroups() ([]BlockGroup, error) {
+	feat, err := f.GetFeatures()
+	if err != nil {
+		return nil, err
+	}
+	tree := extentTreeObjectid
+	if feat.CompatibleRO&featureCompatROBlockGroupTree != 0 {
+		tree = blockGroupTreeObjectid
+	}
+	var out []BlockGroup
+	var mu sync.Mutex
+	err = f.scan(btrfs_ioctl_search_key{
+		TreeID:      uint64(tree),
+		MinObjectID: 0,
+		MaxObjectID: maxUint64,
+		MinType:     uint32(blockGroupItemKey),
+		MaxType:     uint32(blockGroupItemKey),
+		MaxOffset:   maxUint64,
+		MaxTransID:  maxUint64,
+	}, func(r searchResult) error {
+		if r.Type != blockGroupItemKey {
+			return nil
+		}
+		if len(r.Data) < 24 {
+			return fmt.Errorf("block group item is too short: %d", len(r.Data))
+		}
+		bg := blockGroup(order.Uint64(r.Data[16:]))
+		mu.Lock()
+		defer mu.Unlock()
+		out = append(out, BlockGroup{
+			Start:   uint64(r.ObjectID),
+			Length:  r.Offset,
+			Used:    order.Uint64(r.Data[0:]),
+			Type:    BlockGroupType(bg & (blockGroupData | blockGroupMetadata | blockGroupSystem)),
+			Profile: profileOf(bg),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Start < out[j].Start
+	})
+	return out, nil
+}
@@ -7,7 +7,9 @@ import (
 	"path/filepath"
 	"strconv"
 	"syscall"
+	"time"
 
+	"github.com/dennwc/btrfs/raw"
 	"github.com/dennwc/ioctl"
 )
 
@@ -17,6 +19,24 @@ func CloneFile(dst, src *os.File) error {
 	return iocClone(dst, src)
 }
 
+// CloneRange shares n bytes of src starting at srcOff with dst at dstOff.
+// If n is zero, the range up to the end of src is cloned.
+//
+// Offsets must be aligned to the clone alignment of the filesystem (see CloneAlignment),
+// as well as the length, unless the range ends at the end of src. Otherwise,
+// ErrUnalignedRange is returned.
+func CloneRange(dst, src *os.File, srcOff, n, dstOff uint64) error {
+	if err := checkRemapFiles("clone", src, srcOff, dstOff, n, false); err != nil {
+		return err
+	}
+	return iocCloneRange(dst, &btrfs_ioctl_clone_range_args{
+		SrcFd:      int64(src.Fd()),
+		SrcOffset:  srcOff,
+		SrcLength:  n,
+		DestOffset: dstOff,
+	})
+}
+
 func Open(path string, ro bool) (*FS, error) {
 	if ok, err := IsSubVolume(path); err != nil {
 		return nil, err
@@ -46,17 +66,36 @@ func Open(path string, ro bool) (*FS, error) {
 		dir.Close()
 		return nil, fmt.Errorf("not a directory: %s", path)
 	}
-	return &FS{f: dir}, nil
+	return newFS(dir), nil
 }
 
 type FS struct {
-	f *os.File
+	f        *os.File
+	stateDir string
+	audit    AuditFunc
+	reason   string
+	guard    *Guard
+	override bool
+	cache    *subvolCache
+	ident    *handleIdent // see Validate
+
+	autoValidate bool
+
+	scanWorkers int
+
+	scrubStatusDir string // see SetScrubStatusDir
 }
 
 func (f *FS) Close() error {
 	return f.f.Close()
 }
 
+// Path returns the path the filesystem was opened at. Paths passed to methods of FS
+// are relative to it.
+func (f *FS) Path() string {
+	return f.f.Name()
+}
+
 type Info struct {
 	MaxID          uint64
 	NumDevices     uint64
@@ -67,6 +106,9 @@ type Info struct {
 }
 
 func (f *FS) SubVolumeID() (uint64, error) {
+	if err := f.revalidate(); err != nil {
+		return 0, err
+	}
 	id, err := getFileRootID(f.f)
 	if err != nil {
 		return 0, err
@@ -75,22 +117,26 @@ func (f *FS) SubVolumeID() (uint64, error) {
 }
 
 func (f *FS) Info() (out Info, err error) {
+	if err = f.revalidate(); err != nil {
+		return
+	}
 	var arg btrfs_ioctl_fs_info_args
 	arg, err = iocFsInfo(f.f)
 	if err == nil {
 		out = Info{
-			MaxID:          arg.max_id,
-			NumDevices:     arg.num_devices,
-			FSID:           arg.fsid,
-			NodeSize:       arg.nodesize,
-			SectorSize:     arg.sectorsize,
-			CloneAlignment: arg.clone_alignment,
+			MaxID:          arg.MaxID,
+			NumDevices:     arg.NumDevices,
+			FSID:           FSID(arg.FSID),
+			NodeSize:       arg.NodeSize,
+			SectorSize:     arg.SectorSize,
+			CloneAlignment: arg.CloneAlignment,
 		}
 	}
 	return
 }
 
 type DevInfo struct {
+	ID         uint64
 	UUID       UUID
 	BytesUsed  uint64
 	TotalBytes uint64
@@ -99,19 +145,43 @@ type DevInfo struct {
 
 func (f *FS) GetDevInfo(id uint64) (out DevInfo, err error) {
 	var arg btrfs_ioctl_dev_info_args
-	arg.devid = id
+	arg.DevID = id
 
-	if err = ioctl.Do(f.f, _BTRFS_IOC_DEV_INFO, &arg); err != nil {
+	if err = raw.DevInfo(f.f, &arg); err != nil {
 		return
 	}
-	out.UUID = arg.uuid
-	out.BytesUsed = arg.bytes_used
-	out.TotalBytes = arg.total_bytes
-	out.Path = stringFromBytes(arg.path[:])
+	out.ID = arg.DevID
+	out.UUID = UUID(arg.UUID)
+	out.BytesUsed = arg.BytesUsed
+	out.TotalBytes = arg.TotalBytes
+	out.Path = stringFromBytes(arg.Path[:])
 
 	return
 }
 
+// Devices returns information about all devices of the filesystem.
+// Device ids may have gaps, for example after a device was removed.
+func (f *FS) Devices() ([]DevInfo, error) {
+	if err := f.revalidate(); err != nil {
+		return nil, err
+	}
+	info, err := iocFsInfo(f.f)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]DevInfo, 0, info.NumDevices)
+	for i := uint64(1); i <= info.MaxID; i++ {
+		dev, err := f.GetDevInfo(i)
+		if err == syscall.ENODEV {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		out = append(out, dev)
+	}
+	return out, nil
+}
+
 type DevStatsFlags = uint64
 
 const (
@@ -132,26 +202,37 @@ type DevStats struct {
 }
 
 func (f *FS) GetDevStatsWithFlags(id uint64, flags uint64) (out DevStats, err error) {
+	if err = f.revalidate(); err != nil {
+		return
+	}
 	var arg btrfs_ioctl_get_dev_stats
-	arg.devid = id
-	arg.nr_items = _BTRFS_DEV_STAT_VALUES_MAX
-	arg.flags = flags
-	if err = ioctl.Do(f.f, _BTRFS_IOC_GET_DEV_STATS, &arg); err != nil {
+	arg.DevID = id
+	arg.NrItems = _BTRFS_DEV_STAT_VALUES_MAX
+	arg.Flags = flags
+	get := func() error {
+		return iocGetDevStats(f.f, &arg)
+	}
+	if flags&DevStatsFlagsReset != 0 {
+		err = f.audited("reset_dev_stats", map[string]interface{}{"devid": id}, get)
+	} else {
+		err = get()
+	}
+	if err != nil {
 		return
 	}
 	i := 0
-	out.WriteErrs = arg.values[i]
+	out.WriteErrs = arg.Values[i]
 	i++
-	out.ReadErrs = arg.values[i]
+	out.ReadErrs = arg.Values[i]
 	i++
-	out.FlushErrs = arg.values[i]
+	out.FlushErrs = arg.Values[i]
 	i++
-	out.CorruptionErrs = arg.values[i]
+	out.CorruptionErrs = arg.Values[i]
 	i++
-	out.GenerationErrs = arg.values[i]
+	out.GenerationErrs = arg.Values[i]
 	i++
-	if int(arg.nr_items) > i {
-		out.Unknown = arg.values[i:arg.nr_items]
+	if int(arg.NrItems) > i {
+		out.Unknown = arg.Values[i:arg.NrItems]
 	}
 	return
 }
@@ -160,10 +241,12 @@ func (f *FS) GetDevStats(id uint64) (out DevStats, err error) {
 }
 func (f *FS) ResetDevStats(id uint64) (err error) {
 	var arg btrfs_ioctl_get_dev_stats
-	arg.devid = id
-	arg.nr_items = _BTRFS_DEV_STAT_VALUES_MAX
-	arg.flags = DevStatsFlagsReset
-	return ioctl.Do(f.f, _BTRFS_IOC_GET_DEV_STATS, &arg)
+	arg.DevID = id
+	arg.NrItems = _BTRFS_DEV_STAT_VALUES_MAX
+	arg.Flags = DevStatsFlagsReset
+	return f.audited("reset_dev_stats", map[string]interface{}{"devid": id}, func() error {
+		return iocGetDevStats(f.f, &arg)
+	})
 }
 
 type ScrubProgress struct {
@@ -192,15 +275,11 @@ type ScrubProgress struct {
 // Start a scrub on the given device, starting at start blocks and ending on end blocks
 // If you want to scan the whole device, set start to 0 and end to the maximal value of uint64( for example via math.MaxUint64)
 // Another option is to resume a earlier interrupted scrub, by setting the start to the same value as reported in LastPhysical (can be retrieved via .ScrubStatus)
-// WARNING: This method WILL BLOCK until the scrub is done, or the scrub is cancelled
+// WARNING: This method WILL BLOCK until the scrub is done, or the scrub is cancelled (see ScrubStartAsync)
 // Scrub operations requiere CAP_SYSADMIN or root
+// If the state directory is set (see SetStateDir), the result is recorded to the scrub history.
 func (f *FS) ScrubStart(dev uint64, start uint64, end uint64) error {
-	var arg btrfs_ioctl_scrub_args
-	arg.devid = dev
-	arg.flags = 0
-	arg.start = start
-	arg.end = end
-	return iocScrub(f.f, &arg)
+	return f.ScrubStartWithFlags(dev, start, end, 0)
 }
 
 // Cancel a scrub on the given device
@@ -212,29 +291,36 @@ func (f *FS) ScrubCancel(dev uint64) error {
 // Get the progress of a scrub on the given device
 // Scrub operations requiere CAP_SYSADMIN or root
 func (f *FS) ScrubStatus(dev uint64) (ScrubProgress, error) {
+	if err := f.revalidate(); err != nil {
+		return ScrubProgress{}, err
+	}
 	var arg btrfs_ioctl_scrub_args
-	arg.devid = dev
-	arg.flags = 0
+	arg.DevID = dev
+	arg.Flags = 0
 	if err := iocScrubProgress(f.f, &arg); err != nil {
 		return ScrubProgress{}, err
 	}
+	return scrubProgress(&arg.Progress), nil
+}
+
+func scrubProgress(p *btrfs_scrub_progress) ScrubProgress {
 	return ScrubProgress{
-		arg.progress.data_extents_scrubbed,
-		arg.progress.tree_extents_scrubbed,
-		arg.progress.data_bytes_scrubbed,
-		arg.progress.tree_bytes_scrubbed,
-		arg.progress.read_errors,
-		arg.progress.csum_errors,
-		arg.progress.verify_errors,
-		arg.progress.no_csum,
-		arg.progress.csum_discards,
-		arg.progress.super_errors,
-		arg.progress.malloc_errors,
-		arg.progress.uncorrectable_errors,
-		arg.progress.corrected_errors,
-		arg.progress.last_physical,
-		arg.progress.unverified_errors,
-	}, nil
+		p.DataExtentsScrubbed,
+		p.TreeExtentsScrubbed,
+		p.DataBytesScrubbed,
+		p.TreeBytesScrubbed,
+		p.ReadErrors,
+		p.CsumErrors,
+		p.VerifyErrors,
+		p.NoCsum,
+		p.CsumDiscards,
+		p.SuperErrors,
+		p.MallocErrors,
+		p.UncorrectableErrors,
+		p.CorrectedErrors,
+		p.LastPhysical,
+		p.UnverifiedErrors,
+	}
 }
 
 type FSFeatureFlags struct {
@@ -245,67 +331,106 @@ type FSFeatureFlags struct {
 
 func (f *FS) GetFeatures() (out FSFeatureFlags, err error) {
 	var arg btrfs_ioctl_feature_flags
-	if err = ioctl.Do(f.f, _BTRFS_IOC_GET_FEATURES, &arg); err != nil {
+	if err = raw.GetFeatures(f.f, &arg); err != nil {
 		return
 	}
 	out = FSFeatureFlags{
-		Compatible:   arg.compat_flags,
-		CompatibleRO: arg.compat_ro_flags,
-		Incompatible: arg.incompat_flags,
+		Compatible:   FeatureFlags(arg.Compat),
+		CompatibleRO: FeatureFlags(arg.CompatRO),
+		Incompatible: IncompatFeatures(arg.Incompat),
 	}
 	return
 }
 
 func (f *FS) GetSupportedFeatures() (out FSFeatureFlags, err error) {
 	var arg [3]btrfs_ioctl_feature_flags
-	if err = ioctl.Do(f.f, _BTRFS_IOC_GET_SUPPORTED_FEATURES, &arg); err != nil {
+	if err = raw.GetSupportedFeatures(f.f, &arg); err != nil {
 		return
 	}
 	out = FSFeatureFlags{
-		Compatible:   arg[0].compat_flags,
-		CompatibleRO: arg[0].compat_ro_flags,
-		Incompatible: arg[0].incompat_flags,
+		Compatible:   FeatureFlags(arg[0].Compat),
+		CompatibleRO: FeatureFlags(arg[0].CompatRO),
+		Incompatible: IncompatFeatures(arg[0].Incompat),
 	}
 	//for i, a := range arg {
 	//	out[i] = FSFeatureFlags{
-	//		Compatible:   a.compat_flags,
-	//		CompatibleRO: a.compat_ro_flags,
-	//		Incompatible: a.incompat_flags,
+	//		Compatible:   FeatureFlags(a.Compat),
+	//		CompatibleRO: FeatureFlags(a.CompatRO),
+	//		Incompatible: IncompatFeatures(a.Incompat),
 	//	}
 	//}
 	return
 }
 
 func (f *FS) GetFlags() (SubvolFlags, error) {
+	if err := f.revalidate(); err != nil {
+		return 0, err
+	}
 	return iocSubvolGetflags(f.f)
 }
 
 func (f *FS) SetFlags(flags SubvolFlags) error {
-	return iocSubvolSetflags(f.f, flags)
+	return f.audited("set_flags", map[string]interface{}{"flags": uint64(flags)}, func() error {
+		if err := f.checkSetFlags(f, flags); err != nil {
+			return err
+		}
+		return iocSubvolSetflags(f.f, flags)
+	})
+}
+
+// SetReceived marks the subvolume as received. See SetReceivedSubvolume.
+func (f *FS) SetReceived(uuid UUID, stransid uint64, stime time.Time) error {
+	args := btrfs_ioctl_received_subvol_args{
+		UUID:     raw.UUID(uuid),
+		STransID: stransid,
+		STime: btrfs_ioctl_timespec{
+			Sec:  uint64(stime.Unix()),
+			Nsec: uint32(stime.Nanosecond()),
+		},
+	}
+	return f.audited("set_received", map[string]interface{}{
+		"uuid": uuid.String(), "stransid": stransid, "stime": stime,
+	}, func() error {
+		return iocSetReceivedSubvol(f.f, &args)
+	})
 }
 
 func (f *FS) Sync() (err error) {
-	if err = ioctl.Ioctl(f.f, _BTRFS_IOC_START_SYNC, 0); err != nil {
+	if err = f.revalidate(); err != nil {
 		return
 	}
-	return ioctl.Ioctl(f.f, _BTRFS_IOC_WAIT_SYNC, 0)
+	if err = ioctl.Ioctl(f.f, raw.IocStartSync, 0); err != nil {
+		return
+	}
+	return ioctl.Ioctl(f.f, raw.IocWaitSync, 0)
 }
 
 func (f *FS) CreateSubVolume(name string) error {
-	return CreateSubVolume(filepath.Join(f.f.Name(), name))
+	return f.audited("create_subvolume", map[string]interface{}{"name": name}, func() error {
+		return CreateSubVolume(filepath.Join(f.f.Name(), name))
+	})
 }
 
 func (f *FS) DeleteSubVolume(name string) error {
-	return DeleteSubVolume(filepath.Join(f.f.Name(), name))
+	return f.audited("delete_subvolume", map[string]interface{}{"name": name}, func() error {
+		if err := f.checkProtected("delete_subvolume", name); err != nil {
+			return err
+		}
+		return DeleteSubVolume(filepath.Join(f.f.Name(), name))
+	})
 }
 
 func (f *FS) Snapshot(dst string, ro bool) error {
-	return SnapshotSubVolume(f.f.Name(), filepath.Join(f.f.Name(), dst), ro)
+	return f.audited("snapshot", map[string]interface{}{"dst": dst, "ro": ro}, func() error {
+		return SnapshotSubVolume(f.f.Name(), filepath.Join(f.f.Name(), dst), ro)
+	})
 }
 
 func (f *FS) SnapshotSubVolume(name string, dst string, ro bool) error {
-	return SnapshotSubVolume(filepath.Join(f.f.Name(), name),
-		filepath.Join(f.f.Name(), dst), ro)
+	return f.audited("snapshot", map[string]interface{}{"src": name, "dst": dst, "ro": ro}, func() error {
+		return SnapshotSubVolume(filepath.Join(f.f.Name(), name),
+			filepath.Join(f.f.Name(), dst), ro)
+	})
 }
 
 func (f *FS) Send(w io.Writer, parent string, subvols ...string) error {
@@ -320,14 +445,21 @@ func (f *FS) Send(w io.Writer, parent string, subvols ...string) error {
 }
 
 func (f *FS) Receive(r io.Reader) error {
-	return Receive(r, f.f.Name())
+	return f.audited("receive", nil, func() error {
+		return Receive(r, f.f.Name())
+	})
 }
 
 func (f *FS) ReceiveTo(r io.Reader, mount string) error {
-	return Receive(r, filepath.Join(f.f.Name(), mount))
+	return f.audited("receive", map[string]interface{}{"dst": mount}, func() error {
+		return Receive(r, filepath.Join(f.f.Name(), mount))
+	})
 }
 
 func (f *FS) ListSubvolumes(filter func(SubvolInfo) bool) ([]SubvolInfo, error) {
+	if err := f.revalidate(); err != nil {
+		return nil, err
+	}
 	m, err := listSubVolumes(f.f, filter)
 	if err != nil {
 		return nil, err
@@ -340,48 +472,62 @@ func (f *FS) ListSubvolumes(filter func(SubvolInfo) bool) ([]SubvolInfo, error)
 }
 
 func (f *FS) SubvolumeByUUID(uuid UUID) (*SubvolInfo, error) {
-	id, err := lookupUUIDSubvolItem(f.f, uuid)
+	id, err := f.lookupUUID(uuid, false)
 	if err != nil {
 		return nil, err
 	}
-	return subvolSearchByRootID(f.f, id, "")
+	return f.subvolInfo(id)
 }
 
 func (f *FS) SubvolumeByReceivedUUID(uuid UUID) (*SubvolInfo, error) {
-	id, err := lookupUUIDReceivedSubvolItem(f.f, uuid)
+	id, err := f.lookupUUID(uuid, true)
 	if err != nil {
 		return nil, err
 	}
-	return subvolSearchByRootID(f.f, id, "")
+	return f.subvolInfo(id)
 }
 
 func (f *FS) SubvolumeByPath(path string) (*SubvolInfo, error) {
 	return subvolSearchByPath(f.f, path)
 }
 
-func (f *FS) Usage() (UsageInfo, error) { return spaceUsage(f.f) }
+// SubvolumePath returns an absolute path to the root of a subvolume with a given id.
+// The subvolume must be reachable from the subvolume this FS was opened at.
+func (f *FS) SubvolumePath(rootID uint64) (string, error) {
+	return f.subvolMountPath(objectID(rootID))
+}
+
+func (f *FS) Usage() (UsageInfo, error) {
+	if err := f.revalidate(); err != nil {
+		return UsageInfo{}, err
+	}
+	return spaceUsage(f.f)
+}
 
 func (f *FS) Balance(flags BalanceFlags) (BalanceProgress, error) {
-	args := btrfs_ioctl_balance_args{flags: flags}
-	err := iocBalanceV2(f.f, &args)
-	return args.stat, err
+	args := btrfs_ioctl_balance_args{Flags: uint64(flags)}
+	err := f.audited("balance", map[string]interface{}{"flags": uint64(flags)}, func() error {
+		return iocBalanceV2(f.f, &args)
+	})
+	return args.Stat, err
 }
 
 func (f *FS) Resize(size int64) error {
 	amount := strconv.FormatInt(size, 10)
-	args := &btrfs_ioctl_vol_args{}
-	args.SetName(amount)
-	if err := iocResize(f.f, args); err != nil {
-		return fmt.Errorf("resize failed: %v", err)
-	}
-	return nil
+	return f.resize(amount)
 }
 
 func (f *FS) ResizeToMax() error {
+	return f.resize("max")
+}
+
+func (f *FS) resize(amount string) error {
 	args := &btrfs_ioctl_vol_args{}
-	args.SetName("max")
-	if err := iocResize(f.f, args); err != nil {
-		return fmt.Errorf("resize failed: %v", err)
-	}
-	return nil
+	args.SetName(amount)
+	return f.audited("resize", map[string]interface{}{"size": amount}, func() error {
+		if err := iocResize(f.f, args); err != nil {
+			return fmt.Errorf("resize failed: %v", err)
+		}
+		return nil
+	})
 }
@@ -55,6 +55,11 @@ const (
 	FeatureIncompatRAID56         = IncompatFeatures(1 << 7)
 	FeatureIncompatSkinnyMetadata = IncompatFeatures(1 << 8)
 	FeatureIncompatNoHoles        = IncompatFeatures(1 << 9)
+	FeatureIncompatMetadataUUID   = IncompatFeatures(1 << 10)
+	FeatureIncompatRAID1C34       = IncompatFeatures(1 << 11)
+	FeatureIncompatZoned          = IncompatFeatures(1 << 12)
+	FeatureIncompatExtentTreeV2   = IncompatFeatures(1 << 13)
+	FeatureIncompatRaidStripeTree = IncompatFeatures(1 << 14)
 )
 
 // Flags definition for balance.
@@ -71,3 +76,20 @@ const (
 	BalanceForce  = BalanceFlags(1 << 3)
 	BalanceResume = BalanceFlags(1 << 4)
 )
+
+// Flags definition for balance filters.
+type balanceArgsFlags uint64
+
+const (
+	balanceArgsProfiles     = balanceArgsFlags(1 << 0)
+	balanceArgsUsage        = balanceArgsFlags(1 << 1)
+	balanceArgsDevid        = balanceArgsFlags(1 << 2)
+	balanceArgsDrange       = balanceArgsFlags(1 << 3)
+	balanceArgsVrange       = balanceArgsFlags(1 << 4)
+	balanceArgsLimit        = balanceArgsFlags(1 << 5)
+	balanceArgsLimitRange   = balanceArgsFlags(1 << 6)
+	balanceArgsStripesRange = balanceArgsFlags(1 << 7)
+	balanceArgsConvert      = balanceArgsFlags(1 << 8)
+	balanceArgsSoft         = balanceArgsFlags(1 << 9)
+	balanceArgsUsageRange   = balanceArgsFlags(1 << 10)
+)
@@ -4,12 +4,12 @@ import "os"
 
 func getFileRootID(file *os.File) (objectID, error) {
 	args := btrfs_ioctl_ino_lookup_args{
-		objectid: firstFreeObjectid,
+		ObjectID: uint64(firstFreeObjectid),
 	}
 	if err := iocInoLookup(file, &args); err != nil {
 		return 0, err
 	}
-	return args.treeid, nil
+	return objectID(args.TreeID), nil
 }
 
 func getPathRootID(path string) (objectID, error) {
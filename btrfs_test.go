@@ -1,6 +1,10 @@
 package btrfs
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/dennwc/btrfs/test"
 	"io"
 	"io/ioutil"
@@ -8,7 +12,9 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"syscall"
 	"testing"
+	"time"
 )
 
 const sizeDef = 256 * 1024 * 1024
@@ -156,6 +162,27 @@ func TestSubvolumes(t *testing.T) {
 	}
 }
 
+func TestSubvolCreateV2(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	d, err := openDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// the kernel reads a name at a different offset if the v1 request is used
+	var args btrfs_ioctl_vol_args_v2
+	copy(args.Name[:], "sub")
+	if err := iocSubvolCreateV2(d, &args); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := IsSubVolume(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected a subvolume to be created")
+	}
+}
+
 func TestCompression(t *testing.T) {
 	dir, closer := btrfstest.New(t, sizeDef)
 	defer closer()
@@ -275,3 +302,613 @@ func TestResize(t *testing.T) {
 		t.Fatal("to resized:", st.Total, st2.Total)
 	}
 }
+
+func TestCloneAcrossSubvolumes(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+
+	for _, name := range []string{"a", "b"} {
+		if err := CreateSubVolume(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const data = "btrfs_test"
+	src := filepath.Join(dir, "a", "1.dat")
+	if err := ioutil.WriteFile(src, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "b", "2.dat")
+	if err := CloneAcrossSubvolumes(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(buf) != data {
+		t.Fatalf("wrong data returned: %q", string(buf))
+	}
+
+	// a clone onto the source itself is rejected without truncating it
+	link := filepath.Join(dir, "a", "link.dat")
+	if err = os.Link(src, link); err != nil {
+		t.Fatal(err)
+	}
+	symlink := filepath.Join(dir, "a", "symlink.dat")
+	if err = os.Symlink(src, symlink); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{src, link, symlink} {
+		if err = CloneAcrossSubvolumes(p, src); err == nil {
+			t.Fatalf("expected an error for a clone of %s onto itself", p)
+		}
+		if buf, err = ioutil.ReadFile(src); err != nil {
+			t.Fatal(err)
+		} else if string(buf) != data {
+			t.Fatalf("source was modified: %q", string(buf))
+		}
+	}
+
+	// a clone to another filesystem is rejected without touching the destination
+	other, err := ioutil.TempDir("", "btrfs-clone-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(other)
+	const keep = "keep"
+	existing := filepath.Join(other, "existing.dat")
+	if err = ioutil.WriteFile(existing, []byte(keep), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = CloneAcrossSubvolumes(existing, src); err == nil {
+		t.Fatal("expected an error for a clone to another filesystem")
+	}
+	if buf, err = ioutil.ReadFile(existing); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != keep {
+		t.Fatalf("destination was modified: %q", string(buf))
+	}
+	if err = CloneAcrossSubvolumes(filepath.Join(other, "new.dat"), src); err == nil {
+		t.Fatal("expected an error for a clone to another filesystem")
+	} else if _, err = os.Lstat(filepath.Join(other, "new.dat")); !os.IsNotExist(err) {
+		t.Fatalf("destination was created: %v", err)
+	}
+}
+
+func TestInodePaths(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err := fs.CreateSubVolume("sub"); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "sub", "1.dat")
+	if err := ioutil.WriteFile(path, []byte("btrfs_test"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := getPathRootID(filepath.Join(dir, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := fs.InodePaths(uint64(root), st.Sys().(*syscall.Stat_t).Ino)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(paths) != 1 || paths[0] != path {
+		t.Fatalf("unexpected paths: %q", paths)
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	f, err := os.Create(filepath.Join(dir, "1.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.Write(make([]byte, 64*1024)); err != nil {
+		t.Fatal(err)
+	} else if err = os.Remove(f.Name()); err != nil {
+		t.Fatal(err)
+	} else if err = fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := fs.FindOrphans()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(rep.Inodes) != 1 {
+		t.Fatalf("expected one orphan inode: %+v", rep)
+	} else if len(rep.Dangling) != 0 {
+		t.Fatalf("unexpected dangling roots: %+v", rep.Dangling)
+	}
+}
+
+func TestSubvolumeMetadata(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err := fs.CreateSubVolume("sub"); err != nil {
+		t.Fatal(err)
+	} else if err = fs.SnapshotSubVolume("sub", "snap", true); err != nil {
+		t.Fatal(err)
+	} else if err = fs.CreateSubVolume("restored"); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err = fs.ExportSubvolumeMetadata(buf, "snap"); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := ReadMetadataDocument(buf)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(doc.Subvolumes) != 1 || !doc.Subvolumes[0].ReadOnly {
+		t.Fatalf("unexpected document: %+v", doc)
+	}
+	m := doc.Subvolumes[0]
+	if err = fs.ApplyReceivedMetadata("restored", &m); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.SubvolumeByPath("restored")
+	if err != nil {
+		t.Fatal(err)
+	} else if info.ReceivedUUID != m.UUID {
+		t.Fatalf("unexpected received uuid: %v vs %v", info.ReceivedUUID, m.UUID)
+	}
+}
+
+func TestSubvolCache(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	fs.EnableSubvolCache()
+	if err = fs.CreateSubVolume("v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := fs.SubvolumeByPath("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		v, err := fs.SubvolumeByUUID(info.UUID)
+		if err != nil {
+			t.Fatal(err)
+		} else if v.Path != "v1" {
+			t.Fatalf("unexpected path: %q", v.Path)
+		}
+	}
+	if st := fs.SubvolCacheStats(); st.Hits != 2 || st.Misses != 2 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+	if err = os.Rename(filepath.Join(dir, "v1"), filepath.Join(dir, "v2")); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	v, err := fs.SubvolumeByUUID(info.UUID)
+	if err != nil {
+		t.Fatal(err)
+	} else if v.Path != "v2" {
+		t.Fatalf("unexpected path after rename: %q", v.Path)
+	}
+	if st := fs.SubvolCacheStats(); st.Invalidations == 0 {
+		t.Fatalf("expected invalidation: %+v", st)
+	}
+}
+
+func TestBlockGroupsParallel(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	seq, err := fs.BlockGroups()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(seq) == 0 {
+		t.Fatal("no block groups")
+	}
+	fs.SetScanWorkers(4)
+	par, err := fs.BlockGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(seq, par) {
+		t.Fatalf("results differ:\n%+v\n%+v", seq, par)
+	}
+}
+
+func TestWithQuiescedSnapshot(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	vol := filepath.Join(dir, "db")
+	if err := CreateSubVolume(vol); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(vol, "data"), []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		steps []string
+		snap  string
+	)
+	err := WithQuiescedSnapshot(context.Background(), vol, func() error {
+		steps = append(steps, "quiesce")
+		return nil
+	}, func() error {
+		steps = append(steps, "release")
+		return nil
+	}, func(path string) error {
+		steps = append(steps, "backup")
+		snap = path
+		if ro, err := IsReadOnly(path); err != nil {
+			return err
+		} else if !ro {
+			return fmt.Errorf("snapshot is not read-only")
+		}
+		_, err := os.Stat(filepath.Join(path, "data"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"quiesce", "release", "backup"}; !reflect.DeepEqual(steps, exp) {
+		t.Fatalf("unexpected steps: %v", steps)
+	}
+	if _, err = os.Stat(snap); !os.IsNotExist(err) {
+		t.Fatalf("snapshot was not deleted: %v", err)
+	}
+
+	steps = nil
+	err = WithQuiescedSnapshot(context.Background(), vol, func() error {
+		steps = append(steps, "quiesce")
+		return errors.New("locked")
+	}, func() error {
+		steps = append(steps, "release")
+		return nil
+	}, func(path string) error {
+		steps = append(steps, "backup")
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if exp := []string{"quiesce", "release"}; !reflect.DeepEqual(steps, exp) {
+		t.Fatalf("unexpected steps: %v", steps)
+	}
+}
+
+func TestCopySubvolume(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err = fs.CreateSubVolume("src"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "src", "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	strategy, err := CopySubvolume(context.Background(), fs, "src", fs, "dst")
+	if err != nil {
+		t.Fatal(err)
+	} else if strategy != CopyReflink {
+		t.Fatalf("unexpected strategy: %v", strategy)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "dst", "file")); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "data" {
+		t.Fatalf("unexpected data: %q", data)
+	}
+	if ro, err := IsReadOnly(filepath.Join(dir, "dst")); err != nil {
+		t.Fatal(err)
+	} else if ro {
+		t.Fatal("copy is read-only")
+	}
+}
+
+func TestVerifyMetadataCsums(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err = fs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := fs.VerifyMetadataCsums(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Total == 0 || rep.Checked != rep.Total || rep.Copies == 0 {
+		t.Fatalf("unexpected report: %+v", rep)
+	}
+	for _, p := range rep.Problems {
+		t.Error(p)
+	}
+}
+
+func TestSnapshotCostReport(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err = fs.CreateSubVolume("sub"); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"snap1", "snap2"} {
+		data := bytes.Repeat([]byte{byte(i)}, 1<<20)
+		if err = ioutil.WriteFile(filepath.Join(dir, "sub", name), data, 0644); err != nil {
+			t.Fatal(err)
+		} else if err = fs.SnapshotSubVolume("sub", name, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rep, err := fs.SnapshotCostReport("sub")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(rep.Snapshots) != 2 {
+		t.Fatalf("unexpected snapshots: %+v", rep.Snapshots)
+	}
+	first, second := rep.Snapshots[0], rep.Snapshots[1]
+	if filepath.Base(first.Path) != "snap1" || filepath.Base(second.Path) != "snap2" {
+		t.Fatalf("unexpected order: %s, %s", first.Path, second.Path)
+	} else if second.SincePrevious < 1<<20 || first.UntilNext != second.SincePrevious {
+		t.Fatalf("unexpected incremental sizes: %d, %d", first.UntilNext, second.SincePrevious)
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err = fs.CreateSubVolume("sub"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"snaps", "dst"} {
+		if err = os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst := LocalTarget(filepath.Join(dir, "dst"))
+	var last *ReplicateResult
+	for i := 0; i < 3; i++ {
+		if err = ioutil.WriteFile(filepath.Join(dir, "sub", fmt.Sprint(i)), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		now := time.Date(2020, 1, 1, 0, i, 0, 0, time.UTC)
+		res, err := Replicate(filepath.Join(dir, "sub"), dst, &ReplicateOptions{
+			SnapshotDir: filepath.Join(dir, "snaps"),
+			Keep:        2,
+			Now:         func() time.Time { return now },
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if (i == 0) != (res.Parent == "") {
+			t.Fatalf("unexpected parent on run %d: %q", i, res.Parent)
+		} else if last != nil && res.Parent != last.Snapshot {
+			t.Fatalf("expected %q as a parent, got %q", last.Snapshot, res.Parent)
+		}
+		last = res
+	}
+	if len(last.Pruned) != 1 {
+		t.Fatalf("unexpected pruned snapshots: %q", last.Pruned)
+	}
+	for _, sub := range []string{"snaps", "dst"} {
+		names, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			t.Fatal(err)
+		} else if len(names) != 2 {
+			t.Fatalf("expected 2 snapshots in %s, got %d", sub, len(names))
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, "dst", last.Received, "2")); err != nil {
+		t.Fatal(err)
+	}
+	// pruning goes through the FS, thus it's blocked by the guard
+	fs.SetGuard(Guard{ProtectPaths: []string{"snaps/*"}})
+	defer fs.ClearGuard()
+	now := time.Date(2020, 1, 1, 0, 3, 0, 0, time.UTC)
+	_, err = Replicate(filepath.Join(dir, "sub"), LocalTargetFS(fs, "dst"), &ReplicateOptions{
+		SnapshotDir: filepath.Join(dir, "snaps"),
+		Keep:        2,
+		Now:         func() time.Time { return now },
+		FS:          fs,
+	})
+	if !isGuardErr(err) {
+		t.Fatalf("expected a guard error, got: %v", err)
+	}
+}
+
+func TestFSReplicate(t *testing.T) {
+	srcDir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	dstDir, closer2 := btrfstest.New(t, sizeDef)
+	defer closer2()
+	src, err := Open(srcDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := Open(dstDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err = src.CreateSubVolume("sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(srcDir, "sub", "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	first, err := src.Replicate(dst, "sub", "")
+	if err != nil {
+		t.Fatal(err)
+	} else if first.Snapshot == filepath.Join(srcDir, "sub") {
+		t.Fatal("expected a read-only snapshot to be created")
+	}
+	if err = src.SnapshotSubVolume("sub", "sub.2", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = src.Replicate(dst, "sub.2", "sub"); err == nil {
+		t.Fatal("expected an error for a parent that was not received")
+	}
+	second, err := src.Replicate(dst, "sub.2", filepath.Base(first.Snapshot))
+	if err != nil {
+		t.Fatal(err)
+	} else if second.Received != "sub.2" {
+		t.Fatalf("unexpected received subvolume: %q", second.Received)
+	}
+	if _, err = os.Stat(filepath.Join(dstDir, "sub.2", "file")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTempSubvolumes(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err = fs.CreateSubVolume("sub"); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := fs.TempSnapshot("sub", "backup", true, -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	} else if ro, err := IsReadOnly(expired); err != nil || !ro {
+		t.Fatalf("expected a read-only snapshot: %v", err)
+	}
+	alive, err := fs.CreateTempSubvolume("scratch", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := fs.CleanupExpired()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(deleted) != 1 || deleted[0] != expired {
+		t.Fatalf("unexpected deleted subvolumes: %q", deleted)
+	}
+	if _, err = os.Stat(alive); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	sb, err := fs.CreateSandbox("ci", 64*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(sb.Path(), "file"), make([]byte, 1024*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = CreateSubVolume(filepath.Join(sb.Path(), "nested")); err != nil {
+		t.Fatal(err)
+	}
+	if err = CreateSubVolume(filepath.Join(sb.Path(), "nested", "deeper")); err != nil {
+		t.Fatal(err)
+	}
+	q, err := sb.Usage()
+	if err != nil {
+		t.Fatal(err)
+	} else if q.MaxReferenced != 64*1024*1024 {
+		t.Fatalf("unexpected limit: %d", q.MaxReferenced)
+	} else if q.Referenced < 1024*1024 {
+		t.Fatalf("unexpected usage: %d", q.Referenced)
+	}
+	if err = sb.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(sb.Path()); !os.IsNotExist(err) {
+		t.Fatalf("sandbox was not deleted: %v", err)
+	}
+}
+
+func TestReceiveStaged(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err = fs.CreateSubVolume("sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.SnapshotSubVolume("sub", "snap", true); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(dir, "dst"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err = fs.Send(buf, "", "snap"); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// truncated stream must not leave anything in the destination
+	if _, err = fs.ReceiveStaged(bytes.NewReader(data[:len(data)/2]), "dst"); err == nil {
+		t.Fatal("expected an error for a truncated stream")
+	}
+	if list, err := ioutil.ReadDir(filepath.Join(dir, "dst")); err != nil {
+		t.Fatal(err)
+	} else if len(list) != 0 {
+		t.Fatalf("unexpected files after a failed receive: %v", list)
+	}
+	paths, err := fs.ReceiveStaged(bytes.NewReader(data), "dst")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(paths) != 1 || paths[0] != filepath.Join("dst", "snap") {
+		t.Fatalf("unexpected paths: %q", paths)
+	}
+	if _, err = fs.ReceiveStaged(bytes.NewReader(data), "dst"); err == nil {
+		t.Fatal("expected an error for an existing subvolume")
+	}
+}
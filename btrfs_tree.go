@@ -6,12 +6,19 @@ import (
 	"unsafe"
 )
 
+const (
+	blockGroupRaid1C3 blockGroup = (1 << 9)
+	blockGroupRaid1C4 blockGroup = (1 << 10)
+)
+
 const (
 	_BTRFS_BLOCK_GROUP_TYPE_MASK = (blockGroupData |
 		blockGroupSystem |
 		blockGroupMetadata)
 	_BTRFS_BLOCK_GROUP_PROFILE_MASK = (blockGroupRaid0 |
 		blockGroupRaid1 |
+		blockGroupRaid1C3 |
+		blockGroupRaid1C4 |
 		blockGroupRaid5 |
 		blockGroupRaid6 |
 		blockGroupDup |
@@ -191,6 +198,10 @@ type inodeItem struct {
 	OTime      time.Time
 }
 
+func asInodeItem(p []byte) *btrfs_inode_item_raw {
+	return (*btrfs_inode_item_raw)(unsafe.Pointer(&p[0]))
+}
+
 func asRootItem(p []byte) *btrfs_root_item_raw {
 	return (*btrfs_root_item_raw)(unsafe.Pointer(&p[0]))
 }
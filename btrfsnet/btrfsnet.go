@@ -0,0 +1,525 @@
+// Package btrfsnet implements a protocol to transfer send streams over a network connection
+// or a pair of pipes, for example stdio of a process started over SSH.
+//
+// The protocol is a sequence of length-prefixed frames. After a handshake, one side offers
+// a subvolume, the other side replies with an offset to resume the stream from (see
+// send.ReceiveCheckpoint), and the stream follows in data frames. Both sides send keepalive
+// frames when idle, so dead connections are detected on transports with read deadlines.
+//
+// Conn implements the protocol, and Push, Pull and Receiver build replication on top of it.
+package btrfsnet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dennwc/btrfs"
+)
+
+const (
+	magic = "BTRFSNET"
+	// Version is the version of the protocol.
+	Version = 1
+
+	frameHeaderSize = 5
+	maxFrameSize    = 1 << 20
+
+	defaultKeepalive = 30 * time.Second
+)
+
+type msgType byte
+
+const (
+	msgHello msgType = iota + 1
+	msgRequest
+	msgOffer
+	msgResume
+	msgData
+	msgEnd
+	msgResult
+	msgPing
+)
+
+func (t msgType) String() string {
+	switch t {
+	case msgHello:
+		return "hello"
+	case msgRequest:
+		return "request"
+	case msgOffer:
+		return "offer"
+	case msgResume:
+		return "resume"
+	case msgData:
+		return "data"
+	case msgEnd:
+		return "end"
+	case msgResult:
+		return "result"
+	case msgPing:
+		return "ping"
+	}
+	return fmt.Sprintf("msg(%d)", byte(t))
+}
+
+// RemoteError is an error reported by the other side of the connection.
+type RemoteError string
+
+func (e RemoteError) Error() string {
+	return "remote: " + string(e)
+}
+
+// ErrProtocol is returned when the other side violates the protocol.
+var ErrProtocol = errors.New("btrfsnet: protocol error")
+
+type hello struct {
+	Version   int   `json:"version"`
+	Keepalive int64 `json:"keepalive_ms,omitempty"`
+}
+
+// Request asks the other side to send a subvolume, see Conn.Request.
+type Request struct {
+	Subvolume string `json:"subvolume"`
+	Parent    string `json:"parent,omitempty"` // parent for an incremental stream
+}
+
+// Offer describes a subvolume that is about to be sent.
+type Offer struct {
+	Name       string     `json:"name"`
+	UUID       btrfs.UUID `json:"uuid"`
+	ParentUUID btrfs.UUID `json:"parent_uuid,omitempty"`
+	CTransID   uint64     `json:"ctransid"`
+}
+
+type resume struct {
+	Offset int64  `json:"offset"`
+	Error  string `json:"error,omitempty"`
+}
+
+type result struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Options controls the behavior of a connection.
+type Options struct {
+	// Keepalive is the interval of keepalive frames sent when the connection is idle.
+	// The default is 30 seconds; negative value disables keepalives.
+	Keepalive time.Duration
+	// Timeout is the maximal time without any frames from the other side, after which
+	// the connection is considered dead. The default is three keepalive intervals.
+	// It's only used if the reader supports read deadlines (e.g. net.Conn).
+	Timeout time.Duration
+}
+
+// Conn is a connection between two peers. Methods of Conn must not be called concurrently.
+type Conn struct {
+	r        *bufio.Reader
+	w        io.Writer
+	closers  []io.Closer
+	deadline interface{ SetReadDeadline(t time.Time) error }
+	opts     Options
+
+	wmu       sync.Mutex // protects w and lastWrite
+	lastWrite time.Time
+
+	done      chan struct{}
+	closeOnce sync.Once
+	peer      hello
+}
+
+// NewConn creates a connection over a reader and a writer. If they implement io.Closer,
+// they are closed by Close. Handshake must be called before any other method.
+func NewConn(r io.Reader, w io.Writer, opts *Options) *Conn {
+	c := &Conn{
+		r:    bufio.NewReaderSize(r, frameHeaderSize+maxFrameSize),
+		w:    w,
+		done: make(chan struct{}),
+	}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.Keepalive == 0 {
+		c.opts.Keepalive = defaultKeepalive
+	}
+	if c.opts.Timeout == 0 && c.opts.Keepalive > 0 {
+		c.opts.Timeout = 3 * c.opts.Keepalive
+	}
+	if d, ok := r.(interface{ SetReadDeadline(t time.Time) error }); ok {
+		c.deadline = d
+	}
+	if cl, ok := r.(io.Closer); ok {
+		c.closers = append(c.closers, cl)
+	}
+	if cl, ok := w.(io.Closer); ok && interface{}(w) != interface{}(r) {
+		c.closers = append(c.closers, cl)
+	}
+	return c
+}
+
+// Dial connects to a peer over the network and performs the handshake.
+func Dial(network, addr string, opts *Options) (*Conn, error) {
+	nc, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := NewConn(nc, nc, opts)
+	if err = c.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Stdio returns a connection over stdin and stdout of the process, for example
+// for a peer started over SSH. The handshake is not performed.
+func Stdio(opts *Options) *Conn {
+	return NewConn(os.Stdin, os.Stdout, opts)
+}
+
+// Handshake exchanges protocol versions with the other side and starts keepalives.
+func (c *Conn) Handshake() error {
+	h := hello{Version: Version, Keepalive: int64(c.opts.Keepalive / time.Millisecond)}
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	// both sides write first, so writes must not block reads on unbuffered transports
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.write(append([]byte(magic), frame(msgHello, data)...))
+	}()
+	if err = c.readHello(); err != nil {
+		return err
+	}
+	if err = <-errc; err != nil {
+		return err
+	}
+	if c.peer.Version != Version {
+		return fmt.Errorf("unsupported protocol version: %d", c.peer.Version)
+	}
+	if c.opts.Keepalive > 0 {
+		go c.keepalive()
+	}
+	return nil
+}
+
+func (c *Conn) readHello() error {
+	buf := make([]byte, len(magic))
+	if err := c.setDeadline(); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return err
+	} else if string(buf) != magic {
+		return fmt.Errorf("%v: not a btrfsnet peer", ErrProtocol)
+	}
+	return c.readJSON(msgHello, &c.peer)
+}
+
+// Close stops keepalives and closes the underlying reader and writer.
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		for _, cl := range c.closers {
+			if err2 := cl.Close(); err == nil {
+				err = err2
+			}
+		}
+	})
+	return err
+}
+
+func (c *Conn) keepalive() {
+	t := time.NewTicker(c.opts.Keepalive / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		c.wmu.Lock()
+		var err error
+		if time.Since(c.lastWrite) >= c.opts.Keepalive {
+			err = c.writeLocked(frame(msgPing, nil))
+		}
+		c.wmu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func frame(t msgType, data []byte) []byte {
+	buf := make([]byte, frameHeaderSize+len(data))
+	buf[0] = byte(t)
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(data)))
+	copy(buf[frameHeaderSize:], data)
+	return buf
+}
+
+func (c *Conn) write(p []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writeLocked(p)
+}
+
+func (c *Conn) writeLocked(p []byte) error {
+	_, err := c.w.Write(p)
+	c.lastWrite = time.Now()
+	return err
+}
+
+func (c *Conn) writeJSON(t msgType, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.write(frame(t, data))
+}
+
+func (c *Conn) setDeadline() error {
+	if c.deadline == nil || c.opts.Timeout <= 0 {
+		return nil
+	}
+	return c.deadline.SetReadDeadline(time.Now().Add(c.opts.Timeout))
+}
+
+// readFrame reads the next frame, skipping keepalives. The data is only valid until the next call.
+func (c *Conn) readFrame() (msgType, []byte, error) {
+	var hdr [frameHeaderSize]byte
+	for {
+		if err := c.setDeadline(); err != nil {
+			return 0, nil, err
+		}
+		if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+			return 0, nil, err
+		}
+		t := msgType(hdr[0])
+		n := binary.BigEndian.Uint32(hdr[1:])
+		if n > maxFrameSize {
+			return 0, nil, fmt.Errorf("%v: frame is too large: %d", ErrProtocol, n)
+		}
+		data, err := c.r.Peek(int(n))
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		c.r.Discard(int(n))
+		if t != msgPing {
+			return t, data, nil
+		}
+	}
+}
+
+// readJSON reads a frame of a given type. If the other side reports an error instead,
+// it's returned as RemoteError.
+func (c *Conn) readJSON(exp msgType, v interface{}) error {
+	t, data, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	if t == msgResult && exp != msgResult {
+		var r result
+		if err = json.Unmarshal(data, &r); err == nil && r.Error != "" {
+			return RemoteError(r.Error)
+		}
+	}
+	if t != exp {
+		return fmt.Errorf("%v: expected %v, got %v", ErrProtocol, exp, t)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%v: invalid %v: %v", ErrProtocol, t, err)
+	}
+	return nil
+}
+
+// Request asks the other side to send a subvolume. It should be followed by ReceiveStream.
+func (c *Conn) Request(req Request) error {
+	return c.writeJSON(msgRequest, req)
+}
+
+// ReadRequest waits for a request from the other side. It returns io.EOF if the other side
+// closed the connection. The request should be answered with SendStream, or with Reject.
+func (c *Conn) ReadRequest() (*Request, error) {
+	var req Request
+	if err := c.readJSON(msgRequest, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// Reject reports an error to the other side instead of a stream it waits for.
+func (c *Conn) Reject(err error) error {
+	return c.writeJSON(msgResult, result{Error: err.Error()})
+}
+
+// SendStream offers a subvolume to the other side and calls src to write the stream.
+// The stream must be written starting from the offset requested by the receiver,
+// for example with send.ResumeWriter. It returns an error from src, or an error
+// of the receiver.
+func (c *Conn) SendStream(o Offer, src func(w io.Writer, off int64) error) error {
+	if err := c.writeJSON(msgOffer, o); err != nil {
+		return err
+	}
+	var res resume
+	if err := c.readJSON(msgResume, &res); err != nil {
+		return err
+	} else if res.Error != "" {
+		return RemoteError(res.Error)
+	} else if res.Offset < 0 {
+		return fmt.Errorf("%v: invalid resume offset: %d", ErrProtocol, res.Offset)
+	}
+	// the receiver may fail early, so its result is read concurrently to stop sending
+	resc := make(chan error, 1)
+	go func() {
+		var r result
+		err := c.readJSON(msgResult, &r)
+		if err == nil && r.Error != "" {
+			err = RemoteError(r.Error)
+		}
+		resc <- err
+	}()
+	dw := &dataWriter{c: c, resc: resc}
+	err := src(dw, res.Offset)
+	var end result
+	if err != nil {
+		end.Error = err.Error()
+	}
+	if err2 := c.writeJSON(msgEnd, end); err == nil {
+		err = err2
+	}
+	rerr := dw.result()
+	if dw.early || err == nil {
+		// the receiver error explains why src failed
+		err = rerr
+	}
+	return err
+}
+
+type dataWriter struct {
+	c     *Conn
+	resc  chan error
+	early bool // result was received before the end of the stream
+	err   error
+}
+
+func (w *dataWriter) result() error {
+	if !w.early {
+		w.err = <-w.resc
+	}
+	return w.err
+}
+
+func (w *dataWriter) Write(p []byte) (int, error) {
+	select {
+	case w.err = <-w.resc:
+		w.early = true
+		if w.err == nil {
+			w.err = fmt.Errorf("%v: receiver completed before the end of the stream", ErrProtocol)
+		}
+	default:
+	}
+	if w.early {
+		return 0, w.err
+	}
+	total := len(p)
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		if err := w.c.write(frame(msgData, p[:n])); err != nil {
+			return total - len(p), err
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// ReceiveStream waits for a subvolume offered by the other side. The resume function returns
+// the offset to resume the stream from (zero for a new stream), and dst is called to read the stream.
+// It returns the offer and an error from resume or dst, which is reported to the sender as well.
+//
+// It returns io.EOF if the other side closed the connection before offering a subvolume.
+func (c *Conn) ReceiveStream(resumeFn func(o Offer) (int64, error), dst func(o Offer, r io.Reader) error) (*Offer, error) {
+	var o Offer
+	if err := c.readJSON(msgOffer, &o); err != nil {
+		return nil, err
+	}
+	off, err := resumeFn(o)
+	if err != nil {
+		c.writeJSON(msgResume, resume{Error: err.Error()})
+		return &o, err
+	}
+	if err = c.writeJSON(msgResume, resume{Offset: off}); err != nil {
+		return &o, err
+	}
+	dr := &dataReader{c: c}
+	err = dst(o, dr)
+	var res result
+	if err != nil {
+		res.Error = err.Error()
+	}
+	if err2 := c.writeJSON(msgResult, res); err == nil {
+		err = err2
+	}
+	if !dr.eof && dr.err == nil {
+		// skip the rest of the stream; the sender stops after reading the result
+		if _, err2 := io.Copy(ioutil.Discard, dr); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	return &o, err
+}
+
+type dataReader struct {
+	c   *Conn
+	buf []byte
+	eof bool
+	err error
+}
+
+func (r *dataReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		} else if r.eof {
+			return 0, io.EOF
+		}
+		t, data, err := r.c.readFrame()
+		if err != nil {
+			r.err = err
+			continue
+		}
+		switch t {
+		case msgData:
+			r.buf = data
+		case msgEnd:
+			r.eof = true
+			var res result
+			if err = json.Unmarshal(data, &res); err != nil {
+				r.err = fmt.Errorf("%v: invalid %v: %v", ErrProtocol, t, err)
+			} else if res.Error != "" {
+				r.err = RemoteError(res.Error)
+			}
+		default:
+			r.err = fmt.Errorf("%v: unexpected %v in the stream", ErrProtocol, t)
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
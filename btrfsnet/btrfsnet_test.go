@@ -0,0 +1,171 @@
+package btrfsnet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func testPair(t *testing.T, opts1, opts2 *Options) (*Conn, *Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	errc := make(chan error, 1)
+	var server *Conn
+	go func() {
+		nc, err := l.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		server = NewConn(nc, nc, opts2)
+		errc <- server.Handshake()
+	}()
+	client, err := Dial("tcp", l.Addr().String(), opts1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// transfer sends data from c1 to c2 with given callbacks.
+func transfer(c1, c2 *Conn, src func(w io.Writer, off int64) error,
+	resume func(o Offer) (int64, error), dst func(o Offer, r io.Reader) error) (error, error) {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c1.SendStream(Offer{Name: "sub"}, src)
+	}()
+	_, err := c2.ReceiveStream(resume, dst)
+	return <-errc, err
+}
+
+func TestTransfer(t *testing.T) {
+	c1, c2 := testPair(t, nil, nil)
+	defer c1.Close()
+	defer c2.Close()
+
+	data := make([]byte, 3*maxFrameSize+100)
+	rand.Read(data)
+	var (
+		got []byte
+		off int64
+	)
+	src := func(w io.Writer, o int64) error {
+		off = o
+		_, err := w.Write(data[o:])
+		return err
+	}
+	dst := func(o Offer, r io.Reader) error {
+		if o.Name != "sub" {
+			return errors.New("unexpected name: " + o.Name)
+		}
+		var err error
+		got, err = ioutil.ReadAll(r)
+		return err
+	}
+	noResume := func(o Offer) (int64, error) { return 0, nil }
+	if err1, err2 := transfer(c1, c2, src, noResume, dst); err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	} else if !bytes.Equal(got, data) {
+		t.Fatal("data differs")
+	}
+
+	// resume from an offset
+	resume := func(o Offer) (int64, error) { return 100, nil }
+	if err1, err2 := transfer(c1, c2, src, resume, dst); err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	} else if off != 100 || !bytes.Equal(got, data[100:]) {
+		t.Fatalf("unexpected resume: offset %d, %d bytes", off, len(got))
+	}
+
+	// receiver fails in the middle of the stream
+	failDst := func(o Offer, r io.Reader) error {
+		io.ReadFull(r, make([]byte, 10))
+		return errors.New("disk full")
+	}
+	err1, err2 := transfer(c1, c2, src, noResume, failDst)
+	if err1 != RemoteError("disk full") || err2 == nil {
+		t.Fatalf("unexpected errors: %v, %v", err1, err2)
+	}
+
+	// sender fails
+	failSrc := func(w io.Writer, off int64) error {
+		w.Write(data[:10])
+		return errors.New("send failed")
+	}
+	err1, err2 = transfer(c1, c2, failSrc, noResume, dst)
+	if err1 == nil || err2 != RemoteError("send failed") {
+		t.Fatalf("unexpected errors: %v, %v", err1, err2)
+	}
+
+	// the connection is still usable
+	if err1, err2 := transfer(c1, c2, src, noResume, dst); err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	c1, c2 := testPair(t, nil, nil)
+	defer c1.Close()
+	defer c2.Close()
+
+	if err := c1.Request(Request{Subvolume: "snap"}); err != nil {
+		t.Fatal(err)
+	}
+	req, err := c2.ReadRequest()
+	if err != nil {
+		t.Fatal(err)
+	} else if req.Subvolume != "snap" {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+	if err = c2.Reject(errors.New("no such subvolume")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c1.ReceiveStream(nil, nil)
+	if err != RemoteError("no such subvolume") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c1.Close()
+	if _, err = c2.ReadRequest(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	opts := &Options{Keepalive: 20 * time.Millisecond}
+	c1, c2 := testPair(t, opts, opts)
+	defer c1.Close()
+	defer c2.Close()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c2.ReadRequest()
+		errc <- err
+	}()
+	// idle for longer than the timeout
+	time.Sleep(200 * time.Millisecond)
+	if err := c1.Request(Request{Subvolume: "snap"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	// a peer without keepalives is considered dead
+	c3, c4 := testPair(t, opts, &Options{Keepalive: -1})
+	defer c3.Close()
+	defer c4.Close()
+	_, err := c3.ReadRequest()
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
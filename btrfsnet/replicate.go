@@ -0,0 +1,176 @@
+package btrfsnet
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/send"
+)
+
+func subvolInfo(path string) (*btrfs.SubvolInfo, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := btrfs.Open(path, true)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+	return fs.SubvolumeByPath(path)
+}
+
+func newOffer(subvol, parent string) (*Offer, error) {
+	info, err := subvolInfo(subvol)
+	if err != nil {
+		return nil, err
+	}
+	o := &Offer{Name: filepath.Base(subvol), UUID: info.UUID, CTransID: info.CTransID}
+	if parent != "" {
+		pinfo, err := subvolInfo(parent)
+		if err != nil {
+			return nil, err
+		}
+		o.ParentUUID = pinfo.UUID
+	}
+	return o, nil
+}
+
+// Push sends a read-only subvolume to the other side, which must receive it with ReceiveStream
+// (see Receiver). The stream is incremental from parent, if it's set. If the receiver has a checkpoint
+// of an interrupted transfer of the same subvolume, the stream is resumed from it.
+func Push(c *Conn, subvol, parent string) error {
+	o, err := newOffer(subvol, parent)
+	if err != nil {
+		return err
+	}
+	return push(c, o, subvol, parent)
+}
+
+func push(c *Conn, o *Offer, subvol, parent string) error {
+	return c.SendStream(*o, func(w io.Writer, off int64) error {
+		if off > 0 {
+			w = send.ResumeWriter(w, &send.ReceiveCheckpoint{Offset: off})
+		}
+		return btrfs.Send(w, parent, subvol)
+	})
+}
+
+// Receiver receives subvolumes into a local directory.
+type Receiver struct {
+	// Dir is the directory to receive subvolumes into.
+	Dir string
+	// StateDir is a directory for checkpoints of interrupted transfers. If it's empty,
+	// transfers cannot be resumed.
+	StateDir string
+	// Options are passed to send.Receive. The state file is set from StateDir.
+	Options send.ReceiveOptions
+}
+
+func (r *Receiver) stateFile(o Offer) string {
+	if r.StateDir == "" {
+		return ""
+	}
+	return filepath.Join(r.StateDir, o.UUID.String()+".json")
+}
+
+func (r *Receiver) resume(o Offer) (int64, error) {
+	path := r.stateFile(o)
+	if path == "" {
+		return 0, nil
+	}
+	cp, err := send.ReadCheckpoint(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if cp.UUID != o.UUID || cp.CTransID != o.CTransID {
+		return 0, fmt.Errorf("checkpoint %s is for a different subvolume", path)
+	}
+	return cp.Offset, nil
+}
+
+func (r *Receiver) receive(o Offer, rd io.Reader) error {
+	opts := r.Options
+	opts.StateFile = r.stateFile(o)
+	_, err := send.Receive(rd, r.Dir, &opts)
+	return err
+}
+
+// ReceiveOne receives a single subvolume offered by the other side.
+func (r *Receiver) ReceiveOne(c *Conn) (*Offer, error) {
+	return c.ReceiveStream(r.resume, r.receive)
+}
+
+// Serve receives subvolumes until the other side closes the connection.
+func (r *Receiver) Serve(c *Conn) error {
+	for {
+		if _, err := r.ReceiveOne(c); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Pull requests a subvolume from the other side (see ServePull), and receives it with r.
+func Pull(c *Conn, r *Receiver, req Request) (*Offer, error) {
+	if err := c.Request(req); err != nil {
+		return nil, err
+	}
+	return r.ReceiveOne(c)
+}
+
+// ServePull serves requests of the other side made with Pull, until it closes the connection.
+// Only read-only subvolumes in dir can be requested, and names in requests are relative to it.
+// Invalid requests are rejected; other errors stop serving.
+func ServePull(c *Conn, dir string) error {
+	for {
+		req, err := c.ReadRequest()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var (
+			o      *Offer
+			parent string
+		)
+		subvol, err := servedPath(dir, req.Subvolume)
+		if err == nil && req.Parent != "" {
+			parent, err = servedPath(dir, req.Parent)
+		}
+		if err == nil {
+			o, err = newOffer(subvol, parent)
+		}
+		if err != nil {
+			if err = c.Reject(err); err != nil {
+				return err
+			}
+			continue
+		}
+		// errors of the stream are reported to the other side
+		if err = push(c, o, subvol, parent); err != nil {
+			if _, ok := err.(RemoteError); !ok {
+				return err
+			}
+		}
+	}
+}
+
+func servedPath(dir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return "", fmt.Errorf("invalid subvolume name: %q", name)
+	}
+	path := filepath.Join(dir, name)
+	if ok, err := btrfs.IsReadOnly(path); err != nil {
+		return "", err
+	} else if !ok {
+		return "", fmt.Errorf("subvolume %q is not read-only", name)
+	}
+	return path, nil
+}
@@ -0,0 +1,167 @@
+package btrfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// CloneAcrossSubvolumes creates a reflink copy of srcPath at dstPath.
+// An existing destination file is replaced, unless it is the source file itself.
+// If the clone fails, a destination file created by the call is removed.
+//
+// Both files may live in different subvolumes, or even be reached through
+// different mounts, as long as they belong to the same filesystem (same fsid).
+// Kernels before 5.18 reject clones between different mounts of the same
+// filesystem with EXDEV; in this case the source is reopened through the
+// destination mount, if it is reachable from there.
+func CloneAcrossSubvolumes(dstPath, srcPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	st, err := src.Stat()
+	if err != nil {
+		return err
+	} else if !st.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file: %s", srcPath)
+	}
+	srcFSID, err := fileFSID(src)
+	if err != nil {
+		return err
+	}
+	// check the destination directory first, so the destination is not touched if the clone is rejected
+	dir, err := os.Open(filepath.Dir(dstPath))
+	if err != nil {
+		return err
+	}
+	dstFSID, err := fileFSID(dir)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	if srcFSID != dstFSID {
+		return fmt.Errorf("%s and %s are on different filesystems (%v vs %v)",
+			srcPath, dstPath, srcFSID, dstFSID)
+	}
+	_, err = os.Lstat(dstPath)
+	created := os.IsNotExist(err)
+	// the destination is truncated only after checking that it's not the source itself,
+	// which may be reached through a hardlink or a symlink
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE, st.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if dst2, err := dst.Stat(); err != nil {
+		return err
+	} else if os.SameFile(st, dst2) {
+		return fmt.Errorf("%s and %s are the same file", srcPath, dstPath)
+	}
+	if err = dst.Truncate(0); err == nil {
+		err = cloneFile(dst, src, srcPath, dstPath)
+	}
+	if err != nil && created {
+		dst.Close()
+		os.Remove(dstPath)
+	}
+	return err
+}
+
+// cloneFile clones src into dst, reopening the source through the destination mount if necessary.
+func cloneFile(dst, src *os.File, srcPath, dstPath string) error {
+	err := iocClone(dst, src)
+	if err != syscall.EXDEV {
+		return err
+	}
+	// Same filesystem, but the kernel refused to clone between mounts.
+	alt, err2 := reopenThroughMount(src, srcPath, dstPath)
+	if err2 != nil {
+		return fmt.Errorf("cannot clone %s to %s across mounts: %v (%v)", srcPath, dstPath, err, err2)
+	}
+	defer alt.Close()
+	return iocClone(dst, alt)
+}
+
+// fileFSID returns an fsid of a btrfs filesystem the file belongs to.
+func fileFSID(f *os.File) (FSID, error) {
+	if ok, err := isBtrfs(f.Name()); err != nil {
+		return FSID{}, err
+	} else if !ok {
+		return FSID{}, ErrNotBtrfs{Path: f.Name()}
+	}
+	info, err := iocFsInfo(f)
+	if err != nil {
+		return FSID{}, err
+	}
+	return FSID(info.FSID), nil
+}
+
+// reopenThroughMount opens the source file using a path that is reachable from
+// the mount where dstPath is located.
+func reopenThroughMount(src *os.File, srcPath, dstPath string) (*os.File, error) {
+	dstPath, err := filepath.Abs(dstPath)
+	if err != nil {
+		return nil, err
+	}
+	mnt, err := findMountRoot(dstPath)
+	if err != nil {
+		return nil, err
+	}
+	mfs, err := Open(mnt, true)
+	if err != nil {
+		return nil, err
+	}
+	defer mfs.Close()
+	srcRoot, err := getFileRootID(src)
+	if err != nil {
+		return nil, err
+	}
+	subPath, err := mfs.subvolMountPath(srcRoot)
+	if err != nil {
+		return nil, err
+	}
+	// path of the source directory relative to its subvolume
+	var dirSt syscall.Stat_t
+	if err := syscall.Stat(filepath.Dir(srcPath), &dirSt); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: filepath.Dir(srcPath), Err: err}
+	}
+	dirPath := ""
+	if objectID(dirSt.Ino) != firstFreeObjectid {
+		arg := btrfs_ioctl_ino_lookup_args{
+			TreeID:   uint64(srcRoot),
+			ObjectID: dirSt.Ino,
+		}
+		if err := iocInoLookup(mfs.f, &arg); err != nil {
+			return nil, err
+		}
+		dirPath = inoLookupName(&arg)
+	}
+	path := filepath.Join(subPath, dirPath, filepath.Base(srcPath))
+	alt, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// make sure that we opened the same file
+	var st1, st2 syscall.Stat_t
+	if err := syscall.Fstat(int(src.Fd()), &st1); err != nil {
+		alt.Close()
+		return nil, err
+	} else if err := syscall.Fstat(int(alt.Fd()), &st2); err != nil {
+		alt.Close()
+		return nil, err
+	}
+	if st1.Ino != st2.Ino {
+		alt.Close()
+		return nil, fmt.Errorf("%s is not the same file as %s", path, srcPath)
+	} else if id, err := getFileRootID(alt); err != nil {
+		alt.Close()
+		return nil, err
+	} else if id != srcRoot {
+		alt.Close()
+		return nil, fmt.Errorf("%s is not the same file as %s", path, srcPath)
+	}
+	return alt, nil
+}
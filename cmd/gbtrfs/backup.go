@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/ledger"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(BackupCmd)
+	BackupCmd.Flags().String("ledger", "", "ledger file (default: <dest>/.gbtrfs-ledger.json)")
+	BackupCmd.Flags().String("snapshots", "", "directory for source snapshots (default: parent of <subvol>)")
+}
+
+const ledgerName = ".gbtrfs-ledger.json"
+
+var BackupCmd = &cobra.Command{
+	Use:   "backup [--ledger <file>] [--snapshots <dir>] <subvol> <dest>",
+	Short: "Snapshot a subvolume and send it to <dest>.",
+	Long: `Creates a read-only snapshot of <subvol> and receives it into <dest>.
+The last snapshot recorded in the ledger is used as a parent for an incremental
+transfer. If the previous run was interrupted, the same snapshot is sent again
+instead of creating a new one.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return fmt.Errorf("expected subvolume and destination arguments")
+		}
+		subvol, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+		dst, err := filepath.Abs(args[1])
+		if err != nil {
+			return err
+		}
+		ledgerPath, _ := cmd.Flags().GetString("ledger")
+		if ledgerPath == "" {
+			ledgerPath = filepath.Join(dst, ledgerName)
+		}
+		snapDir, _ := cmd.Flags().GetString("snapshots")
+		if snapDir == "" {
+			snapDir = filepath.Dir(subvol)
+		}
+		l, err := ledger.Open(ledgerPath)
+		if err != nil {
+			return err
+		}
+		var cur ledger.Entry
+		// resume an interrupted transfer, if its snapshot still exists
+		for _, e := range l.Pending(subvol, dst) {
+			if ok, _ := btrfs.IsSubVolume(e.Snapshot); ok {
+				cur = e
+			} else if err = l.Remove(e.Snapshot, dst); err != nil {
+				return err
+			}
+		}
+		if cur.Snapshot == "" {
+			now := time.Now().UTC()
+			cur = ledger.Entry{
+				Subvolume: subvol,
+				Snapshot:  filepath.Join(snapDir, filepath.Base(subvol)+"."+now.Format("20060102T150405Z")),
+				Target:    dst,
+				Created:   now,
+			}
+			if err = btrfs.SnapshotSubVolume(subvol, cur.Snapshot, true); err != nil {
+				return err
+			}
+		} else {
+			fmt.Fprintln(os.Stderr, "resuming transfer of", cur.Snapshot)
+		}
+		if cur.UUID, err = subvolumeUUID(cur.Snapshot); err != nil {
+			return err
+		}
+		// use the most recent snapshot that reached the target as a parent
+		cur.Parent = ""
+		sent := l.Sent(subvol, dst)
+		for i := len(sent) - 1; i >= 0; i-- {
+			e := sent[i]
+			if !e.Created.Before(cur.Created) {
+				continue
+			}
+			if ok, _ := btrfs.IsSubVolume(e.Snapshot); ok {
+				cur.Parent = e.Snapshot
+				break
+			}
+		}
+		// remove leftovers of the interrupted receive; receive sets the received uuid only
+		// after the whole stream is applied, thus other subvolumes with the same name are kept
+		partial := filepath.Join(dst, filepath.Base(cur.Snapshot))
+		if ok, _ := btrfs.IsSubVolume(partial); ok {
+			if info, err := subvolumeInfo(partial); err != nil {
+				return err
+			} else if !info.ReceivedUUID.IsZero() && info.ReceivedUUID != cur.UUID {
+				return fmt.Errorf("%s already exists and is not a partial receive of %s", partial, cur.Snapshot)
+			}
+			if err = btrfs.DeleteSubVolume(partial); err != nil {
+				return err
+			}
+		}
+		if err = l.Begin(cur); err != nil {
+			return err
+		}
+		n, err := transfer(dst, cur.Parent, cur.Snapshot)
+		if err != nil {
+			return err
+		}
+		if err = l.Finish(cur.Snapshot, dst, n); err != nil {
+			return err
+		}
+		if cur.Parent != "" {
+			fmt.Printf("sent %s (parent %s) to %s: %s\n", cur.Snapshot, cur.Parent, dst, fmtSize(n))
+		} else {
+			fmt.Printf("sent %s to %s: %s\n", cur.Snapshot, dst, fmtSize(n))
+		}
+		return nil
+	},
+}
+
+func subvolumeUUID(path string) (btrfs.UUID, error) {
+	info, err := subvolumeInfo(path)
+	if err != nil {
+		return btrfs.UUID{}, err
+	}
+	return info.UUID, nil
+}
+
+func subvolumeInfo(path string) (*btrfs.SubvolInfo, error) {
+	fs, err := btrfs.Open(path, true)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+	return fs.SubvolumeByPath(path)
+}
+
+// transfer sends the snapshot and receives it into dst, returning the size of the stream.
+func transfer(dst, parent, snap string) (uint64, error) {
+	pr, pw := io.Pipe()
+	cw := &countingWriter{w: summaryWriter{pw}}
+	errc := make(chan error, 1)
+	go func() {
+		err := btrfs.Send(cw, parent, snap)
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+	err := btrfs.Receive(pr, dst)
+	pr.Close()
+	if err2 := <-errc; err2 != nil {
+		err = err2
+	}
+	return cw.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += uint64(n)
+	return n, err
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/units"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(BalanceCmd)
+	BalanceCmd.AddCommand(
+		BalanceStartCmd,
+		BalanceStatusCmd,
+		BalancePauseCmd,
+		BalanceResumeCmd,
+		BalanceCancelCmd,
+		BalanceRecommendCmd,
+		BalanceQuickCmd,
+	)
+	BalanceStartCmd.Flags().StringP("data", "d", "", "Filters for data block groups, e.g. -dusage=50 or -dconvert=raid1 (empty to relocate all of them).")
+	BalanceStartCmd.Flags().StringP("metadata", "m", "", "Filters for metadata block groups, e.g. -musage=50 or -mconvert=raid1 (empty to relocate all of them).")
+	BalanceStartCmd.Flags().StringP("system", "s", "", "Filters for system block groups (same as metadata, if not set).")
+	BalanceStartCmd.Flags().BoolP("force", "f", false, "Allow to reduce the redundancy of metadata.")
+	BalanceStartCmd.Flags().Bool("full-balance", false, "Relocate all block groups, if no filters are given.")
+	BalanceStartCmd.Flags().Bool("background", false, "Run the balance in the background.")
+	BalanceStartCmd.Flags().Bool("progress", false, "Print the progress of the balance to stderr.")
+	BalanceStartCmd.Flags().Bool("dry-run", false, "Print block groups that would be relocated, without starting the balance.")
+	BalanceRecommendCmd.Flags().Bool("run", false, "run the recommended balance")
+	BalanceQuickCmd.Flags().Uint64("usage", btrfs.QuickBalanceUsage, "relocate block groups used less than this percent")
+	BalanceQuickCmd.Flags().String("free", "", "escalate the usage filter until this much space is unallocated, e.g. 10G")
+	BalanceRecommendCmd.Flags().String("goal", "", "desired unallocated space, e.g. 10G (default 5% of the filesystem, at least 2 GiB)")
+}
+
+var BalanceCmd = &cobra.Command{
+	Use: "balance <command> <args>",
+}
+
+// balanceOptions returns balance options selected by the filter flags.
+func balanceOptions(cmd *cobra.Command) (btrfs.BalanceOptions, error) {
+	var opts btrfs.BalanceOptions
+	for _, f := range []struct {
+		name string
+		dst  **btrfs.BalanceArgs
+	}{
+		{"data", &opts.Data},
+		{"metadata", &opts.Metadata},
+		{"system", &opts.System},
+	} {
+		if !cmd.Flags().Changed(f.name) {
+			continue
+		}
+		s, _ := cmd.Flags().GetString(f.name)
+		a, err := btrfs.ParseBalanceArgs(s)
+		if err != nil {
+			return opts, fmt.Errorf("--%s: %v", f.name, err)
+		}
+		*f.dst = a
+	}
+	opts.Force, _ = cmd.Flags().GetBool("force")
+	full, _ := cmd.Flags().GetBool("full-balance")
+	if opts.Data == nil && opts.Metadata == nil && opts.System == nil && !full {
+		return opts, fmt.Errorf("no filters given, use --full-balance to relocate all block groups")
+	}
+	return opts, nil
+}
+
+// balanceRunning checks if a balance is running or paused.
+func balanceRunning(fs *btrfs.FS) bool {
+	_, _, err := fs.BalanceStatus()
+	return err == nil
+}
+
+// printBalancePlan prints block groups that would be relocated by a balance.
+func printBalancePlan(fs *btrfs.FS, opts btrfs.BalanceOptions) error {
+	p, err := fs.PlanBalance(opts)
+	if err != nil {
+		return err
+	}
+	for _, bg := range p.BlockGroups {
+		fmt.Printf("%-16s %-8s %12d %10s %5.1f%%\n", bg.Type, bg.Profile, bg.Start, fmtSize(bg.Length), bg.Usage())
+	}
+	fmt.Printf("would relocate %d block groups, %s total, %s used\n", len(p.BlockGroups), fmtSize(p.Length), fmtSize(p.Used))
+	return nil
+}
+
+// printBalanceDone prints the result of a balance.
+func printBalanceDone(p btrfs.BalanceProgress, err error) error {
+	if err == syscall.ECANCELED || err == context.Canceled {
+		fmt.Printf("balance paused or canceled: %d out of %d chunks relocated\n", p.Completed, p.Considered)
+		return err
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("Done, had to relocate %d out of %d chunks\n", p.Completed, p.Considered)
+	return nil
+}
+
+var BalanceStartCmd = &cobra.Command{
+	Use:   "start [-d<filters>] [-m<filters>] [-s<filters>] [-f] [--full-balance] [--background] [--dry-run] <mount>",
+	Short: "Balance block groups of the filesystem.",
+	Long: `Relocates block groups matching the filters, to reclaim space or to convert them to another profile.
+Filters are the same as in btrfs-progs, e.g. -dusage=50,limit=10 or -mconvert=raid1,soft.
+Without filters, --full-balance is required to relocate all block groups.
+The command waits for the balance to finish, interrupting it cancels the balance.
+With --background, the balance runs in a separate process and the command returns once it has started.
+With --dry-run, block groups that would be relocated are printed instead.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected one mount argument")
+		}
+		opts, err := balanceOptions(cmd)
+		if err != nil {
+			return err
+		}
+		fs, err := btrfs.Open(args[0], false)
+		if err != nil {
+			return err
+		}
+		defer fs.Close()
+		if dry, _ := cmd.Flags().GetBool("dry-run"); dry {
+			return printBalancePlan(fs, opts)
+		}
+		if bg, _ := cmd.Flags().GetBool("background"); bg {
+			if balanceRunning(fs) {
+				return fmt.Errorf("balance is already running: %v", syscall.EINPROGRESS)
+			}
+			// report problems of conversions before the balance runs in the background
+			if err = fs.CheckBalanceConvert(opts); err != nil {
+				return err
+			}
+			pid, err := detach("--background=false", func() bool { return balanceRunning(fs) })
+			if err != nil {
+				return err
+			}
+			fmt.Printf("balance started in the background, pid %d\n", pid)
+			return nil
+		}
+		var fn btrfs.BalanceProgressFunc
+		if progress, _ := cmd.Flags().GetBool("progress"); progress {
+			fn = func(p btrfs.BalanceProgress) {
+				fmt.Fprintf(os.Stderr, "%d out of about %d chunks balanced (%d considered)\n", p.Completed, p.Expected, p.Considered)
+			}
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		h, err := fs.BalanceAsync(ctx, opts, fn)
+		if err != nil {
+			return err
+		}
+		return printBalanceDone(h.Wait())
+	},
+}
+
+var BalanceStatusCmd = &cobra.Command{
+	Use:   "status <mount>",
+	Short: "Print the status of a running or paused balance.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected one mount argument")
+		}
+		fs, err := btrfs.Open(args[0], true)
+		if err != nil {
+			return err
+		}
+		defer fs.Close()
+		st, err := fs.BalanceState()
+		if err != nil {
+			return err
+		}
+		switch st {
+		case btrfs.BalanceNone:
+			fmt.Printf("No balance found on '%s'\n", args[0])
+			return nil
+		case btrfs.BalancePendingResume:
+			fmt.Printf("Balance on '%s' is interrupted, it will be resumed at read-write mount\n", args[0])
+		}
+		p, state, err := fs.BalanceStatus()
+		if err == syscall.ENOTCONN {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		s := "paused"
+		if state&btrfs.BalanceStateRunning != 0 {
+			s = "running"
+		}
+		if state&btrfs.BalanceStateCancelReq != 0 {
+			s += ", cancel requested"
+		} else if state&btrfs.BalanceStatePauseReq != 0 {
+			s += ", pause requested"
+		}
+		fmt.Printf("Balance on '%s' is %s\n", args[0], s)
+		left := 100.0
+		if p.Expected != 0 {
+			left = 100 * (1 - float64(p.Completed)/float64(p.Expected))
+		}
+		fmt.Printf("%d out of about %d chunks balanced (%d considered), %3.f%% left\n", p.Completed, p.Expected, p.Considered, left)
+		return nil
+	},
+}
+
+var BalancePauseCmd = &cobra.Command{
+	Use:   "pause <mount>",
+	Short: "Pause a running balance.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return balanceCtl(args, (*btrfs.FS).BalancePause)
+	},
+}
+
+var BalanceCancelCmd = &cobra.Command{
+	Use:   "cancel <mount>",
+	Short: "Cancel a running or paused balance.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return balanceCtl(args, (*btrfs.FS).BalanceCancel)
+	},
+}
+
+// balanceCtl runs a balance control operation on the mount given in args.
+func balanceCtl(args []string, fn func(fs *btrfs.FS) error) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected one mount argument")
+	}
+	fs, err := btrfs.Open(args[0], false)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	if err = fn(fs); err == syscall.ENOTCONN {
+		return fmt.Errorf("no balance found on '%s'", args[0])
+	}
+	return err
+}
+
+var BalanceResumeCmd = &cobra.Command{
+	Use:   "resume <mount>",
+	Short: "Resume a paused balance and wait for it to finish.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected one mount argument")
+		}
+		fs, err := btrfs.Open(args[0], false)
+		if err != nil {
+			return err
+		}
+		defer fs.Close()
+		p, err := fs.BalanceResume()
+		if err == syscall.ENOTCONN {
+			return fmt.Errorf("no paused balance found on '%s'", args[0])
+		} else if err == syscall.EINPROGRESS {
+			return fmt.Errorf("balance on '%s' is already running", args[0])
+		}
+		return printBalanceDone(p, err)
+	},
+}
+
+var BalanceRecommendCmd = &cobra.Command{
+	Use:   "recommend [--run] [--goal <size>] <mount>",
+	Short: "Recommend a minimal balance to relieve allocation pressure.",
+	Long: `Inspects usage of block groups and unallocated space and prints the smallest
+usage filters that are expected to bring unallocated space up to the goal.
+With --run, the recommended balance is started and the command waits for it to finish.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected one mount argument")
+		}
+		run, _ := cmd.Flags().GetBool("run")
+		var goal uint64
+		if s, _ := cmd.Flags().GetString("goal"); s != "" {
+			v, err := units.Parse(s)
+			if err != nil {
+				return err
+			}
+			goal = v
+		}
+		fs, err := btrfs.Open(args[0], false)
+		if err != nil {
+			return err
+		}
+		defer fs.Close()
+		r, err := fs.RecommendBalance(goal)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("unallocated: %s, goal: %s\n", fmtSize(r.Unallocated), fmtSize(r.Goal))
+		if !r.Needed() {
+			if r.Sufficient {
+				fmt.Println("no balance needed")
+			} else {
+				fmt.Println("no balance can reclaim space, consider adding a device or deleting data")
+			}
+			return nil
+		}
+		fmt.Printf("recommended: btrfs balance start %s %s\n", strings.Join(r.Args(), " "), args[0])
+		fmt.Printf("relocates %d block groups, expected to reclaim %s\n", r.Chunks, fmtSize(r.Reclaim))
+		if !r.Sufficient {
+			fmt.Println("warning: the goal is not expected to be reached")
+		}
+		if !run {
+			return nil
+		}
+		st, err := fs.BalanceStart(r.Options())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("balance done: %d of %d block groups relocated\n", st.Completed, st.Considered)
+		return nil
+	},
+}
+
+var BalanceQuickCmd = &cobra.Command{
+	Use:   "quick [--usage <percent>] [--free <size>] <mount>",
+	Short: "Reclaim nearly empty block groups.",
+	Long: `Relocates data and metadata block groups that are almost empty, same as
+"btrfs balance start -dusage=5 -musage=5". With --free, balances with escalating
+usage filters are run until the given amount of space becomes unallocated.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected one mount argument")
+		}
+		fs, err := btrfs.Open(args[0], false)
+		if err != nil {
+			return err
+		}
+		defer fs.Close()
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		if s, _ := cmd.Flags().GetString("free"); s != "" {
+			free, err := units.Parse(s)
+			if err != nil {
+				return err
+			}
+			r, err := fs.ReclaimSpace(ctx, free, func(s btrfs.ReclaimStep) {
+				fmt.Printf("usage=%d: %d of %d block groups relocated, unallocated: %s\n",
+					s.Usage, s.Progress.Completed, s.Progress.Considered, fmtSize(s.Unallocated))
+			})
+			if r != nil {
+				fmt.Printf("freed %s\n", fmtSize(r.Freed()))
+			}
+			if err != nil {
+				return err
+			} else if r.Freed() < free {
+				return fmt.Errorf("could not free %s", fmtSize(free))
+			}
+			return nil
+		}
+		usage, _ := cmd.Flags().GetUint64("usage")
+		h, err := fs.BalanceAsync(ctx, btrfs.UsageBalance(usage), nil)
+		if err != nil {
+			return err
+		}
+		return printBalanceDone(h.Wait())
+	},
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+	"github.com/dennwc/btrfs/send"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(KeygenCmd)
+	KeygenCmd.Flags().String("type", send.KeyX25519, "Key type: "+send.KeyX25519+" for encryption, or "+send.KeyEd25519+" for signatures.")
+	SendCmd.Flags().StringArray("encrypt-to", nil, "Encrypt the stream to the X25519 public key in <file> (multiple allowed).")
+	SendCmd.Flags().String("sign-key", "", "Sign the stream with the Ed25519 private key in <file>.")
+	SendCmd.Flags().String("signature-file", "", "Write the digest of the stream and its signature to <file>.")
+	ReceiveCmd.Flags().String("decrypt-key", "", "Decrypt the stream with the X25519 private key in <file>.")
+	ReceiveCmd.Flags().String("verify-key", "", "Verify the signature of the stream with the Ed25519 public key in <file>.")
+	ReceiveCmd.Flags().String("signature-file", "", "Verify the stream against the signed digest stored in <file>.")
+}
+
+var KeygenCmd = &cobra.Command{
+	Use:   "keygen [--type x25519|ed25519] <private-key-file> <public-key-file>",
+	Short: "Generate a key pair to encrypt or sign send streams.",
+	Long: `Generates a key pair and writes it to files: X25519 keys in the age format,
+Ed25519 keys in PEM files.
+X25519 keys are used with send --encrypt-to and receive --decrypt-key,
+and Ed25519 keys are used with send --sign-key and receive --verify-key.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return fmt.Errorf("expected private and public key file arguments")
+		}
+		typ, _ := cmd.Flags().GetString("type")
+		key, err := send.GenerateKey(typ)
+		if err != nil {
+			return err
+		}
+		pub, err := send.PublicKey(key)
+		if err != nil {
+			return err
+		}
+		if err = send.WriteKeyFile(args[0], key); err != nil {
+			return err
+		}
+		return send.WriteKeyFile(args[1], pub)
+	},
+}
+
+// encryptOutput wraps w with an encryption writer, if the stream must be encrypted.
+// It returns nil otherwise.
+func encryptOutput(cmd *cobra.Command, w io.Writer) (io.WriteCloser, error) {
+	files, _ := cmd.Flags().GetStringArray("encrypt-to")
+	if len(files) == 0 {
+		return nil, nil
+	}
+	keys := make([]age.Recipient, 0, len(files))
+	for _, name := range files {
+		key, err := send.ReadKeyFile(name)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := key.(*age.X25519Recipient)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an X25519 public key", name)
+		}
+		keys = append(keys, pub)
+	}
+	return send.NewEncryptWriter(w, keys...)
+}
+
+// decryptInput wraps r with a decryption reader, if a decryption key is set.
+func decryptInput(cmd *cobra.Command, r io.Reader) (io.Reader, error) {
+	name, _ := cmd.Flags().GetString("decrypt-key")
+	if name == "" {
+		return r, nil
+	}
+	key, err := send.ReadKeyFile(name)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(*age.X25519Identity)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an X25519 private key", name)
+	}
+	return send.NewDecryptReader(r, priv)
+}
+
+// signingKey returns a key to sign the stream with, or nil if the stream must not be signed.
+func signingKey(cmd *cobra.Command) (ed25519.PrivateKey, error) {
+	name, _ := cmd.Flags().GetString("sign-key")
+	sigFile, _ := cmd.Flags().GetString("signature-file")
+	if name == "" && sigFile == "" {
+		return nil, nil
+	} else if name == "" || sigFile == "" {
+		return nil, fmt.Errorf("--sign-key and --signature-file must be used together")
+	}
+	key, err := send.ReadKeyFile(name)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 private key", name)
+	}
+	return priv, nil
+}
+
+// signedDigest returns the digest from the signature file after checking its signature,
+// or nil if the stream signature must not be verified.
+func signedDigest(cmd *cobra.Command) (*send.Digest, error) {
+	name, _ := cmd.Flags().GetString("verify-key")
+	sigFile, _ := cmd.Flags().GetString("signature-file")
+	if name == "" && sigFile == "" {
+		return nil, nil
+	} else if name == "" || sigFile == "" {
+		return nil, fmt.Errorf("--verify-key and --signature-file must be used together")
+	}
+	key, err := send.ReadKeyFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 public key", name)
+	}
+	d, sig, err := send.ReadSignatureFile(sigFile)
+	if err != nil {
+		return nil, err
+	}
+	if err = send.VerifyDigest(pub, d, sig); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
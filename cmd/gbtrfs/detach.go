@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// detachTimeout is the maximal time to wait for an operation running in the background to start.
+const detachTimeout = 10 * time.Second
+
+// detach runs the current command again in a background process, with an additional argument
+// that makes it run in the foreground, and returns its pid. The output of the process is discarded.
+//
+// It waits until started reports that the operation has started, or the process exits,
+// so that errors are reported by the current process.
+func detach(arg string, started func() bool) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer null.Close()
+	c := exec.Command(exe, append(append([]string{}, os.Args[1:]...), arg)...)
+	c.Stdin, c.Stdout, c.Stderr = null, null, null
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err = c.Start(); err != nil {
+		return 0, err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- c.Wait()
+	}()
+	timeout := time.After(detachTimeout)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case err = <-exited:
+			if err != nil {
+				return 0, fmt.Errorf("failed in the background, run in the foreground for details: %v", err)
+			}
+			return c.Process.Pid, nil // finished already
+		case <-timeout:
+			return c.Process.Pid, nil
+		case <-tick.C:
+			if started() {
+				return c.Process.Pid, nil
+			}
+		}
+	}
+}
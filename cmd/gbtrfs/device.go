@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dennwc/btrfs"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	DeviceCmd.AddCommand(DeviceAddCmd, DeviceRemoveCmd)
+	DeviceRemoveCmd.Flags().Bool("keep-signature", false, "Do not wipe btrfs signatures from removed devices.")
+}
+
+var DeviceAddCmd = &cobra.Command{
+	Use:   "add <device> [<device>...] <mount>",
+	Short: "Add devices to the filesystem.",
+	Long: `Adds block devices to a mounted filesystem. Devices with btrfs signatures are refused.
+Existing block groups are not moved to the new devices, run a balance for that.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return fmt.Errorf("expected at least one device and a mount path")
+		}
+		mnt := args[len(args)-1]
+		fs, err := btrfs.Open(mnt, false)
+		if err != nil {
+			return err
+		}
+		defer fs.Close()
+		for _, dev := range args[:len(args)-1] {
+			if err = fs.AddDevice(dev); err != nil {
+				return fmt.Errorf("cannot add %s: %v", dev, err)
+			}
+		}
+		return nil
+	},
+}
+
+var DeviceRemoveCmd = &cobra.Command{
+	Use:     "remove [--keep-signature] <device>|missing [<device>...] <mount>",
+	Aliases: []string{"delete"},
+	Short:   "Remove devices from the filesystem.",
+	Long: `Removes devices from a mounted filesystem, relocating their data to the remaining
+devices. Btrfs signatures are wiped from all superblock copies of the removed devices,
+so they are not detected as stale members of the filesystem later.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return fmt.Errorf("expected at least one device and a mount path")
+		}
+		keep, _ := cmd.Flags().GetBool("keep-signature")
+		mnt := args[len(args)-1]
+		fs, err := btrfs.Open(mnt, false)
+		if err != nil {
+			return err
+		}
+		defer fs.Close()
+		info, err := fs.Info()
+		if err != nil {
+			return err
+		}
+		for _, dev := range args[:len(args)-1] {
+			if err = fs.RemoveDevice(dev); err != nil {
+				return fmt.Errorf("cannot remove %s: %v", dev, err)
+			}
+			if keep || dev == "missing" {
+				continue
+			}
+			if err = btrfs.ReleaseDevice(dev, info.FSID); err != nil {
+				return fmt.Errorf("removed %s, but cannot wipe signatures: %v", dev, err)
+			}
+		}
+		return nil
+	},
+}
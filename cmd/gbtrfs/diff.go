@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/dennwc/btrfs/send"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(DiffCmd)
+	DiffCmd.Flags().Bool("name-only", false, "print only names of changed paths")
+	DiffCmd.Flags().Bool("stat", false, "print the number of bytes written for each path")
+	DiffCmd.Flags().Bool("json", false, "print changes as JSON")
+}
+
+var diffMarks = map[send.ChangeType]string{
+	send.Created:  "+",
+	send.Deleted:  "-",
+	send.Modified: "M",
+	send.Renamed:  "R",
+}
+
+var DiffCmd = &cobra.Command{
+	Use:   "diff [--name-only|--stat|--json] <old-snapshot> <new-snapshot>",
+	Short: "Print paths changed between two snapshots.",
+	Long: `Compares two read-only snapshots of the same subvolume and prints
+created (+), deleted (-), modified (M) and renamed (R) paths.
+Changes of timestamps only are not reported.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return fmt.Errorf("expected old and new snapshot arguments")
+		}
+		nameOnly, _ := cmd.Flags().GetBool("name-only")
+		stat, _ := cmd.Flags().GetBool("stat")
+		asJSON, _ := cmd.Flags().GetBool("json")
+		changes, err := send.DiffSnapshots(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		switch {
+		case asJSON:
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "\t")
+			if changes == nil {
+				changes = []send.Change{}
+			}
+			return enc.Encode(changes)
+		case nameOnly:
+			for _, c := range changes {
+				fmt.Println(c.Path)
+			}
+		case stat:
+			var total uint64
+			for _, c := range changes {
+				fmt.Printf("%12s %s %s\n", fmtSize(c.Bytes), diffMarks[c.Type], c.Path)
+				total += c.Bytes
+			}
+			fmt.Printf("%d paths changed, %s written\n", len(changes), fmtSize(total))
+		default:
+			for _, c := range changes {
+				if c.Type == send.Renamed {
+					fmt.Printf("%s %s -> %s\n", diffMarks[c.Type], c.OldPath, c.Path)
+				} else {
+					fmt.Printf("%s %s\n", diffMarks[c.Type], c.Path)
+				}
+			}
+		}
+		return nil
+	},
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/dmesglink"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(DmesgLinkCmd)
+	DmesgLinkCmd.Flags().StringP("file", "f", "", "read the kernel log from <file> instead of stdin")
+	DmesgLinkCmd.Flags().Bool("json", false, "print the records as JSON")
+}
+
+var DmesgLinkCmd = &cobra.Command{
+	Use:   "dmesg-link [-f <file>] [--json] <mount>",
+	Short: "Find files affected by errors in the kernel log.",
+	Long: `Parses btrfs checksum and IO errors from the kernel log, e.g. the output
+of dmesg or journalctl -k, and resolves their addresses and inode numbers
+into paths on the filesystem mounted at <mount>. Messages of other
+filesystems are ignored. Requires root privileges.
+
+Example: dmesg | btrfs dmesg-link /mnt`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected one mount argument")
+		}
+		in := os.Stdin
+		if name, _ := cmd.Flags().GetString("file"); name != "" {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		fs, err := btrfs.Open(args[0], true)
+		if err != nil {
+			return err
+		}
+		defer fs.Close()
+		recs, err := dmesglink.LinkLog(fs, in)
+		if err != nil {
+			return err
+		}
+		if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "\t")
+			return enc.Encode(recs)
+		}
+		affected := make(map[string]int)
+		for _, r := range recs {
+			where := ""
+			switch {
+			case r.Logical != 0:
+				where = fmt.Sprintf(" logical %d", r.Logical)
+			case r.Inode != 0:
+				where = fmt.Sprintf(" inode %d", r.Inode)
+			}
+			if r.DevPath != "" {
+				where += " on " + r.DevPath
+			}
+			switch {
+			case r.Metadata:
+				fmt.Printf("%v%s: metadata\n", r.Kind, where)
+			case len(r.Paths) != 0:
+				for _, p := range r.Paths {
+					fmt.Printf("%v%s: %s\n", r.Kind, where, p)
+					affected[p]++
+				}
+			case r.ResolveErr != nil:
+				fmt.Printf("%v%s: cannot resolve: %v\n", r.Kind, where, r.ResolveErr)
+			case r.Kind != dmesglink.DevStats:
+				fmt.Printf("%v%s\n", r.Kind, where)
+			}
+		}
+		if len(affected) == 0 {
+			return nil
+		}
+		paths := make([]string, 0, len(affected))
+		for p := range affected {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		fmt.Printf("\n%d affected files:\n", len(paths))
+		for _, p := range paths {
+			fmt.Printf("%6d  %s\n", affected[p], p)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// docsProgram is the name of the installed binary used in generated documentation.
+// RootCmd is named after btrfs-progs, but pages must not collide with their man pages.
+const docsProgram = "gbtrfs"
+
+// annotationExitCodes is the annotation of commands with specific exit codes, one "<code>: <description>"
+// per line. All commands exit with 0 on success and with 255 on errors.
+const annotationExitCodes = "exit-codes"
+
+func init() {
+	RootCmd.AddCommand(DocsCmd)
+	DocsCmd.AddCommand(DocsGenerateCmd)
+	DocsGenerateCmd.Flags().String("format", "man", "Documentation format: man or markdown.")
+	HealthCmd.Annotations = map[string]string{
+		annotationExitCodes: "1: the filesystem health is yellow\n2: the filesystem health is red",
+	}
+	StatsGet.Annotations = map[string]string{
+		annotationExitCodes: "255: an error occurred, or any of the counters is not zero with -c",
+	}
+}
+
+var DocsCmd = &cobra.Command{
+	Use:   "docs <command> <args>",
+	Short: "Generate documentation.",
+}
+
+var DocsGenerateCmd = &cobra.Command{
+	Use:   "generate [--format man|markdown] <dir>",
+	Short: "Generate the reference of all commands.",
+	Long: `Renders a page for each command, with its flags and exit codes, into <dir>.
+Man pages are written to section 8, e.g. ` + docsProgram + `-send.8, and markdown pages
+are named similarly, e.g. ` + docsProgram + `-send.md.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected one directory argument")
+		}
+		format, _ := cmd.Flags().GetString("format")
+		var (
+			render func(c *cobra.Command) []byte
+			ext    string
+		)
+		switch format {
+		case "man":
+			render, ext = renderMan, ".8"
+		case "markdown":
+			render, ext = renderMarkdown, ".md"
+		default:
+			return fmt.Errorf("unsupported format: %q", format)
+		}
+		if err := os.MkdirAll(args[0], 0755); err != nil {
+			return err
+		}
+		for _, c := range docCommands(RootCmd) {
+			path := filepath.Join(args[0], docName(c)+ext)
+			if err := ioutil.WriteFile(path, render(c), 0644); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// docCommands returns the command and all its documented descendants.
+func docCommands(c *cobra.Command) []*cobra.Command {
+	out := []*cobra.Command{c}
+	for _, sub := range c.Commands() {
+		if !sub.IsAvailableCommand() || sub.IsAdditionalHelpTopicCommand() {
+			continue
+		}
+		out = append(out, docCommands(sub)...)
+	}
+	return out
+}
+
+// docPath returns the full command path with the name of the installed binary, e.g. "gbtrfs send".
+func docPath(c *cobra.Command) string {
+	return docsProgram + strings.TrimPrefix(c.CommandPath(), c.Root().Name())
+}
+
+// docName returns the name of the page of the command, e.g. "gbtrfs-send".
+func docName(c *cobra.Command) string {
+	return strings.Replace(docPath(c), " ", "-", -1)
+}
+
+func docUseLine(c *cobra.Command) string {
+	line := docsProgram + strings.TrimPrefix(c.UseLine(), c.Root().Name())
+	if c.HasAvailableSubCommands() && !strings.Contains(line, "<command>") {
+		line += " <command>"
+	}
+	return line
+}
+
+type docExitCode struct {
+	Code, Desc string
+}
+
+func docExitCodes(c *cobra.Command) []docExitCode {
+	out := []docExitCode{{"0", "success"}}
+	specific := make(map[string]bool)
+	for _, line := range strings.Split(c.Annotations[annotationExitCodes], "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		code := strings.TrimSpace(line[:i])
+		specific[code] = true
+		out = append(out, docExitCode{code, strings.TrimSpace(line[i+1:])})
+	}
+	if !specific["255"] {
+		out = append(out, docExitCode{"255", "an error occurred"})
+	}
+	return out
+}
+
+type docFlag struct {
+	Names string // e.g. "-f, --file <string>"
+	Usage string
+}
+
+func docFlags(fs *pflag.FlagSet) []docFlag {
+	var out []docFlag
+	fs.VisitAll(func(f *pflag.Flag) {
+		if f.Hidden {
+			return
+		}
+		names := "--" + f.Name
+		if f.Shorthand != "" {
+			names = "-" + f.Shorthand + ", " + names
+		}
+		if typ := f.Value.Type(); typ != "bool" {
+			names += " <" + typ + ">"
+		}
+		usage := f.Usage
+		switch f.DefValue {
+		case "", "false", "0", "0s", "[]":
+		default:
+			usage += fmt.Sprintf(" (default %s)", f.DefValue)
+		}
+		out = append(out, docFlag{Names: names, Usage: usage})
+	})
+	return out
+}
+
+// docSeeAlso returns the parent and the children of the command.
+func docSeeAlso(c *cobra.Command) []*cobra.Command {
+	var out []*cobra.Command
+	if c.HasParent() {
+		out = append(out, c.Parent())
+	}
+	var subs []*cobra.Command
+	for _, sub := range c.Commands() {
+		if sub.IsAvailableCommand() && !sub.IsAdditionalHelpTopicCommand() {
+			subs = append(subs, sub)
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Name() < subs[j].Name() })
+	return append(out, subs...)
+}
+
+// manEscape escapes text for roff.
+func manEscape(s string) string {
+	s = strings.Replace(s, `\`, `\e`, -1)
+	s = strings.Replace(s, "-", `\-`, -1)
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		if strings.HasPrefix(l, ".") || strings.HasPrefix(l, "'") {
+			lines[i] = `\&` + l
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func renderMan(c *cobra.Command) []byte {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, ".TH %q \"8\" \"\" %q \"System Administration\"\n", strings.ToUpper(docName(c)), docsProgram)
+	fmt.Fprintf(buf, ".SH NAME\n%s \\- %s\n", manEscape(docName(c)), manEscape(c.Short))
+	fmt.Fprintf(buf, ".SH SYNOPSIS\n.nf\n%s\n.fi\n", manEscape(docUseLine(c)))
+	desc := c.Long
+	if desc == "" {
+		desc = c.Short
+	}
+	fmt.Fprintf(buf, ".SH DESCRIPTION\n")
+	for _, p := range strings.Split(desc, "\n\n") {
+		fmt.Fprintf(buf, ".PP\n%s\n", manEscape(p))
+	}
+	section := func(title string, flags []docFlag) {
+		if len(flags) == 0 {
+			return
+		}
+		fmt.Fprintf(buf, ".SH %s\n", title)
+		for _, f := range flags {
+			fmt.Fprintf(buf, ".TP\n\\fB%s\\fR\n%s\n", manEscape(f.Names), manEscape(f.Usage))
+		}
+	}
+	section("OPTIONS", docFlags(c.NonInheritedFlags()))
+	section("GLOBAL OPTIONS", docFlags(c.InheritedFlags()))
+	fmt.Fprintf(buf, ".SH \"EXIT STATUS\"\n")
+	for _, e := range docExitCodes(c) {
+		fmt.Fprintf(buf, ".TP\n\\fB%s\\fR\n%s\n", e.Code, manEscape(e.Desc))
+	}
+	if also := docSeeAlso(c); len(also) != 0 {
+		fmt.Fprintf(buf, ".SH \"SEE ALSO\"\n")
+		for i, a := range also {
+			sep := ","
+			if i == len(also)-1 {
+				sep = ""
+			}
+			fmt.Fprintf(buf, ".BR %s (8)%s\n", manEscape(docName(a)), sep)
+		}
+	}
+	return buf.Bytes()
+}
+
+func renderMarkdown(c *cobra.Command) []byte {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "# %s\n\n%s\n\n", docPath(c), c.Short)
+	fmt.Fprintf(buf, "## Synopsis\n\n```\n%s\n```\n\n", docUseLine(c))
+	if c.Long != "" {
+		fmt.Fprintf(buf, "%s\n\n", c.Long)
+	}
+	section := func(title string, flags []docFlag) {
+		if len(flags) == 0 {
+			return
+		}
+		fmt.Fprintf(buf, "## %s\n\n", title)
+		for _, f := range flags {
+			fmt.Fprintf(buf, "* `%s`: %s\n", f.Names, f.Usage)
+		}
+		fmt.Fprintln(buf)
+	}
+	section("Options", docFlags(c.NonInheritedFlags()))
+	section("Global options", docFlags(c.InheritedFlags()))
+	fmt.Fprintf(buf, "## Exit status\n\n")
+	for _, e := range docExitCodes(c) {
+		fmt.Fprintf(buf, "* `%s`: %s\n", e.Code, e.Desc)
+	}
+	if also := docSeeAlso(c); len(also) != 0 {
+		fmt.Fprintf(buf, "\n## See also\n\n")
+		for _, a := range also {
+			fmt.Fprintf(buf, "* [%s](%s.md)", docPath(a), docName(a))
+			if a.Short != "" {
+				fmt.Fprintf(buf, ": %s", a.Short)
+			}
+			fmt.Fprintln(buf)
+		}
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dennwc/btrfs"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(DuCmd)
+	DuCmd.Flags().Duration("watch", 0, "sample usage with a given interval and print growth rates")
+	DuCmd.Flags().Int("count", 0, "number of samples to take in --watch mode (default: unlimited)")
+}
+
+type duSubvol struct {
+	path string
+	fs   *btrfs.FS
+	id   uint64
+
+	first, last uint64 // exclusive bytes in the first and the last sample
+}
+
+func (s *duSubvol) sample() (*btrfs.Qgroup, error) {
+	if err := s.fs.Sync(); err != nil {
+		return nil, err
+	}
+	return s.fs.SubvolumeQgroup(s.id)
+}
+
+var DuCmd = &cobra.Command{
+	Use:   "du [--watch <interval>] [--count <n>] <subvol> [<subvol>...]",
+	Short: "Print referenced and exclusive bytes of subvolumes.",
+	Long: `Prints usage of subvolumes, as accounted by quota groups.
+Quotas must be enabled on the filesystem.
+
+In --watch mode, exclusive bytes are sampled periodically and growth rates
+are printed, which helps to find out which snapshots grow the most.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("expected at least one subvolume")
+		}
+		watch, _ := cmd.Flags().GetDuration("watch")
+		count, _ := cmd.Flags().GetInt("count")
+		subs := make([]*duSubvol, 0, len(args))
+		defer func() {
+			for _, s := range subs {
+				s.fs.Close()
+			}
+		}()
+		for _, path := range args {
+			fs, err := btrfs.Open(path, true)
+			if err != nil {
+				return err
+			}
+			id, err := fs.SubVolumeID()
+			if err != nil {
+				fs.Close()
+				return err
+			}
+			subs = append(subs, &duSubvol{path: path, fs: fs, id: id})
+		}
+		if watch <= 0 {
+			fmt.Printf("%15s %15s  %s\n", "Referenced", "Exclusive", "Path")
+			for _, s := range subs {
+				q, err := s.sample()
+				if err != nil {
+					return fmt.Errorf("%s: %v", s.path, err)
+				}
+				fmt.Printf("%15s %15s  %s\n", fmtSize(q.Referenced), fmtSize(q.Exclusive), s.path)
+			}
+			return nil
+		}
+		start := time.Now()
+		prev := start
+		for i := 0; count <= 0 || i < count; i++ {
+			if i != 0 {
+				time.Sleep(watch)
+			}
+			now := time.Now()
+			fmt.Printf("%s\n", now.Format(time.RFC3339))
+			fmt.Printf("%15s %15s %15s %15s  %s\n", "Exclusive", "Delta", "Rate/s", "Total rate/s", "Path")
+			for _, s := range subs {
+				q, err := s.sample()
+				if err != nil {
+					return fmt.Errorf("%s: %v", s.path, err)
+				}
+				if i == 0 {
+					s.first, s.last = q.Exclusive, q.Exclusive
+				}
+				delta := int64(q.Exclusive - s.last)
+				total := int64(q.Exclusive - s.first)
+				var rate, totalRate float64
+				if dt := now.Sub(prev).Seconds(); i != 0 && dt > 0 {
+					rate = float64(delta) / dt
+				}
+				if dt := now.Sub(start).Seconds(); dt > 0 {
+					totalRate = float64(total) / dt
+				}
+				s.last = q.Exclusive
+				fmt.Printf("%15s %15s %15s %15s  %s\n", fmtSize(q.Exclusive), fmtDelta(delta), fmtDelta(int64(rate)), fmtDelta(int64(totalRate)), s.path)
+			}
+			prev = now
+		}
+		return nil
+	},
+}
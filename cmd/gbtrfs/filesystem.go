@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dennwc/btrfs"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(FilesystemCmd)
+	FilesystemCmd.AddCommand(FilesystemUsageCmd, FilesystemVerifyMetadataCmd)
+	FilesystemVerifyMetadataCmd.Flags().Float64("sample", 1, "Fraction of tree blocks to check, from 0 to 1.")
+}
+
+var FilesystemCmd = &cobra.Command{
+	Use:     "filesystem <command> <args>",
+	Aliases: []string{"fi", "fs"},
+}
+
+// logicalSize converts raw space to logical space using a ratio of the profile.
+func logicalSize(raw uint64, ratio float64) uint64 {
+	if ratio <= 0 {
+		return raw
+	}
+	return uint64(float64(raw) / ratio)
+}
+
+var FilesystemUsageCmd = &cobra.Command{
+	Use:   "usage [--iec|--si|--raw] <mount>",
+	Short: "Show space usage of the filesystem.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected one mount argument")
+		}
+		fs, err := btrfs.Open(args[0], true)
+		if err != nil {
+			return err
+		}
+		defer fs.Close()
+		u, err := fs.Usage()
+		if err != nil {
+			return err
+		}
+		fmt.Println("Overall:")
+		for _, v := range []struct {
+			name string
+			val  string
+		}{
+			{"Device size", fmtSize(u.Total)},
+			{"Device allocated", fmtSize(u.TotalChunks)},
+			{"Device unallocated", fmtSize(u.TotalUnused)},
+			{"Used", fmtSize(u.TotalUsed)},
+			{"Free (estimated)", fmt.Sprintf("%s (min: %s)", fmtSize(u.FreeEstimated), fmtSize(u.FreeMin))},
+			{"Data ratio", fmt.Sprintf("%.2f", u.DataRatio)},
+			{"Metadata ratio", fmt.Sprintf("%.2f", u.MetadataRatio)},
+			{"Global reserve", fmt.Sprintf("%s (used: %s)", fmtSize(u.GlobalReserve), fmtSize(u.GlobalReserveUsed))},
+		} {
+			fmt.Printf("    %-28s %s\n", v.name+":", v.val)
+		}
+		fmt.Println()
+		fmt.Printf("Data: size %s, used %s\n", fmtSize(u.LogicalDataChunks), fmtSize(logicalSize(u.RawDataUsed, u.DataRatio)))
+		fmt.Printf("Metadata: size %s, used %s\n", fmtSize(u.LogicalMetaChunks), fmtSize(logicalSize(u.RawMetaUsed, u.MetadataRatio)))
+		fmt.Printf("System: raw size %s, raw used %s\n", fmtSize(u.SystemChunks), fmtSize(u.SystemUsed))
+		return nil
+	},
+}
+
+var FilesystemVerifyMetadataCmd = &cobra.Command{
+	Use:   "verify-metadata [--sample <rate>] <mount>",
+	Short: "Check checksums and structure of tree blocks.",
+	Long: `Reads tree blocks directly from the devices of a mounted filesystem and checks their
+checksums, headers, key ordering and parent-child pointers. Nothing is repaired.
+Exits with an error if any problems are found.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected one mount argument")
+		}
+		rate, _ := cmd.Flags().GetFloat64("sample")
+		fs, err := btrfs.Open(args[0], true)
+		if err != nil {
+			return err
+		}
+		defer fs.Close()
+		rep, err := fs.VerifyMetadataCsums(context.Background(), rate)
+		if err != nil {
+			return err
+		}
+		for _, p := range rep.Problems {
+			fmt.Println(p)
+		}
+		fmt.Printf("checked %d of %d tree blocks (%d copies, %d skipped, %d changed during the check)\n",
+			rep.Checked, rep.Total, rep.Copies, rep.Skipped, rep.Changed)
+		if len(rep.Problems) != 0 {
+			return fmt.Errorf("found %d problems", len(rep.Problems))
+		}
+		return nil
+	},
+}
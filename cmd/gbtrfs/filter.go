@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dennwc/btrfs/send"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{SendCmd, ReceiveCmd} {
+		cmd.Flags().StringArray("exclude", nil, "Exclude paths matching <glob> from the stream (multiple allowed).")
+		cmd.Flags().StringArray("rewrite", nil, "Move files under <old> to <new> in the stream, given as <old>=<new> (multiple allowed).")
+		cmd.Flags().StringArray("strip-xattr", nil, "Remove extended attributes matching <glob> from the stream (multiple allowed).")
+		cmd.Flags().Bool("strip-security", false, "Remove security labels from the stream.")
+	}
+}
+
+// streamFilters returns stream transforms selected by filter flags, or nil if there are none.
+func streamFilters(cmd *cobra.Command) ([]send.Transform, error) {
+	var o send.FilterOptions
+	o.Exclude, _ = cmd.Flags().GetStringArray("exclude")
+	o.DropXattrs, _ = cmd.Flags().GetStringArray("strip-xattr")
+	o.StripSecurity, _ = cmd.Flags().GetBool("strip-security")
+	rewrite, _ := cmd.Flags().GetStringArray("rewrite")
+	for _, r := range rewrite {
+		i := strings.IndexByte(r, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid --rewrite value: %q", r)
+		}
+		if o.Rewrite == nil {
+			o.Rewrite = make(map[string]string)
+		}
+		o.Rewrite[r[:i]] = r[i+1:]
+	}
+	return o.Transforms()
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"math"
+	"io"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/send"
+	"github.com/dennwc/btrfs/units"
 	"github.com/spf13/cobra"
 )
 
@@ -23,6 +29,7 @@ func init() {
 		ScrubStartCmd,
 		ScrubStatusCmd,
 		ScrubCancelCmd,
+		ScrubResumeCmd,
 	)
 	SubvolumeCmd.AddCommand(
 		SubvolumeCreateCmd,
@@ -33,7 +40,38 @@ func init() {
 	StatsGet.Flags().BoolP("reset", "z", false, "reset the stats after reading")
 	StatsGet.Flags().BoolP("check", "c", false, "return a non zero code if any stat counter is not zero")
 	StatsGet.Flags().BoolP("tabular", "T", false, "return a non zero code if any stat counter is not zero")
+	StatsGet.Flags().Bool("prom", false, "print the stats in the Prometheus text format, for the node_exporter textfile collector")
+	SubvolumeListCmd.Flags().Bool("tree", false, "print subvolumes as a tree")
 	SendCmd.Flags().StringP("parent", "p", "", "Send an incremental stream from <parent> to <subvol>.")
+	SendCmd.Flags().StringArrayP("clone-src", "c", nil, "Use this snapshot as a clone source for an incremental send (multiple allowed).")
+	SendCmd.Flags().Bool("estimate", false, "Print the projected size of the stream and exit.")
+	SendCmd.Flags().String("state-file", "", "Skip the part of the stream already applied by the receiver, according to its state file.")
+	SendCmd.Flags().Bool("compressed-data", false, "Send compressed extents without decompressing them (protocol version 2).")
+	SendCmd.Flags().Int("proto", 1, "Use send protocol version <N>, or the newest version supported by the kernel if <N> is 0.")
+	SendCmd.Flags().Bool("no-data", false, "Send in metadata-only mode, without file data.")
+	SendCmd.Flags().StringP("file", "f", "", "Write the stream to <outfile> instead of stdout.")
+	ReceiveCmd.Flags().StringP("file", "f", "", "Read the stream from <infile> instead of stdin.")
+	ReceiveCmd.Flags().String("resume", "", "Record progress to <state-file> and resume from it, if it exists.")
+	SendCmd.Flags().String("rate-limit", "", "Limit the bandwidth to <size> per second (e.g. 10M).")
+	ReceiveCmd.Flags().String("rate-limit", "", "Limit the bandwidth to <size> per second (e.g. 10M).")
+	SendCmd.Flags().Bool("progress", false, "Print the progress of the transfer to stderr.")
+	ReceiveCmd.Flags().Bool("progress", false, "Print the progress of the transfer to stderr.")
+	ReceiveCmd.Flags().Bool("dump", false, "Print the commands of the stream instead of applying them.")
+	SendCmd.Flags().String("digest-file", "", "Write a SHA-256 digest of the stream to <file>.")
+	ReceiveCmd.Flags().String("digest-file", "", "Verify the stream against the digest stored in <file>.")
+	SendCmd.Flags().String("checksum-file", "", "Write SHA-256 checksums of file data in the stream to <file>.")
+	ReceiveCmd.Flags().String("checksum-file", "", "Verify file data written by the stream against the checksums stored in <file>.")
+	ReceiveCmd.Flags().Bool("strict", false, "Validate the stream strictly: verify checksums of commands and reject malformed paths.")
+	ReceiveCmd.Flags().BoolP("terminate-on-end", "e", false, "Terminate after receiving an end-cmd marker, instead of reading concatenated streams until EOF.")
+	ReceiveCmd.Flags().Bool("plain", false, "Apply the stream to an ordinary directory that does not have to be on btrfs.")
+	ReceiveCmd.Flags().Bool("staged", false, "Receive into a hidden directory and move subvolumes to <mount> only after the stream was received completely.")
+	ScrubStartCmd.Flags().BoolP("readonly", "r", false, "Read-only mode: report errors, but do not repair them.")
+	ScrubStartCmd.Flags().BoolP("foreground", "B", false, "Do not run in the background, print the progress and the summary.")
+	ScrubStatusCmd.Flags().BoolP("devices", "d", false, "Print the status of each device separately.")
+	ScrubStartCmd.Flags().String("limit", "", "Limit the scrub bandwidth of each device to <size> per second (e.g. 100M).")
+	ScrubCmd.PersistentFlags().String("state-dir", "", "Record scrub results to the history in <dir>, which is required to resume scrubs.")
+	ScrubCmd.PersistentFlags().String("status-dir", btrfs.ScrubStatusDir, "Directory with scrub status files shared with btrfs-progs, or empty to disable them.")
+	ReceiveCmd.Flags().Int("max-errors", 1, "Terminate as soon as <N> errors occur. If <N> is zero, never terminate.")
 }
 
 var RootCmd = &cobra.Command{
@@ -86,7 +124,7 @@ operation is safely stored on the media.`,
 }
 
 var SubvolumeListCmd = &cobra.Command{
-	Use:     "list <mount>",
+	Use:     "list [--tree] <mount>",
 	Short:   "List subvolumes",
 	Aliases: []string{"ls"},
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -98,6 +136,9 @@ var SubvolumeListCmd = &cobra.Command{
 			return err
 		}
 		defer fs.Close()
+		if tree, _ := cmd.Flags().GetBool("tree"); tree {
+			return printSubvolumeTree(fs)
+		}
 		list, err := fs.ListSubvolumes(nil)
 		if err == nil {
 			for _, v := range list {
@@ -109,36 +150,340 @@ var SubvolumeListCmd = &cobra.Command{
 }
 
 var SendCmd = &cobra.Command{
-	Use:   "send [-v] [-p <parent>] [-c <clone-src>] [-f <outfile>] <subvol> [<subvol>...]",
+	Use:   "send [-v] [--progress] [--rate-limit <size>] [--estimate] [--compressed-data] [--no-data] [--proto <N>] [--state-file <file>] [--digest-file <file>] [--checksum-file <file>] [--encrypt-to <pubkey>] [--sign-key <key> --signature-file <file>] [--exclude <glob>] [--rewrite <old>=<new>] [--strip-xattr <glob>] [--strip-security] [-p <parent>] [-c <clone-src>] [-f <outfile>] <subvol> [<subvol>...]",
 	Short: "Send the subvolume(s) to stdout.",
-	Long: `Sends the subvolume(s) specified by <subvol> to stdout.
-<subvol> should be read-only here.`,
+	Long: `Sends the subvolume(s) specified by <subvol> to stdout, or to <outfile> with -f.
+<subvol> should be read-only here.
+
+With --encrypt-to, the stream is encrypted to one or more X25519 public keys.
+With --sign-key, the digest of the stream (before encryption) is signed
+with an Ed25519 key and written to the --signature-file.
+Keys can be generated with "keygen".
+
+With --checksum-file, checksums of the file data in the stream are written
+to <file>, so the receiver can verify the data written to its files.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		parent, _ := cmd.Flags().GetString("parent")
-		return btrfs.Send(os.Stdout, parent, args...)
+		if estimate, _ := cmd.Flags().GetBool("estimate"); estimate {
+			size, err := btrfs.SendEstimate(parent, args...)
+			if err != nil {
+				return err
+			}
+			fmt.Println(fmtSize(size))
+			return nil
+		}
+		var (
+			w   io.Writer = summaryWriter{os.Stdout}
+			out *os.File
+		)
+		if name, _ := cmd.Flags().GetString("file"); name != "" {
+			f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w, out = summaryWriter{f}, f
+		}
+		enc, err := encryptOutput(cmd, w)
+		if err != nil {
+			return err
+		} else if enc != nil {
+			w = enc
+		}
+		signKey, err := signingKey(cmd)
+		if err != nil {
+			return err
+		}
+		var dw *send.DigestWriter
+		digestFile, _ := cmd.Flags().GetString("digest-file")
+		if digestFile != "" || signKey != nil {
+			var err error
+			dw, err = send.NewDigestWriter(w, send.DigestSHA256)
+			if err != nil {
+				return err
+			}
+			w = dw
+		}
+		var cw *send.ChecksumWriter
+		checksumFile, _ := cmd.Flags().GetString("checksum-file")
+		if checksumFile != "" {
+			cw, err = send.NewChecksumWriter(w, send.DigestSHA256)
+			if err != nil {
+				return err
+			}
+			w = cw
+		}
+		if stateFile, _ := cmd.Flags().GetString("state-file"); stateFile != "" {
+			if enc != nil {
+				// the encrypted stream cannot be appended to
+				return fmt.Errorf("--state-file cannot be used with --encrypt-to")
+			} else if cw != nil {
+				// offsets of commands in a resumed stream differ from the complete one
+				return fmt.Errorf("--state-file cannot be used with --checksum-file")
+			}
+			cp, err := send.ReadCheckpoint(stateFile)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			} else if cp != nil {
+				uuid, err := subvolumeUUID(args[len(args)-1])
+				if err != nil {
+					return err
+				} else if uuid != cp.UUID {
+					return fmt.Errorf("state file is for subvolume %v, not for %s", cp.UUID, args[len(args)-1])
+				}
+				w = send.ResumeWriter(w, cp)
+			}
+		}
+		if progress, _ := cmd.Flags().GetBool("progress"); progress {
+			fn, done := progressPrinter()
+			defer done()
+			w = send.ProgressWriter(w, fn)
+		}
+		limit, err := rateLimit(cmd)
+		if err != nil {
+			return err
+		}
+		btrfs.SetSendRateLimit(limit)
+		filters, err := streamFilters(cmd)
+		if err != nil {
+			return err
+		}
+		if len(filters) != 0 {
+			tw := send.NewTransformWriter(w, filters...)
+			err = sendStream(cmd, tw, parent, args)
+			if err2 := tw.Close(); err == nil {
+				err = err2
+			}
+		} else {
+			err = sendStream(cmd, w, parent, args)
+		}
+		if err != nil {
+			return err
+		}
+		if cw != nil {
+			if err = cw.Close(); err != nil {
+				return err
+			}
+			if err = send.WriteChecksumFile(checksumFile, cw.Checksums()); err != nil {
+				return err
+			}
+		}
+		if enc != nil {
+			if err = enc.Close(); err != nil {
+				return err
+			}
+		}
+		if out != nil {
+			// make sure the stream is on disk before it's considered complete
+			if err = out.Sync(); err != nil {
+				return err
+			}
+		}
+		if dw == nil {
+			return nil
+		}
+		if digestFile != "" {
+			if err = send.WriteDigestFile(digestFile, dw.Digest()); err != nil {
+				return err
+			}
+		}
+		if signKey != nil {
+			sigFile, _ := cmd.Flags().GetString("signature-file")
+			d := dw.Digest()
+			return send.WriteSignatureFile(sigFile, d, send.SignDigest(signKey, d))
+		}
+		return nil
 	},
 }
 
+func sendStream(cmd *cobra.Command, w io.Writer, parent string, args []string) error {
+	noData, _ := cmd.Flags().GetBool("no-data")
+	compressed, _ := cmd.Flags().GetBool("compressed-data")
+	clones, _ := cmd.Flags().GetStringArray("clone-src")
+	if len(clones) != 0 && (noData || compressed) {
+		return fmt.Errorf("-c cannot be used with --no-data or --compressed-data")
+	} else if noData && compressed {
+		return fmt.Errorf("--no-data and --compressed-data cannot be used together")
+	}
+	opts := &btrfs.SendOptions{
+		Parent:       parent,
+		CloneSources: clones,
+		NoData:       noData,
+		Compressed:   compressed,
+	}
+	if cmd.Flags().Changed("proto") {
+		// as in btrfs-progs, zero selects the newest version supported by the kernel
+		if opts.Proto, _ = cmd.Flags().GetInt("proto"); opts.Proto == 0 {
+			opts.Proto = btrfs.ProtoAuto
+		} else if opts.Proto < 0 {
+			return fmt.Errorf("invalid --proto value: %d", opts.Proto)
+		}
+	}
+	return btrfs.SendWithOptions(w, opts, args...)
+}
+
 var ReceiveCmd = &cobra.Command{
-	Use:   "receive [-v] [-f <infile>] [--max-errors <N>] <mount>",
+	Use:   "receive [-v] [-e] [--staged] [--progress] [--rate-limit <size>] [-f <infile>] [--max-errors <N>] [--resume <state-file>] [--digest-file <file>] [--checksum-file <file>] [--strict] [--plain] [--decrypt-key <key>] [--verify-key <pubkey> --signature-file <file>] [--exclude <glob>] [--rewrite <old>=<new>] [--strip-xattr <glob>] [--strip-security] <mount> | --dump",
 	Short: "Receive subvolumes from stdin.",
 	Long: `Receives one or more subvolumes that were previously
-sent with btrfs send. The received subvolumes are stored
-into <mount>.`,
+sent with btrfs send, from stdin or from <infile> with -f.
+The received subvolumes are stored into <mount>.
+
+With --decrypt-key, an encrypted stream is decrypted with an X25519 private key.
+With --verify-key, the signature in --signature-file is checked before
+receiving, and the stream is verified against the signed digest.
+With --checksum-file, file data is read back after each write and compared
+to the checksums written by send; the subvolume is not marked as received
+if any of them differs or is missing.
+
+With --plain, the stream is applied to an ordinary directory tree, e.g. to
+inspect a backup on a machine without btrfs. Snapshots and clones are emulated
+by copying the data, and btrfs-only metadata is skipped. The received uuids are
+recorded in hidden files in <mount>, so incremental streams can be applied
+on top of them.
+
+With --staged, subvolumes are received into a hidden directory in <mount>
+and moved to <mount> only after the stream was received completely,
+so an interrupted transfer never leaves a partial subvolume in <mount>.
+
+With --dump, the stream is not applied; its commands are printed instead.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		in := os.Stdin
+		if name, _ := cmd.Flags().GetString("file"); name != "" {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		r, err := decryptInput(cmd, summaryReader{in})
+		if err != nil {
+			return err
+		}
+		if dump, _ := cmd.Flags().GetBool("dump"); dump {
+			if len(args) != 0 {
+				return fmt.Errorf("no destination is expected with --dump")
+			}
+			return send.DumpStream(r, os.Stdout)
+		}
 		if len(args) != 1 {
 			return fmt.Errorf("expected one destination argument")
 		}
-		return btrfs.Receive(os.Stdin, args[0])
+		stateFile, _ := cmd.Flags().GetString("resume")
+		maxErrors, _ := cmd.Flags().GetInt("max-errors")
+		if maxErrors < 0 {
+			return fmt.Errorf("invalid --max-errors value: %d", maxErrors)
+		}
+		if progress, _ := cmd.Flags().GetBool("progress"); progress {
+			fn, done := progressPrinter()
+			defer done()
+			r = send.ProgressReader(r, fn)
+		}
+		limit, err := rateLimit(cmd)
+		if err != nil {
+			return err
+		}
+		r = limit.Reader(r)
+		digest, err := signedDigest(cmd)
+		if err != nil {
+			return err
+		}
+		if digestFile, _ := cmd.Flags().GetString("digest-file"); digestFile != "" {
+			if digest != nil {
+				return fmt.Errorf("--digest-file cannot be used with --signature-file")
+			}
+			d, err := send.ReadDigestFile(digestFile)
+			if err != nil {
+				return err
+			}
+			digest = &d
+		}
+		var verifier send.DataVerifier
+		if checksumFile, _ := cmd.Flags().GetString("checksum-file"); checksumFile != "" {
+			sums, err := send.ReadChecksumFile(checksumFile)
+			if err != nil {
+				return err
+			}
+			verifier = sums
+		}
+		var ropts *send.ReaderOptions
+		if strict, _ := cmd.Flags().GetBool("strict"); strict {
+			ropts = &send.ReaderOptions{Strict: true}
+		}
+		stopAtEnd, _ := cmd.Flags().GetBool("terminate-on-end")
+		plain, _ := cmd.Flags().GetBool("plain")
+		filters, err := streamFilters(cmd)
+		if err != nil {
+			return err
+		} else if len(filters) != 0 {
+			if digest != nil {
+				return fmt.Errorf("the digest of a filtered stream cannot be verified")
+			} else if verifier != nil {
+				return fmt.Errorf("checksums of a filtered stream cannot be verified")
+			}
+			tr := send.NewTransformReader(r, filters...)
+			defer tr.Close()
+			r = tr
+		}
+		receive := func(dir string) error {
+			if stateFile == "" && maxErrors == 1 && digest == nil && verifier == nil && ropts == nil && !stopAtEnd && !plain {
+				return btrfs.Receive(r, dir)
+			}
+			// btrfs receive counts the fatal error as well, and treats zero as no limit
+			_, err := send.Receive(r, dir, &send.ReceiveOptions{
+				StateFile: stateFile,
+				MaxErrors: maxErrors - 1,
+				Digest:    digest,
+				StopAtEnd: stopAtEnd,
+				Verifier:  verifier,
+				Reader:    ropts,
+				Plain:     plain,
+			})
+			return err
+		}
+		if staged, _ := cmd.Flags().GetBool("staged"); staged {
+			if stateFile != "" {
+				return fmt.Errorf("--resume cannot be used with --staged")
+			} else if plain {
+				return fmt.Errorf("--plain cannot be used with --staged")
+			}
+			_, err = btrfs.ReceiveStagedFunc(args[0], receive)
+			return err
+		}
+		return receive(args[0])
 	},
 }
 
+// rateLimit returns a limiter for the --rate-limit flag, or nil if it is not set.
+func rateLimit(cmd *cobra.Command) (*btrfs.RateLimiter, error) {
+	s, _ := cmd.Flags().GetString("rate-limit")
+	if s == "" {
+		return nil, nil
+	}
+	rate, err := units.Parse(s)
+	if err != nil {
+		return nil, err
+	} else if rate == 0 {
+		return nil, fmt.Errorf("invalid rate limit: %q", s)
+	}
+	return btrfs.NewRateLimiter(int64(rate), 0), nil
+}
+
 var ScrubStartCmd = &cobra.Command{
-	Use:   "start <mount>",
+	Use:   "start [-B] [-r] [--limit <size>] [--state-dir <dir>] <mount>",
 	Short: "Start scrubs",
-	Long: `Start sscrub on all devices that mount the given path e.g.
+	Long: `Start scrub on all devices that mount the given path e.g.
 	on a raid1 configuration it would start the scrub on both devices,
-	while on a non raid configuration only on the single device`,
+	while on a non raid configuration only on the single device.
+	Devices are scrubbed in parallel and missing devices are skipped.
+	By default, the scrub runs in the background and the command returns
+	once it has started; use "scrub status" to follow it.
+	With -B, the scrub stays in the foreground, prints the progress and a combined
+	summary when all scrubs finish. Interrupting it cancels the scrubs.
+	With -r, errors are only reported, which is required on a read-only mount.
+	With --limit, the bandwidth of each device is limited for the duration of the scrub.
+	With --state-dir, the results are recorded, so an interrupted scrub can be resumed`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) == 0 {
 			return fmt.Errorf("mount not specified")
@@ -153,15 +498,56 @@ var ScrubStartCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		for i := uint64(1); i <= info.MaxID; i++ {
-			fmt.Println("starting scrub: ", i)
-			if err := fs.ScrubStart(i, 0, math.MaxUint64); err != nil {
-				fmt.Println("starting scrub: ", i, " failed", err)
+		stateDir, _ := cmd.Flags().GetString("state-dir")
+		fs.SetStateDir(stateDir)
+		statusDir, _ := cmd.Flags().GetString("status-dir")
+		fs.SetScrubStatusDir(statusDir)
+		var flags btrfs.ScrubFlags
+		if ro, _ := cmd.Flags().GetBool("readonly"); ro {
+			flags |= btrfs.ScrubFlagsReadOnly
+		}
+		var limit uint64
+		if s, _ := cmd.Flags().GetString("limit"); s != "" {
+			if limit, err = units.Parse(s); err != nil {
+				return err
+			} else if limit == 0 {
+				return fmt.Errorf("invalid scrub limit: %q", s)
+			}
+			// check that the kernel supports limits, before the scrub runs in the background
+			if _, err = fs.ScrubLimits(); err != nil {
+				return err
+			}
+		}
+		fg, _ := cmd.Flags().GetBool("foreground")
+		if !fg {
+			pid, err := scrubDetach(fs)
+			if err != nil {
 				return err
 			}
-			fmt.Println("starting scrub: ", i, " ok")
+			fmt.Printf("scrub started on %v, pid %d\n", btrfs.UUID(info.FSID), pid)
+			return nil
+		}
+		if limit != 0 {
+			restore, err := setScrubLimits(fs, limit)
+			if err != nil {
+				return err
+			}
+			defer restore()
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		started := time.Now()
+		fmt.Printf("scrub started on %v\n", btrfs.UUID(info.FSID))
+		res, err := scrubDevices(ctx, fs, flags, true)
+		if err != nil {
+			return err
+		}
+		printScrubSummary(info.FSID, started, res)
+		for _, r := range res {
+			if r.err != nil {
+				return fmt.Errorf("scrub %s on device %d", scrubStatus(r.err), r.dev.ID)
+			}
 		}
-		fmt.Println("starting scrub done")
 		return nil
 	},
 }
@@ -193,32 +579,94 @@ var ScrubCancelCmd = &cobra.Command{
 		return nil
 	},
 }
-var ScrubStatusCmd = &cobra.Command{
-	Use:   "status <mount>",
-	Short: "Print the status of scrubs",
-	Long: `Print the status of scrubs on all devices that back the given mount
-	e.g. on  raid1 configuration this will display the scrub status on both devices, on a non raid configuratrion only the scrub status of the single device`,
+var ScrubResumeCmd = &cobra.Command{
+	Use:   "resume [--state-dir <dir>] <mount>",
+	Short: "Resume interrupted scrubs",
+	Long: `Resume scrubs that were canceled or failed on the devices that back the given mount,
+	starting from the last scrubbed position. Scrubs must have been started with the same --state-dir.
+	Without it, scrubs are resumed from the status file, including ones started by btrfs-progs`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) == 0 {
 			return fmt.Errorf("mount not specified")
 		} else if len(args) > 1 {
 			return fmt.Errorf("only one mount path is allowed")
 		}
+		stateDir, _ := cmd.Flags().GetString("state-dir")
+		statusDir, _ := cmd.Flags().GetString("status-dir")
+		if stateDir == "" && statusDir == "" {
+			return fmt.Errorf("state directory not specified")
+		}
 		fs, err := btrfs.Open(args[0], false)
 		if err != nil {
 			return err
 		}
+		fs.SetStateDir(stateDir)
+		fs.SetScrubStatusDir(statusDir)
 		info, err := fs.Info()
 		if err != nil {
 			return err
 		}
+		resumed := 0
 		for i := uint64(1); i <= info.MaxID; i++ {
-			progress, err := fs.ScrubStatus(i)
-			if err != nil {
+			err := fs.ScrubResume(i)
+			if err == btrfs.ErrNoScrubToResume {
+				continue
+			} else if err != nil {
+				fmt.Println("resuming scrub: ", i, " failed", err)
 				return err
 			}
-			fmt.Printf("scrub status on device %d: %+v", i, progress)
-			fmt.Println()
+			fmt.Println("resuming scrub: ", i, " ok")
+			resumed++
+		}
+		if resumed == 0 {
+			return btrfs.ErrNoScrubToResume
+		}
+		return nil
+	},
+}
+var ScrubStatusCmd = &cobra.Command{
+	Use:   "status [-d] <mount>",
+	Short: "Print the status of scrubs",
+	Long: `Print the status of scrubs on all devices that back the given mount:
+	the state, bytes scrubbed, errors and the overall rate, combined for all devices,
+	and the state of the scrub on each device. With -d, the full status of each device is printed.
+	Scrubs that are not running are reported from the status files, including ones started by btrfs-progs`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("mount not specified")
+		} else if len(args) > 1 {
+			return fmt.Errorf("only one mount path is allowed")
+		}
+		fs, err := btrfs.Open(args[0], false)
+		if err != nil {
+			return err
+		}
+		info, err := fs.Info()
+		if err != nil {
+			return err
+		}
+		statusDir, _ := cmd.Flags().GetString("status-dir")
+		fs.SetScrubStatusDir(statusDir)
+		perDev, _ := cmd.Flags().GetBool("devices")
+		devs, err := scrubDevStatuses(fs)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("UUID:             %v\n", btrfs.UUID(info.FSID))
+		if perDev {
+			for _, d := range devs {
+				fmt.Printf("scrub device %s (id %d) status\n", d.dev.Path, d.dev.ID)
+				printScrubDevStatus(d)
+			}
+			return nil
+		}
+		printScrubDevStatus(sumScrubDevStatus(devs))
+		for _, d := range devs {
+			state := d.state
+			if state == "" {
+				state = "no stats available"
+			}
+			fmt.Printf("  device %d (%s): %s\n", d.dev.ID, d.dev.Path, state)
 		}
 		return nil
 	},
@@ -250,9 +698,12 @@ var StatsReset = &cobra.Command{
 	},
 }
 var StatsGet = &cobra.Command{
-	Use:   "stats <mount>",
+	Use:   "stats [-z] [-c] [-T | --prom] <mount>",
 	Short: "Get device stats",
-	Long:  `Get device stats on the given device`,
+	Long: `Get device stats on the given device.
+
+With --prom, the stats are printed as btrfs_device_errors_total counters
+labeled with the fsid, the device id, the device path and the error type.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) == 0 {
 			return fmt.Errorf("mount not specified")
@@ -271,9 +722,15 @@ var StatsGet = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		prom, _ := cmd.Flags().GetBool("prom")
+		if prom && tabular {
+			return fmt.Errorf("-T and --prom cannot be used together")
+		}
 		flags := uint64(0)
 		if resetFlag {
-			fmt.Println("Stats will be reset after reading")
+			if !prom {
+				fmt.Println("Stats will be reset after reading")
+			}
 			flags = btrfs.DevStatsFlagsReset
 		}
 
@@ -330,7 +787,11 @@ var StatsGet = &cobra.Command{
 				Path:  devInfo.Path,
 			})
 		}
-		if tabular {
+		if prom {
+			if err = writePromStats(os.Stdout, btrfs.UUID(info.FSID), stats); err != nil {
+				return err
+			}
+		} else if tabular {
 			fmt.Print("Id")
 			fmt.Print(" ")
 			fmt.Print("Path")
@@ -406,7 +867,10 @@ type DeviceWithStats struct {
 }
 
 func main() {
-	if err := RootCmd.Execute(); err != nil {
+	start := time.Now()
+	cmd, err := RootCmd.ExecuteC()
+	writeSummary(cmd, start, err)
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
 	}
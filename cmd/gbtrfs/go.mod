@@ -1,11 +1,19 @@
 module github.com/dennwc/btrfs/cmd/gbtrfs
 
-go 1.12
+go 1.19
 
 require (
+	filippo.io/age v1.2.1
 	github.com/dennwc/btrfs v0.0.0-20181021180244-694b569856e3
-	github.com/dennwc/ioctl v1.0.0 // indirect
-	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/spf13/cobra v0.0.3
-	github.com/spf13/pflag v1.0.3 // indirect
+	github.com/spf13/pflag v1.0.3
+)
+
+require (
+	github.com/dennwc/ioctl v1.0.1-0.20181021180353-017804252068 // indirect
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	golang.org/x/crypto v0.24.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
 )
+
+replace github.com/dennwc/btrfs => ../..
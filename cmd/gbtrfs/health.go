@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/dennwc/btrfs"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(HealthCmd)
+	HealthCmd.Flags().Bool("json", false, "print the report as JSON")
+	HealthCmd.Flags().String("state-dir", "", "directory with scrub history and acknowledged device errors")
+	HealthCmd.Flags().Duration("scrub-age", 0, "maximal age of the last scrub (default 31 days)")
+}
+
+var HealthCmd = &cobra.Command{
+	Use:   "health [--json] [--state-dir <dir>] <mount>",
+	Short: "Check the health of the filesystem.",
+	Long: `Combines device error counters, missing devices, scrub recency, space
+pressure and redundancy of block group profiles into a single verdict.
+Exit code is 0 for green, 1 for yellow and 2 for red.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected one mount argument")
+		}
+		asJSON, _ := cmd.Flags().GetBool("json")
+		stateDir, _ := cmd.Flags().GetString("state-dir")
+		scrubAge, _ := cmd.Flags().GetDuration("scrub-age")
+		fs, err := btrfs.Open(args[0], true)
+		if err != nil {
+			return err
+		}
+		defer fs.Close()
+		fs.SetStateDir(stateDir)
+		r, err := fs.Health(&btrfs.HealthOptions{ScrubMaxAge: scrubAge})
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "\t")
+			if err = enc.Encode(r); err != nil {
+				return err
+			}
+		} else {
+			fmt.Printf("%s: %v\n", args[0], r.Status)
+			for _, c := range r.Checks {
+				fmt.Printf("  [%v] %s: %s\n", c.Status, c.Name, c.Message)
+			}
+		}
+		if r.Status != btrfs.HealthGreen {
+			fs.Close()
+			os.Exit(int(r.Status))
+		}
+		return nil
+	},
+}
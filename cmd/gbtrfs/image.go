@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/units"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(ImageCmd)
+	ImageCmd.AddCommand(ImageLsCmd, ImageCatCmd, ImageStatCmd)
+	ImageLsCmd.Flags().BoolP("long", "l", false, "use a long listing format")
+	ImageCmd.PersistentFlags().Bool("direct", false, "read the device with O_DIRECT, bypassing the page cache")
+	ImageCmd.PersistentFlags().String("read-ahead", "", "size of read-ahead windows for sequential reads, e.g. 4M")
+	ImageCmd.PersistentFlags().Int("concurrency", 1, "number of read-ahead windows read in parallel")
+	ImageCmd.PersistentFlags().StringArray("device", nil, "other member device of a multi-device filesystem (multiple allowed)")
+	ImageCmd.PersistentFlags().Bool("ignore-csum", false, "return damaged file data if no copy matches its checksum")
+	ImageCatCmd.Flags().Bool("progress", false, "print read throughput to stderr")
+}
+
+var ImageCmd = &cobra.Command{
+	Use:   "image <command> <args>",
+	Short: "Browse files of an unmounted filesystem image or device.",
+	Long: `Reads files directly from a btrfs image or an unmounted device, without
+mounting it. Root privileges are only needed to access the device itself.
+Paths are relative to the top-level subvolume; symlinks are not followed.
+
+Other devices of a multi-device filesystem are passed with --device. Missing
+devices are tolerated if their data has other copies (raid1, raid10), and
+copies that fail checksums are replaced by intact ones, so files can be
+recovered from degraded arrays that the kernel refuses to mount.`,
+}
+
+// openImageArgs opens the image from the first argument and returns the path from the second one.
+func openImageArgs(cmd *cobra.Command, args []string, needPath bool) (*btrfs.Image, string, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, "", fmt.Errorf("expected an image and an optional path")
+	} else if needPath && len(args) != 2 {
+		return nil, "", fmt.Errorf("expected an image and a path")
+	}
+	path := "/"
+	if len(args) == 2 {
+		path = args[1]
+	}
+	var opts btrfs.ImageOptions
+	opts.DirectIO, _ = cmd.Flags().GetBool("direct")
+	opts.Concurrency, _ = cmd.Flags().GetInt("concurrency")
+	if s, _ := cmd.Flags().GetString("read-ahead"); s != "" {
+		n, err := units.Parse(s)
+		if err != nil {
+			return nil, "", err
+		}
+		opts.ReadAhead = int(n)
+	}
+	if opts.Concurrency < 1 {
+		return nil, "", fmt.Errorf("invalid concurrency: %d", opts.Concurrency)
+	}
+	opts.IgnoreDataCsum, _ = cmd.Flags().GetBool("ignore-csum")
+	devs, _ := cmd.Flags().GetStringArray("device")
+	im, err := btrfs.OpenImageDevices(append([]string{args[0]}, devs...), &opts)
+	return im, path, err
+}
+
+var ImageLsCmd = &cobra.Command{
+	Use:   "ls [-l] <image> [<path>]",
+	Short: "List a directory of the image.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		im, path, err := openImageArgs(cmd, args, false)
+		if err != nil {
+			return err
+		}
+		defer im.Close()
+		long, _ := cmd.Flags().GetBool("long")
+		fi, err := im.Stat(path)
+		if err != nil {
+			return err
+		}
+		list := []os.FileInfo{fi}
+		dir := ""
+		if fi.IsDir() {
+			if list, err = im.ReadDir(path); err != nil {
+				return err
+			}
+			dir = path + "/"
+		}
+		for _, fi := range list {
+			if !long {
+				fmt.Println(fi.Name())
+				continue
+			}
+			ino := fi.Sys().(*btrfs.ImageInode)
+			name := fi.Name()
+			if fi.Mode()&os.ModeSymlink != 0 {
+				if dst, err := im.ReadLink(dir + fi.Name()); err == nil {
+					name += " -> " + dst
+				}
+			}
+			fmt.Printf("%v %3d %5d %5d %10d %s %s\n", fi.Mode(), ino.NLink, ino.UID, ino.GID,
+				fi.Size(), fi.ModTime().Format("2006-01-02 15:04"), name)
+		}
+		return nil
+	},
+}
+
+var ImageCatCmd = &cobra.Command{
+	Use:   "cat <image> <path>",
+	Short: "Write the contents of a file in the image to stdout.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		im, path, err := openImageArgs(cmd, args, true)
+		if err != nil {
+			return err
+		}
+		defer im.Close()
+		f, err := im.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if progress, _ := cmd.Flags().GetBool("progress"); progress {
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				t := time.NewTicker(progressInterval)
+				defer t.Stop()
+				for {
+					select {
+					case <-done:
+						return
+					case <-t.C:
+						st := im.Stats()
+						fmt.Fprintf(os.Stderr, "%s read (%s/s)\n", fmtSize(st.Bytes), fmtSize(uint64(st.Rate())))
+					}
+				}
+			}()
+		}
+		_, err = io.Copy(os.Stdout, f)
+		return err
+	},
+}
+
+var ImageStatCmd = &cobra.Command{
+	Use:   "stat <image> [<path>]",
+	Short: "Show information about a file in the image.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		im, path, err := openImageArgs(cmd, args, false)
+		if err != nil {
+			return err
+		}
+		defer im.Close()
+		fi, err := im.Stat(path)
+		if err != nil {
+			return err
+		}
+		ino := fi.Sys().(*btrfs.ImageInode)
+		fmt.Printf("  File: %s\n", path)
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if dst, err := im.ReadLink(path); err == nil {
+				fmt.Printf("  Link: %s\n", dst)
+			}
+		}
+		fmt.Printf("  Size: %d\n", fi.Size())
+		fmt.Printf(" Inode: %d (subvolume %d)\n", ino.Inode, ino.Tree)
+		fmt.Printf("  Mode: %v (%04o)\n", fi.Mode(), ino.Mode&07777)
+		fmt.Printf(" Links: %d\n", ino.NLink)
+		fmt.Printf("   Uid: %d\n", ino.UID)
+		fmt.Printf("   Gid: %d\n", ino.GID)
+		if fi.Mode()&os.ModeDevice != 0 {
+			fmt.Printf("  Rdev: %d,%d\n", ino.RDev>>20, ino.RDev&(1<<20-1))
+		}
+		for _, t := range []struct {
+			name string
+			t    time.Time
+		}{
+			{"Access", ino.ATime},
+			{"Modify", ino.MTime},
+			{"Change", ino.CTime},
+			{" Birth", ino.OTime},
+		} {
+			fmt.Printf("%s: %s\n", t.name, t.t.Format("2006-01-02 15:04:05.000000000 -0700"))
+		}
+		fmt.Printf("  FSID: %v, generation %d\n", im.FSID(), im.Generation())
+		return nil
+	},
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dennwc/btrfs/send"
+)
+
+// progressInterval is the minimal interval between progress lines.
+const progressInterval = time.Second
+
+// progressPrinter returns a callback that prints the progress of a stream transfer
+// to stderr, and a function that prints the final state.
+func progressPrinter() (send.ProgressFunc, func()) {
+	var (
+		last  send.Progress
+		shown time.Time
+		start = time.Now()
+	)
+	print := func() {
+		rate := float64(last.Bytes) / time.Since(start).Seconds()
+		fmt.Fprintf(os.Stderr, "%s (%s/s), %d commands, %v %s\n",
+			fmtSize(uint64(last.Bytes)), fmtSize(uint64(rate)), last.Commands, last.Cmd, last.Path)
+	}
+	fn := func(p send.Progress) {
+		last = p
+		if now := time.Now(); now.Sub(shown) >= progressInterval {
+			shown = now
+			print()
+		}
+	}
+	return fn, func() {
+		if last.Commands != 0 {
+			print()
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dennwc/btrfs"
+)
+
+// promLabel escapes a label value for the Prometheus text format.
+func promLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// writePromStats writes device error counters in the Prometheus text format,
+// suitable for the textfile collector of node_exporter.
+func writePromStats(w io.Writer, fsid btrfs.UUID, stats []DeviceWithStats) error {
+	const name = "btrfs_device_errors_total"
+	if _, err := fmt.Fprintf(w, "# HELP %s Number of errors of a btrfs device by type.\n# TYPE %s counter\n", name, name); err != nil {
+		return err
+	}
+	for _, v := range stats {
+		for _, c := range []struct {
+			typ string
+			val uint64
+		}{
+			{"write_io_errs", v.Stats.WriteErrs},
+			{"read_io_errs", v.Stats.ReadErrs},
+			{"flush_io_errs", v.Stats.FlushErrs},
+			{"corruption_errs", v.Stats.CorruptionErrs},
+			{"generation_errs", v.Stats.GenerationErrs},
+		} {
+			_, err := fmt.Fprintf(w, "%s{fsid=\"%s\",devid=\"%d\",device=\"%s\",type=\"%s\"} %d\n",
+				name, fsid, v.Id, promLabel(v.Path), c.typ, c.val)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
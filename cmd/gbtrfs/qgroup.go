@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dennwc/btrfs"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(QgroupCmd)
+	QgroupCmd.AddCommand(QgroupUsageCmd)
+	QgroupUsageCmd.Flags().Float64("exceeds", 0, "show only subvolumes using more than a given percentage of their limit")
+}
+
+var QgroupCmd = &cobra.Command{
+	Use: "qgroup <command> <args>",
+}
+
+const usageBarWidth = 20
+
+// usageBar renders a percentage as a bar of a fixed width.
+func usageBar(pct float64) string {
+	n := int(pct / 100 * usageBarWidth)
+	if n > usageBarWidth {
+		n = usageBarWidth
+	} else if n < 0 {
+		n = 0
+	}
+	return "[" + strings.Repeat("#", n) + strings.Repeat(".", usageBarWidth-n) + "]"
+}
+
+// qgroupPercent returns the usage of the most constrained limit, or -1 if there are no limits.
+func qgroupPercent(q *btrfs.Qgroup) float64 {
+	pct := -1.0
+	if q.MaxReferenced != 0 {
+		pct = float64(q.Referenced) / float64(q.MaxReferenced) * 100
+	}
+	if q.MaxExclusive != 0 {
+		if p := float64(q.Exclusive) / float64(q.MaxExclusive) * 100; p > pct {
+			pct = p
+		}
+	}
+	return pct
+}
+
+var QgroupUsageCmd = &cobra.Command{
+	Use:   "usage [--exceeds <percent>] <mount>",
+	Short: "Show usage of subvolumes against their quota limits.",
+	Long: `Prints referenced and exclusive bytes of each subvolume together with its
+limits. Subvolumes with limits have a bar showing the usage of the most
+constrained limit. With --exceeds, only subvolumes using more than a given
+percentage of their limit are shown.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected one mount argument")
+		}
+		exceeds, _ := cmd.Flags().GetFloat64("exceeds")
+		fs, err := btrfs.Open(args[0], true)
+		if err != nil {
+			return err
+		}
+		defer fs.Close()
+		if err = fs.Sync(); err != nil {
+			return err
+		}
+		qgroups, err := fs.Qgroups()
+		if err != nil {
+			return err
+		}
+		list, err := fs.ListSubvolumes(nil)
+		if err != nil {
+			return err
+		}
+		paths := map[uint64]string{5: "<FS_TREE>"}
+		for _, v := range list {
+			paths[v.RootID] = v.Path
+		}
+		sort.Slice(qgroups, func(i, j int) bool {
+			return qgroupPercent(&qgroups[i]) > qgroupPercent(&qgroups[j])
+		})
+		fmt.Printf("%-10s %15s %15s %15s %15s %-*s %7s  %s\n",
+			"Qgroup", "Referenced", "Max ref", "Exclusive", "Max excl", usageBarWidth+2, "Usage", "%", "Path")
+		limit := func(v uint64) string {
+			if v == 0 {
+				return "none"
+			}
+			return fmtSize(v)
+		}
+		for i := range qgroups {
+			q := &qgroups[i]
+			if q.ID.Level() != 0 {
+				continue
+			}
+			path, ok := paths[q.ID.ID()]
+			if !ok {
+				continue // stale qgroup of a deleted subvolume
+			}
+			pct := qgroupPercent(q)
+			if exceeds > 0 && pct < exceeds {
+				continue
+			}
+			bar, spct := strings.Repeat(" ", usageBarWidth+2), "-"
+			if pct >= 0 {
+				bar, spct = usageBar(pct), fmt.Sprintf("%.1f", pct)
+			}
+			fmt.Printf("%-10v %15s %15s %15s %15s %s %7s  %s\n",
+				q.ID, fmtSize(q.Referenced), limit(q.MaxReferenced), fmtSize(q.Exclusive), limit(q.MaxExclusive), bar, spct, path)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dennwc/btrfs"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	DeviceCmd.AddCommand(ReplaceCmd)
+	ReplaceCmd.AddCommand(ReplaceWizardCmd)
+}
+
+var ReplaceCmd = &cobra.Command{
+	Use: "replace <command> <args>",
+}
+
+// replaceCandidate is a device together with its state, as shown by the wizard.
+type replaceCandidate struct {
+	dev     btrfs.DevInfo
+	missing bool
+	errs    uint64 // number of errors since the last acknowledgment
+}
+
+// suggestReplace returns an index of the device that is most likely to fail:
+// a missing one, or the one with the most errors. It returns -1 if all devices look healthy.
+func suggestReplace(cands []replaceCandidate) int {
+	best := -1
+	for i, c := range cands {
+		switch {
+		case c.missing:
+			return i
+		case c.errs == 0:
+		case best < 0 || c.errs > cands[best].errs:
+			best = i
+		}
+	}
+	return best
+}
+
+func devStatsTotal(s btrfs.DevStats) uint64 {
+	return s.WriteErrs + s.ReadErrs + s.FlushErrs + s.CorruptionErrs + s.GenerationErrs
+}
+
+// prompt prints a question and reads a single line of the answer. Default value is
+// returned for an empty answer.
+func prompt(r *bufio.Reader, question, def string) (string, error) {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	line, err := r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def, nil
+	}
+	return line, nil
+}
+
+var ReplaceWizardCmd = &cobra.Command{
+	Use:   "wizard <mount>",
+	Short: "Interactively replace a failing device.",
+	Long: `Lists devices of the filesystem with their sizes and error counters, suggests
+the failing one (missing, or with the most errors since the last acknowledgment),
+checks that the replacement is large enough and runs the replace, showing its progress.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected one mount argument")
+		}
+		fs, err := btrfs.Open(args[0], false)
+		if err != nil {
+			return err
+		}
+		defer fs.Close()
+		if st, err := fs.ReplaceStatus(); err != nil {
+			return err
+		} else if st.State == btrfs.ReplaceStarted || st.State == btrfs.ReplaceSuspended {
+			return fmt.Errorf("device replace is already %v (%.1f%% done)", st.State, st.Progress*100)
+		}
+		devs, err := fs.Devices()
+		if err != nil {
+			return err
+		}
+		cands := make([]replaceCandidate, 0, len(devs))
+		fmt.Printf("%5s  %10s  %10s  %8s  %s\n", "devid", "size", "used", "errors", "path")
+		for _, d := range devs {
+			c := replaceCandidate{dev: d}
+			if d.Path == "" {
+				c.missing = true
+			} else if _, err := os.Stat(d.Path); os.IsNotExist(err) {
+				c.missing = true
+			}
+			if s, err := fs.DevStatsSinceAck(d.ID); err == nil {
+				c.errs = devStatsTotal(s)
+			}
+			path := d.Path
+			if c.missing {
+				path += " (missing)"
+			}
+			fmt.Printf("%5d  %10s  %10s  %8d  %s\n", d.ID, fmtSize(d.TotalBytes), fmtSize(d.BytesUsed), c.errs, path)
+			cands = append(cands, c)
+		}
+		def := ""
+		if i := suggestReplace(cands); i >= 0 {
+			def = strconv.FormatUint(cands[i].dev.ID, 10)
+		}
+		in := bufio.NewReader(os.Stdin)
+		ans, err := prompt(in, "Device id to replace", def)
+		if err != nil {
+			return err
+		}
+		id, err := strconv.ParseUint(ans, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid device id: %q", ans)
+		}
+		var src *replaceCandidate
+		for i := range cands {
+			if cands[i].dev.ID == id {
+				src = &cands[i]
+			}
+		}
+		if src == nil {
+			return fmt.Errorf("no device with id %d", id)
+		}
+		tgt, err := prompt(in, "Replacement device path", "")
+		if err != nil {
+			return err
+		} else if tgt == "" {
+			return fmt.Errorf("replacement device is not set")
+		}
+		size, err := btrfs.DeviceSize(tgt)
+		if err != nil {
+			return err
+		}
+		if size < src.dev.TotalBytes {
+			return fmt.Errorf("%s is too small: %s, while devid %d has %s", tgt, fmtSize(size), id, fmtSize(src.dev.TotalBytes))
+		}
+		// avoid reading from a device that is known to produce errors
+		avoid := src.errs != 0
+		ans, err = prompt(in, fmt.Sprintf("Replace devid %d with %s? All data on %s will be lost (yes/no)", id, tgt, tgt), "no")
+		if err != nil {
+			return err
+		} else if ans != "yes" && ans != "y" {
+			return fmt.Errorf("aborted")
+		}
+		errc := make(chan error, 1)
+		go func() {
+			errc <- fs.ReplaceStart(id, "", tgt, avoid)
+		}()
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case err = <-errc:
+			case <-ticker.C:
+				if st, err := fs.ReplaceStatus(); err == nil && st.State == btrfs.ReplaceStarted {
+					fmt.Printf("\r%5.1f%% done, %d write errors, %d uncorrectable read errors",
+						st.Progress*100, st.WriteErrors, st.UncorrectableReadErrors)
+				}
+				continue
+			}
+			break
+		}
+		fmt.Println()
+		if err != nil {
+			return err
+		}
+		st, err := fs.ReplaceStatus()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("replace %v, %d write errors, %d uncorrectable read errors\n",
+			st.State, st.WriteErrors, st.UncorrectableReadErrors)
+		return nil
+	},
+}
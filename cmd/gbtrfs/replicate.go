@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dennwc/btrfs"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(ReplicateCmd)
+	ReplicateCmd.Flags().String("ssh", "", "receive on a remote host (user@host) with btrfs-progs")
+	ReplicateCmd.Flags().String("snapshots", "", "directory for source snapshots (default: parent of <src-subvol>)")
+	ReplicateCmd.Flags().Int("keep", 0, "number of recent snapshots to keep on both sides (0 keeps all)")
+}
+
+var ReplicateCmd = &cobra.Command{
+	Use:   "replicate [--ssh user@host] [--snapshots <dir>] [--keep N] <src-subvol> <dst-mount>",
+	Short: "Snapshot a subvolume, send it incrementally and prune old snapshots.",
+	Long: `Creates a read-only snapshot of <src-subvol> and receives it into <dst-mount>,
+using the most recent read-only snapshot of <src-subvol> that was already received
+by the destination (according to its received UUID) as a parent.
+With --keep, older snapshots are deleted from both sides after a successful transfer.
+
+With --ssh, the stream is received by "btrfs receive" on the remote host.
+
+A JSON summary is printed to stdout at the end.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return fmt.Errorf("expected source subvolume and destination arguments")
+		}
+		host, _ := cmd.Flags().GetString("ssh")
+		snapDir, _ := cmd.Flags().GetString("snapshots")
+		keep, _ := cmd.Flags().GetInt("keep")
+		if keep < 0 {
+			return fmt.Errorf("invalid number of snapshots to keep: %d", keep)
+		}
+		var dst btrfs.ReplicaTarget
+		if host != "" {
+			dst = &sshTarget{host: host, dir: args[1]}
+		} else {
+			dst = btrfs.LocalTarget(args[1])
+		}
+		res, err := btrfs.Replicate(args[0], dst, &btrfs.ReplicateOptions{
+			SnapshotDir: snapDir,
+			Keep:        keep,
+		})
+		if err != nil {
+			return err
+		}
+		atomic.AddUint64(&summaryBytes, res.Bytes)
+		return json.NewEncoder(os.Stdout).Encode(struct {
+			Snapshot string   `json:"snapshot"`
+			Parent   string   `json:"parent"`
+			Received string   `json:"received"`
+			Bytes    uint64   `json:"bytes_sent"`
+			Duration float64  `json:"duration_sec"`
+			Pruned   []string `json:"pruned"`
+		}{
+			Snapshot: res.Snapshot,
+			Parent:   res.Parent,
+			Received: res.Received,
+			Bytes:    res.Bytes,
+			Duration: res.Duration.Seconds(),
+			Pruned:   res.Pruned,
+		})
+	},
+}
+
+// sshTarget runs btrfs-progs on a remote host to receive and manage snapshots.
+type sshTarget struct {
+	host string
+	dir  string
+}
+
+func (t *sshTarget) command(args ...string) *exec.Cmd {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	c := exec.Command("ssh", t.host, strings.Join(quoted, " "))
+	c.Stderr = os.Stderr
+	return c
+}
+
+func (t *sshTarget) Receive(r io.Reader) error {
+	c := t.command("btrfs", "receive", t.dir)
+	c.Stdin = r
+	return c.Run()
+}
+
+func (t *sshTarget) Lookup(uuid btrfs.UUID) (string, error) {
+	out, err := t.command("btrfs", "subvolume", "list", "-o", "-R", t.dir).Output()
+	if err != nil {
+		return "", err
+	}
+	// ID 258 gen 12 top level 5 received_uuid 2b7d... path backups/home.20200101T000000Z
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		i := strings.Index(line, " received_uuid ")
+		j := strings.Index(line, " path ")
+		if i < 0 || j < i {
+			continue
+		}
+		id, err := btrfs.ParseUUID(strings.TrimSpace(line[i+len(" received_uuid ") : j]))
+		if err != nil || id != uuid {
+			continue
+		}
+		return path.Base(line[j+len(" path "):]), nil
+	}
+	if err = sc.Err(); err != nil {
+		return "", err
+	}
+	return "", btrfs.ErrNotFound
+}
+
+func (t *sshTarget) Delete(name string) error {
+	return t.command("btrfs", "subvolume", "delete", path.Join(t.dir, name)).Run()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dennwc/btrfs"
+)
+
+// scrubResult is a result of a scrub on a single device.
+type scrubResult struct {
+	dev      btrfs.DevInfo
+	progress btrfs.ScrubProgress
+	err      error
+}
+
+// scrubDevices scrubs all devices of the filesystem concurrently and waits for the scrubs to finish.
+// Missing devices are reported and skipped. Devices that failed to start are returned with an error.
+// Scrubs are canceled when the context is canceled. If progress is set, the combined progress
+// is printed to stderr while the scrubs run.
+func scrubDevices(ctx context.Context, fs *btrfs.FS, flags btrfs.ScrubFlags, progress bool) ([]scrubResult, error) {
+	devs, err := fs.Devices()
+	if err != nil {
+		return nil, err
+	}
+	var present []btrfs.DevInfo
+	for _, d := range devs {
+		if d.Path == "" {
+			fmt.Fprintf(os.Stderr, "device %d is missing, skipping\n", d.ID)
+		} else {
+			present = append(present, d)
+		}
+	}
+	if progress {
+		pctx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			printScrubProgress(pctx, fs, present)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+	}
+	res, err := fs.ScrubAllWithFlags(ctx, flags)
+	if res == nil {
+		return nil, err
+	}
+	// cancellation is reported by results of individual devices
+	var out []scrubResult
+	for _, d := range devs {
+		if r, ok := res[d.ID]; ok {
+			out = append(out, scrubResult{dev: d, progress: r.Progress, err: r.Err})
+		}
+	}
+	return out, nil
+}
+
+// printScrubProgress periodically prints the combined progress of scrubs on the devices to stderr,
+// until the context is canceled.
+func printScrubProgress(ctx context.Context, fs *btrfs.FS, devs []btrfs.DevInfo) {
+	start := btrfs.ScrubSample{Time: time.Now()}
+	var size uint64
+	for _, d := range devs {
+		size += d.BytesUsed
+	}
+	last := make(map[uint64]btrfs.ScrubProgress)
+	t := time.NewTicker(progressInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		cur := btrfs.ScrubSample{Time: time.Now()}
+		for _, d := range devs {
+			// keep the last progress of devices that have finished
+			if p, err := fs.ScrubStatus(d.ID); err == nil {
+				last[d.ID] = p
+			}
+			cur.Progress = cur.Progress.Add(last[d.ID])
+		}
+		done := cur.Progress.DataBytesScrubbed + cur.Progress.TreeBytesScrubbed
+		fmt.Fprintf(os.Stderr, "%s of %s scrubbed, %s\n", fmtSize(done), fmtSize(size),
+			fmtScrubRate(btrfs.ScrubEstimate(start, cur, size)))
+	}
+}
+
+// scrubDetach runs "scrub start" again with -B in a background process, same as btrfs-progs
+// does by default, and returns its pid. It waits until the scrub has started, so that errors
+// like a scrub that is already running are reported. The background process records the results
+// to the status files and the history, but its output is discarded.
+func scrubDetach(fs *btrfs.FS) (int, error) {
+	devs, err := fs.Devices()
+	if err != nil {
+		return 0, err
+	}
+	running := func() bool {
+		for _, d := range devs {
+			if _, err := fs.ScrubStatus(d.ID); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+	if running() {
+		return 0, fmt.Errorf("scrub is already running: %v", syscall.EINPROGRESS)
+	}
+	return detach("-B", running)
+}
+
+// setScrubLimits limits the scrub bandwidth of all devices and returns a function
+// that restores the previous limits.
+func setScrubLimits(fs *btrfs.FS, limit uint64) (func(), error) {
+	prev, err := fs.ScrubLimits()
+	if err != nil {
+		return nil, err
+	}
+	restore := func() {
+		for _, l := range prev {
+			if err := fs.SetScrubLimit(l.DevID, l.BytesPerSec); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot restore scrub limit of device %d: %v\n", l.DevID, err)
+			}
+		}
+	}
+	for _, l := range prev {
+		if err = fs.SetScrubLimit(l.DevID, limit); err != nil {
+			restore()
+			return nil, err
+		}
+	}
+	return restore, nil
+}
+
+// scrubStatus returns the state of a finished scrub, as named by btrfs-progs.
+func scrubStatus(err error) string {
+	switch err {
+	case nil:
+		return "finished"
+	case syscall.ECANCELED:
+		return "interrupted"
+	}
+	return "aborted"
+}
+
+// scrubFileStatus returns the state of a scrub recorded in the status file.
+func scrubFileStatus(e btrfs.ScrubFileEntry) string {
+	switch {
+	case e.Canceled:
+		return "interrupted"
+	case e.Finished:
+		return "finished"
+	}
+	return "aborted" // not running according to the kernel, but not stopped either
+}
+
+// fmtScrubDuration formats a duration of a scrub as h:mm:ss.
+func fmtScrubDuration(d time.Duration) string {
+	sec := int64(d.Round(time.Second).Seconds())
+	return fmt.Sprintf("%d:%02d:%02d", sec/3600, sec/60%60, sec%60)
+}
+
+// fmtScrubRate formats the rate and the completion estimate of a running scrub.
+func fmtScrubRate(r btrfs.ScrubRate) string {
+	eta := "unknown"
+	if !r.ETA.IsZero() {
+		eta = fmt.Sprintf("%s (in %s)", r.ETA.Format(time.ANSIC), fmtScrubDuration(r.Remaining))
+	}
+	return fmt.Sprintf("%.2f%% done, rate %s/s, ETA %s", r.Percent, fmtSize(uint64(r.BytesPerSec)), eta)
+}
+
+// fmtScrubErrors formats the error summary of a scrub, in the same way as btrfs-progs.
+func fmtScrubErrors(p btrfs.ScrubProgress) string {
+	if !p.HasErrors() {
+		return "no errors found"
+	}
+	var errs []string
+	for _, c := range []struct {
+		name string
+		n    uint64
+	}{
+		{"read", p.ReadErrors},
+		{"super", p.SuperErrors},
+		{"verify", p.VerifyErrors},
+		{"csum", p.CsumErrors},
+	} {
+		if c.n != 0 {
+			errs = append(errs, fmt.Sprintf("%s=%d", c.name, c.n))
+		}
+	}
+	return fmt.Sprintf("%s\n  Corrected:      %d\n  Uncorrectable:  %d\n  Unverified:     %d",
+		strings.Join(errs, " "), p.CorrectedErrors, p.UncorrectableErrors, p.UnverifiedErrors)
+}
+
+// scrubDevStatus is a status of scrubs on a device, or a combined status of all devices.
+type scrubDevStatus struct {
+	dev      btrfs.DevInfo
+	state    string    // running, finished, interrupted, aborted, or empty if there's no scrub
+	started  time.Time // zero if unknown
+	duration time.Duration
+	prev     btrfs.ScrubSample // first sample of a running scrub, to compute the rate
+	cur      btrfs.ScrubSample
+}
+
+// rate returns the rate of the scrub. For scrubs that are not running, it's the average rate.
+func (d *scrubDevStatus) rate() btrfs.ScrubRate {
+	if d.state == "running" {
+		return btrfs.ScrubEstimate(d.prev, d.cur, d.dev.BytesUsed)
+	}
+	var start btrfs.ScrubSample
+	end := btrfs.ScrubSample{Time: start.Time.Add(d.duration), Progress: d.cur.Progress}
+	r := btrfs.ScrubEstimate(start, end, d.dev.BytesUsed)
+	r.Remaining, r.ETA = 0, time.Time{}
+	return r
+}
+
+// scrubDevStatuses returns the status of scrubs on all devices. Running scrubs are taken from
+// the kernel and sampled twice to compute the rate, other ones are taken from the status file.
+func scrubDevStatuses(fs *btrfs.FS) ([]scrubDevStatus, error) {
+	devs, err := fs.Devices()
+	if err != nil {
+		return nil, err
+	}
+	last := make(map[uint64]btrfs.ScrubFileEntry)
+	entries, err := fs.ScrubStatusFile()
+	if err != nil && err != btrfs.ErrNotFound && fs.ScrubStatusDir() != "" {
+		return nil, err
+	}
+	for _, e := range entries {
+		last[e.DevID] = e
+	}
+	out := make([]scrubDevStatus, 0, len(devs))
+	running := false
+	for _, d := range devs {
+		st := scrubDevStatus{dev: d}
+		e, ok := last[d.ID]
+		if ok {
+			st.started, st.duration = e.Started, e.Duration
+			st.cur.Progress = e.Progress
+			st.state = scrubFileStatus(e)
+		}
+		if p, err := fs.ScrubStatus(d.ID); err == nil {
+			st.state = "running"
+			st.prev = btrfs.ScrubSample{Time: time.Now(), Progress: p}
+			st.cur = st.prev
+			if ok && e.Running() {
+				since := e.Started
+				if !e.Resumed.IsZero() {
+					since = e.Resumed
+				}
+				st.duration = e.Duration + time.Since(since)
+			} else {
+				st.started, st.duration = time.Time{}, 0
+			}
+			running = true
+		} else if err != syscall.ENOTCONN && err != syscall.ENODEV {
+			return nil, err
+		}
+		out = append(out, st)
+	}
+	if !running {
+		return out, nil
+	}
+	time.Sleep(progressInterval)
+	for i := range out {
+		st := &out[i]
+		if st.state != "running" {
+			continue
+		}
+		st.cur.Time = time.Now()
+		if p, err := fs.ScrubStatus(st.dev.ID); err == nil {
+			st.cur.Progress = p
+		} else if err != syscall.ENOTCONN {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// sumScrubDevStatus combines the status of scrubs on all devices.
+func sumScrubDevStatus(devs []scrubDevStatus) scrubDevStatus {
+	var (
+		sum    scrubDevStatus
+		states = make(map[string]bool)
+	)
+	for _, d := range devs {
+		sum.dev.BytesUsed += d.dev.BytesUsed
+		if d.state == "running" {
+			sum.prev.Progress = sum.prev.Progress.Add(d.prev.Progress)
+			// samples of devices are taken at almost the same time
+			sum.prev.Time, sum.cur.Time = d.prev.Time, d.cur.Time
+		} else {
+			sum.prev.Progress = sum.prev.Progress.Add(d.cur.Progress)
+		}
+		sum.cur.Progress = sum.cur.Progress.Add(d.cur.Progress)
+		if !d.started.IsZero() && (sum.started.IsZero() || d.started.Before(sum.started)) {
+			sum.started = d.started
+		}
+		if d.duration > sum.duration {
+			sum.duration = d.duration
+		}
+		states[d.state] = true
+	}
+	for _, s := range []string{"running", "aborted", "interrupted", "finished"} {
+		if states[s] {
+			sum.state = s
+			break
+		}
+	}
+	return sum
+}
+
+// printScrubDevStatus prints the status of scrubs on a device, or a combined status of all devices.
+func printScrubDevStatus(d scrubDevStatus) {
+	if d.state == "" {
+		fmt.Printf("\tno stats available\n")
+		return
+	}
+	r := d.rate()
+	done := d.cur.Progress.DataBytesScrubbed + d.cur.Progress.TreeBytesScrubbed
+	if !d.started.IsZero() {
+		fmt.Printf("Scrub started:    %s\n", d.started.Format(time.ANSIC))
+	}
+	fmt.Printf("Status:           %s\n", d.state)
+	if d.duration != 0 {
+		fmt.Printf("Duration:         %s\n", fmtScrubDuration(d.duration))
+	}
+	fmt.Printf("Total to scrub:   %s\n", fmtSize(d.dev.BytesUsed))
+	fmt.Printf("Bytes scrubbed:   %s (%.2f%%)\n", fmtSize(done), r.Percent)
+	fmt.Printf("Rate:             %s/s\n", fmtSize(uint64(r.BytesPerSec)))
+	if d.state == "running" && !r.ETA.IsZero() {
+		fmt.Printf("ETA:              %s (in %s)\n", r.ETA.Format(time.ANSIC), fmtScrubDuration(r.Remaining))
+	}
+	fmt.Printf("Error summary:    %s\n", fmtScrubErrors(d.cur.Progress))
+}
+
+// printScrubSummary prints the combined result of scrubs on all devices.
+func printScrubSummary(fsid btrfs.FSID, started time.Time, res []scrubResult) {
+	var (
+		total  btrfs.ScrubProgress
+		status = "finished"
+	)
+	for _, r := range res {
+		total = total.Add(r.progress)
+		if s := scrubStatus(r.err); s == "aborted" || status == "finished" {
+			status = s
+		}
+	}
+	fmt.Printf("scrub done for %v\n", btrfs.UUID(fsid))
+	fmt.Printf("Scrub started:    %s\n", started.Format(time.ANSIC))
+	fmt.Printf("Status:           %s\n", status)
+	fmt.Printf("Duration:         %s\n", fmtScrubDuration(time.Since(started)))
+	fmt.Printf("Total scrubbed:   %s (data %s, tree %s)\n",
+		fmtSize(total.DataBytesScrubbed+total.TreeBytesScrubbed),
+		fmtSize(total.DataBytesScrubbed), fmtSize(total.TreeBytesScrubbed))
+	fmt.Printf("Error summary:    %s\n", fmtScrubErrors(total))
+	for _, r := range res {
+		if r.err != nil && r.err != syscall.ECANCELED {
+			fmt.Printf("device %d (%s): %v\n", r.dev.ID, r.dev.Path, r.err)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dennwc/btrfs"
+)
+
+func printSubvolumeTree(fs *btrfs.FS) error {
+	root, err := fs.SubvolumeTree()
+	if err != nil {
+		return err
+	}
+	return root.Walk(func(n, parent *btrfs.SubvolumeNode, depth int) error {
+		name := n.Name(parent)
+		if parent == nil {
+			name = "<FS_TREE>"
+		}
+		line := strings.Repeat("    ", depth) + name
+		if n.Flags.ReadOnly() {
+			line += " [ro]"
+		}
+		if q := n.Qgroup; q != nil {
+			line += fmt.Sprintf(" (referenced %s, exclusive %s)", fmtSize(q.Referenced), fmtSize(q.Exclusive))
+		}
+		fmt.Println(line)
+		return nil
+	})
+}
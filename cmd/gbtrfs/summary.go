@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.PersistentFlags().Int("summary-fd", -1, "write a single-line JSON summary of the command to file descriptor <fd> when it completes")
+}
+
+// summaryBytes is the number of bytes processed by the command, as reported in the summary.
+var summaryBytes uint64
+
+// summaryWriter counts bytes written to w in the summary.
+type summaryWriter struct {
+	w io.Writer
+}
+
+func (w summaryWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddUint64(&summaryBytes, uint64(n))
+	return n, err
+}
+
+// summaryReader counts bytes read from r in the summary.
+type summaryReader struct {
+	r io.Reader
+}
+
+func (r summaryReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddUint64(&summaryBytes, uint64(n))
+	return n, err
+}
+
+type commandSummary struct {
+	Operation string  `json:"operation"`
+	Duration  float64 `json:"duration_sec"`
+	Bytes     uint64  `json:"bytes"`
+	Result    string  `json:"result"` // "ok" or "error"
+	Error     string  `json:"error,omitempty"`
+}
+
+// writeSummary writes the summary of the command to the file descriptor selected by --summary-fd.
+func writeSummary(cmd *cobra.Command, start time.Time, err error) {
+	if cmd == nil {
+		return
+	}
+	fd, _ := cmd.Flags().GetInt("summary-fd")
+	if fd < 0 {
+		return
+	}
+	s := commandSummary{
+		Operation: strings.TrimPrefix(cmd.CommandPath(), RootCmd.Name()+" "),
+		Duration:  time.Since(start).Seconds(),
+		Bytes:     atomic.LoadUint64(&summaryBytes),
+		Result:    "ok",
+	}
+	if err != nil {
+		s.Result, s.Error = "error", err.Error()
+	}
+	f := os.NewFile(uintptr(fd), "summary")
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(s); err != nil {
+		fmt.Fprintln(os.Stderr, "cannot write the summary:", err)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dennwc/btrfs"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	SubvolumeCmd.AddCommand(SubvolumeCleanupTmpCmd)
+}
+
+var SubvolumeCleanupTmpCmd = &cobra.Command{
+	Use:   "cleanup-tmp <subvol>",
+	Short: "Delete expired temporary subvolumes.",
+	Long: `Deletes temporary subvolumes and snapshots in <subvol>/` + btrfs.TempDirName + ` that are
+past their expiration time, for example the ones left by a crashed backup.
+It's meant to be run periodically, e.g. from a systemd timer.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected one subvolume argument")
+		}
+		fs, err := btrfs.Open(args[0], false)
+		if err != nil {
+			return err
+		}
+		defer fs.Close()
+		deleted, err := fs.CleanupExpired()
+		for _, path := range deleted {
+			fmt.Println("deleted", path)
+		}
+		return err
+	},
+}
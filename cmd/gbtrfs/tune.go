@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dennwc/btrfs"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.AddCommand(TuneCmd)
+	TuneCmd.Flags().BoolP("no-holes", "n", false, "Enable the no-holes feature.")
+	TuneCmd.Flags().Bool("clear-space-cache", false, "Invalidate the free space cache (v1) before converting to the free space tree.")
+	TuneCmd.Flags().IntP("seeding", "S", 0, "Set (1) or clear (0) the seeding flag.")
+	TuneCmd.Flags().BoolP("random-fsid", "m", false, "Change the fsid to a random one, keeping the metadata uuid.")
+	TuneCmd.Flags().StringP("fsid", "M", "", "Change the fsid to <uuid>, keeping the metadata uuid.")
+}
+
+var TuneCmd = &cobra.Command{
+	Use:   "tune [-n] [--clear-space-cache] [-S 0|1] [-m | -M <uuid>] <device>",
+	Short: "Change filesystem parameters of an unmounted device.",
+	Long: `Changes parameters stored in the superblocks of an unmounted single-device
+filesystem, like btrfstune. All superblock copies must be consistent.
+
+The free space tree is created on the next mount with -o space_cache=v2,
+after the free space cache is cleared.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected one device argument")
+		}
+		dev := args[0]
+		noHoles, _ := cmd.Flags().GetBool("no-holes")
+		clearCache, _ := cmd.Flags().GetBool("clear-space-cache")
+		randomFSID, _ := cmd.Flags().GetBool("random-fsid")
+		fsid, _ := cmd.Flags().GetString("fsid")
+		var id btrfs.UUID
+		if fsid != "" {
+			if randomFSID {
+				return fmt.Errorf("-m and -M cannot be used together")
+			}
+			var err error
+			if id, err = btrfs.ParseUUID(fsid); err != nil {
+				return err
+			}
+		}
+		var ops []func() error
+		if cmd.Flags().Changed("seeding") {
+			seeding, _ := cmd.Flags().GetInt("seeding")
+			if seeding != 0 && seeding != 1 {
+				return fmt.Errorf("invalid seeding value: %d", seeding)
+			}
+			ops = append(ops, func() error { return btrfs.SetSeeding(dev, seeding == 1) })
+		}
+		if noHoles {
+			ops = append(ops, func() error { return btrfs.EnableNoHoles(dev) })
+		}
+		if clearCache {
+			ops = append(ops, func() error { return btrfs.ClearSpaceCache(dev) })
+		}
+		if randomFSID || fsid != "" {
+			ops = append(ops, func() error { return btrfs.ChangeFSID(dev, id) })
+		}
+		if len(ops) == 0 {
+			return fmt.Errorf("nothing to change")
+		}
+		for _, op := range ops {
+			if err := op(); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dennwc/btrfs/units"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	RootCmd.PersistentFlags().Bool("iec", false, "print sizes in powers of 1024 (KiB, MiB, ...), the default")
+	RootCmd.PersistentFlags().Bool("si", false, "print sizes in powers of 1000 (kB, MB, ...)")
+	RootCmd.PersistentFlags().Bool("raw", false, "print sizes in bytes")
+	RootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		iec, _ := cmd.Flags().GetBool("iec")
+		si, _ := cmd.Flags().GetBool("si")
+		raw, _ := cmd.Flags().GetBool("raw")
+		n := 0
+		for _, v := range []bool{iec, si, raw} {
+			if v {
+				n++
+			}
+		}
+		if n > 1 {
+			return fmt.Errorf("only one of --iec, --si and --raw can be set")
+		}
+		switch {
+		case si:
+			sizeMode = units.SI
+		case raw:
+			sizeMode = units.Raw
+		default:
+			sizeMode = units.IEC
+		}
+		return nil
+	}
+}
+
+// sizeMode is the mode used to print sizes, as selected by global flags.
+var sizeMode = units.IEC
+
+// fmtSize renders a size in bytes according to global flags.
+func fmtSize(n uint64) string {
+	return units.Format(n, sizeMode)
+}
+
+// fmtDelta renders a signed size difference according to global flags.
+func fmtDelta(n int64) string {
+	return units.FormatSigned(n, sizeMode)
+}
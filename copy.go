@@ -0,0 +1,642 @@
+package btrfs
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// CopyStrategy is a method used by CopySubvolume to copy the data.
+type CopyStrategy string
+
+const (
+	// CopyReflink clones files into a new subvolume; used when both are on the same filesystem.
+	CopyReflink CopyStrategy = "reflink"
+	// CopySend pipes a send stream to receive; used for different filesystems.
+	CopySend CopyStrategy = "send"
+	// CopyTar copies files through a tar stream; used when send is not available.
+	CopyTar CopyStrategy = "tar"
+)
+
+// CopySubvolume copies a subvolume to a new independent (writable, not received) subvolume
+// at dstPath, and returns the strategy that was used. Relative paths are resolved against
+// the paths src and dst were opened at.
+//
+// If both subvolumes are on the same filesystem, files are cloned. Otherwise, the subvolume
+// is sent and received, which requires CAP_SYS_ADMIN and the btrfs tool. If they are not
+// available, files are copied through a tar stream. Nested subvolumes are not copied, and
+// appear as empty directories, same as in snapshots.
+//
+// A writable subvolume is copied from a temporary read-only snapshot. If the copy fails,
+// the partially copied subvolume is deleted.
+func CopySubvolume(ctx context.Context, src *FS, srcSubvol string, dst *FS, dstPath string) (CopyStrategy, error) {
+	srcPath := src.resolve(srcSubvol)
+	dstPath = dst.resolve(dstPath)
+	if ok, err := IsSubVolume(srcPath); err != nil {
+		return "", err
+	} else if !ok {
+		return "", fmt.Errorf("not a subvolume: %s", srcPath)
+	}
+	if _, err := os.Lstat(dstPath); err == nil {
+		return "", fmt.Errorf("%s already exists", dstPath)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	sinfo, err := src.Info()
+	if err != nil {
+		return "", err
+	}
+	dinfo, err := dst.Info()
+	if err != nil {
+		return "", err
+	}
+	strategy := CopyTar
+	if sinfo.FSID == dinfo.FSID {
+		strategy = CopyReflink
+	} else if canSend() {
+		strategy = CopySend
+	}
+	snap, release, err := src.readOnlySource(srcPath)
+	if err != nil {
+		return "", err
+	}
+	switch strategy {
+	case CopyReflink:
+		err = dst.copyIntoSubvolume(dstPath, func() error {
+			return copyTree(ctx, snap, dstPath)
+		})
+	case CopySend:
+		err = dst.copySend(ctx, snap, dstPath)
+	default:
+		err = dst.copyIntoSubvolume(dstPath, func() error {
+			return copyTar(ctx, snap, dstPath)
+		})
+	}
+	if err2 := release(); err == nil && err2 != nil {
+		err = fmt.Errorf("cannot delete temporary snapshot: %v", err2)
+	}
+	return strategy, err
+}
+
+// resolve returns an absolute path for a path relative to the FS.
+func (f *FS) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(f.f.Name(), path)
+}
+
+// rel returns a path relative to the FS, as accepted by its methods, for an absolute path
+// or a path relative to the FS. The path may point outside of the FS (e.g. "../snap").
+func (f *FS) rel(path string) (string, error) {
+	root, err := filepath.Abs(f.f.Name())
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(f.resolve(path))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(root, abs)
+}
+
+// canSend checks if the process has CAP_SYS_ADMIN, which is required for send,
+// and if the btrfs tool used by Receive is available.
+func canSend() bool {
+	if _, err := exec.LookPath("btrfs"); err != nil {
+		return false
+	}
+	const capSysAdmin = 21
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(line[len("CapEff:"):]), 16, 64)
+		return err == nil && caps&(1<<capSysAdmin) != 0
+	}
+	return false
+}
+
+// readOnlySource returns a read-only version of the subvolume, creating a temporary snapshot
+// through f if necessary. The release function deletes the snapshot.
+func (f *FS) readOnlySource(path string) (string, func() error, error) {
+	if ro, err := IsReadOnly(path); err != nil {
+		return "", nil, err
+	} else if ro {
+		return path, func() error { return nil }, nil
+	}
+	snap := filepath.Join(filepath.Dir(path),
+		fmt.Sprintf(".%s.copy-%d", filepath.Base(path), time.Now().UnixNano()))
+	subRel, err := f.rel(path)
+	if err != nil {
+		return "", nil, err
+	}
+	snapRel, err := f.rel(snap)
+	if err != nil {
+		return "", nil, err
+	}
+	if err = f.SnapshotSubVolume(subRel, snapRel, true); err != nil {
+		return "", nil, err
+	}
+	return snap, func() error { return f.DeleteSubVolume(snapRel) }, nil
+}
+
+// copyIntoSubvolume creates a subvolume through f and fills it. The subvolume is deleted on error.
+func (f *FS) copyIntoSubvolume(path string, fill func() error) error {
+	rel, err := f.rel(path)
+	if err != nil {
+		return err
+	}
+	if err = f.CreateSubVolume(rel); err != nil {
+		return err
+	}
+	err = fill()
+	if err != nil {
+		if err2 := f.DeleteSubVolume(rel); err2 != nil {
+			err = fmt.Errorf("%v (cannot delete %s: %v)", err, path, err2)
+		}
+	}
+	return err
+}
+
+// copySend sends a read-only subvolume and receives it at dst, on the filesystem f.
+// The received subvolume is made writable, and its received uuid is cleared to make it independent.
+func (f *FS) copySend(ctx context.Context, snap, dst string) error {
+	dir := filepath.Dir(dst)
+	recv := filepath.Join(dir, filepath.Base(snap))
+	if _, err := os.Lstat(recv); err == nil {
+		return fmt.Errorf("%s already exists", recv)
+	}
+	dirRel, err := f.rel(dir)
+	if err != nil {
+		return err
+	}
+	recvRel, err := f.rel(recv)
+	if err != nil {
+		return err
+	}
+	dstRel, err := f.rel(dst)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := Send(pw, "", snap)
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			pr.CloseWithError(ctx.Err())
+		case <-done:
+		}
+	}()
+	err = f.ReceiveTo(pr, dirRel)
+	close(done)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if serr := <-errc; serr != nil && serr != io.ErrClosedPipe {
+		err = serr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = os.Rename(recv, dst)
+	}
+	if err != nil {
+		if _, err2 := os.Lstat(recv); err2 == nil {
+			if err2 = f.DeleteSubVolume(recvRel); err2 != nil {
+				err = fmt.Errorf("%v (cannot delete %s: %v)", err, recv, err2)
+			}
+		}
+		return err
+	}
+	if err = makeIndependent(dst); err != nil {
+		if err2 := f.DeleteSubVolume(dstRel); err2 != nil {
+			err = fmt.Errorf("%v (cannot delete %s: %v)", err, dst, err2)
+		}
+	}
+	return err
+}
+
+// makeIndependent makes a received subvolume writable and clears its received uuid,
+// so it cannot be used as a parent for incremental streams anymore.
+func makeIndependent(path string) error {
+	fs, err := Open(path, false)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	flags, err := fs.GetFlags()
+	if err != nil {
+		return err
+	}
+	if err = fs.SetFlags(flags &^ SubvolReadOnly); err != nil {
+		return err
+	}
+	return fs.SetReceived(UUID{}, 0, time.Unix(0, 0))
+}
+
+// fileMeta is a metadata of a file that is restored after copying it.
+type fileMeta struct {
+	mode         os.FileMode
+	uid, gid     int
+	atime, mtime time.Time
+	xattrs       map[string]string
+}
+
+func readMeta(path string, fi os.FileInfo) (*fileMeta, error) {
+	st := fi.Sys().(*syscall.Stat_t)
+	m := &fileMeta{
+		mode:  fi.Mode(),
+		uid:   int(st.Uid),
+		gid:   int(st.Gid),
+		atime: time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec)),
+		mtime: fi.ModTime(),
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return m, nil
+	}
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	m.xattrs = xattrs
+	return m, nil
+}
+
+func readXattrs(path string) (map[string]string, error) {
+	sz, err := syscall.Listxattr(path, nil)
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	} else if sz == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, sz)
+	sz, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+	out := make(map[string]string)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:sz]), "\x00"), "\x00") {
+		vsz, err := syscall.Getxattr(path, name, nil)
+		if err == syscall.ENODATA {
+			continue
+		} else if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		val := make([]byte, vsz)
+		if vsz, err = syscall.Getxattr(path, name, val); err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		out[name] = string(val[:vsz])
+	}
+	return out, nil
+}
+
+// apply restores the metadata. Extended attributes that cannot be set
+// (for example, because of missing privileges) are skipped.
+func (m *fileMeta) apply(path string) error {
+	if err := os.Lchown(path, m.uid, m.gid); err != nil {
+		return err
+	}
+	if m.mode&os.ModeSymlink == 0 {
+		// chmod after chown, since chown drops setuid bits
+		if err := syscall.Chmod(path, unixMode(m.mode)&07777); err != nil {
+			return &os.PathError{Op: "chmod", Path: path, Err: err}
+		}
+		for name, val := range m.xattrs {
+			err := syscall.Setxattr(path, name, []byte(val), 0)
+			if err != nil && err != syscall.ENOTSUP && err != syscall.EPERM {
+				return &os.PathError{Op: "setxattr", Path: path, Err: err}
+			}
+		}
+	}
+	return lutimes(path, m.atime, m.mtime)
+}
+
+// unixMode converts a file mode to a mode used by syscalls.
+func unixMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
+// lutimes sets access and modification times without following symlinks.
+func lutimes(path string, atime, mtime time.Time) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	ts := [2]syscall.Timespec{
+		syscall.NsecToTimespec(atime.UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+	const atSymlinkNofollow = 0x100
+	atFDCWD := -0x64
+	_, _, e := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(atFDCWD), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&ts[0])), atSymlinkNofollow, 0, 0)
+	if e != 0 {
+		return &os.PathError{Op: "utimensat", Path: path, Err: e}
+	}
+	return nil
+}
+
+// isNestedSubvolume checks if the directory is a root of another subvolume.
+func isNestedSubvolume(fi os.FileInfo) bool {
+	st := fi.Sys().(*syscall.Stat_t)
+	return fi.IsDir() && objectID(st.Ino) == firstFreeObjectid
+}
+
+// dirMeta is a metadata of a directory that is applied after its content is copied.
+type dirMeta struct {
+	path string
+	meta *fileMeta
+}
+
+func applyDirs(dirs []dirMeta) error {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := dirs[i].meta.apply(dirs[i].path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTree copies the content of src subvolume to the existing subvolume dst, cloning files.
+func copyTree(ctx context.Context, src, dst string) error {
+	var (
+		dirs  []dirMeta
+		links = make(map[uint64]string)
+	)
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if err = ctx.Err(); err != nil {
+			return err
+		}
+		target := filepath.Join(dst, path[len(src):])
+		meta, err := readMeta(path, fi)
+		if err != nil {
+			return err
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		switch {
+		case path == src:
+			dirs = append(dirs, dirMeta{path: target, meta: meta})
+			return nil
+		case fi.IsDir():
+			if err = os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirMeta{path: target, meta: meta})
+			if isNestedSubvolume(fi) {
+				return filepath.SkipDir
+			}
+			return nil
+		case st.Nlink > 1 && links[st.Ino] != "":
+			return os.Link(links[st.Ino], target)
+		case fi.Mode().IsRegular():
+			err = CloneAcrossSubvolumes(target, path)
+		case fi.Mode()&os.ModeSymlink != 0:
+			var link string
+			if link, err = os.Readlink(path); err == nil {
+				err = os.Symlink(link, target)
+			}
+		default:
+			if err = syscall.Mknod(target, st.Mode, int(st.Rdev)); err != nil {
+				err = &os.PathError{Op: "mknod", Path: target, Err: err}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if st.Nlink > 1 {
+			links[st.Ino] = target
+		}
+		return meta.apply(target)
+	})
+	if err != nil {
+		return err
+	}
+	return applyDirs(dirs)
+}
+
+// copyTar copies the content of src subvolume to the existing subvolume dst through a tar stream.
+func copyTar(ctx context.Context, src, dst string) error {
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := writeTar(ctx, pw, src)
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+	err := extractTar(pr, dst)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if werr := <-errc; werr != nil && werr != io.ErrClosedPipe {
+		return werr
+	}
+	return err
+}
+
+const paxXattr = "SCHILY.xattr."
+
+func writeTar(ctx context.Context, w io.Writer, src string) error {
+	tw := tar.NewWriter(w)
+	links := make(map[uint64]string)
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if err = ctx.Err(); err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSocket != 0 {
+			return nil // sockets cannot be stored in tar
+		}
+		name := "."
+		if path != src {
+			name = filepath.ToSlash(path[len(src)+1:])
+		}
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name, hdr.Uname, hdr.Gname = name, "", ""
+		hdr.Format = tar.FormatPAX
+		meta, err := readMeta(path, fi)
+		if err != nil {
+			return err
+		}
+		hdr.AccessTime = meta.atime
+		for k, v := range meta.xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords[paxXattr+k] = v
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if !fi.IsDir() && st.Nlink > 1 {
+			if first, ok := links[st.Ino]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+			} else {
+				links[st.Ino] = name
+			}
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		if fi.IsDir() && path != src && isNestedSubvolume(fi) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func extractTar(r io.Reader, dst string) error {
+	tr := tar.NewReader(r)
+	var dirs []dirMeta
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		target, err := tarPath(dst, hdr.Name)
+		if err != nil {
+			return err
+		}
+		fi := hdr.FileInfo()
+		meta := &fileMeta{
+			mode:  fi.Mode(),
+			uid:   hdr.Uid,
+			gid:   hdr.Gid,
+			atime: hdr.AccessTime,
+			mtime: hdr.ModTime,
+		}
+		for k, v := range hdr.PAXRecords {
+			if strings.HasPrefix(k, paxXattr) {
+				if meta.xattrs == nil {
+					meta.xattrs = make(map[string]string)
+				}
+				meta.xattrs[k[len(paxXattr):]] = v
+			}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if target != dst {
+				if err = os.Mkdir(target, 0700); err != nil {
+					return err
+				}
+			}
+			dirs = append(dirs, dirMeta{path: target, meta: meta})
+			continue
+		case tar.TypeLink:
+			var first string
+			if first, err = tarPath(dst, hdr.Linkname); err != nil {
+				return err
+			} else if err = os.Link(first, target); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeReg:
+			var f *os.File
+			f, err = os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, target)
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			mode := uint32(syscall.S_IFIFO)
+			if hdr.Typeflag == tar.TypeChar {
+				mode = syscall.S_IFCHR
+			} else if hdr.Typeflag == tar.TypeBlock {
+				mode = syscall.S_IFBLK
+			}
+			dev := int(mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
+			if err = syscall.Mknod(target, mode|0600, dev); err != nil {
+				err = &os.PathError{Op: "mknod", Path: target, Err: err}
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = meta.apply(target); err != nil {
+			return err
+		}
+	}
+	return applyDirs(dirs)
+}
+
+// tarPath returns a path of a file from the tar stream in dst.
+func tarPath(dst, name string) (string, error) {
+	name = filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path in tar stream: %q", name)
+	}
+	return filepath.Join(dst, name), nil
+}
+
+// mkdev encodes a device number, as the kernel does it.
+func mkdev(major, minor uint32) uint64 {
+	return uint64(minor&0xff) | uint64(major&0xfff)<<8 |
+		uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+}
@@ -0,0 +1,82 @@
+package btrfs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCopyTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs-copy-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	for _, d := range []string{src, dst, filepath.Join(src, "sub")} {
+		if err = os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := bytes.Repeat([]byte("data"), 1000)
+	if err = ioutil.WriteFile(filepath.Join(src, "sub", "file"), data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Link(filepath.Join(src, "sub", "file"), filepath.Join(src, "hard")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("sub/file", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1500000000, 0)
+	if err = os.Chtimes(filepath.Join(src, "sub"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err = copyTar(context.Background(), src, dst); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dst, "sub", "file"))
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Fatal("unexpected file content")
+	}
+	st, err := os.Stat(filepath.Join(dst, "sub", "file"))
+	if err != nil {
+		t.Fatal(err)
+	} else if st.Mode().Perm() != 0640 {
+		t.Fatalf("unexpected mode: %v", st.Mode())
+	}
+	st2, err := os.Stat(filepath.Join(dst, "hard"))
+	if err != nil {
+		t.Fatal(err)
+	} else if st.Sys().(*syscall.Stat_t).Ino != st2.Sys().(*syscall.Stat_t).Ino {
+		t.Fatal("hardlink was not preserved")
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "link")); err != nil {
+		t.Fatal(err)
+	} else if link != "sub/file" {
+		t.Fatalf("unexpected link: %q", link)
+	}
+	if st, err = os.Stat(filepath.Join(dst, "sub")); err != nil {
+		t.Fatal(err)
+	} else if !st.ModTime().Equal(mtime) {
+		t.Fatalf("unexpected directory mtime: %v", st.ModTime())
+	}
+}
+
+func TestTarPath(t *testing.T) {
+	for _, name := range []string{"../x", "/etc/passwd", "a/../../x"} {
+		if _, err := tarPath("/dst", name); err == nil {
+			t.Errorf("expected an error for %q", name)
+		}
+	}
+	if p, err := tarPath("/dst", "./a/b"); err != nil || p != "/dst/a/b" {
+		t.Errorf("unexpected path: %q, %v", p, err)
+	}
+}
@@ -0,0 +1,63 @@
+package btrfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// ErrDataDiffers is returned by Dedupe if the ranges have different contents.
+var ErrDataDiffers = errors.New("data differs")
+
+// maxDedupeLen is the maximal length of a single extent-same request accepted by the kernel.
+const maxDedupeLen = 16 * 1024 * 1024
+
+// btrfs_ioctl_same_args with a single destination
+type sameArgs1 struct {
+	args btrfs_ioctl_same_args
+	info btrfs_ioctl_same_extent_info
+}
+
+// Dedupe makes n bytes of dst at dstOff share extents with the same range of src at srcOff,
+// like CloneRange, but only if the data is identical. Otherwise, ErrDataDiffers is returned.
+// It returns the number of deduplicated bytes.
+//
+// Offsets must be aligned to the clone alignment of the filesystem (see CloneAlignment),
+// otherwise ErrUnalignedRange is returned. An unaligned tail of the range is not deduplicated,
+// unless it ends at the end of src.
+func Dedupe(dst, src *os.File, srcOff, n, dstOff uint64) (uint64, error) {
+	if err := checkRemapFiles("dedupe", src, srcOff, dstOff, n, true); err != nil {
+		return 0, err
+	}
+	var total uint64
+	for n > 0 {
+		l := n
+		if l > maxDedupeLen {
+			l = maxDedupeLen
+		}
+		var arg sameArgs1
+		arg.args.LogicalOffset = srcOff
+		arg.args.Length = l
+		arg.args.DestCount = 1
+		arg.info.Fd = int64(dst.Fd())
+		arg.info.LogicalOffset = dstOff
+		if err := iocFileExtentSame(src, &arg.args); err != nil {
+			return total, err
+		}
+		switch st := arg.info.Status; {
+		case st == _BTRFS_SAME_DATA_DIFFERS:
+			return total, ErrDataDiffers
+		case st < 0:
+			return total, syscall.Errno(-st)
+		}
+		done := arg.info.BytesDeduped
+		if done == 0 {
+			break
+		}
+		total += done
+		n -= done
+		srcOff += done
+		dstOff += done
+	}
+	return total, nil
+}
@@ -0,0 +1,122 @@
+package btrfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// AddDevice adds a block device to the filesystem. Its space can be used for new block groups
+// right away; run a balance to spread the existing ones over it.
+//
+// The device is opened exclusively before adding it, thus the call fails with EBUSY if it's
+// mounted or used by another filesystem. Devices with btrfs signatures are refused, since they
+// are either members of this filesystem already or hold another one; see ReleaseDevice.
+// Requires CAP_SYS_ADMIN.
+func (f *FS) AddDevice(path string) error {
+	if err := f.revalidate(); err != nil {
+		return err
+	}
+	if len(path) > volNameMax {
+		return fmt.Errorf("device path is too long")
+	}
+	if err := checkNewDevice(path); err != nil {
+		return err
+	}
+	args := &btrfs_ioctl_vol_args{}
+	args.SetName(path)
+	return f.audited("add_device", map[string]interface{}{"device": path}, func() error {
+		if err := iocAddDev(f.f, args); err != nil {
+			return fmt.Errorf("add device failed: %v", err)
+		}
+		return nil
+	})
+}
+
+// checkNewDevice checks that a device is an unused block device without btrfs signatures.
+func checkNewDevice(path string) error {
+	d, err := os.OpenFile(path, os.O_RDONLY|syscall.O_EXCL, 0)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	fi, err := d.Stat()
+	if err != nil {
+		return err
+	} else if fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		return &os.PathError{Op: "add device", Path: path, Err: syscall.ENOTBLK}
+	}
+	return checkNoSignature(d, path)
+}
+
+// checkNoSignature returns an error if any superblock copy on the device has the btrfs magic.
+func checkNoSignature(r io.ReaderAt, path string) error {
+	buf := make([]byte, len(superMagic))
+	for _, off := range superMirrorOffsets {
+		if _, err := r.ReadAt(buf, off+superMagicOff); err != nil {
+			break // device is smaller than this mirror offset
+		}
+		if string(buf) == superMagic {
+			return fmt.Errorf("%s has a btrfs signature at %d, wipe it with ReleaseDevice first", path, off)
+		}
+	}
+	return nil
+}
+
+// RemoveDevice removes a device from the filesystem, relocating its data to the remaining
+// devices first. The device is specified by its path, or as "missing" to remove the first
+// device that is not present.
+//
+// The device keeps btrfs superblocks after the removal; see ReleaseDevice.
+func (f *FS) RemoveDevice(dev string) error {
+	args := &btrfs_ioctl_vol_args{}
+	args.SetName(dev)
+	return f.audited("remove_device", map[string]interface{}{"device": dev}, func() error {
+		if err := iocRmDev(f.f, args); err != nil {
+			return fmt.Errorf("remove device failed: %v", err)
+		}
+		return nil
+	})
+}
+
+// ReleaseDevice wipes btrfs signatures from all superblock copies of a device that was
+// removed from the filesystem with a given fsid (see FS.Info), so it won't be detected
+// as a stale member of it by a device scan (for example, on boot). Only the magic is
+// cleared, as wipefs does.
+//
+// Nothing is wiped if any superblock copy belongs to another filesystem, which protects
+// members of other filesystems from a mistyped path. The device is opened exclusively,
+// thus the call fails with EBUSY if it is still used by a mounted filesystem.
+// It returns nil if no signatures were found.
+func ReleaseDevice(path string, fsid FSID) error {
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_EXCL, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var found []int64
+	for _, off := range superMirrorOffsets {
+		sb, err := readSuperblock(f, off)
+		if err != nil {
+			break // device is smaller than this mirror offset
+		}
+		if string(sb[superMagicOff:superMagicOff+len(superMagic)]) != superMagic {
+			continue
+		}
+		if id := FSID(sb.uuid(superFSIDOff)); id != fsid {
+			return fmt.Errorf("%s belongs to filesystem %v, not %v", path, UUID(id), UUID(fsid))
+		}
+		found = append(found, off)
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	zero := make([]byte, len(superMagic))
+	for _, off := range found {
+		if _, err = f.WriteAt(zero, off+superMagicOff); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
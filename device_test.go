@@ -0,0 +1,76 @@
+package btrfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReleaseDevice(t *testing.T) {
+	f, err := ioutil.TempFile("", "btrfs-dev-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	// sparse file with the primary superblock and the first copy only
+	if err = f.Truncate(superMirrorOffsets[1] + 4096); err != nil {
+		t.Fatal(err)
+	}
+	fsid := FSID{1, 2, 3, 4}
+	for _, off := range superMirrorOffsets[:2] {
+		if _, err = f.WriteAt([]byte(superMagic), off+superMagicOff); err != nil {
+			t.Fatal(err)
+		} else if _, err = f.WriteAt(fsid[:], off+superFSIDOff); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	checkMagic := func(exp bool) {
+		data, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, off := range superMirrorOffsets[:2] {
+			off += superMagicOff
+			if got := string(data[off:off+int64(len(superMagic))]) == superMagic; got != exp {
+				t.Fatalf("unexpected signature at %d: %v", off, got)
+			}
+		}
+	}
+	// a device of another filesystem is not wiped
+	if err = ReleaseDevice(f.Name(), FSID{5, 6, 7, 8}); err == nil {
+		t.Fatal("expected an error for a device of another filesystem")
+	}
+	checkMagic(true)
+	if err = ReleaseDevice(f.Name(), fsid); err != nil {
+		t.Fatal(err)
+	}
+	checkMagic(false)
+	if err = ReleaseDevice(f.Name(), fsid); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckNoSignature(t *testing.T) {
+	f, err := ioutil.TempFile("", "btrfs-dev-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err = f.Truncate(superMirrorOffsets[1] + 4096); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkNoSignature(f, f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte(superMagic), superMirrorOffsets[1]+superMagicOff); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkNoSignature(f, f.Name()); err == nil {
+		t.Fatal("expected an error for a device with a signature")
+	}
+	if err = checkNewDevice(f.Name()); err == nil {
+		t.Fatal("expected an error for a regular file")
+	}
+}
@@ -0,0 +1,196 @@
+package btrfs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const devStatsBaselineVersion = 1
+
+// HasErrors checks if any of the error counters is non-zero.
+func (s DevStats) HasErrors() bool {
+	if s.WriteErrs != 0 || s.ReadErrs != 0 || s.FlushErrs != 0 ||
+		s.CorruptionErrs != 0 || s.GenerationErrs != 0 {
+		return true
+	}
+	for _, v := range s.Unknown {
+		if v != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Sub returns an increase of the counters relative to the base. If a counter is lower
+// than in the base (counters were reset), the current value is used as an increase.
+func (s DevStats) Sub(base DevStats) DevStats {
+	sub := func(cur, base uint64) uint64 {
+		if cur < base {
+			return cur
+		}
+		return cur - base
+	}
+	out := DevStats{
+		WriteErrs:      sub(s.WriteErrs, base.WriteErrs),
+		ReadErrs:       sub(s.ReadErrs, base.ReadErrs),
+		FlushErrs:      sub(s.FlushErrs, base.FlushErrs),
+		CorruptionErrs: sub(s.CorruptionErrs, base.CorruptionErrs),
+		GenerationErrs: sub(s.GenerationErrs, base.GenerationErrs),
+	}
+	for i, v := range s.Unknown {
+		var b uint64
+		if i < len(base.Unknown) {
+			b = base.Unknown[i]
+		}
+		out.Unknown = append(out.Unknown, sub(v, b))
+	}
+	return out
+}
+
+// DevStatsBaseline is an acknowledged state of device error counters.
+type DevStatsBaseline struct {
+	DevID        uint64    `json:"devid"`
+	UUID         UUID      `json:"uuid"` // device uuid; baseline is ignored if the device was replaced
+	Acknowledged time.Time `json:"acknowledged"`
+	Stats        DevStats  `json:"stats"`
+}
+
+type devStatsBaselineFile struct {
+	Version   int                `json:"version"`
+	FSID      string             `json:"fsid"`
+	Baselines []DevStatsBaseline `json:"baselines"`
+}
+
+func readDevStatsBaselines(path string) (*devStatsBaselineFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &devStatsBaselineFile{Version: devStatsBaselineVersion}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var b devStatsBaselineFile
+	if err = json.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (f *FS) devStatsBaselinePath() (string, FSID, error) {
+	return f.statePath(".devstats.json")
+}
+
+// AckDevStats records current error counters of given devices as an acknowledged baseline.
+// If no devices are specified, counters of all devices are acknowledged.
+// Raw counters in the kernel are not modified. The state directory must be set with SetStateDir.
+func (f *FS) AckDevStats(ids ...uint64) error {
+	path, fsid, err := f.devStatsBaselinePath()
+	if err != nil {
+		return err
+	}
+	var devs []DevInfo
+	if len(ids) == 0 {
+		devs, err = f.Devices()
+	} else {
+		for _, id := range ids {
+			var d DevInfo
+			d, err = f.GetDevInfo(id)
+			if err != nil {
+				break
+			}
+			devs = append(devs, d)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	acks := make([]DevStatsBaseline, 0, len(devs))
+	for _, d := range devs {
+		st, err := f.GetDevStats(d.ID)
+		if err != nil {
+			return err
+		}
+		acks = append(acks, DevStatsBaseline{DevID: d.ID, UUID: d.UUID, Acknowledged: now, Stats: st})
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	b, err := readDevStatsBaselines(path)
+	if err != nil {
+		return err
+	}
+	b.Version = devStatsBaselineVersion
+	b.FSID = fsid.String()
+	b.Baselines = mergeDevStatsBaselines(b.Baselines, acks)
+	data, err := json.MarshalIndent(b, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// mergeDevStatsBaselines replaces baselines of devices present in acks.
+func mergeDevStatsBaselines(old, acks []DevStatsBaseline) []DevStatsBaseline {
+	byID := make(map[uint64]DevStatsBaseline, len(old)+len(acks))
+	for _, b := range old {
+		byID[b.DevID] = b
+	}
+	for _, b := range acks {
+		byID[b.DevID] = b
+	}
+	out := make([]DevStatsBaseline, 0, len(byID))
+	for _, b := range byID {
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DevID < out[j].DevID })
+	return out
+}
+
+// DevStatsBaseline returns an acknowledged baseline for a device.
+// It returns ErrNotFound if counters of the device were never acknowledged,
+// or the device was replaced since then.
+func (f *FS) DevStatsBaseline(id uint64) (*DevStatsBaseline, error) {
+	path, _, err := f.devStatsBaselinePath()
+	if err != nil {
+		return nil, err
+	}
+	b, err := readDevStatsBaselines(path)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := f.GetDevInfo(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range b.Baselines {
+		if v.DevID == id && v.UUID == dev.UUID {
+			return &v, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// DevStatsSinceAck returns an increase of device error counters since they were
+// acknowledged with AckDevStats. If counters were never acknowledged, raw counters are returned.
+func (f *FS) DevStatsSinceAck(id uint64) (DevStats, error) {
+	st, err := f.GetDevStats(id)
+	if err != nil {
+		return DevStats{}, err
+	}
+	base, err := f.DevStatsBaseline(id)
+	if err == ErrNotFound {
+		return st, nil
+	} else if err != nil {
+		return DevStats{}, err
+	}
+	return st.Sub(base.Stats), nil
+}
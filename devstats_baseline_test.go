@@ -0,0 +1,18 @@
+package btrfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDevStatsSub(t *testing.T) {
+	cur := DevStats{WriteErrs: 5, ReadErrs: 2, CorruptionErrs: 1, Unknown: []uint64{3}}
+	base := DevStats{WriteErrs: 3, ReadErrs: 4}
+	exp := DevStats{WriteErrs: 2, ReadErrs: 2, CorruptionErrs: 1, Unknown: []uint64{3}}
+	if got := cur.Sub(base); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected stats: %+v", got)
+	}
+	if cur.Sub(cur).HasErrors() {
+		t.Fatal("expected no errors")
+	}
+}
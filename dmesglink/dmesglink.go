@@ -0,0 +1,302 @@
+// Package dmesglink correlates btrfs kernel log messages with the affected files.
+//
+// The kernel reports checksum and IO errors with logical or physical addresses and inode
+// numbers. Parse turns such lines from dmesg or the journal into structured records, and
+// Link resolves them into paths on a mounted filesystem, so the damaged files can be restored.
+package dmesglink
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dennwc/btrfs"
+)
+
+// Kind is a kind of a kernel message.
+type Kind int
+
+const (
+	// CsumError is a checksum mismatch of data or metadata.
+	CsumError Kind = iota + 1
+	// IOError is a failed read or write of a device.
+	IOError
+	// Corrected is an error that was repaired from another copy.
+	Corrected
+	// Uncorrectable is an error found by scrub that could not be repaired.
+	Uncorrectable
+	// TransidError is a tree block with an unexpected generation, e.g. after a lost write.
+	TransidError
+	// TreeBlockError is a tree block that is invalid for other reasons.
+	TreeBlockError
+	// DevStats is a report of device error counters.
+	DevStats
+)
+
+func (k Kind) String() string {
+	switch k {
+	case CsumError:
+		return "csum"
+	case IOError:
+		return "io"
+	case Corrected:
+		return "corrected"
+	case Uncorrectable:
+		return "uncorrectable"
+	case TransidError:
+		return "transid"
+	case TreeBlockError:
+		return "tree-block"
+	case DevStats:
+		return "dev-stats"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Record is a btrfs error reported by the kernel. Zero values of numeric fields mean
+// that the message does not include them; zero is never a valid address of user data.
+type Record struct {
+	Line   string `json:"line"`   // the original line
+	Level  string `json:"level"`  // message level: error, warning, info, etc
+	Device string `json:"device"` // name of the filesystem device, as in "(device sda1)"
+	Kind   Kind   `json:"kind"`
+
+	Logical  uint64 `json:"logical,omitempty"`  // logical address
+	Physical uint64 `json:"physical,omitempty"` // physical address on DevPath
+	DevPath  string `json:"dev_path,omitempty"` // device the error happened on, if reported
+	DevID    uint64 `json:"devid,omitempty"`    // id of DevPath; only set by Link, unless reported
+	Mirror   int    `json:"mirror,omitempty"`
+	Metadata bool   `json:"metadata,omitempty"` // the error is in a tree block, not in file data
+
+	Root   uint64 `json:"root,omitempty"` // subvolume id
+	Inode  uint64 `json:"inode,omitempty"`
+	Offset uint64 `json:"offset,omitempty"` // offset in the file
+
+	// KernelPath is the file path reported by scrub, relative to the subvolume.
+	KernelPath string `json:"kernel_path,omitempty"`
+	// Stats are device error counters of DevStats records: wr, rd, flush, corrupt, gen.
+	Stats map[string]uint64 `json:"stats,omitempty"`
+
+	// Paths are the absolute paths of the affected files, as resolved by Link.
+	Paths []string `json:"paths,omitempty"`
+	// ResolveErr is an error from resolving Paths, if any.
+	ResolveErr error `json:"-"`
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (k Kind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+var (
+	reHeader   = regexp.MustCompile(`BTRFS (\w+) \(device ([^)\s]+)[^)]*\)(?: \[[^]]*\])?: (.*)$`)
+	reLogical  = regexp.MustCompile(`\blogical (\d+)`)
+	reFailedOn = regexp.MustCompile(`failed on (\d+)`) // older kernels omit "logical"
+	rePhysical = regexp.MustCompile(`\bphysical (\d+)`)
+	reOnDev    = regexp.MustCompile(`\bon dev ([^,\s]+)`)
+	reSector   = regexp.MustCompile(`\(dev ([^\s]+) sector (\d+)\)`)
+	reDevID    = regexp.MustCompile(`\bdevid (\d+)`)
+	reMirror   = regexp.MustCompile(`\bmirror (\d+)`)
+	reRoot     = regexp.MustCompile(`\broot (-?\d+)`)
+	reInode    = regexp.MustCompile(`\b(?:ino|inode) (\d+)`)
+	reOffset   = regexp.MustCompile(`\b(?:off|offset) (\d+)`)
+	rePath     = regexp.MustCompile(`\(path: (.*)\)$`)
+	reDevStats = regexp.MustCompile(`\bbdev ([^\s]+) errs: wr (\d+), rd (\d+), flush (\d+), corrupt (\d+), gen (\d+)`)
+)
+
+// classify returns a kind of the message, or zero if it's not an error report.
+func classify(msg string) (Kind, bool) {
+	switch {
+	case strings.Contains(msg, "errs: wr "):
+		return DevStats, false
+	case strings.Contains(msg, "parent transid verify failed"):
+		return TransidError, true
+	case strings.Contains(msg, "checksum verify failed"):
+		return CsumError, true
+	case strings.Contains(msg, "bad tree block"):
+		return TreeBlockError, true
+	case strings.Contains(msg, "unable to fixup"):
+		return Uncorrectable, strings.Contains(msg, "metadata")
+	case strings.Contains(msg, "read error corrected"), strings.Contains(msg, "fixed up error"):
+		return Corrected, false
+	case strings.Contains(msg, "csum failed"), strings.Contains(msg, "checksum error"):
+		return CsumError, strings.Contains(msg, "metadata")
+	case strings.Contains(msg, "i/o error"), strings.Contains(msg, "io error"),
+		strings.Contains(msg, "IO error"), strings.Contains(msg, "read error"):
+		return IOError, strings.Contains(msg, "metadata")
+	}
+	return 0, false
+}
+
+func atou(s string) uint64 {
+	v, _ := strconv.ParseUint(s, 10, 64)
+	return v
+}
+
+// find returns the first submatch of a regexp, or an empty string.
+func find(re *regexp.Regexp, s string) string {
+	if m := re.FindStringSubmatch(s); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// Parse parses a btrfs error message. Prefixes added by dmesg or the journal are ignored.
+// It returns false for other messages, including informational btrfs messages.
+func Parse(line string) (Record, bool) {
+	m := reHeader.FindStringSubmatch(line)
+	if m == nil {
+		return Record{}, false
+	}
+	msg := m[3]
+	kind, meta := classify(msg)
+	if kind == 0 {
+		return Record{}, false
+	}
+	r := Record{Line: line, Level: m[1], Device: m[2], Kind: kind, Metadata: meta}
+	if kind == DevStats {
+		if s := reDevStats.FindStringSubmatch(msg); s != nil {
+			r.DevPath = s[1]
+			r.Stats = map[string]uint64{
+				"wr": atou(s[2]), "rd": atou(s[3]), "flush": atou(s[4]), "corrupt": atou(s[5]), "gen": atou(s[6]),
+			}
+		}
+		return r, true
+	}
+	if s := find(reLogical, msg); s != "" {
+		r.Logical = atou(s)
+	} else if s = find(reFailedOn, msg); s != "" {
+		r.Logical = atou(s)
+	}
+	r.Physical = atou(find(rePhysical, msg))
+	r.DevPath = find(reOnDev, msg)
+	if s := reSector.FindStringSubmatch(msg); s != nil {
+		r.DevPath, r.Physical = s[1], atou(s[2])*512
+	}
+	r.DevID = atou(find(reDevID, msg))
+	r.Mirror = int(atou(find(reMirror, msg)))
+	if s := find(reRoot, msg); s != "" && !strings.HasPrefix(s, "-") {
+		r.Root = atou(s) // negative ids are internal trees, e.g. of relocation
+	}
+	r.Inode = atou(find(reInode, msg))
+	r.Offset = atou(find(reOffset, msg))
+	r.KernelPath = find(rePath, msg)
+	return r, true
+}
+
+// ParseLog parses btrfs error messages from a kernel log, e.g. the output of dmesg.
+func ParseLog(r io.Reader) ([]Record, error) {
+	var out []Record
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		if rec, ok := Parse(sc.Text()); ok {
+			out = append(out, rec)
+		}
+	}
+	return out, sc.Err()
+}
+
+// deviceNames maps kernel names of the filesystem devices (e.g. sda1, dm-0) to their ids.
+func deviceNames(fs *btrfs.FS) (map[string]uint64, error) {
+	devs, err := fs.Devices()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]uint64)
+	for _, d := range devs {
+		if d.Path == "" {
+			continue // missing device
+		}
+		out[filepath.Base(d.Path)] = d.ID
+		if p, err := filepath.EvalSymlinks(d.Path); err == nil {
+			out[filepath.Base(p)] = d.ID
+		}
+	}
+	return out, nil
+}
+
+type inodeKey struct {
+	root, ino uint64
+}
+
+// Link returns the records of a mounted filesystem, with the affected files resolved
+// into Paths. Records of other filesystems are dropped, based on the device name.
+//
+// Data errors with an inode number are resolved directly, other data errors with a logical
+// address are resolved through the files that reference the extent. Metadata errors have no
+// paths. Failures of individual records are reported in ResolveErr; e.g. the file might have
+// been deleted since the message. Requires CAP_SYS_ADMIN.
+func Link(fs *btrfs.FS, recs []Record) ([]Record, error) {
+	names, err := deviceNames(fs)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		out    []Record
+		inodes = make(map[inodeKey][]string)
+		extent = make(map[uint64][]btrfs.ExtentRef)
+	)
+	paths := func(k inodeKey) ([]string, error) {
+		if p, ok := inodes[k]; ok {
+			return p, nil
+		}
+		p, err := fs.InodePaths(k.root, k.ino)
+		if err != nil {
+			return nil, err
+		}
+		inodes[k] = p
+		return p, nil
+	}
+	for _, r := range recs {
+		if _, ok := names[r.Device]; !ok {
+			continue
+		}
+		if r.DevID == 0 && r.DevPath != "" {
+			r.DevID = names[filepath.Base(r.DevPath)]
+		}
+		switch {
+		case r.Kind == DevStats || r.Metadata:
+		case r.Root != 0 && r.Inode != 0:
+			r.Paths, r.ResolveErr = paths(inodeKey{root: r.Root, ino: r.Inode})
+		case r.Logical != 0:
+			refs, ok := extent[r.Logical]
+			if !ok {
+				refs, r.ResolveErr = fs.ExtentRefs(r.Logical)
+				if r.ResolveErr != nil {
+					break
+				}
+				extent[r.Logical] = refs
+			}
+			seen := make(map[inodeKey]bool)
+			for _, ref := range refs {
+				k := inodeKey{root: ref.Root, ino: ref.Inode}
+				if seen[k] {
+					continue // the extent is referenced at multiple offsets
+				}
+				seen[k] = true
+				p, err := paths(k)
+				if err != nil {
+					r.ResolveErr = err
+					continue
+				}
+				r.Paths = append(r.Paths, p...)
+			}
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// LinkLog parses a kernel log and resolves the records of a mounted filesystem. See Link.
+func LinkLog(fs *btrfs.FS, r io.Reader) ([]Record, error) {
+	recs, err := ParseLog(r)
+	if err != nil {
+		return nil, err
+	}
+	return Link(fs, recs)
+}
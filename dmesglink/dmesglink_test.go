@@ -0,0 +1,78 @@
+package dmesglink
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		exp  Record
+	}{
+		{
+			line: "[ 1234.567890] BTRFS warning (device sda1): csum failed root 5 ino 257 off 4096 csum 0x8941f998 expected csum 0x1337 mirror 1",
+			exp:  Record{Level: "warning", Device: "sda1", Kind: CsumError, Root: 5, Inode: 257, Offset: 4096, Mirror: 1},
+		},
+		{
+			line: "Oct 10 12:00:00 host kernel: BTRFS warning (device sdb): checksum error at logical 298844160 on dev /dev/sdc, physical 298844160, root 5, inode 257, offset 0, length 4096, links 1 (path: dir/file)",
+			exp: Record{Level: "warning", Device: "sdb", Kind: CsumError, Logical: 298844160, Physical: 298844160,
+				DevPath: "/dev/sdc", Root: 5, Inode: 257, KernelPath: "dir/file"},
+		},
+		{
+			line: "BTRFS warning (device sdb): checksum error at logical 30408704 on dev /dev/sdb, physical 30408704: metadata leaf (level 0) in tree 5",
+			exp:  Record{Level: "warning", Device: "sdb", Kind: CsumError, Logical: 30408704, Physical: 30408704, DevPath: "/dev/sdb", Metadata: true},
+		},
+		{
+			line: "BTRFS error (device loop0 state EA): parent transid verify failed on logical 30425088 mirror 1 wanted 8 found 7",
+			exp:  Record{Level: "error", Device: "loop0", Kind: TransidError, Logical: 30425088, Mirror: 1, Metadata: true},
+		},
+		{
+			line: "BTRFS error (device loop0): parent transid verify failed on 30425088 wanted 8 found 7",
+			exp:  Record{Level: "error", Device: "loop0", Kind: TransidError, Logical: 30425088, Metadata: true},
+		},
+		{
+			line: "BTRFS info (device dm-0): read error corrected: ino 257 off 4096 (dev /dev/sdb sector 2048)",
+			exp:  Record{Level: "info", Device: "dm-0", Kind: Corrected, Inode: 257, Offset: 4096, DevPath: "/dev/sdb", Physical: 2048 * 512},
+		},
+		{
+			line: "BTRFS error (device sda1): unable to fixup (regular) error at logical 1234567 on dev /dev/sda1 physical 7654321",
+			exp:  Record{Level: "error", Device: "sda1", Kind: Uncorrectable, Logical: 1234567, Physical: 7654321, DevPath: "/dev/sda1"},
+		},
+		{
+			line: "BTRFS warning (device sda1): csum failed root -9 ino 257 off 0 csum 0x1 expected csum 0x2 mirror 2",
+			exp:  Record{Level: "warning", Device: "sda1", Kind: CsumError, Inode: 257, Mirror: 2},
+		},
+		{
+			line: "BTRFS error (device sda1): bdev /dev/sdb errs: wr 0, rd 3, flush 0, corrupt 2, gen 0",
+			exp: Record{Level: "error", Device: "sda1", Kind: DevStats, DevPath: "/dev/sdb",
+				Stats: map[string]uint64{"wr": 0, "rd": 3, "flush": 0, "corrupt": 2, "gen": 0}},
+		},
+	} {
+		r, ok := Parse(c.line)
+		if !ok {
+			t.Errorf("not parsed: %q", c.line)
+			continue
+		}
+		c.exp.Line = c.line
+		if !reflect.DeepEqual(r, c.exp) {
+			t.Errorf("unexpected record for %q:\n%+v\nvs\n%+v", c.line, r, c.exp)
+		}
+	}
+	for _, line := range []string{
+		"BTRFS info (device sda1): disk space caching is enabled",
+		"EXT4-fs error (device sdc): checksum error",
+		"",
+	} {
+		if r, ok := Parse(line); ok {
+			t.Errorf("unexpected record: %+v", r)
+		}
+	}
+	recs, err := ParseLog(strings.NewReader("a\nBTRFS error (device sda1): bdev /dev/sda1 errs: wr 1, rd 0, flush 0, corrupt 0, gen 0\nb\n"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(recs) != 1 || recs[0].Stats["wr"] != 1 {
+		t.Fatalf("unexpected records: %+v", recs)
+	}
+}
@@ -0,0 +1,69 @@
+package btrfs
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// EncodedCompression is a compression of encoded file data.
+// Values match the compression field of the send stream (protocol version 2).
+type EncodedCompression uint32
+
+const (
+	EncodedNone EncodedCompression = iota
+	EncodedZlib
+	EncodedZstd
+	EncodedLZO4K
+	EncodedLZO8K
+	EncodedLZO16K
+	EncodedLZO32K
+	EncodedLZO64K
+)
+
+func (c EncodedCompression) String() string {
+	switch c {
+	case EncodedNone:
+		return "none"
+	case EncodedZlib:
+		return "zlib"
+	case EncodedZstd:
+		return "zstd"
+	case EncodedLZO4K, EncodedLZO8K, EncodedLZO16K, EncodedLZO32K, EncodedLZO64K:
+		return "lzo-" + strconv.Itoa(4<<(c-EncodedLZO4K)) + "k"
+	}
+	return "compression(" + strconv.FormatUint(uint64(c), 10) + ")"
+}
+
+// EncodedExtent describes encoded data for a range of a file.
+type EncodedExtent struct {
+	Len             uint64 // length of the file range
+	UnencodedLen    uint64 // length of the data after decoding
+	UnencodedOffset uint64 // offset of the file range in the decoded data
+	Compression     EncodedCompression
+	Encryption      uint32
+}
+
+// EncodedWrite writes encoded (compressed) data directly to the file at a given offset,
+// without decompressing it. It requires CAP_SYS_ADMIN and Linux 5.18+.
+//
+// The kernel returns EINVAL if it cannot store the data as is (for example, if it is not
+// aligned to the sector size), and ENOSPC if the extent is larger than it can handle.
+// The caller is expected to decode the data and write it instead in this case.
+func EncodedWrite(f *os.File, off uint64, e EncodedExtent, data []byte) error {
+	iov := syscall.Iovec{Len: uint64(len(data))}
+	if len(data) != 0 {
+		iov.Base = (*byte)(unsafe.Pointer(&data[0]))
+	}
+	return iocEncodedWrite(f, &btrfs_ioctl_encoded_io_args{
+		Iov:             &iov,
+		IovCnt:          1,
+		Offset:          int64(off),
+		Len:             e.Len,
+		UnencodedLen:    e.UnencodedLen,
+		UnencodedOffset: e.UnencodedOffset,
+		Compression:     uint32(e.Compression),
+		Encryption:      e.Encryption,
+	})
+}
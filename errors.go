@@ -13,6 +13,53 @@ func (e ErrNotBtrfs) Error() string {
 	return fmt.Sprintf("not a btrfs filesystem: %s", e.Path)
 }
 
+// ErrBalancePreflight is returned when a balance conversion is not possible
+// with the current state of the filesystem.
+type ErrBalancePreflight struct {
+	Type    string  // type of block groups: data, metadata or system
+	Profile Profile // target profile
+	Reason  string
+}
+
+func (e ErrBalancePreflight) Error() string {
+	return fmt.Sprintf("cannot convert %s to %v: %s", e.Type, e.Profile, e.Reason)
+}
+
+// ErrConvert is returned by ConvertProfile when a phase of the conversion fails.
+type ErrConvert struct {
+	Phase string // check, data or metadata
+	Err   error
+}
+
+func (e ErrConvert) Error() string {
+	return fmt.Sprintf("profile conversion failed at %s phase: %v", e.Phase, e.Err)
+}
+
+// ErrUnalignedRange is returned by CloneRange and Dedupe if offsets or the length of the range
+// are not aligned to the clone alignment of the filesystem. See AlignRange.
+type ErrUnalignedRange struct {
+	Op             string // clone or dedupe
+	SrcOff, DstOff uint64
+	Len            uint64
+	Alignment      uint64
+}
+
+func (e ErrUnalignedRange) Error() string {
+	return fmt.Sprintf("%s: range (src %d, dst %d, len %d) is not aligned to %d bytes",
+		e.Op, e.SrcOff, e.DstOff, e.Len, e.Alignment)
+}
+
+// ErrStaleHandle is returned by FS.Validate if the path the FS was opened at no longer refers
+// to the same filesystem and subvolume, for example after it was unmounted.
+type ErrStaleHandle struct {
+	Path   string
+	Reason string
+}
+
+func (e ErrStaleHandle) Error() string {
+	return fmt.Sprintf("stale filesystem handle %s: %s", e.Path, e.Reason)
+}
+
 // Error codes as returned by the kernel
 type ErrCode int
 
@@ -0,0 +1,259 @@
+package btrfs_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dennwc/btrfs"
+	"github.com/dennwc/btrfs/test"
+)
+
+// mountPoint is a btrfs mount used by examples. TestExamples replaces it with a loopback filesystem.
+var mountPoint = "/mnt/data"
+
+// Create a read-only snapshot of a subvolume and save it as a send stream.
+func Example_backup() {
+	home := filepath.Join(mountPoint, "home")
+	snap := filepath.Join(mountPoint, "home."+time.Now().UTC().Format("20060102T150405Z"))
+	if err := btrfs.SnapshotSubVolume(home, snap, true); err != nil {
+		log.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "home.stream")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	// pass the previous snapshot as a parent to send only the changes
+	if err = btrfs.Send(f, "", snap); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("saved", snap, "to", f.Name())
+}
+
+// Scrub all devices of the filesystem and print the progress.
+func ExampleFS_ScrubStart() {
+	fs, err := btrfs.Open(mountPoint, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fs.Close()
+	devs, err := fs.Devices()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, d := range devs {
+		done := make(chan error, 1)
+		go func() {
+			done <- fs.ScrubStart(d.ID, 0, 1<<64-1)
+		}()
+		ticker := time.NewTicker(time.Second)
+	wait:
+		for {
+			select {
+			case err = <-done:
+				break wait
+			case <-ticker.C:
+				if p, err := fs.ScrubStatus(d.ID); err == nil {
+					fmt.Printf("device %d: %d bytes scrubbed\n", d.ID, p.DataBytesScrubbed+p.TreeBytesScrubbed)
+				}
+			}
+		}
+		ticker.Stop()
+		if err != nil {
+			log.Fatal(err)
+		}
+		p, err := fs.ScrubStatus(d.ID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("device %d: done, %d uncorrectable errors\n", d.ID, p.UncorrectableErrors)
+	}
+}
+
+// Scrub all devices of the filesystem in parallel and print the progress.
+func ExampleFS_ScrubStartAsync() {
+	fs, err := btrfs.Open(mountPoint, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fs.Close()
+	devs, err := fs.Devices()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var scrubs []*btrfs.ScrubHandle
+	for _, d := range devs {
+		h, err := fs.ScrubStartAsync(d.ID, 0, 1<<64-1)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scrubs = append(scrubs, h)
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for _, h := range scrubs {
+	wait:
+		for {
+			select {
+			case <-h.Done():
+				break wait
+			case <-ticker.C:
+				if p, err := h.Progress(); err == nil {
+					fmt.Printf("device %d: %d bytes scrubbed\n", h.Device(), p.DataBytesScrubbed+p.TreeBytesScrubbed)
+				}
+			}
+		}
+		if err = h.Wait(); err != nil {
+			log.Fatal(err)
+		}
+		p, _ := h.Progress()
+		fmt.Printf("device %d: done, %d uncorrectable errors\n", h.Device(), p.UncorrectableErrors)
+	}
+}
+
+// Scrub the whole filesystem, but give up after an hour.
+func ExampleFS_ScrubAll() {
+	fs, err := btrfs.Open(mountPoint, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fs.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	res, err := fs.ScrubAll(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for dev, r := range res {
+		if r.Err != nil {
+			log.Fatalf("device %d: %v", dev, r.Err)
+		}
+		fmt.Printf("device %d: %d uncorrectable errors\n", dev, r.Progress.UncorrectableErrors)
+	}
+}
+
+// Compact data block groups in the background, printing the progress, and stop on timeout.
+func ExampleFS_BalanceAsync() {
+	fs, err := btrfs.Open(mountPoint, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fs.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	opts := btrfs.BalanceOptions{
+		Data: &btrfs.BalanceArgs{Usage: &btrfs.BalanceRange{Max: 50}},
+	}
+	h, err := fs.BalanceAsync(ctx, opts, func(p btrfs.BalanceProgress) {
+		fmt.Printf("%d of %d block groups relocated\n", p.Completed, p.Expected)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err = h.Wait(); err != nil && err != context.DeadlineExceeded {
+		log.Fatal(err)
+	}
+}
+
+// Wait for a balance, possibly started by another process, to stop or pause, logging its progress.
+func ExampleFS_MonitorBalance() {
+	fs, err := btrfs.Open(mountPoint, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fs.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = fs.MonitorBalance(ctx, 0, func(e btrfs.BalanceEvent) {
+		switch e.Type {
+		case btrfs.BalanceEventProgress:
+			fmt.Printf("balance: %d of %d block groups relocated\n", e.Progress.Completed, e.Progress.Expected)
+		case btrfs.BalanceEventFinished, btrfs.BalanceEventPaused:
+			cancel()
+		default:
+			fmt.Println("balance:", e.Type)
+		}
+	})
+	if err != nil && err != context.Canceled {
+		log.Fatal(err)
+	}
+}
+
+// Limit the space used by a subvolume.
+func ExampleFS_SetQgroupLimit() {
+	fs, err := btrfs.Open(filepath.Join(mountPoint, "home"), false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer fs.Close()
+	if err = fs.EnableQuota(); err != nil {
+		log.Fatal(err)
+	}
+	id, err := fs.SubVolumeID()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// limit the data referenced by the subvolume, including the data shared with snapshots
+	if err = fs.SetQgroupLimit(btrfs.NewQgroupID(0, id), 10<<30, 0); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Deduplicate two files with the same content.
+func ExampleDedupe() {
+	a, err := os.Open(filepath.Join(mountPoint, "home", "a"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer a.Close()
+	b, err := os.OpenFile(filepath.Join(mountPoint, "home", "b"), os.O_RDWR, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer b.Close()
+	st, err := a.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	n, err := btrfs.Dedupe(b, a, 0, uint64(st.Size()), 0)
+	if err == btrfs.ErrDataDiffers {
+		fmt.Println("files are different")
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("deduplicated", n, "bytes")
+}
+
+func TestExamples(t *testing.T) {
+	dir, closer := btrfstest.New(t, 256*1024*1024)
+	defer closer()
+	old := mountPoint
+	mountPoint = dir
+	defer func() {
+		mountPoint = old
+	}()
+	if err := btrfs.CreateSubVolume(filepath.Join(dir, "home")); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("data"), 64*1024)
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "home", name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Example_backup()
+	ExampleFS_ScrubStart()
+	ExampleFS_ScrubStartAsync()
+	ExampleFS_ScrubAll()
+	ExampleFS_BalanceAsync()
+	ExampleFS_SetQgroupLimit()
+	ExampleDedupe()
+}
@@ -0,0 +1,152 @@
+package btrfs
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// Modes of fallocate(2).
+const (
+	fallocKeepSize     = 0x01 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole    = 0x02 // FALLOC_FL_PUNCH_HOLE
+	fallocZeroRange    = 0x10 // FALLOC_FL_ZERO_RANGE
+	fallocUnshareRange = 0x40 // FALLOC_FL_UNSHARE_RANGE
+
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+)
+
+// unshareChunk is the size of a buffer used to rewrite shared extents.
+const unshareChunk = 1 << 20
+
+func fallocate(f *os.File, mode uint32, off, n int64) error {
+	if err := syscall.Fallocate(int(f.Fd()), mode, off, n); err != nil {
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+// SetNoCOW enables or disables copy-on-write for the file (chattr +C).
+//
+// Btrfs applies the flag only to empty files; for directories it is inherited by new files.
+// NoCOW files are overwritten in place, thus they are not checksummed and not compressed,
+// which suits databases and VM images managing their own layout. Extents shared with
+// snapshots or reflinks are still copied on the first write.
+func SetNoCOW(f *os.File, v bool) error {
+	flags, err := iocGetFlags(f)
+	if err != nil {
+		return &os.PathError{Op: "getflags", Path: f.Name(), Err: err}
+	}
+	if v {
+		flags |= _FS_NOCOW_FL
+	} else {
+		flags &^= _FS_NOCOW_FL
+	}
+	if err = iocSetFlags(f, flags); err != nil {
+		return &os.PathError{Op: "setflags", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+// IsNoCOW checks if copy-on-write is disabled for the file.
+func IsNoCOW(f *os.File) (bool, error) {
+	flags, err := iocGetFlags(f)
+	if err != nil {
+		return false, &os.PathError{Op: "getflags", Path: f.Name(), Err: err}
+	}
+	return flags&_FS_NOCOW_FL != 0, nil
+}
+
+// Preallocate allocates extents for a range of the file. If keepSize is set, the file size
+// is not changed, even if the range is past the end of the file.
+//
+// On btrfs, the first write to a preallocated range is done in place, but the following
+// writes are copy-on-write as usual, unless the file is NoCOW (see SetNoCOW). Thus preallocation
+// only guarantees space for the first write. Data written to preallocated ranges is never
+// compressed, and ranges shared with snapshots are still copied on write.
+func Preallocate(f *os.File, off, n int64, keepSize bool) error {
+	var mode uint32
+	if keepSize {
+		mode |= fallocKeepSize
+	}
+	return fallocate(f, mode, off, n)
+}
+
+// PunchHole deallocates a range of the file. Reads from the range return zeros,
+// and the file size is not changed.
+//
+// Btrfs frees an extent only when no part of it is referenced. Extents of compressed
+// files (up to 128K) and extents shared with snapshots or reflinks stay allocated until
+// all their references are dropped, thus punching a hole may not free any space.
+func PunchHole(f *os.File, off, n int64) error {
+	return fallocate(f, fallocPunchHole|fallocKeepSize, off, n)
+}
+
+// ZeroRange zeroes a range of the file, preallocating it. If keepSize is set, the file size
+// is not changed. It requires Linux 5.9+ on btrfs. See Preallocate for the notes on
+// preallocated ranges.
+func ZeroRange(f *os.File, off, n int64, keepSize bool) error {
+	mode := uint32(fallocZeroRange)
+	if keepSize {
+		mode |= fallocKeepSize
+	}
+	return fallocate(f, mode, off, n)
+}
+
+// Unshare makes sure that a range of the file does not share extents with other files
+// or snapshots, so the following writes do not have to copy them. The file must be opened
+// for reading and writing.
+//
+// Btrfs does not implement FALLOC_FL_UNSHARE_RANGE, thus if the kernel does not support
+// it, data in the range is read and written back, which allocates new extents for it.
+// Holes are skipped. This also works for NoCOW files, since shared extents are always
+// copied on write. For compressed files, rewritten data is compressed again.
+func Unshare(f *os.File, off, n int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocUnshareRange, off, n)
+	if err == nil {
+		return nil
+	} else if err != syscall.EOPNOTSUPP && err != syscall.EINVAL {
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+	}
+	return rewriteRange(f, off, off+n)
+}
+
+// rewriteRange reads data regions in the range and writes them back.
+func rewriteRange(f *os.File, off, end int64) error {
+	fd := int(f.Fd())
+	buf := make([]byte, unshareChunk)
+	for off < end {
+		start, err := syscall.Seek(fd, off, seekData)
+		if err == syscall.ENXIO {
+			return nil // no data till the end of the file
+		} else if err != nil {
+			return &os.PathError{Op: "seek", Path: f.Name(), Err: err}
+		}
+		stop, err := syscall.Seek(fd, start, seekHole)
+		if err != nil {
+			return &os.PathError{Op: "seek", Path: f.Name(), Err: err}
+		}
+		if stop > end {
+			stop = end
+		}
+		for off = start; off < stop; {
+			p := buf
+			if rem := stop - off; rem < int64(len(p)) {
+				p = p[:rem]
+			}
+			n, err := f.ReadAt(p, off)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if n == 0 {
+				return nil
+			}
+			if _, err = f.WriteAt(p[:n], off); err != nil {
+				return err
+			}
+			off += int64(n)
+		}
+	}
+	return nil
+}
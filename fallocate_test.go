@@ -0,0 +1,68 @@
+package btrfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestFallocate(t *testing.T) {
+	f, err := ioutil.TempFile("", "btrfs-falloc-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	const sz = 3 * 4096
+	if err = Preallocate(f, 0, sz, true); isNotSupported(err) {
+		t.Skip("fallocate is not supported:", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if st, err := f.Stat(); err != nil {
+		t.Fatal(err)
+	} else if st.Size() != 0 {
+		t.Fatalf("size changed with keepSize: %d", st.Size())
+	}
+	data := bytes.Repeat([]byte{0xab}, sz)
+	if _, err = f.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = PunchHole(f, 4096, 4096); isNotSupported(err) {
+		t.Skip("punch hole is not supported:", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	for i := 4096; i < 2*4096; i++ {
+		data[i] = 0
+	}
+	check := func() {
+		t.Helper()
+		got := make([]byte, sz)
+		if _, err := f.ReadAt(got, 0); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, data) {
+			t.Fatal("unexpected file content")
+		}
+	}
+	check()
+	if err = rewriteRange(f, 0, sz); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if err = Unshare(f, 0, sz); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func isNotSupported(err error) bool {
+	if e, ok := err.(*os.PathError); ok {
+		err = e.Err
+	}
+	return err == syscall.EOPNOTSUPP
+}
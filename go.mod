@@ -1,5 +1,13 @@
 module github.com/dennwc/btrfs
 
-go 1.12
+go 1.19
 
-require github.com/dennwc/ioctl v1.0.1-0.20181021180353-017804252068
+require (
+	filippo.io/age v1.2.1
+	github.com/dennwc/ioctl v1.0.1-0.20181021180353-017804252068
+)
+
+require (
+	golang.org/x/crypto v0.24.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+)
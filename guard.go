@@ -0,0 +1,136 @@
+package btrfs
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Guard is a set of policies that protect a filesystem from destructive operations
+// performed through FS. It is a safety layer for automation, not a security boundary:
+// package-level functions and other handles are not affected.
+type Guard struct {
+	// ProtectPaths lists subvolumes that cannot be deleted. Paths are relative to the
+	// FS and may contain wildcards, as accepted by path.Match.
+	ProtectPaths []string
+	// RequireReason requires a reason (see WithReason) for destructive operations:
+	// subvolume deletion, flag and received uuid changes, balance, resize, device changes
+	// and stats reset.
+	RequireReason bool
+	// AllowReceivedWritable allows to make received read-only snapshots writable.
+	// Such snapshots can no longer be used as parents of incremental streams.
+	AllowReceivedWritable bool
+}
+
+// ErrGuard is returned when an operation is blocked by a Guard.
+type ErrGuard struct {
+	Op     string
+	Path   string
+	Reason string
+}
+
+func (e ErrGuard) Error() string {
+	if e.Path != "" {
+		return fmt.Sprintf("%s %q is blocked: %s", e.Op, e.Path, e.Reason)
+	}
+	return fmt.Sprintf("%s is blocked: %s", e.Op, e.Reason)
+}
+
+// SetGuard sets policies for destructive operations performed through this FS.
+// It must be called before the FS is used concurrently.
+func (f *FS) SetGuard(g Guard) {
+	f.guard = &g
+}
+
+// ClearGuard removes policies set by SetGuard.
+func (f *FS) ClearGuard() {
+	f.guard = nil
+}
+
+// WithOverride returns a copy of the FS that bypasses Guard policies. Reason is required
+// and is recorded in the audit log (see SetAudit), together with the override flag.
+// The copy shares the underlying handle with f, thus only one of them should be closed.
+func (f *FS) WithOverride(reason string) *FS {
+	c := f.WithReason(reason)
+	c.override = true
+	return c
+}
+
+// destructiveOps lists audited operations that require a reason when the guard asks for it.
+var destructiveOps = map[string]bool{
+	"delete_subvolume":        true,
+	"set_flags":               true,
+	"set_received":            true,
+	"apply_received_metadata": true,
+	"balance":                 true,
+	"balance_resume":          true,
+	"resize":                  true,
+	"add_device":              true,
+	"replace_start":           true,
+	"remove_device":           true,
+	"reset_dev_stats":         true,
+}
+
+// isGuardErr checks if an operation was blocked by a Guard.
+func isGuardErr(err error) bool {
+	_, ok := err.(ErrGuard)
+	return ok
+}
+
+// checkGuard validates generic policies for an operation.
+func (f *FS) checkGuard(op string) error {
+	g := f.guard
+	if g == nil || !destructiveOps[op] {
+		return nil
+	}
+	if f.override && f.reason == "" {
+		return ErrGuard{Op: op, Reason: "override requires a reason"}
+	}
+	if g.RequireReason && f.reason == "" {
+		return ErrGuard{Op: op, Reason: "reason is required"}
+	}
+	return nil
+}
+
+// checkProtected checks if a subvolume at a given path (relative to the FS) can be deleted
+// or otherwise modified by an operation.
+func (f *FS) checkProtected(op, name string) error {
+	g := f.guard
+	if g == nil || f.override {
+		return nil
+	}
+	rel := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(name)), "/")
+	for _, p := range g.ProtectPaths {
+		p = strings.TrimPrefix(path.Clean(p), "/")
+		if ok, _ := path.Match(p, rel); ok {
+			return ErrGuard{Op: op, Path: name, Reason: fmt.Sprintf("protected by %q", p)}
+		}
+	}
+	return nil
+}
+
+// checkSetFlags checks if flags of the subvolume opened as sub can be changed.
+// Sub is either f itself, or a subvolume reached through it.
+func (f *FS) checkSetFlags(sub *FS, flags SubvolFlags) error {
+	g := f.guard
+	if g == nil || f.override || g.AllowReceivedWritable || flags.ReadOnly() {
+		return nil
+	}
+	cur, err := sub.GetFlags()
+	if err != nil || !cur.ReadOnly() {
+		return err
+	}
+	id, err := sub.SubVolumeID()
+	if err != nil {
+		return err
+	}
+	info, err := subvolSearchByRootID(sub.f, objectID(id), "")
+	if err != nil {
+		return err
+	}
+	if !info.ReceivedUUID.IsZero() {
+		return ErrGuard{Op: "set_flags", Path: sub.f.Name(), Reason: "received snapshot cannot be made writable"}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package btrfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGuard(t *testing.T) {
+	dir, err := os.Open(os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	f := &FS{f: dir}
+	f.SetGuard(Guard{ProtectPaths: []string{"@home", "snaps/keep-*"}, RequireReason: true})
+
+	for _, name := range []string{"@home", "/@home/", "snaps/keep-1"} {
+		err := f.WithReason("test").DeleteSubVolume(name)
+		if _, ok := err.(ErrGuard); !ok {
+			t.Errorf("%q: expected guard error, got %v", name, err)
+		}
+	}
+	if err := f.checkProtected("delete_subvolume", "snaps/old-1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := f.checkGuard("delete_subvolume"); err == nil {
+		t.Error("expected an error without a reason")
+	}
+	if err := f.checkGuard("snapshot"); err != nil {
+		t.Errorf("unexpected error for non-destructive op: %v", err)
+	}
+	o := f.WithOverride("migration")
+	if err := o.checkProtected("delete_subvolume", "@home"); err != nil {
+		t.Errorf("unexpected error with override: %v", err)
+	}
+	if err := f.WithOverride("").checkGuard("delete_subvolume"); err == nil {
+		t.Error("expected an error for override without a reason")
+	}
+	m := &SubvolumeMetadata{Path: "src", UUID: UUID{1}}
+	if err := f.ApplyReceivedMetadata("restored", m); !isGuardErr(err) {
+		t.Errorf("expected guard error without a reason, got %v", err)
+	}
+	if err := f.WithReason("test").ApplyReceivedMetadata("@home", m); !isGuardErr(err) {
+		t.Errorf("expected guard error for a protected path, got %v", err)
+	}
+	f.ClearGuard()
+	if err := f.checkProtected("delete_subvolume", "@home"); err != nil {
+		t.Errorf("unexpected error without guard: %v", err)
+	}
+}
@@ -0,0 +1,276 @@
+package btrfs
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// HealthStatus is an overall verdict of a health check.
+type HealthStatus int
+
+const (
+	HealthGreen HealthStatus = iota
+	HealthYellow
+	HealthRed
+)
+
+func (s HealthStatus) String() string {
+	switch s {
+	case HealthGreen:
+		return "green"
+	case HealthYellow:
+		return "yellow"
+	case HealthRed:
+		return "red"
+	}
+	return fmt.Sprintf("HealthStatus(%d)", int(s))
+}
+
+func (s HealthStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// HealthCheck is a result of a single health check.
+type HealthCheck struct {
+	Name    string       `json:"name"`
+	Status  HealthStatus `json:"status"`
+	Message string       `json:"message"`
+}
+
+// HealthReport is a combined result of all health checks.
+type HealthReport struct {
+	Status HealthStatus  `json:"status"` // the worst status of all checks
+	Checks []HealthCheck `json:"checks"`
+}
+
+func (r *HealthReport) add(name string, st HealthStatus, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, HealthCheck{Name: name, Status: st, Message: fmt.Sprintf(format, args...)})
+	if st > r.Status {
+		r.Status = st
+	}
+}
+
+// HealthOptions controls thresholds used by Health.
+type HealthOptions struct {
+	// ScrubMaxAge is the maximal age of the last scrub. Default is 31 days.
+	ScrubMaxAge time.Duration
+	// MinUnallocated is the minimal amount of unallocated space. Default is 1 GiB.
+	MinUnallocated uint64
+}
+
+const (
+	defaultScrubMaxAge    = 31 * 24 * time.Hour
+	defaultMinUnallocated = 1024 * 1024 * 1024
+)
+
+// Health runs a set of health checks: device errors (since acknowledgment, see AckDevStats),
+// missing devices, scrub recency (see SetStateDir), space pressure and redundancy of profiles.
+func (f *FS) Health(opts *HealthOptions) (*HealthReport, error) {
+	var o HealthOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.ScrubMaxAge == 0 {
+		o.ScrubMaxAge = defaultScrubMaxAge
+	}
+	if o.MinUnallocated == 0 {
+		o.MinUnallocated = defaultMinUnallocated
+	}
+	info, err := f.Info()
+	if err != nil {
+		return nil, err
+	}
+	devs, err := f.Devices()
+	if err != nil {
+		return nil, err
+	}
+	r := &HealthReport{}
+	f.healthDevices(r, info, devs)
+	if err := f.healthDevStats(r, devs); err != nil {
+		return nil, err
+	}
+	if err := f.healthScrub(r, o.ScrubMaxAge); err != nil {
+		return nil, err
+	}
+	if err := f.healthSpace(r, o.MinUnallocated); err != nil {
+		return nil, err
+	}
+	if err := f.healthRedundancy(r, devs); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (f *FS) healthDevices(r *HealthReport, info Info, devs []DevInfo) {
+	const name = "devices"
+	var missing []string
+	for _, d := range devs {
+		if d.Path == "" {
+			missing = append(missing, fmt.Sprintf("devid %d", d.ID))
+		} else if _, err := os.Stat(d.Path); os.IsNotExist(err) {
+			missing = append(missing, fmt.Sprintf("devid %d (%s)", d.ID, d.Path))
+		}
+	}
+	if n := int(info.NumDevices) - len(devs); n > 0 {
+		missing = append(missing, fmt.Sprintf("%d unknown", n))
+	}
+	if len(missing) != 0 {
+		r.add(name, HealthRed, "missing devices: %s", strings.Join(missing, ", "))
+		return
+	}
+	r.add(name, HealthGreen, "%d devices present", len(devs))
+}
+
+func (f *FS) healthDevStats(r *HealthReport, devs []DevInfo) error {
+	const name = "device errors"
+	st := HealthGreen
+	var lines []string
+	for _, d := range devs {
+		s, err := f.DevStatsSinceAck(d.ID)
+		if err != nil {
+			return err
+		}
+		if !s.HasErrors() {
+			continue
+		}
+		if s.WriteErrs != 0 || s.ReadErrs != 0 || s.FlushErrs != 0 || s.CorruptionErrs != 0 {
+			st = HealthRed
+		} else if st < HealthYellow {
+			st = HealthYellow
+		}
+		lines = append(lines, fmt.Sprintf("devid %d: write %d, read %d, flush %d, corruption %d, generation %d",
+			d.ID, s.WriteErrs, s.ReadErrs, s.FlushErrs, s.CorruptionErrs, s.GenerationErrs))
+	}
+	if len(lines) == 0 {
+		r.add(name, HealthGreen, "no new errors")
+		return nil
+	}
+	r.add(name, st, "%s", strings.Join(lines, "; "))
+	return nil
+}
+
+func (f *FS) healthScrub(r *HealthReport, maxAge time.Duration) error {
+	const name = "scrub"
+	last, err := f.LastScrub()
+	if err == errNoStateDir {
+		r.add(name, HealthGreen, "not checked: scrub history is not available")
+		return nil
+	} else if err == ErrNotFound {
+		r.add(name, HealthYellow, "never scrubbed")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	age := time.Since(last.Finished)
+	switch {
+	case last.Errors:
+		r.add(name, HealthRed, "last scrub finished %v ago with errors", age.Truncate(time.Minute))
+	case last.Canceled:
+		r.add(name, HealthYellow, "last scrub was canceled %v ago", age.Truncate(time.Minute))
+	case age > maxAge:
+		r.add(name, HealthYellow, "last scrub finished %v ago", age.Truncate(time.Minute))
+	default:
+		r.add(name, HealthGreen, "last scrub finished %v ago without errors", age.Truncate(time.Minute))
+	}
+	return nil
+}
+
+func (f *FS) healthSpace(r *HealthReport, minUnallocated uint64) error {
+	u, err := f.Usage()
+	if err != nil {
+		return err
+	}
+	healthUsage(r, u, minUnallocated)
+	return nil
+}
+
+// healthUsage classifies space pressure reported by Usage.
+func healthUsage(r *HealthReport, u UsageInfo, minUnallocated uint64) {
+	var metaFree uint64
+	if u.RawMetaChunks > u.RawMetaUsed {
+		metaFree = uint64(float64(u.RawMetaChunks-u.RawMetaUsed) / u.MetadataRatio)
+	}
+	switch {
+	case u.TotalUnused < minMetaChunk && metaFree < u.GlobalReserve*2:
+		r.add("space", HealthRed, "metadata is almost full (%d bytes free) and no space can be allocated (%d bytes unallocated)",
+			metaFree, u.TotalUnused)
+	case u.TotalUnused < minUnallocated:
+		r.add("space", HealthYellow, "low unallocated space: %d bytes", u.TotalUnused)
+	default:
+		r.add("space", HealthGreen, "%d bytes unallocated, %d bytes of metadata free", u.TotalUnused, metaFree)
+	}
+}
+
+// blockGroupProfiles returns profiles of allocated block groups of each type.
+func (f *FS) blockGroupProfiles() (data, meta, sys []Profile, _ error) {
+	spaces, err := iocSpaceInfo(f.f)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, s := range spaces {
+		if blockGroup(s.Flags)&spaceInfoGlobalRsv != 0 {
+			continue
+		}
+		bg := s.Flags.BlockGroup()
+		p := profileOf(bg)
+		if bg&blockGroupData != 0 {
+			data = append(data, p)
+		}
+		if bg&blockGroupMetadata != 0 {
+			meta = append(meta, p)
+		}
+		if bg&blockGroupSystem != 0 {
+			sys = append(sys, p)
+		}
+	}
+	return data, meta, sys, nil
+}
+
+func (f *FS) healthRedundancy(r *HealthReport, devs []DevInfo) error {
+	data, meta, sys, err := f.blockGroupProfiles()
+	if err != nil {
+		return err
+	}
+	healthProfiles(r, data, meta, sys, len(devs))
+	return nil
+}
+
+// healthProfiles classifies profiles of allocated block groups on a filesystem with ndevs devices.
+func healthProfiles(r *HealthReport, data, meta, sys []Profile, ndevs int) {
+	const name = "redundancy"
+	st := HealthGreen
+	var lines []string
+	for _, t := range []struct {
+		name  string
+		profs []Profile
+	}{{"data", data}, {"metadata", meta}, {"system", sys}} {
+		if len(t.profs) > 1 {
+			// usually a result of an interrupted conversion
+			st = HealthYellow
+			lines = append(lines, fmt.Sprintf("%s has multiple profiles: %v", t.name, t.profs))
+			continue
+		}
+		if len(t.profs) == 0 || t.name == "data" {
+			continue
+		}
+		p := t.profs[0]
+		if ndevs > 1 && p.Tolerated() == 0 {
+			st = HealthYellow
+			lines = append(lines, fmt.Sprintf("%s is %v on %d devices, a single device failure will lose the filesystem",
+				t.name, p, ndevs))
+		}
+	}
+	for _, p := range append(append(append([]Profile{}, data...), meta...), sys...) {
+		if n := p.MinDevices(); ndevs < n {
+			st = HealthRed
+			lines = append(lines, fmt.Sprintf("%v requires %d devices, only %d present", p, n, ndevs))
+		}
+	}
+	if len(lines) == 0 {
+		r.add(name, HealthGreen, "data: %v, metadata: %v, system: %v", data, meta, sys)
+		return
+	}
+	r.add(name, st, "%s", strings.Join(lines, "; "))
+}
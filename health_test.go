@@ -0,0 +1,50 @@
+package btrfs
+
+import "testing"
+
+const mib = 1024 * 1024
+
+var healthUsageCases = []struct {
+	name string
+	u    UsageInfo
+	exp  HealthStatus
+}{
+	{"plenty", UsageInfo{TotalUnused: 10 * gib, RawMetaChunks: gib, RawMetaUsed: 100 * mib, MetadataRatio: 2, GlobalReserve: 16 * mib}, HealthGreen},
+	{"low unallocated", UsageInfo{TotalUnused: 512 * mib, RawMetaChunks: gib, RawMetaUsed: 100 * mib, MetadataRatio: 2, GlobalReserve: 16 * mib}, HealthYellow},
+	{"metadata full", UsageInfo{TotalUnused: 100 * mib, RawMetaChunks: gib, RawMetaUsed: gib - 40*mib, MetadataRatio: 2, GlobalReserve: 16 * mib}, HealthRed},
+	{"metadata full, can allocate", UsageInfo{TotalUnused: 10 * gib, RawMetaChunks: gib, RawMetaUsed: gib, MetadataRatio: 2, GlobalReserve: 16 * mib}, HealthGreen},
+}
+
+func TestHealthUsage(t *testing.T) {
+	for _, c := range healthUsageCases {
+		var r HealthReport
+		healthUsage(&r, c.u, defaultMinUnallocated)
+		if r.Status != c.exp || len(r.Checks) != 1 {
+			t.Errorf("%s: expected %v, got %v (%+v)", c.name, c.exp, r.Status, r.Checks)
+		}
+	}
+}
+
+var healthProfilesCases = []struct {
+	name            string
+	data, meta, sys []Profile
+	ndevs           int
+	exp             HealthStatus
+}{
+	{"single device", []Profile{ProfileSingle}, []Profile{ProfileDup}, []Profile{ProfileDup}, 1, HealthGreen},
+	{"mirrored", []Profile{ProfileRaid0}, []Profile{ProfileRaid1}, []Profile{ProfileRaid1}, 2, HealthGreen},
+	{"no metadata redundancy", []Profile{ProfileRaid1}, []Profile{ProfileSingle}, []Profile{ProfileRaid1}, 2, HealthYellow},
+	{"interrupted conversion", []Profile{ProfileSingle, ProfileRaid1}, []Profile{ProfileRaid1}, []Profile{ProfileRaid1}, 2, HealthYellow},
+	{"missing device", []Profile{ProfileRaid1}, []Profile{ProfileRaid1}, []Profile{ProfileRaid1}, 1, HealthRed},
+	{"raid6 degraded", []Profile{ProfileRaid6}, []Profile{ProfileRaid1C3}, []Profile{ProfileRaid1C3}, 2, HealthRed},
+}
+
+func TestHealthProfiles(t *testing.T) {
+	for _, c := range healthProfilesCases {
+		var r HealthReport
+		healthProfiles(&r, c.data, c.meta, c.sys, c.ndevs)
+		if r.Status != c.exp || len(r.Checks) != 1 {
+			t.Errorf("%s: expected %v, got %v (%+v)", c.name, c.exp, r.Status, r.Checks)
+		}
+	}
+}
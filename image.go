@@ -0,0 +1,824 @@
+package btrfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Image reads files from a btrfs filesystem image or an unmounted device directly,
+// without mounting it. It requires neither root privileges nor kernel support, thus it
+// can be used to inspect images on other systems, or to extract files from a filesystem
+// that the kernel refuses to mount.
+//
+// Names are slash-separated paths relative to the top-level subvolume. Subvolumes are
+// traversed as regular directories. Symlinks are never followed; see ReadLink.
+//
+// Multi-device filesystems are opened with OpenImageDevices. Data is read from any
+// available copy: if a device is missing, or a copy fails the checksum, other copies
+// of raid1 and raid10 chunks are tried, so degraded arrays can be read as well.
+// Only uncompressed and zlib-compressed extents are supported.
+type Image struct {
+	devs       map[uint64]*imageDevice // by devid
+	sb         *superblock
+	nodeSize   uint32
+	sectorSize uint32
+	chunks     []chunk // sorted by the logical address
+	verifier   blockVerifier
+	roots      map[uint64]imageRoot
+	ignoreCsum bool
+
+	csumRoot   *imageRoot // root of the csum tree, nil if there is none
+	csumLoaded bool
+
+	fallbacks uint64 // atomic; see ImageStats.Fallbacks
+}
+
+// imageRoot is a root of a tree, as recorded in the root tree.
+type imageRoot struct {
+	bytenr uint64
+	dirID  uint64 // inode number of the root directory
+}
+
+// ImageInode describes a file in an Image. It is returned by the Sys method of FileInfo.
+type ImageInode struct {
+	Tree  uint64 // id of the subvolume
+	Inode uint64
+	Size  uint64
+	NLink uint32
+	UID   uint32
+	GID   uint32
+	Mode  uint32 // unix mode
+	RDev  uint64
+	Flags uint64
+
+	ATime time.Time
+	CTime time.Time
+	MTime time.Time
+	OTime time.Time
+}
+
+// OpenImage opens a filesystem image or a device for reading. It does not check if the filesystem
+// is mounted, so the data may be inconsistent if it's modified concurrently.
+func OpenImage(path string) (*Image, error) {
+	return OpenImageWithOptions(path, nil)
+}
+
+// OpenImageWithOptions is like OpenImage, but allows to tune reads from the device,
+// e.g. to restore files from a large device at its full speed.
+func OpenImageWithOptions(path string, opts *ImageOptions) (*Image, error) {
+	return OpenImageDevices([]string{path}, opts)
+}
+
+func (im *Image) init() error {
+	sb := im.sb
+	im.nodeSize = sb.u32(superNodeSizeOff)
+	if im.nodeSize < headerSize || im.nodeSize > 64<<10 {
+		return fmt.Errorf("invalid node size: %d", im.nodeSize)
+	}
+	im.sectorSize = sb.u32(superSectorSizeOff)
+	if im.sectorSize < 512 || im.sectorSize&(im.sectorSize-1) != 0 {
+		return fmt.Errorf("invalid sector size: %d", im.sectorSize)
+	}
+	im.verifier = blockVerifier{
+		nodeSize: im.nodeSize,
+		csumType: sb.csumType(),
+		metaUUID: sb.uuid(superFSIDOff),
+		checkFS:  true,
+	}
+	if sb.incompat()&FeatureIncompatMetadataUUID != 0 {
+		im.verifier.metaUUID = sb.uuid(superMetadataUUIDOff)
+	}
+	// system chunks are stored in the superblock, so the chunk tree can be read
+	n := int(sb.u32(superSysArraySizeOff))
+	if n > superSysArrayMax {
+		return fmt.Errorf("invalid system chunk array size: %d", n)
+	}
+	for p := sb[superSysArrayOff : superSysArrayOff+n]; len(p) > 0; {
+		if len(p) < diskKeySize {
+			return errors.New("truncated system chunk array")
+		}
+		k := readDiskKey(p)
+		c, size, err := parseChunkItem(k.Offset, p[diskKeySize:])
+		if err != nil {
+			return err
+		}
+		im.addChunk(c)
+		p = p[diskKeySize+size:]
+	}
+	err := im.search(sb.u64(superChunkRootOff), diskKey{ObjectID: uint64(firstChunkTreeObjectid), Type: byte(chunkItemKey)},
+		diskKey{ObjectID: uint64(firstChunkTreeObjectid), Type: byte(chunkItemKey), Offset: maxUint64},
+		func(k diskKey, data []byte) error {
+			c, _, err := parseChunkItem(k.Offset, data)
+			if err != nil {
+				return err
+			}
+			im.addChunk(c)
+			return nil
+		})
+	if err != nil {
+		return fmt.Errorf("cannot read chunk tree: %v", err)
+	}
+	return nil
+}
+
+// addChunk adds a chunk mapping, unless it's already known.
+func (im *Image) addChunk(c chunk) {
+	i := sort.Search(len(im.chunks), func(i int) bool { return im.chunks[i].start >= c.start })
+	if i < len(im.chunks) && im.chunks[i].start == c.start {
+		return
+	}
+	im.chunks = append(im.chunks, chunk{})
+	copy(im.chunks[i+1:], im.chunks[i:])
+	im.chunks[i] = c
+}
+
+// Close closes the image.
+func (im *Image) Close() error {
+	var err error
+	for _, d := range im.devs {
+		if err2 := d.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// Stats returns counters of reads from all devices, e.g. for progress reporting.
+func (im *Image) Stats() ImageStats {
+	var out ImageStats
+	for _, d := range im.devs {
+		st := d.Stats()
+		out.Bytes += st.Bytes
+		out.Reads += st.Reads
+		out.CacheHits += st.CacheHits
+		if st.Elapsed > out.Elapsed {
+			out.Elapsed = st.Elapsed
+		}
+	}
+	out.Fallbacks = atomic.LoadUint64(&im.fallbacks)
+	return out
+}
+
+// FSID returns the filesystem id.
+func (im *Image) FSID() UUID {
+	return im.sb.uuid(superFSIDOff)
+}
+
+// Generation returns the generation of the last committed transaction.
+func (im *Image) Generation() uint64 {
+	return im.sb.u64(superGenerationOff)
+}
+
+// contiguous returns the number of bytes starting from a logical address that are stored
+// contiguously on each device.
+func (c *chunk) contiguous(logical uint64) uint64 {
+	n := c.start + c.length - logical
+	switch profileOf(c.typ) {
+	case ProfileRaid0, ProfileRaid10:
+		if c.stripeLen != 0 {
+			if k := c.stripeLen - (logical-c.start)%c.stripeLen; k < n {
+				n = k
+			}
+		}
+	}
+	return n
+}
+
+// chunkAt returns the chunk that contains a logical address.
+func (im *Image) chunkAt(logical uint64) (*chunk, error) {
+	i := sort.Search(len(im.chunks), func(i int) bool {
+		c := &im.chunks[i]
+		return c.start+c.length > logical
+	})
+	if i == len(im.chunks) || im.chunks[i].start > logical {
+		return nil, fmt.Errorf("no chunk for logical address %d", logical)
+	}
+	return &im.chunks[i], nil
+}
+
+// readLogical reads data at a given logical address. Each contiguous part is read from the first
+// copy that is available and passes the check, if it is set. Other copies are tried if a device
+// is missing, the read fails, or the check fails.
+func (im *Image) readLogical(p []byte, logical uint64, check func(p []byte, logical uint64) error) error {
+	for len(p) > 0 {
+		c, err := im.chunkAt(logical)
+		if err != nil {
+			return err
+		}
+		copies, ok := c.copies(logical)
+		if !ok {
+			return fmt.Errorf("unsupported chunk profile: %v", profileOf(c.typ))
+		}
+		n := c.contiguous(logical)
+		if n > uint64(len(p)) {
+			n = uint64(len(p))
+		}
+		if err = im.readCopies(p[:n], logical, copies, check); err != nil {
+			return err
+		}
+		p, logical = p[n:], logical+n
+	}
+	return nil
+}
+
+// readCopies reads data from the first good copy, see readLogical.
+func (im *Image) readCopies(p []byte, logical uint64, copies []chunkStripe, check func(p []byte, logical uint64) error) error {
+	var (
+		first   error
+		salvage *imageDevice // first readable copy with bad data checksums
+		soff    int64
+	)
+	for i, s := range copies {
+		dev := im.devs[s.devid]
+		var err error
+		if dev == nil {
+			err = fmt.Errorf("device %d is missing", s.devid)
+		} else if _, err = dev.ReadAt(p, int64(s.offset)); err == nil && check != nil {
+			err = check(p, logical)
+			if _, ok := err.(errDataCsum); ok && salvage == nil {
+				salvage, soff = dev, int64(s.offset)
+			}
+		}
+		if err == nil {
+			if i > 0 {
+				atomic.AddUint64(&im.fallbacks, 1)
+			}
+			return nil
+		} else if first == nil {
+			first = err
+		}
+	}
+	if salvage != nil && im.ignoreCsum {
+		_, err := salvage.ReadAt(p, soff)
+		return err
+	}
+	if first == nil {
+		return fmt.Errorf("logical address %d has no copies", logical)
+	}
+	return fmt.Errorf("logical address %d: %v", logical, first)
+}
+
+// readBlock reads and verifies a tree block. If level is not negative, the block must have this level.
+func (im *Image) readBlock(logical uint64, level int) ([]byte, error) {
+	b := make([]byte, im.nodeSize)
+	err := im.readLogical(b, logical, func(b []byte, logical uint64) error {
+		if len(b) != int(im.nodeSize) {
+			return fmt.Errorf("tree block %d crosses a stripe boundary", logical)
+		}
+		_, reason := im.verifier.verify(treeBlockRef{logical: logical, level: level}, b, func(uint64, childRef) {})
+		if reason != "" {
+			return fmt.Errorf("tree block %d: %s", logical, reason)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// errStopSearch stops the search without an error.
+var errStopSearch = errors.New("stop search")
+
+// search calls fn for all items of a tree with keys in the [min, max] range, in key order.
+func (im *Image) search(root uint64, min, max diskKey, fn func(k diskKey, data []byte) error) error {
+	err := im.searchBlock(root, -1, min, max, fn)
+	if err == errStopSearch {
+		err = nil
+	}
+	return err
+}
+
+// searchBlock is like search, but starts from a tree block with a given level (or any level, if it's negative).
+// Children must have a level lower by one, thus a cycle of pointers is rejected.
+func (im *Image) searchBlock(logical uint64, level int, min, max diskKey, fn func(k diskKey, data []byte) error) error {
+	b, err := im.readBlock(logical, level)
+	if err != nil {
+		return err
+	}
+	n := int(order.Uint32(b[headerNrItemsOff:]))
+	level = int(b[headerLevelOff])
+	if level == 0 {
+		for i := 0; i < n; i++ {
+			p := b[headerSize+i*itemSize:]
+			k := readDiskKey(p)
+			if keyLess(k, min) {
+				continue
+			} else if keyLess(max, k) {
+				return errStopSearch
+			}
+			off, size := order.Uint32(p[diskKeySize:]), order.Uint32(p[diskKeySize+4:])
+			if err = fn(k, b[headerSize+off:headerSize+off+size]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := 0; i < n; i++ {
+		p := b[headerSize+i*keyPtrSize:]
+		if keyLess(max, readDiskKey(p)) {
+			return errStopSearch
+		}
+		// the child covers keys up to the first key of the next one
+		if i+1 < n && !keyLess(min, readDiskKey(b[headerSize+(i+1)*keyPtrSize:])) {
+			continue
+		}
+		if err = im.searchBlock(order.Uint64(p[diskKeySize:]), level-1, min, max, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// root returns the root of a tree with a given id.
+func (im *Image) root(id uint64) (imageRoot, error) {
+	if r, ok := im.roots[id]; ok {
+		return r, nil
+	}
+	r, found, err := im.findRoot(id)
+	if err != nil {
+		return r, err
+	} else if !found {
+		return r, fmt.Errorf("tree %d: %v", id, ErrNotFound)
+	}
+	im.roots[id] = r
+	return r, nil
+}
+
+// findRoot reads the root item of a tree from the root tree.
+func (im *Image) findRoot(id uint64) (imageRoot, bool, error) {
+	var (
+		r     imageRoot
+		found bool
+	)
+	err := im.search(im.sb.u64(superRootOff),
+		diskKey{ObjectID: id, Type: byte(rootItemKey)},
+		diskKey{ObjectID: id, Type: byte(rootItemKey), Offset: maxUint64},
+		func(k diskKey, data []byte) error {
+			if len(data) < 239 {
+				return fmt.Errorf("root item is too short: %d", len(data))
+			}
+			// struct btrfs_root_item: root_dirid and bytenr follow the inode item and the generation
+			r = imageRoot{dirID: order.Uint64(data[168:]), bytenr: order.Uint64(data[176:])}
+			found = true
+			return errStopSearch
+		})
+	return r, found, err
+}
+
+// imageNode is a reference to an inode in a tree.
+type imageNode struct {
+	tree, ino uint64
+}
+
+// inode reads the inode item.
+func (im *Image) inode(n imageNode) (*ImageInode, error) {
+	r, err := im.root(n.tree)
+	if err != nil {
+		return nil, err
+	}
+	k := diskKey{ObjectID: n.ino, Type: byte(inodeItemKey)}
+	var out *ImageInode
+	err = im.search(r.bytenr, k, k, func(_ diskKey, data []byte) error {
+		if len(data) < 160 {
+			return fmt.Errorf("inode item is too short: %d", len(data))
+		}
+		it := asInodeItem(data).Decode()
+		out = &ImageInode{
+			Tree: n.tree, Inode: n.ino,
+			Size: it.Size, NLink: it.NLink,
+			UID: it.UID, GID: it.GID, Mode: it.Mode,
+			RDev: it.RDev, Flags: it.Flags,
+			ATime: it.ATime, CTime: it.CTime, MTime: it.MTime, OTime: it.OTime,
+		}
+		return nil
+	})
+	if err == nil && out == nil {
+		err = fmt.Errorf("inode %d in tree %d: %v", n.ino, n.tree, ErrNotFound)
+	}
+	return out, err
+}
+
+// imageDirEntry is a directory entry, as stored in a dir index item.
+type imageDirEntry struct {
+	name string
+	node imageNode
+}
+
+// dirEntries calls fn for all entries of a directory, in the order they were created.
+func (im *Image) dirEntries(dir imageNode, fn func(e imageDirEntry) error) error {
+	r, err := im.root(dir.tree)
+	if err != nil {
+		return err
+	}
+	return im.search(r.bytenr,
+		diskKey{ObjectID: dir.ino, Type: byte(dirIndexKey)},
+		diskKey{ObjectID: dir.ino, Type: byte(dirIndexKey), Offset: maxUint64},
+		func(_ diskKey, data []byte) error {
+			// struct btrfs_dir_item
+			const size = diskKeySize + 13
+			if len(data) < size {
+				return fmt.Errorf("dir item is too short: %d", len(data))
+			}
+			loc := readDiskKey(data)
+			n := int(order.Uint16(data[diskKeySize+10:]))
+			if len(data) < size+n {
+				return fmt.Errorf("dir item is too short: %d", len(data))
+			}
+			e := imageDirEntry{name: string(data[size : size+n]), node: imageNode{tree: dir.tree, ino: loc.ObjectID}}
+			if treeKeyType(loc.Type) == rootItemKey {
+				sub, err := im.root(loc.ObjectID)
+				if err != nil {
+					return err
+				}
+				e.node = imageNode{tree: loc.ObjectID, ino: sub.dirID}
+			}
+			return fn(e)
+		})
+}
+
+// lookup resolves a path to an inode.
+func (im *Image) lookup(op, name string) (imageNode, *ImageInode, error) {
+	r, err := im.root(uint64(fsTreeObjectid))
+	if err != nil {
+		return imageNode{}, nil, err
+	}
+	cur := imageNode{tree: uint64(fsTreeObjectid), ino: r.dirID}
+	ino, err := im.inode(cur)
+	if err != nil {
+		return cur, nil, err
+	}
+	for _, s := range strings.Split(name, "/") {
+		if s == "" || s == "." {
+			continue
+		} else if s == ".." {
+			return cur, nil, &os.PathError{Op: op, Path: name, Err: os.ErrInvalid}
+		} else if ino.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			return cur, nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		found := false
+		err = im.dirEntries(cur, func(e imageDirEntry) error {
+			if e.name != s {
+				return nil
+			}
+			cur, found = e.node, true
+			return errStopSearch
+		})
+		if err != nil {
+			return cur, nil, err
+		} else if !found {
+			return cur, nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		if ino, err = im.inode(cur); err != nil {
+			return cur, nil, err
+		}
+	}
+	return cur, ino, nil
+}
+
+// imageFileInfo implements os.FileInfo.
+type imageFileInfo struct {
+	name string
+	ino  *ImageInode
+}
+
+func (fi *imageFileInfo) Name() string       { return fi.name }
+func (fi *imageFileInfo) Size() int64        { return int64(fi.ino.Size) }
+func (fi *imageFileInfo) Mode() os.FileMode  { return fileMode(fi.ino.Mode) }
+func (fi *imageFileInfo) ModTime() time.Time { return fi.ino.MTime }
+func (fi *imageFileInfo) IsDir() bool        { return fi.ino.Mode&syscall.S_IFMT == syscall.S_IFDIR }
+func (fi *imageFileInfo) Sys() interface{}   { return fi.ino }
+
+// fileMode converts a unix mode to os.FileMode.
+func fileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		m |= os.ModeDir
+	case syscall.S_IFLNK:
+		m |= os.ModeSymlink
+	case syscall.S_IFIFO:
+		m |= os.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		m |= os.ModeSocket
+	case syscall.S_IFCHR:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFBLK:
+		m |= os.ModeDevice
+	}
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+func baseName(name string) string {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return "/"
+	}
+	return path.Base(name)
+}
+
+// Stat returns the information about a file. Symlinks are not followed.
+func (im *Image) Stat(name string) (os.FileInfo, error) {
+	_, ino, err := im.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return &imageFileInfo{name: baseName(name), ino: ino}, nil
+}
+
+// ReadDir returns the entries of a directory, sorted by name.
+func (im *Image) ReadDir(name string) ([]os.FileInfo, error) {
+	dir, ino, err := im.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	} else if ino.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	var out []os.FileInfo
+	err = im.dirEntries(dir, func(e imageDirEntry) error {
+		ino, err := im.inode(e.node)
+		if err != nil {
+			return err
+		}
+		out = append(out, &imageFileInfo{name: e.name, ino: ino})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out, nil
+}
+
+// ReadLink returns the destination of a symlink.
+func (im *Image) ReadLink(name string) (string, error) {
+	node, ino, err := im.lookup("readlink", name)
+	if err != nil {
+		return "", err
+	} else if ino.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrInvalid}
+	}
+	f := &ImageFile{im: im, ino: ino}
+	if err = f.loadExtents(node); err != nil {
+		return "", err
+	}
+	// the destination is stored as an inline extent, and the inode size is its length
+	buf := make([]byte, ino.Size)
+	if _, err = f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// Open opens a regular file for reading.
+func (im *Image) Open(name string) (*ImageFile, error) {
+	node, ino, err := im.lookup("open", name)
+	if err != nil {
+		return nil, err
+	} else if ino.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrInvalid}
+	}
+	f := &ImageFile{im: im, name: baseName(name), ino: ino}
+	if err = f.loadExtents(node); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// imageExtent is a file extent item.
+type imageExtent struct {
+	off         uint64 // offset in the file
+	len         uint64 // length in the file
+	typ         fileExtentType
+	compression byte
+	ramBytes    uint64 // size of the decoded extent
+	inline      []byte
+	diskBytenr  uint64 // zero for holes
+	diskBytes   uint64
+	offset      uint64 // offset in the decoded extent
+}
+
+// Compression types of file extents.
+const (
+	compressNone = 0
+	compressZlib = 1
+)
+
+// ImageFile is a regular file opened from an Image.
+type ImageFile struct {
+	im      *Image
+	name    string
+	ino     *ImageInode
+	extents []imageExtent
+	pos     int64
+
+	// last decoded compressed extent
+	cached    uint64
+	cachedBuf []byte
+}
+
+func (f *ImageFile) loadExtents(n imageNode) error {
+	r, err := f.im.root(n.tree)
+	if err != nil {
+		return err
+	}
+	return f.im.search(r.bytenr,
+		diskKey{ObjectID: n.ino, Type: byte(extentDataKey)},
+		diskKey{ObjectID: n.ino, Type: byte(extentDataKey), Offset: maxUint64},
+		func(k diskKey, data []byte) error {
+			// struct btrfs_file_extent_item
+			if len(data) < 21 {
+				return fmt.Errorf("file extent item is too short: %d", len(data))
+			}
+			e := imageExtent{
+				off:         k.Offset,
+				ramBytes:    order.Uint64(data[8:]),
+				compression: data[16],
+				typ:         fileExtentType(data[20]),
+			}
+			if data[17] != 0 || order.Uint16(data[18:]) != 0 {
+				return fmt.Errorf("encrypted or encoded extents are not supported")
+			}
+			if e.typ == fileExtentInline {
+				e.inline = data[21:]
+				e.len = e.ramBytes
+			} else {
+				if len(data) < 53 {
+					return fmt.Errorf("file extent item is too short: %d", len(data))
+				}
+				e.diskBytenr = order.Uint64(data[21:])
+				e.diskBytes = order.Uint64(data[29:])
+				e.offset = order.Uint64(data[37:])
+				e.len = order.Uint64(data[45:])
+				if e.typ == fileExtentPrealloc {
+					e.diskBytenr = 0 // reads as zeros
+				}
+			}
+			f.extents = append(f.extents, e)
+			return nil
+		})
+}
+
+// Name returns the base name of the file.
+func (f *ImageFile) Name() string { return f.name }
+
+// Stat returns the information about the file.
+func (f *ImageFile) Stat() (os.FileInfo, error) {
+	return &imageFileInfo{name: f.name, ino: f.ino}, nil
+}
+
+// Close releases resources of the file. The image remains open.
+func (f *ImageFile) Close() error {
+	f.extents, f.cachedBuf = nil, nil
+	return nil
+}
+
+func (f *ImageFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *ImageFile) Seek(off int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		off += f.pos
+	case io.SeekEnd:
+		off += int64(f.ino.Size)
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.pos = off
+	return off, nil
+}
+
+func (f *ImageFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrInvalid}
+	}
+	size := int64(f.ino.Size)
+	if off >= size {
+		return 0, io.EOF
+	}
+	var err error
+	if rem := size - off; int64(len(p)) > rem {
+		p, err = p[:rem], io.EOF
+	}
+	pos := uint64(off)
+	for i := 0; i < len(p); {
+		n, rerr := f.readExtent(p[i:], pos)
+		if rerr != nil {
+			return i, rerr
+		}
+		i += n
+		pos += uint64(n)
+	}
+	return len(p), err
+}
+
+// readExtent reads the data starting at a given file offset from a single extent,
+// or fills a hole with zeros.
+func (f *ImageFile) readExtent(p []byte, pos uint64) (int, error) {
+	// first extent that ends after pos
+	i := sort.Search(len(f.extents), func(i int) bool {
+		e := &f.extents[i]
+		return e.off+e.len > pos
+	})
+	if i == len(f.extents) || f.extents[i].off > pos {
+		// hole up to the next extent
+		n := uint64(len(p))
+		if i < len(f.extents) && f.extents[i].off-pos < n {
+			n = f.extents[i].off - pos
+		}
+		for j := range p[:n] {
+			p[j] = 0
+		}
+		return int(n), nil
+	}
+	e := &f.extents[i]
+	rel := pos - e.off
+	n := e.len - rel
+	if n > uint64(len(p)) {
+		n = uint64(len(p))
+	}
+	p = p[:n]
+	switch {
+	case e.typ != fileExtentInline && e.diskBytenr == 0:
+		for j := range p {
+			p[j] = 0
+		}
+		return int(n), nil
+	case e.typ != fileExtentInline && e.compression == compressNone:
+		return int(n), f.im.readData(p, e.diskBytenr+e.offset+rel)
+	}
+	data, err := f.decode(e)
+	if err != nil {
+		return 0, err
+	}
+	start := e.offset + rel
+	if start >= uint64(len(data)) {
+		// inline data may be shorter than the extent, the rest is zeros
+		for j := range p {
+			p[j] = 0
+		}
+		return int(n), nil
+	}
+	k := copy(p, data[start:])
+	for j := range p[k:] {
+		p[k+j] = 0
+	}
+	return int(n), nil
+}
+
+// decode returns the decoded data of an inline or a compressed extent.
+func (f *ImageFile) decode(e *imageExtent) ([]byte, error) {
+	if e.typ == fileExtentInline && e.compression == compressNone {
+		return e.inline, nil
+	}
+	if e.typ != fileExtentInline && f.cachedBuf != nil && f.cached == e.diskBytenr {
+		return f.cachedBuf, nil
+	}
+	raw := e.inline
+	if e.typ != fileExtentInline {
+		raw = make([]byte, e.diskBytes)
+		if err := f.im.readData(raw, e.diskBytenr); err != nil {
+			return nil, err
+		}
+	}
+	if e.compression != compressZlib {
+		return nil, fmt.Errorf("unsupported compression type: %d", e.compression)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress extent: %v", err)
+	}
+	buf := make([]byte, e.ramBytes)
+	// the compressed data may end early; the rest of the extent is zeros
+	if _, err = io.ReadFull(zr, buf); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, fmt.Errorf("cannot decompress extent: %v", err)
+	}
+	if e.typ != fileExtentInline {
+		f.cached, f.cachedBuf = e.diskBytenr, buf
+	}
+	return buf, nil
+}
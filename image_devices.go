@@ -0,0 +1,163 @@
+package btrfs
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// errDataCsum is a mismatch of a data checksum.
+type errDataCsum struct {
+	logical uint64
+}
+
+func (e errDataCsum) Error() string {
+	return fmt.Sprintf("data checksum mismatch at logical address %d", e.logical)
+}
+
+// OpenImageDevices opens a filesystem that spans multiple images or devices. The paths can be
+// listed in any order, and some of them can be omitted if the data has other copies, e.g. to read
+// a degraded raid1 or raid10 filesystem. All devices must belong to the same filesystem and must
+// have been written by the same transaction.
+func OpenImageDevices(paths []string, opts *ImageOptions) (*Image, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no devices to open")
+	}
+	var o ImageOptions
+	if opts != nil {
+		o = *opts
+	}
+	im := &Image{
+		devs:       make(map[uint64]*imageDevice),
+		roots:      make(map[uint64]imageRoot),
+		ignoreCsum: o.IgnoreDataCsum,
+	}
+	for _, path := range paths {
+		if err := im.addDevice(path, &o); err != nil {
+			im.Close()
+			return nil, err
+		}
+	}
+	if err := im.init(); err != nil {
+		im.Close()
+		return nil, err
+	}
+	return im, nil
+}
+
+// addDevice opens a device and checks that it belongs to the same filesystem as the other ones.
+func (im *Image) addDevice(path string, o *ImageOptions) error {
+	dev, err := openImageDevice(path, o)
+	if err != nil {
+		return err
+	}
+	off := superMirrorOffsets[0]
+	sb, err := readSuperblock(dev, off)
+	if err == nil {
+		err = sb.validate(off)
+	}
+	if err != nil {
+		dev.Close()
+		return fmt.Errorf("%s: cannot read superblock: %v", path, err)
+	}
+	devid := sb.u64(superDevIDOff)
+	if im.sb != nil {
+		if fsid := sb.uuid(superFSIDOff); fsid != im.FSID() {
+			err = fmt.Errorf("%s: belongs to another filesystem: %v", path, fsid)
+		} else if gen := sb.u64(superGenerationOff); gen != im.Generation() {
+			err = fmt.Errorf("%s: generation %d does not match %d of other devices", path, gen, im.Generation())
+		} else if im.devs[devid] != nil {
+			err = fmt.Errorf("%s: device %d is listed twice", path, devid)
+		}
+		if err != nil {
+			dev.Close()
+			return err
+		}
+	} else {
+		im.sb = sb
+	}
+	im.devs[devid] = dev
+	return nil
+}
+
+// readData reads file data at a given logical address, verifying it against the csum tree.
+// The read is extended to whole sectors, since each of them has a separate checksum.
+func (im *Image) readData(p []byte, logical uint64) error {
+	ss := uint64(im.sectorSize)
+	start := logical &^ (ss - 1)
+	end := (logical + uint64(len(p)) + ss - 1) &^ (ss - 1)
+	if start == logical && end == logical+uint64(len(p)) {
+		return im.readLogical(p, logical, im.checkData)
+	}
+	buf := make([]byte, end-start)
+	if err := im.readLogical(buf, start, im.checkData); err != nil {
+		return err
+	}
+	copy(p, buf[logical-start:])
+	return nil
+}
+
+// checkData verifies sectors read from a given logical address. Sectors without checksums,
+// e.g. of files with checksums disabled, are not verified.
+func (im *Image) checkData(p []byte, logical uint64) error {
+	sums, err := im.dataCsums(logical, uint64(len(p)))
+	if err != nil || len(sums) == 0 {
+		return err
+	}
+	ss := int(im.sectorSize)
+	for i := 0; i+ss <= len(p); i += ss {
+		exp, ok := sums[logical+uint64(i)]
+		if !ok {
+			continue
+		}
+		sum, err := checksum(im.sb.csumType(), p[i:i+ss])
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(sum, exp) {
+			return errDataCsum{logical: logical + uint64(i)}
+		}
+	}
+	return nil
+}
+
+// dataCsums returns checksums of sectors in a given logical range, by their logical address.
+func (im *Image) dataCsums(logical, n uint64) (map[uint64][]byte, error) {
+	if !im.csumLoaded {
+		r, found, err := im.findRoot(uint64(csumTreeObjectid))
+		if err != nil {
+			return nil, err
+		} else if found {
+			im.csumRoot = &r
+		}
+		im.csumLoaded = true
+	}
+	if im.csumRoot == nil {
+		return nil, nil
+	}
+	sum, err := checksum(im.sb.csumType(), nil)
+	if err != nil {
+		return nil, err
+	}
+	sumSize := uint64(len(sum))
+	ss := uint64(im.sectorSize)
+	// an item starting before the range may cover it; a leaf holds at most this many checksums
+	cover := uint64(im.nodeSize) / sumSize * ss
+	min := uint64(0)
+	if logical > cover {
+		min = logical - cover
+	}
+	out := make(map[uint64][]byte)
+	err = im.search(im.csumRoot.bytenr,
+		diskKey{ObjectID: uint64(extentCsumObjectid), Type: byte(extentCsumKey), Offset: min},
+		diskKey{ObjectID: uint64(extentCsumObjectid), Type: byte(extentCsumKey), Offset: logical + n - 1},
+		func(k diskKey, data []byte) error {
+			for i := uint64(0); (i+1)*sumSize <= uint64(len(data)); i++ {
+				addr := k.Offset + i*ss
+				if addr >= logical && addr < logical+n {
+					out[addr] = data[i*sumSize : (i+1)*sumSize]
+				}
+			}
+			return nil
+		})
+	return out, err
+}
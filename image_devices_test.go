@@ -0,0 +1,78 @@
+package btrfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs-image-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	big := bytes.Repeat([]byte("0123456789abcdef"), 512)
+	zipped := bytes.Repeat([]byte("compressed "), 900)
+	p1, p2 := filepath.Join(dir, "dev1"), filepath.Join(dir, "dev2")
+	writeTestImageDevices(t, []string{p1, p2}, big, zipped)
+	corrupt := func(path string, off int64) {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err = f.WriteAt([]byte("garbage"), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(paths []string, opts *ImageOptions, name string) ([]byte, ImageStats, error) {
+		im, err := OpenImageDevices(paths, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer im.Close()
+		f, err := im.Open(name)
+		if err != nil {
+			return nil, ImageStats{}, err
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		return data, im.Stats(), err
+	}
+	expBig := append(make([]byte, 4096), big...)
+	if _, err = OpenImageDevices([]string{p1, p1}, nil); err == nil {
+		t.Fatal("expected an error for a duplicate device")
+	}
+
+	// damaged data and a damaged tree block on the first device
+	corrupt(p1, testBigData+100)
+	corrupt(p1, 1<<20+3*4096+200) // first leaf of the fs tree
+	data, st, err := read([]string{p1, p2}, nil, "big")
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, expBig) {
+		t.Fatal("unexpected data")
+	} else if st.Fallbacks == 0 {
+		t.Fatal("expected reads from the second copy")
+	}
+	// the first device is missing
+	if data, _, err = read([]string{p2}, nil, "zip"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, zipped) {
+		t.Fatal("unexpected data")
+	}
+	// no intact copies
+	corrupt(p2, testBigData+100)
+	if _, _, err = read([]string{p1, p2}, nil, "big"); err == nil {
+		t.Fatal("expected a checksum error")
+	}
+	data, _, err = read([]string{p2, p1}, &ImageOptions{IgnoreDataCsum: true}, "big")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(data) != len(expBig) || bytes.Equal(data, expBig) {
+		t.Fatal("expected damaged data")
+	}
+}
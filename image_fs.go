@@ -0,0 +1,111 @@
+//go:build go1.16
+// +build go1.16
+
+package btrfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+)
+
+// FS returns a read-only io/fs view of the image. Symlinks are not followed: like special files,
+// they are opened as empty files, and ReadLink returns their destination.
+func (im *Image) FS() fs.FS {
+	return imageFS{im: im}
+}
+
+type imageFS struct {
+	im *Image
+}
+
+func (f imageFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	fi, err := f.im.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case fi.IsDir():
+		list, err := f.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &imageDir{fi: fi, list: list}, nil
+	case fi.Mode().IsRegular():
+		return f.im.Open(name)
+	}
+	return imageSpecial{fi: fi}, nil
+}
+
+func (f imageFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	return f.im.Stat(name)
+}
+
+func (f imageFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	list, err := f.im.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]fs.DirEntry, 0, len(list))
+	for _, fi := range list {
+		out = append(out, fsDirEntry{fi})
+	}
+	return out, nil
+}
+
+// fsDirEntry implements fs.DirEntry.
+type fsDirEntry struct {
+	fi os.FileInfo
+}
+
+func (e fsDirEntry) Name() string               { return e.fi.Name() }
+func (e fsDirEntry) IsDir() bool                { return e.fi.IsDir() }
+func (e fsDirEntry) Type() fs.FileMode          { return e.fi.Mode().Type() }
+func (e fsDirEntry) Info() (fs.FileInfo, error) { return e.fi, nil }
+
+// imageDir is an opened directory.
+type imageDir struct {
+	fi   os.FileInfo
+	list []fs.DirEntry
+}
+
+func (d *imageDir) Stat() (fs.FileInfo, error) { return d.fi, nil }
+func (d *imageDir) Close() error               { return nil }
+
+func (d *imageDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.fi.Name(), Err: fs.ErrInvalid}
+}
+
+func (d *imageDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		list := d.list
+		d.list = nil
+		return list, nil
+	} else if len(d.list) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.list) {
+		n = len(d.list)
+	}
+	list := d.list[:n]
+	d.list = d.list[n:]
+	return list, nil
+}
+
+// imageSpecial is an opened symlink or a special file.
+type imageSpecial struct {
+	fi os.FileInfo
+}
+
+func (f imageSpecial) Stat() (fs.FileInfo, error) { return f.fi, nil }
+func (f imageSpecial) Read([]byte) (int, error)   { return 0, io.EOF }
+func (f imageSpecial) Close() error               { return nil }
@@ -0,0 +1,31 @@
+//go:build go1.16
+// +build go1.16
+
+package btrfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestImageFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs-image-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "image")
+	writeTestImage(t, path, bytes.Repeat([]byte{1}, 8192), []byte("compressed"))
+	im, err := OpenImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+	if err = fstest.TestFS(im.FS(), "file", "big", "zip"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,220 @@
+package btrfs
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ImageOptions controls how OpenImageWithOptions and OpenImageDevices read the devices.
+type ImageOptions struct {
+	// DirectIO opens the device with O_DIRECT, bypassing the page cache. It avoids
+	// evicting other data when reading large devices, and reading the same data twice
+	// through the cache. Not all filesystems support it for image files.
+	DirectIO bool
+	// ReadAhead is the size of windows read ahead when the data is read sequentially,
+	// e.g. by ImageFile.Read. Zero disables read-ahead.
+	ReadAhead int
+	// Concurrency is the number of read-ahead windows read in parallel. Default is 1.
+	// Devices with deep queues (SSDs, RAID) are only saturated by multiple concurrent reads.
+	Concurrency int
+	// IgnoreDataCsum returns file data even if no copy of it matches the checksum,
+	// instead of failing the read, e.g. to salvage damaged files. Intact copies are still preferred.
+	IgnoreDataCsum bool
+}
+
+// ImageStats are counters of reads from the device of an Image.
+type ImageStats struct {
+	Bytes     uint64        // bytes read from the device, including read-ahead
+	Reads     uint64        // number of reads from the device
+	CacheHits uint64        // reads served from read-ahead windows
+	Fallbacks uint64        // reads served from another copy, because a device was missing or a copy was damaged
+	Elapsed   time.Duration // time since the image was opened
+}
+
+// Rate returns the average read throughput in bytes per second.
+func (s ImageStats) Rate() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Elapsed.Seconds()
+}
+
+// imageWindow is a read-ahead window of the device.
+type imageWindow struct {
+	off  int64
+	done chan struct{}
+	buf  []byte // may be shorter than the window at the end of the device
+	err  error
+}
+
+// imageDevice reads the device of an image, optionally with O_DIRECT and read-ahead.
+// It's safe for concurrent use.
+type imageDevice struct {
+	f      *os.File
+	direct bool
+	window int64
+	sem    chan struct{} // limits concurrent read-ahead
+	start  time.Time
+
+	bytes, reads, hits uint64 // atomic
+
+	mu      sync.Mutex
+	windows map[int64]*imageWindow
+	order   []int64 // windows in the order of creation, for eviction
+	next    int64   // offset that continues the last sequential read
+}
+
+func openImageDevice(path string, o *ImageOptions) (*imageDevice, error) {
+	flags := os.O_RDONLY
+	if o.DirectIO {
+		flags |= syscall.O_DIRECT
+	}
+	f, err := os.OpenFile(path, flags, 0)
+	if err != nil {
+		return nil, err
+	}
+	d := &imageDevice{f: f, direct: o.DirectIO, start: time.Now()}
+	if o.ReadAhead > 0 {
+		n := o.Concurrency
+		if n <= 0 {
+			n = 1
+		}
+		d.window = alignUp(int64(o.ReadAhead))
+		d.sem = make(chan struct{}, n)
+		d.windows = make(map[int64]*imageWindow)
+	}
+	return d, nil
+}
+
+func (d *imageDevice) Close() error {
+	return d.f.Close()
+}
+
+func (d *imageDevice) Stats() ImageStats {
+	return ImageStats{
+		Bytes:     atomic.LoadUint64(&d.bytes),
+		Reads:     atomic.LoadUint64(&d.reads),
+		CacheHits: atomic.LoadUint64(&d.hits),
+		Elapsed:   time.Since(d.start),
+	}
+}
+
+func alignUp(n int64) int64 {
+	return (n + directIOSize - 1) &^ (directIOSize - 1)
+}
+
+// readRaw reads from the device, aligning the request for O_DIRECT if necessary.
+// Like ReadAt, it returns io.EOF if the read ends after the end of the device.
+func (d *imageDevice) readRaw(p []byte, off int64) (int, error) {
+	atomic.AddUint64(&d.reads, 1)
+	if !d.direct {
+		n, err := d.f.ReadAt(p, off)
+		atomic.AddUint64(&d.bytes, uint64(n))
+		return n, err
+	}
+	start := off &^ (directIOSize - 1)
+	end := alignUp(off + int64(len(p)))
+	buf := p
+	if start != off || end != off+int64(len(p)) || uintptr(unsafe.Pointer(&p[0]))&(directIOSize-1) != 0 {
+		buf = alignedBuffer(int(end - start))
+	}
+	n, err := d.f.ReadAt(buf, start)
+	atomic.AddUint64(&d.bytes, uint64(n))
+	if &buf[0] == &p[0] {
+		return n, err
+	}
+	n -= int(off - start)
+	if n < 0 {
+		n = 0
+	}
+	n = copy(p, buf[off-start:off-start+int64(n)])
+	if n < len(p) && err == nil {
+		err = io.EOF
+	} else if n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+// fetch returns a read-ahead window at a given aligned offset, starting a read if necessary.
+// It must be called with the lock held.
+func (d *imageDevice) fetch(off int64) *imageWindow {
+	if w := d.windows[off]; w != nil {
+		return w
+	}
+	w := &imageWindow{off: off, done: make(chan struct{})}
+	d.windows[off] = w
+	d.order = append(d.order, off)
+	// keep windows read ahead, the current one, and the same number of previous ones
+	if max := 2*cap(d.sem) + 1; len(d.order) > max {
+		for _, o := range d.order[:len(d.order)-max] {
+			delete(d.windows, o)
+		}
+		d.order = append(d.order[:0], d.order[len(d.order)-max:]...)
+	}
+	go func() {
+		d.sem <- struct{}{}
+		defer func() { <-d.sem }()
+		buf := alignedBuffer(int(d.window))
+		n, err := d.readRaw(buf, off)
+		if err == io.EOF {
+			err = nil
+		}
+		w.buf, w.err = buf[:n], err
+		close(w.done)
+	}()
+	return w
+}
+
+// ReadAt reads from the device. Sequential reads are served from read-ahead windows,
+// while the following windows are read in the background.
+func (d *imageDevice) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if d.window == 0 {
+		return d.readRaw(p, off)
+	}
+	d.mu.Lock()
+	base := off - off%d.window
+	_, cached := d.windows[base]
+	if !cached && off != d.next {
+		// random reads, e.g. of tree blocks, would only be amplified by read-ahead
+		d.mu.Unlock()
+		return d.readRaw(p, off)
+	}
+	d.next = off + int64(len(p))
+	var ws []*imageWindow
+	for o := base; o < off+int64(len(p)); o += d.window {
+		ws = append(ws, d.fetch(o))
+	}
+	last := ws[len(ws)-1].off
+	for i := 1; i <= cap(d.sem); i++ {
+		d.fetch(last + int64(i)*d.window)
+	}
+	d.mu.Unlock()
+	if cached {
+		atomic.AddUint64(&d.hits, 1)
+	}
+	total := 0
+	for _, w := range ws {
+		<-w.done
+		if w.err != nil {
+			return total, w.err
+		}
+		rel := off + int64(total) - w.off
+		if rel >= int64(len(w.buf)) {
+			return total, io.EOF
+		}
+		total += copy(p[total:], w.buf[rel:])
+	}
+	if total < len(p) {
+		return total, io.EOF
+	}
+	return total, nil
+}
@@ -0,0 +1,82 @@
+package btrfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs-image-io-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := make([]byte, 1<<20+123)
+	rnd := rand.New(rand.NewSource(1))
+	rnd.Read(data)
+	path := filepath.Join(dir, "dev")
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range []ImageOptions{
+		{},
+		{ReadAhead: 64 << 10},
+		{ReadAhead: 100 << 10, Concurrency: 4},
+		{DirectIO: true},
+		{DirectIO: true, ReadAhead: 64 << 10, Concurrency: 2},
+	} {
+		d, err := openImageDevice(path, &o)
+		if err != nil {
+			if o.DirectIO {
+				t.Logf("direct IO is not supported: %v", err)
+				continue
+			}
+			t.Fatal(err)
+		}
+		// sequential reads of odd sizes
+		got := bytes.NewBuffer(nil)
+		buf := make([]byte, 7777)
+		for off := int64(0); ; {
+			n, err := d.ReadAt(buf, off)
+			got.Write(buf[:n])
+			off += int64(n)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%+v: %v", o, err)
+			}
+		}
+		if !bytes.Equal(got.Bytes(), data) {
+			t.Fatalf("%+v: sequential read mismatch", o)
+		}
+		// random reads
+		for i := 0; i < 100; i++ {
+			off := rnd.Intn(len(data))
+			p := make([]byte, rnd.Intn(20000)+1)
+			n, err := d.ReadAt(p, int64(off))
+			if off+len(p) > len(data) {
+				if err != io.EOF || n != len(data)-off {
+					t.Fatalf("%+v: expected a short read at %d: %d, %v", o, off, n, err)
+				}
+			} else if err != nil {
+				t.Fatalf("%+v: %v", o, err)
+			}
+			if !bytes.Equal(p[:n], data[off:off+n]) {
+				t.Fatalf("%+v: read mismatch at %d", o, off)
+			}
+		}
+		st := d.Stats()
+		if st.Bytes < uint64(len(data)) || st.Reads == 0 {
+			t.Fatalf("%+v: unexpected stats: %+v", o, st)
+		}
+		if o.ReadAhead != 0 && st.CacheHits == 0 {
+			t.Fatalf("%+v: expected reads from read-ahead windows", o)
+		}
+		d.Close()
+	}
+}
@@ -0,0 +1,331 @@
+package btrfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+type testItem struct {
+	key  diskKey
+	data []byte
+}
+
+func putDiskKey(p []byte, k diskKey) {
+	binary.LittleEndian.PutUint64(p[0:], k.ObjectID)
+	p[8] = k.Type
+	binary.LittleEndian.PutUint64(p[9:], k.Offset)
+}
+
+// testImage builds tree blocks and data of a synthetic single-device image.
+type testImage struct {
+	buf  []byte
+	fsid UUID
+}
+
+func (im *testImage) header(b []byte, bytenr, owner uint64, n, level int) {
+	copy(b[headerFSIDOff:], im.fsid[:])
+	binary.LittleEndian.PutUint64(b[headerBytenrOff:], bytenr)
+	binary.LittleEndian.PutUint64(b[headerGenerationOff:], 10)
+	binary.LittleEndian.PutUint64(b[0x58:], owner)
+	binary.LittleEndian.PutUint32(b[headerNrItemsOff:], uint32(n))
+	b[headerLevelOff] = byte(level)
+	sum, _ := checksum(csumTypeCrc32, b[headerFSIDOff:])
+	copy(b, sum)
+}
+
+func (im *testImage) leaf(bytenr, owner uint64, items []testItem) {
+	b := im.buf[bytenr : bytenr+4096]
+	end := len(b) - headerSize
+	for i, it := range items {
+		p := b[headerSize+i*itemSize:]
+		end -= len(it.data)
+		putDiskKey(p, it.key)
+		binary.LittleEndian.PutUint32(p[diskKeySize:], uint32(end))
+		binary.LittleEndian.PutUint32(p[diskKeySize+4:], uint32(len(it.data)))
+		copy(b[headerSize+end:], it.data)
+	}
+	im.header(b, bytenr, owner, len(items), 0)
+}
+
+func (im *testImage) node(bytenr, owner uint64, keys []diskKey, children []uint64) {
+	b := im.buf[bytenr : bytenr+4096]
+	for i, k := range keys {
+		p := b[headerSize+i*keyPtrSize:]
+		putDiskKey(p, k)
+		binary.LittleEndian.PutUint64(p[diskKeySize:], children[i])
+		binary.LittleEndian.PutUint64(p[diskKeySize+8:], 10)
+	}
+	im.header(b, bytenr, owner, len(keys), 1)
+}
+
+// testChunkItem returns a chunk mapped to the same offsets of all devices (raid1 if there are multiple).
+func testChunkItem(size uint64, devs int) []byte {
+	p := make([]byte, 48+32*devs)
+	binary.LittleEndian.PutUint64(p[0:], size)
+	binary.LittleEndian.PutUint64(p[8:], 2)
+	binary.LittleEndian.PutUint64(p[16:], 64<<10)
+	typ := blockGroupSystem | blockGroupMetadata | blockGroupData
+	if devs > 1 {
+		typ |= blockGroupRaid1
+	}
+	binary.LittleEndian.PutUint64(p[24:], uint64(typ))
+	binary.LittleEndian.PutUint16(p[44:], uint16(devs))
+	for i := 0; i < devs; i++ {
+		binary.LittleEndian.PutUint64(p[48+32*i:], uint64(i+1)) // devid, offset is zero
+	}
+	return p
+}
+
+func testInode(mode uint32, size uint64) []byte {
+	p := make([]byte, 160)
+	binary.LittleEndian.PutUint64(p[16:], size)
+	binary.LittleEndian.PutUint32(p[40:], 1)
+	binary.LittleEndian.PutUint32(p[44:], 1000)
+	binary.LittleEndian.PutUint32(p[52:], mode)
+	binary.LittleEndian.PutUint64(p[136:], 1500000000)
+	return p
+}
+
+func testDirIndex(ino uint64, typ fileType, name string) []byte {
+	p := make([]byte, diskKeySize+13+len(name))
+	putDiskKey(p, diskKey{ObjectID: ino, Type: byte(inodeItemKey)})
+	binary.LittleEndian.PutUint16(p[diskKeySize+10:], uint16(len(name)))
+	p[diskKeySize+12] = byte(typ)
+	copy(p[diskKeySize+13:], name)
+	return p
+}
+
+func testInline(data []byte) []byte {
+	p := make([]byte, 21+len(data))
+	binary.LittleEndian.PutUint64(p[8:], uint64(len(data)))
+	copy(p[21:], data)
+	return p
+}
+
+func testRegular(compression byte, ram, bytenr, diskBytes, num uint64) []byte {
+	p := make([]byte, 53)
+	binary.LittleEndian.PutUint64(p[8:], ram)
+	p[16] = compression
+	p[20] = byte(fileExtentReg)
+	binary.LittleEndian.PutUint64(p[21:], bytenr)
+	binary.LittleEndian.PutUint64(p[29:], diskBytes)
+	binary.LittleEndian.PutUint64(p[45:], num)
+	return p
+}
+
+func writeTestImage(t testing.TB, path string, big, zipped []byte) {
+	writeTestImageDevices(t, []string{path}, big, zipped)
+}
+
+// Offsets of file data in test images.
+const (
+	testBigData = 2 << 20
+	testZipData = 3 << 20
+)
+
+// writeTestImageDevices writes a test image to one or more devices, with data checksums.
+func writeTestImageDevices(t testing.TB, paths []string, big, zipped []byte) {
+	const (
+		chunkLeaf = 1 << 20
+		rootLeaf  = chunkLeaf + 4096
+		fsNode    = chunkLeaf + 2*4096
+		fsLeafA   = chunkLeaf + 3*4096
+		fsLeafB   = chunkLeaf + 4*4096
+		csumLeaf  = chunkLeaf + 5*4096
+		bigData   = testBigData
+		zipData   = testZipData
+	)
+	im := &testImage{buf: make([]byte, 4<<20), fsid: UUID{1, 2, 3}}
+	chunkKey := diskKey{ObjectID: uint64(firstChunkTreeObjectid), Type: byte(chunkItemKey)}
+	im.leaf(chunkLeaf, 3, []testItem{{chunkKey, testChunkItem(uint64(len(im.buf)), len(paths))}})
+
+	rootItem := func(dirID, bytenr uint64) []byte {
+		p := make([]byte, 439)
+		binary.LittleEndian.PutUint64(p[168:], dirID)
+		binary.LittleEndian.PutUint64(p[176:], bytenr)
+		return p
+	}
+	im.leaf(rootLeaf, 1, []testItem{
+		{diskKey{ObjectID: 5, Type: byte(rootItemKey)}, rootItem(256, fsNode)},
+		{diskKey{ObjectID: uint64(csumTreeObjectid), Type: byte(rootItemKey)}, rootItem(0, csumLeaf)},
+	})
+
+	var zbuf bytes.Buffer
+	zw := zlib.NewWriter(&zbuf)
+	zw.Write(zipped)
+	zw.Close()
+	copy(im.buf[bigData:], big)
+	copy(im.buf[zipData:], zbuf.Bytes())
+
+	key := func(ino uint64, typ treeKeyType, off uint64) diskKey {
+		return diskKey{ObjectID: ino, Type: byte(typ), Offset: off}
+	}
+	im.leaf(fsLeafA, 5, []testItem{
+		{key(256, inodeItemKey, 0), testInode(syscall.S_IFDIR|0755, 0)},
+		{key(256, dirIndexKey, 2), testDirIndex(257, ftRegFile, "file")},
+		{key(256, dirIndexKey, 3), testDirIndex(258, ftRegFile, "big")},
+		{key(256, dirIndexKey, 4), testDirIndex(259, ftSymlink, "link")},
+		{key(256, dirIndexKey, 5), testDirIndex(260, ftRegFile, "zip")},
+		{key(257, inodeItemKey, 0), testInode(syscall.S_IFREG|0644, 5)},
+		{key(257, extentDataKey, 0), testInline([]byte("hello"))},
+	})
+	im.leaf(fsLeafB, 5, []testItem{
+		{key(258, inodeItemKey, 0), testInode(syscall.S_IFREG|0600, 4096+uint64(len(big)))},
+		{key(258, extentDataKey, 4096), testRegular(compressNone, uint64(len(big)), bigData, uint64(len(big)), uint64(len(big)))},
+		{key(259, inodeItemKey, 0), testInode(syscall.S_IFLNK|0777, 4)},
+		{key(259, extentDataKey, 0), testInline([]byte("file"))},
+		{key(260, inodeItemKey, 0), testInode(syscall.S_IFREG|0644, uint64(len(zipped)))},
+		{key(260, extentDataKey, 0), testRegular(compressZlib, 12288, zipData, 4096, 12288)},
+	})
+	im.node(fsNode, 5, []diskKey{key(256, inodeItemKey, 0), key(258, inodeItemKey, 0)}, []uint64{fsLeafA, fsLeafB})
+
+	csums := func(start, n uint64) []byte {
+		var out []byte
+		for off := start; off < start+n; off += 4096 {
+			sum, _ := checksum(csumTypeCrc32, im.buf[off:off+4096])
+			out = append(out, sum...)
+		}
+		return out
+	}
+	im.leaf(csumLeaf, uint64(csumTreeObjectid), []testItem{
+		{key(uint64(extentCsumObjectid), extentCsumKey, bigData), csums(bigData, uint64(len(big)))},
+		{key(uint64(extentCsumObjectid), extentCsumKey, zipData), csums(zipData, 4096)},
+	})
+
+	sb := new(superblock)
+	copy(sb[superMagicOff:], superMagic)
+	sb.setUUID(superFSIDOff, im.fsid)
+	sb.setU64(superGenerationOff, 10)
+	sb.setU64(superRootOff, rootLeaf)
+	sb.setU64(superChunkRootOff, chunkLeaf)
+	sb.setU64(superNumDevicesOff, uint64(len(paths)))
+	binary.LittleEndian.PutUint32(sb[superSectorSizeOff:], 4096)
+	binary.LittleEndian.PutUint32(sb[superNodeSizeOff:], 4096)
+	sys := append(make([]byte, diskKeySize), testChunkItem(uint64(len(im.buf)), len(paths))...)
+	putDiskKey(sys, chunkKey)
+	copy(sb[superSysArrayOff:], sys)
+	binary.LittleEndian.PutUint32(sb[superSysArraySizeOff:], uint32(len(sys)))
+	sb.setU64(superBytenrOff, uint64(superMirrorOffsets[0]))
+	for i, path := range paths {
+		sb.setU64(superDevIDOff, uint64(i+1))
+		if err := sb.updateCsum(); err != nil {
+			t.Fatal(err)
+		}
+		copy(im.buf[superMirrorOffsets[0]:], sb[:])
+		if err := ioutil.WriteFile(path, im.buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestImageTreeCycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs-image-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "image")
+	writeTestImage(t, path, []byte("big"), []byte("zipped"))
+
+	// point the second child of the fs tree node to the node itself
+	const fsNode = 1<<20 + 2*4096
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := data[fsNode : fsNode+4096]
+	binary.LittleEndian.PutUint64(b[headerSize+keyPtrSize+diskKeySize:], fsNode)
+	sum, _ := checksum(csumTypeCrc32, b[headerFSIDOff:])
+	copy(b, sum)
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	im, err := OpenImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+	if _, err = im.Stat("file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = im.Stat("big"); err == nil || !strings.Contains(err.Error(), "wrong level") {
+		t.Fatalf("expected a wrong level error, got %v", err)
+	}
+}
+
+func TestImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs-image-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	big := bytes.Repeat([]byte("0123456789abcdef"), 512)
+	zipped := bytes.Repeat([]byte("compressed "), 900)
+	path := filepath.Join(dir, "image")
+	writeTestImage(t, path, big, zipped)
+
+	im, err := OpenImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.Close()
+
+	list, err := im.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range list {
+		names = append(names, fi.Name())
+	}
+	if exp := []string{"big", "file", "link", "zip"}; !reflect.DeepEqual(names, exp) {
+		t.Fatalf("unexpected entries: %q", names)
+	}
+	read := func(name string) []byte {
+		f, err := im.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	if data := read("file"); string(data) != "hello" {
+		t.Fatalf("unexpected data: %q", data)
+	}
+	if data := read("/big"); !bytes.Equal(data, append(make([]byte, 4096), big...)) {
+		t.Fatalf("unexpected data of a file with a hole")
+	}
+	if data := read("zip"); !bytes.Equal(data, zipped) {
+		t.Fatalf("unexpected data of a compressed file")
+	}
+	if dst, err := im.ReadLink("link"); err != nil {
+		t.Fatal(err)
+	} else if dst != "file" {
+		t.Fatalf("unexpected link: %q", dst)
+	}
+	fi, err := im.Stat("link")
+	if err != nil {
+		t.Fatal(err)
+	} else if fi.Mode() != os.ModeSymlink|0777 {
+		t.Fatalf("unexpected mode: %v", fi.Mode())
+	}
+	if _, err = im.Stat("missing"); !os.IsNotExist(err) {
+		t.Fatalf("expected not exists error, got %v", err)
+	}
+	if _, err = im.Open("file/x"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
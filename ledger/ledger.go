@@ -0,0 +1,212 @@
+// Package ledger records which snapshots were replicated to which targets.
+//
+// The ledger is a single JSON file per target. It is used by backup tools to find
+// parents for incremental transfers, to resume interrupted jobs and to report
+// replication lag per subvolume.
+package ledger
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dennwc/btrfs"
+)
+
+const version = 1
+
+// Entry describes a single transfer of a snapshot to a target.
+type Entry struct {
+	Subvolume string     `json:"subvolume"`        // path of the source subvolume
+	Snapshot  string     `json:"snapshot"`         // path of the read-only snapshot that was sent
+	UUID      btrfs.UUID `json:"uuid"`             // uuid of the snapshot
+	Parent    string     `json:"parent,omitempty"` // snapshot used as a parent for an incremental transfer
+	Target    string     `json:"target"`           // destination of the transfer
+	Created   time.Time  `json:"created"`          // snapshot creation time
+	Started   time.Time  `json:"started"`
+	Finished  time.Time  `json:"finished,omitempty"` // zero for transfers that were not finished
+	Bytes     uint64     `json:"bytes"`              // size of the stream
+}
+
+// Done checks if the transfer was finished.
+func (e *Entry) Done() bool { return !e.Finished.IsZero() }
+
+type file struct {
+	Version int     `json:"version"`
+	Entries []Entry `json:"entries"`
+}
+
+// Ledger is a set of transfer records backed by a file.
+type Ledger struct {
+	path    string
+	mu      sync.Mutex
+	entries []Entry
+}
+
+// Open opens or creates a ledger file.
+func Open(path string) (*Ledger, error) {
+	l := &Ledger{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	l.entries = f.Entries
+	return l, nil
+}
+
+// Path returns the path of the ledger file.
+func (l *Ledger) Path() string { return l.path }
+
+// save atomically writes the ledger to disk. Must be called with the lock held.
+func (l *Ledger) save() error {
+	data, err := json.MarshalIndent(file{Version: version, Entries: l.entries}, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(l.path), "."+filepath.Base(l.path))
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Begin records the start of a transfer. If an unfinished record for the same snapshot
+// and target exists, it is replaced.
+func (l *Ledger) Begin(e Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e.Started.IsZero() {
+		e.Started = time.Now().UTC()
+	}
+	e.Finished = time.Time{}
+	for i, e2 := range l.entries {
+		if e2.Snapshot == e.Snapshot && e2.Target == e.Target && !e2.Done() {
+			l.entries[i] = e
+			return l.save()
+		}
+	}
+	l.entries = append(l.entries, e)
+	return l.save()
+}
+
+// Finish marks the transfer of a snapshot to the target as completed.
+func (l *Ledger) Finish(snapshot, target string, bytes uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		e := &l.entries[i]
+		if e.Snapshot == snapshot && e.Target == target && !e.Done() {
+			e.Finished = time.Now().UTC()
+			e.Bytes = bytes
+			return l.save()
+		}
+	}
+	return btrfs.ErrNotFound
+}
+
+// Remove deletes all records for the snapshot on a given target.
+func (l *Ledger) Remove(snapshot, target string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := l.entries[:0]
+	for _, e := range l.entries {
+		if e.Snapshot != snapshot || e.Target != target {
+			out = append(out, e)
+		}
+	}
+	l.entries = out
+	return l.save()
+}
+
+// Entries returns all records, ordered by the start time.
+func (l *Ledger) Entries() []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := append([]Entry{}, l.entries...)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+// Pending returns transfers of the subvolume to the target that were started but not finished.
+func (l *Ledger) Pending(subvol, target string) []Entry {
+	var out []Entry
+	for _, e := range l.Entries() {
+		if e.Subvolume == subvol && e.Target == target && !e.Done() {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Sent returns finished transfers of the subvolume to the target, ordered by the snapshot creation time.
+func (l *Ledger) Sent(subvol, target string) []Entry {
+	var out []Entry
+	for _, e := range l.Entries() {
+		if e.Subvolume == subvol && e.Target == target && e.Done() {
+			out = append(out, e)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+// LastSent returns the most recent snapshot of the subvolume that was completely sent to the target.
+func (l *Ledger) LastSent(subvol, target string) (Entry, bool) {
+	sent := l.Sent(subvol, target)
+	if len(sent) == 0 {
+		return Entry{}, false
+	}
+	return sent[len(sent)-1], true
+}
+
+// Lag returns the replication lag of the subvolume to the target: the time passed since the
+// creation of the most recent snapshot that reached the target.
+// It returns false if nothing was replicated yet.
+func (l *Ledger) Lag(subvol, target string, now time.Time) (time.Duration, bool) {
+	e, ok := l.LastSent(subvol, target)
+	if !ok {
+		return 0, false
+	}
+	return now.Sub(e.Created), true
+}
+
+// Lags returns the replication lag for each subvolume and target recorded in the ledger.
+func (l *Ledger) Lags(now time.Time) map[string]map[string]time.Duration {
+	out := make(map[string]map[string]time.Duration)
+	for _, e := range l.Entries() {
+		if !e.Done() {
+			continue
+		}
+		m := out[e.Subvolume]
+		if m == nil {
+			m = make(map[string]time.Duration)
+			out[e.Subvolume] = m
+		}
+		if d := now.Sub(e.Created); d < m[e.Target] || m[e.Target] == 0 {
+			m[e.Target] = d
+		}
+	}
+	return out
+}
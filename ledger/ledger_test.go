@@ -0,0 +1,54 @@
+package ledger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLedger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs_ledger_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ledger.json")
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range []string{"snap1", "snap2"} {
+		err = l.Begin(Entry{
+			Subvolume: "/data", Snapshot: name, Target: "/backup",
+			Created: t0.Add(time.Duration(i) * time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = l.Finish("snap1", "/backup", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen to check that the state was persisted
+	l, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := l.Pending("/data", "/backup"); len(p) != 1 || p[0].Snapshot != "snap2" {
+		t.Fatalf("unexpected pending transfers: %+v", p)
+	}
+	if e, ok := l.LastSent("/data", "/backup"); !ok || e.Snapshot != "snap1" || e.Bytes != 100 {
+		t.Fatalf("unexpected last snapshot: %+v", e)
+	}
+	if lag, ok := l.Lag("/data", "/backup", t0.Add(3*time.Hour)); !ok || lag != 3*time.Hour {
+		t.Fatalf("unexpected lag: %v", lag)
+	}
+	if _, ok := l.Lag("/data", "/other", t0); ok {
+		t.Fatal("expected no lag for unknown target")
+	}
+}
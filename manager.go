@@ -0,0 +1,230 @@
+package btrfs
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dennwc/btrfs/mtab"
+)
+
+// Manager tracks all mounted btrfs filesystems of the machine.
+//
+// Each filesystem is opened only once, even if it's mounted at multiple places
+// (for example, different subvolumes of it). Handles returned by the manager
+// are owned by it and must not be closed by the caller.
+type Manager struct {
+	mu  sync.Mutex
+	fss map[FSID]*managedFS
+}
+
+type managedFS struct {
+	fs     *FS
+	fsid   FSID
+	mount  string   // mount point the handle was opened at
+	mounts []string // all mount points of the filesystem
+	top    bool     // handle is opened at the top-level subvolume
+	excl   sync.Mutex
+}
+
+// NewManager creates a new manager and loads currently mounted filesystems.
+func NewManager() (*Manager, error) {
+	m := &Manager{fss: make(map[FSID]*managedFS)}
+	if err := m.Refresh(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Refresh rescans mount points. New filesystems are opened, and handles to
+// filesystems that are no longer mounted are closed, thus callers should not keep
+// handles returned by the manager for a long time.
+func (m *Manager) Refresh() error {
+	mounts, err := mtab.Mounts()
+	if err != nil {
+		return err
+	}
+	m.refresh(mounts, openMounted)
+	return nil
+}
+
+// openMounted opens a mount point and returns an id of its filesystem.
+func openMounted(mount string) (*FS, FSID, error) {
+	fs, err := Open(mount, true)
+	if err != nil {
+		return nil, FSID{}, err
+	}
+	fsid := fs.fsid()
+	if fsid == (FSID{}) {
+		fs.Close()
+		return nil, FSID{}, fmt.Errorf("cannot get fsid of %s", mount)
+	}
+	return fs, fsid, nil
+}
+
+// refresh updates tracked filesystems according to the list of mount points.
+func (m *Manager) refresh(mounts []mtab.MountPoint, open func(mount string) (*FS, FSID, error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := make(map[FSID]bool)
+	points := make(map[FSID][]string)
+	for _, mp := range mounts {
+		if mp.Type != "btrfs" {
+			continue
+		}
+		top := isTopLevelMount(mp.Opts)
+		if mfs, ok := m.findMount(mp.Mount); ok {
+			seen[mfs.fsid] = true
+			points[mfs.fsid] = append(points[mfs.fsid], mp.Mount)
+			continue
+		}
+		fs, fsid, err := open(mp.Mount)
+		if err != nil {
+			// mount point may be inaccessible, or hidden by another mount
+			continue
+		}
+		seen[fsid] = true
+		points[fsid] = append(points[fsid], mp.Mount)
+		if cur := m.fss[fsid]; cur != nil {
+			if cur.top || !top {
+				fs.Close()
+				continue
+			}
+			// prefer the top-level subvolume, since all subvolumes are reachable from it
+			cur.fs.Close()
+			cur.fs, cur.mount, cur.top = fs, mp.Mount, top
+			continue
+		}
+		m.fss[fsid] = &managedFS{fs: fs, fsid: fsid, mount: mp.Mount, top: top}
+	}
+	for fsid, mfs := range m.fss {
+		if !seen[fsid] {
+			mfs.fs.Close()
+			delete(m.fss, fsid)
+			continue
+		}
+		mfs.mounts = points[fsid]
+		sort.Strings(mfs.mounts)
+	}
+}
+
+// findMount finds a tracked filesystem that was opened at a given mount point.
+func (m *Manager) findMount(mount string) (*managedFS, bool) {
+	for _, mfs := range m.fss {
+		if mfs.mount == mount {
+			return mfs, true
+		}
+	}
+	return nil, false
+}
+
+func isTopLevelMount(opts string) bool {
+	for _, o := range strings.Split(opts, ",") {
+		if o == "subvolid=5" || o == "subvol=/" {
+			return true
+		}
+	}
+	return false
+}
+
+// fsid returns an id of the filesystem, or zero value on error.
+func (f *FS) fsid() FSID {
+	info, err := iocFsInfo(f.f)
+	if err != nil {
+		return FSID{}
+	}
+	return FSID(info.FSID)
+}
+
+// Filesystems returns ids of all tracked filesystems.
+func (m *Manager) Filesystems() []FSID {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]FSID, 0, len(m.fss))
+	for fsid := range m.fss {
+		out = append(out, fsid)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].String() < out[j].String()
+	})
+	return out
+}
+
+// Get returns a handle to a filesystem with a given id. It returns ErrNotFound
+// if the filesystem is not mounted.
+func (m *Manager) Get(fsid FSID) (*FS, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mfs := m.fss[fsid]
+	if mfs == nil {
+		return nil, ErrNotFound
+	}
+	return mfs.fs, nil
+}
+
+// Mounts returns all mount points of a filesystem with a given id.
+func (m *Manager) Mounts(fsid FSID) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mfs := m.fss[fsid]
+	if mfs == nil {
+		return nil
+	}
+	return append([]string{}, mfs.mounts...)
+}
+
+// Lookup returns a handle to a filesystem that contains a given path.
+// Mount points are rescanned if the filesystem is not yet tracked.
+func (m *Manager) Lookup(path string) (*FS, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fsid, err := fileFSID(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	fs, err := m.Get(fsid)
+	if err != ErrNotFound {
+		return fs, err
+	}
+	if err = m.Refresh(); err != nil {
+		return nil, err
+	}
+	return m.Get(fsid)
+}
+
+// Exclusive runs fn while holding an exclusive lock for the filesystem.
+// It serializes operations like balance, device add/remove or replace,
+// which the kernel refuses to run concurrently.
+func (m *Manager) Exclusive(fsid FSID, fn func(fs *FS) error) error {
+	m.mu.Lock()
+	mfs := m.fss[fsid]
+	m.mu.Unlock()
+	if mfs == nil {
+		return ErrNotFound
+	}
+	mfs.excl.Lock()
+	defer mfs.excl.Unlock()
+	m.mu.Lock()
+	fs := mfs.fs
+	m.mu.Unlock()
+	return fn(fs)
+}
+
+// Close closes all the handles.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var last error
+	for fsid, mfs := range m.fss {
+		if err := mfs.fs.Close(); err != nil {
+			last = err
+		}
+		delete(m.fss, fsid)
+	}
+	return last
+}
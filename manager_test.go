@@ -0,0 +1,88 @@
+package btrfs
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dennwc/btrfs/mtab"
+)
+
+func TestManagerRefresh(t *testing.T) {
+	fsid1, fsid2 := FSID{1}, FSID{2}
+	ids := map[string]FSID{"/home": fsid1, "/mnt/top": fsid1, "/data": fsid2}
+	var opened []string
+	open := func(mount string) (*FS, FSID, error) {
+		opened = append(opened, mount)
+		fsid, ok := ids[mount]
+		if !ok {
+			return nil, FSID{}, errors.New("inaccessible")
+		}
+		f, err := os.Open(os.TempDir())
+		if err != nil {
+			return nil, FSID{}, err
+		}
+		return &FS{f: f}, fsid, nil
+	}
+	m := &Manager{fss: make(map[FSID]*managedFS)}
+	defer m.Close()
+
+	m.refresh([]mtab.MountPoint{
+		{Mount: "/home", Type: "btrfs", Opts: "rw,subvolid=256,subvol=/home"},
+		{Mount: "/mnt/top", Type: "btrfs", Opts: "rw,subvolid=5,subvol=/"},
+		{Mount: "/data", Type: "btrfs", Opts: "rw"},
+		{Mount: "/boot", Type: "ext4", Opts: "rw"},
+		{Mount: "/hidden", Type: "btrfs", Opts: "rw"},
+	}, open)
+	if exp := []string{"/home", "/mnt/top", "/data", "/hidden"}; !reflect.DeepEqual(opened, exp) {
+		t.Fatalf("unexpected mounts opened: %q", opened)
+	}
+	if got := m.Filesystems(); !reflect.DeepEqual(got, []FSID{fsid1, fsid2}) {
+		t.Fatalf("unexpected filesystems: %v", got)
+	}
+	if mfs := m.fss[fsid1]; mfs.mount != "/mnt/top" || !mfs.top {
+		t.Fatalf("expected the top-level mount to be used, got %q", mfs.mount)
+	}
+	if got := m.Mounts(fsid1); !reflect.DeepEqual(got, []string{"/home", "/mnt/top"}) {
+		t.Fatalf("unexpected mounts: %q", got)
+	}
+
+	// tracked mount points are not opened again, unmounted filesystems are dropped
+	opened = nil
+	m.refresh([]mtab.MountPoint{
+		{Mount: "/mnt/top", Type: "btrfs", Opts: "rw,subvolid=5,subvol=/"},
+	}, open)
+	if len(opened) != 0 {
+		t.Fatalf("unexpected mounts opened: %q", opened)
+	}
+	if got := m.Filesystems(); !reflect.DeepEqual(got, []FSID{fsid1}) {
+		t.Fatalf("unexpected filesystems: %v", got)
+	}
+	if got := m.Mounts(fsid1); !reflect.DeepEqual(got, []string{"/mnt/top"}) {
+		t.Fatalf("unexpected mounts: %q", got)
+	}
+	if _, err := m.Get(fsid2); err != ErrNotFound {
+		t.Fatalf("expected %v, got %v", ErrNotFound, err)
+	}
+	if err := m.Exclusive(fsid2, func(*FS) error { return nil }); err != ErrNotFound {
+		t.Fatalf("expected %v, got %v", ErrNotFound, err)
+	}
+	called := false
+	if err := m.Exclusive(fsid1, func(*FS) error { called = true; return nil }); err != nil || !called {
+		t.Fatalf("unexpected result: %v, %v", called, err)
+	}
+}
+
+func TestIsTopLevelMount(t *testing.T) {
+	for opts, exp := range map[string]bool{
+		"rw,relatime,subvolid=5,subvol=/":            true,
+		"rw,subvol=/":                                true,
+		"rw,relatime,subvolid=256,subvol=/@home":     false,
+		"rw,relatime,subvolid=50,subvol=/snapshot/5": false,
+	} {
+		if got := isTopLevelMount(opts); got != exp {
+			t.Errorf("%q: expected %v, got %v", opts, exp, got)
+		}
+	}
+}
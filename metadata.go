@@ -0,0 +1,178 @@
+package btrfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// metadataVersion is the version of the exported metadata document.
+const metadataVersion = 1
+
+// SubvolumeMetadata is a portable description of the subvolume identity.
+//
+// It can be stored together with backups and later used to re-link a restored
+// subvolume on another filesystem, so incremental replication can continue.
+type SubvolumeMetadata struct {
+	Path string `json:"path"`
+
+	ReadOnly bool `json:"readonly"`
+
+	UUID         UUID `json:"uuid"`
+	ParentUUID   UUID `json:"parent_uuid"`
+	ReceivedUUID UUID `json:"received_uuid"`
+
+	CTransID uint64 `json:"ctransid"`
+	OTransID uint64 `json:"otransid"`
+	STransID uint64 `json:"stransid"`
+	RTransID uint64 `json:"rtransid"`
+
+	CTime time.Time `json:"ctime"`
+	OTime time.Time `json:"otime"`
+	STime time.Time `json:"stime"`
+	RTime time.Time `json:"rtime"`
+}
+
+// SendUUID returns the uuid and the transaction id that are used to identify this
+// subvolume in send streams. For received subvolumes it's the uuid of the original.
+func (m *SubvolumeMetadata) SendUUID() (UUID, uint64) {
+	if !m.ReceivedUUID.IsZero() {
+		return m.ReceivedUUID, m.STransID
+	}
+	return m.UUID, m.CTransID
+}
+
+// MetadataDocument is a set of subvolume metadata exported from a filesystem.
+type MetadataDocument struct {
+	Version    int                 `json:"version"`
+	FSID       string              `json:"fsid"`
+	Exported   time.Time           `json:"exported"`
+	Subvolumes []SubvolumeMetadata `json:"subvolumes"`
+}
+
+func metadataFromInfo(info *SubvolInfo) SubvolumeMetadata {
+	return SubvolumeMetadata{
+		Path:         info.Path,
+		ReadOnly:     info.Flags.ReadOnly(),
+		UUID:         info.UUID,
+		ParentUUID:   info.ParentUUID,
+		ReceivedUUID: info.ReceivedUUID,
+		CTransID:     info.CTransID,
+		OTransID:     info.OTransID,
+		STransID:     info.STransID,
+		RTransID:     info.RTransID,
+		CTime:        info.CTime,
+		OTime:        info.OTime,
+		STime:        info.STime,
+		RTime:        info.RTime,
+	}
+}
+
+// SubvolumeMetadata returns identity metadata of a subvolume at a given path (relative to the FS).
+func (f *FS) SubvolumeMetadata(path string) (*SubvolumeMetadata, error) {
+	info, err := f.SubvolumeByPath(path)
+	if err != nil {
+		return nil, err
+	}
+	m := metadataFromInfo(info)
+	return &m, nil
+}
+
+// ExportSubvolumeMetadata writes a JSON document describing given subvolumes.
+// If no subvolumes are specified, all subvolumes are exported.
+func (f *FS) ExportSubvolumeMetadata(w io.Writer, subvols ...string) error {
+	info, err := f.Info()
+	if err != nil {
+		return err
+	}
+	doc := MetadataDocument{
+		Version:  metadataVersion,
+		FSID:     info.FSID.String(),
+		Exported: time.Now().UTC(),
+	}
+	if len(subvols) == 0 {
+		list, err := f.ListSubvolumes(nil)
+		if err != nil {
+			return err
+		}
+		for i := range list {
+			doc.Subvolumes = append(doc.Subvolumes, metadataFromInfo(&list[i]))
+		}
+	} else {
+		for _, s := range subvols {
+			m, err := f.SubvolumeMetadata(s)
+			if err != nil {
+				return fmt.Errorf("cannot export %s: %v", s, err)
+			}
+			doc.Subvolumes = append(doc.Subvolumes, *m)
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(doc)
+}
+
+// ReadMetadataDocument reads a document written by ExportSubvolumeMetadata.
+func ReadMetadataDocument(r io.Reader) (*MetadataDocument, error) {
+	var doc MetadataDocument
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	} else if doc.Version != metadataVersion {
+		return nil, fmt.Errorf("unsupported metadata version: %d", doc.Version)
+	}
+	return &doc, nil
+}
+
+// ApplyReceivedMetadata marks a subvolume at path (relative to the FS) as received from
+// the subvolume described by m, exactly as receive would do it. This allows to use
+// a subvolume restored by other means as a parent for incremental streams.
+//
+// Read-only subvolumes are temporarily made writable to apply the change, subject to
+// the policies set by SetGuard.
+func (f *FS) ApplyReceivedMetadata(path string, m *SubvolumeMetadata) error {
+	return f.audited("apply_received_metadata", map[string]interface{}{"path": path, "source": m.Path}, func() error {
+		return f.applyReceivedMetadata(path, m)
+	})
+}
+
+func (f *FS) applyReceivedMetadata(path string, m *SubvolumeMetadata) error {
+	uuid, stransid := m.SendUUID()
+	if uuid.IsZero() {
+		return fmt.Errorf("metadata for %q has no uuid", m.Path)
+	}
+	if err := f.checkProtected("apply_received_metadata", path); err != nil {
+		return err
+	}
+	// the handle is only used to issue ioctls; policies of f are checked explicitly,
+	// and the operation is audited as a whole
+	sub, err := Open(filepath.Join(f.f.Name(), path), false)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	flags, err := sub.GetFlags()
+	if err != nil {
+		return err
+	}
+	if flags.ReadOnly() {
+		rw := flags &^ subvolReadOnlyMask
+		if err = f.checkSetFlags(sub, rw); err != nil {
+			return err
+		} else if err = iocSubvolSetflags(sub.f, rw); err != nil {
+			return err
+		}
+	}
+	stime := m.STime
+	if m.ReceivedUUID.IsZero() {
+		stime = m.CTime
+	}
+	err = sub.SetReceived(uuid, stransid, stime)
+	if flags.ReadOnly() {
+		if err2 := iocSubvolSetflags(sub.f, flags); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
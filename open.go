@@ -0,0 +1,101 @@
+package btrfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// constants not exported by the syscall package
+const (
+	oPath   = 0x200000 // O_PATH
+	atFDCWD = -0x64    // AT_FDCWD
+)
+
+// OpenOptions controls flags used to open a filesystem with OpenWithOptions and OpenAt.
+type OpenOptions struct {
+	// NoATime opens the subvolume with O_NOATIME. Unlike Open, it fails if the caller
+	// is not permitted to use the flag (it requires ownership of the directory).
+	NoATime bool
+	// Directory opens the subvolume with O_DIRECTORY, so opening anything else fails
+	// in the kernel instead of a later check.
+	Directory bool
+	// Path opens the subvolume with O_PATH. Such handles cannot be used for ioctls, thus most
+	// methods of FS fail; they are only useful as a directory for OpenAt.
+	Path bool
+	// Inherit allows the handle to be inherited by child processes (O_CLOEXEC is not set).
+	Inherit bool
+}
+
+func (o *OpenOptions) flags() int {
+	flags := syscall.O_RDONLY
+	if o.NoATime {
+		flags |= syscall.O_NOATIME
+	}
+	if o.Directory {
+		flags |= syscall.O_DIRECTORY
+	}
+	if o.Path {
+		flags |= oPath
+	}
+	if !o.Inherit {
+		flags |= syscall.O_CLOEXEC
+	}
+	return flags
+}
+
+// OpenWithOptions is like Open, but gives explicit control over flags used to open the subvolume.
+func OpenWithOptions(path string, opts *OpenOptions) (*FS, error) {
+	return openAt(atFDCWD, path, path, opts)
+}
+
+// OpenAt opens a subvolume at a path relative to an open directory, similar to openat(2).
+// The check that the handle is a btrfs subvolume is done on the opened handle, not on the path,
+// thus it's safe to use in untrusted mount namespaces, for example by container runtimes.
+//
+// Methods of FS that accept paths resolve them relative to the path of the handle,
+// as reported by the kernel at the time of opening.
+func OpenAt(dirfd int, rel string, opts *OpenOptions) (*FS, error) {
+	name := rel
+	if dir, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(dirfd)); err == nil {
+		name = filepath.Join(dir, rel)
+	}
+	return openAt(dirfd, rel, name, opts)
+}
+
+func openAt(dirfd int, path, name string, opts *OpenOptions) (*FS, error) {
+	var o OpenOptions
+	if opts != nil {
+		o = *opts
+	}
+	fd, err := syscall.Openat(dirfd, path, o.flags(), 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	if err = checkSubVolumeFd(fd, name); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return newFS(os.NewFile(uintptr(fd), name)), nil
+}
+
+// checkSubVolumeFd checks that an open file is a root of a btrfs subvolume.
+func checkSubVolumeFd(fd int, name string) error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return fmt.Errorf("not a directory: %s", name)
+	}
+	var stfs syscall.Statfs_t
+	if err := syscall.Fstatfs(fd, &stfs); err != nil {
+		return &os.PathError{Op: "statfs", Path: name, Err: err}
+	}
+	if uint32(stfs.Type) != SuperMagic || objectID(st.Ino) != firstFreeObjectid {
+		return ErrNotBtrfs{Path: name}
+	}
+	return nil
+}
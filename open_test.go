@@ -0,0 +1,48 @@
+package btrfs
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/dennwc/btrfs/test"
+)
+
+func TestOpenOptionsFlags(t *testing.T) {
+	if f := (&OpenOptions{}).flags(); f != syscall.O_RDONLY|syscall.O_CLOEXEC {
+		t.Fatalf("unexpected flags: %#x", f)
+	}
+	if f := (&OpenOptions{NoATime: true, Directory: true, Path: true, Inherit: true}).flags(); f != syscall.O_NOATIME|syscall.O_DIRECTORY|oPath {
+		t.Fatalf("unexpected flags: %#x", f)
+	}
+}
+
+func TestOpenAt(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	if err := CreateSubVolume(dir + "/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir+"/plain", 0755); err != nil {
+		t.Fatal(err)
+	}
+	d, err := OpenWithOptions(dir, &OpenOptions{Path: true, Directory: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	fs, err := OpenAt(int(d.f.Fd()), "sub", &OpenOptions{Directory: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if fs.Path() != dir+"/sub" {
+		t.Fatalf("unexpected path: %q", fs.Path())
+	}
+	if _, err = fs.SubVolumeID(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenAt(int(d.f.Fd()), "plain", nil); err == nil {
+		t.Fatal("expected an error for a directory that is not a subvolume")
+	}
+}
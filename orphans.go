@@ -0,0 +1,208 @@
+package btrfs
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"unsafe"
+)
+
+// OrphanInode is an inode that was unlinked, but is still kept open by some process
+// (or was not yet cleaned up after a crash). Its space is not freed until then.
+type OrphanInode struct {
+	Root  uint64 // subvolume id
+	Inode uint64
+	Size  uint64 // logical size of the file
+	Bytes uint64 // bytes allocated for the file
+}
+
+// OrphanRoot is a subvolume that was deleted, but not yet cleaned by the kernel.
+type OrphanRoot struct {
+	RootID uint64
+	Bytes  uint64 // bytes still used by the subvolume tree
+}
+
+// DanglingRoot is a subvolume root that is inconsistent with its references.
+type DanglingRoot struct {
+	RootID   uint64
+	ParentID uint64 // parent subvolume id, if known
+	Reason   string
+}
+
+// OrphanReport contains all orphan items found in the filesystem.
+type OrphanReport struct {
+	Inodes   []OrphanInode
+	Roots    []OrphanRoot
+	Dangling []DanglingRoot
+}
+
+// InodeBytes returns the total amount of bytes held by orphan inodes.
+func (r *OrphanReport) InodeBytes() uint64 {
+	var n uint64
+	for _, o := range r.Inodes {
+		n += o.Bytes
+	}
+	return n
+}
+
+// RootBytes returns the total amount of bytes held by deleted subvolumes.
+func (r *OrphanReport) RootBytes() uint64 {
+	var n uint64
+	for _, o := range r.Roots {
+		n += o.Bytes
+	}
+	return n
+}
+
+// FindOrphans scans the filesystem for orphan inodes (unlinked but still open files),
+// deleted subvolumes pending cleanup and dangling subvolume references.
+//
+// It helps to explain the difference between the used space and the output of du
+// without running a full fsck. Requires CAP_SYS_ADMIN.
+func (f *FS) FindOrphans() (*OrphanReport, error) {
+	return findOrphans(f.f)
+}
+
+func findOrphans(mnt *os.File) (*OrphanReport, error) {
+	var (
+		rep     OrphanReport
+		roots   = make(map[objectID]uint32) // root id -> refs
+		parents = make(map[objectID][]objectID)
+		deleted = make(map[objectID]bool)
+	)
+	// collect all subvolume roots and back references
+	err := treeSearch(mnt, btrfs_ioctl_search_key{
+		TreeID:      uint64(rootTreeObjectid),
+		MinObjectID: uint64(fsTreeObjectid),
+		MaxObjectID: uint64(lastFreeObjectid),
+		MinType:     uint32(rootItemKey),
+		MaxType:     uint32(rootBackrefKey),
+		MaxOffset:   maxUint64,
+		MaxTransID:  maxUint64,
+	}, func(r searchResult) error {
+		if r.ObjectID != fsTreeObjectid && r.ObjectID < firstFreeObjectid {
+			return nil
+		}
+		switch r.Type {
+		case rootItemKey:
+			if len(r.Data) < int(unsafe.Sizeof(btrfs_root_item_raw_p1{}))+4 {
+				return fmt.Errorf("root item %v is too small: %d", r.ObjectID, len(r.Data))
+			}
+			// refs are located right after the first part
+			roots[r.ObjectID] = asUint32(r.Data[unsafe.Sizeof(btrfs_root_item_raw_p1{}):])
+		case rootBackrefKey:
+			parents[r.ObjectID] = append(parents[r.ObjectID], objectID(r.Offset))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// deleted subvolumes are recorded as orphan items in the root tree
+	err = treeSearch(mnt, btrfs_ioctl_search_key{
+		TreeID:      uint64(rootTreeObjectid),
+		MinObjectID: uint64(orphanObjectid),
+		MaxObjectID: uint64(orphanObjectid),
+		MinType:     uint32(orphanItemKey),
+		MaxType:     uint32(orphanItemKey),
+		MaxOffset:   maxUint64,
+		MaxTransID:  maxUint64,
+	}, func(r searchResult) error {
+		if r.Type != orphanItemKey {
+			return nil
+		}
+		id := objectID(r.Offset)
+		deleted[id] = true
+		o := OrphanRoot{RootID: uint64(id)}
+		if it, err := readRootItem(mnt, id); err == nil {
+			o.Bytes = it.BytesUsed
+		} else if err != ErrNotFound {
+			return err
+		}
+		rep.Roots = append(rep.Roots, o)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]objectID, 0, len(roots))
+	for id := range roots {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if deleted[id] {
+			continue
+		}
+		if roots[id] == 0 {
+			rep.Dangling = append(rep.Dangling, DanglingRoot{
+				RootID: uint64(id), Reason: "root has no references, but is not queued for deletion",
+			})
+		} else if id != fsTreeObjectid && len(parents[id]) == 0 {
+			rep.Dangling = append(rep.Dangling, DanglingRoot{
+				RootID: uint64(id), Reason: "root is not referenced by any directory",
+			})
+		}
+		inodes, err := findOrphanInodes(mnt, id)
+		if err != nil {
+			return nil, fmt.Errorf("cannot scan subvolume %d: %v", id, err)
+		}
+		rep.Inodes = append(rep.Inodes, inodes...)
+	}
+	for id, refs := range parents {
+		if _, ok := roots[id]; ok || deleted[id] {
+			continue
+		}
+		for _, p := range refs {
+			rep.Dangling = append(rep.Dangling, DanglingRoot{
+				RootID: uint64(id), ParentID: uint64(p), Reason: "reference to a missing root",
+			})
+		}
+	}
+	sort.Slice(rep.Dangling, func(i, j int) bool { return rep.Dangling[i].RootID < rep.Dangling[j].RootID })
+	return &rep, nil
+}
+
+// findOrphanInodes lists orphan items in a given subvolume tree.
+func findOrphanInodes(mnt *os.File, root objectID) ([]OrphanInode, error) {
+	var out []OrphanInode
+	err := treeSearch(mnt, btrfs_ioctl_search_key{
+		TreeID:      uint64(root),
+		MinObjectID: uint64(orphanObjectid),
+		MaxObjectID: uint64(orphanObjectid),
+		MinType:     uint32(orphanItemKey),
+		MaxType:     uint32(orphanItemKey),
+		MaxOffset:   maxUint64,
+		MaxTransID:  maxUint64,
+	}, func(r searchResult) error {
+		if r.Type == orphanItemKey {
+			out = append(out, OrphanInode{Root: uint64(root), Inode: r.Offset})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range out {
+		res, err := treeSearchRaw(mnt, btrfs_ioctl_search_key{
+			TreeID:      uint64(root),
+			MinObjectID: out[i].Inode,
+			MaxObjectID: out[i].Inode,
+			MinType:     uint32(inodeItemKey),
+			MaxType:     uint32(inodeItemKey),
+			MaxOffset:   0,
+			MaxTransID:  maxUint64,
+			NrItems:     1,
+		})
+		if err != nil {
+			return nil, err
+		} else if len(res) == 0 || res[0].Type != inodeItemKey {
+			continue // already cleaned
+		} else if len(res[0].Data) < int(unsafe.Sizeof(btrfs_inode_item_raw{})) {
+			return nil, fmt.Errorf("inode item %v is too small: %d", out[i].Inode, len(res[0].Data))
+		}
+		it := asInodeItem(res[0].Data).Decode()
+		out[i].Size, out[i].Bytes = it.Size, it.NBytes
+	}
+	return out, nil
+}
@@ -0,0 +1,147 @@
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"syscall"
+)
+
+// ErrQuotaDisabled is returned when quota groups are requested, but quotas are not enabled.
+var ErrQuotaDisabled = errors.New("quotas are not enabled")
+
+// QgroupID is an id of a quota group. Level 0 qgroups correspond to subvolumes.
+type QgroupID uint64
+
+// NewQgroupID builds a qgroup id from the level and the id.
+func NewQgroupID(level uint16, id uint64) QgroupID {
+	return QgroupID(uint64(level)<<qgroupLevelShift | id&(1<<qgroupLevelShift-1))
+}
+
+// Level returns the level of the qgroup.
+func (id QgroupID) Level() uint16 { return uint16(uint64(id) >> qgroupLevelShift) }
+
+// ID returns the id of the qgroup within its level. For level 0 it's a subvolume id.
+func (id QgroupID) ID() uint64 { return uint64(id) & (1<<qgroupLevelShift - 1) }
+
+func (id QgroupID) String() string {
+	return fmt.Sprintf("%d/%d", id.Level(), id.ID())
+}
+
+// Qgroup is usage and limits of a quota group.
+type Qgroup struct {
+	ID         QgroupID
+	Generation uint64
+
+	Referenced           uint64 // bytes referenced by the qgroup
+	ReferencedCompressed uint64
+	Exclusive            uint64 // bytes referenced only by the qgroup
+	ExclusiveCompressed  uint64
+
+	MaxReferenced uint64 // limit of referenced bytes, zero if not set
+	MaxExclusive  uint64 // limit of exclusive bytes, zero if not set
+}
+
+const (
+	qgroupLimitMaxRfer = 1 << 0
+	qgroupLimitMaxExcl = 1 << 1
+)
+
+// Qgroups returns usage of all quota groups. It returns ErrQuotaDisabled if quotas are not enabled.
+//
+// Values are updated by the kernel on transaction commits, thus Sync should be called
+// first to get up-to-date values.
+func (f *FS) Qgroups() ([]Qgroup, error) {
+	byID := make(map[QgroupID]*Qgroup)
+	get := func(id QgroupID) *Qgroup {
+		q := byID[id]
+		if q == nil {
+			q = &Qgroup{ID: id}
+			byID[id] = q
+		}
+		return q
+	}
+	err := treeSearch(f.f, btrfs_ioctl_search_key{
+		TreeID:      uint64(quotaTreeObjectid),
+		MinObjectID: 0,
+		MaxObjectID: 0,
+		MinType:     uint32(qgroupInfoKey),
+		MaxType:     uint32(qgroupLimitKey),
+		MaxOffset:   maxUint64,
+		MaxTransID:  maxUint64,
+	}, func(r searchResult) error {
+		switch r.Type {
+		case qgroupInfoKey:
+			if len(r.Data) < 40 {
+				return fmt.Errorf("qgroup info item is too short: %d", len(r.Data))
+			}
+			q := get(QgroupID(r.Offset))
+			q.Generation = order.Uint64(r.Data[0:])
+			q.Referenced = order.Uint64(r.Data[8:])
+			q.ReferencedCompressed = order.Uint64(r.Data[16:])
+			q.Exclusive = order.Uint64(r.Data[24:])
+			q.ExclusiveCompressed = order.Uint64(r.Data[32:])
+		case qgroupLimitKey:
+			if len(r.Data) < 24 {
+				return fmt.Errorf("qgroup limit item is too short: %d", len(r.Data))
+			}
+			q := get(QgroupID(r.Offset))
+			flags := order.Uint64(r.Data[0:])
+			if flags&qgroupLimitMaxRfer != 0 {
+				q.MaxReferenced = order.Uint64(r.Data[8:])
+			}
+			if flags&qgroupLimitMaxExcl != 0 {
+				q.MaxExclusive = order.Uint64(r.Data[16:])
+			}
+		}
+		return nil
+	})
+	if err == syscall.ENOENT {
+		return nil, ErrQuotaDisabled
+	} else if err != nil {
+		return nil, err
+	}
+	out := make([]Qgroup, 0, len(byID))
+	for _, q := range byID {
+		out = append(out, *q)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// SubvolumeQgroup returns usage of a level 0 qgroup of a given subvolume.
+func (f *FS) SubvolumeQgroup(subvol uint64) (*Qgroup, error) {
+	list, err := f.Qgroups()
+	if err != nil {
+		return nil, err
+	}
+	id := NewQgroupID(0, subvol)
+	for i := range list {
+		if list[i].ID == id {
+			return &list[i], nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// EnableQuota enables quota groups on the filesystem. Usage of existing data is accounted
+// by a rescan that runs in the background.
+func (f *FS) EnableQuota() error {
+	return iocQuotaCtl(f.f, &btrfs_ioctl_quota_ctl_args{Cmd: _BTRFS_QUOTA_CTL_ENABLE})
+}
+
+// SetQgroupLimit limits the number of referenced and exclusive bytes of a quota group.
+// Zero value removes the corresponding limit.
+func (f *FS) SetQgroupLimit(id QgroupID, maxReferenced, maxExclusive uint64) error {
+	arg := btrfs_ioctl_qgroup_limit_args{QgroupID: uint64(id)}
+	arg.Lim.Flags = qgroupLimitMaxRfer | qgroupLimitMaxExcl
+	arg.Lim.MaxReferenced, arg.Lim.MaxExclusive = maxReferenced, maxExclusive
+	// the kernel clears the limit if the value is all ones
+	if maxReferenced == 0 {
+		arg.Lim.MaxReferenced = maxUint64
+	}
+	if maxExclusive == 0 {
+		arg.Lim.MaxExclusive = maxUint64
+	}
+	return iocQgroupLimit(f.f, &arg)
+}
@@ -0,0 +1,117 @@
+package btrfs
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// WithQuiescedSnapshot takes an application-consistent snapshot of a subvolume and calls fn with its path.
+//
+// The steps are:
+//
+//   - quiesce is called to bring the application to a consistent on-disk state
+//     (for example, FLUSH TABLES WITH READ LOCK);
+//   - a read-only snapshot is created next to the subvolume;
+//   - release is called right after the snapshot, so the application is blocked
+//     only for the duration of the snapshot creation;
+//   - fn is called with the path of the snapshot, for example to back it up;
+//   - the snapshot is deleted, even if fn fails.
+//
+// Release is called whenever quiesce was called, even if quiesce failed, because
+// it may have been partially applied. Both hooks may be nil. The context is checked before
+// each step; the snapshot itself cannot be interrupted. Note that quiesce must not freeze
+// the filesystem holding the subvolume (fsfreeze), since snapshot creation would block.
+//
+// Errors from quiesce, snapshot and fn take precedence over errors from release
+// and cleanup, which are reported together with them.
+//
+// The snapshot is created and deleted through the filesystem of the subvolume, opened for
+// the call; use FS.WithQuiescedSnapshot to apply a guard and an audit log.
+func WithQuiescedSnapshot(ctx context.Context, subvol string, quiesce func() error, release func() error, fn func(path string) error) error {
+	subvol, err := filepath.Abs(subvol)
+	if err != nil {
+		return err
+	}
+	fs, err := openMount(subvol, false)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	return fs.WithQuiescedSnapshot(ctx, subvol, quiesce, release, fn)
+}
+
+// WithQuiescedSnapshot is like the package-level WithQuiescedSnapshot, but the subvolume
+// is relative to f, and the snapshot is created and deleted through f.
+func (f *FS) WithQuiescedSnapshot(ctx context.Context, subvol string, quiesce func() error, release func() error, fn func(path string) error) error {
+	subvol, err := filepath.Abs(f.resolve(subvol))
+	if err != nil {
+		return err
+	}
+	if ok, err := IsSubVolume(subvol); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("not a subvolume: %s", subvol)
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	snap := filepath.Join(filepath.Dir(subvol),
+		fmt.Sprintf(".%s.quiesced-%d", filepath.Base(subvol), time.Now().UnixNano()))
+	subRel, err := f.rel(subvol)
+	if err != nil {
+		return err
+	}
+	snapRel, err := f.rel(snap)
+	if err != nil {
+		return err
+	}
+
+	err = f.quiescedSnapshot(ctx, subRel, snapRel, quiesce, release)
+	if err != nil {
+		return err
+	}
+	if err = ctx.Err(); err == nil {
+		err = fn(snap)
+	}
+	if err2 := f.DeleteSubVolume(snapRel); err2 != nil {
+		if err == nil {
+			return fmt.Errorf("cannot delete snapshot %s: %v", snap, err2)
+		}
+		return fmt.Errorf("%v (cannot delete snapshot %s: %v)", err, snap, err2)
+	}
+	return err
+}
+
+// quiescedSnapshot creates a read-only snapshot between quiesce and release calls.
+// Paths are relative to f.
+func (f *FS) quiescedSnapshot(ctx context.Context, subvol, snap string, quiesce, release func() error) error {
+	var err error
+	if quiesce != nil {
+		if err = quiesce(); err != nil {
+			err = fmt.Errorf("quiesce failed: %v", err)
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = f.SnapshotSubVolume(subvol, snap, true)
+	}
+	if release != nil {
+		if err2 := release(); err2 != nil {
+			if err == nil {
+				err = fmt.Errorf("release failed: %v", err2)
+				// the snapshot is consistent, but the application is left quiesced;
+				// report it instead of silently using the snapshot
+				if err3 := f.DeleteSubVolume(snap); err3 != nil {
+					err = fmt.Errorf("%v (cannot delete snapshot %s: %v)", err, f.resolve(snap), err3)
+				}
+			} else {
+				err = fmt.Errorf("%v (release failed: %v)", err, err2)
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package btrfs
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimiter limits the bandwidth of a stream with a token bucket: up to burst bytes can be
+// transferred at once, and the bucket is refilled at rate bytes per second.
+// It is safe for concurrent use; streams sharing a limiter share the bandwidth.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter for rate bytes per second. If burst is not set,
+// one second worth of data is allowed.
+func NewRateLimiter(rate, burst int64) *RateLimiter {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &RateLimiter{rate: float64(rate), burst: float64(burst), tokens: float64(burst)}
+}
+
+// WaitN blocks until n bytes can be transferred. Requests larger than the burst are allowed,
+// and are paid for by waiting longer.
+func (l *RateLimiter) WaitN(n int) {
+	if l == nil || n <= 0 || l.rate <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Reader returns a reader that reads from r at the rate of the limiter.
+func (l *RateLimiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, l: l}
+}
+
+// Writer returns a writer that writes to w at the rate of the limiter.
+func (l *RateLimiter) Writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &limitedWriter{w: w, l: l}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *RateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if max := int(r.l.burst); len(p) > max && max > 0 {
+		p = p[:max] // keep the stream smooth
+	}
+	n, err := r.r.Read(p)
+	r.l.WaitN(n)
+	return n, err
+}
+
+type limitedWriter struct {
+	w io.Writer
+	l *RateLimiter
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	w.l.WaitN(len(p))
+	return w.w.Write(p)
+}
+
+var (
+	sendRateLimit    atomic.Value // *RateLimiter
+	receiveRateLimit atomic.Value // *RateLimiter
+)
+
+// SetSendRateLimit limits the bandwidth of all following Send calls. Nil removes the limit.
+func SetSendRateLimit(l *RateLimiter) {
+	sendRateLimit.Store(l)
+}
+
+// SetReceiveRateLimit limits the bandwidth of all following Receive calls. Nil removes the limit.
+func SetReceiveRateLimit(l *RateLimiter) {
+	receiveRateLimit.Store(l)
+}
+
+func loadRateLimit(v *atomic.Value) *RateLimiter {
+	l, _ := v.Load().(*RateLimiter)
+	return l
+}
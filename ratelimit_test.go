@@ -0,0 +1,48 @@
+package btrfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	const (
+		rate  = 1 << 20
+		burst = 100 << 10
+		size  = 300 << 10
+	)
+	l := NewRateLimiter(rate, burst)
+	start := time.Now()
+	w := l.Writer(ioutil.Discard)
+	for i := 0; i < size/(10<<10); i++ {
+		if _, err := w.Write(make([]byte, 10<<10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// burst is free, the rest is limited
+	exp := time.Duration(float64(size-burst) / rate * float64(time.Second))
+	if dt := time.Since(start); dt < exp*9/10 || dt > exp*5 {
+		t.Fatalf("unexpected duration: %v, expected ~%v", dt, exp)
+	}
+
+	l = NewRateLimiter(rate, burst)
+	start = time.Now()
+	n, err := io.Copy(ioutil.Discard, l.Reader(bytes.NewReader(make([]byte, size))))
+	if err != nil {
+		t.Fatal(err)
+	} else if n != size {
+		t.Fatalf("unexpected size: %d", n)
+	}
+	if dt := time.Since(start); dt < exp*9/10 || dt > exp*5 {
+		t.Fatalf("unexpected duration: %v, expected ~%v", dt, exp)
+	}
+
+	// nil limiter does nothing
+	var nl *RateLimiter
+	if r := bytes.NewReader(nil); nl.Reader(r) != io.Reader(r) {
+		t.Fatal("expected the same reader")
+	}
+}
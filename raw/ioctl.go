@@ -0,0 +1,330 @@
+package raw
+
+import (
+	"os"
+	"unsafe"
+
+	"github.com/dennwc/ioctl"
+)
+
+// Request numbers of btrfs ioctls.
+var (
+	IocSnapCreate           = ioctl.IOW(Magic, 1, unsafe.Sizeof(VolArgs{}))
+	IocDefrag               = ioctl.IOW(Magic, 2, unsafe.Sizeof(VolArgs{}))
+	IocResize               = ioctl.IOW(Magic, 3, unsafe.Sizeof(VolArgs{}))
+	IocScanDev              = ioctl.IOW(Magic, 4, unsafe.Sizeof(VolArgs{}))
+	IocSync                 = ioctl.IO(Magic, 8)
+	IocClone                = ioctl.IOW(Magic, 9, 4)
+	IocAddDev               = ioctl.IOW(Magic, 10, unsafe.Sizeof(VolArgs{}))
+	IocRmDev                = ioctl.IOW(Magic, 11, unsafe.Sizeof(VolArgs{}))
+	IocCloneRange           = ioctl.IOW(Magic, 13, unsafe.Sizeof(CloneRangeArgs{}))
+	IocSubvolCreate         = ioctl.IOW(Magic, 14, unsafe.Sizeof(VolArgs{}))
+	IocSnapDestroy          = ioctl.IOW(Magic, 15, unsafe.Sizeof(VolArgs{}))
+	IocDefragRange          = ioctl.IOW(Magic, 16, unsafe.Sizeof(DefragRangeArgs{}))
+	IocTreeSearch           = ioctl.IOWR(Magic, 17, unsafe.Sizeof(SearchArgs{}))
+	IocTreeSearchV2         = ioctl.IOWR(Magic, 17, unsafe.Sizeof(SearchArgsV2{}))
+	IocInoLookup            = ioctl.IOWR(Magic, 18, unsafe.Sizeof(InoLookupArgs{}))
+	IocDefaultSubvol        = ioctl.IOW(Magic, 19, 8)
+	IocSpaceInfo            = ioctl.IOWR(Magic, 20, unsafe.Sizeof(SpaceArgs{}))
+	IocStartSync            = ioctl.IOR(Magic, 24, 8)
+	IocWaitSync             = ioctl.IOW(Magic, 22, 8)
+	IocSnapCreateV2         = ioctl.IOW(Magic, 23, unsafe.Sizeof(VolArgsV2{}))
+	IocSubvolCreateV2       = ioctl.IOW(Magic, 24, unsafe.Sizeof(VolArgsV2{}))
+	IocSubvolGetflags       = ioctl.IOR(Magic, 25, 8)
+	IocSubvolSetflags       = ioctl.IOW(Magic, 26, 8)
+	IocScrub                = ioctl.IOWR(Magic, 27, unsafe.Sizeof(ScrubArgs{}))
+	IocScrubCancel          = ioctl.IO(Magic, 28)
+	IocScrubProgress        = ioctl.IOWR(Magic, 29, unsafe.Sizeof(ScrubArgs{}))
+	IocDevInfo              = ioctl.IOWR(Magic, 30, unsafe.Sizeof(DevInfoArgs{}))
+	IocFSInfo               = ioctl.IOR(Magic, 31, unsafe.Sizeof(FSInfoArgs{}))
+	IocBalanceV2            = ioctl.IOWR(Magic, 32, unsafe.Sizeof(BalanceIoctlArgs{}))
+	IocBalanceCtl           = ioctl.IOW(Magic, 33, 4)
+	IocBalanceProgress      = ioctl.IOR(Magic, 34, unsafe.Sizeof(BalanceIoctlArgs{}))
+	IocInoPaths             = ioctl.IOWR(Magic, 35, unsafe.Sizeof(InoPathArgs{}))
+	IocLogicalIno           = ioctl.IOWR(Magic, 36, unsafe.Sizeof(LogicalInoArgs{}))
+	IocSetReceivedSubvol    = ioctl.IOWR(Magic, 37, unsafe.Sizeof(ReceivedSubvolArgs{}))
+	IocSend                 = ioctl.IOW(Magic, 38, unsafe.Sizeof(SendArgs{}))
+	IocDevicesReady         = ioctl.IOR(Magic, 39, unsafe.Sizeof(VolArgs{}))
+	IocQuotaCtl             = ioctl.IOWR(Magic, 40, unsafe.Sizeof(QuotaCtlArgs{}))
+	IocQgroupAssign         = ioctl.IOW(Magic, 41, unsafe.Sizeof(QgroupAssignArgs{}))
+	IocQgroupCreate         = ioctl.IOW(Magic, 42, unsafe.Sizeof(QgroupCreateArgs{}))
+	IocQgroupLimit          = ioctl.IOR(Magic, 43, unsafe.Sizeof(QgroupLimitArgs{}))
+	IocQuotaRescan          = ioctl.IOW(Magic, 44, unsafe.Sizeof(QuotaRescanArgs{}))
+	IocQuotaRescanStatus    = ioctl.IOR(Magic, 45, unsafe.Sizeof(QuotaRescanArgs{}))
+	IocQuotaRescanWait      = ioctl.IO(Magic, 46)
+	IocGetFslabel           = ioctl.IOR(Magic, 49, unsafe.Sizeof([LabelSize]byte{}))
+	IocSetFslabel           = ioctl.IOW(Magic, 50, unsafe.Sizeof([LabelSize]byte{}))
+	IocGetDevStats          = ioctl.IOWR(Magic, 52, unsafe.Sizeof(GetDevStatsArgs{}))
+	IocDevReplace           = ioctl.IOWR(Magic, 53, unsafe.Sizeof(DevReplaceArgs{}))
+	IocFileExtentSame       = ioctl.IOWR(Magic, 54, unsafe.Sizeof(SameArgs{}))
+	IocGetFeatures          = ioctl.IOR(Magic, 57, unsafe.Sizeof(FeatureFlags{}))
+	IocSetFeatures          = ioctl.IOW(Magic, 57, unsafe.Sizeof([2]FeatureFlags{}))
+	IocGetSupportedFeatures = ioctl.IOR(Magic, 57, unsafe.Sizeof([3]FeatureFlags{}))
+	IocLogicalInoV2         = ioctl.IOWR(Magic, 59, unsafe.Sizeof(LogicalInoArgs{}))
+	IocEncodedWrite         = ioctl.IOW(Magic, 64, unsafe.Sizeof(EncodedIOArgs{}))
+)
+
+// SnapCreate creates a snapshot of a subvolume with an open descriptor Fd in the directory.
+func SnapCreate(f *os.File, arg *VolArgs) error {
+	return ioctl.Do(f, IocSnapCreate, arg)
+}
+
+// Defrag defragments a file or the metadata of a subvolume.
+func Defrag(f *os.File, arg *VolArgs) error {
+	return ioctl.Do(f, IocDefrag, arg)
+}
+
+// Resize resizes a device of the filesystem; Name is "[devid:]size".
+func Resize(f *os.File, arg *VolArgs) error {
+	return ioctl.Do(f, IocResize, arg)
+}
+
+// ScanDev registers a device; it must be called on /dev/btrfs-control.
+func ScanDev(f *os.File, arg *VolArgs) error {
+	return ioctl.Do(f, IocScanDev, arg)
+}
+
+// Sync commits the current transaction.
+func Sync(f *os.File) error {
+	return ioctl.Do(f, IocSync, nil)
+}
+
+// Clone clones the whole file src into dst.
+func Clone(dst, src *os.File) error {
+	return ioctl.Ioctl(dst, IocClone, src.Fd())
+}
+
+// AddDev adds a device with a given path to the filesystem.
+func AddDev(f *os.File, arg *VolArgs) error {
+	return ioctl.Do(f, IocAddDev, arg)
+}
+
+// RmDev removes a device with a given path from the filesystem.
+func RmDev(f *os.File, arg *VolArgs) error {
+	return ioctl.Do(f, IocRmDev, arg)
+}
+
+// CloneRange clones a range of the file SrcFd into the file.
+func CloneRange(f *os.File, arg *CloneRangeArgs) error {
+	return ioctl.Do(f, IocCloneRange, arg)
+}
+
+// SubvolCreate creates a subvolume with a given name in the directory.
+func SubvolCreate(f *os.File, arg *VolArgs) error {
+	return ioctl.Do(f, IocSubvolCreate, arg)
+}
+
+// SnapDestroy deletes a subvolume with a given name in the directory.
+func SnapDestroy(f *os.File, arg *VolArgs) error {
+	return ioctl.Do(f, IocSnapDestroy, arg)
+}
+
+// DefragRange defragments a range of a file.
+func DefragRange(f *os.File, arg *DefragRangeArgs) error {
+	return ioctl.Do(f, IocDefragRange, arg)
+}
+
+// TreeSearch searches for items in a tree.
+func TreeSearch(f *os.File, arg *SearchArgs) error {
+	return ioctl.Do(f, IocTreeSearch, arg)
+}
+
+// TreeSearchV2 is like TreeSearch, but the result buffer follows the arguments, and can be larger than 4K.
+func TreeSearchV2(f *os.File, arg *SearchArgsV2) error {
+	return ioctl.Do(f, IocTreeSearchV2, arg)
+}
+
+// InoLookup resolves a path of an inode relative to the root of its subvolume.
+func InoLookup(f *os.File, arg *InoLookupArgs) error {
+	return ioctl.Do(f, IocInoLookup, arg)
+}
+
+// DefaultSubvol sets the default subvolume of the filesystem.
+func DefaultSubvol(f *os.File, arg *uint64) error {
+	return ioctl.Do(f, IocDefaultSubvol, arg)
+}
+
+// GetSpaceInfo returns space usage by block group type. See SpaceArgs for the buffer layout.
+func GetSpaceInfo(f *os.File, arg *SpaceArgs) error {
+	return ioctl.Do(f, IocSpaceInfo, arg)
+}
+
+// StartSync starts a transaction commit and returns its id.
+func StartSync(f *os.File, arg *uint64) error {
+	return ioctl.Do(f, IocStartSync, arg)
+}
+
+// WaitSync waits for a transaction with a given id to commit; zero means the current one.
+func WaitSync(f *os.File, arg *uint64) error {
+	return ioctl.Do(f, IocWaitSync, arg)
+}
+
+// SnapCreateV2 is like SnapCreate, but supports read-only snapshots and qgroup inheritance.
+func SnapCreateV2(f *os.File, arg *VolArgsV2) error {
+	return ioctl.Do(f, IocSnapCreateV2, arg)
+}
+
+// SubvolCreateV2 is like SubvolCreate, but supports qgroup inheritance.
+func SubvolCreateV2(f *os.File, arg *VolArgsV2) error {
+	return ioctl.Do(f, IocSubvolCreateV2, arg)
+}
+
+// SubvolGetflags returns flags of a subvolume.
+func SubvolGetflags(f *os.File, arg *uint64) error {
+	return ioctl.Do(f, IocSubvolGetflags, arg)
+}
+
+// SubvolSetflags sets flags of a subvolume.
+func SubvolSetflags(f *os.File, arg *uint64) error {
+	return ioctl.Do(f, IocSubvolSetflags, arg)
+}
+
+// Scrub scrubs a device. It blocks until the scrub is finished or canceled.
+func Scrub(f *os.File, arg *ScrubArgs) error {
+	return ioctl.Do(f, IocScrub, arg)
+}
+
+// ScrubCancel cancels all running scrubs of the filesystem.
+func ScrubCancel(f *os.File) error {
+	return ioctl.Do(f, IocScrubCancel, nil)
+}
+
+// GetScrubProgress returns the progress of a running scrub of a device.
+func GetScrubProgress(f *os.File, arg *ScrubArgs) error {
+	return ioctl.Do(f, IocScrubProgress, arg)
+}
+
+// DevInfo returns information about a device of the filesystem.
+func DevInfo(f *os.File, arg *DevInfoArgs) error {
+	return ioctl.Do(f, IocDevInfo, arg)
+}
+
+// FSInfo returns information about the filesystem.
+func FSInfo(f *os.File, arg *FSInfoArgs) error {
+	return ioctl.Do(f, IocFSInfo, arg)
+}
+
+// BalanceV2 starts or resumes a balance. It blocks until the balance is finished, paused or canceled.
+func BalanceV2(f *os.File, arg *BalanceIoctlArgs) error {
+	return ioctl.Do(f, IocBalanceV2, arg)
+}
+
+// BalanceCtl pauses or cancels a running balance.
+func BalanceCtl(f *os.File, cmd int32) error {
+	return ioctl.Ioctl(f, IocBalanceCtl, uintptr(cmd))
+}
+
+// GetBalanceProgress returns the progress of a running balance.
+func GetBalanceProgress(f *os.File, arg *BalanceIoctlArgs) error {
+	return ioctl.Do(f, IocBalanceProgress, arg)
+}
+
+// InoPaths resolves paths of an inode.
+func InoPaths(f *os.File, arg *InoPathArgs) error {
+	return ioctl.Do(f, IocInoPaths, arg)
+}
+
+// LogicalIno resolves inodes referencing a logical address.
+func LogicalIno(f *os.File, arg *LogicalInoArgs) error {
+	return ioctl.Do(f, IocLogicalIno, arg)
+}
+
+// SetReceivedSubvol marks a subvolume as received.
+func SetReceivedSubvol(f *os.File, arg *ReceivedSubvolArgs) error {
+	return ioctl.Do(f, IocSetReceivedSubvol, arg)
+}
+
+// Send writes a send stream of a subvolume to SendFd.
+func Send(f *os.File, arg *SendArgs) error {
+	return ioctl.Do(f, IocSend, arg)
+}
+
+// DevicesReady checks if all devices of the filesystem with a given device are registered; it must be called on /dev/btrfs-control.
+func DevicesReady(f *os.File, arg *VolArgs) error {
+	return ioctl.Do(f, IocDevicesReady, arg)
+}
+
+// QuotaCtl enables or disables quotas.
+func QuotaCtl(f *os.File, arg *QuotaCtlArgs) error {
+	return ioctl.Do(f, IocQuotaCtl, arg)
+}
+
+// QgroupAssign assigns a qgroup to a parent qgroup, or removes the relation.
+func QgroupAssign(f *os.File, arg *QgroupAssignArgs) error {
+	return ioctl.Do(f, IocQgroupAssign, arg)
+}
+
+// QgroupCreate creates or removes a qgroup.
+func QgroupCreate(f *os.File, arg *QgroupCreateArgs) error {
+	return ioctl.Do(f, IocQgroupCreate, arg)
+}
+
+// SetQgroupLimit sets limits of a qgroup.
+func SetQgroupLimit(f *os.File, arg *QgroupLimitArgs) error {
+	return ioctl.Do(f, IocQgroupLimit, arg)
+}
+
+// QuotaRescan starts a rescan of quotas.
+func QuotaRescan(f *os.File, arg *QuotaRescanArgs) error {
+	return ioctl.Do(f, IocQuotaRescan, arg)
+}
+
+// QuotaRescanStatus returns the status of a running quota rescan.
+func QuotaRescanStatus(f *os.File, arg *QuotaRescanArgs) error {
+	return ioctl.Do(f, IocQuotaRescanStatus, arg)
+}
+
+// QuotaRescanWait waits for a running quota rescan to finish.
+func QuotaRescanWait(f *os.File) error {
+	return ioctl.Do(f, IocQuotaRescanWait, nil)
+}
+
+// GetFslabel returns the label of the filesystem.
+func GetFslabel(f *os.File, arg *[LabelSize]byte) error {
+	return ioctl.Do(f, IocGetFslabel, arg)
+}
+
+// SetFslabel sets the label of the filesystem.
+func SetFslabel(f *os.File, arg *[LabelSize]byte) error {
+	return ioctl.Do(f, IocSetFslabel, arg)
+}
+
+// GetDevStats returns I/O error statistics of a device.
+func GetDevStats(f *os.File, arg *GetDevStatsArgs) error {
+	return ioctl.Do(f, IocGetDevStats, arg)
+}
+
+// DevReplace starts, cancels a device replace, or returns its status.
+func DevReplace(f *os.File, arg *DevReplaceArgs) error {
+	return ioctl.Do(f, IocDevReplace, arg)
+}
+
+// FileExtentSame deduplicates a range of the file with ranges of other files. See SameArgs for the buffer layout.
+func FileExtentSame(f *os.File, arg *SameArgs) error {
+	return ioctl.Do(f, IocFileExtentSame, arg)
+}
+
+// GetFeatures returns features enabled on the filesystem.
+func GetFeatures(f *os.File, arg *FeatureFlags) error {
+	return ioctl.Do(f, IocGetFeatures, arg)
+}
+
+// SetFeatures changes features of the filesystem: the first value are the features to set, the second one is a mask.
+func SetFeatures(f *os.File, arg *[2]FeatureFlags) error {
+	return ioctl.Do(f, IocSetFeatures, arg)
+}
+
+// GetSupportedFeatures returns features supported by the kernel: supported, safe to set and safe to clear.
+func GetSupportedFeatures(f *os.File, arg *[3]FeatureFlags) error {
+	return ioctl.Do(f, IocGetSupportedFeatures, arg)
+}
+
+// LogicalInoV2 is like LogicalIno, but supports flags.
+func LogicalInoV2(f *os.File, arg *LogicalInoArgs) error {
+	return ioctl.Do(f, IocLogicalInoV2, arg)
+}
+
+// EncodedWrite writes encoded (compressed) data to a file.
+func EncodedWrite(f *os.File, arg *EncodedIOArgs) error {
+	return ioctl.Do(f, IocEncodedWrite, arg)
+}
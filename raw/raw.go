@@ -0,0 +1,499 @@
+// Package raw exposes btrfs ioctls and their arguments as defined by the kernel (linux/btrfs.h).
+//
+// It's intended for ioctls or flags that are not covered by the high-level API of the btrfs
+// package yet. Structures have the same memory layout as their C counterparts, fields follow
+// the kernel names in Go style. Names of types, fields, request numbers and functions
+// in this package are stable.
+//
+// Arguments are passed to the kernel as-is: the caller is responsible for setting flags,
+// buffer sizes and for interpreting the results. Most ioctls require CAP_SYS_ADMIN.
+package raw
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Magic is the type of all btrfs ioctl request numbers.
+const Magic = 0x94
+
+const (
+	// VolNameMax is the maximal length of a name in VolArgs.
+	VolNameMax = 4087
+	// SubvolNameMax is the maximal length of a name in VolArgsV2.
+	SubvolNameMax = 4039
+	// DevicePathNameMax is the maximal length of a device path.
+	DevicePathNameMax = 1024
+	// InoLookupPathMax is the size of the name buffer of InoLookupArgs.
+	InoLookupPathMax = 4080
+	// LabelSize is the size of the filesystem label buffer.
+	LabelSize = 256
+	// SearchArgsBufSize is the size of the result buffer of SearchArgs.
+	SearchArgsBufSize = 4096 - unsafe.Sizeof(SearchKey{})
+	// MaxDedupeLen is the maximal length of a single FileExtentSame request.
+	MaxDedupeLen = 16 * 1024 * 1024
+)
+
+// UUID is an uuid of a filesystem, device or subvolume.
+type UUID [16]byte
+
+// VolArgs is struct btrfs_ioctl_vol_args.
+type VolArgs struct {
+	Fd   int64
+	Name [VolNameMax + 1]byte
+}
+
+// SetName sets a zero-terminated name.
+func (a *VolArgs) SetName(name string) {
+	n := copy(a.Name[:VolNameMax], name)
+	a.Name[n] = 0
+}
+
+// Flags of VolArgsV2.
+const (
+	SubvolRdonly        = 1 << 1 // BTRFS_SUBVOL_RDONLY
+	SubvolQgroupInherit = 1 << 2 // BTRFS_SUBVOL_QGROUP_INHERIT
+	SubvolSpecByID      = 1 << 4 // BTRFS_SUBVOL_SPEC_BY_ID
+)
+
+// QgroupLimit is struct btrfs_qgroup_limit.
+type QgroupLimit struct {
+	Flags         uint64 // QgroupLimit* flags
+	MaxReferenced uint64
+	MaxExclusive  uint64
+	RsvReferenced uint64
+	RsvExclusive  uint64
+}
+
+// Flags of QgroupLimit.
+const (
+	QgroupLimitMaxRfer = 1 << 0
+	QgroupLimitMaxExcl = 1 << 1
+	QgroupLimitRsvRfer = 1 << 2
+	QgroupLimitRsvExcl = 1 << 3
+)
+
+// QgroupInherit is struct btrfs_qgroup_inherit. It's followed by the array
+// of NumQgroups + 2*NumRefCopies + 2*NumExclCopies qgroup ids.
+type QgroupInherit struct {
+	Flags         uint64
+	NumQgroups    uint64
+	NumRefCopies  uint64
+	NumExclCopies uint64
+	Lim           QgroupLimit
+}
+
+// QgroupLimitArgs is struct btrfs_ioctl_qgroup_limit_args.
+type QgroupLimitArgs struct {
+	QgroupID uint64
+	Lim      QgroupLimit
+}
+
+// VolArgsV2 is struct btrfs_ioctl_vol_args_v2.
+type VolArgsV2 struct {
+	Fd      int64
+	TransID uint64
+	Flags   uint64 // Subvol* flags
+	// Size is the size of QgroupInherit, if SubvolQgroupInherit is set.
+	Size          uint64
+	QgroupInherit *QgroupInherit
+	_             [2]uint64
+	// Name is a zero-terminated name; it's used as SubvolID if SubvolSpecByID is set.
+	Name [SubvolNameMax + 1]byte
+}
+
+// SetName sets a zero-terminated name.
+func (a *VolArgsV2) SetName(name string) {
+	n := copy(a.Name[:SubvolNameMax], name)
+	a.Name[n] = 0
+}
+
+// ScrubProgress is struct btrfs_scrub_progress.
+type ScrubProgress struct {
+	DataExtentsScrubbed uint64
+	TreeExtentsScrubbed uint64
+	DataBytesScrubbed   uint64
+	TreeBytesScrubbed   uint64
+	ReadErrors          uint64
+	CsumErrors          uint64
+	VerifyErrors        uint64
+	NoCsum              uint64
+	CsumDiscards        uint64
+	SuperErrors         uint64
+	MallocErrors        uint64
+	UncorrectableErrors uint64
+	CorrectedErrors     uint64
+	LastPhysical        uint64
+	UnverifiedErrors    uint64
+}
+
+// Flags of ScrubArgs.
+const (
+	ScrubReadonly = 1 << 0
+)
+
+// ScrubArgs is struct btrfs_ioctl_scrub_args.
+type ScrubArgs struct {
+	DevID    uint64
+	Start    uint64
+	End      uint64
+	Flags    uint64 // Scrub* flags
+	Progress ScrubProgress
+	_        [1024 - 4*8 - unsafe.Sizeof(ScrubProgress{})]byte
+}
+
+// Commands of DevReplaceArgs.
+const (
+	DevReplaceCmdStart  = 0
+	DevReplaceCmdStatus = 1
+	DevReplaceCmdCancel = 2
+)
+
+// DevReplaceStartParams is the start variant of btrfs_ioctl_dev_replace_args.
+type DevReplaceStartParams struct {
+	SrcDevID                  uint64 // if zero, SrcDevName is used
+	ContReadingFromSrcdevMode uint64
+	SrcDevName                [DevicePathNameMax + 1]byte
+	TgtDevName                [DevicePathNameMax + 1]byte
+}
+
+// DevReplaceStatusParams is the status variant of btrfs_ioctl_dev_replace_args.
+type DevReplaceStatusParams struct {
+	ReplaceState               uint64
+	Progress1000               uint64 // 0 <= x <= 1000
+	TimeStarted                uint64 // seconds since 1-Jan-1970
+	TimeStopped                uint64 // seconds since 1-Jan-1970
+	NumWriteErrors             uint64
+	NumUncorrectableReadErrors uint64
+}
+
+// DevReplaceArgs is struct btrfs_ioctl_dev_replace_args with the start parameters.
+type DevReplaceArgs struct {
+	Cmd    uint64 // DevReplaceCmd*
+	Result uint64
+	Start  DevReplaceStartParams
+	_      [64]uint64
+}
+
+// Status returns status parameters, which share memory with start parameters.
+func (a *DevReplaceArgs) Status() *DevReplaceStatusParams {
+	return (*DevReplaceStatusParams)(unsafe.Pointer(&a.Start))
+}
+
+// DevInfoArgs is struct btrfs_ioctl_dev_info_args.
+type DevInfoArgs struct {
+	DevID      uint64
+	UUID       UUID
+	BytesUsed  uint64
+	TotalBytes uint64
+	_          [379]uint64
+	Path       [DevicePathNameMax]byte
+}
+
+// Flags of FSInfoArgs, requesting optional fields.
+const (
+	FSInfoFlagCsumInfo     = 1 << 0
+	FSInfoFlagGeneration   = 1 << 1
+	FSInfoFlagMetadataUUID = 1 << 2
+)
+
+// FSInfoArgs is struct btrfs_ioctl_fs_info_args.
+type FSInfoArgs struct {
+	MaxID          uint64
+	NumDevices     uint64
+	FSID           UUID
+	NodeSize       uint32
+	SectorSize     uint32
+	CloneAlignment uint32
+	CsumType       uint16
+	CsumSize       uint16
+	Flags          uint64 // FSInfoFlag*
+	Generation     uint64
+	MetadataUUID   UUID
+	_              [118 * 8]byte
+}
+
+// FeatureFlags is struct btrfs_ioctl_feature_flags.
+type FeatureFlags struct {
+	Compat   uint64
+	CompatRO uint64
+	Incompat uint64
+}
+
+// BalanceArgs is struct btrfs_balance_args.
+type BalanceArgs struct {
+	Profiles uint64
+	// Usage is either a single value, or min and max (BTRFS_BALANCE_ARGS_USAGE_RANGE).
+	Usage      [8]byte
+	DevID      uint64
+	PStart     uint64
+	PEnd       uint64
+	VStart     uint64
+	VEnd       uint64
+	Target     uint64
+	Flags      uint64
+	Limit      [8]byte // see Usage
+	StripesMin uint32
+	StripesMax uint32
+	_          [48]byte
+}
+
+// BalanceProgress is struct btrfs_balance_progress.
+type BalanceProgress struct {
+	Expected   uint64
+	Considered uint64
+	Completed  uint64
+}
+
+// Commands of BalanceCtl.
+const (
+	BalanceCtlPause  = 1
+	BalanceCtlCancel = 2
+)
+
+// BalanceIoctlArgs is struct btrfs_ioctl_balance_args.
+type BalanceIoctlArgs struct {
+	Flags uint64
+	State uint64
+	Data  BalanceArgs
+	Meta  BalanceArgs
+	Sys   BalanceArgs
+	Stat  BalanceProgress
+	_     [72 * 8]byte
+}
+
+// InoLookupArgs is struct btrfs_ioctl_ino_lookup_args.
+type InoLookupArgs struct {
+	TreeID   uint64
+	ObjectID uint64
+	Name     [InoLookupPathMax]byte
+}
+
+// SearchKey is struct btrfs_ioctl_search_key. Keys returned are >= min and <= max.
+type SearchKey struct {
+	TreeID      uint64 // zero is the tree of tree roots
+	MinObjectID uint64
+	MaxObjectID uint64
+	MinOffset   uint64
+	MaxOffset   uint64
+	MinTransID  uint64
+	MaxTransID  uint64
+	MinType     uint32
+	MaxType     uint32
+	NrItems     uint32 // in: max number of items; out: number of returned items
+	_           [36]byte
+}
+
+// SearchHeader is struct btrfs_ioctl_search_header. It precedes each item in the search buffer.
+type SearchHeader struct {
+	TransID  uint64
+	ObjectID uint64
+	Offset   uint64
+	Type     uint32
+	Len      uint32
+}
+
+// SearchArgs is struct btrfs_ioctl_search_args.
+type SearchArgs struct {
+	Key SearchKey
+	Buf [SearchArgsBufSize]byte
+}
+
+// SearchArgsV2 is struct btrfs_ioctl_search_args_v2. It's followed by a buffer of BufSize bytes.
+type SearchArgsV2 struct {
+	Key     SearchKey
+	BufSize uint64
+}
+
+// CloneRangeArgs is struct btrfs_ioctl_clone_range_args.
+// With SrcLength of zero, the range from SrcOffset to the end of file is cloned.
+type CloneRangeArgs struct {
+	SrcFd      int64
+	SrcOffset  uint64
+	SrcLength  uint64
+	DestOffset uint64
+}
+
+// SameDataDiffers is the status of SameExtentInfo when the data is not the same.
+const SameDataDiffers = 1
+
+// SameExtentInfo is struct btrfs_ioctl_same_extent_info.
+type SameExtentInfo struct {
+	Fd            int64
+	LogicalOffset uint64
+	BytesDeduped  uint64
+	Status        int32 // zero on success, negative errno, or SameDataDiffers
+	_             uint32
+}
+
+// SameArgs is struct btrfs_ioctl_same_args. It's followed by DestCount of SameExtentInfo.
+type SameArgs struct {
+	LogicalOffset uint64
+	Length        uint64
+	DestCount     uint16
+	_             [6]byte
+}
+
+// Flags of DefragRangeArgs.
+const (
+	DefragRangeCompress = 1
+	DefragRangeStartIO  = 2
+)
+
+// DefragRangeArgs is struct btrfs_ioctl_defrag_range_args.
+type DefragRangeArgs struct {
+	Start        uint64
+	Len          uint64 // (u64)-1 means all
+	Flags        uint64 // DefragRange*
+	ExtentThresh uint32
+	CompressType uint32
+	_            [16]byte
+}
+
+// SpaceInfo is struct btrfs_ioctl_space_info.
+type SpaceInfo struct {
+	Flags      uint64
+	TotalBytes uint64
+	UsedBytes  uint64
+}
+
+// SpaceArgs is struct btrfs_ioctl_space_args. It's followed by SpaceSlots of SpaceInfo.
+type SpaceArgs struct {
+	SpaceSlots  uint64
+	TotalSpaces uint64
+}
+
+// DataContainer is struct btrfs_data_container. It's followed by ElemCnt values.
+type DataContainer struct {
+	BytesLeft    uint32
+	BytesMissing uint32
+	ElemCnt      uint32
+	ElemMissed   uint32
+}
+
+// InoPathArgs is struct btrfs_ioctl_ino_path_args.
+type InoPathArgs struct {
+	Inum   uint64
+	Size   uint64
+	_      [32]byte
+	FSPath uint64 // address of DataContainer
+}
+
+// Flags of LogicalInoArgs.
+const (
+	LogicalInoArgsIgnoreOffset = 1 << 0
+)
+
+// LogicalInoArgs is struct btrfs_ioctl_logical_ino_args.
+type LogicalInoArgs struct {
+	Logical uint64
+	Size    uint64
+	_       [24]byte
+	Flags   uint64 // LogicalInoArgs* flags, v2 only
+	Inodes  uint64 // address of DataContainer
+}
+
+// Indexes of GetDevStats values.
+const (
+	DevStatWriteErrs = iota
+	DevStatReadErrs
+	DevStatFlushErrs
+	DevStatCorruptionErrs
+	DevStatGenerationErrs
+	DevStatValuesMax
+)
+
+// DevStatsReset is a flag of GetDevStatsArgs to reset statistics after reading.
+const DevStatsReset = 1 << 0
+
+// GetDevStatsArgs is struct btrfs_ioctl_get_dev_stats.
+type GetDevStatsArgs struct {
+	DevID   uint64
+	NrItems uint64
+	Flags   uint64
+	Values  [DevStatValuesMax]uint64
+	_       [128 - 2 - DevStatValuesMax]uint64
+}
+
+// Commands of QuotaCtlArgs.
+const (
+	QuotaCtlEnable  = 1
+	QuotaCtlDisable = 2
+)
+
+// QuotaCtlArgs is struct btrfs_ioctl_quota_ctl_args.
+type QuotaCtlArgs struct {
+	Cmd    uint64
+	Status uint64
+}
+
+// QuotaRescanArgs is struct btrfs_ioctl_quota_rescan_args.
+type QuotaRescanArgs struct {
+	Flags    uint64
+	Progress uint64
+	_        [6]uint64
+}
+
+// QgroupAssignArgs is struct btrfs_ioctl_qgroup_assign_args.
+type QgroupAssignArgs struct {
+	Assign uint64
+	Src    uint64
+	Dst    uint64
+}
+
+// QgroupCreateArgs is struct btrfs_ioctl_qgroup_create_args.
+type QgroupCreateArgs struct {
+	Create   uint64
+	QgroupID uint64
+}
+
+// Timespec is struct btrfs_ioctl_timespec.
+type Timespec struct {
+	Sec  uint64
+	Nsec uint32
+}
+
+// ReceivedSubvolArgs is struct btrfs_ioctl_received_subvol_args.
+type ReceivedSubvolArgs struct {
+	UUID     UUID
+	STransID uint64
+	RTransID uint64
+	STime    Timespec
+	RTime    Timespec
+	Flags    uint64
+	_        [16]uint64
+}
+
+// Flags of SendArgs.
+const (
+	SendFlagNoFileData       = 0x1
+	SendFlagOmitStreamHeader = 0x2
+	SendFlagOmitEndCmd       = 0x4
+	SendFlagVersion          = 0x8
+	SendFlagCompressed       = 0x10
+)
+
+// SendArgs is struct btrfs_ioctl_send_args.
+type SendArgs struct {
+	SendFd            int64
+	CloneSourcesCount uint64
+	CloneSources      *uint64
+	ParentRoot        uint64
+	Flags             uint64 // SendFlag*
+	Version           uint32 // if SendFlagVersion is set
+	_                 [28]byte
+}
+
+// EncodedIOArgs is struct btrfs_ioctl_encoded_io_args.
+type EncodedIOArgs struct {
+	Iov             *syscall.Iovec
+	IovCnt          uint64
+	Offset          int64
+	Flags           uint64
+	Len             uint64
+	UnencodedLen    uint64
+	UnencodedOffset uint64
+	Compression     uint32
+	Encryption      uint32
+	_               [64]byte
+}
@@ -0,0 +1,119 @@
+package raw
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Sizes of structures as defined by the kernel, see linux/btrfs.h.
+var caseSizes = []struct {
+	obj  interface{}
+	size int
+}{
+	{obj: VolArgs{}, size: 4096},
+	{obj: QgroupLimit{}, size: 40},
+	{obj: QgroupInherit{}, size: 72},
+	{obj: QgroupLimitArgs{}, size: 48},
+	{obj: VolArgsV2{}, size: 4096},
+	{obj: ScrubProgress{}, size: 120},
+	{obj: ScrubArgs{}, size: 1024},
+	{obj: DevReplaceStartParams{}, size: 2072},
+	{obj: DevReplaceStatusParams{}, size: 48},
+	{obj: DevReplaceArgs{}, size: 2600},
+	{obj: DevInfoArgs{}, size: 4096},
+	{obj: FSInfoArgs{}, size: 1024},
+	{obj: FeatureFlags{}, size: 24},
+	{obj: BalanceArgs{}, size: 136},
+	{obj: BalanceProgress{}, size: 24},
+	{obj: BalanceIoctlArgs{}, size: 1024},
+	{obj: InoLookupArgs{}, size: 4096},
+	{obj: SearchKey{}, size: 104},
+	{obj: SearchHeader{}, size: 32},
+	{obj: SearchArgs{}, size: 4096},
+	{obj: SearchArgsV2{}, size: 112},
+	{obj: CloneRangeArgs{}, size: 32},
+	{obj: SameExtentInfo{}, size: 32},
+	{obj: SameArgs{}, size: 24},
+	{obj: DefragRangeArgs{}, size: 48},
+	{obj: SpaceInfo{}, size: 24},
+	{obj: SpaceArgs{}, size: 16},
+	{obj: DataContainer{}, size: 16},
+	{obj: InoPathArgs{}, size: 56},
+	{obj: LogicalInoArgs{}, size: 56},
+	{obj: GetDevStatsArgs{}, size: 1032},
+	{obj: QuotaCtlArgs{}, size: 16},
+	{obj: QuotaRescanArgs{}, size: 64},
+	{obj: QgroupAssignArgs{}, size: 24},
+	{obj: QgroupCreateArgs{}, size: 16},
+	{obj: Timespec{}, size: 16},
+	{obj: ReceivedSubvolArgs{}, size: 200},
+	{obj: SendArgs{}, size: 72},
+	{obj: EncodedIOArgs{}, size: 128},
+}
+
+func TestSizes(t *testing.T) {
+	for _, c := range caseSizes {
+		if sz := int(reflect.ValueOf(c.obj).Type().Size()); sz != c.size {
+			t.Errorf("unexpected size of %T: %d (exp: %d)", c.obj, sz, c.size)
+		}
+	}
+}
+
+// Request numbers as computed by the kernel headers on amd64.
+var caseRequests = []struct {
+	name string
+	req  uintptr
+	exp  uintptr
+}{
+	{"SNAP_CREATE", IocSnapCreate, 0x50009401},
+	{"SYNC", IocSync, 0x00009408},
+	{"CLONE", IocClone, 0x40049409},
+	{"CLONE_RANGE", IocCloneRange, 0x4020940d},
+	{"SUBVOL_CREATE", IocSubvolCreate, 0x5000940e},
+	{"SNAP_DESTROY", IocSnapDestroy, 0x5000940f},
+	{"DEFRAG_RANGE", IocDefragRange, 0x40309410},
+	{"TREE_SEARCH", IocTreeSearch, 0xd0009411},
+	{"TREE_SEARCH_V2", IocTreeSearchV2, 0xc0709411},
+	{"INO_LOOKUP", IocInoLookup, 0xd0009412},
+	{"DEFAULT_SUBVOL", IocDefaultSubvol, 0x40089413},
+	{"SPACE_INFO", IocSpaceInfo, 0xc0109414},
+	{"START_SYNC", IocStartSync, 0x80089418},
+	{"WAIT_SYNC", IocWaitSync, 0x40089416},
+	{"SNAP_CREATE_V2", IocSnapCreateV2, 0x50009417},
+	{"SUBVOL_CREATE_V2", IocSubvolCreateV2, 0x50009418},
+	{"SUBVOL_GETFLAGS", IocSubvolGetflags, 0x80089419},
+	{"SUBVOL_SETFLAGS", IocSubvolSetflags, 0x4008941a},
+	{"SCRUB", IocScrub, 0xc400941b},
+	{"SCRUB_CANCEL", IocScrubCancel, 0x0000941c},
+	{"SCRUB_PROGRESS", IocScrubProgress, 0xc400941d},
+	{"DEV_INFO", IocDevInfo, 0xd000941e},
+	{"FS_INFO", IocFSInfo, 0x8400941f},
+	{"BALANCE_V2", IocBalanceV2, 0xc4009420},
+	{"BALANCE_CTL", IocBalanceCtl, 0x40049421},
+	{"BALANCE_PROGRESS", IocBalanceProgress, 0x84009422},
+	{"INO_PATHS", IocInoPaths, 0xc0389423},
+	{"LOGICAL_INO", IocLogicalIno, 0xc0389424},
+	{"SET_RECEIVED_SUBVOL", IocSetReceivedSubvol, 0xc0c89425},
+	{"SEND", IocSend, 0x40489426},
+	{"QUOTA_CTL", IocQuotaCtl, 0xc0109428},
+	{"QGROUP_ASSIGN", IocQgroupAssign, 0x40189429},
+	{"QGROUP_CREATE", IocQgroupCreate, 0x4010942a},
+	{"QGROUP_LIMIT", IocQgroupLimit, 0x8030942b},
+	{"QUOTA_RESCAN", IocQuotaRescan, 0x4040942c},
+	{"GET_DEV_STATS", IocGetDevStats, 0xc4089434},
+	{"DEV_REPLACE", IocDevReplace, 0xca289435},
+	{"FILE_EXTENT_SAME", IocFileExtentSame, 0xc0189436},
+	{"GET_FEATURES", IocGetFeatures, 0x80189439},
+	{"SET_FEATURES", IocSetFeatures, 0x40309439},
+	{"GET_SUPPORTED_FEATURES", IocGetSupportedFeatures, 0x80489439},
+	{"LOGICAL_INO_V2", IocLogicalInoV2, 0xc038943b},
+	{"ENCODED_WRITE", IocEncodedWrite, 0x40809440},
+}
+
+func TestRequests(t *testing.T) {
+	for _, c := range caseRequests {
+		if c.req != c.exp {
+			t.Errorf("unexpected request number of %s: %#x (exp: %#x)", c.name, c.req, c.exp)
+		}
+	}
+}
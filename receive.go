@@ -16,7 +16,7 @@ func Receive(r io.Reader, dstDir string) error {
 	if !nativeReceive {
 		buf := bytes.NewBuffer(nil)
 		cmd := exec.Command("btrfs", "receive", dstDir)
-		cmd.Stdin = r
+		cmd.Stdin = loadRateLimit(&receiveRateLimit).Reader(r)
 		cmd.Stderr = buf
 		if err := cmd.Run(); err != nil {
 			if buf.Len() != 0 {
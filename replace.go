@@ -0,0 +1,183 @@
+package btrfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ReplaceState is a state of a device replace operation.
+type ReplaceState int
+
+const (
+	ReplaceNeverStarted ReplaceState = ReplaceState(_BTRFS_IOCTL_DEV_REPLACE_STATE_NEVER_STARTED)
+	ReplaceStarted      ReplaceState = ReplaceState(_BTRFS_IOCTL_DEV_REPLACE_STATE_STARTED)
+	ReplaceFinished     ReplaceState = ReplaceState(_BTRFS_IOCTL_DEV_REPLACE_STATE_FINISHED)
+	ReplaceCanceled     ReplaceState = ReplaceState(_BTRFS_IOCTL_DEV_REPLACE_STATE_CANCELED)
+	ReplaceSuspended    ReplaceState = ReplaceState(_BTRFS_IOCTL_DEV_REPLACE_STATE_SUSPENDED)
+)
+
+func (s ReplaceState) String() string {
+	switch s {
+	case ReplaceNeverStarted:
+		return "never started"
+	case ReplaceStarted:
+		return "started"
+	case ReplaceFinished:
+		return "finished"
+	case ReplaceCanceled:
+		return "canceled"
+	case ReplaceSuspended:
+		return "suspended"
+	}
+	return fmt.Sprintf("ReplaceState(%d)", int(s))
+}
+
+// ReplaceStatus is a status of a device replace operation.
+type ReplaceStatus struct {
+	State    ReplaceState
+	Progress float64 // fraction of the work done, from 0 to 1
+	Started  time.Time
+	Stopped  time.Time // zero if still running
+	// WriteErrors is the number of write errors on the target device.
+	WriteErrors uint64
+	// UncorrectableReadErrors is the number of blocks that could not be read
+	// from the source device or from any mirror.
+	UncorrectableReadErrors uint64
+}
+
+// ErrReplace is a failure reported by the kernel when starting a device replace.
+type ErrReplace uint64
+
+func (e ErrReplace) Error() string {
+	switch e {
+	case _BTRFS_IOCTL_DEV_REPLACE_RESULT_NOT_STARTED:
+		return "device replace is not started"
+	case _BTRFS_IOCTL_DEV_REPLACE_RESULT_ALREADY_STARTED:
+		return "device replace is already in progress"
+	case _BTRFS_IOCTL_DEV_REPLACE_RESULT_SCRUB_INPROGRESS:
+		return "scrub is in progress"
+	}
+	return fmt.Sprintf("device replace error %d", uint64(e))
+}
+
+// ReplaceStart replaces a device with id srcID by a device at tgtPath. If srcID is zero,
+// the source device is looked up by srcPath. If avoidSrc is set, the source device is
+// read only if there is no other mirror of the data, which is useful for failing disks.
+//
+// The call blocks until the replace finishes or is canceled; use ReplaceStatus from
+// another goroutine to monitor progress. It requires CAP_SYS_ADMIN.
+func (f *FS) ReplaceStart(srcID uint64, srcPath, tgtPath string, avoidSrc bool) error {
+	return f.audited("replace_start", map[string]interface{}{
+		"srcdevid": srcID, "src": srcPath, "tgt": tgtPath, "avoid_src": avoidSrc,
+	}, func() error {
+		return f.replaceStart(srcID, srcPath, tgtPath, avoidSrc)
+	})
+}
+
+func (f *FS) replaceStart(srcID uint64, srcPath, tgtPath string, avoidSrc bool) error {
+	arg, err := replaceStartArgs(srcID, srcPath, tgtPath, avoidSrc)
+	if err != nil {
+		return err
+	}
+	if err := iocDevReplace(f.f, arg); err != nil {
+		if arg.Result != _BTRFS_IOCTL_DEV_REPLACE_RESULT_NO_ERROR && arg.Result != ^uint64(0) {
+			return ErrReplace(arg.Result)
+		}
+		return err
+	}
+	if arg.Result != _BTRFS_IOCTL_DEV_REPLACE_RESULT_NO_ERROR {
+		return ErrReplace(arg.Result)
+	}
+	return nil
+}
+
+// replaceStartArgs validates arguments of ReplaceStart and fills the ioctl request.
+func replaceStartArgs(srcID uint64, srcPath, tgtPath string, avoidSrc bool) (*btrfs_ioctl_dev_replace_args, error) {
+	var arg btrfs_ioctl_dev_replace_args
+	arg.Cmd = _BTRFS_IOCTL_DEV_REPLACE_CMD_START
+	arg.Start.SrcDevID = srcID
+	if srcID == 0 {
+		if srcPath == "" {
+			return nil, fmt.Errorf("source device is not set")
+		} else if len(srcPath) > devicePathNameMax {
+			return nil, fmt.Errorf("source device path is too long")
+		}
+		copy(arg.Start.SrcDevName[:], srcPath)
+	}
+	if tgtPath == "" {
+		return nil, fmt.Errorf("target device is not set")
+	} else if len(tgtPath) > devicePathNameMax {
+		return nil, fmt.Errorf("target device path is too long")
+	}
+	copy(arg.Start.TgtDevName[:], tgtPath)
+	if avoidSrc {
+		arg.Start.ContReadingFromSrcdevMode = _BTRFS_IOCTL_DEV_REPLACE_CONT_READING_FROM_SRCDEV_MODE_AVOID
+	}
+	return &arg, nil
+}
+
+// ReplaceStatus returns the status of the last device replace operation.
+func (f *FS) ReplaceStatus() (ReplaceStatus, error) {
+	var arg btrfs_ioctl_dev_replace_args
+	arg.Cmd = _BTRFS_IOCTL_DEV_REPLACE_CMD_STATUS
+	if err := iocDevReplace(f.f, &arg); err != nil {
+		return ReplaceStatus{}, err
+	}
+	st := arg.Status()
+	out := ReplaceStatus{
+		State:                   ReplaceState(st.ReplaceState),
+		Progress:                float64(st.Progress1000) / 1000,
+		WriteErrors:             st.NumWriteErrors,
+		UncorrectableReadErrors: st.NumUncorrectableReadErrors,
+	}
+	if st.TimeStarted != 0 {
+		out.Started = time.Unix(int64(st.TimeStarted), 0)
+	}
+	if st.TimeStopped != 0 {
+		out.Stopped = time.Unix(int64(st.TimeStopped), 0)
+	}
+	return out, nil
+}
+
+// ReplaceCancel cancels a running device replace operation.
+func (f *FS) ReplaceCancel() error {
+	return f.audited("replace_cancel", nil, f.replaceCancel)
+}
+
+func (f *FS) replaceCancel() error {
+	var arg btrfs_ioctl_dev_replace_args
+	arg.Cmd = _BTRFS_IOCTL_DEV_REPLACE_CMD_CANCEL
+	if err := iocDevReplace(f.f, &arg); err != nil {
+		return err
+	}
+	if arg.Result != _BTRFS_IOCTL_DEV_REPLACE_RESULT_NO_ERROR {
+		return ErrReplace(arg.Result)
+	}
+	return nil
+}
+
+// DeviceSize returns the size of a block device or a regular file in bytes.
+func DeviceSize(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.Mode().IsRegular() {
+		return uint64(fi.Size()), nil
+	} else if fi.Mode()&os.ModeDevice == 0 {
+		return 0, &os.PathError{Op: "size", Path: path, Err: syscall.ENOTBLK}
+	}
+	n, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(n), nil
+}
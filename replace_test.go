@@ -0,0 +1,71 @@
+package btrfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplaceStartArgs(t *testing.T) {
+	long := "/dev/" + strings.Repeat("x", devicePathNameMax)
+	for _, c := range []struct {
+		srcID    uint64
+		src, tgt string
+	}{
+		{0, "", "/dev/sdc"},
+		{0, long, "/dev/sdc"},
+		{1, "", ""},
+		{1, "", long},
+	} {
+		if _, err := replaceStartArgs(c.srcID, c.src, c.tgt, false); err == nil {
+			t.Errorf("%d %q %q: expected an error", c.srcID, c.src, c.tgt)
+		}
+	}
+	name := func(b []byte) string {
+		return string(b[:bytes.IndexByte(b, 0)])
+	}
+	arg, err := replaceStartArgs(0, "/dev/sdb", "/dev/sdc", true)
+	if err != nil {
+		t.Fatal(err)
+	} else if arg.Cmd != _BTRFS_IOCTL_DEV_REPLACE_CMD_START {
+		t.Fatalf("unexpected command: %d", arg.Cmd)
+	} else if s := name(arg.Start.SrcDevName[:]); s != "/dev/sdb" {
+		t.Fatalf("unexpected source: %q", s)
+	} else if s := name(arg.Start.TgtDevName[:]); s != "/dev/sdc" {
+		t.Fatalf("unexpected target: %q", s)
+	} else if arg.Start.ContReadingFromSrcdevMode != _BTRFS_IOCTL_DEV_REPLACE_CONT_READING_FROM_SRCDEV_MODE_AVOID {
+		t.Fatalf("unexpected read mode: %d", arg.Start.ContReadingFromSrcdevMode)
+	}
+	// the name is ignored if the id is set
+	arg, err = replaceStartArgs(2, "/dev/sdb", "/dev/sdc", false)
+	if err != nil {
+		t.Fatal(err)
+	} else if arg.Start.SrcDevID != 2 || arg.Start.SrcDevName[0] != 0 {
+		t.Fatalf("unexpected source: %d %q", arg.Start.SrcDevID, name(arg.Start.SrcDevName[:]))
+	} else if arg.Start.ContReadingFromSrcdevMode != 0 {
+		t.Fatalf("unexpected read mode: %d", arg.Start.ContReadingFromSrcdevMode)
+	}
+}
+
+func TestDeviceSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs-replace-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	img := filepath.Join(dir, "disk.img")
+	if err = ioutil.WriteFile(img, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := DeviceSize(img); err != nil {
+		t.Fatal(err)
+	} else if n != 4096 {
+		t.Fatalf("unexpected size: %d", n)
+	}
+	if _, err = DeviceSize(dir); err == nil {
+		t.Fatal("expected an error for a directory")
+	}
+}
@@ -0,0 +1,440 @@
+package btrfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ReplicaTarget is a destination of Replicate, for example a directory on a local
+// or a remote filesystem.
+type ReplicaTarget interface {
+	// Receive applies a send stream to the destination.
+	Receive(r io.Reader) error
+	// Lookup returns the name of a subvolume in the destination that was received
+	// from a subvolume with a given uuid. It returns ErrNotFound if there is none.
+	Lookup(uuid UUID) (string, error)
+	// Delete deletes a subvolume with a given name from the destination.
+	Delete(name string) error
+}
+
+// LocalTarget returns a target that receives subvolumes into a local directory.
+// Subvolumes are deleted through the filesystem of the directory, opened for each call;
+// use LocalTargetFS to apply a guard and an audit log.
+func LocalTarget(dir string) ReplicaTarget {
+	return localTarget{dir: dir}
+}
+
+// LocalTargetFS returns a target that receives subvolumes into a directory relative to fs.
+// Subvolumes are received and deleted through fs, thus its guard and audit log apply.
+func LocalTargetFS(fs *FS, dir string) ReplicaTarget {
+	return localTarget{fs: fs, dir: dir}
+}
+
+type localTarget struct {
+	fs  *FS // nil if the filesystem is opened for each call
+	dir string
+}
+
+func (t localTarget) Receive(r io.Reader) error {
+	if t.fs != nil {
+		return t.fs.ReceiveTo(r, t.dir)
+	}
+	return Receive(r, t.dir)
+}
+
+func (t localTarget) Lookup(uuid UUID) (string, error) {
+	dir, err := filepath.Abs(t.dir)
+	if err != nil {
+		return "", err
+	}
+	fs := t.fs
+	if fs == nil {
+		if fs, err = openMount(dir, true); err != nil {
+			return "", err
+		}
+		defer fs.Close()
+	} else {
+		dir = fs.resolve(t.dir)
+		if dir, err = filepath.Abs(dir); err != nil {
+			return "", err
+		}
+	}
+	list, err := fs.ListSubvolumes(func(s SubvolInfo) bool {
+		return s.ReceivedUUID == uuid
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, s := range list {
+		path, err := fs.SubvolumePath(s.RootID)
+		if err == nil && filepath.Dir(path) == dir {
+			return filepath.Base(path), nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (t localTarget) Delete(name string) error {
+	dir, fs := t.dir, t.fs
+	if fs == nil {
+		var err error
+		if dir, err = filepath.Abs(dir); err != nil {
+			return err
+		} else if fs, err = openMount(dir, false); err != nil {
+			return err
+		}
+		defer fs.Close()
+	}
+	rel, err := fs.rel(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	return fs.DeleteSubVolume(rel)
+}
+
+// openMount opens the mount point of the filesystem a path belongs to.
+func openMount(path string, ro bool) (*FS, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	mnt, err := findMountRoot(path)
+	if err != nil {
+		return nil, err
+	}
+	return Open(mnt, ro)
+}
+
+// ReplicateOptions controls the behavior of Replicate.
+type ReplicateOptions struct {
+	// SnapshotDir is a directory for read-only snapshots of the source subvolume.
+	// By default, snapshots are created next to the subvolume.
+	SnapshotDir string
+	// Keep is the number of the most recent snapshots to keep, both in the snapshot directory
+	// and in the destination. Older ones are deleted after a successful transfer.
+	// Zero disables pruning.
+	Keep int
+	// Now is used to name the snapshot; time.Now is used by default.
+	Now func() time.Time
+	// FS is the filesystem of the subvolume. Snapshots are created and pruned through it,
+	// thus its guard and audit log apply. By default, the mount point of the subvolume is opened.
+	FS *FS
+}
+
+// ReplicateResult summarizes a replication.
+type ReplicateResult struct {
+	Snapshot string        `json:"snapshot"`         // path of the new snapshot
+	Parent   string        `json:"parent,omitempty"` // path of the parent snapshot, if the stream was incremental
+	Received string        `json:"received"`         // name of the snapshot in the destination
+	Bytes    uint64        `json:"bytes"`            // size of the stream
+	Duration time.Duration `json:"duration"`
+	Pruned   []string      `json:"pruned,omitempty"` // paths of deleted source snapshots
+}
+
+// Replicate creates a read-only snapshot of a subvolume, sends it to the destination, and prunes
+// old snapshots. Snapshots are named after the subvolume with a UTC timestamp suffix.
+//
+// The most recent read-only snapshot of the subvolume that is present in the destination (according
+// to its received uuid) is used as a parent, so only the changes are sent. It may be any snapshot
+// on the source filesystem, but only snapshots in SnapshotDir named by Replicate are pruned. If the transfer fails, both the new
+// snapshot and its partial copy in the destination are deleted.
+func Replicate(subvol string, dst ReplicaTarget, opts *ReplicateOptions) (*ReplicateResult, error) {
+	start := time.Now()
+	var o ReplicateOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Now == nil {
+		o.Now = time.Now
+	}
+	subvol, err := filepath.Abs(subvol)
+	if err != nil {
+		return nil, err
+	}
+	if o.SnapshotDir == "" {
+		o.SnapshotDir = filepath.Dir(subvol)
+	} else if o.SnapshotDir, err = filepath.Abs(o.SnapshotDir); err != nil {
+		return nil, err
+	}
+	// any snapshot of the subvolume that is present in the destination can be a parent,
+	// not only the ones created by Replicate
+	parents, err := subvolSnapshots(subvol)
+	if err != nil {
+		return nil, err
+	}
+	snaps := replicaSnapshots(parents, subvol, o.SnapshotDir)
+	fs := o.FS
+	if fs == nil {
+		if fs, err = openMount(subvol, false); err != nil {
+			return nil, err
+		}
+		defer fs.Close()
+	}
+	res := &ReplicateResult{
+		Snapshot: filepath.Join(o.SnapshotDir, filepath.Base(subvol)+"."+o.Now().UTC().Format("20060102T150405Z")),
+	}
+	for i := len(parents) - 1; i >= 0; i-- {
+		if _, err := dst.Lookup(parents[i].UUID); err == nil {
+			res.Parent = parents[i].Path
+			break
+		} else if err != ErrNotFound {
+			return nil, err
+		}
+	}
+	subRel, err := fs.rel(subvol)
+	if err != nil {
+		return nil, err
+	}
+	snapRel, err := fs.rel(res.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if err = fs.SnapshotSubVolume(subRel, snapRel, true); err != nil {
+		return nil, err
+	}
+	res.Bytes, err = replicaTransfer(dst.Receive, res.Parent, res.Snapshot)
+	if err != nil {
+		if name, err2 := replicaLookup(dst, res.Snapshot); err2 == nil {
+			if err2 = dst.Delete(name); err2 != nil {
+				err = fmt.Errorf("%v (cannot delete %s from the destination: %v)", err, name, err2)
+			}
+		} else {
+			// receive creates the subvolume with the same name before the uuid is set,
+			// it may also not exist at all, but guard errors are reported
+			if err2 := dst.Delete(filepath.Base(res.Snapshot)); isGuardErr(err2) {
+				err = fmt.Errorf("%v (%v)", err, err2)
+			}
+		}
+		if err2 := fs.DeleteSubVolume(snapRel); err2 != nil {
+			err = fmt.Errorf("%v (cannot delete %s: %v)", err, res.Snapshot, err2)
+		}
+		return nil, err
+	}
+	if res.Received, err = replicaLookup(dst, res.Snapshot); err != nil {
+		return res, fmt.Errorf("cannot find the received snapshot: %v", err)
+	}
+	if o.Keep > 0 && len(snaps)+1 > o.Keep {
+		for _, s := range snaps[:len(snaps)+1-o.Keep] {
+			if name, err := dst.Lookup(s.UUID); err == nil {
+				if err = dst.Delete(name); err != nil {
+					return res, err
+				}
+			} else if err != ErrNotFound {
+				return res, err
+			}
+			rel, err := fs.rel(s.Path)
+			if err != nil {
+				return res, err
+			}
+			if err = fs.DeleteSubVolume(rel); err != nil {
+				return res, err
+			}
+			res.Pruned = append(res.Pruned, s.Path)
+		}
+	}
+	res.Duration = time.Since(start)
+	return res, nil
+}
+
+// replicaSnapshot is an existing read-only snapshot of the replicated subvolume.
+type replicaSnapshot struct {
+	Path     string
+	UUID     UUID
+	OTransID uint64
+}
+
+// replicaSnapshots selects snapshots of a subvolume in a directory that were named by Replicate.
+func replicaSnapshots(all []replicaSnapshot, subvol, dir string) []replicaSnapshot {
+	prefix := filepath.Base(subvol) + "."
+	var out []replicaSnapshot
+	for _, s := range all {
+		if filepath.Dir(s.Path) == dir && strings.HasPrefix(filepath.Base(s.Path), prefix) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// subvolSnapshots lists all read-only snapshots of a subvolume on its filesystem, from the oldest one.
+func subvolSnapshots(subvol string) ([]replicaSnapshot, error) {
+	mnt, err := findMountRoot(subvol)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := Open(mnt, true)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+	info, err := fs.SubvolumeByPath(subvol)
+	if err != nil {
+		return nil, err
+	}
+	list, err := fs.ListSubvolumes(func(s SubvolInfo) bool {
+		return s.ParentUUID == info.UUID && s.Flags.ReadOnly()
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out []replicaSnapshot
+	for _, s := range list {
+		path, err := fs.SubvolumePath(s.RootID)
+		if err != nil {
+			continue
+		}
+		out = append(out, replicaSnapshot{Path: path, UUID: s.UUID, OTransID: s.OTransID})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].OTransID < out[j].OTransID })
+	return out, nil
+}
+
+// replicaLookup finds a copy of a local snapshot in the destination.
+func replicaLookup(dst ReplicaTarget, snap string) (string, error) {
+	uuid, err := subvolUUID(snap)
+	if err != nil {
+		return "", err
+	}
+	return dst.Lookup(uuid)
+}
+
+func subvolUUID(path string) (UUID, error) {
+	it, err := subvolRootItem(path)
+	if err != nil {
+		return UUID{}, err
+	}
+	return it.UUID, nil
+}
+
+func subvolRootItem(path string) (*rootItem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	id, err := getFileRootID(f)
+	if err != nil {
+		return nil, err
+	}
+	return readRootItem(f, id)
+}
+
+// replicaTransfer sends a snapshot to the receiver and returns the size of the stream.
+func replicaTransfer(receive func(r io.Reader) error, parent, snap string) (uint64, error) {
+	pr, pw := io.Pipe()
+	cw := &replicaCounter{w: pw}
+	errc := make(chan error, 1)
+	go func() {
+		err := Send(cw, parent, snap)
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+	err := receive(pr)
+	pr.Close()
+	if err2 := <-errc; err2 != nil && err2 != io.ErrClosedPipe {
+		err = err2
+	}
+	return cw.n, err
+}
+
+// deletePartialReceive deletes a subvolume with a given name in the root of the FS, if it was
+// left by a failed receive of a snapshot with a given uuid. Other subvolumes are kept.
+func (f *FS) deletePartialReceive(name string, uuid UUID) error {
+	path := filepath.Join(f.f.Name(), name)
+	if ok, err := IsSubVolume(path); os.IsNotExist(err) || (err == nil && !ok) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	it, err := subvolRootItem(path)
+	if err != nil {
+		return err
+	}
+	// receive sets the uuid only after the whole stream is applied
+	if !it.ReceivedUUID.IsZero() && it.ReceivedUUID != uuid {
+		return nil
+	}
+	return f.DeleteSubVolume(name)
+}
+
+type replicaCounter struct {
+	w io.Writer
+	n uint64
+}
+
+func (w *replicaCounter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += uint64(n)
+	return n, err
+}
+
+// Replicate sends a subvolume to another filesystem, incremental from parent, if it's set.
+// Both paths are relative to f, and the subvolume is received into the root of dst.
+//
+// If the subvolume is not read-only, a read-only snapshot of it is created next to it first,
+// and it's sent instead. The parent must be a read-only snapshot that was received by dst before;
+// this is checked before sending. If the transfer fails, the new snapshot and the partially
+// received subvolume are deleted, as done by the package-level Replicate.
+func (f *FS) Replicate(dst *FS, subvol, parent string) (*ReplicateResult, error) {
+	start := time.Now()
+	res := &ReplicateResult{Snapshot: filepath.Join(f.f.Name(), subvol)}
+	if parent != "" {
+		res.Parent = filepath.Join(f.f.Name(), parent)
+		uuid, err := subvolUUID(res.Parent)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get parent uuid: %v", err)
+		}
+		if _, err = dst.SubvolumeByReceivedUUID(uuid); err == ErrNotFound {
+			return nil, fmt.Errorf("parent %s was not received by the destination", parent)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	ro, err := IsReadOnly(res.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	var snapRel string // set if the snapshot was created by this call
+	if !ro {
+		snapRel = subvol + "." + start.UTC().Format("20060102T150405Z")
+		if err = f.SnapshotSubVolume(subvol, snapRel, true); err != nil {
+			return nil, err
+		}
+		res.Snapshot = filepath.Join(f.f.Name(), snapRel)
+	}
+	uuid, err := subvolUUID(res.Snapshot)
+	if err == nil {
+		name := filepath.Base(res.Snapshot)
+		_, err = os.Lstat(filepath.Join(dst.f.Name(), name))
+		existed := err == nil
+		res.Bytes, err = replicaTransfer(dst.Receive, res.Parent, res.Snapshot)
+		if err != nil && !existed {
+			if err2 := dst.deletePartialReceive(name, uuid); err2 != nil {
+				err = fmt.Errorf("%v (cannot delete %s from the destination: %v)", err, name, err2)
+			}
+		}
+	}
+	if err != nil {
+		if snapRel != "" {
+			if err2 := f.DeleteSubVolume(snapRel); err2 != nil {
+				err = fmt.Errorf("%v (cannot delete %s: %v)", err, res.Snapshot, err2)
+			}
+		}
+		return nil, err
+	}
+	info, err := dst.SubvolumeByReceivedUUID(uuid)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the received subvolume: %v", err)
+	}
+	path, err := dst.SubvolumePath(info.RootID)
+	if err != nil {
+		return nil, err
+	}
+	res.Received = filepath.Base(path)
+	res.Duration = time.Since(start)
+	return res, nil
+}
@@ -0,0 +1,103 @@
+package btrfs
+
+import (
+	"path/filepath"
+	"sort"
+)
+
+// Sandbox is a subvolume with a space limit, used as an ephemeral workspace,
+// for example by CI systems and build farms. See FS.CreateSandbox.
+type Sandbox struct {
+	fs   *FS
+	name string
+	id   uint64
+}
+
+// CreateSandbox creates a subvolume (relative to f) and limits the number of bytes it can reference.
+// Quotas are enabled on the filesystem if necessary. If limitBytes is zero, the space is not limited,
+// but the usage is still accounted.
+//
+// The sandbox keeps a reference to f, thus f must not be closed while the sandbox is in use.
+func (f *FS) CreateSandbox(name string, limitBytes uint64) (*Sandbox, error) {
+	if _, err := f.Qgroups(); err == ErrQuotaDisabled {
+		if err = f.EnableQuota(); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if err := f.CreateSubVolume(name); err != nil {
+		return nil, err
+	}
+	info, err := f.SubvolumeByPath(name)
+	if err == nil && limitBytes != 0 {
+		err = f.SetQgroupLimit(NewQgroupID(0, info.RootID), limitBytes, 0)
+	}
+	if err != nil {
+		f.DeleteSubVolume(name)
+		return nil, err
+	}
+	return &Sandbox{fs: f, name: name, id: info.RootID}, nil
+}
+
+// Path returns an absolute path of the sandbox.
+func (s *Sandbox) Path() string {
+	return filepath.Join(s.fs.f.Name(), s.name)
+}
+
+// Usage returns the space used by the sandbox and its limit. Nested subvolumes are not included.
+// The filesystem is synced first to get up-to-date values.
+func (s *Sandbox) Usage() (*Qgroup, error) {
+	if err := s.fs.Sync(); err != nil {
+		return nil, err
+	}
+	return s.fs.SubvolumeQgroup(s.id)
+}
+
+// Destroy deletes the sandbox with all its content, including nested subvolumes
+// created in it (for example, by container runtimes).
+func (s *Sandbox) Destroy() error {
+	list, err := s.fs.ListSubvolumes(nil)
+	if err != nil {
+		return err
+	}
+	parents := make(map[uint64]uint64, len(list))
+	for _, v := range list {
+		parents[v.RootID] = v.ParentID
+	}
+	// find all descendants and delete them from the deepest one
+	depth := make(map[uint64]int)
+	for _, v := range list {
+		d := 0
+		for id := v.RootID; id != s.id; d++ {
+			p, ok := parents[id]
+			if !ok || p == id {
+				d = -1
+				break
+			}
+			id = p
+		}
+		if d > 0 {
+			depth[v.RootID] = d
+		}
+	}
+	nested := make([]uint64, 0, len(depth))
+	for id := range depth {
+		nested = append(nested, id)
+	}
+	sort.Slice(nested, func(i, j int) bool { return depth[nested[i]] > depth[nested[j]] })
+	for _, id := range nested {
+		path, err := s.fs.SubvolumePath(id)
+		if err != nil {
+			return err
+		}
+		rel, err := s.fs.rel(path)
+		if err != nil {
+			return err
+		}
+		if err = s.fs.DeleteSubVolume(rel); err != nil {
+			return err
+		}
+	}
+	return s.fs.DeleteSubVolume(s.name)
+}
@@ -0,0 +1,362 @@
+package btrfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ScrubFlags control the scrub, see ScrubStartWithFlags.
+type ScrubFlags = uint64
+
+const (
+	// ScrubFlagsReadOnly only reports errors and does not repair them.
+	ScrubFlagsReadOnly ScrubFlags = _BTRFS_SCRUB_READONLY
+)
+
+// ScrubStartWithFlags is like ScrubStart, but accepts flags, e.g. ScrubFlagsReadOnly.
+//
+// A read-only scrub is the only kind of scrub allowed on a filesystem mounted read-only.
+// It's also useful for audits, or when repairs must be scheduled separately.
+func (f *FS) ScrubStartWithFlags(dev uint64, start uint64, end uint64, flags ScrubFlags) error {
+	_, err := f.scrub(dev, start, end, flags)
+	return err
+}
+
+// scrub runs a scrub on a device and records the result to the history, if the state directory is set.
+// It returns the progress reported at the end of the scrub.
+func (f *FS) scrub(dev, start, end uint64, flags ScrubFlags) (ScrubProgress, error) {
+	var arg btrfs_ioctl_scrub_args
+	arg.DevID = dev
+	arg.Flags = flags
+	arg.Start = start
+	arg.End = end
+	started := time.Now()
+	base, err := f.scrubStatusStart(dev, start, started)
+	if err != nil {
+		return ScrubProgress{}, fmt.Errorf("cannot write scrub status: %v", err)
+	}
+	err = iocScrub(f.f, &arg)
+	p := scrubProgress(&arg.Progress)
+	if err2 := f.scrubStatusFinish(dev, base, p, started, err); err == nil && err2 != nil {
+		err = fmt.Errorf("cannot write scrub status: %v", err2)
+	}
+	if f.stateDir == "" {
+		return p, err
+	}
+	rec := ScrubRecord{
+		DevID:    dev,
+		Started:  started,
+		Finished: time.Now(),
+		ReadOnly: flags&ScrubFlagsReadOnly != 0,
+		Start:    start,
+		End:      end,
+		Progress: p,
+	}
+	if err == syscall.ECANCELED {
+		rec.Canceled = true
+	} else if err != nil {
+		rec.Error = err.Error()
+	}
+	if err2 := f.recordScrub(rec); err == nil && err2 != nil {
+		err = fmt.Errorf("cannot record scrub result: %v", err2)
+	}
+	return p, err
+}
+
+// ErrNoScrubToResume is returned by ScrubResume if the last scrub of the device was not interrupted.
+var ErrNoScrubToResume = errors.New("no interrupted scrub to resume")
+
+// ScrubResume continues the last scrub of the given device from the last scrubbed physical address,
+// if it was canceled or failed. The range and flags of the original scrub are preserved.
+// It blocks until the scrub is done, same as ScrubStart.
+//
+// Scrubs are resumed from the history, thus the state directory must be set with SetStateDir,
+// both for the original scrub and for the resumed one. If only the scrub status directory is set
+// with SetScrubStatusDir, scrubs are resumed from the status file, same as btrfs-progs does,
+// which also allows to resume scrubs started by it. ErrNoScrubToResume is returned
+// if the last scrub has finished, or if no scrubs were recorded.
+func (f *FS) ScrubResume(dev uint64) error {
+	if err := f.revalidate(); err != nil {
+		return err
+	}
+	var (
+		start, end uint64
+		flags      ScrubFlags
+	)
+	if f.stateDir == "" && f.scrubStatusDir != "" {
+		entries, err := f.ScrubStatusFile()
+		if err == ErrNotFound {
+			return ErrNoScrubToResume
+		} else if err != nil {
+			return err
+		}
+		start, end, err = resumePointFile(entries, dev)
+		if err != nil {
+			return err
+		}
+	} else {
+		recs, err := f.ScrubHistory()
+		if err != nil {
+			return err
+		}
+		start, end, flags, err = resumePoint(recs, dev)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := f.ScrubStatus(dev); err == nil {
+		return fmt.Errorf("device %d: %v", dev, syscall.EINPROGRESS)
+	} else if err != syscall.ENOTCONN {
+		return err
+	}
+	return f.ScrubStartWithFlags(dev, start, end, flags)
+}
+
+// resumePoint returns the range and flags to continue the last recorded scrub of a device.
+func resumePoint(recs []ScrubRecord, dev uint64) (start, end uint64, flags ScrubFlags, err error) {
+	var last *ScrubRecord
+	for i := range recs {
+		r := &recs[i]
+		if r.DevID == dev && (last == nil || !r.Finished.Before(last.Finished)) {
+			last = r
+		}
+	}
+	if last == nil || (!last.Canceled && last.Error == "") {
+		return 0, 0, 0, ErrNoScrubToResume
+	}
+	start, end = last.Start, last.End
+	if end == 0 {
+		end = math.MaxUint64 // recorded by older versions
+	}
+	if p := last.Progress.LastPhysical; p > start {
+		start = p
+	}
+	if last.ReadOnly {
+		flags |= ScrubFlagsReadOnly
+	}
+	return start, end, flags, nil
+}
+
+// resumePointFile returns the range to continue the scrub of a device recorded in the status file.
+// The file has no range and flags, thus the scrub continues to the end of the device, repairing errors.
+func resumePointFile(entries []ScrubFileEntry, dev uint64) (start, end uint64, err error) {
+	for _, e := range entries {
+		if e.DevID != dev {
+			continue
+		}
+		if e.Finished && !e.Canceled {
+			break
+		}
+		return e.Progress.LastPhysical, math.MaxUint64, nil
+	}
+	return 0, 0, ErrNoScrubToResume
+}
+
+// ScrubResult is a result of a scrub on a single device, see ScrubAll.
+type ScrubResult struct {
+	Progress ScrubProgress // progress at the end of the scrub
+	Err      error         // error of the scrub; syscall.ECANCELED if it was canceled
+}
+
+// ScrubAll scrubs all devices of the filesystem concurrently and waits for the scrubs to finish.
+// Missing devices are skipped. Results are returned by device id, including devices where
+// the scrub failed to start; the returned error is only set if the scrubs cannot be run at all.
+//
+// If the context is canceled, the scrubs are canceled as well, and ScrubAll returns ctx.Err()
+// after they stop, together with the results. The scrubs can be continued with ScrubResume.
+func (f *FS) ScrubAll(ctx context.Context) (map[uint64]ScrubResult, error) {
+	return f.ScrubAllWithFlags(ctx, 0)
+}
+
+// ScrubAllWithFlags is like ScrubAll, but accepts flags, e.g. ScrubFlagsReadOnly.
+func (f *FS) ScrubAllWithFlags(ctx context.Context, flags ScrubFlags) (map[uint64]ScrubResult, error) {
+	devs, err := f.Devices()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[uint64]ScrubResult, len(devs))
+	var handles []*ScrubHandle
+	for _, d := range devs {
+		if d.Path == "" {
+			continue // missing device
+		}
+		h, err := f.ScrubStartAsyncWithFlags(d.ID, 0, math.MaxUint64, flags)
+		if err != nil {
+			out[d.ID] = ScrubResult{Err: err}
+			continue
+		}
+		handles = append(handles, h)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, h := range handles {
+			h.Wait()
+		}
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		for _, h := range handles {
+			h.Cancel()
+		}
+		<-done
+	}
+	for _, h := range handles {
+		var r ScrubResult
+		r.Err = h.Wait()
+		r.Progress, _ = h.Progress()
+		out[h.Device()] = r
+	}
+	return out, ctx.Err()
+}
+
+// ScrubSample is a progress of a scrub at a given time.
+type ScrubSample struct {
+	Time     time.Time
+	Progress ScrubProgress
+}
+
+// ScrubRate is an estimate of the throughput and the completion time of a scrub, see ScrubEstimate.
+type ScrubRate struct {
+	BytesPerSec float64       // data and tree bytes scrubbed per second
+	Percent     float64       // percent of the device scrubbed, from 0 to 100
+	Remaining   time.Duration // estimated time until the scrub finishes; zero if unknown
+	ETA         time.Time     // estimated completion time; zero if unknown
+}
+
+// ScrubEstimate computes the throughput of a scrub from two progress samples, together with the
+// percent complete and the estimated completion time. The size is the number of bytes to scrub,
+// usually DevInfo.BytesUsed of the device. The rate is unknown if the samples are taken at the same
+// time, and the completion time is unknown if no bytes were scrubbed between the samples.
+func ScrubEstimate(prev, cur ScrubSample, size uint64) ScrubRate {
+	var r ScrubRate
+	done := cur.Progress.DataBytesScrubbed + cur.Progress.TreeBytesScrubbed
+	if size != 0 {
+		r.Percent = 100 * float64(done) / float64(size)
+		if r.Percent > 100 {
+			r.Percent = 100 // the device usage changed during the scrub
+		}
+	}
+	dt := cur.Time.Sub(prev.Time)
+	last := prev.Progress.DataBytesScrubbed + prev.Progress.TreeBytesScrubbed
+	if dt <= 0 || done < last {
+		return r
+	}
+	r.BytesPerSec = float64(done-last) / dt.Seconds()
+	if r.BytesPerSec == 0 || size == 0 {
+		return r
+	}
+	if done < size {
+		r.Remaining = time.Duration(float64(size-done) / r.BytesPerSec * float64(time.Second))
+	}
+	r.ETA = cur.Time.Add(r.Remaining)
+	return r
+}
+
+// ScrubHandle is a scrub running in the background, see ScrubStartAsync.
+type ScrubHandle struct {
+	fs   *FS
+	dev  uint64
+	done chan struct{}
+
+	mu   sync.Mutex
+	last ScrubProgress // progress at the end of the scrub
+	err  error
+}
+
+// ScrubStartAsync starts a scrub on the given device in the background and returns immediately.
+// Parameters are the same as for ScrubStart. The scrub is waited for and polled with the returned handle.
+//
+// It fails if a scrub is already running on the device. Other errors of the scrub are returned by Wait.
+func (f *FS) ScrubStartAsync(dev uint64, start uint64, end uint64) (*ScrubHandle, error) {
+	return f.ScrubStartAsyncWithFlags(dev, start, end, 0)
+}
+
+// ScrubStartAsyncWithFlags is like ScrubStartAsync, but accepts flags, e.g. ScrubFlagsReadOnly.
+func (f *FS) ScrubStartAsyncWithFlags(dev uint64, start uint64, end uint64, flags ScrubFlags) (*ScrubHandle, error) {
+	if err := f.revalidate(); err != nil {
+		return nil, err
+	}
+	if _, err := f.ScrubStatus(dev); err == nil {
+		return nil, fmt.Errorf("device %d: %v", dev, syscall.EINPROGRESS)
+	} else if err != syscall.ENOTCONN {
+		return nil, err
+	}
+	h := &ScrubHandle{fs: f, dev: dev, done: make(chan struct{})}
+	go func() {
+		defer close(h.done)
+		p, err := f.scrub(dev, start, end, flags)
+		h.mu.Lock()
+		h.last, h.err = p, err
+		h.mu.Unlock()
+	}()
+	return h, nil
+}
+
+// Device returns the id of the scrubbed device.
+func (h *ScrubHandle) Device() uint64 {
+	return h.dev
+}
+
+// Done returns a channel that is closed when the scrub finishes.
+func (h *ScrubHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait blocks until the scrub finishes and returns its error. A canceled scrub returns syscall.ECANCELED.
+func (h *ScrubHandle) Wait() error {
+	<-h.done
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// finished returns the result of the scrub, if it has finished.
+func (h *ScrubHandle) finished() (ScrubProgress, bool) {
+	select {
+	case <-h.done:
+	default:
+		return ScrubProgress{}, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.last, true
+}
+
+// Progress returns the current progress of the scrub, or the final one if it has finished.
+func (h *ScrubHandle) Progress() (ScrubProgress, error) {
+	if p, ok := h.finished(); ok {
+		return p, nil
+	}
+	p, err := h.fs.ScrubStatus(h.dev)
+	if err == syscall.ENOTCONN {
+		// finished after the check, or not started by the kernel yet
+		if p, ok := h.finished(); ok {
+			return p, nil
+		}
+		return ScrubProgress{}, nil
+	}
+	return p, err
+}
+
+// Cancel cancels the scrub and returns without waiting for it to stop. It does nothing
+// if the scrub has already finished.
+//
+// The kernel cancels scrubs on all devices of the filesystem at once,
+// thus scrubs started by other handles are canceled as well.
+func (h *ScrubHandle) Cancel() error {
+	if _, ok := h.finished(); ok {
+		return nil
+	}
+	err := h.fs.ScrubCancel(h.dev)
+	if err == syscall.ENOTCONN {
+		return nil
+	}
+	return err
+}
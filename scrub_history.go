@@ -0,0 +1,250 @@
+package btrfs
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// scrubHistoryMax is the number of scrub results kept per device.
+const scrubHistoryMax = 64
+
+const scrubHistoryVersion = 1
+
+// errNoStateDir is returned when the state is requested, but the state directory is not set.
+var errNoStateDir = errors.New("state directory is not set")
+
+// ScrubRecord is a result of a single scrub run on a device.
+type ScrubRecord struct {
+	DevID    uint64        `json:"devid"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+	Canceled bool          `json:"canceled,omitempty"`
+	ReadOnly bool          `json:"readonly,omitempty"` // errors were not repaired
+	Start    uint64        `json:"start,omitempty"`    // start of the physical range
+	End      uint64        `json:"end,omitempty"`      // end of the range, inclusive
+	Error    string        `json:"error,omitempty"`    // error returned by the scrub ioctl
+	Progress ScrubProgress `json:"progress"`
+}
+
+// HasErrors checks if the scrub found any errors.
+func (r *ScrubRecord) HasErrors() bool {
+	return r.Progress.HasErrors()
+}
+
+// HasErrors checks if the scrub found any errors, including corrected ones.
+func (p ScrubProgress) HasErrors() bool {
+	return p.ReadErrors != 0 || p.CsumErrors != 0 || p.VerifyErrors != 0 ||
+		p.SuperErrors != 0 || p.UncorrectableErrors != 0 || p.CorrectedErrors != 0
+}
+
+// LastScrubInfo summarizes the most recent scrub of all devices of the filesystem.
+type LastScrubInfo struct {
+	Finished time.Time     // when the last device finished the scrub
+	Errors   bool          // scrub found errors on any device
+	Canceled bool          // scrub was canceled on any device
+	Devices  []ScrubRecord // the most recent record for each device
+}
+
+type scrubHistoryFile struct {
+	Version int           `json:"version"`
+	FSID    string        `json:"fsid"`
+	Records []ScrubRecord `json:"records"`
+}
+
+// SetStateDir sets a directory where the state of the filesystem is persisted.
+// It is used to keep the history of scrub results and acknowledged device error counters.
+// Empty path disables the persistence.
+func (f *FS) SetStateDir(dir string) {
+	f.stateDir = dir
+}
+
+// StateDir returns a state directory set by SetStateDir.
+func (f *FS) StateDir() string {
+	return f.stateDir
+}
+
+// statePath returns a path of a state file with a given suffix for this filesystem,
+// together with the filesystem id.
+func (f *FS) statePath(suffix string) (string, FSID, error) {
+	if f.stateDir == "" {
+		return "", FSID{}, errNoStateDir
+	}
+	info, err := f.Info()
+	if err != nil {
+		return "", FSID{}, err
+	}
+	return filepath.Join(f.stateDir, info.FSID.String()+suffix), info.FSID, nil
+}
+
+func (f *FS) scrubHistoryPath() (string, FSID, error) {
+	return f.statePath(".scrub.json")
+}
+
+// recordScrub saves the scrub result to the history, if the state directory is set.
+func (f *FS) recordScrub(rec ScrubRecord) error {
+	if f.stateDir == "" {
+		return nil
+	}
+	path, fsid, err := f.scrubHistoryPath()
+	if err != nil {
+		return err
+	}
+	return appendScrubHistory(path, fsid.String(), rec)
+}
+
+// ScrubHistory returns all the recorded scrub results, ordered by the finish time.
+// The state directory must be set with SetStateDir.
+func (f *FS) ScrubHistory() ([]ScrubRecord, error) {
+	path, _, err := f.scrubHistoryPath()
+	if err != nil {
+		return nil, err
+	}
+	h, err := readScrubHistory(path)
+	if err != nil {
+		return nil, err
+	}
+	return h.Records, nil
+}
+
+// LastScrub returns the summary of the most recent scrub on each device.
+// It returns ErrNotFound if no scrubs were recorded. The state directory must be set with SetStateDir.
+func (f *FS) LastScrub() (*LastScrubInfo, error) {
+	recs, err := f.ScrubHistory()
+	if err != nil {
+		return nil, err
+	}
+	return lastScrub(recs)
+}
+
+func lastScrub(recs []ScrubRecord) (*LastScrubInfo, error) {
+	if len(recs) == 0 {
+		return nil, ErrNotFound
+	}
+	last := make(map[uint64]ScrubRecord)
+	for _, r := range recs {
+		if l, ok := last[r.DevID]; !ok || !r.Finished.Before(l.Finished) {
+			last[r.DevID] = r
+		}
+	}
+	info := &LastScrubInfo{}
+	for _, r := range last {
+		info.Devices = append(info.Devices, r)
+		if r.Finished.After(info.Finished) {
+			info.Finished = r.Finished
+		}
+		if r.HasErrors() || r.Error != "" {
+			info.Errors = true
+		}
+		if r.Canceled {
+			info.Canceled = true
+		}
+	}
+	sort.Slice(info.Devices, func(i, j int) bool {
+		return info.Devices[i].DevID < info.Devices[j].DevID
+	})
+	return info, nil
+}
+
+func readScrubHistory(path string) (*scrubHistoryFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &scrubHistoryFile{Version: scrubHistoryVersion}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var h scrubHistoryFile
+	if err = json.Unmarshal(data, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// scrubHistoryMu serializes updates of history files in this process.
+var scrubHistoryMu sync.Mutex
+
+// appendScrubHistory adds a record to the history file, dropping the oldest records
+// of the same device if there are more than scrubHistoryMax of them.
+func appendScrubHistory(path, fsid string, rec ScrubRecord) error {
+	scrubHistoryMu.Lock()
+	defer scrubHistoryMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	h, err := readScrubHistory(path)
+	if err != nil {
+		return err
+	}
+	h.Version = scrubHistoryVersion
+	h.FSID = fsid
+	h.Records = append(h.Records, rec)
+	sort.SliceStable(h.Records, func(i, j int) bool {
+		return h.Records[i].Finished.Before(h.Records[j].Finished)
+	})
+	cnt := make(map[uint64]int)
+	for _, r := range h.Records {
+		cnt[r.DevID]++
+	}
+	recs := h.Records[:0]
+	for _, r := range h.Records {
+		if cnt[r.DevID] > scrubHistoryMax {
+			cnt[r.DevID]--
+			continue
+		}
+		recs = append(recs, r)
+	}
+	h.Records = recs
+	data, err := json.MarshalIndent(h, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// lockFile takes an exclusive lock on a file, creating it if necessary.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "flock", Path: path, Err: err}
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
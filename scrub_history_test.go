@@ -0,0 +1,88 @@
+package btrfs
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScrubHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs-scrub-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state", "fsid.scrub.json")
+
+	if _, err := readScrubHistory(path); err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < scrubHistoryMax+5; i++ {
+		rec := ScrubRecord{DevID: 1, Started: t0, Finished: t0.Add(time.Duration(i) * time.Hour)}
+		if err := appendScrubHistory(path, "fsid", rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec := ScrubRecord{DevID: 2, Started: t0, Finished: t0.Add(time.Minute)}
+	rec.Progress.CsumErrors = 1
+	if err := appendScrubHistory(path, "fsid", rec); err != nil {
+		t.Fatal(err)
+	}
+	h, err := readScrubHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if h.FSID != "fsid" {
+		t.Fatalf("unexpected fsid: %q", h.FSID)
+	} else if len(h.Records) != scrubHistoryMax+1 {
+		t.Fatalf("unexpected number of records: %d", len(h.Records))
+	}
+	last, err := lastScrub(h.Records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := t0.Add((scrubHistoryMax + 4) * time.Hour); !last.Finished.Equal(exp) {
+		t.Fatalf("unexpected finish time: %v vs %v", last.Finished, exp)
+	} else if !last.Errors {
+		t.Fatal("expected errors")
+	} else if len(last.Devices) != 2 {
+		t.Fatalf("unexpected devices: %+v", last.Devices)
+	}
+	if _, err = lastScrub(nil); err != ErrNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestScrubResumePoint(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	recs := []ScrubRecord{
+		{DevID: 1, Finished: t0, Canceled: true, ReadOnly: true, Start: 0, End: 1 << 30},
+		{DevID: 2, Finished: t0, Canceled: true, End: 1 << 30},
+		{DevID: 2, Finished: t0.Add(time.Hour)},
+		{DevID: 3, Finished: t0, Error: "input/output error"},
+	}
+	recs[0].Progress.LastPhysical = 1 << 20
+	recs[3].Progress.LastPhysical = 1 << 20
+
+	start, end, flags, err := resumePoint(recs, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if start != 1<<20 || end != 1<<30 || flags != ScrubFlagsReadOnly {
+		t.Fatalf("unexpected resume point: [%d, %d], flags %d", start, end, flags)
+	}
+	if _, _, _, err = resumePoint(recs, 2); err != ErrNoScrubToResume {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	start, end, flags, err = resumePoint(recs, 3)
+	if err != nil {
+		t.Fatal(err)
+	} else if start != 1<<20 || end != math.MaxUint64 || flags != 0 {
+		t.Fatalf("unexpected resume point: [%d, %d], flags %d", start, end, flags)
+	}
+	if _, _, _, err = resumePoint(recs, 4); err != ErrNoScrubToResume {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
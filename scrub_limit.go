@@ -0,0 +1,99 @@
+package btrfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sysfsBtrfs is a sysfs directory with the attributes of mounted btrfs filesystems.
+const sysfsBtrfs = "/sys/fs/btrfs"
+
+// scrubSpeedMax is an attribute of a device that limits the scrub bandwidth, available since Linux 5.14.
+const scrubSpeedMax = "scrub_speed_max"
+
+// ScrubLimit is a bandwidth limit of scrub on a device, see ScrubLimits.
+type ScrubLimit struct {
+	DevID       uint64
+	BytesPerSec uint64 // zero means unlimited
+}
+
+// devinfoDir returns a sysfs directory with the attributes of devices of the filesystem.
+func (f *FS) devinfoDir() (string, error) {
+	info, err := f.Info()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(sysfsBtrfs, UUID(info.FSID).String(), "devinfo")
+	if _, err = os.Stat(dir); os.IsNotExist(err) {
+		return "", fmt.Errorf("device attributes are not supported by the kernel")
+	} else if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// ScrubLimits returns the scrub bandwidth limits of all devices, ordered by device id.
+// Limits are kept by the kernel until the filesystem is unmounted, see SetScrubLimit.
+func (f *FS) ScrubLimits() ([]ScrubLimit, error) {
+	dir, err := f.devinfoDir()
+	if err != nil {
+		return nil, err
+	}
+	return readScrubLimits(dir)
+}
+
+// SetScrubLimit limits the scrub bandwidth of a device, in bytes per second. Zero removes the limit.
+// The limit applies to running scrubs as well. Requires CAP_SYS_ADMIN and Linux 5.14.
+func (f *FS) SetScrubLimit(dev uint64, bytesPerSec uint64) error {
+	dir, err := f.devinfoDir()
+	if err != nil {
+		return err
+	}
+	return writeScrubLimit(dir, dev, bytesPerSec)
+}
+
+func readScrubLimits(dir string) ([]ScrubLimit, error) {
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []ScrubLimit
+	for _, fi := range names {
+		id, err := strconv.ParseUint(fi.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name(), scrubSpeedMax))
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("scrub limits are not supported by the kernel")
+		} else if err != nil {
+			return nil, err
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse scrub limit of device %d: %v", id, err)
+		}
+		out = append(out, ScrubLimit{DevID: id, BytesPerSec: v})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].DevID < out[j].DevID
+	})
+	return out, nil
+}
+
+func writeScrubLimit(dir string, dev uint64, bytesPerSec uint64) error {
+	ddir := filepath.Join(dir, strconv.FormatUint(dev, 10))
+	if _, err := os.Stat(ddir); os.IsNotExist(err) {
+		return fmt.Errorf("device %d: %v", dev, ErrNotFound)
+	}
+	path := filepath.Join(ddir, scrubSpeedMax)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return fmt.Errorf("scrub limits are not supported by the kernel")
+	}
+	return ioutil.WriteFile(path, []byte(strconv.FormatUint(bytesPerSec, 10)), 0644)
+}
@@ -0,0 +1,43 @@
+package btrfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScrubLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs-devinfo-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"1", "3", "10"} {
+		if err = os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, name, scrubSpeedMax), []byte("0\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writeScrubLimit(dir, 3, 50<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeScrubLimit(dir, 2, 50<<20); err == nil {
+		t.Fatal("expected an error for a missing device")
+	}
+	limits, err := readScrubLimits(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []ScrubLimit{{DevID: 1}, {DevID: 3, BytesPerSec: 50 << 20}, {DevID: 10}}
+	if len(limits) != len(exp) {
+		t.Fatalf("unexpected limits: %+v", limits)
+	}
+	for i := range exp {
+		if limits[i] != exp[i] {
+			t.Fatalf("unexpected limits: %+v", limits)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package btrfs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ScrubStatusDir is the directory where btrfs-progs keeps the status of scrubs.
+const ScrubStatusDir = "/var/lib/btrfs"
+
+const (
+	scrubStatusPrefix  = "scrub status"
+	scrubStatusVersion = 1
+)
+
+// ScrubFileEntry is a status of a scrub on a device, as stored in the scrub status file of btrfs-progs.
+type ScrubFileEntry struct {
+	DevID    uint64
+	Progress ScrubProgress
+	Started  time.Time     // start of the scrub
+	Resumed  time.Time     // last time the scrub was resumed, zero if it was not
+	Duration time.Duration // time spent scrubbing, excluding interruptions
+	Canceled bool
+	Finished bool // the scrub has stopped, either completed or failed; see Canceled
+}
+
+// Running checks if the entry describes a scrub that has not stopped yet.
+// It's also the case if the process running the scrub was killed.
+func (e *ScrubFileEntry) Running() bool {
+	return !e.Finished && !e.Canceled
+}
+
+// SetScrubStatusDir sets a directory where the status of scrubs is written in the format of btrfs-progs,
+// so that scrubs started by this package are reported by "btrfs scrub status" and vice versa.
+// It's usually ScrubStatusDir. Empty path disables the status file, which is the default.
+func (f *FS) SetScrubStatusDir(dir string) {
+	f.scrubStatusDir = dir
+}
+
+// ScrubStatusDir returns a scrub status directory set by SetScrubStatusDir.
+func (f *FS) ScrubStatusDir() string {
+	return f.scrubStatusDir
+}
+
+// ScrubStatusFile reads the status of the last scrub of each device from the status file
+// of btrfs-progs, in the directory set by SetScrubStatusDir. Entries are ordered by device id.
+// It returns ErrNotFound if there's no status file for this filesystem.
+func (f *FS) ScrubStatusFile() ([]ScrubFileEntry, error) {
+	path, fsid, err := f.scrubStatusPath()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readScrubStatusFile(path, fsid)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return entries, err
+}
+
+func (f *FS) scrubStatusPath() (string, FSID, error) {
+	if f.scrubStatusDir == "" {
+		return "", FSID{}, errNoStateDir
+	}
+	info, err := f.Info()
+	if err != nil {
+		return "", FSID{}, err
+	}
+	return filepath.Join(f.scrubStatusDir, "scrub.status."+UUID(info.FSID).String()), info.FSID, nil
+}
+
+// scrubStatusMu serializes updates of status files in this process. Same as btrfs-progs,
+// other processes are not locked out, but the file is replaced atomically.
+var scrubStatusMu sync.Mutex
+
+// updateScrubStatus changes an entry of a device in the status file, if the status directory is set.
+func (f *FS) updateScrubStatus(dev uint64, fn func(e *ScrubFileEntry, found bool)) error {
+	if f.scrubStatusDir == "" {
+		return nil
+	}
+	path, fsid, err := f.scrubStatusPath()
+	if err != nil {
+		return err
+	}
+	scrubStatusMu.Lock()
+	defer scrubStatusMu.Unlock()
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	entries, err := readScrubStatusFile(path, fsid)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].DevID >= dev
+	})
+	found := i < len(entries) && entries[i].DevID == dev
+	if !found {
+		entries = append(entries, ScrubFileEntry{})
+		copy(entries[i+1:], entries[i:])
+		entries[i] = ScrubFileEntry{DevID: dev}
+	}
+	fn(&entries[i], found)
+	var buf bytes.Buffer
+	writeScrubStatus(&buf, fsid, entries)
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// scrubStatusStart marks a scrub as running in the status file. A scrub that continues
+// an interrupted one from a non-zero offset is recorded as resumed, and the counters
+// of the interrupted scrub are returned, so they can be added to the new ones.
+func (f *FS) scrubStatusStart(dev, start uint64, now time.Time) (base *ScrubProgress, err error) {
+	err = f.updateScrubStatus(dev, func(e *ScrubFileEntry, found bool) {
+		if found && start != 0 && (e.Canceled || !e.Finished) {
+			p := e.Progress
+			base = &p
+			e.Resumed = now
+		} else {
+			*e = ScrubFileEntry{DevID: dev, Started: now}
+		}
+		e.Canceled, e.Finished = false, false
+	})
+	return base, err
+}
+
+// scrubStatusFinish records the result of a scrub started with scrubStatusStart.
+func (f *FS) scrubStatusFinish(dev uint64, base *ScrubProgress, p ScrubProgress, started time.Time, err error) error {
+	return f.updateScrubStatus(dev, func(e *ScrubFileEntry, found bool) {
+		if !found {
+			e.Started = started
+		}
+		if base != nil {
+			p = base.Add(p)
+		}
+		e.Progress = p
+		e.Duration += time.Since(started).Round(time.Second)
+		e.Canceled = err == syscall.ECANCELED
+		e.Finished = !e.Canceled
+	})
+}
+
+// Add returns the sum of counters of two scrubs, e.g. of different devices, or of an interrupted
+// scrub and the resumed one. LastPhysical is an address rather than a counter, thus the maximal one is kept.
+func (p ScrubProgress) Add(o ScrubProgress) ScrubProgress {
+	p.DataExtentsScrubbed += o.DataExtentsScrubbed
+	p.TreeExtentsScrubbed += o.TreeExtentsScrubbed
+	p.DataBytesScrubbed += o.DataBytesScrubbed
+	p.TreeBytesScrubbed += o.TreeBytesScrubbed
+	p.ReadErrors += o.ReadErrors
+	p.CsumErrors += o.CsumErrors
+	p.VerifyErrors += o.VerifyErrors
+	p.NoCsum += o.NoCsum
+	p.CsumDiscards += o.CsumDiscards
+	p.SuperErrors += o.SuperErrors
+	p.MallocErrors += o.MallocErrors
+	p.UncorrectableErrors += o.UncorrectableErrors
+	p.CorrectedErrors += o.CorrectedErrors
+	p.UnverifiedErrors += o.UnverifiedErrors
+	if o.LastPhysical > p.LastPhysical {
+		p.LastPhysical = o.LastPhysical
+	}
+	return p
+}
+
+// scrubStatusFields returns pointers to the counters of a scrub, by their names in the status file.
+// The order is the same as in the files written by btrfs-progs.
+func scrubStatusFields(p *ScrubProgress) []struct {
+	name string
+	v    *uint64
+} {
+	return []struct {
+		name string
+		v    *uint64
+	}{
+		{"data_extents_scrubbed", &p.DataExtentsScrubbed},
+		{"tree_extents_scrubbed", &p.TreeExtentsScrubbed},
+		{"data_bytes_scrubbed", &p.DataBytesScrubbed},
+		{"tree_bytes_scrubbed", &p.TreeBytesScrubbed},
+		{"read_errors", &p.ReadErrors},
+		{"csum_errors", &p.CsumErrors},
+		{"verify_errors", &p.VerifyErrors},
+		{"no_csum", &p.NoCsum},
+		{"csum_discards", &p.CsumDiscards},
+		{"super_errors", &p.SuperErrors},
+		{"malloc_errors", &p.MallocErrors},
+		{"uncorrectable_errors", &p.UncorrectableErrors},
+		{"corrected_errors", &p.CorrectedErrors},
+		{"last_physical", &p.LastPhysical},
+	}
+}
+
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func boolInt(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// writeScrubStatus writes the entries in the format of the scrub status file of btrfs-progs.
+func writeScrubStatus(w io.Writer, fsid FSID, entries []ScrubFileEntry) {
+	fmt.Fprintf(w, "%s:%d\n", scrubStatusPrefix, scrubStatusVersion)
+	id := UUID(fsid).String()
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s:%d|", id, e.DevID)
+		for _, c := range scrubStatusFields(&e.Progress) {
+			fmt.Fprintf(w, "%s:%d|", c.name, *c.v)
+		}
+		fmt.Fprintf(w, "t_start:%d|t_resumed:%d|duration:%d|canceled:%d|finished:%d\n",
+			unixTime(e.Started), unixTime(e.Resumed), int64(e.Duration/time.Second),
+			boolInt(e.Canceled), boolInt(e.Finished))
+	}
+}
+
+func readScrubStatusFile(path string, fsid FSID) ([]ScrubFileEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := parseScrubStatus(f, fsid)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return entries, nil
+}
+
+// parseScrubStatus reads entries of a given filesystem from a scrub status file of btrfs-progs.
+// Unknown fields are ignored, so files written by newer versions can be read as well.
+func parseScrubStatus(r io.Reader, fsid FSID) ([]ScrubFileEntry, error) {
+	sc := bufio.NewScanner(r)
+	if !sc.Scan() {
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		return nil, nil // progs creates an empty file before the first scrub
+	}
+	if v := strings.TrimPrefix(sc.Text(), scrubStatusPrefix+":"); v == sc.Text() {
+		return nil, fmt.Errorf("not a scrub status file")
+	} else if v != strconv.Itoa(scrubStatusVersion) {
+		return nil, fmt.Errorf("unsupported scrub status version: %s", v)
+	}
+	id := UUID(fsid).String()
+	var out []ScrubFileEntry
+	for line := 2; sc.Scan(); line++ {
+		fields := strings.Split(strings.TrimSpace(sc.Text()), "|")
+		if len(fields) == 0 || fields[0] == "" {
+			continue
+		}
+		i := strings.LastIndexByte(fields[0], ':')
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: invalid device: %q", line, fields[0])
+		} else if fields[0][:i] != id {
+			continue
+		}
+		devid, err := strconv.ParseUint(fields[0][i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid device id: %v", line, err)
+		}
+		e := ScrubFileEntry{DevID: devid}
+		counters := scrubStatusFields(&e.Progress)
+		for _, kv := range fields[1:] {
+			i := strings.IndexByte(kv, ':')
+			if i < 0 {
+				continue
+			}
+			v, err := strconv.ParseUint(kv[i+1:], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid value of %s: %v", line, kv[:i], err)
+			}
+			switch name := kv[:i]; name {
+			case "t_start":
+				if v != 0 {
+					e.Started = time.Unix(int64(v), 0)
+				}
+			case "t_resumed":
+				if v != 0 {
+					e.Resumed = time.Unix(int64(v), 0)
+				}
+			case "duration":
+				e.Duration = time.Duration(v) * time.Second
+			case "canceled":
+				e.Canceled = v != 0
+			case "finished":
+				e.Finished = v != 0
+			default:
+				for _, c := range counters {
+					if c.name == name {
+						*c.v = v
+						break
+					}
+				}
+			}
+		}
+		out = append(out, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].DevID < out[j].DevID
+	})
+	return out, nil
+}
@@ -0,0 +1,55 @@
+package btrfs
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testScrubStatus is a status file written by btrfs-progs, with an interrupted scrub of device 2
+// and a scrub of another filesystem.
+const testScrubStatus = `scrub status:1
+8d8c7f2c-1ae3-4b6a-9e3c-2d3f6c0a1b2e:1|data_extents_scrubbed:10|tree_extents_scrubbed:20|data_bytes_scrubbed:1048576|tree_bytes_scrubbed:327680|read_errors:0|csum_errors:2|verify_errors:0|no_csum:16|csum_discards:0|super_errors:0|malloc_errors:0|uncorrectable_errors:0|corrected_errors:2|last_physical:2147483648|t_start:1577836800|t_resumed:0|duration:62|canceled:0|finished:1
+8d8c7f2c-1ae3-4b6a-9e3c-2d3f6c0a1b2e:2|data_extents_scrubbed:5|tree_extents_scrubbed:7|data_bytes_scrubbed:524288|tree_bytes_scrubbed:114688|read_errors:0|csum_errors:0|verify_errors:0|no_csum:0|csum_discards:0|super_errors:0|malloc_errors:0|uncorrectable_errors:0|corrected_errors:0|last_physical:1073741824|t_start:1577836800|t_resumed:0|duration:31|canceled:1|finished:0
+00000000-1111-2222-3333-444444444444:1|data_extents_scrubbed:1|last_physical:1|t_start:1|t_resumed:0|duration:1|canceled:0|finished:1
+`
+
+var testScrubFSID = FSID{0x8d, 0x8c, 0x7f, 0x2c, 0x1a, 0xe3, 0x4b, 0x6a, 0x9e, 0x3c, 0x2d, 0x3f, 0x6c, 0x0a, 0x1b, 0x2e}
+
+func TestScrubStatusFile(t *testing.T) {
+	entries, err := parseScrubStatus(strings.NewReader(testScrubStatus), testScrubFSID)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	e := entries[0]
+	if e.DevID != 1 || !e.Finished || e.Canceled || e.Duration != 62*time.Second ||
+		!e.Started.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) || !e.Resumed.IsZero() {
+		t.Fatalf("unexpected entry: %+v", e)
+	} else if e.Progress.CsumErrors != 2 || e.Progress.DataBytesScrubbed != 1<<20 || e.Progress.LastPhysical != 2<<30 {
+		t.Fatalf("unexpected progress: %+v", e.Progress)
+	}
+
+	var buf bytes.Buffer
+	writeScrubStatus(&buf, testScrubFSID, entries)
+	if exp := strings.Join(strings.SplitAfter(testScrubStatus, "\n")[:3], ""); buf.String() != exp {
+		t.Fatalf("unexpected file:\n%s\nvs\n%s", buf.String(), exp)
+	}
+
+	if _, _, err = resumePointFile(entries, 1); err != ErrNoScrubToResume {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	start, end, err := resumePointFile(entries, 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if start != 1<<30 || end != math.MaxUint64 {
+		t.Fatalf("unexpected resume point: [%d, %d]", start, end)
+	}
+
+	if _, err = parseScrubStatus(strings.NewReader("scrub status:2\n"), testScrubFSID); err == nil {
+		t.Fatal("expected an error for an unknown version")
+	}
+}
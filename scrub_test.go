@@ -0,0 +1,35 @@
+package btrfs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScrubEstimate(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	prev := ScrubSample{Time: t0}
+	prev.Progress.DataBytesScrubbed = 100 << 20
+	cur := ScrubSample{Time: t0.Add(10 * time.Second)}
+	cur.Progress.DataBytesScrubbed = 900 << 20
+	cur.Progress.TreeBytesScrubbed = 200 << 20
+
+	r := ScrubEstimate(prev, cur, 4<<30)
+	if r.BytesPerSec != 100<<20 {
+		t.Fatalf("unexpected rate: %v", r.BytesPerSec)
+	} else if exp := 100 * float64(1100) / 4096; r.Percent != exp {
+		t.Fatalf("unexpected percent: %v vs %v", r.Percent, exp)
+	} else if exp := 29960 * time.Millisecond; r.Remaining != exp {
+		t.Fatalf("unexpected remaining time: %v vs %v", r.Remaining, exp)
+	} else if !r.ETA.Equal(cur.Time.Add(r.Remaining)) {
+		t.Fatalf("unexpected ETA: %v", r.ETA)
+	}
+
+	r = ScrubEstimate(cur, cur, 4<<30)
+	if r.BytesPerSec != 0 || !r.ETA.IsZero() || r.Percent == 0 {
+		t.Fatalf("unexpected estimate for the same sample: %+v", r)
+	}
+	r = ScrubEstimate(prev, cur, 1<<20)
+	if r.Percent != 100 || r.Remaining != 0 || !r.ETA.Equal(cur.Time) {
+		t.Fatalf("unexpected estimate for a finished scrub: %+v", r)
+	}
+}
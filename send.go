@@ -3,12 +3,157 @@ package btrfs
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"unsafe"
 )
 
+// SendOptions controls the stream produced by SendWithOptions.
+type SendOptions struct {
+	// Parent is a read-only snapshot to send an incremental stream from.
+	Parent string
+	// CloneSources are additional read-only snapshots the stream may reference. See SendWithClones.
+	CloneSources []string
+	// NoData produces a metadata-only stream. See SendMetadata.
+	NoData bool
+	// Compressed passes compressed extents as is. It requires protocol version 2. See SendCompressed.
+	Compressed bool
+	// OmitStreamHeader skips the stream header, so the output can be appended to another stream.
+	OmitStreamHeader bool
+	// OmitEndCmd skips the end command after the last subvolume, so more streams can be appended.
+	OmitEndCmd bool
+	// Proto is the protocol version of the stream, or one of the Proto constants.
+	// Older receivers only support version 1.
+	Proto int
+	// Flags are passed to the kernel as is, in addition to flags set by other options.
+	// It allows using flags that are not supported by this package yet.
+	Flags uint64
+}
+
+const (
+	// ProtoDefault selects version 1 of the send protocol, or version 2 if compressed data is sent.
+	ProtoDefault = 0
+	// ProtoAuto selects the newest version of the send protocol supported by the kernel.
+	ProtoAuto = -1
+)
+
+// flags returns send ioctl flags and the protocol version, which is zero if not set explicitly.
+// The maximal version is the one supported by the kernel.
+func (o *SendOptions) flags(max int) (uint64, uint32, error) {
+	flags := o.Flags
+	if o.NoData {
+		flags |= _BTRFS_SEND_FLAG_NO_FILE_DATA
+	}
+	if o.OmitStreamHeader {
+		flags |= _BTRFS_SEND_FLAG_OMIT_STREAM_HEADER
+	}
+	if o.OmitEndCmd {
+		flags |= _BTRFS_SEND_FLAG_OMIT_END_CMD
+	}
+	version := o.Proto
+	if version == ProtoAuto {
+		version = max
+	}
+	if o.Compressed {
+		flags |= _BTRFS_SEND_FLAG_COMPRESSED
+		if version == ProtoDefault {
+			version = 2
+		} else if version < 2 {
+			return 0, 0, fmt.Errorf("compressed data requires send protocol version 2, got %d", version)
+		}
+	}
+	if version < 0 {
+		return 0, 0, fmt.Errorf("invalid send protocol version: %d", version)
+	} else if version > max {
+		return 0, 0, fmt.Errorf("send protocol version %d is not supported by the kernel (maximal version is %d)", version, max)
+	} else if version != ProtoDefault {
+		flags |= _BTRFS_SEND_FLAG_VERSION
+	}
+	return flags, uint32(version), nil
+}
+
+const sysfsSendStreamVersion = "/sys/fs/btrfs/features/send_stream_version"
+
+// SendStreamVersion returns the newest version of the send protocol supported by the kernel.
+// Kernels that don't report it only support version 1.
+func SendStreamVersion() (int, error) {
+	data, err := ioutil.ReadFile(sysfsSendStreamVersion)
+	if os.IsNotExist(err) {
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse send stream version: %v", err)
+	}
+	return v, nil
+}
+
+// Send writes a send stream of read-only subvolumes to w, incremental from parent, if it's set.
+//
+// Multiple subvolumes are written as a single stream: it has one header, and only the last
+// subvolume is followed by the end command. For incremental streams, each subvolume may also
+// use the preceding ones as clone sources.
 func Send(w io.Writer, parent string, subvols ...string) error {
+	return SendWithOptions(w, &SendOptions{Parent: parent}, subvols...)
+}
+
+// SendMetadata is like Send, but produces a metadata-only stream: file data is not read,
+// and UpdateExtent commands are sent instead of writes and clones. Such streams are cheap
+// to generate and are useful for comparing snapshots or building catalogs of files.
+// Receiving such a stream recreates the file tree with sparse files of the same size.
+func SendMetadata(w io.Writer, parent string, subvols ...string) error {
+	return SendWithOptions(w, &SendOptions{Parent: parent, NoData: true}, subvols...)
+}
+
+// SendCompressed is like Send, but passes compressed extents to the stream as is,
+// instead of decompressing them. The stream uses protocol version 2, which requires
+// Linux 5.18+ on both sides. Receivers apply such extents with EncodedWrite,
+// avoiding both decompression on the sender and compression on the receiver.
+func SendCompressed(w io.Writer, parent string, subvols ...string) error {
+	return SendWithOptions(w, &SendOptions{Parent: parent, Compressed: true}, subvols...)
+}
+
+// SendWithClones is like Send, but also allows the stream to reference extents from
+// additional read-only snapshots (clone sources) instead of sending the data. All clone
+// sources must exist on the receiving side.
+//
+// If the parent is not set, the best parent for each subvolume is selected from clone sources;
+// if there is none, a full stream is sent, which still references extents of clone sources.
+func SendWithClones(w io.Writer, parent string, clones []string, subvols ...string) error {
+	return SendWithOptions(w, &SendOptions{Parent: parent, CloneSources: clones}, subvols...)
+}
+
+// SendWithOptions is like Send, but allows to control all flags of the stream,
+// for example to produce streams for receivers that only support a specific protocol version.
+func SendWithOptions(w io.Writer, opts *SendOptions, subvols ...string) error {
+	var o SendOptions
+	if opts != nil {
+		o = *opts
+	}
+	return sendSubvols(w, &o, subvols)
+}
+
+// sendSubvols sends subvolumes to w.
+func sendSubvols(w io.Writer, opts *SendOptions, subvols []string) error {
+	parent, clones := opts.Parent, opts.CloneSources
+	max := 1
+	if opts.Proto != ProtoDefault || opts.Compressed {
+		v, err := SendStreamVersion()
+		if err != nil {
+			return err
+		}
+		max = v
+	}
+	extra, version, err := opts.flags(max)
+	if err != nil {
+		return err
+	}
 	if len(subvols) == 0 {
 		return nil
 	}
@@ -39,6 +184,27 @@ func Send(w io.Writer, parent string, subvols ...string) error {
 		parentID = id
 		cloneSrc = append(cloneSrc, id)
 	}
+	for _, c := range clones {
+		c, err = filepath.Abs(c)
+		if err != nil {
+			return err
+		}
+		if mount, err := findMountRoot(c); err != nil {
+			return fmt.Errorf("cannot find mount root for %v: %v", c, err)
+		} else if mount != mountRoot {
+			return fmt.Errorf("clone sources must be from the same filesystem (%s is not)", c)
+		}
+		if ok, err := IsReadOnly(c); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("clone source %s is not read-only", c)
+		}
+		id, err := getPathRootID(c)
+		if err != nil {
+			return fmt.Errorf("cannot get clone source root id: %v", err)
+		}
+		cloneSrc = append(cloneSrc, id)
+	}
 	// check all subvolumes
 	paths := make([]string, 0, len(subvols))
 	for _, sub := range subvols {
@@ -68,7 +234,7 @@ func Send(w io.Writer, parent string, subvols ...string) error {
 	full := len(cloneSrc) == 0
 	for i, sub := range paths {
 		var rootID objectID
-		if !full && parent != "" {
+		if !full {
 			rel, err := filepath.Rel(mountRoot, sub)
 			if err != nil {
 				return err
@@ -78,8 +244,10 @@ func Send(w io.Writer, parent string, subvols ...string) error {
 				return fmt.Errorf("cannot find subvolume %s: %v", rel, err)
 			}
 			rootID = objectID(si.RootID)
-			parentID, err = findGoodParent(mfs.f, rootID, cloneSrc)
-			if err != nil {
+			parentID, err = findGoodParent(mountLookup{mfs.f}, rootID, cloneSrc)
+			if err == ErrNotFound && parent == "" {
+				parentID = 0 // full stream, but with clone sources
+			} else if err != nil {
 				return fmt.Errorf("cannot find good parent for %v: %v", rel, err)
 			}
 		}
@@ -87,34 +255,35 @@ func Send(w io.Writer, parent string, subvols ...string) error {
 		if err != nil {
 			return err
 		}
-		var flags uint64
+		flags := extra
 		if i != 0 { // not first
 			flags |= _BTRFS_SEND_FLAG_OMIT_STREAM_HEADER
 		}
 		if i < len(paths)-1 { // not last
 			flags |= _BTRFS_SEND_FLAG_OMIT_END_CMD
 		}
-		err = send(w, fs.f, parentID, cloneSrc, flags)
+		err = send(w, fs.f, parentID, cloneSrc, flags, version)
 		fs.Close()
 		if err != nil {
 			return fmt.Errorf("error sending %s: %v", sub, err)
 		}
-		if !full && parent != "" {
+		if !full {
 			cloneSrc = append(cloneSrc, rootID)
 		}
 	}
 	return nil
 }
 
-func send(w io.Writer, subvol *os.File, parent objectID, sources []objectID, flags uint64) error {
+func send(w io.Writer, subvol *os.File, parent objectID, sources []objectID, flags uint64, version uint32) error {
 	pr, pw, err := os.Pipe()
 	if err != nil {
 		return err
 	}
+	setPipeSize(pw, int(atomic.LoadInt64(&sendBufferSize)))
 	errc := make(chan error, 1)
 	go func() {
 		defer pr.Close()
-		_, err := io.Copy(w, pr)
+		_, err := copySendStream(w, pr)
 		errc <- err
 	}()
 	fd := pw.Fd()
@@ -123,13 +292,14 @@ func send(w io.Writer, subvol *os.File, parent objectID, sources []objectID, fla
 		return <-errc
 	}
 	args := &btrfs_ioctl_send_args{
-		send_fd:     int64(fd),
-		parent_root: parent,
-		flags:       flags,
+		SendFd:     int64(fd),
+		ParentRoot: uint64(parent),
+		Flags:      flags,
+		Version:    version,
 	}
 	if len(sources) != 0 {
-		args.clone_sources = &sources[0]
-		args.clone_sources_count = uint64(len(sources))
+		args.CloneSources = (*uint64)(&sources[0])
+		args.CloneSourcesCount = uint64(len(sources))
 	}
 	if err := iocSend(subvol, args); err != nil {
 		wait()
@@ -147,18 +317,18 @@ func send(w io.Writer, subvol *os.File, parent objectID, sources []objectID, fla
 // once mounted with an older kernel that was not aware of the root item structure change.
 func readRootItem(mnt *os.File, rootID objectID) (*rootItem, error) {
 	sk := btrfs_ioctl_search_key{
-		tree_id: rootTreeObjectid,
+		TreeID: uint64(rootTreeObjectid),
 		// There may be more than one ROOT_ITEM key if there are
 		// snapshots pending deletion, we have to loop through them.
-		min_objectid: rootID,
-		max_objectid: rootID,
-		min_type:     rootItemKey,
-		max_type:     rootItemKey,
-		max_offset:   maxUint64,
-		max_transid:  maxUint64,
-		nr_items:     4096,
-	}
-	for ; sk.min_offset < maxUint64; sk.min_offset++ {
+		MinObjectID: uint64(rootID),
+		MaxObjectID: uint64(rootID),
+		MinType:     uint32(rootItemKey),
+		MaxType:     uint32(rootItemKey),
+		MaxOffset:   maxUint64,
+		MaxTransID:  maxUint64,
+		NrItems:     4096,
+	}
+	for ; sk.MinOffset < maxUint64; sk.MinOffset++ {
 		results, err := treeSearchRaw(mnt, sk)
 		if err != nil {
 			return nil, err
@@ -166,9 +336,9 @@ func readRootItem(mnt *os.File, rootID objectID) (*rootItem, error) {
 			break
 		}
 		for _, r := range results {
-			sk.min_objectid = r.ObjectID
-			sk.min_type = r.Type
-			sk.min_offset = r.Offset
+			sk.MinObjectID = uint64(r.ObjectID)
+			sk.MinType = uint32(r.Type)
+			sk.MinOffset = r.Offset
 			if r.ObjectID > rootID {
 				break
 			}
@@ -184,24 +354,48 @@ func readRootItem(mnt *os.File, rootID objectID) (*rootItem, error) {
 			}
 		}
 		results = nil
-		if sk.min_type != rootItemKey || sk.min_objectid != rootID {
+		if treeKeyType(sk.MinType) != rootItemKey || objectID(sk.MinObjectID) != rootID {
 			break
 		}
 	}
 	return nil, ErrNotFound
 }
 
-func getParent(mnt *os.File, rootID objectID) (*SubvolInfo, error) {
-	st, err := subvolSearchByRootID(mnt, rootID, "")
+// subvolLookup finds subvolumes of a filesystem; see mountLookup.
+type subvolLookup interface {
+	byRootID(id objectID) (*SubvolInfo, error)
+	byUUID(uuid UUID) (*SubvolInfo, error)
+}
+
+// mountLookup finds subvolumes with tree searches on a mount point.
+type mountLookup struct {
+	mnt *os.File
+}
+
+func (l mountLookup) byRootID(id objectID) (*SubvolInfo, error) {
+	return subvolSearchByRootID(l.mnt, id, "")
+}
+
+func (l mountLookup) byUUID(uuid UUID) (*SubvolInfo, error) {
+	return subvolSearchByUUID(l.mnt, uuid)
+}
+
+func getParent(l subvolLookup, rootID objectID) (*SubvolInfo, error) {
+	st, err := l.byRootID(rootID)
 	if err != nil {
 		return nil, fmt.Errorf("cannot find subvolume %d to determine parent: %v", rootID, err)
 	}
-	return subvolSearchByUUID(mnt, st.ParentUUID)
+	return l.byUUID(st.ParentUUID)
 }
 
-func findGoodParent(mnt *os.File, rootID objectID, cloneSrc []objectID) (objectID, error) {
-	parent, err := getParent(mnt, rootID)
-	if err != nil {
+// findGoodParent selects a parent for an incremental stream of a subvolume among clone sources.
+// It prefers the subvolume it was snapshotted from, then its sibling snapshot with the closest
+// transaction id, and then repeats the search for the parent subvolume.
+func findGoodParent(l subvolLookup, rootID objectID, cloneSrc []objectID) (objectID, error) {
+	parent, err := getParent(l, rootID)
+	if err == ErrNotFound {
+		return 0, err
+	} else if err != nil {
 		return 0, fmt.Errorf("get parent failed: %v", err)
 	}
 	for _, id := range cloneSrc {
@@ -214,7 +408,7 @@ func findGoodParent(mnt *os.File, rootID objectID, cloneSrc []objectID) (objectI
 		bestDiff   uint64 = maxUint64
 	)
 	for _, id := range cloneSrc {
-		parent2, err := getParent(mnt, id)
+		parent2, err := getParent(l, id)
 		if err == ErrNotFound {
 			continue
 		} else if err != nil {
@@ -223,7 +417,7 @@ func findGoodParent(mnt *os.File, rootID objectID, cloneSrc []objectID) (objectI
 		if parent2.RootID != parent.RootID {
 			continue
 		}
-		parent2, err = subvolSearchByRootID(mnt, id, "")
+		parent2, err = l.byRootID(id)
 		if err != nil {
 			return 0, err
 		}
@@ -239,7 +433,7 @@ func findGoodParent(mnt *os.File, rootID objectID, cloneSrc []objectID) (objectI
 		return objectID(bestParent.RootID), nil
 	}
 	if !parent.ParentUUID.IsZero() {
-		return findGoodParent(mnt, objectID(parent.RootID), cloneSrc)
+		return findGoodParent(l, objectID(parent.RootID), cloneSrc)
 	}
 	return 0, ErrNotFound
 }
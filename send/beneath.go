@@ -0,0 +1,138 @@
+package send
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// ErrUnsafePath is returned by Receive for a stream command with a path that could
+// escape the subvolume being received. Such errors are never tolerated.
+type ErrUnsafePath struct {
+	Path   string
+	Reason string
+}
+
+func (e ErrUnsafePath) Error() string {
+	return "unsafe path in stream: " + e.Reason + ": " + escapePath(e.Path)
+}
+
+// checkStreamPath rejects paths that are absolute or contain ".." components.
+// Paths in the stream are always relative to the root of the subvolume.
+func checkStreamPath(p string) error {
+	if strings.HasPrefix(p, "/") {
+		return ErrUnsafePath{Path: p, Reason: "absolute path"}
+	}
+	for _, s := range strings.Split(p, "/") {
+		if s == ".." {
+			return ErrUnsafePath{Path: p, Reason: "parent directory reference"}
+		}
+	}
+	return nil
+}
+
+// checkSubvolName checks that the subvolume is created directly in the destination.
+func checkSubvolName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return ErrUnsafePath{Path: name, Reason: "invalid subvolume name"}
+	}
+	return nil
+}
+
+// checkBeneath checks that the parent directory of a path does not leave root.
+//
+// Sent paths always refer to real directories, thus a symlink in any component except the last one
+// means that the stream was crafted to redirect the following commands outside of the subvolume.
+// On Linux 5.6+ it is resolved with openat2 and RESOLVE_BENEATH; on older kernels each component
+// is checked with lstat. Missing directories are not reported, the command fails on its own.
+func checkBeneath(root, p string) error {
+	if err := checkStreamPath(p); err != nil {
+		return err
+	}
+	dir := filepath.Dir(p)
+	if dir == "." || dir == "/" {
+		return nil
+	}
+	err := openBeneath(root, dir)
+	if err == syscall.ENOSYS {
+		err = lstatBeneath(root, dir)
+	}
+	switch err {
+	case nil, syscall.ENOENT, syscall.ENOTDIR:
+		return nil
+	case syscall.ELOOP, syscall.EXDEV:
+		return ErrUnsafePath{Path: p, Reason: "symlink in the parent directory"}
+	}
+	return &os.PathError{Op: "openat2", Path: filepath.Join(root, dir), Err: err}
+}
+
+const (
+	sysOpenat2        = 437
+	oPath             = 0x200000
+	resolveNoSymlinks = 0x04
+	resolveBeneath    = 0x08
+)
+
+// noOpenat2 is set once openat2 is known to be unsupported.
+var noOpenat2 int32
+
+// openHow is struct open_how of openat2.
+type openHow struct {
+	Flags   uint64
+	Mode    uint64
+	Resolve uint64
+}
+
+// openBeneath resolves a directory relative to root with openat2. It returns ENOSYS if it's not supported.
+func openBeneath(root, dir string) error {
+	if atomic.LoadInt32(&noOpenat2) != 0 {
+		return syscall.ENOSYS
+	}
+	rfd, err := syscall.Open(root, oPath|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(rfd)
+	p, err := syscall.BytePtrFromString(dir)
+	if err != nil {
+		return err
+	}
+	how := openHow{
+		Flags:   oPath | syscall.O_DIRECTORY | syscall.O_CLOEXEC,
+		Resolve: resolveBeneath | resolveNoSymlinks,
+	}
+	fd, _, e := syscall.Syscall6(sysOpenat2, uintptr(rfd), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&how)), unsafe.Sizeof(how), 0, 0)
+	if e == syscall.ENOSYS || e == syscall.EPERM {
+		// EPERM is returned by some seccomp filters that do not know the syscall
+		atomic.StoreInt32(&noOpenat2, 1)
+		return syscall.ENOSYS
+	} else if e != 0 {
+		return e
+	}
+	syscall.Close(int(fd))
+	return nil
+}
+
+// lstatBeneath checks that no component of a directory path relative to root is a symlink.
+func lstatBeneath(root, dir string) error {
+	cur := root
+	for _, s := range strings.Split(dir, "/") {
+		if s == "" || s == "." {
+			continue
+		}
+		cur = filepath.Join(cur, s)
+		var st syscall.Stat_t
+		if err := syscall.Lstat(cur, &st); err != nil {
+			return err
+		} else if st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+			return syscall.ELOOP
+		} else if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			return syscall.ENOTDIR
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package send
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const dataChecksumsVersion = 1
+
+// DataVerifier checks file data applied by Receive, see ReceiveOptions.Verifier.
+type DataVerifier interface {
+	// VerifyWrite checks data of a write command at a given stream offset,
+	// as read back from the file after it was written.
+	VerifyWrite(off int64, path string, fileOff uint64, data []byte) error
+	// VerifyRange is called before a subvolume is marked as received, with the range of stream
+	// offsets applied by the receive. It should check that all expected writes were verified.
+	// If the receive was resumed, the range starts at the checkpoint.
+	VerifyRange(start, end int64) error
+}
+
+// ErrChecksumMismatch is returned by Receive if data written to a file doesn't match its checksum.
+type ErrChecksumMismatch struct {
+	Offset  int64 // stream offset of the command
+	Path    string
+	FileOff uint64
+}
+
+func (e ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("checksum mismatch of %s at %d (stream offset %d)", e.Path, e.FileOff, e.Offset)
+}
+
+// WriteChecksum is a checksum of the data of a single write command.
+type WriteChecksum struct {
+	Offset  int64  `json:"offset"` // stream offset of the command
+	Path    string `json:"path"`
+	FileOff uint64 `json:"file_offset"`
+	Len     int    `json:"len"`
+	Sum     string `json:"sum"` // hex-encoded
+}
+
+// DataChecksums lists checksums of file data in a stream, see ChecksumWriter.
+// It implements DataVerifier; an instance must only be used for a single Receive.
+type DataChecksums struct {
+	Version   int             `json:"version"`
+	Algorithm string          `json:"algorithm"`
+	Writes    []WriteChecksum `json:"writes"`
+
+	index map[int64]int // writes by stream offset
+	seen  map[int64]bool
+}
+
+func (d *DataChecksums) sum(data []byte) (string, error) {
+	h, err := newDigestHash(d.Algorithm)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyWrite implements DataVerifier.
+func (d *DataChecksums) VerifyWrite(off int64, path string, fileOff uint64, data []byte) error {
+	if d.index == nil {
+		d.index = make(map[int64]int, len(d.Writes))
+		d.seen = make(map[int64]bool, len(d.Writes))
+		for i, w := range d.Writes {
+			d.index[w.Offset] = i
+		}
+	}
+	i, ok := d.index[off]
+	if !ok {
+		return ErrChecksumMismatch{Offset: off, Path: path, FileOff: fileOff}
+	}
+	w := d.Writes[i]
+	sum, err := d.sum(data)
+	if err != nil {
+		return err
+	}
+	if w.Path != path || w.FileOff != fileOff || w.Len != len(data) || w.Sum != sum {
+		return ErrChecksumMismatch{Offset: off, Path: path, FileOff: fileOff}
+	}
+	d.seen[off] = true
+	return nil
+}
+
+// VerifyRange implements DataVerifier.
+func (d *DataChecksums) VerifyRange(start, end int64) error {
+	for _, w := range d.Writes {
+		if w.Offset >= start && w.Offset < end && !d.seen[w.Offset] {
+			return fmt.Errorf("write of %s at %d (stream offset %d) is missing", w.Path, w.FileOff, w.Offset)
+		}
+	}
+	return nil
+}
+
+// ReadChecksumFile reads checksums written by WriteChecksumFile.
+func ReadChecksumFile(path string) (*DataChecksums, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var d DataChecksums
+	if err = json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("cannot read checksums: %v", err)
+	} else if d.Version != dataChecksumsVersion {
+		return nil, fmt.Errorf("unsupported checksums version: %d", d.Version)
+	} else if _, err = newDigestHash(d.Algorithm); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// WriteChecksumFile writes checksums of stream data to a sidecar file.
+func WriteChecksumFile(path string, d *DataChecksums) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// ChecksumWriter passes a stream to the underlying writer and calculates checksums
+// of file data in it. Receive can verify the data written to files against them,
+// which protects the stream end-to-end, unlike the checksums of the stream itself.
+type ChecksumWriter struct {
+	w    io.Writer
+	pw   *io.PipeWriter
+	done chan error
+	sums *DataChecksums
+}
+
+// NewChecksumWriter creates a writer that calculates checksums with a given algorithm
+// (see DigestSHA256). Close must be called at the end of the stream.
+func NewChecksumWriter(w io.Writer, alg string) (*ChecksumWriter, error) {
+	if _, err := newDigestHash(alg); err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	cw := &ChecksumWriter{
+		w: w, pw: pw, done: make(chan error, 1),
+		sums: &DataChecksums{Version: dataChecksumsVersion, Algorithm: alg},
+	}
+	go func() {
+		err := cw.sums.read(pr)
+		pr.CloseWithError(err)
+		cw.done <- err
+	}()
+	return cw, nil
+}
+
+func (w *ChecksumWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		if _, err2 := w.pw.Write(p[:n]); err == nil {
+			err = err2
+		}
+	}
+	return n, err
+}
+
+// Close waits until all checksums are calculated. It doesn't close the underlying writer.
+func (w *ChecksumWriter) Close() error {
+	w.pw.Close()
+	return <-w.done
+}
+
+// Checksums returns checksums of the stream. It must only be called after Close.
+func (w *ChecksumWriter) Checksums() *DataChecksums {
+	return w.sums
+}
+
+// read calculates checksums of write commands in a stream. Offsets are calculated
+// the same way as in Receive.
+func (d *DataChecksums) read(r io.Reader) error {
+	cr := &countingReader{r: r}
+	sr, err := NewStreamReader(cr)
+	if err != nil {
+		return err
+	}
+	for {
+		off := cr.n
+		c, err := sr.ReadCommand()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch c := c.(type) {
+		case *WriteCmd:
+			sum, err := d.sum(c.Data)
+			if err != nil {
+				return err
+			}
+			d.Writes = append(d.Writes, WriteChecksum{
+				Offset: off, Path: c.Path, FileOff: c.Off, Len: len(c.Data), Sum: sum,
+			})
+		case *StreamEnd:
+			if err = sr.NextStream(); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package send
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dennwc/btrfs"
+)
+
+func TestDataChecksums(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	cw, err := NewChecksumWriter(out, DigestSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewStreamWriter(cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Cmd{
+		&SubvolCmd{Path: "vol", UUID: btrfs.UUID{1}, CTransID: 10},
+		&MkfileCmd{Path: "file", Ino: 257},
+		&WriteCmd{Path: "file", Data: []byte("data")},
+		&WriteCmd{Path: "file", Off: 4, Data: []byte("more")},
+		&StreamEnd{},
+	} {
+		if err = w.WriteCommand(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "btrfs-checksums-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sums.json")
+	if err = WriteChecksumFile(path, cw.Checksums()); err != nil {
+		t.Fatal(err)
+	}
+	sums, err := ReadChecksumFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(sums.Writes) != 2 {
+		t.Fatalf("unexpected checksums: %+v", sums.Writes)
+	}
+	w1, w2 := sums.Writes[0], sums.Writes[1]
+	if err = sums.VerifyWrite(w1.Offset, "file", 0, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err = sums.VerifyRange(0, int64(out.Len())); err == nil {
+		t.Fatal("expected an error for a missing write")
+	}
+	// resumed after the first write
+	if err = sums.VerifyRange(w2.Offset, int64(out.Len())); err == nil {
+		t.Fatal("expected an error for a missing write")
+	}
+	if err = sums.VerifyWrite(w2.Offset, "file", 4, []byte("mode")); err == nil {
+		t.Fatal("expected a mismatch")
+	} else if _, ok := err.(ErrChecksumMismatch); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = sums.VerifyWrite(w2.Offset, "file", 4, []byte("more")); err != nil {
+		t.Fatal(err)
+	}
+	if err = sums.VerifyRange(0, int64(out.Len())); err != nil {
+		t.Fatal(err)
+	}
+	if err = sums.VerifyWrite(w2.Offset+1, "file", 4, []byte("more")); err == nil {
+		t.Fatal("expected an error for an unknown write")
+	}
+}
@@ -0,0 +1,346 @@
+package send
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	chunkManifestVersion = 1
+	// DefaultChunkSize is the size of stream chunks used by ChunkWriter by default.
+	DefaultChunkSize = 64 * 1024 * 1024
+)
+
+// ChunkStore stores chunks of a stream and the manifest, for example as objects in a bucket.
+type ChunkStore interface {
+	// Create creates an object. The object must only become visible when it is closed without errors.
+	Create(name string) (io.WriteCloser, error)
+	// Open opens an object for reading.
+	Open(name string) (io.ReadCloser, error)
+}
+
+// DirChunkStore returns a store that keeps chunks as files in a directory.
+func DirChunkStore(dir string) ChunkStore {
+	return dirChunkStore(dir)
+}
+
+type dirChunkStore string
+
+func (d dirChunkStore) Create(name string) (io.WriteCloser, error) {
+	f, err := ioutil.TempFile(string(d), "."+name)
+	if err != nil {
+		return nil, err
+	}
+	return &dirChunkFile{File: f, path: filepath.Join(string(d), name)}, nil
+}
+
+func (d dirChunkStore) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), name))
+}
+
+// dirChunkFile is renamed to the final path when closed.
+type dirChunkFile struct {
+	*os.File
+	path string
+}
+
+func (f *dirChunkFile) Close() error {
+	err := f.File.Sync()
+	if err2 := f.File.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// ChunkInfo describes a single chunk of a stream.
+type ChunkInfo struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"` // see Digest.String
+}
+
+// ChunkManifest lists chunks of a stream in order. It's stored next to the chunks.
+type ChunkManifest struct {
+	Version   int         `json:"version"`
+	ChunkSize int64       `json:"chunk_size"`
+	Size      int64       `json:"size"`   // size of the complete stream
+	Digest    string      `json:"digest"` // digest of the complete stream
+	Chunks    []ChunkInfo `json:"chunks"`
+}
+
+// ManifestName returns the name of the manifest for a stream stored with a given name.
+func ManifestName(name string) string {
+	return name + ".manifest.json"
+}
+
+func chunkName(name string, i int) string {
+	return fmt.Sprintf("%s.%06d", name, i)
+}
+
+// ReadChunkManifest reads the manifest of a stream stored with a given name.
+func ReadChunkManifest(s ChunkStore, name string) (*ChunkManifest, error) {
+	rc, err := s.Open(ManifestName(name))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var m ChunkManifest
+	if err = json.NewDecoder(rc).Decode(&m); err != nil {
+		return nil, fmt.Errorf("cannot read chunk manifest: %v", err)
+	} else if m.Version != chunkManifestVersion {
+		return nil, fmt.Errorf("unsupported chunk manifest version: %d", m.Version)
+	}
+	return &m, nil
+}
+
+// ChunkWriter splits a stream into numbered chunks of a fixed size, suitable for uploading
+// to an object storage. Close must be called to write the last chunk and the manifest;
+// a stream without a manifest is incomplete.
+type ChunkWriter struct {
+	s    ChunkStore
+	name string
+	m    ChunkManifest
+	all  *DigestWriter
+
+	cur  io.WriteCloser
+	dw   *DigestWriter
+	size int64
+	err  error
+}
+
+// NewChunkWriter creates a writer that stores the stream as chunks named "<name>.NNNNNN"
+// and a manifest (see ManifestName). If size is zero, DefaultChunkSize is used.
+func NewChunkWriter(s ChunkStore, name string, size int64) (*ChunkWriter, error) {
+	if size == 0 {
+		size = DefaultChunkSize
+	} else if size < 0 {
+		return nil, fmt.Errorf("invalid chunk size: %d", size)
+	}
+	all, err := NewDigestWriter(ioutil.Discard, DigestSHA256)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkWriter{
+		s: s, name: name, all: all,
+		m: ChunkManifest{Version: chunkManifestVersion, ChunkSize: size},
+	}, nil
+}
+
+func (w *ChunkWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for len(p) > 0 {
+		if w.cur == nil {
+			if w.err = w.next(); w.err != nil {
+				return n, w.err
+			}
+		}
+		b := p
+		if rem := w.m.ChunkSize - w.size; int64(len(b)) > rem {
+			b = b[:rem]
+		}
+		k, err := w.dw.Write(b)
+		w.all.Write(b[:k])
+		w.size += int64(k)
+		n += k
+		p = p[k:]
+		if err != nil {
+			w.err = err
+			return n, err
+		}
+		if w.size == w.m.ChunkSize {
+			if w.err = w.flush(); w.err != nil {
+				return n, w.err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *ChunkWriter) next() error {
+	wc, err := w.s.Create(chunkName(w.name, len(w.m.Chunks)))
+	if err != nil {
+		return err
+	}
+	w.cur, w.size = wc, 0
+	w.dw, err = NewDigestWriter(wc, DigestSHA256)
+	return err
+}
+
+func (w *ChunkWriter) flush() error {
+	err := w.cur.Close()
+	if err != nil {
+		return err
+	}
+	w.m.Chunks = append(w.m.Chunks, ChunkInfo{
+		Name: chunkName(w.name, len(w.m.Chunks)), Size: w.size, Digest: w.dw.Digest().String(),
+	})
+	w.m.Size += w.size
+	w.cur, w.dw, w.size = nil, nil, 0
+	return nil
+}
+
+// Close writes the last chunk and the manifest.
+func (w *ChunkWriter) Close() error {
+	if w.err != nil {
+		if w.cur != nil {
+			w.cur.Close()
+			w.cur = nil
+		}
+		return w.err
+	}
+	if w.cur != nil {
+		if w.err = w.flush(); w.err != nil {
+			return w.err
+		}
+	}
+	w.m.Digest = w.all.Digest().String()
+	mw, err := w.s.Create(ManifestName(w.name))
+	if err != nil {
+		w.err = err
+		return err
+	}
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "\t")
+	err = enc.Encode(&w.m)
+	if err2 := mw.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		w.err = err
+		return err
+	}
+	w.err = errors.New("chunk writer is closed")
+	return nil
+}
+
+// Manifest returns the manifest of the chunks written so far.
+func (w *ChunkWriter) Manifest() ChunkManifest {
+	m := w.m
+	m.Chunks = append([]ChunkInfo(nil), m.Chunks...)
+	return m
+}
+
+// ErrChunkCorrupt is returned by ChunkReader when a chunk does not match the manifest.
+type ErrChunkCorrupt struct {
+	Name   string
+	Reason string
+}
+
+func (e ErrChunkCorrupt) Error() string {
+	return "chunk " + e.Name + " is corrupted: " + e.Reason
+}
+
+// ChunkReader reassembles a stream from chunks listed in the manifest, verifying their sizes
+// and digests. Corrupted chunks are reported as ErrChunkCorrupt. Since a chunk is only
+// verified when it's read completely, the data of a corrupted chunk may have been returned
+// already; the receive fails on the error in this case, and the stream is not marked as received.
+type ChunkReader struct {
+	s   ChunkStore
+	m   *ChunkManifest
+	i   int
+	cur io.ReadCloser
+	dr  *DigestWriter
+	n   int64
+	err error
+}
+
+// NewChunkReader creates a reader for the stream described by the manifest.
+func NewChunkReader(s ChunkStore, m *ChunkManifest) *ChunkReader {
+	return &ChunkReader{s: s, m: m}
+}
+
+// OpenChunks reads the manifest of a stream stored with a given name and opens the stream.
+func OpenChunks(s ChunkStore, name string) (*ChunkReader, error) {
+	m, err := ReadChunkManifest(s, name)
+	if err != nil {
+		return nil, err
+	}
+	return NewChunkReader(s, m), nil
+}
+
+func (r *ChunkReader) Read(p []byte) (int, error) {
+	for r.err == nil {
+		if r.cur == nil {
+			if r.i >= len(r.m.Chunks) {
+				r.err = io.EOF
+				break
+			}
+			c := r.m.Chunks[r.i]
+			rc, err := r.s.Open(c.Name)
+			if err != nil {
+				r.err = err
+				break
+			}
+			r.cur, r.n = rc, 0
+			r.dr, _ = NewDigestWriter(ioutil.Discard, DigestSHA256)
+		}
+		c := r.m.Chunks[r.i]
+		if r.n < c.Size {
+			if rem := c.Size - r.n; int64(len(p)) > rem {
+				p = p[:rem]
+			}
+			n, err := r.cur.Read(p)
+			r.dr.Write(p[:n])
+			r.n += int64(n)
+			if err == io.EOF && r.n < c.Size {
+				r.err = ErrChunkCorrupt{Name: c.Name, Reason: fmt.Sprintf("expected %d bytes, got %d", c.Size, r.n)}
+			} else if err != nil && err != io.EOF {
+				r.err = err
+			}
+			if n > 0 || r.err != nil {
+				return n, r.err
+			}
+			continue
+		}
+		r.err = r.finish(c)
+	}
+	return 0, r.err
+}
+
+// finish verifies the chunk that was read completely and closes it.
+func (r *ChunkReader) finish(c ChunkInfo) error {
+	var b [1]byte
+	n, _ := io.ReadFull(r.cur, b[:])
+	r.cur.Close()
+	r.cur = nil
+	r.i++
+	if n != 0 {
+		return ErrChunkCorrupt{Name: c.Name, Reason: fmt.Sprintf("larger than %d bytes", c.Size)}
+	}
+	if got := r.dr.Digest().String(); got != c.Digest {
+		return ErrChunkCorrupt{Name: c.Name, Reason: fmt.Sprintf("digest mismatch: expected %v, got %v", c.Digest, got)}
+	}
+	return nil
+}
+
+// Close closes the current chunk.
+func (r *ChunkReader) Close() error {
+	if r.cur != nil {
+		r.cur.Close()
+		r.cur = nil
+	}
+	if r.err == nil {
+		r.err = errors.New("chunk reader is closed")
+	}
+	return nil
+}
+
+// Digest returns the digest of the complete stream, as listed in the manifest.
+// It can be passed to ReceiveOptions to verify the whole stream.
+func (r *ChunkReader) Digest() (Digest, error) {
+	return ParseDigest(r.m.Digest)
+}
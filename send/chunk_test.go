@@ -0,0 +1,84 @@
+package send
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs-chunks-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := DirChunkStore(dir)
+
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+	w, err := NewChunkWriter(s, "stream", 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := data; len(p) > 0; {
+		n := 1500
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err = w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadChunkManifest(s, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Chunks) != 3 || m.Size != int64(len(data)) || m.Chunks[2].Size != 10000-2*4096 {
+		t.Fatalf("unexpected manifest: %+v", m)
+	}
+	r, err := OpenChunks(s, "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Fatal("data mismatch")
+	}
+	if d, err := r.Digest(); err != nil {
+		t.Fatal(err)
+	} else if d.String() != m.Digest {
+		t.Fatalf("unexpected digest: %v", d)
+	}
+
+	// corrupt the second chunk
+	path := filepath.Join(dir, m.Chunks[1].Name)
+	chunk, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk[10] ^= 0xff
+	if err = ioutil.WriteFile(path, chunk, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(NewChunkReader(s, m))
+	if e, ok := err.(ErrChunkCorrupt); !ok || e.Name != m.Chunks[1].Name {
+		t.Fatalf("expected corrupted chunk error, got %v", err)
+	}
+	// truncate it
+	if err = ioutil.WriteFile(path, chunk[:100], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(NewChunkReader(s, m)); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,38 @@
+package send
+
+import (
+	"errors"
+	"io"
+
+	"filippo.io/age"
+)
+
+// Encrypted streams use the age format (https://age-encryption.org), thus they can be decrypted
+// with other age implementations, and streams encrypted by them can be received.
+
+// ErrNoDecryptionKey is returned by NewDecryptReader if the stream is not encrypted to the key.
+var ErrNoDecryptionKey = errors.New("stream is not encrypted to the key")
+
+// NewEncryptWriter returns a writer that encrypts a stream to one or more age recipients and
+// writes it to w. Any of the corresponding identities can decrypt it with NewDecryptReader.
+// Close must be called to write the last chunk of the stream; it doesn't close w.
+func NewEncryptWriter(w io.Writer, recipients ...age.Recipient) (io.WriteCloser, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	return age.Encrypt(w, recipients...)
+}
+
+// NewDecryptReader reads the header of an age-encrypted stream and returns a reader of the
+// decrypted stream. It returns ErrNoDecryptionKey if the stream is not encrypted to any of
+// the identities.
+//
+// The reader returns an error if the stream was modified or truncated; data returned before
+// the error was authenticated, but the stream as a whole must not be trusted.
+func NewDecryptReader(r io.Reader, identities ...age.Identity) (io.Reader, error) {
+	dr, err := age.Decrypt(r, identities...)
+	if _, ok := err.(*age.NoIdentityMatchError); ok {
+		return nil, ErrNoDecryptionKey
+	}
+	return dr, err
+}
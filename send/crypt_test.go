@@ -0,0 +1,84 @@
+package send
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func encryptTest(t *testing.T, data []byte, keys ...age.Recipient) []byte {
+	buf := bytes.NewBuffer(nil)
+	w, err := NewEncryptWriter(buf, keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write in odd pieces to cross chunk boundaries
+	for p := data; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err = w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decryptTest(enc []byte, key age.Identity) ([]byte, error) {
+	r, err := NewDecryptReader(bytes.NewReader(enc), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestEncryptStream(t *testing.T) {
+	const chunkSize = 64 * 1024 // of the age payload
+	var keys []*age.X25519Identity
+	for i := 0; i < 3; i++ {
+		k, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	k1, k2, other := keys[0], keys[1], keys[2]
+	for _, size := range []int{0, 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		data := make([]byte, size)
+		rand.Read(data)
+		enc := encryptTest(t, data, k1.Recipient(), k2.Recipient())
+		for _, k := range []*age.X25519Identity{k1, k2} {
+			out, err := decryptTest(enc, k)
+			if err != nil {
+				t.Fatalf("size %d: %v", size, err)
+			} else if !bytes.Equal(out, data) {
+				t.Fatalf("size %d: data differs", size)
+			}
+		}
+		if _, err := decryptTest(enc, other); err != ErrNoDecryptionKey {
+			t.Fatalf("size %d: expected %v, got %v", size, ErrNoDecryptionKey, err)
+		}
+	}
+
+	data := make([]byte, 2*chunkSize+100)
+	enc := encryptTest(t, data, k1.Recipient())
+	const tagSize = 16
+	hdr := len(enc) - 3*tagSize - len(data)
+	for name, bad := range map[string][]byte{
+		"truncated": enc[:len(enc)-10],
+		"chunk":     enc[:hdr+2*(chunkSize+tagSize)],
+		"flipped":   append(append([]byte{}, enc[:hdr+10]...), append([]byte{enc[hdr+10] ^ 1}, enc[hdr+11:]...)...),
+	} {
+		if _, err := decryptTest(bad, k1); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package send
+
+import (
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dennwc/btrfs"
+)
+
+// ChangeType is a type of change between two snapshots.
+type ChangeType int
+
+const (
+	Created ChangeType = iota + 1
+	Deleted
+	Modified
+	Renamed
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case Created:
+		return "created"
+	case Deleted:
+		return "deleted"
+	case Modified:
+		return "modified"
+	case Renamed:
+		return "renamed"
+	}
+	return "unknown"
+}
+
+func (t ChangeType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// ChangeAttr is a set of file properties changed by a modification.
+type ChangeAttr uint
+
+const (
+	AttrData  ChangeAttr = 1 << iota // file data was written, cloned or preallocated
+	AttrSize                         // file was truncated
+	AttrMode                         // permissions were changed
+	AttrOwner                        // owner or group was changed
+	AttrXattr                        // extended attributes were set or removed
+	AttrFlags                        // inode flags were changed
+)
+
+var changeAttrNames = []string{"data", "size", "mode", "owner", "xattr", "flags"}
+
+func (a ChangeAttr) String() string {
+	var names []string
+	for i, name := range changeAttrNames {
+		if a&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (a ChangeAttr) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// Change describes a changed path between two snapshots.
+type Change struct {
+	Type    ChangeType `json:"type"`
+	Path    string     `json:"path"`               // path in the new snapshot; the old path for deleted files
+	OldPath string     `json:"old_path,omitempty"` // path in the old snapshot, for renamed files
+	Bytes   uint64     `json:"bytes"`              // number of bytes written or cloned
+	// Attrs and Xattrs are only set for modified and renamed paths.
+	Attrs  ChangeAttr `json:"attrs,omitempty"`  // properties that were changed
+	Xattrs []string   `json:"xattrs,omitempty"` // names of changed extended attributes
+}
+
+// tempName matches names that send uses for orphans and not yet linked inodes.
+var tempName = regexp.MustCompile(`^o[0-9]+-[0-9]+-[0-9]+$`)
+
+func isTempPath(p string) bool {
+	return tempName.MatchString(p[strings.LastIndexByte(p, '/')+1:])
+}
+
+type diffEntry struct {
+	created  bool
+	deleted  bool
+	modified bool
+	renamed  bool   // entry itself was renamed, not its parent
+	orig     string // path in the old snapshot
+	bytes    uint64
+	attrs    ChangeAttr
+	xattrs   []string
+}
+
+// differ reconstructs path-level changes from an incremental send stream.
+type differ struct {
+	cur     map[string]*diffEntry // current path -> entry
+	deleted []*diffEntry
+}
+
+// entry returns an entry for the current path, creating it if necessary.
+func (d *differ) entry(p string) *diffEntry {
+	if e := d.cur[p]; e != nil {
+		return e
+	}
+	// path might be inside of a renamed or created directory
+	orig, created := p, false
+	for dir := p; dir != ""; {
+		i := strings.LastIndexByte(dir, '/')
+		if i < 0 {
+			break
+		}
+		dir = dir[:i]
+		if e := d.cur[dir]; e != nil {
+			orig, created = e.orig+p[len(dir):], e.created
+			break
+		}
+	}
+	e := &diffEntry{orig: orig, created: created}
+	d.cur[p] = e
+	return e
+}
+
+func (d *differ) create(p string) {
+	d.cur[p] = &diffEntry{created: true}
+}
+
+func (d *differ) modify(p string, n uint64, attrs ChangeAttr) {
+	e := d.entry(p)
+	e.modified = true
+	e.bytes += n
+	e.attrs |= attrs
+}
+
+func (d *differ) modifyXattr(p, name string) {
+	d.modify(p, 0, AttrXattr)
+	e := d.cur[p]
+	for _, x := range e.xattrs {
+		if x == name {
+			return
+		}
+	}
+	e.xattrs = append(e.xattrs, name)
+}
+
+func (d *differ) remove(p string) {
+	e := d.entry(p)
+	delete(d.cur, p)
+	if !e.created {
+		e.deleted = true
+		d.deleted = append(d.deleted, e)
+	}
+	d.moveChildren(p, "")
+}
+
+func (d *differ) rename(from, to string) {
+	e := d.entry(from)
+	e.renamed = true
+	delete(d.cur, from)
+	d.cur[to] = e
+	d.moveChildren(from, to)
+}
+
+// moveChildren moves tracked entries inside of a directory to a new location.
+// If to is empty, entries are dropped.
+func (d *differ) moveChildren(from, to string) {
+	pref := from + "/"
+	for p, e := range d.cur {
+		if !strings.HasPrefix(p, pref) {
+			continue
+		}
+		delete(d.cur, p)
+		if to != "" {
+			d.cur[to+"/"+p[len(pref):]] = e
+		}
+	}
+}
+
+func (d *differ) apply(c Cmd) {
+	switch c := c.(type) {
+	case *MkfileCmd:
+		d.create(c.Path)
+	case *MkdirCmd:
+		d.create(c.Path)
+	case *RenameCmd:
+		d.rename(c.From, c.To)
+	case *WriteCmd:
+		d.modify(c.Path, uint64(len(c.Data)), AttrData)
+	case *TruncateCmd:
+		d.modify(c.Path, 0, AttrSize)
+	case *ChmodCmd:
+		d.modify(c.Path, 0, AttrMode)
+	case *ChownCmd:
+		d.modify(c.Path, 0, AttrOwner)
+	case *UTimesCmd:
+		// timestamps of parent directories are updated on any change; ignore them
+		d.entry(c.Path)
+	case *MknodCmd:
+		d.create(c.Path)
+	case *MkfifoCmd:
+		d.create(c.Path)
+	case *MksockCmd:
+		d.create(c.Path)
+	case *SymlinkCmd:
+		d.create(c.Path)
+	case *LinkCmd:
+		d.create(c.Path)
+	case *UnlinkCmd:
+		d.remove(c.Path)
+	case *RmdirCmd:
+		d.remove(c.Path)
+	case *CloneCmd:
+		d.modify(c.Path, c.Len, AttrData)
+	case *SetXattrCmd:
+		d.modifyXattr(c.Path, c.Name)
+	case *RemoveXattrCmd:
+		d.modifyXattr(c.Path, c.Name)
+	case *UpdateExtentCmd:
+		d.modify(c.Path, c.Size, AttrData)
+	case *EncodedWriteCmd:
+		d.modify(c.Path, c.Extent.Len, AttrData)
+	case *FallocateCmd:
+		d.modify(c.Path, 0, AttrData)
+	case *FileattrCmd:
+		d.modify(c.Path, 0, AttrFlags)
+	}
+}
+
+func (d *differ) changes() []Change {
+	var out []Change
+	for p, e := range d.cur {
+		if isTempPath(p) {
+			continue
+		}
+		switch {
+		case e.created:
+			out = append(out, Change{Type: Created, Path: p, Bytes: e.bytes})
+		case e.renamed && e.orig != p:
+			out = append(out, Change{Type: Renamed, Path: p, OldPath: e.orig, Bytes: e.bytes, Attrs: e.attrs, Xattrs: e.xattrs})
+		case e.modified:
+			out = append(out, Change{Type: Modified, Path: p, Bytes: e.bytes, Attrs: e.attrs, Xattrs: e.xattrs})
+		}
+	}
+	for _, e := range d.deleted {
+		out = append(out, Change{Type: Deleted, Path: e.orig})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Path == out[j].Path {
+			return out[i].Type < out[j].Type
+		}
+		return out[i].Path < out[j].Path
+	})
+	return out
+}
+
+// Diff reads an incremental send stream and returns the list of changed paths.
+// Changes that only affect timestamps are not reported.
+func Diff(r io.Reader) ([]Change, error) {
+	sr, err := NewStreamReader(r)
+	if err != nil {
+		return nil, err
+	}
+	d := &differ{cur: make(map[string]*diffEntry)}
+	for {
+		c, err := sr.ReadCommand()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if c.Type() == sendCmdEnd {
+			break
+		}
+		d.apply(c)
+	}
+	return d.changes(), nil
+}
+
+// DiffSnapshots returns the list of paths that changed between two read-only snapshots
+// of the same subvolume. It requires CAP_SYS_ADMIN, since a send stream is generated.
+// The stream is metadata-only, thus file data is not read.
+func DiffSnapshots(old, new string) ([]Change, error) {
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := btrfs.SendMetadata(pw, old, new)
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+	changes, err := Diff(pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if serr := <-errc; serr != nil && serr != io.ErrClosedPipe {
+		return nil, serr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// SubvolumeDiff is like DiffSnapshots, but the snapshots are given relative to fs.
+func SubvolumeDiff(fs *btrfs.FS, old, new string) ([]Change, error) {
+	return DiffSnapshots(filepath.Join(fs.Path(), old), filepath.Join(fs.Path(), new))
+}
@@ -0,0 +1,47 @@
+package send
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffer(t *testing.T) {
+	d := &differ{cur: make(map[string]*diffEntry)}
+	for _, c := range []Cmd{
+		&MkfileCmd{Path: "o257-7-0"},
+		&RenameCmd{From: "o257-7-0", To: "dir/new.txt"},
+		&WriteCmd{Path: "dir/new.txt", Data: make([]byte, 10)},
+		&RenameCmd{From: "a", To: "o260-5-0"},
+		&RenameCmd{From: "o260-5-0", To: "b"},
+		&WriteCmd{Path: "b/file", Data: make([]byte, 5)},
+		&UnlinkCmd{Path: "b/old"},
+		&UnlinkCmd{Path: "gone"},
+		&ChmodCmd{Path: "mod"},
+		&ChownCmd{Path: "mod"},
+		&SetXattrCmd{Path: "mod", Name: "user.a"},
+		&RemoveXattrCmd{Path: "mod", Name: "user.a"},
+		&UpdateExtentCmd{Path: "meta", Off: 4096, Size: 8192},
+		&UTimesCmd{Path: "dir"},
+	} {
+		d.apply(c)
+	}
+	exp := []Change{
+		{Type: Deleted, Path: "a/old"},
+		{Type: Renamed, Path: "b", OldPath: "a"},
+		{Type: Modified, Path: "b/file", Bytes: 5, Attrs: AttrData},
+		{Type: Created, Path: "dir/new.txt", Bytes: 10},
+		{Type: Deleted, Path: "gone"},
+		{Type: Modified, Path: "meta", Bytes: 8192, Attrs: AttrData},
+		{Type: Modified, Path: "mod", Attrs: AttrMode | AttrOwner | AttrXattr, Xattrs: []string{"user.a"}},
+	}
+	got := d.changes()
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected changes:\n%+v\nvs\n%+v", got, exp)
+	}
+}
+
+func TestChangeAttrString(t *testing.T) {
+	if s := (AttrData | AttrOwner | AttrFlags).String(); s != "data,owner,flags" {
+		t.Fatalf("unexpected string: %q", s)
+	}
+}
@@ -0,0 +1,117 @@
+package send
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Digest algorithms supported for send streams.
+const (
+	DigestSHA256 = "sha256"
+	DigestSHA512 = "sha512"
+)
+
+func newDigestHash(alg string) (hash.Hash, error) {
+	switch alg {
+	case DigestSHA256:
+		return sha256.New(), nil
+	case DigestSHA512:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported digest algorithm: %q", alg)
+}
+
+// Digest is a cryptographic hash of a complete send stream. Unlike the checksums
+// of individual commands, it detects lost, reordered or substituted commands.
+type Digest struct {
+	Algorithm string
+	Sum       []byte
+}
+
+// String returns the digest in the "<algorithm>:<hex>" form.
+func (d Digest) String() string {
+	return d.Algorithm + ":" + hex.EncodeToString(d.Sum)
+}
+
+// Equal checks if two digests are the same.
+func (d Digest) Equal(d2 Digest) bool {
+	return d.Algorithm == d2.Algorithm && bytes.Equal(d.Sum, d2.Sum)
+}
+
+// ParseDigest parses a digest in the "<algorithm>:<hex>" form.
+func ParseDigest(s string) (Digest, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return Digest{}, fmt.Errorf("invalid digest: %q", s)
+	}
+	d := Digest{Algorithm: s[:i]}
+	h, err := newDigestHash(d.Algorithm)
+	if err != nil {
+		return Digest{}, err
+	}
+	d.Sum, err = hex.DecodeString(s[i+1:])
+	if err != nil {
+		return Digest{}, fmt.Errorf("invalid digest: %v", err)
+	} else if len(d.Sum) != h.Size() {
+		return Digest{}, fmt.Errorf("invalid %s digest size: %d", d.Algorithm, len(d.Sum))
+	}
+	return d, nil
+}
+
+// ReadDigestFile reads a digest from a sidecar file written by WriteDigestFile.
+func ReadDigestFile(path string) (Digest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Digest{}, err
+	}
+	return ParseDigest(strings.TrimSpace(string(data)))
+}
+
+// WriteDigestFile writes a digest to a sidecar file.
+func WriteDigestFile(path string, d Digest) error {
+	return ioutil.WriteFile(path, []byte(d.String()+"\n"), 0644)
+}
+
+// ErrDigestMismatch is returned by Receive when the stream does not match the expected digest.
+type ErrDigestMismatch struct {
+	Expected, Actual Digest
+}
+
+func (e ErrDigestMismatch) Error() string {
+	return fmt.Sprintf("stream digest mismatch: expected %v, got %v", e.Expected, e.Actual)
+}
+
+// DigestWriter passes a stream to the underlying writer and calculates its digest.
+// It can wrap the writer passed to btrfs.Send.
+type DigestWriter struct {
+	w   io.Writer
+	alg string
+	h   hash.Hash
+}
+
+// NewDigestWriter creates a writer that calculates a digest with a given algorithm.
+func NewDigestWriter(w io.Writer, alg string) (*DigestWriter, error) {
+	h, err := newDigestHash(alg)
+	if err != nil {
+		return nil, err
+	}
+	return &DigestWriter{w: w, alg: alg, h: h}, nil
+}
+
+func (w *DigestWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.h.Write(p[:n])
+	return n, err
+}
+
+// Digest returns the digest of the data written so far.
+func (w *DigestWriter) Digest() Digest {
+	return Digest{Algorithm: w.alg, Sum: w.h.Sum(nil)}
+}
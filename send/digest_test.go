@@ -0,0 +1,48 @@
+package send
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDigest(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	dw, err := NewDigestWriter(buf, DigestSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewStreamWriter(dw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteCommand(&StreamEnd{}); err != nil {
+		t.Fatal(err)
+	}
+	d := dw.Digest()
+	d2, err := ParseDigest(d.String())
+	if err != nil {
+		t.Fatal(err)
+	} else if !d.Equal(d2) {
+		t.Fatalf("digests differ: %v vs %v", d, d2)
+	}
+	if _, err = ParseDigest("sha256:00"); err == nil {
+		t.Fatal("expected an error for a short digest")
+	}
+
+	dir, err := ioutil.TempDir("", "btrfs-digest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stream := buf.Bytes()
+	if _, err = Receive(bytes.NewReader(stream), dir, &ReceiveOptions{Digest: &d}); err != nil {
+		t.Fatal(err)
+	}
+	bad := Digest{Algorithm: DigestSHA256, Sum: make([]byte, len(d.Sum))}
+	_, err = Receive(bytes.NewReader(stream), dir, &ReceiveOptions{Digest: &bad})
+	if _, ok := err.(ErrDigestMismatch); !ok {
+		t.Fatalf("expected digest mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package send
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// dumpTimeFormat matches the time format of btrfs receive --dump.
+const dumpTimeFormat = "2006-01-02T15:04:05-0700"
+
+// DumpStream reads a send stream and writes its commands with their arguments to w,
+// one per line, in the same format as btrfs receive --dump. Nothing is applied.
+//
+// Paths are prefixed with the path of the subvolume they belong to.
+func DumpStream(r io.Reader, w io.Writer) error {
+	sr, err := NewStreamReader(r)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	var d dumper
+	for {
+		c, err := sr.ReadCommand()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			bw.Flush()
+			return err
+		}
+		if line := d.format(c); line != "" {
+			bw.WriteString(line)
+			bw.WriteByte('\n')
+		}
+		if c.Type() == sendCmdEnd {
+			if err = sr.NextStream(); err == io.EOF {
+				break
+			} else if err != nil {
+				bw.Flush()
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+type dumper struct {
+	subvol string // path of the current subvolume
+}
+
+func (d *dumper) path(p string) string {
+	return escapePath("./" + path.Join(d.subvol, p))
+}
+
+// format returns a line describing the command. It returns an empty string for commands
+// that are not printed.
+func (d *dumper) format(c Cmd) string {
+	var (
+		p    string
+		args string
+	)
+	switch c := c.(type) {
+	case *StreamEnd:
+		return ""
+	case *SubvolCmd:
+		d.subvol = c.Path
+		p = d.path("")
+		args = fmt.Sprintf("uuid=%v transid=%d", c.UUID, c.CTransID)
+	case *SnapshotCmd:
+		d.subvol = c.Path
+		p = d.path("")
+		args = fmt.Sprintf("uuid=%v transid=%d parent_uuid=%v parent_transid=%d",
+			c.UUID, c.CTransID, c.CloneUUID, c.CloneTransID)
+	case *MkfileCmd:
+		p = d.path(c.Path)
+	case *MkdirCmd:
+		p = d.path(c.Path)
+	case *MkfifoCmd:
+		p = d.path(c.Path)
+	case *MksockCmd:
+		p = d.path(c.Path)
+	case *MknodCmd:
+		p = d.path(c.Path)
+		args = fmt.Sprintf("mode=%o dev=0x%x", c.Mode, c.Rdev)
+	case *SymlinkCmd:
+		p = d.path(c.Path)
+		args = "dest=" + escapePath(c.Link)
+	case *RenameCmd:
+		p = d.path(c.From)
+		args = "dest=" + d.path(c.To)
+	case *LinkCmd:
+		p = d.path(c.Path)
+		args = "dest=" + escapePath(c.Link)
+	case *UnlinkCmd:
+		p = d.path(c.Path)
+	case *RmdirCmd:
+		p = d.path(c.Path)
+	case *WriteCmd:
+		p = d.path(c.Path)
+		args = fmt.Sprintf("offset=%d len=%d", c.Off, len(c.Data))
+	case *EncodedWriteCmd:
+		p = d.path(c.Path)
+		args = fmt.Sprintf("offset=%d len=%d unencoded_file_len=%d unencoded_len=%d unencoded_offset=%d compression=%d encryption=%d",
+			c.Off, len(c.Data), c.Extent.Len, c.Extent.UnencodedLen, c.Extent.UnencodedOffset,
+			uint32(c.Extent.Compression), c.Extent.Encryption)
+	case *CloneCmd:
+		p = d.path(c.Path)
+		args = fmt.Sprintf("offset=%d len=%d from=%s clone_offset=%d clone_uuid=%v clone_transid=%d",
+			c.Off, c.Len, escapePath(c.ClonePath), c.CloneOff, c.CloneUUID, c.CloneCTransID)
+	case *SetXattrCmd:
+		p = d.path(c.Path)
+		args = fmt.Sprintf("name=%s data=%s len=%d", escapePath(c.Name), escapePath(string(c.Data)), len(c.Data))
+	case *RemoveXattrCmd:
+		p = d.path(c.Path)
+		args = "name=" + escapePath(c.Name)
+	case *TruncateCmd:
+		p = d.path(c.Path)
+		args = fmt.Sprintf("size=%d", c.Size)
+	case *ChmodCmd:
+		p = d.path(c.Path)
+		args = fmt.Sprintf("mode=%o", c.Mode)
+	case *ChownCmd:
+		p = d.path(c.Path)
+		args = fmt.Sprintf("gid=%d uid=%d", c.GID, c.UID)
+	case *UTimesCmd:
+		p = d.path(c.Path)
+		args = fmt.Sprintf("atime=%s mtime=%s ctime=%s",
+			dumpTime(c.ATime), dumpTime(c.MTime), dumpTime(c.CTime))
+	case *UpdateExtentCmd:
+		p = d.path(c.Path)
+		args = fmt.Sprintf("offset=%d len=%d", c.Off, c.Size)
+	case *FallocateCmd:
+		p = d.path(c.Path)
+		args = fmt.Sprintf("mode=%d offset=%d len=%d", c.Mode, c.Off, c.Size)
+	case *FileattrCmd:
+		p = d.path(c.Path)
+		args = fmt.Sprintf("fileattr=0x%x", c.Attr)
+	case *UnknownSendCmd:
+		args = fmt.Sprintf("attrs=%d", len(c.Params))
+	}
+	line := fmt.Sprintf("%-16s%-32s", c.Type(), p)
+	if args != "" {
+		line += " " + args
+	}
+	return strings.TrimRight(line, " ")
+}
+
+func dumpTime(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return t.Format(dumpTimeFormat)
+}
+
+// escapePath escapes whitespace, backslashes and non-printable characters, so each command
+// stays on a single line, and its arguments can be separated by spaces.
+func escapePath(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\':
+			b.WriteString(`\\`)
+		case c <= ' ' || c >= 0x7f:
+			fmt.Fprintf(&b, `\%03o`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,83 @@
+package send
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/dennwc/btrfs"
+)
+
+func TestDumpStream(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w, err := NewStreamWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Cmd{
+		&SubvolCmd{Path: "vol", UUID: btrfs.UUID{1}, CTransID: 10},
+		&MkfileCmd{Path: "o257-7-0", Ino: 257},
+		&RenameCmd{From: "o257-7-0", To: "a file"},
+		&WriteCmd{Path: "a file", Off: 4096, Data: make([]byte, 100)},
+		&ChmodCmd{Path: "a file", Mode: 0644},
+		&StreamEnd{},
+	} {
+		if err = w.WriteCommand(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := bytes.NewBuffer(nil)
+	if err = DumpStream(buf, out); err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{
+		"subvol          ./vol                            uuid=" + btrfs.UUID{1}.String() + " transid=10",
+		"mkfile          ./vol/o257-7-0",
+		`rename          ./vol/o257-7-0                   dest=./vol/a\040file`,
+		`write           ./vol/a\040file                  offset=4096 len=100`,
+		`chmod           ./vol/a\040file                  mode=644`,
+	}
+	if got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"); strings.Join(got, "\n") != strings.Join(exp, "\n") {
+		t.Fatalf("unexpected dump:\n%s\nvs\n%s", strings.Join(got, "\n"), strings.Join(exp, "\n"))
+	}
+}
+
+func TestDumpStreamConcat(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	// two subvolumes in one stream, as sent with omitted end command, followed by another stream
+	for _, cmds := range [][]Cmd{
+		{
+			&SubvolCmd{Path: "a", UUID: btrfs.UUID{1}, CTransID: 10},
+			&MkdirCmd{Path: "x", Ino: 257},
+			&SubvolCmd{Path: "b", UUID: btrfs.UUID{2}, CTransID: 11},
+			&MkdirCmd{Path: "y", Ino: 257},
+			&StreamEnd{},
+		},
+		{
+			&SnapshotCmd{Path: "c", UUID: btrfs.UUID{3}, CTransID: 12, CloneUUID: btrfs.UUID{2}, CloneTransID: 11},
+			&MkdirCmd{Path: "z", Ino: 258},
+			&StreamEnd{},
+		},
+	} {
+		w, err := NewStreamWriter(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range cmds {
+			if err = w.WriteCommand(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	out := bytes.NewBuffer(nil)
+	if err := DumpStream(buf, out); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		paths = append(paths, strings.Fields(line)[1])
+	}
+	if got, exp := strings.Join(paths, " "), "./a ./a/x ./b ./b/y ./c ./c/z"; got != exp {
+		t.Fatalf("unexpected dump: %s", out.String())
+	}
+}
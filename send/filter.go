@@ -0,0 +1,230 @@
+package send
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/dennwc/btrfs"
+)
+
+// filePaths returns pointers to all paths of files in the subvolume referenced by the command.
+// Names of subvolumes, symlink targets and paths in clone sources are not included.
+func filePaths(c Cmd) []*string {
+	switch c := c.(type) {
+	case *MkfileCmd:
+		return []*string{&c.Path}
+	case *MkdirCmd:
+		return []*string{&c.Path}
+	case *MknodCmd:
+		return []*string{&c.Path}
+	case *MkfifoCmd:
+		return []*string{&c.Path}
+	case *MksockCmd:
+		return []*string{&c.Path}
+	case *SymlinkCmd:
+		return []*string{&c.Path}
+	case *LinkCmd:
+		return []*string{&c.Path, &c.Link}
+	case *UnlinkCmd:
+		return []*string{&c.Path}
+	case *RmdirCmd:
+		return []*string{&c.Path}
+	case *RenameCmd:
+		return []*string{&c.From, &c.To}
+	case *WriteCmd:
+		return []*string{&c.Path}
+	case *TruncateCmd:
+		return []*string{&c.Path}
+	case *ChmodCmd:
+		return []*string{&c.Path}
+	case *ChownCmd:
+		return []*string{&c.Path}
+	case *UTimesCmd:
+		return []*string{&c.Path}
+	case *SetXattrCmd:
+		return []*string{&c.Path}
+	case *RemoveXattrCmd:
+		return []*string{&c.Path}
+	case *CloneCmd:
+		return []*string{&c.Path}
+	case *UpdateExtentCmd:
+		return []*string{&c.Path}
+	case *FallocateCmd:
+		return []*string{&c.Path}
+	case *FileattrCmd:
+		return []*string{&c.Path}
+	case *EncodedWriteCmd:
+		return []*string{&c.Path}
+	}
+	return nil
+}
+
+// matchGlobs checks if a path matches any of the patterns. Patterns without a slash
+// match names of files and directories at any depth, other patterns match the whole path.
+func matchGlobs(patterns []string, p string) bool {
+	base := p[strings.LastIndexByte(p, '/')+1:]
+	for _, pat := range patterns {
+		name := p
+		if !strings.ContainsRune(pat, '/') {
+			name = base
+		}
+		if ok, _ := path.Match(strings.TrimPrefix(pat, "/"), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func checkGlobs(patterns []string) error {
+	for _, pat := range patterns {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pat, err)
+		}
+	}
+	return nil
+}
+
+// ExcludeGlobs is like ExcludePaths, but excludes files and directories matching glob patterns
+// (see path.Match). Patterns without a slash match names at any depth (e.g. "*.tmp"),
+// other patterns match paths relative to the subvolume root (e.g. "var/cache").
+func ExcludeGlobs(patterns ...string) (Transform, error) {
+	if err := checkGlobs(patterns); err != nil {
+		return nil, err
+	}
+	return ExcludePaths(func(p string) bool {
+		return matchGlobs(patterns, p)
+	}), nil
+}
+
+// DropXattrGlobs is like DropXattrs, but removes extended attributes with names matching
+// glob patterns (e.g. "user.*").
+func DropXattrGlobs(patterns ...string) (Transform, error) {
+	if err := checkGlobs(patterns); err != nil {
+		return nil, err
+	}
+	return DropXattrs(func(name string) bool {
+		for _, pat := range patterns {
+			if ok, _ := path.Match(pat, name); ok {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+// RewritePrefix moves files under one directory of the subvolume to another one. Paths are relative
+// to the subvolume root, and prefixes only match whole path elements. The parent of the new
+// location must exist in the received subvolume.
+func RewritePrefix(from, to string) Transform {
+	from, to = strings.Trim(from, "/"), strings.Trim(to, "/")
+	rewrite := func(p string) string {
+		if p == from {
+			return to
+		} else if strings.HasPrefix(p, from+"/") {
+			return to + p[len(from):]
+		}
+		return p
+	}
+	var cur btrfs.UUID // current subvolume
+	return TransformFunc(func(c Cmd) ([]Cmd, error) {
+		switch c := c.(type) {
+		case *SubvolCmd:
+			cur = c.UUID
+		case *SnapshotCmd:
+			cur = c.UUID
+		case *CloneCmd:
+			// clones from the same subvolume refer to rewritten paths
+			if c.CloneUUID == cur {
+				c.ClonePath = rewrite(c.ClonePath)
+			}
+		}
+		for _, p := range filePaths(c) {
+			*p = rewrite(*p)
+		}
+		return []Cmd{c}, nil
+	})
+}
+
+// FilterOptions is a set of common stream transformations, see Transforms.
+type FilterOptions struct {
+	Exclude        []string          // glob patterns of paths to exclude, see ExcludeGlobs
+	Rewrite        map[string]string // path prefixes to rewrite, see RewritePrefix
+	DropXattrs     []string          // glob patterns of extended attributes to remove
+	StripSecurity  bool              // remove security labels, see StripSecurityLabels
+	UIDMap, GIDMap map[uint64]uint64 // owners to change, see RemapOwners
+}
+
+// Transforms returns transforms that implement the options. Files are excluded
+// before paths are rewritten, thus exclude patterns refer to original paths.
+func (o *FilterOptions) Transforms() ([]Transform, error) {
+	var out []Transform
+	if len(o.Exclude) != 0 {
+		t, err := ExcludeGlobs(o.Exclude...)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	// rewrite longer prefixes first, so the result doesn't depend on the order of the map
+	prefixes := make([]string, 0, len(o.Rewrite))
+	for from, to := range o.Rewrite {
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("invalid path rewrite: %q -> %q", from, to)
+		}
+		prefixes = append(prefixes, from)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if len(prefixes[i]) != len(prefixes[j]) {
+			return len(prefixes[i]) > len(prefixes[j])
+		}
+		return prefixes[i] < prefixes[j]
+	})
+	for _, from := range prefixes {
+		out = append(out, RewritePrefix(from, o.Rewrite[from]))
+	}
+	if len(o.DropXattrs) != 0 {
+		t, err := DropXattrGlobs(o.DropXattrs...)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	if o.StripSecurity {
+		out = append(out, StripSecurityLabels())
+	}
+	if len(o.UIDMap) != 0 || len(o.GIDMap) != 0 {
+		out = append(out, RemapOwners(o.UIDMap, o.GIDMap))
+	}
+	return out, nil
+}
+
+// NewTransformWriter returns a writer that transforms the stream written to it with
+// TransformStream and writes the result to w. Close must be called to wait for the
+// transformation to complete; it returns the error of the transformation, if any.
+func NewTransformWriter(w io.Writer, transforms ...Transform) io.WriteCloser {
+	pr, pw := io.Pipe()
+	tw := &transformWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := TransformStream(w, pr, transforms...)
+		pr.CloseWithError(err)
+		tw.done <- err
+	}()
+	return tw
+}
+
+type transformWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *transformWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *transformWriter) Close() error {
+	w.pw.Close()
+	return <-w.done
+}
@@ -0,0 +1,61 @@
+package send
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dennwc/btrfs"
+)
+
+func TestMatchGlobs(t *testing.T) {
+	patterns := []string{"*.tmp", "var/cache", "/home/*/.cache"}
+	for p, exp := range map[string]bool{
+		"a.tmp":                 true,
+		"dir/b.tmp":             true,
+		"var/cache":             true,
+		"var/cache2":            false,
+		"srv/var/cache":         false,
+		"home/user/.cache":      true,
+		"home/user/.cache/file": false, // parents are checked by ExcludePaths
+		"file":                  false,
+	} {
+		if got := matchGlobs(patterns, p); got != exp {
+			t.Errorf("%q: expected %v, got %v", p, exp, got)
+		}
+	}
+	if _, err := ExcludeGlobs("[a-"); err == nil {
+		t.Fatal("expected an error for an invalid pattern")
+	}
+}
+
+func TestRewritePrefix(t *testing.T) {
+	tr := RewritePrefix("/srv/old/", "srv/new")
+	var got []Cmd
+	for _, c := range []Cmd{
+		&SubvolCmd{Path: "vol", UUID: btrfs.UUID{1}},
+		&RenameCmd{From: "o257-7-0", To: "srv/old"},
+		&WriteCmd{Path: "srv/old/file"},
+		&WriteCmd{Path: "srv/older"},
+		&CloneCmd{Path: "srv/old/copy", CloneUUID: btrfs.UUID{1}, ClonePath: "srv/old/file"},
+		&CloneCmd{Path: "srv/old/copy", CloneUUID: btrfs.UUID{2}, ClonePath: "srv/old/file"},
+		&SymlinkCmd{Path: "srv/old/link", Link: "srv/old/file"},
+	} {
+		out, err := tr.Transform(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, out...)
+	}
+	exp := []Cmd{
+		&SubvolCmd{Path: "vol", UUID: btrfs.UUID{1}},
+		&RenameCmd{From: "o257-7-0", To: "srv/new"},
+		&WriteCmd{Path: "srv/new/file"},
+		&WriteCmd{Path: "srv/older"},
+		&CloneCmd{Path: "srv/new/copy", CloneUUID: btrfs.UUID{1}, ClonePath: "srv/new/file"},
+		&CloneCmd{Path: "srv/new/copy", CloneUUID: btrfs.UUID{2}, ClonePath: "srv/old/file"},
+		&SymlinkCmd{Path: "srv/new/link", Link: "srv/old/file"},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected commands:\n%s\nvs\n%s", dumpCmds(got), dumpCmds(exp))
+	}
+}
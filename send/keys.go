@@ -0,0 +1,110 @@
+package send
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"filippo.io/age"
+)
+
+// Key types supported by GenerateKey.
+const (
+	KeyX25519  = "x25519"  // encryption, see NewEncryptWriter
+	KeyEd25519 = "ed25519" // signatures, see SignDigest
+)
+
+// GenerateKey generates a private key of a given type. The result is either *age.X25519Identity
+// or ed25519.PrivateKey.
+func GenerateKey(typ string) (interface{}, error) {
+	switch typ {
+	case KeyX25519:
+		return age.GenerateX25519Identity()
+	case KeyEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported key type: %q", typ)
+}
+
+// PublicKey returns a public key that corresponds to a private key returned by GenerateKey.
+func PublicKey(key interface{}) (interface{}, error) {
+	switch key := key.(type) {
+	case *age.X25519Identity:
+		return key.Recipient(), nil
+	case ed25519.PrivateKey:
+		return key.Public(), nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %T", key)
+}
+
+// WriteKeyFile writes a private or a public key to a file. X25519 keys are stored in the age format,
+// and Ed25519 keys are stored in PEM files: private keys in PKCS #8 form, and public keys in PKIX form.
+// Thus the files are compatible with other tools like age and openssl.
+func WriteKeyFile(path string, key interface{}) error {
+	switch key := key.(type) {
+	case *age.X25519Identity:
+		data := "# public key: " + key.Recipient().String() + "\n" + key.String() + "\n"
+		return ioutil.WriteFile(path, []byte(data), 0600)
+	case *age.X25519Recipient:
+		return ioutil.WriteFile(path, []byte(key.String()+"\n"), 0644)
+	}
+	var (
+		b    pem.Block
+		perm os.FileMode = 0644
+		err  error
+	)
+	switch key.(type) {
+	case ed25519.PrivateKey:
+		b.Type, perm = "PRIVATE KEY", 0600
+		b.Bytes, err = x509.MarshalPKCS8PrivateKey(key)
+	default:
+		b.Type = "PUBLIC KEY"
+		b.Bytes, err = x509.MarshalPKIXPublicKey(key)
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&b), perm)
+}
+
+// ReadKeyFile reads a private or a public key from a file written by WriteKeyFile, or by other age tools.
+func ReadKeyFile(path string) (interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b, _ := pem.Decode(data)
+	if b == nil {
+		return readAgeKey(path, data)
+	}
+	switch b.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(b.Bytes)
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(b.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported PEM block in %s: %q", path, b.Type)
+}
+
+// readAgeKey reads a single age identity or recipient.
+func readAgeKey(path string, data []byte) (interface{}, error) {
+	if ids, err := age.ParseIdentities(bytes.NewReader(data)); err == nil {
+		if len(ids) != 1 {
+			return nil, fmt.Errorf("expected a single key in %s", path)
+		}
+		return ids[0], nil
+	}
+	if rs, err := age.ParseRecipients(bytes.NewReader(data)); err == nil {
+		if len(rs) != 1 {
+			return nil, fmt.Errorf("expected a single key in %s", path)
+		}
+		return rs[0], nil
+	}
+	return nil, fmt.Errorf("no PEM data or age key in %s", path)
+}
@@ -0,0 +1,181 @@
+package send
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dennwc/btrfs"
+)
+
+// plainMarkerSuffix is the suffix of files that record received subvolumes in plain mode.
+const plainMarkerSuffix = ".received"
+
+// plainMarker records a subvolume received to a plain directory, replacing
+// the received uuid that is stored in the subvolume item on btrfs.
+type plainMarker struct {
+	UUID     btrfs.UUID `json:"uuid"`
+	CTransID uint64     `json:"ctransid"`
+	Time     time.Time  `json:"time"`
+}
+
+// plainMarkerPath returns a path of the marker of a subvolume directory.
+// Markers are hidden files next to it, so the directory contains only the received files.
+func plainMarkerPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+plainMarkerSuffix)
+}
+
+func writePlainMarker(path string, uuid btrfs.UUID, ctransid uint64) error {
+	data, err := json.Marshal(plainMarker{UUID: uuid, CTransID: ctransid, Time: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(plainMarkerPath(path), data, 0644)
+}
+
+// findPlainParent finds a directory in dst that was received in plain mode with a given uuid.
+func findPlainParent(dst string, uuid btrfs.UUID, ctransid uint64) (string, error) {
+	names, err := filepath.Glob(filepath.Join(dst, ".*"+plainMarkerSuffix))
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		var m plainMarker
+		if err = json.Unmarshal(data, &m); err != nil {
+			return "", fmt.Errorf("cannot parse %s: %v", name, err)
+		}
+		if m.UUID != uuid || m.CTransID != ctransid {
+			continue
+		}
+		base := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), "."), plainMarkerSuffix)
+		return filepath.Join(dst, base), nil
+	}
+	return "", fmt.Errorf("cannot find parent directory %v: %v", uuid, btrfs.ErrNotFound)
+}
+
+// copyPlainTree emulates a snapshot by copying the directory tree src to dst, which must not exist.
+// Hard links within the tree are preserved. Owners are only preserved when running as root,
+// and extended attributes are not copied.
+func copyPlainTree(src, dst string) error {
+	root := os.Geteuid() == 0
+	type inode struct{ dev, ino uint64 }
+	links := make(map[inode]string)
+	var dirs []string // to set times after the content is copied
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		out := filepath.Join(dst, rel)
+		st := fi.Sys().(*syscall.Stat_t)
+		mode := fi.Mode()
+		if !mode.IsDir() && st.Nlink > 1 {
+			id := inode{dev: uint64(st.Dev), ino: st.Ino}
+			if first, ok := links[id]; ok {
+				return os.Link(first, out)
+			}
+			links[id] = out
+		}
+		switch {
+		case mode.IsDir():
+			if err = os.Mkdir(out, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, path)
+		case mode.IsRegular():
+			if err = copyPlainFile(path, out); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err = os.Symlink(link, out); err != nil {
+				return err
+			}
+		default:
+			if err = syscall.Mknod(out, st.Mode, int(st.Rdev)); err != nil {
+				return os.NewSyscallError("mknod", err)
+			}
+		}
+		if root {
+			if err = os.Lchown(out, int(st.Uid), int(st.Gid)); err != nil {
+				return err
+			}
+		}
+		if mode&os.ModeSymlink == 0 {
+			if err = syscall.Chmod(out, st.Mode&07777); err != nil {
+				return &os.PathError{Op: "chmod", Path: out, Err: err}
+			}
+		}
+		if mode.IsDir() {
+			return nil
+		}
+		return lutimes(out, time.Unix(st.Atim.Unix()), fi.ModTime())
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fi, err := os.Lstat(dirs[i])
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, dirs[i])
+		atime := time.Unix(fi.Sys().(*syscall.Stat_t).Atim.Unix())
+		if err = lutimes(filepath.Join(dst, rel), atime, fi.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyPlainFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyRange emulates a clone by copying n bytes of src at srcOff to dst at dstOff.
+// Zero length copies the data until the end of src, same as a clone.
+func copyRange(dst, src *os.File, srcOff, n, dstOff uint64) error {
+	if n == 0 {
+		fi, err := src.Stat()
+		if err != nil {
+			return err
+		}
+		if uint64(fi.Size()) <= srcOff {
+			return nil
+		}
+		n = uint64(fi.Size()) - srcOff
+	}
+	r := io.NewSectionReader(src, int64(srcOff), int64(n))
+	w := io.NewOffsetWriter(dst, int64(dstOff))
+	_, err := io.Copy(w, r)
+	return err
+}
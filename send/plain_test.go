@@ -0,0 +1,96 @@
+package send
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dennwc/btrfs"
+)
+
+func TestReceivePlain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs-receive-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	zbuf := bytes.NewBuffer(nil)
+	zw := zlib.NewWriter(zbuf)
+	zw.Write([]byte("compressed"))
+	zw.Close()
+	base := strictTestStream(t,
+		&SubvolCmd{Path: "snap.1", UUID: btrfs.UUID{1}, CTransID: 10},
+		&MkdirCmd{Path: "o257-5-0", Ino: 257},
+		&RenameCmd{From: "o257-5-0", To: "dir"},
+		&MkfileCmd{Path: "dir/file", Ino: 258},
+		&WriteCmd{Path: "dir/file", Data: []byte("hello world")},
+		&LinkCmd{Path: "hardlink", Link: "dir/file"},
+		&SymlinkCmd{Path: "link", Ino: 259, Link: "dir/file"},
+		&SetXattrCmd{Path: "dir/file", Name: "btrfs.compression", Data: []byte("zstd")},
+		&ChmodCmd{Path: "dir/file", Mode: 0640},
+		&StreamEnd{},
+	)
+	if _, err = Receive(bytes.NewReader(base), dir, &ReceiveOptions{Plain: true}); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	w, err := NewStreamWriterVersion(buf, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Cmd{
+		&SnapshotCmd{Path: "snap.2", UUID: btrfs.UUID{2}, CTransID: 20, CloneUUID: btrfs.UUID{1}, CloneTransID: 10},
+		&MkfileCmd{Path: "copy", Ino: 260},
+		&CloneCmd{Path: "copy", Off: 0, Len: 5, ClonePath: "dir/file", CloneUUID: btrfs.UUID{1}, CloneCTransID: 10},
+		&EncodedWriteCmd{Path: "copy", Off: 5, Extent: btrfs.EncodedExtent{
+			Len: 10, UnencodedLen: 10, Compression: btrfs.EncodedZlib,
+		}, Data: zbuf.Bytes()},
+		&UnlinkCmd{Path: "link"},
+		&StreamEnd{},
+	} {
+		if err = w.WriteCommand(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = Receive(buf, dir, &ReceiveOptions{Plain: true}); err != nil {
+		t.Fatal(err)
+	}
+	s1, s2 := filepath.Join(dir, "snap.1"), filepath.Join(dir, "snap.2")
+	for _, c := range []struct{ path, data string }{
+		{filepath.Join(s1, "dir/file"), "hello world"},
+		{filepath.Join(s2, "dir/file"), "hello world"},
+		{filepath.Join(s2, "copy"), "hellocompressed"},
+	} {
+		if data, err := ioutil.ReadFile(c.path); err != nil {
+			t.Fatal(err)
+		} else if string(data) != c.data {
+			t.Fatalf("%s: unexpected data: %q", c.path, data)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(s2, "dir/file")); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0640 {
+		t.Fatalf("unexpected mode: %v", fi.Mode())
+	}
+	if a, err := os.Stat(filepath.Join(s2, "dir/file")); err != nil {
+		t.Fatal(err)
+	} else if b, err := os.Stat(filepath.Join(s2, "hardlink")); err != nil {
+		t.Fatal(err)
+	} else if !os.SameFile(a, b) {
+		t.Fatal("hard link was not preserved")
+	}
+	if _, err = os.Lstat(filepath.Join(s1, "link")); err != nil {
+		t.Fatal("the parent must not be modified")
+	} else if _, err = os.Lstat(filepath.Join(s2, "link")); !os.IsNotExist(err) {
+		t.Fatalf("expected the link to be removed: %v", err)
+	}
+	if p, err := findPlainParent(dir, btrfs.UUID{2}, 20); err != nil || p != s2 {
+		t.Fatalf("unexpected parent: %q, %v", p, err)
+	}
+	if _, err = findPlainParent(dir, btrfs.UUID{2}, 21); err == nil {
+		t.Fatal("expected an error for a different transaction")
+	}
+}
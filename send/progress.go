@@ -0,0 +1,169 @@
+package send
+
+import (
+	"io"
+)
+
+// Progress describes the state of a stream transfer.
+type Progress struct {
+	Bytes    int64   // number of stream bytes transferred
+	Commands int64   // number of complete commands
+	Cmd      CmdType // type of the last command
+	Path     string  // path of the last command, if any
+}
+
+// ProgressFunc is called after each command of the stream.
+// It is called synchronously, thus it should return quickly.
+type ProgressFunc func(p Progress)
+
+// maxPathPrefix is the number of bytes of a command body that is buffered to find its path.
+const maxPathPrefix = tlvHeaderSize + 4096
+
+// progressTracker parses a stream incrementally to report the progress.
+type progressTracker struct {
+	fn   ProgressFunc
+	p    Progress
+	hdr  []byte // partial stream or command header
+	body []byte // beginning of the current command body
+	need int    // remaining bytes of the current command body
+	v2   bool
+	init bool // stream header was read
+}
+
+func newProgressTracker(fn ProgressFunc) *progressTracker {
+	return &progressTracker{
+		fn:   fn,
+		hdr:  make([]byte, 0, streamHeaderSize),
+		body: make([]byte, 0, maxPathPrefix),
+	}
+}
+
+// readHeader accumulates a header of size n. It returns false if more data is needed.
+func (t *progressTracker) readHeader(p *[]byte, n int) bool {
+	k := n - len(t.hdr)
+	if k > len(*p) {
+		k = len(*p)
+	}
+	t.hdr = append(t.hdr, (*p)[:k]...)
+	*p = (*p)[k:]
+	return len(t.hdr) == n
+}
+
+func (t *progressTracker) feed(p []byte) {
+	t.p.Bytes += int64(len(p))
+	for len(p) > 0 {
+		if !t.init {
+			if !t.readHeader(&p, int(streamHeaderSize)) {
+				return
+			}
+			t.v2 = sendEndianess.Uint32(t.hdr[sendStreamMagicSize:]) >= 2
+			t.init = true
+			t.hdr = t.hdr[:0]
+			continue
+		}
+		if t.need == 0 && len(t.hdr) < cmdHeaderSize {
+			if !t.readHeader(&p, cmdHeaderSize) {
+				return
+			}
+			var h cmdHeader
+			h.Unmarshal(t.hdr)
+			t.p.Cmd = h.Cmd
+			t.need = int(h.Len)
+			t.body = t.body[:0]
+			if t.need == 0 {
+				t.done()
+			}
+			continue
+		}
+		n := t.need
+		if n > len(p) {
+			n = len(p)
+		}
+		if k := cap(t.body) - len(t.body); k > 0 {
+			if k > n {
+				k = n
+			}
+			t.body = append(t.body, p[:k]...)
+		}
+		p = p[n:]
+		if t.need -= n; t.need == 0 {
+			t.done()
+		}
+	}
+}
+
+// done is called when the whole command was consumed.
+func (t *progressTracker) done() {
+	t.hdr = t.hdr[:0]
+	t.p.Path = t.path()
+	t.p.Commands++
+	t.fn(t.p)
+}
+
+// path finds the path attribute in the buffered beginning of the command body.
+func (t *progressTracker) path() string {
+	for b := t.body; len(b) >= 2; {
+		typ := sendCmdAttr(sendEndianess.Uint16(b))
+		if t.v2 && typ == sendAttrData {
+			return ""
+		} else if len(b) < tlvHeaderSize {
+			return ""
+		}
+		n := int(sendEndianess.Uint16(b[2:]))
+		b = b[tlvHeaderSize:]
+		if n > len(b) {
+			return ""
+		}
+		if typ == sendAttrPath {
+			return string(b[:n])
+		}
+		b = b[n:]
+	}
+	return ""
+}
+
+// ProgressWriter returns a writer that passes a send stream to w and reports
+// the progress of the transfer to fn. It can wrap the writer passed to btrfs.Send.
+func ProgressWriter(w io.Writer, fn ProgressFunc) io.Writer {
+	return &progressWriter{w: w, t: newProgressTracker(fn)}
+}
+
+type progressWriter struct {
+	w io.Writer
+	t *progressTracker
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.t.feed(p[:n])
+	return n, err
+}
+
+// ProgressReader returns a reader that reads a send stream from r and reports
+// the progress of the transfer to fn. See ReceiveOptions.Progress for reporting
+// the progress of applied commands instead.
+func ProgressReader(r io.Reader, fn ProgressFunc) io.Reader {
+	return &progressReader{r: r, t: newProgressTracker(fn)}
+}
+
+type progressReader struct {
+	r io.Reader
+	t *progressTracker
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.t.feed(p[:n])
+	return n, err
+}
+
+// cmdPath returns the path of the command, if it has one.
+func cmdPath(c Cmd) string {
+	for _, tlv := range c.encode() {
+		if tlv.Attr == sendAttrPath {
+			s, _ := tlv.Val.(string)
+			return s
+		}
+	}
+	return ""
+}
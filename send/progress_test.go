@@ -0,0 +1,52 @@
+package send
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dennwc/btrfs"
+)
+
+func TestProgress(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		buf := bytes.NewBuffer(nil)
+		w, err := NewStreamWriterVersion(buf, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmds := []Cmd{
+			&SubvolCmd{Path: "vol", UUID: btrfs.UUID{1}, CTransID: 10},
+			&MkfileCmd{Path: "file", Ino: 257},
+			&WriteCmd{Path: "file", Data: make([]byte, 1000)},
+			&StreamEnd{},
+		}
+		for _, c := range cmds {
+			if err = w.WriteCommand(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		size := int64(buf.Len())
+
+		var got []Progress
+		pw := ProgressWriter(ioutil.Discard, func(p Progress) {
+			got = append(got, p)
+		})
+		// write in small chunks to cross all the boundaries
+		if _, err = io.CopyBuffer(struct{ io.Writer }{pw}, struct{ io.Reader }{buf}, make([]byte, 7)); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(cmds) {
+			t.Fatalf("v%d: unexpected number of reports: %d", version, len(got))
+		}
+		for i, c := range cmds {
+			if p := got[i]; p.Cmd != c.Type() || p.Path != cmdPath(c) || p.Commands != int64(i+1) {
+				t.Fatalf("v%d: unexpected report %d: %+v", version, i, p)
+			}
+		}
+		if last := got[len(got)-1]; last.Bytes != size {
+			t.Fatalf("v%d: unexpected size: %d vs %d", version, last.Bytes, size)
+		}
+	}
+}
@@ -0,0 +1,1125 @@
+package send
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/dennwc/btrfs"
+)
+
+const (
+	checkpointVersion = 1
+	// defaultCheckpointInterval is the number of stream bytes between checkpoints.
+	defaultCheckpointInterval = 64 * 1024 * 1024
+)
+
+// ReceiveCheckpoint records the progress of a receive, so it can be resumed after an interruption.
+//
+// The same checkpoint can be passed to the sender (see ResumeWriter) to avoid
+// sending the part of the stream that was already applied.
+type ReceiveCheckpoint struct {
+	Version  int        `json:"version"`
+	Path     string     `json:"path"`     // absolute path of the subvolume being received
+	UUID     btrfs.UUID `json:"uuid"`     // uuid of the sent subvolume
+	First    btrfs.UUID `json:"first"`    // uuid of the first subvolume in the stream
+	CTransID uint64     `json:"ctransid"` // transaction id of the sent subvolume
+	Offset   int64      `json:"offset"`   // stream offset after the last applied command
+	Commands int64      `json:"commands"` // number of applied commands
+	Updated  time.Time  `json:"updated"`
+}
+
+// ReadCheckpoint reads a checkpoint file. It returns an error satisfying os.IsNotExist
+// if the file does not exist.
+func ReadCheckpoint(path string) (*ReceiveCheckpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cp ReceiveCheckpoint
+	if err = json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("cannot read checkpoint: %v", err)
+	} else if cp.Version != checkpointVersion {
+		return nil, fmt.Errorf("unsupported checkpoint version: %d", cp.Version)
+	}
+	return &cp, nil
+}
+
+func (cp *ReceiveCheckpoint) save(path string) error {
+	cp.Version = checkpointVersion
+	cp.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(cp, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// streamHeaderSize is the size of the stream magic and version.
+const streamHeaderSize = int64(sendStreamMagicSize + 4)
+
+// ResumeWriter returns a writer that passes the stream header to w, but skips the part
+// of the stream that was already applied by the receiver, according to the checkpoint.
+// The receiver must be resumed with the same checkpoint.
+func ResumeWriter(w io.Writer, cp *ReceiveCheckpoint) io.Writer {
+	return &resumeWriter{w: w, skip: cp.Offset}
+}
+
+type resumeWriter struct {
+	w    io.Writer
+	off  int64
+	skip int64
+}
+
+func (w *resumeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		var (
+			chunk []byte
+			pass  bool
+		)
+		switch {
+		case w.off < streamHeaderSize:
+			chunk, pass = p[:min64(int64(len(p)), streamHeaderSize-w.off)], true
+		case w.off < w.skip:
+			chunk = p[:min64(int64(len(p)), w.skip-w.off)]
+		default:
+			chunk, pass = p, true
+		}
+		if pass {
+			if _, err := w.w.Write(chunk); err != nil {
+				return n - len(p), err
+			}
+		}
+		w.off += int64(len(chunk))
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// ReceiveOptions controls the behavior of Receive.
+type ReceiveOptions struct {
+	// StateFile enables checkpoints. If the file exists, the receive is resumed from it.
+	// The file is removed when the stream is received completely.
+	StateFile string
+	// CheckpointInterval is the number of stream bytes between checkpoints.
+	CheckpointInterval int64
+	// MaxErrors is the number of failed commands to tolerate. Failed commands are skipped
+	// and reported as ReceiveErrors when the stream ends. Negative value means no limit.
+	// Failures to read the stream or to create a subvolume are always fatal.
+	MaxErrors int
+	// Progress is called after each applied command, if set.
+	Progress ProgressFunc
+	// RateLimit limits the rate of reading the stream, if set.
+	RateLimit *btrfs.RateLimiter
+	// Digest is the expected digest of the whole stream (see DigestWriter). If it does not match,
+	// ErrDigestMismatch is returned and the last subvolume of the stream is not marked
+	// as received, so it is not used as a parent. The stream cannot be truncated on resume.
+	Digest *Digest
+	// StopAtEnd stops the receive at the end command of the current stream, instead of reading
+	// concatenated streams until EOF. The reader is not read past the end command, so multiple
+	// streams can be received from one long-lived connection by calling Receive repeatedly.
+	StopAtEnd bool
+	// Verifier checks file data written by the stream, if set (see DataChecksums). Data of each
+	// write command is read back from the file and passed to it. If the check fails, the receive
+	// stops and the subvolume is not marked as received. Encoded writes and clones are not verified.
+	Verifier DataVerifier
+	// Reader controls validation of the stream, see ReaderOptions. Strict validation is recommended
+	// for streams from untrusted sources.
+	Reader *ReaderOptions
+	// Plain applies the stream to an ordinary directory tree, which does not have to be on btrfs,
+	// e.g. to inspect a backup on a machine without btrfs. Subvolumes are created as directories,
+	// snapshots are emulated by copying the parent directory, and clones by copying the data.
+	// Btrfs-only metadata (received uuids, read-only flags, "btrfs." xattrs) is skipped;
+	// received uuids are recorded in hidden ".<name>.received" files next to the directories
+	// instead, so incremental streams can find their parents in dst.
+	Plain bool
+}
+
+// CommandError is a failure of a single stream command.
+type CommandError struct {
+	Offset int64 // stream offset of the command
+	Cmd    CmdType
+	Err    error
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Cmd, e.Err)
+}
+
+// ReceiveErrors is returned by Receive when some commands failed, but the number of failures
+// was within ReceiveOptions.MaxErrors.
+type ReceiveErrors []*CommandError
+
+func (e ReceiveErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%d commands failed, last: %v", len(e), e[len(e)-1])
+}
+
+// ReceiveStats summarizes a receive.
+type ReceiveStats struct {
+	Subvolumes   int           // number of created subvolumes and snapshots
+	Files        int64         // number of created files, directories, symlinks and special files
+	Links        int64         // number of created hard links
+	BytesWritten int64         // number of file bytes written
+	Clones       int64         // number of cloned ranges
+	ClonedBytes  int64         // number of file bytes cloned
+	Xattrs       int64         // number of extended attributes set
+	Commands     int64         // number of applied commands
+	StreamBytes  int64         // number of stream bytes read
+	Errors       int           // number of failed commands that were skipped
+	Elapsed      time.Duration // duration of the receive
+}
+
+// count accounts a successfully applied command.
+func (s *ReceiveStats) count(c Cmd) {
+	s.Commands++
+	switch c := c.(type) {
+	case *SubvolCmd, *SnapshotCmd:
+		s.Subvolumes++
+	case *MkfileCmd, *MkdirCmd, *MknodCmd, *MkfifoCmd, *MksockCmd, *SymlinkCmd:
+		s.Files++
+	case *LinkCmd:
+		s.Links++
+	case *WriteCmd:
+		s.BytesWritten += int64(len(c.Data))
+	case *EncodedWriteCmd:
+		s.BytesWritten += int64(c.Extent.Len)
+	case *CloneCmd:
+		s.Clones++
+		s.ClonedBytes += int64(c.Len)
+	case *SetXattrCmd:
+		s.Xattrs++
+	}
+}
+
+// Receive applies a send stream to the directory dst, creating new subvolumes in it.
+//
+// If the stream is interrupted and opts.StateFile is set, the progress is recorded to it,
+// and the next call with the same state file will continue from that point. The stream
+// provided for resume can either be a complete stream (already applied part is skipped),
+// or a stream produced by ResumeWriter.
+//
+// The stream can contain multiple subvolumes, either sent by a single Send call,
+// or concatenated from the output of multiple calls (see ReceiveOptions.StopAtEnd). Each subvolume
+// is marked as received and made read-only before the next one is started.
+//
+// Statistics are returned even if the receive fails, covering the commands applied so far.
+//
+// Commands are contained in the subvolume they apply to: absolute paths, ".." components,
+// and paths leading through symlinks are rejected with ErrUnsafePath, so streams from
+// less-trusted hosts cannot modify files outside of dst.
+func Receive(r io.Reader, dst string, opts *ReceiveOptions) (*ReceiveStats, error) {
+	dst, err := filepath.Abs(dst)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	rc := &receiver{dst: dst}
+	if opts != nil {
+		rc.opts = *opts
+	}
+	if rc.opts.CheckpointInterval <= 0 {
+		rc.opts.CheckpointInterval = defaultCheckpointInterval
+	}
+	err = rc.run(r)
+	if err2 := rc.closeFile(); err == nil {
+		err = err2
+	}
+	if err == nil && len(rc.errs) != 0 {
+		err = rc.errs
+	}
+	rc.stats.Errors = len(rc.errs)
+	rc.stats.Elapsed = time.Since(start)
+	if rc.cr != nil {
+		rc.stats.StreamBytes = rc.cr.n
+	}
+	return &rc.stats, err
+}
+
+// ResumeReceive continues a receive interrupted with opts.StateFile set. Unlike Receive,
+// it fails if there is no checkpoint to resume from, or if the checkpoint was recorded
+// for a different destination.
+//
+// The stream can either be the complete stream, or the stream produced by ResumeWriter
+// with the same checkpoint.
+func ResumeReceive(r io.Reader, dst string, opts *ReceiveOptions) (*ReceiveStats, error) {
+	if opts == nil || opts.StateFile == "" {
+		return nil, errors.New("state file is required to resume a receive")
+	}
+	dst, err := filepath.Abs(dst)
+	if err != nil {
+		return nil, err
+	}
+	cp, err := ReadCheckpoint(opts.StateFile)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("nothing to resume: %v", err)
+	} else if err != nil {
+		return nil, err
+	}
+	if filepath.Dir(cp.Path) != dst {
+		return nil, fmt.Errorf("checkpoint is for subvolume %s, not in %s", cp.Path, dst)
+	}
+	return Receive(r, dst, opts)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+type receiver struct {
+	dst  string
+	opts ReceiveOptions
+
+	cr   *countingReader
+	bias int64 // difference between stream offsets and bytes read, when resuming a truncated stream
+
+	root     string // current subvolume
+	uuid     btrfs.UUID
+	first    btrfs.UUID // first subvolume of the stream
+	ctransid uint64
+	cmds     int64
+	saved    int64 // offset of the last saved checkpoint
+
+	// tolerant is set when resuming after a crash: commands after the last checkpoint
+	// might have been applied already, so some errors are expected.
+	tolerant bool
+
+	file     *os.File // cached file for sequential writes
+	filePath string
+
+	sources map[btrfs.UUID]string // clone sources by uuid
+
+	errs  ReceiveErrors // tolerated command failures
+	stats ReceiveStats
+
+	digest hash.Hash // digest of the stream, if verified
+
+	cmdOff   int64 // stream offset of the command being applied
+	verified int64 // stream offset since which the data of the current subvolume was verified
+}
+
+// verifyWrite reads back the data written by a command and passes it to the verifier.
+func (rc *receiver) verifyWrite(c *WriteCmd) error {
+	if rc.opts.Verifier == nil {
+		return nil
+	}
+	f, err := os.OpenFile(rc.path(c.Path), os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, len(c.Data))
+	n, err := f.ReadAt(buf, int64(c.Off))
+	if err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	return rc.opts.Verifier.VerifyWrite(rc.cmdOff, c.Path, c.Off, buf[:n])
+}
+
+// verifyRange checks that all data of the current subvolume up to the end command was verified.
+func (rc *receiver) verifyRange(end int64) error {
+	if rc.opts.Verifier == nil || rc.root == "" {
+		return nil
+	}
+	return rc.opts.Verifier.VerifyRange(rc.verified, end)
+}
+
+// checkDigest compares the digest of the stream read so far with the expected one.
+func (rc *receiver) checkDigest() error {
+	if rc.digest == nil {
+		return nil
+	}
+	if rc.bias != 0 {
+		return errors.New("cannot verify the digest of a truncated stream")
+	}
+	got := Digest{Algorithm: rc.opts.Digest.Algorithm, Sum: rc.digest.Sum(nil)}
+	if !got.Equal(*rc.opts.Digest) {
+		return ErrDigestMismatch{Expected: *rc.opts.Digest, Actual: got}
+	}
+	return nil
+}
+
+func (rc *receiver) offset() int64 {
+	return rc.cr.n + rc.bias
+}
+
+func (rc *receiver) run(r io.Reader) error {
+	r = rc.opts.RateLimit.Reader(r)
+	if d := rc.opts.Digest; d != nil {
+		h, err := newDigestHash(d.Algorithm)
+		if err != nil {
+			return err
+		}
+		rc.digest = h
+		r = io.TeeReader(r, h)
+	}
+	rc.cr = &countingReader{r: r}
+	sr, err := NewStreamReaderWithOptions(rc.cr, rc.opts.Reader)
+	if err != nil {
+		return err
+	}
+	var first Cmd
+	if rc.opts.StateFile != "" {
+		cp, err := ReadCheckpoint(rc.opts.StateFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if cp != nil {
+			first, err = rc.resume(sr, cp)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	last := rc.offset()
+	if first != nil {
+		last = rc.saved // first command was read ahead
+	}
+	for {
+		c := first
+		first = nil
+		if c == nil {
+			c, err = sr.ReadCommand()
+			if err == io.EOF {
+				if rc.root != "" {
+					err = io.ErrUnexpectedEOF
+				} else {
+					return rc.checkDigest()
+				}
+			}
+			if err != nil {
+				return rc.fail(last, err)
+			}
+		}
+		if c.Type() == sendCmdEnd {
+			if err = rc.verifyRange(last); err != nil {
+				return err
+			}
+			if rc.opts.StopAtEnd {
+				if err = rc.checkDigest(); err != nil {
+					return err
+				}
+				return rc.finish()
+			}
+			// streams of multiple send invocations can be concatenated
+			if err = sr.NextStream(); err == io.EOF {
+				if err = rc.checkDigest(); err != nil {
+					return err
+				}
+				return rc.finish()
+			} else if err != nil {
+				return rc.fail(last, err)
+			}
+			if err = rc.finish(); err != nil {
+				return err
+			}
+			last = rc.offset()
+			continue
+		}
+		rc.cmdOff = last
+		switch c.(type) {
+		case *SubvolCmd, *SnapshotCmd:
+			rc.verified = last
+		}
+		if err = rc.apply(c); err != nil {
+			cerr := &CommandError{Offset: last, Cmd: c.Type(), Err: err}
+			if !rc.tolerate(c, cerr) {
+				return rc.fail(last, cerr)
+			}
+		} else {
+			rc.stats.count(c)
+		}
+		rc.cmds++
+		last = rc.offset()
+		if rc.opts.Progress != nil {
+			rc.opts.Progress(Progress{Bytes: last, Commands: rc.cmds, Cmd: c.Type(), Path: cmdPath(c)})
+		}
+		if rc.opts.StateFile != "" && rc.root != "" && last-rc.saved >= rc.opts.CheckpointInterval {
+			if err = rc.checkpoint(last); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// resume restores the state from the checkpoint and positions the stream after
+// the last applied command. It returns a command that must be applied first, if any.
+func (rc *receiver) resume(sr *StreamReader, cp *ReceiveCheckpoint) (Cmd, error) {
+	if rc.opts.Plain {
+		if fi, err := os.Lstat(cp.Path); err != nil {
+			return nil, fmt.Errorf("cannot resume: %v", err)
+		} else if !fi.IsDir() {
+			return nil, fmt.Errorf("cannot resume: %s is not a directory", cp.Path)
+		}
+	} else if ok, err := btrfs.IsSubVolume(cp.Path); err != nil {
+		return nil, fmt.Errorf("cannot resume: %v", err)
+	} else if !ok {
+		return nil, fmt.Errorf("cannot resume: %s is not a subvolume", cp.Path)
+	}
+	rc.root, rc.uuid, rc.ctransid = cp.Path, cp.UUID, cp.CTransID
+	rc.first = cp.First
+	if rc.first.IsZero() {
+		rc.first = cp.UUID
+	}
+	rc.cmds, rc.saved = cp.Commands, cp.Offset
+	rc.verified = cp.Offset
+	rc.tolerant = true
+	before := rc.cr.n
+	c, err := sr.ReadCommand()
+	if err != nil {
+		return nil, err
+	}
+	var uuid btrfs.UUID
+	switch c := c.(type) {
+	case *SubvolCmd:
+		uuid = c.UUID
+	case *SnapshotCmd:
+		uuid = c.UUID
+	}
+	if uuid != cp.UUID && uuid != rc.first {
+		// stream was truncated by the sender
+		rc.bias = cp.Offset - before
+		return c, nil
+	}
+	// complete stream; skip commands that were already applied,
+	// including preceding subvolumes of a multi-subvolume stream
+	for rc.offset() < cp.Offset {
+		c, err = sr.ReadCommand()
+		if err == nil && c.Type() == sendCmdEnd {
+			err = sr.NextStream()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot skip to offset %d: %v", cp.Offset, err)
+		}
+	}
+	if rc.offset() != cp.Offset {
+		return nil, fmt.Errorf("checkpoint offset %d does not match the stream", cp.Offset)
+	}
+	return nil, nil
+}
+
+// tolerate records a command failure and checks if the receive can continue.
+func (rc *receiver) tolerate(c Cmd, err *CommandError) bool {
+	switch c.(type) {
+	case *SubvolCmd, *SnapshotCmd:
+		return false // following commands depend on it
+	}
+	switch err.Err.(type) {
+	case ErrUnsafePath, ErrChecksumMismatch:
+		return false // the stream is malicious or corrupted
+	}
+	if max := rc.opts.MaxErrors; max >= 0 && len(rc.errs) >= max {
+		return false
+	}
+	rc.errs = append(rc.errs, err)
+	return true
+}
+
+// fail saves a checkpoint at the last applied command and returns the error.
+func (rc *receiver) fail(off int64, err error) error {
+	if rc.opts.StateFile == "" || rc.root == "" {
+		return err
+	}
+	if err2 := rc.checkpoint(off); err2 != nil {
+		return fmt.Errorf("%v (cannot save checkpoint: %v)", err, err2)
+	}
+	return err
+}
+
+func (rc *receiver) checkpoint(off int64) error {
+	if err := rc.closeFile(); err != nil {
+		return err
+	}
+	if err := rc.sync(); err != nil {
+		return err
+	}
+	cp := &ReceiveCheckpoint{
+		Path:     rc.root,
+		UUID:     rc.uuid,
+		First:    rc.first,
+		CTransID: rc.ctransid,
+		Offset:   off,
+		Commands: rc.cmds,
+	}
+	if err := cp.save(rc.opts.StateFile); err != nil {
+		return err
+	}
+	rc.saved = off
+	rc.tolerant = false
+	return nil
+}
+
+// sync commits the data written to the current subvolume.
+func (rc *receiver) sync() error {
+	if rc.opts.Plain {
+		syscall.Sync()
+		return nil
+	}
+	fs, err := btrfs.Open(rc.root, false)
+	if err != nil {
+		return err
+	}
+	err = fs.Sync()
+	fs.Close()
+	return err
+}
+
+// finish marks the current subvolume as received and makes it read-only.
+// In plain mode, it only records the received uuid.
+func (rc *receiver) finish() error {
+	if rc.root == "" {
+		return nil
+	}
+	if err := rc.closeFile(); err != nil {
+		return err
+	}
+	if rc.opts.Plain {
+		if err := writePlainMarker(rc.root, rc.uuid, rc.ctransid); err != nil {
+			return err
+		}
+	} else if err := rc.markReceived(); err != nil {
+		return err
+	}
+	rc.root = ""
+	if rc.opts.StateFile != "" {
+		if err := os.Remove(rc.opts.StateFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rc *receiver) markReceived() error {
+	if err := btrfs.SetReceivedSubvolume(rc.root, rc.uuid, rc.ctransid, time.Now()); err != nil {
+		return err
+	}
+	fs, err := btrfs.Open(rc.root, false)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	flags, err := fs.GetFlags()
+	if err != nil {
+		return err
+	}
+	return fs.SetFlags(flags | btrfs.SubvolReadOnly)
+}
+
+func (rc *receiver) closeFile() error {
+	if rc.file == nil {
+		return nil
+	}
+	err := rc.file.Close()
+	rc.file, rc.filePath = nil, ""
+	return err
+}
+
+func (rc *receiver) path(p string) string {
+	return filepath.Join(rc.root, p)
+}
+
+// ignore checks if the error is expected for a command that was applied before the crash.
+func (rc *receiver) ignore(err error, errs ...error) bool {
+	if err == nil || !rc.tolerant {
+		return false
+	}
+	if e, ok := err.(*os.PathError); ok {
+		err = e.Err
+	} else if e, ok := err.(*os.LinkError); ok {
+		err = e.Err
+	}
+	for _, e := range errs {
+		if err == e {
+			return true
+		}
+	}
+	return false
+}
+
+// check rejects commands with paths that could escape the destination or the current subvolume.
+func (rc *receiver) check(c Cmd) error {
+	switch c := c.(type) {
+	case *StreamEnd, *UnknownSendCmd:
+		return nil
+	case *SubvolCmd:
+		return checkSubvolName(c.Path)
+	case *SnapshotCmd:
+		return checkSubvolName(c.Path)
+	}
+	if rc.root == "" {
+		return nil
+	}
+	var paths []string
+	switch c := c.(type) {
+	case *RenameCmd:
+		paths = []string{c.From, c.To}
+	case *LinkCmd:
+		paths = []string{c.Path, c.Link}
+	case *CloneCmd:
+		if err := checkStreamPath(c.ClonePath); err != nil {
+			return err
+		}
+		paths = []string{c.Path}
+	default:
+		p := cmdPath(c)
+		if p == rc.filePath && rc.file != nil {
+			return nil // already opened
+		}
+		paths = []string{p}
+	}
+	for _, p := range paths {
+		if err := checkBeneath(rc.root, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rc *receiver) apply(c Cmd) error {
+	if err := rc.check(c); err != nil {
+		return err
+	}
+	switch c := c.(type) {
+	case *SubvolCmd:
+		if err := rc.finish(); err != nil {
+			return err
+		}
+		path := filepath.Join(rc.dst, c.Path)
+		if rc.opts.Plain {
+			if err := os.Mkdir(path, 0755); err != nil {
+				return err
+			}
+		} else if err := btrfs.CreateSubVolume(path); err != nil {
+			return err
+		}
+		return rc.start(path, c.UUID, c.CTransID)
+	case *SnapshotCmd:
+		if err := rc.finish(); err != nil {
+			return err
+		}
+		parent, err := rc.findParent(c.CloneUUID, c.CloneTransID)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(rc.dst, c.Path)
+		if rc.opts.Plain {
+			err = copyPlainTree(parent, path)
+		} else {
+			err = btrfs.SnapshotSubVolume(parent, path, false)
+		}
+		if err != nil {
+			return err
+		}
+		return rc.start(path, c.UUID, c.CTransID)
+	}
+	if rc.root == "" {
+		return fmt.Errorf("no subvolume to apply the command to")
+	}
+	switch c := c.(type) {
+	case *MkfileCmd:
+		f, err := os.OpenFile(rc.path(c.Path), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if rc.ignore(err, syscall.EEXIST) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return f.Close()
+	case *MkdirCmd:
+		err := os.Mkdir(rc.path(c.Path), 0700)
+		if rc.ignore(err, syscall.EEXIST) {
+			return nil
+		}
+		return err
+	case *RenameCmd:
+		if rc.filePath == c.From {
+			if err := rc.closeFile(); err != nil {
+				return err
+			}
+		}
+		err := os.Rename(rc.path(c.From), rc.path(c.To))
+		if rc.ignore(err, syscall.ENOENT) {
+			if _, err2 := os.Lstat(rc.path(c.To)); err2 == nil {
+				return nil
+			}
+		}
+		return err
+	case *MknodCmd:
+		err := syscall.Mknod(rc.path(c.Path), uint32(c.Mode&syscall.S_IFMT), int(c.Rdev))
+		if rc.ignore(err, syscall.EEXIST) {
+			return nil
+		}
+		return os.NewSyscallError("mknod", err)
+	case *MkfifoCmd:
+		err := syscall.Mkfifo(rc.path(c.Path), 0600)
+		if rc.ignore(err, syscall.EEXIST) {
+			return nil
+		}
+		return os.NewSyscallError("mkfifo", err)
+	case *MksockCmd:
+		err := syscall.Mknod(rc.path(c.Path), syscall.S_IFSOCK|0600, 0)
+		if rc.ignore(err, syscall.EEXIST) {
+			return nil
+		}
+		return os.NewSyscallError("mknod", err)
+	case *SymlinkCmd:
+		err := os.Symlink(c.Link, rc.path(c.Path))
+		if rc.ignore(err, syscall.EEXIST) {
+			return nil
+		}
+		return err
+	case *LinkCmd:
+		err := os.Link(rc.path(c.Link), rc.path(c.Path))
+		if rc.ignore(err, syscall.EEXIST) {
+			return nil
+		}
+		return err
+	case *UnlinkCmd:
+		if rc.filePath == c.Path {
+			if err := rc.closeFile(); err != nil {
+				return err
+			}
+		}
+		err := syscall.Unlink(rc.path(c.Path))
+		if rc.ignore(err, syscall.ENOENT) {
+			return nil
+		}
+		return os.NewSyscallError("unlink", err)
+	case *RmdirCmd:
+		err := syscall.Rmdir(rc.path(c.Path))
+		if rc.ignore(err, syscall.ENOENT) {
+			return nil
+		}
+		return os.NewSyscallError("rmdir", err)
+	case *WriteCmd:
+		f, err := rc.openFile(c.Path)
+		if err != nil {
+			return err
+		}
+		if _, err = f.WriteAt(c.Data, int64(c.Off)); err != nil {
+			return err
+		}
+		return rc.verifyWrite(c)
+	case *EncodedWriteCmd:
+		return rc.encodedWrite(c)
+	case *FallocateCmd:
+		f, err := rc.openFile(c.Path)
+		if err != nil {
+			return err
+		}
+		err = syscall.Fallocate(int(f.Fd()), c.Mode, int64(c.Off), int64(c.Size))
+		return os.NewSyscallError("fallocate", err)
+	case *FileattrCmd:
+		// same as btrfs receive: inode flags are not applied yet
+		return nil
+	case *CloneCmd:
+		return rc.clone(c)
+	case *UpdateExtentCmd:
+		// only sent for streams without file data; nothing to do
+		return nil
+	case *TruncateCmd:
+		f, err := rc.openFile(c.Path)
+		if err != nil {
+			return err
+		}
+		return f.Truncate(int64(c.Size))
+	case *ChmodCmd:
+		// chmod follows symlinks, and the stream never changes the mode of one
+		if fi, err := os.Lstat(rc.path(c.Path)); err != nil {
+			return err
+		} else if fi.Mode()&os.ModeSymlink != 0 {
+			return ErrUnsafePath{Path: c.Path, Reason: "chmod of a symlink"}
+		}
+		return os.NewSyscallError("chmod", syscall.Chmod(rc.path(c.Path), uint32(c.Mode&07777)))
+	case *ChownCmd:
+		return os.Lchown(rc.path(c.Path), int(c.UID), int(c.GID))
+	case *UTimesCmd:
+		return lutimes(rc.path(c.Path), c.ATime, c.MTime)
+	case *SetXattrCmd:
+		if rc.opts.Plain && strings.HasPrefix(c.Name, "btrfs.") {
+			return nil // properties such as compression are only supported by btrfs
+		}
+		err := lsetxattr(rc.path(c.Path), c.Name, c.Data)
+		return os.NewSyscallError("lsetxattr", err)
+	case *RemoveXattrCmd:
+		if rc.opts.Plain && strings.HasPrefix(c.Name, "btrfs.") {
+			return nil
+		}
+		err := lremovexattr(rc.path(c.Path), c.Name)
+		if rc.ignore(err, syscall.ENODATA) {
+			return nil
+		}
+		return os.NewSyscallError("lremovexattr", err)
+	}
+	return fmt.Errorf("unsupported command: %v", c.Type())
+}
+
+// openFile returns a file opened for writing. The file is cached for sequential writes.
+func (rc *receiver) openFile(path string) (*os.File, error) {
+	if rc.filePath == path {
+		return rc.file, nil
+	}
+	if err := rc.closeFile(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(rc.path(path), os.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	rc.file, rc.filePath = f, path
+	return f, nil
+}
+
+// encodedWrite writes compressed data as is. If the kernel cannot do it, or in plain mode,
+// the data is decompressed and written as usual, which is only supported for zlib.
+func (rc *receiver) encodedWrite(c *EncodedWriteCmd) error {
+	f, err := rc.openFile(c.Path)
+	if err != nil {
+		return err
+	}
+	if rc.opts.Plain {
+		err = syscall.ENOTTY
+	} else {
+		err = btrfs.EncodedWrite(f, c.Off, c.Extent, c.Data)
+	}
+	if err == nil || (err != syscall.ENOTTY && err != syscall.EINVAL && err != syscall.ENOSPC) {
+		return err
+	}
+	data, derr := decodeExtent(c.Extent, c.Data)
+	if derr != nil {
+		return fmt.Errorf("encoded write failed: %v; %v", err, derr)
+	}
+	_, err = f.WriteAt(data, int64(c.Off))
+	return err
+}
+
+// decodeExtent decompresses data of an encoded extent and returns the part written to the file.
+func decodeExtent(e btrfs.EncodedExtent, data []byte) ([]byte, error) {
+	if e.Encryption != 0 {
+		return nil, fmt.Errorf("encrypted extents are not supported")
+	}
+	switch e.Compression {
+	case btrfs.EncodedNone:
+	case btrfs.EncodedZlib:
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decompress zlib extent: %v", err)
+		}
+		buf := make([]byte, e.UnencodedLen)
+		// the data may end early; the rest of the extent is zeros
+		if _, err = io.ReadFull(zr, buf); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, fmt.Errorf("cannot decompress zlib extent: %v", err)
+		}
+		data = buf
+	default:
+		return nil, fmt.Errorf("cannot decompress %v extent", e.Compression)
+	}
+	if e.UnencodedOffset+e.Len > uint64(len(data)) {
+		return nil, fmt.Errorf("encoded extent is too short: %d < %d", len(data), e.UnencodedOffset+e.Len)
+	}
+	return data[e.UnencodedOffset : e.UnencodedOffset+e.Len], nil
+}
+
+// clone shares a range of a file from the current subvolume or a previously received one.
+// In plain mode, the range is copied.
+func (rc *receiver) clone(c *CloneCmd) error {
+	root := rc.root
+	if c.CloneUUID != rc.uuid {
+		var err error
+		root, err = rc.cloneSource(c.CloneUUID, c.CloneCTransID)
+		if err != nil {
+			return err
+		}
+	}
+	if err := checkBeneath(root, c.ClonePath); err != nil {
+		return err
+	}
+	dst, err := rc.openFile(c.Path)
+	if err != nil {
+		return err
+	}
+	src, err := os.OpenFile(filepath.Join(root, c.ClonePath), os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if rc.opts.Plain {
+		return copyRange(dst, src, c.CloneOff, c.Len, c.Off)
+	}
+	return btrfs.CloneRange(dst, src, c.CloneOff, c.Len, c.Off)
+}
+
+// cloneSource returns a path of the subvolume to clone from. Results are cached,
+// since the stream usually contains many clones from the same subvolume.
+func (rc *receiver) cloneSource(uuid btrfs.UUID, ctransid uint64) (string, error) {
+	if p, ok := rc.sources[uuid]; ok {
+		return p, nil
+	}
+	p, err := rc.findParent(uuid, ctransid)
+	if err != nil {
+		return "", err
+	}
+	if rc.sources == nil {
+		rc.sources = make(map[btrfs.UUID]string)
+	}
+	rc.sources[uuid] = p
+	return p, nil
+}
+
+// start begins receiving a new subvolume.
+func (rc *receiver) start(path string, uuid btrfs.UUID, ctransid uint64) error {
+	rc.root, rc.uuid, rc.ctransid = path, uuid, ctransid
+	if rc.first.IsZero() {
+		rc.first = uuid
+	}
+	rc.tolerant = false
+	if rc.opts.StateFile != "" {
+		return rc.checkpoint(rc.offset())
+	}
+	return nil
+}
+
+// findParent finds a subvolume that was sent (or received) with a given uuid.
+func (rc *receiver) findParent(uuid btrfs.UUID, ctransid uint64) (string, error) {
+	if rc.opts.Plain {
+		return findPlainParent(rc.dst, uuid, ctransid)
+	}
+	mnt := rc.dst
+	for {
+		if ok, err := btrfs.IsSubVolume(mnt); err != nil {
+			return "", err
+		} else if ok {
+			break
+		}
+		if dir := filepath.Dir(mnt); dir != mnt {
+			mnt = dir
+		} else {
+			return "", fmt.Errorf("cannot find subvolume for %s", rc.dst)
+		}
+	}
+	fs, err := btrfs.Open(mnt, true)
+	if err != nil {
+		return "", err
+	}
+	defer fs.Close()
+	info, err := fs.SubvolumeByReceivedUUID(uuid)
+	if err == nil && info.STransID != ctransid {
+		err = btrfs.ErrNotFound
+	}
+	if err != nil {
+		info, err = fs.SubvolumeByUUID(uuid)
+		if err == nil && info.CTransID != ctransid {
+			err = btrfs.ErrNotFound
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot find parent subvolume %v: %v", uuid, err)
+	}
+	return fs.SubvolumePath(info.RootID)
+}
+
+// lutimes sets access and modification times without following symlinks.
+func lutimes(path string, atime, mtime time.Time) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	ts := [2]syscall.Timespec{
+		syscall.NsecToTimespec(atime.UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+	_, _, e := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(atFDCWD), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&ts[0])), atSymlinkNofollow, 0, 0)
+	if e != 0 {
+		return &os.PathError{Op: "utimensat", Path: path, Err: e}
+	}
+	return nil
+}
+
+const atSymlinkNofollow = 0x100 // AT_SYMLINK_NOFOLLOW
+
+// atFDCWD is AT_FDCWD; it is a variable, since a negative constant cannot be converted to uintptr.
+var atFDCWD = -0x64
+
+func lsetxattr(path, name string, data []byte) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	var v unsafe.Pointer
+	if len(data) > 0 {
+		v = unsafe.Pointer(&data[0])
+	}
+	_, _, e := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)),
+		uintptr(v), uintptr(len(data)), 0, 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+func lremovexattr(path, name string) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, e := syscall.Syscall(syscall.SYS_LREMOVEXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)), 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package send
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dennwc/btrfs"
+)
+
+func TestResumeWriter(t *testing.T) {
+	stream := make([]byte, 100)
+	for i := range stream {
+		stream[i] = byte(i)
+	}
+	buf := bytes.NewBuffer(nil)
+	w := ResumeWriter(buf, &ReceiveCheckpoint{Offset: 40})
+	// write in small chunks to cross all the boundaries
+	for p := stream; len(p) > 0; {
+		n := 7
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	exp := append(append([]byte{}, stream[:streamHeaderSize]...), stream[40:]...)
+	if !bytes.Equal(buf.Bytes(), exp) {
+		t.Fatalf("unexpected output:\n%v\nvs\n%v", buf.Bytes(), exp)
+	}
+}
+
+func TestLutimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs-receive-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(target, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err = os.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1500000000, 0)
+	if err = lutimes(link, ts, ts); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Lstat(link); err != nil {
+		t.Fatal(err)
+	} else if !st.ModTime().Equal(ts) {
+		t.Fatalf("unexpected link mtime: %v", st.ModTime())
+	}
+	if st, err := os.Stat(target); err != nil {
+		t.Fatal(err)
+	} else if st.ModTime().Equal(ts) {
+		t.Fatal("symlink was followed")
+	}
+}
+
+func TestDecodeExtent(t *testing.T) {
+	orig := make([]byte, 8192)
+	for i := range orig[:6000] {
+		orig[i] = byte(i)
+	}
+	// btrfs may omit trailing zeros from the compressed data
+	buf := bytes.NewBuffer(nil)
+	zw := zlib.NewWriter(buf)
+	zw.Write(orig[:6000])
+	zw.Close()
+	e := btrfs.EncodedExtent{Len: 4096, UnencodedLen: 8192, UnencodedOffset: 4096, Compression: btrfs.EncodedZlib}
+	data, err := decodeExtent(e, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, orig[4096:]) {
+		t.Fatal("unexpected data")
+	}
+	e.Compression = btrfs.EncodedZstd
+	if _, err = decodeExtent(e, buf.Bytes()); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestReceiveMaxErrors(t *testing.T) {
+	fail := &CommandError{Cmd: sendCmdChmod, Err: os.ErrPermission}
+	rc := &receiver{opts: ReceiveOptions{MaxErrors: 2}}
+	for i := 0; i < 2; i++ {
+		if !rc.tolerate(&ChmodCmd{}, fail) {
+			t.Fatalf("error %d should be tolerated", i)
+		}
+	}
+	if rc.tolerate(&ChmodCmd{}, fail) {
+		t.Fatal("expected the limit to be reached")
+	}
+	if len(rc.errs) != 2 {
+		t.Fatalf("unexpected errors: %v", rc.errs)
+	}
+	rc = &receiver{opts: ReceiveOptions{MaxErrors: -1}}
+	if rc.tolerate(&SubvolCmd{}, fail) {
+		t.Fatal("subvolume errors must be fatal")
+	}
+	for i := 0; i < 10; i++ {
+		if !rc.tolerate(&ChmodCmd{}, fail) {
+			t.Fatal("expected no limit")
+		}
+	}
+}
+
+func TestResumeReceiveCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs-receive-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, "state")
+	opts := &ReceiveOptions{StateFile: state}
+	if _, err = ResumeReceive(bytes.NewReader(nil), dir, opts); err == nil {
+		t.Fatal("expected an error without a checkpoint")
+	}
+	cp := &ReceiveCheckpoint{Path: "/elsewhere/vol", Offset: 100}
+	if err = cp.save(state); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ResumeReceive(bytes.NewReader(nil), dir, opts); err == nil {
+		t.Fatal("expected an error for a checkpoint of another destination")
+	}
+}
+
+func TestReceivePathEscape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs-receive-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root, outside := filepath.Join(dir, "root"), filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside} {
+		if err = os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rc := &receiver{dst: dir, root: root}
+	for _, c := range []Cmd{
+		&MkdirCmd{Path: "dir"},
+		&MkfileCmd{Path: "dir/file"},
+		&SymlinkCmd{Path: "link", Link: outside},
+		&ChmodCmd{Path: "dir/file", Mode: 0644},
+		&TruncateCmd{Path: "dir/file", Size: 10},
+	} {
+		if err = rc.apply(c); err != nil {
+			t.Fatalf("%v: %v", c.Type(), err)
+		}
+	}
+	for _, c := range []Cmd{
+		&SubvolCmd{Path: "../sub"},
+		&SnapshotCmd{Path: "a/b"},
+		&MkfileCmd{Path: "/etc/file"},
+		&MkfileCmd{Path: "dir/../../file"},
+		&MkfileCmd{Path: "link/file"},
+		&RenameCmd{From: "dir/file", To: "link/file"},
+		&LinkCmd{Path: "file", Link: "link/file"},
+		&WriteCmd{Path: "link", Data: []byte("data")},
+		&ChmodCmd{Path: "link", Mode: 0777},
+	} {
+		err = rc.apply(c)
+		if c.Type() == sendCmdWrite {
+			// the last component is not followed
+			if e, ok := err.(*os.PathError); !ok || e.Err != syscall.ELOOP {
+				t.Fatalf("%v: unexpected error: %v", c.Type(), err)
+			}
+			continue
+		}
+		if _, ok := err.(ErrUnsafePath); !ok {
+			t.Fatalf("%v: expected unsafe path error, got %v", c.Type(), err)
+		}
+	}
+	if err = rc.closeFile(); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := ioutil.ReadDir(outside); err != nil {
+		t.Fatal(err)
+	} else if len(list) != 0 {
+		t.Fatalf("files created outside: %v", list)
+	}
+	if err = lstatBeneath(root, "link"); err != syscall.ELOOP {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestReceiveStats(t *testing.T) {
+	var s ReceiveStats
+	for _, c := range []Cmd{
+		&SubvolCmd{Path: "sub"},
+		&MkdirCmd{Path: "dir"},
+		&MkfileCmd{Path: "dir/file"},
+		&WriteCmd{Path: "dir/file", Data: make([]byte, 100)},
+		&CloneCmd{Path: "dir/file", Len: 4096},
+		&LinkCmd{Path: "link", Link: "dir/file"},
+		&SetXattrCmd{Path: "dir/file", Name: "user.a"},
+		&ChmodCmd{Path: "dir/file"},
+	} {
+		s.count(c)
+	}
+	exp := ReceiveStats{Subvolumes: 1, Files: 2, Links: 1, BytesWritten: 100, Clones: 1, ClonedBytes: 4096, Xattrs: 1, Commands: 8}
+	if s != exp {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+}
+
+func TestReceiveStopAtEnd(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < 2; i++ {
+		w, err := NewStreamWriter(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = w.WriteCommand(&StreamEnd{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := int64(buf.Len())
+	st, err := Receive(buf, os.TempDir(), &ReceiveOptions{StopAtEnd: true})
+	if err != nil {
+		t.Fatal(err)
+	} else if st.StreamBytes != size/2 {
+		t.Fatalf("expected to read %d bytes, got %d", size/2, st.StreamBytes)
+	}
+	// the second stream is left in the reader
+	if _, err = Receive(buf, os.TempDir(), &ReceiveOptions{StopAtEnd: true}); err != nil {
+		t.Fatal(err)
+	} else if buf.Len() != 0 {
+		t.Fatalf("unexpected bytes left: %d", buf.Len())
+	}
+}
@@ -3,43 +3,87 @@ package send
 import (
 	"errors"
 	"fmt"
-	"github.com/dennwc/btrfs"
+	"hash/crc32"
 	"io"
-	"io/ioutil"
 	"time"
+
+	"github.com/dennwc/btrfs"
 )
 
 func NewStreamReader(r io.Reader) (*StreamReader, error) {
-	// read magic and version
+	return NewStreamReaderWithOptions(r, nil)
+}
+
+// NewStreamReaderWithOptions is like NewStreamReader, but allows to control validation of the stream.
+func NewStreamReaderWithOptions(r io.Reader, opts *ReaderOptions) (*StreamReader, error) {
+	sr := &StreamReader{r: &countingReader{r: r}}
+	if opts != nil {
+		sr.opts = *opts
+	}
+	version, err := readStreamHeader(sr.r)
+	if err == io.EOF {
+		return nil, fmt.Errorf("cannot read magic: %v", err)
+	} else if err != nil {
+		return nil, err
+	}
+	sr.version = version
+	return sr, nil
+}
+
+// readStreamHeader reads magic and version. It returns io.EOF if r is empty.
+func readStreamHeader(r io.Reader) (int, error) {
 	buf := make([]byte, len(sendStreamMagic)+4)
 	_, err := io.ReadFull(r, buf)
-	if err != nil {
-		return nil, fmt.Errorf("cannot read magic: %v", err)
+	if err == io.EOF {
+		return 0, err
+	} else if err != nil {
+		return 0, fmt.Errorf("cannot read magic: %v", err)
 	} else if string(buf[:sendStreamMagicSize]) != sendStreamMagic {
-		return nil, errors.New("unexpected stream header")
+		return 0, errors.New("unexpected stream header")
 	}
 	version := sendEndianess.Uint32(buf[sendStreamMagicSize:])
-	if version != sendStreamVersion {
-		return nil, fmt.Errorf("stream version %d not supported", version)
+	if version < sendStreamVersion || version > sendStreamVersionMax {
+		return 0, fmt.Errorf("stream version %d not supported", version)
 	}
-	return &StreamReader{r: r}, nil
+	return int(version), nil
 }
 
 type StreamReader struct {
-	r   io.Reader
-	buf [cmdHeaderSize]byte
+	r       *countingReader
+	opts    ReaderOptions
+	version int
+	buf     [cmdHeaderSize]byte
+}
+
+// Version returns the protocol version of the stream.
+func (r *StreamReader) Version() int {
+	return r.version
+}
+
+// NextStream reads the header of the next stream, for streams that were concatenated
+// after the end command, like the output of multiple btrfs send invocations.
+// It must only be called after reading StreamEnd, and returns io.EOF if there are no more streams.
+func (r *StreamReader) NextStream() error {
+	version, err := readStreamHeader(r.r)
+	if err != nil {
+		return err
+	}
+	r.version = version
+	return nil
 }
 
 func (r *StreamReader) readCmdHeader() (h cmdHeader, err error) {
 	_, err = io.ReadFull(r.r, r.buf[:cmdHeaderSize])
 	if err == io.EOF {
 		return
+	} else if err == io.ErrUnexpectedEOF {
+		err = &ErrMalformedStream{Offset: r.r.n, Reason: "truncated command header"}
+		return
 	} else if err != nil {
 		err = fmt.Errorf("cannot read command header: %v", err)
 		return
 	}
 	err = h.Unmarshal(r.buf[:cmdHeaderSize])
-	// TODO: check CRC
 	return
 }
 
@@ -48,76 +92,126 @@ type SendTLV struct {
 	Val  interface{}
 }
 
-func (r *StreamReader) readTLV(rd io.Reader) (*SendTLV, error) {
-	_, err := io.ReadFull(rd, r.buf[:tlvHeaderSize])
-	if err == io.EOF {
-		return nil, err
-	} else if err != nil {
-		return nil, fmt.Errorf("cannot read tlv header: %v", err)
+// parseTLV decodes a single attribute from the payload of a command
+// and returns the number of bytes consumed.
+func (r *StreamReader) parseTLV(p []byte) (*SendTLV, int, error) {
+	if len(p) < 2 {
+		return nil, 0, errors.New("truncated tlv header")
 	}
-	var h tlvHeader
-	if err = h.Unmarshal(r.buf[:tlvHeaderSize]); err != nil {
-		return nil, err
+	typ := sendCmdAttr(sendEndianess.Uint16(p[:2]))
+	if typ > sendAttrMax || (r.opts.Strict && typ == sendAttrUnspec) {
+		return nil, 0, fmt.Errorf("invalid tlv in cmd: %q", typ)
 	}
-	typ := sendCmdAttr(h.Type)
-	if sendCmdAttr(typ) > sendAttrMax { // || th.Len > _BTRFS_SEND_BUF_SIZE {
-		return nil, fmt.Errorf("invalid tlv in cmd: %q", typ)
+	if typ == sendAttrData && r.version >= 2 {
+		// since v2 the data is always the last attribute, and it has no length
+		return &SendTLV{Attr: typ, Val: p[2:]}, len(p), nil
 	}
-	buf := make([]byte, h.Len)
-	_, err = io.ReadFull(rd, buf)
-	if err != nil {
-		return nil, fmt.Errorf("cannot read tlv: %v", err)
+	var h tlvHeader
+	if err := h.Unmarshal(p); err != nil {
+		return nil, 0, errors.New("truncated tlv header")
 	}
+	n := tlvHeaderSize + int(h.Len)
+	if n > len(p) {
+		return nil, 0, fmt.Errorf("tlv %v is out of bounds: %d > %d", typ, h.Len, len(p)-tlvHeaderSize)
+	}
+	buf := p[tlvHeaderSize:n]
 	var v interface{}
 	switch typ {
 	case sendAttrCtransid, sendAttrCloneCtransid,
 		sendAttrUid, sendAttrGid, sendAttrMode,
-		sendAttrIno, sendAttrFileOffset, sendAttrSize,
-		sendAttrCloneOffset, sendAttrCloneLen:
+		sendAttrIno, sendAttrFileOffset, sendAttrSize, sendAttrRdev,
+		sendAttrCloneOffset, sendAttrCloneLen, sendAttrFileattr,
+		sendAttrUnencodedFileLen, sendAttrUnencodedLen, sendAttrUnencodedOffset:
 		if len(buf) != 8 {
-			return nil, fmt.Errorf("unexpected int64 size: %v", h.Len)
+			return nil, 0, fmt.Errorf("unexpected int64 size: %v", h.Len)
 		}
 		v = sendEndianess.Uint64(buf[:8])
-	case sendAttrPath, sendAttrPathTo, sendAttrClonePath, sendAttrXattrName:
+	case sendAttrFallocateMode, sendAttrCompression, sendAttrEncryption:
+		if len(buf) != 4 {
+			return nil, 0, fmt.Errorf("unexpected int32 size: %v", h.Len)
+		}
+		v = sendEndianess.Uint32(buf[:4])
+	case sendAttrPath, sendAttrPathTo, sendAttrPathLink, sendAttrClonePath, sendAttrXattrName:
+		if err := r.opts.checkName(typ, buf); err != nil {
+			return nil, 0, err
+		}
 		v = string(buf)
 	case sendAttrData, sendAttrXattrData:
 		v = buf
 	case sendAttrUuid, sendAttrCloneUuid:
 		if h.Len != btrfs.UUIDSize {
-			return nil, fmt.Errorf("unexpected UUID size: %v", h.Len)
+			return nil, 0, fmt.Errorf("unexpected UUID size: %v", h.Len)
 		}
 		var u btrfs.UUID
 		copy(u[:], buf)
 		v = u
 	case sendAttrAtime, sendAttrMtime, sendAttrCtime, sendAttrOtime:
 		if h.Len != 12 {
-			return nil, fmt.Errorf("unexpected timestamp size: %v", h.Len)
+			return nil, 0, fmt.Errorf("unexpected timestamp size: %v", h.Len)
+		}
+		nsec := sendEndianess.Uint32(buf[8:])
+		if r.opts.Strict && nsec >= 1e9 {
+			return nil, 0, fmt.Errorf("invalid timestamp: %d ns", nsec)
 		}
 		v = time.Unix( // btrfs_timespec
 			int64(sendEndianess.Uint64(buf[:8])),
-			int64(sendEndianess.Uint32(buf[8:])),
+			int64(nsec),
 		)
 	default:
-		return nil, fmt.Errorf("unsupported tlv type: %v (len: %v)", typ, h.Len)
+		return nil, 0, fmt.Errorf("unsupported tlv type: %v (len: %v)", typ, h.Len)
 	}
-	return &SendTLV{Attr: typ, Val: v}, nil
+	return &SendTLV{Attr: typ, Val: v}, n, nil
 }
-func (r *StreamReader) ReadCommand() (_ Cmd, gerr error) {
+
+// ReadCommand reads and decodes the next command. It returns io.EOF at the end of the input,
+// and ErrMalformedStream if the command is corrupted or exceeds limits of the protocol.
+func (r *StreamReader) ReadCommand() (Cmd, error) {
+	off := r.r.n
 	h, err := r.readCmdHeader()
 	if err != nil {
 		return nil, err
 	}
-	var tlvs []SendTLV
-	rd := io.LimitReader(r.r, int64(h.Len))
-	defer io.Copy(ioutil.Discard, rd)
-	for {
-		tlv, err := r.readTLV(rd)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, fmt.Errorf("command %v: %v", h.Cmd, err)
+	malformed := func(format string, args ...interface{}) error {
+		return &ErrMalformedStream{Offset: off, Cmd: h.Cmd, Reason: fmt.Sprintf(format, args...)}
+	}
+	if max := r.opts.maxCommandSize(r.version); int64(h.Len) > int64(max) {
+		return nil, malformed("command size %d exceeds the limit of %d bytes", h.Len, max)
+	}
+	// the whole payload is read first, so a corrupted command doesn't desync the stream
+	payload := make([]byte, h.Len)
+	if _, err = io.ReadFull(r.r, payload); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, malformed("truncated command")
+	} else if err != nil {
+		return nil, fmt.Errorf("command %v: cannot read tlv: %v", h.Cmd, err)
+	}
+	if r.opts.Strict {
+		if h.Cmd == sendCmdUnspec || h.Cmd > sendCmdMax || (r.version < 2 && h.Cmd > sendCmdMaxV1) {
+			return nil, malformed("unsupported command")
+		}
+		hdr := r.buf
+		sendEndianess.PutUint32(hdr[6:], 0)
+		crc := ^crc32.Update(crc32.Update(^uint32(0), crc32c, hdr[:]), crc32c, payload)
+		if crc != h.Crc {
+			return nil, malformed("checksum mismatch: %#x != %#x", crc, h.Crc)
+		}
+	}
+	var (
+		tlvs []SendTLV
+		seen [sendAttrMax + 1]bool
+	)
+	for p := payload; len(p) > 0; {
+		tlv, n, err := r.parseTLV(p)
+		if err != nil {
+			return nil, malformed("%v", err)
+		}
+		if r.opts.Strict {
+			if seen[tlv.Attr] {
+				return nil, malformed("duplicate attribute %v", tlv.Attr)
+			}
+			seen[tlv.Attr] = true
 		}
 		tlvs = append(tlvs, *tlv)
+		p = p[n:]
 	}
 	var c Cmd
 	switch h.Cmd {
@@ -143,12 +237,40 @@ func (r *StreamReader) ReadCommand() (_ Cmd, gerr error) {
 		c = &WriteCmd{}
 	case sendCmdTruncate:
 		c = &TruncateCmd{}
+	case sendCmdMknod:
+		c = &MknodCmd{}
+	case sendCmdMkfifo:
+		c = &MkfifoCmd{}
+	case sendCmdMksock:
+		c = &MksockCmd{}
+	case sendCmdSymlink:
+		c = &SymlinkCmd{}
+	case sendCmdLink:
+		c = &LinkCmd{}
+	case sendCmdUnlink:
+		c = &UnlinkCmd{}
+	case sendCmdRmdir:
+		c = &RmdirCmd{}
+	case sendCmdSetXattr:
+		c = &SetXattrCmd{}
+	case sendCmdRemoveXattr:
+		c = &RemoveXattrCmd{}
+	case sendCmdClone:
+		c = &CloneCmd{}
+	case sendCmdUpdateExtent:
+		c = &UpdateExtentCmd{}
+	case sendCmdFallocate:
+		c = &FallocateCmd{}
+	case sendCmdFileattr:
+		c = &FileattrCmd{}
+	case sendCmdEncodedWrite:
+		c = &EncodedWriteCmd{}
 	}
 	if c == nil {
 		return &UnknownSendCmd{Kind: h.Cmd, Params: tlvs}, nil
 	}
 	if err := c.decode(tlvs); err != nil {
-		return nil, err
+		return nil, malformed("%v", err)
 	}
 	return c, nil
 }
@@ -176,6 +298,7 @@ func (e errUnexpectedAttr) Error() string {
 type Cmd interface {
 	Type() CmdType
 	decode(tlvs []SendTLV) error
+	encode() []SendTLV
 }
 
 type UnknownSendCmd struct {
@@ -482,3 +605,394 @@ func (c *TruncateCmd) decode(tlvs []SendTLV) error {
 	}
 	return nil
 }
+
+type MknodCmd struct {
+	Path string
+	Ino  uint64
+	Mode uint64
+	Rdev uint64
+}
+
+func (c MknodCmd) Type() CmdType {
+	return sendCmdMknod
+}
+func (c *MknodCmd) decode(tlvs []SendTLV) error {
+	return decodeNode(c.Type(), tlvs, &c.Path, &c.Ino, &c.Mode, &c.Rdev)
+}
+
+type MkfifoCmd struct {
+	Path string
+	Ino  uint64
+	Mode uint64
+	Rdev uint64
+}
+
+func (c MkfifoCmd) Type() CmdType {
+	return sendCmdMkfifo
+}
+func (c *MkfifoCmd) decode(tlvs []SendTLV) error {
+	return decodeNode(c.Type(), tlvs, &c.Path, &c.Ino, &c.Mode, &c.Rdev)
+}
+
+type MksockCmd struct {
+	Path string
+	Ino  uint64
+	Mode uint64
+	Rdev uint64
+}
+
+func (c MksockCmd) Type() CmdType {
+	return sendCmdMksock
+}
+func (c *MksockCmd) decode(tlvs []SendTLV) error {
+	return decodeNode(c.Type(), tlvs, &c.Path, &c.Ino, &c.Mode, &c.Rdev)
+}
+
+// decodeNode decodes attributes of special file creation commands (mknod, mkfifo, mksock).
+func decodeNode(typ CmdType, tlvs []SendTLV, path *string, ino, mode, rdev *uint64) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			*path, ok = tlv.Val.(string)
+		case sendAttrIno:
+			*ino, ok = tlv.Val.(uint64)
+		case sendAttrMode:
+			*mode, ok = tlv.Val.(uint64)
+		case sendAttrRdev:
+			*rdev, ok = tlv.Val.(uint64)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: typ}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: typ}
+		}
+	}
+	return nil
+}
+
+type SymlinkCmd struct {
+	Path string
+	Ino  uint64
+	Link string // target of the symlink
+}
+
+func (c SymlinkCmd) Type() CmdType {
+	return sendCmdSymlink
+}
+func (c *SymlinkCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrIno:
+			c.Ino, ok = tlv.Val.(uint64)
+		case sendAttrPathLink:
+			c.Link, ok = tlv.Val.(string)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+
+type LinkCmd struct {
+	Path string // path of the new link
+	Link string // path of an existing file
+}
+
+func (c LinkCmd) Type() CmdType {
+	return sendCmdLink
+}
+func (c *LinkCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrPathLink:
+			c.Link, ok = tlv.Val.(string)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+
+type UnlinkCmd struct {
+	Path string
+}
+
+func (c UnlinkCmd) Type() CmdType {
+	return sendCmdUnlink
+}
+func (c *UnlinkCmd) decode(tlvs []SendTLV) error {
+	return decodePath(c.Type(), tlvs, &c.Path)
+}
+
+type RmdirCmd struct {
+	Path string
+}
+
+func (c RmdirCmd) Type() CmdType {
+	return sendCmdRmdir
+}
+func (c *RmdirCmd) decode(tlvs []SendTLV) error {
+	return decodePath(c.Type(), tlvs, &c.Path)
+}
+
+// decodePath decodes attributes of commands that only have a path.
+func decodePath(typ CmdType, tlvs []SendTLV, path *string) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			*path, ok = tlv.Val.(string)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: typ}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: typ}
+		}
+	}
+	return nil
+}
+
+type SetXattrCmd struct {
+	Path string
+	Name string
+	Data []byte
+}
+
+func (c SetXattrCmd) Type() CmdType {
+	return sendCmdSetXattr
+}
+func (c *SetXattrCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrXattrName:
+			c.Name, ok = tlv.Val.(string)
+		case sendAttrXattrData:
+			c.Data, ok = tlv.Val.([]byte)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+
+type RemoveXattrCmd struct {
+	Path string
+	Name string
+}
+
+func (c RemoveXattrCmd) Type() CmdType {
+	return sendCmdRemoveXattr
+}
+func (c *RemoveXattrCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrXattrName:
+			c.Name, ok = tlv.Val.(string)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+
+// CloneCmd shares a range of another file with the file at Path.
+// The source file is at ClonePath in the subvolume identified by CloneUUID and CloneCTransID.
+type CloneCmd struct {
+	Path          string
+	Off           uint64
+	Len           uint64
+	CloneUUID     btrfs.UUID
+	CloneCTransID uint64
+	ClonePath     string
+	CloneOff      uint64
+}
+
+func (c CloneCmd) Type() CmdType {
+	return sendCmdClone
+}
+func (c *CloneCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrFileOffset:
+			c.Off, ok = tlv.Val.(uint64)
+		case sendAttrCloneLen:
+			c.Len, ok = tlv.Val.(uint64)
+		case sendAttrCloneUuid:
+			c.CloneUUID, ok = tlv.Val.(btrfs.UUID)
+		case sendAttrCloneCtransid:
+			c.CloneCTransID, ok = tlv.Val.(uint64)
+		case sendAttrClonePath:
+			c.ClonePath, ok = tlv.Val.(string)
+		case sendAttrCloneOffset:
+			c.CloneOff, ok = tlv.Val.(uint64)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+
+// UpdateExtentCmd is sent instead of writes when the stream has no file data.
+type UpdateExtentCmd struct {
+	Path string
+	Off  uint64
+	Size uint64
+}
+
+func (c UpdateExtentCmd) Type() CmdType {
+	return sendCmdUpdateExtent
+}
+func (c *UpdateExtentCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrFileOffset:
+			c.Off, ok = tlv.Val.(uint64)
+		case sendAttrSize:
+			c.Size, ok = tlv.Val.(uint64)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+
+// FallocateCmd preallocates or deallocates a range of a file (protocol v2).
+// Mode is a set of FALLOC_FL_* flags.
+type FallocateCmd struct {
+	Path string
+	Mode uint32
+	Off  uint64
+	Size uint64
+}
+
+func (c FallocateCmd) Type() CmdType {
+	return sendCmdFallocate
+}
+func (c *FallocateCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrFallocateMode:
+			c.Mode, ok = tlv.Val.(uint32)
+		case sendAttrFileOffset:
+			c.Off, ok = tlv.Val.(uint64)
+		case sendAttrSize:
+			c.Size, ok = tlv.Val.(uint64)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+
+// FileattrCmd sets inode flags of a file (protocol v2). Attr is a set of BTRFS_INODE_* flags.
+type FileattrCmd struct {
+	Path string
+	Attr uint64
+}
+
+func (c FileattrCmd) Type() CmdType {
+	return sendCmdFileattr
+}
+func (c *FileattrCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrFileattr:
+			c.Attr, ok = tlv.Val.(uint64)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
+
+// EncodedWriteCmd writes compressed data to a file (protocol v2). See btrfs.EncodedWrite.
+type EncodedWriteCmd struct {
+	Path   string
+	Off    uint64
+	Extent btrfs.EncodedExtent
+	Data   []byte
+}
+
+func (c EncodedWriteCmd) Type() CmdType {
+	return sendCmdEncodedWrite
+}
+func (c *EncodedWriteCmd) decode(tlvs []SendTLV) error {
+	for _, tlv := range tlvs {
+		var ok bool
+		switch tlv.Attr {
+		case sendAttrPath:
+			c.Path, ok = tlv.Val.(string)
+		case sendAttrFileOffset:
+			c.Off, ok = tlv.Val.(uint64)
+		case sendAttrUnencodedFileLen:
+			c.Extent.Len, ok = tlv.Val.(uint64)
+		case sendAttrUnencodedLen:
+			c.Extent.UnencodedLen, ok = tlv.Val.(uint64)
+		case sendAttrUnencodedOffset:
+			c.Extent.UnencodedOffset, ok = tlv.Val.(uint64)
+		case sendAttrCompression:
+			var v uint32
+			v, ok = tlv.Val.(uint32)
+			c.Extent.Compression = btrfs.EncodedCompression(v)
+		case sendAttrEncryption:
+			c.Extent.Encryption, ok = tlv.Val.(uint32)
+		case sendAttrData:
+			c.Data, ok = tlv.Val.([]byte)
+		default:
+			return errUnexpectedAttr{Val: tlv, Cmd: c.Type()}
+		}
+		if !ok {
+			return errUnexpectedAttrType{Val: tlv, Cmd: c.Type()}
+		}
+	}
+	return nil
+}
@@ -12,6 +12,10 @@ const (
 	sendStreamMagic     = "btrfs-stream\x00"
 	sendStreamMagicSize = len(sendStreamMagic)
 	sendStreamVersion   = 1
+	// sendStreamVersionMax is the highest supported protocol version.
+	// Version 2 adds encoded writes, fallocate and file attributes, and changes
+	// the encoding of the data attribute.
+	sendStreamVersionMax = 2
 )
 
 const (
@@ -99,6 +103,10 @@ var cmdTypeNames = []string{
 
 	"end",
 	"update_extent",
+
+	"fallocate",
+	"fileattr",
+	"encoded_write",
 	"<max>",
 }
 
@@ -133,9 +141,17 @@ const (
 
 	sendCmdEnd
 	sendCmdUpdateExtent
+
+	// version 2
+	sendCmdFallocate
+	sendCmdFileattr
+	sendCmdEncodedWrite
 	_sendCmdMax
 )
 
+// sendCmdMaxV1 is the last command of the protocol version 1.
+const sendCmdMaxV1 = sendCmdUpdateExtent
+
 const sendCmdMax = _sendCmdMax - 1
 
 type sendCmdAttr uint16
@@ -184,6 +200,15 @@ const (
 	sendAttrCloneOffset
 	sendAttrCloneLen
 
+	// version 2
+	sendAttrFallocateMode
+	sendAttrFileattr
+	sendAttrUnencodedFileLen
+	sendAttrUnencodedLen
+	sendAttrUnencodedOffset
+	sendAttrCompression
+	sendAttrEncryption
+
 	_sendAttrMax
 )
 const sendAttrMax = _sendAttrMax - 1
@@ -221,5 +246,13 @@ var sendAttrNames = []string{
 	"cloneoffset",
 	"clonelen",
 
+	"fallocatemode",
+	"fileattr",
+	"unencodedfilelen",
+	"unencodedlen",
+	"unencodedoffset",
+	"compression",
+	"encryption",
+
 	"<max>",
 }
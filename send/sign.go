@@ -0,0 +1,62 @@
+package send
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const signaturePrefix = "gbtrfs-stream-signature/v1\n"
+
+// ErrBadSignature is returned by VerifyDigest if the signature doesn't match the digest or the key.
+var ErrBadSignature = errors.New("invalid stream signature")
+
+func signedMessage(d Digest) []byte {
+	return []byte(signaturePrefix + d.String())
+}
+
+// SignDigest returns an Ed25519 signature of a stream with a given digest (see DigestWriter).
+// The signature is detached: it's stored separately from the stream, see WriteSignatureFile.
+func SignDigest(key ed25519.PrivateKey, d Digest) []byte {
+	return ed25519.Sign(key, signedMessage(d))
+}
+
+// VerifyDigest checks a signature of a stream digest. The stream itself must be checked against
+// the digest separately, for example with ReceiveOptions.Digest.
+func VerifyDigest(key ed25519.PublicKey, d Digest, sig []byte) error {
+	if !ed25519.Verify(key, signedMessage(d), sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// WriteSignatureFile writes a digest of a stream and its signature to a sidecar file.
+func WriteSignatureFile(path string, d Digest, sig []byte) error {
+	data := d.String() + "\n" + base64.StdEncoding.EncodeToString(sig) + "\n"
+	return ioutil.WriteFile(path, []byte(data), 0644)
+}
+
+// ReadSignatureFile reads a digest and a signature written by WriteSignatureFile.
+// The signature is not verified.
+func ReadSignatureFile(path string) (Digest, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Digest{}, nil, err
+	}
+	lines := strings.Fields(string(data))
+	if len(lines) != 2 {
+		return Digest{}, nil, fmt.Errorf("invalid signature file: %s", path)
+	}
+	d, err := ParseDigest(lines[0])
+	if err != nil {
+		return Digest{}, nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil {
+		return Digest{}, nil, fmt.Errorf("invalid signature: %v", err)
+	}
+	return d, sig, nil
+}
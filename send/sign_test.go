@@ -0,0 +1,91 @@
+package send
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestSignDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "btrfs-sign-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := GenerateKey(KeyEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := PublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, pubFile := filepath.Join(dir, "key.pem"), filepath.Join(dir, "pub.pem")
+	if err = WriteKeyFile(keyFile, key); err != nil {
+		t.Fatal(err)
+	} else if err = WriteKeyFile(pubFile, pub); err != nil {
+		t.Fatal(err)
+	}
+	key2, err := ReadKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub2, err := ReadKeyFile(pubFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := ParseDigest("sha256:" + "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigFile := filepath.Join(dir, "sig")
+	if err = WriteSignatureFile(sigFile, d, SignDigest(key2.(ed25519.PrivateKey), d)); err != nil {
+		t.Fatal(err)
+	}
+	d2, sig, err := ReadSignatureFile(sigFile)
+	if err != nil {
+		t.Fatal(err)
+	} else if !d.Equal(d2) {
+		t.Fatalf("digests differ: %v vs %v", d, d2)
+	}
+	if err = VerifyDigest(pub2.(ed25519.PublicKey), d2, sig); err != nil {
+		t.Fatal(err)
+	}
+	d2.Sum[0] ^= 1
+	if err = VerifyDigest(pub2.(ed25519.PublicKey), d2, sig); err != ErrBadSignature {
+		t.Fatalf("expected %v, got %v", ErrBadSignature, err)
+	}
+
+	xkey, err := GenerateKey(KeyX25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = WriteKeyFile(keyFile, xkey); err != nil {
+		t.Fatal(err)
+	}
+	xkey2, err := ReadKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	} else if xkey2.(*age.X25519Identity).String() != xkey.(*age.X25519Identity).String() {
+		t.Fatal("keys differ")
+	}
+	xpub, err := PublicKey(xkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = WriteKeyFile(pubFile, xpub); err != nil {
+		t.Fatal(err)
+	}
+	xpub2, err := ReadKeyFile(pubFile)
+	if err != nil {
+		t.Fatal(err)
+	} else if xpub2.(*age.X25519Recipient).String() != xpub.(*age.X25519Recipient).String() {
+		t.Fatal("public keys differ")
+	}
+}
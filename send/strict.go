@@ -0,0 +1,101 @@
+package send
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Limits of the kernel for commands of each protocol version: BTRFS_SEND_BUF_SIZE_V1
+// and BTRFS_SEND_BUF_SIZE_V2, which depends on the page size (64K at most).
+const (
+	maxCommandSizeV1 = sendBufSize - cmdHeaderSize
+	maxCommandSizeV2 = 192*1024 - cmdHeaderSize
+
+	maxPathLen = 4095 // PATH_MAX without the terminating zero
+	maxNameLen = 255  // NAME_MAX and XATTR_NAME_MAX
+)
+
+// ErrMalformedStream is returned by StreamReader if a command is corrupted, truncated
+// or exceeds limits of the protocol.
+type ErrMalformedStream struct {
+	Offset int64   // offset of the command, relative to the start of the reader
+	Cmd    CmdType // zero if the command header cannot be read
+	Reason string
+}
+
+func (e *ErrMalformedStream) Error() string {
+	if e.Cmd == sendCmdUnspec {
+		return fmt.Sprintf("malformed stream at %d: %s", e.Offset, e.Reason)
+	}
+	return fmt.Sprintf("malformed stream at %d: command %v: %s", e.Offset, e.Cmd, e.Reason)
+}
+
+// ReaderOptions controls validation of streams by StreamReader.
+//
+// Regardless of the options, the size of each command is limited, so corrupted input cannot
+// cause large allocations, and all decoding failures are reported as ErrMalformedStream.
+type ReaderOptions struct {
+	// Strict enables validation suitable for untrusted streams: checksums of commands are verified,
+	// unknown commands and duplicate attributes are rejected, and paths must not contain
+	// zero bytes or exceed PATH_MAX (NAME_MAX for each component and xattr names).
+	Strict bool
+	// RequireUTF8 rejects paths and xattr names that are not valid UTF-8.
+	// Linux allows any bytes in names, thus it may reject valid streams.
+	RequireUTF8 bool
+	// MaxCommandSize limits the size of a single command. Zero means the maximal size of
+	// commands generated by the kernel for the protocol version. It cannot be raised above it.
+	MaxCommandSize int
+}
+
+func (o *ReaderOptions) maxCommandSize(version int) int {
+	max := maxCommandSizeV1
+	if version >= 2 {
+		max = maxCommandSizeV2
+	}
+	if o.MaxCommandSize > 0 && o.MaxCommandSize < max {
+		max = o.MaxCommandSize
+	}
+	return max
+}
+
+// checkName validates a path or a name attribute.
+func (o *ReaderOptions) checkName(typ sendCmdAttr, p []byte) error {
+	if o.RequireUTF8 && !utf8.Valid(p) {
+		return fmt.Errorf("%v is not valid UTF-8", typ)
+	}
+	if !o.Strict {
+		return nil
+	}
+	if err := checkName(typ, p); err != nil {
+		return fmt.Errorf("invalid %v: %v", typ, err)
+	}
+	return nil
+}
+
+func checkName(typ sendCmdAttr, p []byte) error {
+	if bytes.IndexByte(p, 0) >= 0 {
+		return errors.New("contains a zero byte")
+	}
+	max := maxPathLen
+	if typ == sendAttrXattrName {
+		max = maxNameLen
+		if len(p) == 0 {
+			return errors.New("empty")
+		}
+	}
+	if len(p) > max {
+		return fmt.Errorf("too long: %d bytes", len(p))
+	}
+	if typ == sendAttrXattrName || typ == sendAttrPathLink {
+		// symlink targets are arbitrary strings, only their length is limited
+		return nil
+	}
+	for _, c := range bytes.Split(p, []byte("/")) {
+		if len(c) > maxNameLen {
+			return fmt.Errorf("path component is too long: %d bytes", len(c))
+		}
+	}
+	return nil
+}
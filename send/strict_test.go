@@ -0,0 +1,135 @@
+package send
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/dennwc/btrfs"
+)
+
+func strictTestStream(t testing.TB, cmds ...Cmd) []byte {
+	buf := bytes.NewBuffer(nil)
+	w, err := NewStreamWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cmds {
+		if err := w.WriteCommand(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// readAllCommands reads commands until the end of the stream or the first error.
+func readAllCommands(data []byte, opts *ReaderOptions) error {
+	sr, err := NewStreamReaderWithOptions(bytes.NewReader(data), opts)
+	if err != nil {
+		return err
+	}
+	for {
+		_, err := sr.ReadCommand()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func TestStrictReader(t *testing.T) {
+	cmds := []Cmd{
+		&SubvolCmd{Path: "sub", UUID: btrfs.UUID{1}, CTransID: 10},
+		&MkfileCmd{Path: "file", Ino: 257},
+		&WriteCmd{Path: "file", Data: []byte("data")},
+		&SetXattrCmd{Path: "file", Name: "user.a", Data: []byte("b")},
+		&StreamEnd{},
+	}
+	data := strictTestStream(t, cmds...)
+	strict := &ReaderOptions{Strict: true}
+	if err := readAllCommands(data, strict); err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupted data is only detected by checksums
+	bad := append([]byte{}, data...)
+	i := bytes.Index(bad, []byte("data"))
+	bad[i] = 'x'
+	if err := readAllCommands(bad, nil); err != nil {
+		t.Fatal(err)
+	}
+	err := readAllCommands(bad, strict)
+	if e, ok := err.(*ErrMalformedStream); !ok {
+		t.Fatalf("expected a malformed stream error, got: %v", err)
+	} else if e.Cmd != sendCmdWrite {
+		t.Fatalf("unexpected command: %v", e.Cmd)
+	}
+
+	for _, c := range []struct {
+		name string
+		cmd  Cmd
+	}{
+		{"zero byte", &MkfileCmd{Path: "a\x00b", Ino: 258}},
+		{"long component", &MkfileCmd{Path: string(bytes.Repeat([]byte("a"), maxNameLen+1)), Ino: 258}},
+		{"empty xattr", &RemoveXattrCmd{Path: "file", Name: ""}},
+		{"unknown command", &UnknownSendCmd{Kind: sendCmdUnspec}},
+	} {
+		data := strictTestStream(t, cmds[0], c.cmd)
+		if _, ok := readAllCommands(data, strict).(*ErrMalformedStream); !ok {
+			t.Errorf("%s: expected a malformed stream error", c.name)
+		}
+	}
+
+	data = strictTestStream(t, cmds[0], &WriteCmd{Path: "file", Data: make([]byte, 1000)})
+	if err := readAllCommands(data, &ReaderOptions{MaxCommandSize: 100}); err == nil {
+		t.Fatal("expected an error for a large command")
+	}
+	if err := readAllCommands(data, &ReaderOptions{RequireUTF8: true}); err != nil {
+		t.Fatal(err)
+	}
+	data = strictTestStream(t, cmds[0], &MkfileCmd{Path: "\xff", Ino: 258})
+	if _, ok := readAllCommands(data, &ReaderOptions{RequireUTF8: true}).(*ErrMalformedStream); !ok {
+		t.Fatal("expected a malformed stream error for an invalid UTF-8 path")
+	}
+}
+
+func TestReaderCorruption(t *testing.T) {
+	data := strictTestStream(t,
+		&SubvolCmd{Path: "sub", UUID: btrfs.UUID{1}, CTransID: 10},
+		&MkfileCmd{Path: "file", Ino: 257},
+		&WriteCmd{Path: "file", Off: 4096, Data: bytes.Repeat([]byte("data"), 100)},
+		&UTimesCmd{Path: "file"},
+		&StreamEnd{},
+	)
+	rnd := rand.New(rand.NewSource(1))
+	hdr := sendStreamMagicSize + 4
+	for i := 0; i < 2000; i++ {
+		bad := append([]byte{}, data...)
+		for j := 0; j < 1+rnd.Intn(4); j++ {
+			bad[hdr+rnd.Intn(len(bad)-hdr)] = byte(rnd.Intn(256))
+		}
+		if rnd.Intn(4) == 0 {
+			bad = bad[:hdr+rnd.Intn(len(bad)-hdr)]
+		}
+		for _, opts := range []*ReaderOptions{nil, {Strict: true}} {
+			err := readAllCommands(bad, opts)
+			if _, ok := err.(*ErrMalformedStream); err != nil && !ok {
+				t.Fatalf("unexpected error type: %T: %v", err, err)
+			}
+		}
+	}
+}
+
+func FuzzStreamReader(f *testing.F) {
+	f.Add(strictTestStream(f,
+		&SubvolCmd{Path: "sub", UUID: btrfs.UUID{1}, CTransID: 10},
+		&WriteCmd{Path: "file", Data: []byte("data")},
+		&StreamEnd{},
+	))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		readAllCommands(data, nil)
+		readAllCommands(data, &ReaderOptions{Strict: true, RequireUTF8: true})
+	})
+}
@@ -0,0 +1,245 @@
+package send
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Transform rewrites commands of a send stream, see TransformStream.
+type Transform interface {
+	// Transform returns commands that replace c in the output stream: nil drops the command,
+	// and c itself (possibly modified) keeps it. End commands are not passed to transforms.
+	Transform(c Cmd) ([]Cmd, error)
+}
+
+// TransformFunc is a function implementing Transform.
+type TransformFunc func(c Cmd) ([]Cmd, error)
+
+func (f TransformFunc) Transform(c Cmd) ([]Cmd, error) {
+	return f(c)
+}
+
+// TransformStream decodes a stream from r, passes each command through transforms in order,
+// and writes the re-encoded stream to w. Concatenated streams are transformed one by one.
+//
+// Transforms change the content of the stream, thus its digest; a stream that was transformed
+// on the receiving side must not be verified against a digest of the original stream.
+func TransformStream(w io.Writer, r io.Reader, transforms ...Transform) error {
+	sr, err := NewStreamReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		sw, err := NewStreamWriterVersion(w, sr.Version())
+		if err != nil {
+			return err
+		}
+		for {
+			c, err := sr.ReadCommand()
+			if err == io.EOF {
+				return nil // stream without the end command
+			} else if err != nil {
+				return err
+			}
+			if c.Type() == sendCmdEnd {
+				if err = sw.WriteCommand(c); err != nil {
+					return err
+				}
+				break
+			}
+			cmds, err := applyTransforms(c, transforms)
+			if err != nil {
+				return err
+			}
+			for _, c := range cmds {
+				if err = sw.WriteCommand(c); err != nil {
+					return err
+				}
+			}
+		}
+		if err = sr.NextStream(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func applyTransforms(c Cmd, transforms []Transform) ([]Cmd, error) {
+	cmds := []Cmd{c}
+	for _, t := range transforms {
+		var next []Cmd
+		for _, c := range cmds {
+			out, err := t.Transform(c)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, out...)
+		}
+		if cmds = next; len(cmds) == 0 {
+			break
+		}
+	}
+	return cmds, nil
+}
+
+// NewTransformReader returns a reader of the stream from r transformed by TransformStream.
+// Closing the reader stops the transformation.
+func NewTransformReader(r io.Reader, transforms ...Transform) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(TransformStream(pw, r, transforms...))
+	}()
+	return pr
+}
+
+// DropXattrs removes extended attributes with names accepted by match from the stream.
+func DropXattrs(match func(name string) bool) Transform {
+	return TransformFunc(func(c Cmd) ([]Cmd, error) {
+		switch c := c.(type) {
+		case *SetXattrCmd:
+			if match(c.Name) {
+				return nil, nil
+			}
+		case *RemoveXattrCmd:
+			if match(c.Name) {
+				return nil, nil
+			}
+		}
+		return []Cmd{c}, nil
+	})
+}
+
+// StripSecurityLabels removes security extended attributes (SELinux labels, capabilities, etc)
+// from the stream, so the receiver applies its own policy.
+func StripSecurityLabels() Transform {
+	return DropXattrs(func(name string) bool {
+		return strings.HasPrefix(name, "security.")
+	})
+}
+
+// RemapOwners changes owners and groups of files according to the maps.
+// Ids that are not in the maps are not changed.
+func RemapOwners(uids, gids map[uint64]uint64) Transform {
+	return TransformFunc(func(c Cmd) ([]Cmd, error) {
+		if c, ok := c.(*ChownCmd); ok {
+			if id, ok := uids[c.UID]; ok {
+				c.UID = id
+			}
+			if id, ok := gids[c.GID]; ok {
+				c.GID = id
+			}
+		}
+		return []Cmd{c}, nil
+	})
+}
+
+// ExcludePaths removes files accepted by match from the stream. If a directory is excluded,
+// all its content is excluded as well. Paths are relative to the subvolume root.
+//
+// For incremental streams, the same paths must have been excluded from the parent.
+// Hard links and clones of excluded files cannot be received and are reported as errors.
+func ExcludePaths(match func(path string) bool) Transform {
+	return &excludeTransform{
+		match:  match,
+		dirs:   make(map[string]bool),
+		hidden: make(map[string]bool),
+	}
+}
+
+type excludeTransform struct {
+	match  func(path string) bool
+	dirs   map[string]bool // directories created by the stream
+	hidden map[string]bool // temporary names of excluded files
+}
+
+// excluded checks if the path or any of its parents is excluded.
+func (t *excludeTransform) excluded(p string) bool {
+	for p != "" {
+		if t.hidden[p] || t.match(p) {
+			return true
+		}
+		i := strings.LastIndexByte(p, '/')
+		if i < 0 {
+			return false
+		}
+		p = p[:i]
+	}
+	return false
+}
+
+func (t *excludeTransform) remove(p string) Cmd {
+	if t.dirs[p] {
+		delete(t.dirs, p)
+		return &RmdirCmd{Path: p}
+	}
+	return &UnlinkCmd{Path: p}
+}
+
+func (t *excludeTransform) Transform(c Cmd) ([]Cmd, error) {
+	keep := []Cmd{c}
+	switch c := c.(type) {
+	case *SubvolCmd, *SnapshotCmd:
+		return keep, nil
+	case *RenameCmd:
+		fromEx, toEx := t.excluded(c.From), t.excluded(c.To)
+		switch {
+		case fromEx && toEx:
+			delete(t.hidden, c.From)
+			if isTempPath(c.To) {
+				t.hidden[c.To] = true
+			}
+			return nil, nil
+		case fromEx:
+			// send moves files to temporary names before deleting or moving them
+			if !isTempPath(c.To) {
+				return nil, fmt.Errorf("cannot rename excluded path %q to %q", c.From, c.To)
+			}
+			delete(t.hidden, c.From)
+			t.hidden[c.To] = true
+			return nil, nil
+		case toEx:
+			// the file was created with a temporary name, or moved to an excluded path
+			return []Cmd{t.remove(c.From)}, nil
+		}
+		if t.dirs[c.From] {
+			delete(t.dirs, c.From)
+			t.dirs[c.To] = true
+		}
+		return keep, nil
+	case *MkdirCmd:
+		if t.excluded(c.Path) {
+			return nil, nil
+		}
+		t.dirs[c.Path] = true
+		return keep, nil
+	case *UnlinkCmd:
+		ex := t.excluded(c.Path)
+		delete(t.hidden, c.Path)
+		if ex {
+			return nil, nil
+		}
+		return keep, nil
+	case *RmdirCmd:
+		ex := t.excluded(c.Path)
+		delete(t.hidden, c.Path)
+		delete(t.dirs, c.Path)
+		if ex {
+			return nil, nil
+		}
+		return keep, nil
+	case *LinkCmd:
+		if !t.excluded(c.Path) && t.excluded(c.Link) {
+			return nil, fmt.Errorf("cannot link %q to excluded path %q", c.Path, c.Link)
+		}
+	case *CloneCmd:
+		if !t.excluded(c.Path) && t.excluded(c.ClonePath) {
+			return nil, fmt.Errorf("cannot clone %q from excluded path %q", c.Path, c.ClonePath)
+		}
+	}
+	if t.excluded(cmdPath(c)) {
+		return nil, nil
+	}
+	return keep, nil
+}
@@ -0,0 +1,101 @@
+package send
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dennwc/btrfs"
+)
+
+func TestTransformStream(t *testing.T) {
+	in := bytes.NewBuffer(nil)
+	w, err := NewStreamWriter(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Cmd{
+		&SubvolCmd{Path: "vol", UUID: btrfs.UUID{1}, CTransID: 10},
+		&MkdirCmd{Path: "o257-7-0", Ino: 257},
+		&RenameCmd{From: "o257-7-0", To: "cache"},
+		&MkfileCmd{Path: "o258-7-0", Ino: 258},
+		&RenameCmd{From: "o258-7-0", To: "cache/file"},
+		&WriteCmd{Path: "cache/file", Data: []byte("data")},
+		&MkfileCmd{Path: "o259-7-0", Ino: 259},
+		&RenameCmd{From: "o259-7-0", To: "file"},
+		&SetXattrCmd{Path: "file", Name: "security.selinux", Data: []byte("label")},
+		&SetXattrCmd{Path: "file", Name: "user.a", Data: []byte("a")},
+		&ChownCmd{Path: "file", UID: 1000, GID: 1000},
+		&StreamEnd{},
+	} {
+		if err = w.WriteCommand(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := bytes.NewBuffer(nil)
+	err = TransformStream(out, in,
+		ExcludePaths(func(p string) bool { return p == "cache" }),
+		StripSecurityLabels(),
+		RemapOwners(map[uint64]uint64{1000: 2000}, nil),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr, err := NewStreamReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Cmd
+	for {
+		c, err := sr.ReadCommand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, c)
+		if c.Type() == sendCmdEnd {
+			break
+		}
+	}
+	exp := []Cmd{
+		&SubvolCmd{Path: "vol", UUID: btrfs.UUID{1}, CTransID: 10},
+		&MkdirCmd{Path: "o257-7-0", Ino: 257},
+		&RmdirCmd{Path: "o257-7-0"},
+		&MkfileCmd{Path: "o258-7-0", Ino: 258},
+		&UnlinkCmd{Path: "o258-7-0"},
+		&MkfileCmd{Path: "o259-7-0", Ino: 259},
+		&RenameCmd{From: "o259-7-0", To: "file"},
+		&SetXattrCmd{Path: "file", Name: "user.a", Data: []byte("a")},
+		&ChownCmd{Path: "file", UID: 2000, GID: 1000},
+		&StreamEnd{},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected commands:\n%s\nvs\n%s", dumpCmds(got), dumpCmds(exp))
+	}
+}
+
+func dumpCmds(cmds []Cmd) string {
+	var lines []string
+	for _, c := range cmds {
+		lines = append(lines, c.Type().String()+" "+cmdPath(c))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestExcludeRenameOut(t *testing.T) {
+	tr := ExcludePaths(func(p string) bool { return p == "cache" })
+	if _, err := tr.Transform(&RenameCmd{From: "cache", To: "kept"}); err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, c := range []Cmd{
+		&RenameCmd{From: "cache", To: "o260-5-0"},
+		&UnlinkCmd{Path: "o260-5-0/file"},
+		&RmdirCmd{Path: "o260-5-0"},
+	} {
+		if out, err := tr.Transform(c); err != nil {
+			t.Fatal(err)
+		} else if len(out) != 0 {
+			t.Fatalf("%v: expected the command to be dropped", c.Type())
+		}
+	}
+}
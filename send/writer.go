@@ -0,0 +1,334 @@
+package send
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/dennwc/btrfs"
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// streamCRC calculates a checksum of a command, as the kernel does it:
+// crc32c with zero seed and without the final inversion.
+func streamCRC(p []byte) uint32 {
+	return ^crc32.Update(^uint32(0), crc32c, p)
+}
+
+// maxTLVSize is the maximal size of a TLV value in the stream.
+const maxTLVSize = 1<<16 - 1
+
+// maxWriteSize is the maximal size of data in a single write command.
+// Larger writes are split into multiple commands.
+const maxWriteSize = sendReadSize
+
+// StreamWriter serializes commands into a send stream that can be consumed
+// by Receive or by "btrfs receive".
+type StreamWriter struct {
+	w       io.Writer
+	version int
+	buf     []byte
+}
+
+// NewStreamWriter writes a stream header to w and returns a writer for commands.
+// The stream uses protocol version 1.
+func NewStreamWriter(w io.Writer) (*StreamWriter, error) {
+	return NewStreamWriterVersion(w, sendStreamVersion)
+}
+
+// NewStreamWriterVersion is like NewStreamWriter, but allows to select the protocol version.
+// Version 2 is required for encoded writes, fallocate and file attributes.
+func NewStreamWriterVersion(w io.Writer, version int) (*StreamWriter, error) {
+	if version < sendStreamVersion || version > sendStreamVersionMax {
+		return nil, fmt.Errorf("stream version %d not supported", version)
+	}
+	hdr := make([]byte, sendStreamMagicSize+4)
+	copy(hdr, sendStreamMagic)
+	sendEndianess.PutUint32(hdr[sendStreamMagicSize:], uint32(version))
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &StreamWriter{w: w, version: version, buf: make([]byte, 0, sendBufSize)}, nil
+}
+
+// Version returns the protocol version of the stream.
+func (w *StreamWriter) Version() int {
+	return w.version
+}
+
+// WriteCommand serializes a single command, calculating its checksum.
+// Write commands with more data than a single command can hold are split.
+// Callers must write StreamEnd after the last command.
+func (w *StreamWriter) WriteCommand(c Cmd) error {
+	if wc, ok := c.(*WriteCmd); ok && len(wc.Data) > maxWriteSize {
+		for off := 0; off < len(wc.Data); off += maxWriteSize {
+			end := off + maxWriteSize
+			if end > len(wc.Data) {
+				end = len(wc.Data)
+			}
+			part := &WriteCmd{Path: wc.Path, Off: wc.Off + uint64(off), Data: wc.Data[off:end]}
+			if err := w.WriteCommand(part); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if w.version < 2 && c.Type() > sendCmdMaxV1 {
+		return fmt.Errorf("command %v requires stream version 2", c.Type())
+	}
+	return w.writeRaw(c.Type(), c.encode())
+}
+
+func (w *StreamWriter) writeRaw(typ CmdType, tlvs []SendTLV) error {
+	buf := append(w.buf[:0], make([]byte, cmdHeaderSize)...)
+	var err error
+	for _, tlv := range tlvs {
+		buf, err = appendTLV(buf, tlv, w.version)
+		if err != nil {
+			return fmt.Errorf("command %v: %v", typ, err)
+		}
+	}
+	if max := (&ReaderOptions{}).maxCommandSize(w.version); len(buf)-cmdHeaderSize > max {
+		// receivers reject such commands
+		return fmt.Errorf("command %v: size %d exceeds the limit of %d bytes", typ, len(buf)-cmdHeaderSize, max)
+	}
+	sendEndianess.PutUint32(buf[0:], uint32(len(buf)-cmdHeaderSize))
+	sendEndianess.PutUint16(buf[4:], uint16(typ))
+	sendEndianess.PutUint32(buf[6:], 0)
+	sendEndianess.PutUint32(buf[6:], streamCRC(buf))
+	w.buf = buf
+	_, err = w.w.Write(buf)
+	return err
+}
+
+func appendTLV(buf []byte, tlv SendTLV, version int) ([]byte, error) {
+	var val []byte
+	switch v := tlv.Val.(type) {
+	case uint64:
+		val = make([]byte, 8)
+		sendEndianess.PutUint64(val, v)
+	case uint32:
+		val = make([]byte, 4)
+		sendEndianess.PutUint32(val, v)
+	case string:
+		val = []byte(v)
+	case []byte:
+		val = v
+	case btrfs.UUID:
+		val = v[:]
+	case time.Time:
+		val = make([]byte, 12)
+		if !v.IsZero() {
+			sendEndianess.PutUint64(val[0:], uint64(v.Unix()))
+			sendEndianess.PutUint32(val[8:], uint32(v.Nanosecond()))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported value for %v: %T", tlv.Attr, tlv.Val)
+	}
+	if tlv.Attr == sendAttrData && version >= 2 {
+		// since v2 the data has no length and must be the last attribute
+		var hdr [2]byte
+		sendEndianess.PutUint16(hdr[:], uint16(tlv.Attr))
+		buf = append(buf, hdr[:]...)
+		return append(buf, val...), nil
+	}
+	if len(val) > maxTLVSize {
+		return nil, fmt.Errorf("%v is too large: %d", tlv.Attr, len(val))
+	}
+	var hdr [tlvHeaderSize]byte
+	sendEndianess.PutUint16(hdr[0:], uint16(tlv.Attr))
+	sendEndianess.PutUint16(hdr[2:], uint16(len(val)))
+	buf = append(buf, hdr[:]...)
+	return append(buf, val...), nil
+}
+
+func (c *UnknownSendCmd) encode() []SendTLV { return c.Params }
+
+func (c *StreamEnd) encode() []SendTLV { return nil }
+
+func (c *SubvolCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrUuid, Val: c.UUID},
+		{Attr: sendAttrCtransid, Val: c.CTransID},
+	}
+}
+
+func (c *SnapshotCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrUuid, Val: c.UUID},
+		{Attr: sendAttrCtransid, Val: c.CTransID},
+		{Attr: sendAttrCloneUuid, Val: c.CloneUUID},
+		{Attr: sendAttrCloneCtransid, Val: c.CloneTransID},
+	}
+}
+
+func (c *ChownCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrUid, Val: c.UID},
+		{Attr: sendAttrGid, Val: c.GID},
+	}
+}
+
+func (c *ChmodCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrMode, Val: c.Mode},
+	}
+}
+
+func (c *UTimesCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrAtime, Val: c.ATime},
+		{Attr: sendAttrMtime, Val: c.MTime},
+		{Attr: sendAttrCtime, Val: c.CTime},
+	}
+}
+
+func (c *MkdirCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrIno, Val: c.Ino},
+	}
+}
+
+func (c *RenameCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.From},
+		{Attr: sendAttrPathTo, Val: c.To},
+	}
+}
+
+func (c *MkfileCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrIno, Val: c.Ino},
+	}
+}
+
+func (c *WriteCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrFileOffset, Val: c.Off},
+		{Attr: sendAttrData, Val: c.Data},
+	}
+}
+
+func (c *TruncateCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrSize, Val: c.Size},
+	}
+}
+
+func encodeNode(path string, ino, mode, rdev uint64) []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: path},
+		{Attr: sendAttrIno, Val: ino},
+		{Attr: sendAttrMode, Val: mode},
+		{Attr: sendAttrRdev, Val: rdev},
+	}
+}
+
+func (c *MknodCmd) encode() []SendTLV { return encodeNode(c.Path, c.Ino, c.Mode, c.Rdev) }
+
+func (c *MkfifoCmd) encode() []SendTLV { return encodeNode(c.Path, c.Ino, c.Mode, c.Rdev) }
+
+func (c *MksockCmd) encode() []SendTLV { return encodeNode(c.Path, c.Ino, c.Mode, c.Rdev) }
+
+func (c *SymlinkCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrIno, Val: c.Ino},
+		{Attr: sendAttrPathLink, Val: c.Link},
+	}
+}
+
+func (c *LinkCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrPathLink, Val: c.Link},
+	}
+}
+
+func (c *UnlinkCmd) encode() []SendTLV {
+	return []SendTLV{{Attr: sendAttrPath, Val: c.Path}}
+}
+
+func (c *RmdirCmd) encode() []SendTLV {
+	return []SendTLV{{Attr: sendAttrPath, Val: c.Path}}
+}
+
+func (c *SetXattrCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrXattrName, Val: c.Name},
+		{Attr: sendAttrXattrData, Val: c.Data},
+	}
+}
+
+func (c *RemoveXattrCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrXattrName, Val: c.Name},
+	}
+}
+
+func (c *CloneCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrFileOffset, Val: c.Off},
+		{Attr: sendAttrCloneLen, Val: c.Len},
+		{Attr: sendAttrCloneUuid, Val: c.CloneUUID},
+		{Attr: sendAttrCloneCtransid, Val: c.CloneCTransID},
+		{Attr: sendAttrClonePath, Val: c.ClonePath},
+		{Attr: sendAttrCloneOffset, Val: c.CloneOff},
+	}
+}
+
+func (c *UpdateExtentCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrFileOffset, Val: c.Off},
+		{Attr: sendAttrSize, Val: c.Size},
+	}
+}
+
+func (c *FallocateCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrFallocateMode, Val: c.Mode},
+		{Attr: sendAttrFileOffset, Val: c.Off},
+		{Attr: sendAttrSize, Val: c.Size},
+	}
+}
+
+func (c *FileattrCmd) encode() []SendTLV {
+	return []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrFileattr, Val: c.Attr},
+	}
+}
+
+func (c *EncodedWriteCmd) encode() []SendTLV {
+	tlvs := []SendTLV{
+		{Attr: sendAttrPath, Val: c.Path},
+		{Attr: sendAttrFileOffset, Val: c.Off},
+		{Attr: sendAttrUnencodedFileLen, Val: c.Extent.Len},
+		{Attr: sendAttrUnencodedLen, Val: c.Extent.UnencodedLen},
+		{Attr: sendAttrUnencodedOffset, Val: c.Extent.UnencodedOffset},
+	}
+	// both default to none, if omitted
+	if c.Extent.Compression != 0 {
+		tlvs = append(tlvs, SendTLV{Attr: sendAttrCompression, Val: uint32(c.Extent.Compression)})
+	}
+	if c.Extent.Encryption != 0 {
+		tlvs = append(tlvs, SendTLV{Attr: sendAttrEncryption, Val: c.Extent.Encryption})
+	}
+	return append(tlvs, SendTLV{Attr: sendAttrData, Val: c.Data})
+}
@@ -0,0 +1,161 @@
+package send
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dennwc/btrfs"
+)
+
+func TestStreamWriter(t *testing.T) {
+	ts := time.Unix(1500000000, 123)
+	big := make([]byte, maxWriteSize+100)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	cmds := []Cmd{
+		&SnapshotCmd{Path: "snap", UUID: btrfs.UUID{1}, CTransID: 10, CloneUUID: btrfs.UUID{2}, CloneTransID: 5},
+		&MkfileCmd{Path: "o257-7-0", Ino: 257},
+		&RenameCmd{From: "o257-7-0", To: "file"},
+		&WriteCmd{Path: "file", Off: 4096, Data: big},
+		&TruncateCmd{Path: "file", Size: 8192},
+		&ChownCmd{Path: "file", UID: 1000, GID: 1000},
+		&ChmodCmd{Path: "file", Mode: 0644},
+		&UTimesCmd{Path: "file", ATime: ts, MTime: ts, CTime: ts},
+		&UnlinkCmd{Path: "old"},
+		&RmdirCmd{Path: "dir"},
+		&SymlinkCmd{Path: "link", Ino: 258, Link: "file"},
+		&LinkCmd{Path: "hard", Link: "file"},
+		&MknodCmd{Path: "dev", Ino: 259, Mode: 020644, Rdev: 0x103},
+		&MkfifoCmd{Path: "fifo", Ino: 260, Mode: 010644},
+		&MksockCmd{Path: "sock", Ino: 261, Mode: 0140644},
+		&SetXattrCmd{Path: "file", Name: "user.a", Data: []byte("b")},
+		&RemoveXattrCmd{Path: "file", Name: "user.c"},
+		&CloneCmd{Path: "file", Off: 4096, Len: 8192, CloneUUID: btrfs.UUID{2}, CloneCTransID: 5, ClonePath: "src", CloneOff: 0},
+		&UpdateExtentCmd{Path: "file", Off: 0, Size: 4096},
+		&StreamEnd{},
+	}
+	buf := bytes.NewBuffer(nil)
+	w, err := NewStreamWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cmds {
+		if err := w.WriteCommand(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := buf.Bytes()
+	// check checksums of all commands
+	for p := data[sendStreamMagicSize+4:]; len(p) > 0; {
+		var h cmdHeader
+		if err := h.Unmarshal(p[:cmdHeaderSize]); err != nil {
+			t.Fatal(err)
+		}
+		c := append([]byte{}, p[:cmdHeaderSize+int(h.Len)]...)
+		sendEndianess.PutUint32(c[6:], 0)
+		if crc := streamCRC(c); crc != h.Crc {
+			t.Fatalf("wrong crc for %v: %x vs %x", h.Cmd, h.Crc, crc)
+		}
+		p = p[len(c):]
+	}
+
+	r, err := NewStreamReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Cmd
+	for {
+		c, err := r.ReadCommand()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, c)
+	}
+	exp := append([]Cmd{}, cmds[:3]...)
+	exp = append(exp,
+		&WriteCmd{Path: "file", Off: 4096, Data: big[:maxWriteSize]},
+		&WriteCmd{Path: "file", Off: 4096 + maxWriteSize, Data: big[maxWriteSize:]},
+	)
+	exp = append(exp, cmds[4:]...)
+	if len(got) != len(exp) {
+		t.Fatalf("unexpected number of commands: %d vs %d", len(got), len(exp))
+	}
+	for i := range exp {
+		if !reflect.DeepEqual(got[i], exp[i]) {
+			t.Fatalf("command %d:\n%#v\nvs\n%#v", i, got[i], exp[i])
+		}
+	}
+}
+
+func TestStreamWriterV2(t *testing.T) {
+	cmds := []Cmd{
+		&SubvolCmd{Path: "vol", UUID: btrfs.UUID{1}, CTransID: 10},
+		&MkfileCmd{Path: "file", Ino: 257},
+		&WriteCmd{Path: "file", Off: 0, Data: bytes.Repeat([]byte{1}, 70000)},
+		&EncodedWriteCmd{Path: "file", Off: 131072, Extent: btrfs.EncodedExtent{
+			Len: 4096, UnencodedLen: 8192, UnencodedOffset: 4096, Compression: btrfs.EncodedZstd,
+		}, Data: []byte("compressed")},
+		&FallocateCmd{Path: "file", Mode: 3, Off: 4096, Size: 4096},
+		&FileattrCmd{Path: "file", Attr: 0x10},
+		&StreamEnd{},
+	}
+	buf := bytes.NewBuffer(nil)
+	w, err := NewStreamWriterVersion(buf, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cmds {
+		if err := w.WriteCommand(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := NewStreamReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	} else if r.Version() != 2 {
+		t.Fatalf("unexpected version: %d", r.Version())
+	}
+	var (
+		data []byte
+		got  []Cmd
+	)
+	for {
+		c, err := r.ReadCommand()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if wc, ok := c.(*WriteCmd); ok {
+			// writes are split into multiple commands
+			if wc.Off != uint64(len(data)) {
+				t.Fatalf("unexpected offset: %d", wc.Off)
+			}
+			data = append(data, wc.Data...)
+			continue
+		}
+		got = append(got, c)
+	}
+	exp := append(append([]Cmd{}, cmds[:2]...), cmds[3:]...)
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected commands:\n%#v\nvs\n%#v", got, exp)
+	}
+	if len(data) != 70000 {
+		t.Fatalf("unexpected data size: %d", len(data))
+	}
+
+	w, err = NewStreamWriter(ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.WriteCommand(&FileattrCmd{Path: "file"}); err == nil {
+		t.Fatal("expected an error for v1 stream")
+	}
+}
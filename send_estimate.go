@@ -0,0 +1,111 @@
+package btrfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Constants of the send stream format, as used by the estimator.
+const (
+	sendStreamMagic     = "btrfs-stream\x00"
+	sendCmdHeaderSize   = 10
+	sendTLVHeaderSize   = 4
+	sendReadSize        = 48 * 1024
+	sendCmdUpdateExtent = 22
+	sendAttrPath        = 15
+	sendAttrSize        = 4
+)
+
+// SendEstimate returns a projected size of a stream that Send would produce with the same arguments.
+//
+// The estimate is calculated by requesting a stream without file data from the kernel,
+// thus it's much cheaper than sending the subvolumes. Sizes of writes are accounted
+// precisely, but clones might be reported as writes, making the estimate slightly larger.
+func SendEstimate(parent string, subvols ...string) (uint64, error) {
+	e := &sendEstimator{}
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := e.run(pr)
+		pr.CloseWithError(err)
+		errc <- err
+	}()
+	err := sendSubvols(pw, &SendOptions{Parent: parent, NoData: true}, subvols)
+	pw.CloseWithError(err)
+	if err2 := <-errc; err == nil {
+		err = err2
+	}
+	if err != nil {
+		return 0, err
+	}
+	return e.size, nil
+}
+
+// sendEstimator parses a stream without file data and projects the size of a full stream.
+type sendEstimator struct {
+	size uint64
+}
+
+func (e *sendEstimator) run(r io.Reader) error {
+	hdr := make([]byte, len(sendStreamMagic)+4)
+	if _, err := io.ReadFull(r, hdr); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot read stream header: %v", err)
+	} else if string(hdr[:len(sendStreamMagic)]) != sendStreamMagic {
+		return errors.New("unexpected stream header")
+	}
+	e.size += uint64(len(hdr))
+	var (
+		ch  [sendCmdHeaderSize]byte
+		buf []byte
+	)
+	for {
+		if _, err := io.ReadFull(r, ch[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("cannot read command header: %v", err)
+		}
+		n := binary.LittleEndian.Uint32(ch[0:])
+		cmd := binary.LittleEndian.Uint16(ch[4:])
+		if cap(buf) < int(n) {
+			buf = make([]byte, n)
+		}
+		buf = buf[:n]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return fmt.Errorf("cannot read command: %v", err)
+		}
+		if cmd != sendCmdUpdateExtent {
+			e.size += uint64(sendCmdHeaderSize) + uint64(n)
+			continue
+		}
+		// update_extent replaces write commands in streams without file data
+		var (
+			pathLen int
+			size    uint64
+		)
+		for p := buf; len(p) >= sendTLVHeaderSize; {
+			typ := binary.LittleEndian.Uint16(p[0:])
+			l := int(binary.LittleEndian.Uint16(p[2:]))
+			p = p[sendTLVHeaderSize:]
+			if l > len(p) {
+				return errors.New("malformed update_extent command")
+			}
+			switch typ {
+			case sendAttrPath:
+				pathLen = l
+			case sendAttrSize:
+				if l == 8 {
+					size = binary.LittleEndian.Uint64(p)
+				}
+			}
+			p = p[l:]
+		}
+		writes := (size + sendReadSize - 1) / sendReadSize
+		// each write has a path, an offset and a data attribute
+		perWrite := uint64(sendCmdHeaderSize + sendTLVHeaderSize + pathLen + sendTLVHeaderSize + 8 + sendTLVHeaderSize)
+		e.size += writes*perWrite + size
+	}
+}
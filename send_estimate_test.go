@@ -0,0 +1,41 @@
+package btrfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestSendEstimator(t *testing.T) {
+	le := binary.LittleEndian
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString(sendStreamMagic)
+	binary.Write(buf, le, uint32(1))
+	cmd := func(typ uint16, body []byte) {
+		binary.Write(buf, le, uint32(len(body)))
+		binary.Write(buf, le, typ)
+		binary.Write(buf, le, uint32(0))
+		buf.Write(body)
+	}
+	tlv := func(typ uint16, val []byte) []byte {
+		p := make([]byte, sendTLVHeaderSize, sendTLVHeaderSize+len(val))
+		le.PutUint16(p[0:], typ)
+		le.PutUint16(p[2:], uint16(len(val)))
+		return append(p, val...)
+	}
+	var size [8]byte
+	le.PutUint64(size[:], 100*1024)
+	body := append(tlv(sendAttrPath, []byte("file")), tlv(sendAttrSize, size[:])...)
+	cmd(sendCmdUpdateExtent, body)
+	cmd(21, nil) // end
+
+	e := &sendEstimator{}
+	if err := e.run(buf); err != nil {
+		t.Fatal(err)
+	}
+	const perWrite = sendCmdHeaderSize + sendTLVHeaderSize*3 + 4 + 8
+	exp := uint64(len(sendStreamMagic)+4) + 3*perWrite + 100*1024 + sendCmdHeaderSize
+	if e.size != exp {
+		t.Fatalf("unexpected estimate: %d vs %d", e.size, exp)
+	}
+}
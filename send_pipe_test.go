@@ -0,0 +1,50 @@
+package btrfs
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// countingWriter records sizes of individual writes.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestCopySendStream(t *testing.T) {
+	SetSendBufferSize(0)
+	defer SetSendBufferSize(defaultSendBufferSize)
+
+	data := make([]byte, 10*minSendBufferSize+123)
+	rand.New(rand.NewSource(1)).Read(data)
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		io.Copy(pw, bytes.NewReader(data))
+		pw.Close()
+	}()
+	var w countingWriter
+	n, err := copySendStream(&w, pr)
+	pr.Close()
+	if err != nil {
+		t.Fatal(err)
+	} else if n != int64(len(data)) {
+		t.Fatalf("unexpected size: %d", n)
+	}
+	if !bytes.Equal(w.Bytes(), data) {
+		t.Fatal("data differs")
+	}
+	if w.writes > 11 {
+		t.Fatalf("too many writes: %d", w.writes)
+	}
+}
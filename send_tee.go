@@ -0,0 +1,157 @@
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// sendTeeQueue is the number of writes that can be queued for each destination of SendTee.
+const sendTeeQueue = 16
+
+// TeeError lists the errors of each destination of SendTee, in the order of writers.
+// Destinations that received the complete stream have a nil error.
+type TeeError []error
+
+func (e TeeError) Error() string {
+	var msgs []string
+	for i, err := range e {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("destination %d: %v", i, err))
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// SendTee is a writer that copies a send stream to multiple destinations concurrently,
+// for example to a local archive and a remote receiver.
+//
+// Unlike io.MultiWriter, a failed destination does not stop the others: it is detached,
+// and no further data is written to it, so it never receives a stream with a gap.
+// Writes only fail when all destinations failed. A slow destination slows down the stream
+// once its queue is full, but it doesn't affect the data written to the others.
+type SendTee struct {
+	sinks  []*teeSink
+	wg     sync.WaitGroup
+	closed bool
+}
+
+type teeSink struct {
+	w   io.Writer
+	ch  chan []byte
+	mu  sync.Mutex
+	err error
+}
+
+func (s *teeSink) getErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *teeSink) setErr(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+}
+
+// NewSendTee creates a writer that copies the data to all writers. Close must be called
+// to wait for all pending writes.
+func NewSendTee(ws ...io.Writer) *SendTee {
+	t := &SendTee{sinks: make([]*teeSink, 0, len(ws))}
+	for _, w := range ws {
+		s := &teeSink{w: w, ch: make(chan []byte, sendTeeQueue)}
+		t.sinks = append(t.sinks, s)
+		t.wg.Add(1)
+		go t.run(s)
+	}
+	return t
+}
+
+func (t *SendTee) run(s *teeSink) {
+	defer t.wg.Done()
+	for b := range s.ch {
+		if s.getErr() != nil {
+			continue // drain the queue
+		}
+		n, err := s.w.Write(b)
+		if err == nil && n < len(b) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			s.setErr(err)
+		}
+	}
+}
+
+func (t *SendTee) Write(p []byte) (int, error) {
+	if t.closed {
+		return 0, errors.New("write to a closed tee")
+	}
+	// the buffer is shared by all destinations, and the caller may reuse p
+	b := append([]byte(nil), p...)
+	alive := 0
+	for _, s := range t.sinks {
+		if s.getErr() != nil {
+			continue
+		}
+		s.ch <- b
+		alive++
+	}
+	if alive == 0 {
+		return 0, t.Errs()
+	}
+	return len(p), nil
+}
+
+// Errs returns the errors of all destinations so far.
+func (t *SendTee) Errs() TeeError {
+	out := make(TeeError, len(t.sinks))
+	for i, s := range t.sinks {
+		out[i] = s.getErr()
+	}
+	return out
+}
+
+// Close waits for all pending writes to complete. It returns TeeError if any destination failed.
+// Writers are not closed.
+func (t *SendTee) Close() error {
+	if !t.closed {
+		t.closed = true
+		for _, s := range t.sinks {
+			close(s.ch)
+		}
+	}
+	t.wg.Wait()
+	errs := t.Errs()
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+	return nil
+}
+
+// SendTo is like Send, but writes the stream to multiple destinations concurrently (see SendTee).
+//
+// If some of the destinations fail, the stream is still sent to the others, and TeeError
+// is returned with the error of each destination.
+func SendTo(ws []io.Writer, parent string, subvols ...string) error {
+	t := NewSendTee(ws...)
+	err := Send(t, parent, subvols...)
+	terr := t.Close()
+	if terr == nil {
+		return err
+	}
+	for _, e := range terr.(TeeError) {
+		if e == nil && err != nil {
+			// the send itself failed, and some destinations are incomplete
+			return err
+		}
+	}
+	return terr
+}
@@ -0,0 +1,70 @@
+package btrfs
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+type failingWriter struct {
+	n   int
+	buf bytes.Buffer
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.n {
+		return 0, errors.New("disk full")
+	}
+	return w.buf.Write(p)
+}
+
+type slowWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return w.buf.Write(p)
+}
+
+func TestSendTee(t *testing.T) {
+	var (
+		good bytes.Buffer
+		slow slowWriter
+		bad  = &failingWriter{n: 100}
+	)
+	tee := NewSendTee(&good, bad, &slow)
+	var exp []byte
+	chunk := make([]byte, 40)
+	for i := 0; i < 50; i++ {
+		for j := range chunk {
+			chunk[j] = byte(i)
+		}
+		exp = append(exp, chunk...)
+		if _, err := tee.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tee.Close()
+	errs, ok := err.(TeeError)
+	if !ok || len(errs) != 3 || errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Fatalf("unexpected errors: %#v", err)
+	}
+	if !bytes.Equal(good.Bytes(), exp) || !bytes.Equal(slow.buf.Bytes(), exp) {
+		t.Fatal("unexpected data")
+	}
+	if bad.buf.Len() != 80 {
+		t.Fatalf("unexpected data in the failed destination: %d", bad.buf.Len())
+	}
+
+	tee = NewSendTee(&failingWriter{})
+	tee.Write(chunk)
+	for i := 0; i < 100 && tee.Errs()[0] == nil; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err = tee.Write(chunk); err == nil {
+		t.Fatal("expected an error when all destinations failed")
+	}
+	tee.Close()
+}
@@ -0,0 +1,89 @@
+package btrfs
+
+import "testing"
+
+// fakeLookup is a set of subvolumes indexed by root id.
+type fakeLookup map[objectID]*SubvolInfo
+
+func (l fakeLookup) byRootID(id objectID) (*SubvolInfo, error) {
+	if s := l[id]; s != nil {
+		return s, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (l fakeLookup) byUUID(uuid UUID) (*SubvolInfo, error) {
+	for _, s := range l {
+		if !uuid.IsZero() && s.UUID == uuid {
+			return s, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func TestFindGoodParent(t *testing.T) {
+	l := fakeLookup{
+		256: {RootID: 256, UUID: UUID{1}, CTransID: 35},                      // vol
+		257: {RootID: 257, UUID: UUID{2}, ParentUUID: UUID{1}, CTransID: 10}, // vol.1
+		258: {RootID: 258, UUID: UUID{3}, ParentUUID: UUID{1}, CTransID: 20}, // vol.2
+		259: {RootID: 259, UUID: UUID{4}, ParentUUID: UUID{1}, CTransID: 30}, // vol.3
+		260: {RootID: 260, UUID: UUID{5}, ParentUUID: UUID{3}, CTransID: 40}, // snapshot of vol.2
+	}
+	for _, c := range []struct {
+		root  objectID
+		clone []objectID
+		exp   objectID
+	}{
+		{root: 259, clone: []objectID{256, 257}, exp: 256}, // the origin is preferred
+		{root: 259, clone: []objectID{257, 258}, exp: 258}, // then the closest sibling
+		{root: 259, clone: []objectID{257}, exp: 257},
+		{root: 260, clone: []objectID{257}, exp: 257}, // sibling of the parent
+		{root: 259, clone: nil},
+		{root: 256, clone: []objectID{257}},
+	} {
+		id, err := findGoodParent(l, c.root, c.clone)
+		if c.exp == 0 {
+			if err != ErrNotFound {
+				t.Errorf("%d %v: expected %v, got %d, %v", c.root, c.clone, ErrNotFound, id, err)
+			}
+		} else if err != nil {
+			t.Errorf("%d %v: %v", c.root, c.clone, err)
+		} else if id != c.exp {
+			t.Errorf("%d %v: expected %d, got %d", c.root, c.clone, c.exp, id)
+		}
+	}
+}
+
+func TestSendOptionsFlags(t *testing.T) {
+	for _, c := range []struct {
+		opts    SendOptions
+		max     int
+		flags   uint64
+		version uint32
+		err     bool
+	}{
+		{opts: SendOptions{}, max: 1},
+		{opts: SendOptions{NoData: true, OmitEndCmd: true}, max: 1, flags: _BTRFS_SEND_FLAG_NO_FILE_DATA | _BTRFS_SEND_FLAG_OMIT_END_CMD},
+		{opts: SendOptions{OmitStreamHeader: true, Proto: 1}, max: 2, flags: _BTRFS_SEND_FLAG_OMIT_STREAM_HEADER | _BTRFS_SEND_FLAG_VERSION, version: 1},
+		{opts: SendOptions{Compressed: true}, max: 2, flags: _BTRFS_SEND_FLAG_COMPRESSED | _BTRFS_SEND_FLAG_VERSION, version: 2},
+		{opts: SendOptions{Compressed: true}, max: 1, err: true},
+		{opts: SendOptions{Compressed: true, Proto: 1}, max: 2, err: true},
+		{opts: SendOptions{Proto: ProtoAuto}, max: 3, flags: _BTRFS_SEND_FLAG_VERSION, version: 3},
+		{opts: SendOptions{Proto: 2}, max: 1, err: true},
+		{opts: SendOptions{Proto: -2}, max: 2, err: true},
+		{opts: SendOptions{Flags: 0x100}, max: 1, flags: 0x100},
+	} {
+		flags, version, err := c.opts.flags(c.max)
+		if c.err {
+			if err == nil {
+				t.Errorf("%+v: expected an error", c.opts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", c.opts, err)
+		} else if flags != c.flags || version != c.version {
+			t.Errorf("%+v: unexpected flags: %#x, version %d", c.opts, flags, version)
+		}
+	}
+}
@@ -19,8 +19,7 @@ var caseSizes = []struct {
 	{obj: btrfs_ioctl_scrub_args{}, size: 1024},
 	{obj: btrfs_ioctl_dev_replace_start_params{}, size: 2072},
 	{obj: btrfs_ioctl_dev_replace_status_params{}, size: 48},
-	{obj: btrfs_ioctl_dev_replace_args_u1{}, size: 2600},
-	{obj: btrfs_ioctl_dev_replace_args_u2{}, size: 2600},
+	{obj: btrfs_ioctl_dev_replace_args{}, size: 2600},
 	{obj: btrfs_ioctl_dev_info_args{}, size: 4096},
 	{obj: btrfs_ioctl_fs_info_args{}, size: 1024},
 	{obj: btrfs_ioctl_feature_flags{}, size: 24},
@@ -48,6 +47,7 @@ var caseSizes = []struct {
 	{obj: btrfs_ioctl_timespec{}, size: 16},
 	{obj: btrfs_ioctl_received_subvol_args{}, size: 200},
 	{obj: btrfs_ioctl_send_args{}, size: 72},
+	{obj: btrfs_ioctl_encoded_io_args{}, size: 128},
 
 	//{obj:btrfs_timespec{},size:12},
 	//{obj:btrfs_root_ref{},size:18},
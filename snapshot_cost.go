@@ -0,0 +1,98 @@
+package btrfs
+
+import (
+	"sort"
+)
+
+// SnapshotCost is the space attributed to a single snapshot. See SnapshotCostReport.
+type SnapshotCost struct {
+	Info SubvolInfo
+	Path string // absolute path of the snapshot
+
+	// Exclusive is the number of bytes referenced only by this snapshot, which are freed
+	// if only this snapshot is deleted. It is only set if quotas are enabled.
+	Exclusive uint64
+
+	// SincePrevious is the estimated number of bytes changed since the previous snapshot,
+	// as sent by an incremental send. UntilNext is the same for the next snapshot.
+	// They are zero if there is no such neighbor, or either snapshot is not read-only.
+	//
+	// Data pinned by this snapshot alone is bounded by the smaller of the two, since it
+	// must be added after the previous snapshot and replaced before the next one.
+	SincePrevious uint64
+	UntilNext     uint64
+}
+
+// SnapshotCostSummary lists snapshots of a subvolume with their space costs.
+type SnapshotCostSummary struct {
+	Subvolume SubvolInfo
+	// Quotas is set if quotas are enabled, and thus Exclusive values are known.
+	Quotas    bool
+	Snapshots []SnapshotCost // ordered by the creation generation
+}
+
+// SnapshotCostReport lists all snapshots of a subvolume at a given path with the space they pin:
+// the exclusive bytes that would be freed by deleting each of them, and the incremental bytes
+// relative to the neighboring snapshots. Only snapshots reachable from the subvolume this FS
+// was opened at are listed.
+//
+// Exclusive bytes require quotas to be enabled. Incremental sizes are estimated with SendEstimate,
+// which is cheap, but still walks the changed metadata of each pair of snapshots.
+// It requires CAP_SYS_ADMIN.
+func (f *FS) SnapshotCostReport(subvol string) (*SnapshotCostSummary, error) {
+	info, err := f.SubvolumeByPath(subvol)
+	if err != nil {
+		return nil, err
+	}
+	list, err := f.ListSubvolumes(func(s SubvolInfo) bool {
+		return s.ParentUUID == info.UUID
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].OTransID != list[j].OTransID {
+			return list[i].OTransID < list[j].OTransID
+		}
+		return list[i].RootID < list[j].RootID
+	})
+	rep := &SnapshotCostSummary{Subvolume: *info}
+	for _, s := range list {
+		path, err := f.SubvolumePath(s.RootID)
+		if err != nil {
+			// not reachable from this mount
+			continue
+		}
+		rep.Snapshots = append(rep.Snapshots, SnapshotCost{Info: s, Path: path})
+	}
+	if err = f.Sync(); err != nil {
+		return nil, err
+	}
+	qgroups, err := f.Qgroups()
+	if err != nil && err != ErrQuotaDisabled {
+		return nil, err
+	}
+	rep.Quotas = err == nil
+	excl := make(map[QgroupID]uint64, len(qgroups))
+	for _, q := range qgroups {
+		excl[q.ID] = q.Exclusive
+	}
+	for i := range rep.Snapshots {
+		s := &rep.Snapshots[i]
+		s.Exclusive = excl[NewQgroupID(0, s.Info.RootID)]
+		if i == 0 {
+			continue
+		}
+		prev := &rep.Snapshots[i-1]
+		if !prev.Info.Flags.ReadOnly() || !s.Info.Flags.ReadOnly() {
+			continue
+		}
+		size, err := SendEstimate(prev.Path, s.Path)
+		if err != nil {
+			return nil, err
+		}
+		s.SincePrevious = size
+		prev.UntilNext = size
+	}
+	return rep, nil
+}
@@ -0,0 +1,197 @@
+package btrfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StagingDirPrefix is the name prefix of hidden directories used by ReceiveStaged.
+const StagingDirPrefix = ".gbtrfs-staging."
+
+// ReceiveStaged is like Receive, but the stream is received into a hidden staging directory
+// in dstDir, and the received subvolumes are moved to dstDir only after the stream was applied
+// completely. Thus, a subvolume in dstDir is never a partial copy, even if the transfer
+// is interrupted. It returns paths of the received subvolumes.
+//
+// See ReceiveStagedFunc for details.
+func ReceiveStaged(r io.Reader, dstDir string) ([]string, error) {
+	return ReceiveStagedFunc(dstDir, func(dir string) error {
+		return Receive(r, dir)
+	})
+}
+
+// ReceiveStagedFunc calls receive with a path of a new staging directory in dstDir, and moves
+// subvolumes received into it to dstDir. It allows to use custom receivers, for example ones that
+// verify a digest of the stream, or apply transforms to it.
+//
+// Subvolumes are moved only if receive succeeds, and each of them is read-only and has
+// a received UUID, as set by a receiver at the end of the stream. Names of subvolumes must not
+// exist in dstDir. Otherwise, the received subvolumes are deleted together with the staging directory.
+//
+// Staging directories left by a crashed process can be deleted with CleanupStaging.
+func ReceiveStagedFunc(dstDir string, receive func(dir string) error) ([]string, error) {
+	dstDir, err := filepath.Abs(dstDir)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := openMount(dstDir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+	return receiveStaged(fs, dstDir, receive)
+}
+
+// receiveStaged implements ReceiveStagedFunc. Received subvolumes are deleted through fs,
+// which must be the filesystem of dstDir.
+func receiveStaged(fs *FS, dstDir string, receive func(dir string) error) (_ []string, err error) {
+	staging := filepath.Join(dstDir, StagingDirPrefix+strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err = os.Mkdir(staging, 0700); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err2 := removeStaging(fs, staging); err2 != nil && err == nil {
+			err = fmt.Errorf("cannot delete staging directory: %v", err2)
+		} else if err2 != nil {
+			err = fmt.Errorf("%v (cannot delete staging directory: %v)", err, err2)
+		}
+	}()
+	if err = receive(staging); err != nil {
+		return nil, err
+	}
+	list, err := ioutil.ReadDir(staging)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range list {
+		path := filepath.Join(staging, fi.Name())
+		if err = checkReceived(path); err != nil {
+			return nil, err
+		}
+		if _, err = os.Lstat(filepath.Join(dstDir, fi.Name())); err == nil {
+			return nil, fmt.Errorf("cannot move %s to %s: already exists", fi.Name(), dstDir)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	out := make([]string, 0, len(list))
+	for _, fi := range list {
+		dst := filepath.Join(dstDir, fi.Name())
+		if err = os.Rename(filepath.Join(staging, fi.Name()), dst); err != nil {
+			return out, err
+		}
+		out = append(out, dst)
+	}
+	return out, nil
+}
+
+// checkReceived checks that a subvolume was received completely.
+func checkReceived(path string) error {
+	if ok, err := IsSubVolume(path); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s is not a subvolume", path)
+	}
+	it, err := subvolRootItem(path)
+	if err != nil {
+		return err
+	}
+	if it.ReceivedUUID.IsZero() || !SubvolFlags(it.Flags).ReadOnly() {
+		return fmt.Errorf("subvolume %s was not received completely", path)
+	}
+	return nil
+}
+
+// removeStaging deletes a staging directory with all subvolumes in it, through fs.
+func removeStaging(fs *FS, dir string) error {
+	list, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, fi := range list {
+		path := filepath.Join(dir, fi.Name())
+		if ok, _ := IsSubVolume(path); ok {
+			rel, err := fs.rel(path)
+			if err != nil {
+				return err
+			}
+			if err = fs.DeleteSubVolume(rel); err != nil {
+				return err
+			}
+		} else if err = os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	if err = os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// CleanupStaging deletes staging directories in dir that were left by ReceiveStaged,
+// if they are older than minAge, and returns their paths. The age protects directories
+// of transfers that are still in progress.
+func CleanupStaging(dir string, minAge time.Duration) ([]string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	fs, err := openMount(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+	return cleanupStaging(fs, dir, minAge)
+}
+
+// CleanupStaging is like the package-level CleanupStaging, but dir is relative to f,
+// and subvolumes are deleted through f. Returned paths are absolute.
+func (f *FS) CleanupStaging(dir string, minAge time.Duration) ([]string, error) {
+	return cleanupStaging(f, f.resolve(dir), minAge)
+}
+
+func cleanupStaging(fs *FS, dir string, minAge time.Duration) ([]string, error) {
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	for _, fi := range list {
+		if !fi.IsDir() || !strings.HasPrefix(fi.Name(), StagingDirPrefix) {
+			continue
+		}
+		if time.Since(fi.ModTime()) < minAge {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		if err = removeStaging(fs, path); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, path)
+	}
+	return deleted, nil
+}
+
+// ReceiveStaged is like ReceiveTo, but moves the received subvolumes to the destination only
+// after the stream was received completely, see ReceiveStaged. Paths are relative to f.
+func (f *FS) ReceiveStaged(r io.Reader, mount string) ([]string, error) {
+	var out []string
+	err := f.audited("receive", map[string]interface{}{"dst": mount, "staged": true}, func() error {
+		paths, err := receiveStaged(f, filepath.Join(f.f.Name(), mount), func(dir string) error {
+			return Receive(r, dir)
+		})
+		for _, p := range paths {
+			if rel, err := filepath.Rel(f.f.Name(), p); err == nil {
+				out = append(out, rel)
+			}
+		}
+		return err
+	})
+	return out, err
+}
@@ -0,0 +1,186 @@
+package btrfs
+
+import (
+	"sync"
+)
+
+// SubvolCacheStats are statistics of the subvolume cache. See EnableSubvolCache.
+type SubvolCacheStats struct {
+	Hits          uint64 // lookups served from the cache
+	Misses        uint64 // lookups that walked the trees
+	Invalidations uint64 // number of times the cache was dropped because the root tree changed
+	Entries       int    // number of cached entries
+	Generation    uint64 // generation of the root tree the cache is valid for
+}
+
+// subvolCache maps subvolume ids and uuids to resolved paths and ids.
+//
+// Entries are valid for a given generation of the root tree: any change to root items
+// or references (subvolume created, deleted, renamed or received) drops the whole cache.
+// Renames of regular directories containing subvolumes do not change the root tree,
+// and thus are not detected.
+type subvolCache struct {
+	mu       sync.Mutex
+	gen      uint64
+	paths    map[objectID]string
+	uuids    map[UUID]objectID
+	received map[UUID]objectID
+	stats    SubvolCacheStats
+}
+
+func newSubvolCache() *subvolCache {
+	c := &subvolCache{}
+	c.reset()
+	return c
+}
+
+func (c *subvolCache) reset() {
+	c.paths = make(map[objectID]string)
+	c.uuids = make(map[UUID]objectID)
+	c.received = make(map[UUID]objectID)
+}
+
+// rootTreeChanges returns the highest generation of root tree leaves with subvolume items
+// that were changed after a given generation, or zero if there are no changes.
+func rootTreeChanges(f *FS, since uint64) (uint64, error) {
+	var gen uint64
+	err := treeSearch(f.f, btrfs_ioctl_search_key{
+		TreeID:      uint64(rootTreeObjectid),
+		MinObjectID: uint64(firstFreeObjectid),
+		MaxObjectID: uint64(lastFreeObjectid),
+		MinType:     uint32(rootItemKey),
+		MaxType:     uint32(rootRefKey),
+		MaxOffset:   maxUint64,
+		MinTransID:  since + 1,
+		MaxTransID:  maxUint64,
+	}, func(r searchResult) error {
+		if r.TransID > gen {
+			gen = r.TransID
+		}
+		return nil
+	})
+	return gen, err
+}
+
+// validate drops the cache if the root tree has changed. It must be called with c.mu held.
+func (c *subvolCache) validate(f *FS) error {
+	gen, err := rootTreeChanges(f, c.gen)
+	if err != nil {
+		return err
+	}
+	if gen == 0 {
+		return nil
+	}
+	if c.gen != 0 {
+		c.stats.Invalidations++
+	}
+	c.reset()
+	c.gen = gen
+	return nil
+}
+
+// lookup returns a cached value, or calls fill and caches its result. The generation is
+// checked before calling fill, thus concurrent changes will invalidate the result later.
+func (c *subvolCache) lookup(f *FS, get func() bool, fill func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.validate(f); err != nil {
+		return err
+	}
+	if get() {
+		c.stats.Hits++
+		return nil
+	}
+	c.stats.Misses++
+	return fill()
+}
+
+// EnableSubvolCache enables caching of subvolume ids and paths resolved by SubvolumePath,
+// SubvolumeByUUID and SubvolumeByReceivedUUID. Each lookup still checks that the root tree
+// has not changed since the cache was filled, but it is much cheaper than resolving a path.
+// Root items are updated on each commit that modifies a subvolume, thus on a filesystem
+// with frequent writes the cache is mostly useful for bursts of lookups.
+//
+// It must be called before the FS is used concurrently.
+func (f *FS) EnableSubvolCache() {
+	if f.cache == nil {
+		f.cache = newSubvolCache()
+	}
+}
+
+// SubvolCacheStats returns statistics of the subvolume cache. See EnableSubvolCache.
+func (f *FS) SubvolCacheStats() SubvolCacheStats {
+	c := f.cache
+	if c == nil {
+		return SubvolCacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.stats
+	st.Entries = len(c.paths) + len(c.uuids) + len(c.received)
+	st.Generation = c.gen
+	return st
+}
+
+// resolvePath returns a path of a subvolume relative to the filesystem root.
+func (f *FS) resolvePath(id objectID) (string, error) {
+	c := f.cache
+	if c == nil {
+		return subvolidResolve(f.f, id)
+	}
+	var path string
+	err := c.lookup(f, func() bool {
+		p, ok := c.paths[id]
+		path = p
+		return ok
+	}, func() error {
+		p, err := subvolidResolve(f.f, id)
+		if err == nil {
+			c.paths[id] = p
+			path = p
+		}
+		return err
+	})
+	return path, err
+}
+
+// lookupUUID resolves a subvolume id by its uuid or received uuid.
+func (f *FS) lookupUUID(uuid UUID, received bool) (objectID, error) {
+	find, m := lookupUUIDSubvolItem, (map[UUID]objectID)(nil)
+	if received {
+		find = lookupUUIDReceivedSubvolItem
+	}
+	c := f.cache
+	if c == nil {
+		return find(f.f, uuid)
+	}
+	var id objectID
+	err := c.lookup(f, func() bool {
+		if m = c.uuids; received {
+			m = c.received
+		}
+		v, ok := m[uuid]
+		id = v
+		return ok
+	}, func() error {
+		v, err := find(f.f, uuid)
+		if err == nil {
+			m[uuid] = v
+			id = v
+		}
+		return err
+	})
+	return id, err
+}
+
+// subvolInfo reads a root item of a subvolume and resolves its path.
+func (f *FS) subvolInfo(id objectID) (*SubvolInfo, error) {
+	if f.cache == nil {
+		return subvolSearchByRootID(f.f, id, "")
+	}
+	path, err := f.resolvePath(id)
+	if err != nil {
+		return nil, err
+	}
+	return subvolSearchByRootID(f.f, id, path)
+}
@@ -48,17 +48,15 @@ func CreateSubVolume(path string) error {
 	if inherit != nil {
 		panic("not implemented") // TODO
 		args := btrfs_ioctl_vol_args_v2{
-			flags: subvolQGroupInherit,
-			btrfs_ioctl_vol_args_v2_u1: btrfs_ioctl_vol_args_v2_u1{
-				//size: 	qgroup_inherit_size(inherit),
-				qgroup_inherit: inherit,
-			},
+			Flags: uint64(subvolQGroupInherit),
+			//Size: 	qgroup_inherit_size(inherit),
+			QgroupInherit: inherit,
 		}
-		copy(args.name[:], newName)
+		copy(args.Name[:], newName)
 		return iocSubvolCreateV2(dst, &args)
 	}
 	var args btrfs_ioctl_vol_args
-	copy(args.name[:], newName)
+	copy(args.Name[:], newName)
 	return iocSubvolCreate(dst, &args)
 }
 
@@ -81,7 +79,7 @@ func DeleteSubVolume(path string) error {
 	}
 	defer dir.Close()
 	var args btrfs_ioctl_vol_args
-	copy(args.name[:], vname)
+	copy(args.Name[:], vname)
 	return iocSnapDestroy(dir, &args)
 }
 
@@ -128,18 +126,18 @@ func SnapshotSubVolume(subvol, dst string, ro bool) error {
 	}
 	defer f.Close()
 	args := btrfs_ioctl_vol_args_v2{
-		fd: int64(f.Fd()),
+		Fd: int64(f.Fd()),
 	}
 	if ro {
-		args.flags |= SubvolReadOnly
+		args.Flags |= uint64(SubvolReadOnly)
 	}
 	// TODO
 	//if inherit != nil {
-	//	args.flags |= subvolQGroupInherit
-	//	args.size = qgroup_inherit_size(inherit)
-	//	args.qgroup_inherit = inherit
+	//	args.Flags |= uint64(subvolQGroupInherit)
+	//	args.Size = qgroup_inherit_size(inherit)
+	//	args.QgroupInherit = inherit
 	//}
-	copy(args.name[:], newName)
+	copy(args.Name[:], newName)
 	if err := iocSnapCreateV2(fdst, &args); err != nil {
 		return fmt.Errorf("snapshot create failed: %v", err)
 	}
@@ -163,25 +161,37 @@ func GetFlags(path string) (SubvolFlags, error) {
 	return fs.GetFlags()
 }
 
+// SetReceivedSubvolume marks a subvolume as received from a subvolume with a given uuid
+// and transaction id. This information is used by send and receive to find parents
+// for incremental streams. The subvolume must be writable.
+func SetReceivedSubvolume(path string, uuid UUID, stransid uint64, stime time.Time) error {
+	fs, err := Open(path, false)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	return fs.SetReceived(uuid, stransid, stime)
+}
+
 func listSubVolumes(f *os.File, filter func(SubvolInfo) bool) (map[objectID]SubvolInfo, error) {
 	sk := btrfs_ioctl_search_key{
 		// search in the tree of tree roots
-		tree_id: rootTreeObjectid,
+		TreeID: uint64(rootTreeObjectid),
 
 		// Set the min and max to backref keys. The search will
 		// only send back this type of key now.
-		min_type: rootItemKey,
-		max_type: rootBackrefKey,
+		MinType: uint32(rootItemKey),
+		MaxType: uint32(rootBackrefKey),
 
-		min_objectid: firstFreeObjectid,
+		MinObjectID: uint64(firstFreeObjectid),
 
 		// Set all the other params to the max, we'll take any objectid
 		// and any trans.
-		max_objectid: lastFreeObjectid,
-		max_offset:   maxUint64,
-		max_transid:  maxUint64,
+		MaxObjectID: uint64(lastFreeObjectid),
+		MaxOffset:   maxUint64,
+		MaxTransID:  maxUint64,
 
-		nr_items: 4096, // just a big number, doesn't matter much
+		NrItems: 4096, // just a big number, doesn't matter much
 	}
 	m := make(map[objectID]SubvolInfo)
 	for {
@@ -193,6 +203,10 @@ func listSubVolumes(f *os.File, filter func(SubvolInfo) bool) (map[objectID]Subv
 		}
 		for _, obj := range out {
 			switch obj.Type {
+			case rootBackrefKey:
+				o := m[obj.ObjectID]
+				o.ParentID = obj.Offset
+				m[obj.ObjectID] = o
 			//case rootBackrefKey:
 			//	ref := asRootRef(obj.Data)
 			//	o := m[obj.ObjectID]
@@ -213,26 +227,30 @@ func listSubVolumes(f *os.File, filter func(SubvolInfo) bool) (map[objectID]Subv
 		// record the mins in key so we can make sure the
 		// next search doesn't repeat this root
 		last := out[len(out)-1]
-		sk.min_objectid = last.ObjectID
-		sk.min_type = last.Type
-		sk.min_offset = last.Offset + 1
-		if sk.min_offset == 0 { // overflow
-			sk.min_type++
+		sk.MinObjectID = uint64(last.ObjectID)
+		sk.MinType = uint32(last.Type)
+		sk.MinOffset = last.Offset + 1
+		if sk.MinOffset == 0 { // overflow
+			sk.MinType++
 		} else {
 			continue
 		}
-		if sk.min_type > rootBackrefKey {
-			sk.min_type = rootItemKey
-			sk.min_objectid++
+		if treeKeyType(sk.MinType) > rootBackrefKey {
+			sk.MinType = uint32(rootItemKey)
+			sk.MinObjectID++
 		} else {
 			continue
 		}
-		if sk.min_objectid > sk.max_objectid {
+		if sk.MinObjectID > sk.MaxObjectID {
 			break
 		}
 	}
 	// resolve paths
 	for id, v := range m {
+		if v.RootID == 0 { // backref without a root item
+			delete(m, id)
+			continue
+		}
 		if path, err := subvolidResolve(f, id); err == ErrNotFound {
 			delete(m, id)
 			continue
@@ -251,7 +269,8 @@ func listSubVolumes(f *os.File, filter func(SubvolInfo) bool) (map[objectID]Subv
 }
 
 type SubvolInfo struct {
-	RootID uint64
+	RootID   uint64
+	ParentID uint64 // id of the subvolume this one is linked to; only set by ListSubvolumes
 
 	Flags SubvolFlags
 
@@ -325,14 +344,14 @@ func subvolidResolveSub(mnt *os.File, path string, subvolID objectID) (string, e
 		return "", nil
 	}
 	sk := btrfs_ioctl_search_key{
-		tree_id:      rootTreeObjectid,
-		min_objectid: subvolID,
-		max_objectid: subvolID,
-		min_type:     rootBackrefKey,
-		max_type:     rootBackrefKey,
-		max_offset:   maxUint64,
-		max_transid:  maxUint64,
-		nr_items:     1,
+		TreeID:      uint64(rootTreeObjectid),
+		MinObjectID: uint64(subvolID),
+		MaxObjectID: uint64(subvolID),
+		MinType:     uint32(rootBackrefKey),
+		MaxType:     uint32(rootBackrefKey),
+		MaxOffset:   maxUint64,
+		MaxTransID:  maxUint64,
+		NrItems:     1,
 	}
 	results, err := treeSearchRaw(mnt, sk)
 	if err != nil {
@@ -351,17 +370,42 @@ func subvolidResolveSub(mnt *os.File, path string, subvolID objectID) (string, e
 	backRef := asRootRef(res.Data)
 	if backRef.DirID != firstFreeObjectid {
 		arg := btrfs_ioctl_ino_lookup_args{
-			treeid:   objectID(res.Offset),
-			objectid: backRef.DirID,
+			TreeID:   res.Offset,
+			ObjectID: uint64(backRef.DirID),
 		}
 		if err := iocInoLookup(mnt, &arg); err != nil {
 			return "", err
 		}
-		path += arg.Name()
+		path += inoLookupName(&arg)
 	}
 	return path + backRef.Name, nil
 }
 
+// subvolMountPath returns a path to the root of the subvolume that is reachable
+// from the subvolume opened as mnt. mnt must be the root directory of a subvolume.
+func (f *FS) subvolMountPath(rootID objectID) (string, error) {
+	mnt := f.f
+	mntID, err := getFileRootID(mnt)
+	if err != nil {
+		return "", err
+	}
+	base, err := f.resolvePath(mntID)
+	if err != nil {
+		return "", err
+	}
+	path, err := f.resolvePath(rootID)
+	if err != nil {
+		return "", err
+	}
+	if base != "" {
+		if path != base && !strings.HasPrefix(path, base+"/") {
+			return "", fmt.Errorf("subvolume %q is not reachable from %s", path, mnt.Name())
+		}
+		path = strings.TrimPrefix(strings.TrimPrefix(path, base), "/")
+	}
+	return filepath.Join(mnt.Name(), path), nil
+}
+
 // subvolSearchByRootID
 //
 // Path is optional, and will be resolved automatically if not set.
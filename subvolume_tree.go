@@ -0,0 +1,85 @@
+package btrfs
+
+import "sort"
+
+// SubvolumeNode is a node in the hierarchy of subvolumes.
+type SubvolumeNode struct {
+	SubvolInfo
+	Qgroup   *Qgroup // usage of the subvolume, if quotas are enabled
+	Children []*SubvolumeNode
+}
+
+// Name returns the path of the subvolume relative to its parent.
+func (n *SubvolumeNode) Name(parent *SubvolumeNode) string {
+	if parent == nil || parent.Path == "" {
+		return n.Path
+	}
+	if len(n.Path) > len(parent.Path) && n.Path[:len(parent.Path)+1] == parent.Path+"/" {
+		return n.Path[len(parent.Path)+1:]
+	}
+	return n.Path
+}
+
+// Walk calls fn for the node and all its descendants in depth-first order.
+// Depth of the root node is zero.
+func (n *SubvolumeNode) Walk(fn func(n, parent *SubvolumeNode, depth int) error) error {
+	return n.walk(nil, 0, fn)
+}
+
+func (n *SubvolumeNode) walk(parent *SubvolumeNode, depth int, fn func(n, parent *SubvolumeNode, depth int) error) error {
+	if err := fn(n, parent, depth); err != nil {
+		return err
+	}
+	for _, c := range n.Children {
+		if err := c.walk(n, depth+1, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SubvolumeTree returns the hierarchy of all subvolumes of the filesystem.
+// The root node is the top-level subvolume. If quotas are enabled, nodes include the usage.
+func (f *FS) SubvolumeTree() (*SubvolumeNode, error) {
+	list, err := f.ListSubvolumes(nil)
+	if err != nil {
+		return nil, err
+	}
+	qgroups, err := f.Qgroups()
+	if err != nil && err != ErrQuotaDisabled {
+		return nil, err
+	}
+	return buildSubvolumeTree(list, qgroups), nil
+}
+
+// buildSubvolumeTree links subvolumes returned by ListSubvolumes to their parents. Subvolumes
+// with an unknown parent are attached to the root. Qgroups of level 0 are attached to nodes.
+func buildSubvolumeTree(list []SubvolInfo, qgroups []Qgroup) *SubvolumeNode {
+	usage := make(map[uint64]*Qgroup)
+	for i := range qgroups {
+		if q := &qgroups[i]; q.ID.Level() == 0 {
+			usage[q.ID.ID()] = q
+		}
+	}
+	root := &SubvolumeNode{SubvolInfo: SubvolInfo{RootID: uint64(fsTreeObjectid)}, Qgroup: usage[uint64(fsTreeObjectid)]}
+	nodes := make(map[uint64]*SubvolumeNode, len(list)+1)
+	nodes[root.RootID] = root
+	for _, v := range list {
+		nodes[v.RootID] = &SubvolumeNode{SubvolInfo: v, Qgroup: usage[v.RootID]}
+	}
+	for _, v := range list {
+		n := nodes[v.RootID]
+		p := nodes[v.ParentID]
+		if p == nil || p == n {
+			p = root
+		}
+		p.Children = append(p.Children, n)
+	}
+	root.Walk(func(n, _ *SubvolumeNode, _ int) error {
+		sort.Slice(n.Children, func(i, j int) bool {
+			return n.Children[i].Path < n.Children[j].Path
+		})
+		return nil
+	})
+	return root
+}
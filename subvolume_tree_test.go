@@ -0,0 +1,57 @@
+package btrfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildSubvolumeTree(t *testing.T) {
+	list := []SubvolInfo{
+		{RootID: 258, ParentID: 256, Path: "home/user"},
+		{RootID: 256, ParentID: 5, Path: "home"},
+		{RootID: 257, ParentID: 5, Path: "data"},
+		{RootID: 259, ParentID: 256, Path: "home/alice"},
+		{RootID: 260, ParentID: 300, Path: "orphan"}, // parent was not listed
+		{RootID: 261, ParentID: 261, Path: "self"},
+	}
+	qgroups := []Qgroup{
+		{ID: NewQgroupID(0, 256), Referenced: 100},
+		{ID: NewQgroupID(1, 256), Referenced: 200},
+		{ID: NewQgroupID(0, 5), Referenced: 10},
+	}
+	root := buildSubvolumeTree(list, qgroups)
+	if root.RootID != uint64(fsTreeObjectid) {
+		t.Fatalf("unexpected root: %d", root.RootID)
+	}
+	type line struct {
+		Name  string
+		Depth int
+	}
+	var got []line
+	root.Walk(func(n, parent *SubvolumeNode, depth int) error {
+		got = append(got, line{Name: n.Name(parent), Depth: depth})
+		return nil
+	})
+	exp := []line{
+		{"", 0},
+		{"data", 1},
+		{"home", 1},
+		{"alice", 2},
+		{"user", 2},
+		{"orphan", 1},
+		{"self", 1},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected tree:\n%v\nexp:\n%v", got, exp)
+	}
+	if root.Qgroup == nil || root.Qgroup.Referenced != 10 {
+		t.Fatalf("unexpected root qgroup: %+v", root.Qgroup)
+	}
+	home := root.Children[1]
+	if home.Qgroup == nil || home.Qgroup.Referenced != 100 {
+		t.Fatalf("expected a level 0 qgroup, got %+v", home.Qgroup)
+	}
+	if q := root.Children[0].Qgroup; q != nil {
+		t.Fatalf("unexpected qgroup: %+v", q)
+	}
+}
@@ -0,0 +1,168 @@
+package btrfs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const (
+	superInfoSize = 4096
+	superMagic    = "_BHRfS_M"
+)
+
+// superMirrorOffsets are the offsets of the primary superblock and its copies on a device.
+var superMirrorOffsets = []int64{
+	64 << 10,
+	64 << 20,
+	256 << 30,
+}
+
+// Offsets of superblock fields, see struct btrfs_super_block.
+const (
+	superCsumOff         = 0x00
+	superFSIDOff         = 0x20
+	superBytenrOff       = 0x30
+	superFlagsOff        = 0x38
+	superMagicOff        = 0x40
+	superGenerationOff   = 0x48
+	superRootOff         = 0x50
+	superChunkRootOff    = 0x58
+	superLogRootOff      = 0x60
+	superNumDevicesOff   = 0x88
+	superSectorSizeOff   = 0x90
+	superNodeSizeOff     = 0x94
+	superSysArraySizeOff = 0xa0
+	superCompatROOff     = 0xb4
+	superIncompatOff     = 0xbc
+	superCsumTypeOff     = 0xc4
+	superRootLevelOff    = 0xc6
+	superChunkLevelOff   = 0xc7
+	superDevIDOff        = 0xc9 // devid of the embedded dev_item
+	superCacheGenOff     = 0x22b
+	superMetadataUUIDOff = 0x23b
+	superSysArrayOff     = 0x32b
+	superSysArrayMax     = 2048
+)
+
+// Checksum types, in addition to csumTypeCrc32.
+const (
+	csumTypeSHA256 = 2
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// superblock is a raw on-disk superblock.
+type superblock [superInfoSize]byte
+
+func (sb *superblock) u64(off int) uint64 {
+	return binary.LittleEndian.Uint64(sb[off:])
+}
+
+func (sb *superblock) setU64(off int, v uint64) {
+	binary.LittleEndian.PutUint64(sb[off:], v)
+}
+
+func (sb *superblock) uuid(off int) (id UUID) {
+	copy(id[:], sb[off:off+UUIDSize])
+	return
+}
+
+func (sb *superblock) setUUID(off int, id UUID) {
+	copy(sb[off:off+UUIDSize], id[:])
+}
+
+func (sb *superblock) incompat() IncompatFeatures {
+	return IncompatFeatures(sb.u64(superIncompatOff))
+}
+
+func (sb *superblock) u32(off int) uint32 {
+	return binary.LittleEndian.Uint32(sb[off:])
+}
+
+func (sb *superblock) csumType() uint16 {
+	return binary.LittleEndian.Uint16(sb[superCsumTypeOff:])
+}
+
+// csum calculates the checksum of the superblock.
+func (sb *superblock) csum() ([]byte, error) {
+	return checksum(sb.csumType(), sb[superFSIDOff:])
+}
+
+// checksum calculates a metadata checksum of a given type. Only crc32c and sha256 are supported.
+func checksum(typ uint16, data []byte) ([]byte, error) {
+	switch typ {
+	case csumTypeCrc32:
+		var p [4]byte
+		binary.LittleEndian.PutUint32(p[:], crc32.Checksum(data, crc32c))
+		return p[:], nil
+	case csumTypeSHA256:
+		h := sha256.Sum256(data)
+		return h[:], nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum type: %d", typ)
+	}
+}
+
+func (sb *superblock) updateCsum() error {
+	sum, err := sb.csum()
+	if err != nil {
+		return err
+	}
+	copy(sb[superCsumOff:superFSIDOff], make([]byte, superFSIDOff))
+	copy(sb[superCsumOff:], sum)
+	return nil
+}
+
+// validate checks the magic, the location and the checksum of a superblock read at a given offset.
+func (sb *superblock) validate(off int64) error {
+	if string(sb[superMagicOff:superMagicOff+len(superMagic)]) != superMagic {
+		return errNoSuperblock
+	}
+	if sb.u64(superBytenrOff) != uint64(off) {
+		return fmt.Errorf("superblock at %d has wrong location: %d", off, sb.u64(superBytenrOff))
+	}
+	sum, err := sb.csum()
+	if err != nil {
+		return err
+	}
+	if string(sb[superCsumOff:superCsumOff+len(sum)]) != string(sum) {
+		return fmt.Errorf("superblock at %d has wrong checksum", off)
+	}
+	return nil
+}
+
+var errNoSuperblock = errors.New("no btrfs superblock found")
+
+func readSuperblock(f io.ReaderAt, off int64) (*superblock, error) {
+	sb := new(superblock)
+	if _, err := f.ReadAt(sb[:], off); err != nil {
+		return nil, err
+	}
+	return sb, nil
+}
+
+// writeSuperblocks writes the superblock to all mirror locations that fit on the device.
+func writeSuperblocks(f *os.File, sb *superblock) error {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	for _, off := range superMirrorOffsets {
+		if off+superInfoSize > size {
+			break
+		}
+		sb.setU64(superBytenrOff, uint64(off))
+		if err = sb.updateCsum(); err != nil {
+			return err
+		}
+		if _, err = f.WriteAt(sb[:], off); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
@@ -0,0 +1,184 @@
+package btrfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ErrNothingToThin is returned by ThinSnapshots if space is still low, but all eligible
+// snapshots were already deleted.
+var ErrNothingToThin = errors.New("no snapshots left to thin")
+
+// ThinPolicy controls automatic deletion of old snapshots by ThinSnapshots.
+//
+// Thinning is triggered when any of the thresholds is crossed. At least one must be set.
+type ThinPolicy struct {
+	// Dir is a directory with snapshots, relative to the FS. Only read-only subvolumes
+	// directly in it are eligible for deletion.
+	Dir string
+	// Match is a glob pattern of names of eligible snapshots. Empty means all of them.
+	Match string
+	// Keep is the number of the most recent eligible snapshots that are never deleted.
+	Keep int
+
+	// MinUnallocated triggers thinning when the unallocated space drops below it.
+	MinUnallocated uint64
+	// Qgroup and MaxQgroupUsage trigger thinning when referenced or exclusive bytes of the qgroup
+	// exceed the given fraction of its limits, e.g. 0.9. Quotas must be enabled.
+	Qgroup         QgroupID
+	MaxQgroupUsage float64
+
+	// PollInterval is the interval of checks whether a deleted snapshot was cleaned up.
+	// Default is one second.
+	PollInterval time.Duration
+	// OnDelete is called after each deleted snapshot was cleaned up, if set.
+	OnDelete func(e ThinEvent)
+}
+
+// ThinEvent describes a snapshot deleted by ThinSnapshots.
+type ThinEvent struct {
+	Time     time.Time
+	Snapshot string // path relative to the FS
+	Reason   string // the threshold that triggered the deletion
+	Waited   time.Duration
+}
+
+// thinTrigger returns a reason to thin snapshots, or an empty string if space is sufficient.
+func (f *FS) thinTrigger(p *ThinPolicy) (string, error) {
+	if p.MinUnallocated != 0 {
+		u, err := f.Usage()
+		if err != nil {
+			return "", err
+		}
+		if u.TotalUnused < p.MinUnallocated {
+			return fmt.Sprintf("unallocated space %d is below %d", u.TotalUnused, p.MinUnallocated), nil
+		}
+	}
+	if p.MaxQgroupUsage > 0 {
+		if err := f.Sync(); err != nil {
+			return "", err
+		}
+		list, err := f.Qgroups()
+		if err != nil {
+			return "", err
+		}
+		for _, q := range list {
+			if q.ID != p.Qgroup {
+				continue
+			}
+			if q.MaxReferenced != 0 && float64(q.Referenced) > p.MaxQgroupUsage*float64(q.MaxReferenced) {
+				return fmt.Sprintf("qgroup %v references %d of %d bytes", q.ID, q.Referenced, q.MaxReferenced), nil
+			}
+			if q.MaxExclusive != 0 && float64(q.Exclusive) > p.MaxQgroupUsage*float64(q.MaxExclusive) {
+				return fmt.Sprintf("qgroup %v uses %d of %d exclusive bytes", q.ID, q.Exclusive, q.MaxExclusive), nil
+			}
+			return "", nil
+		}
+		return "", fmt.Errorf("qgroup %v: %v", p.Qgroup, ErrNotFound)
+	}
+	return "", nil
+}
+
+// thinCandidates returns eligible snapshots, from the oldest one.
+func (f *FS) thinCandidates(p *ThinPolicy) ([]SubvolInfo, error) {
+	dir := filepath.Clean(p.Dir)
+	list, err := f.ListSubvolumes(func(s SubvolInfo) bool {
+		return s.Flags.ReadOnly()
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out []SubvolInfo
+	for _, s := range list {
+		abs, err := f.SubvolumePath(s.RootID)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(f.f.Name(), abs)
+		if err != nil || filepath.Dir(rel) != dir {
+			continue
+		}
+		if p.Match != "" {
+			if ok, _ := path.Match(p.Match, filepath.Base(rel)); !ok {
+				continue
+			}
+		}
+		s.Path = rel
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].OTransID < out[j].OTransID })
+	if len(out) <= p.Keep {
+		return nil, nil
+	}
+	return out[:len(out)-p.Keep], nil
+}
+
+// waitCleaned waits until the cleaner drops a deleted subvolume, so its space is freed.
+func (f *FS) waitCleaned(ctx context.Context, id uint64, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if _, err := readRootItem(f.f, objectID(id)); err == ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// ThinSnapshots deletes the oldest eligible snapshots while any threshold of the policy is crossed,
+// and returns paths of deleted snapshots. After each deletion it waits until the snapshot is cleaned
+// up and checks the thresholds again, since the space is not freed until then.
+//
+// It returns ErrNothingToThin if thresholds are still crossed after all eligible snapshots
+// were deleted. Deletions are subject to the guard and are audited (see SetGuard and SetAudit);
+// if the guard requires a reason, it must be set with WithReason.
+func (f *FS) ThinSnapshots(ctx context.Context, p ThinPolicy) ([]string, error) {
+	if p.MinUnallocated == 0 && p.MaxQgroupUsage <= 0 {
+		return nil, errors.New("no thinning thresholds are set")
+	} else if p.Keep < 0 {
+		return nil, fmt.Errorf("invalid number of snapshots to keep: %d", p.Keep)
+	}
+	if p.PollInterval <= 0 {
+		p.PollInterval = time.Second
+	}
+	var deleted []string
+	for {
+		reason, err := f.thinTrigger(&p)
+		if err != nil || reason == "" {
+			return deleted, err
+		}
+		cands, err := f.thinCandidates(&p)
+		if err != nil {
+			return deleted, err
+		} else if len(cands) == 0 {
+			return deleted, ErrNothingToThin
+		}
+		s := cands[0]
+		start := time.Now()
+		if err = f.DeleteSubVolume(s.Path); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, s.Path)
+		// the cleaner starts after the deletion is committed
+		if err = f.Sync(); err != nil {
+			return deleted, err
+		}
+		if err = f.waitCleaned(ctx, s.RootID, p.PollInterval); err != nil {
+			return deleted, err
+		}
+		if p.OnDelete != nil {
+			p.OnDelete(ThinEvent{Time: start, Snapshot: s.Path, Reason: reason, Waited: time.Since(start)})
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package btrfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dennwc/btrfs/test"
+)
+
+func TestThinSnapshots(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if _, err = fs.ThinSnapshots(context.Background(), ThinPolicy{Dir: "snaps"}); err == nil {
+		t.Fatal("expected an error without thresholds")
+	}
+	if err = fs.CreateSubVolume("sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(dir, "snaps"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"snap.1", "snap.2", "snap.3"} {
+		if err = fs.SnapshotSubVolume("sub", filepath.Join("snaps", name), true); err != nil {
+			t.Fatal(err)
+		}
+		if err = fs.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	policy := ThinPolicy{
+		Dir: "snaps", Match: "snap.*", Keep: 1,
+		MinUnallocated: 1 << 62, // always triggered
+		PollInterval:   10 * time.Millisecond,
+	}
+	// the guard is not satisfied implicitly by thinning
+	fs.SetGuard(Guard{RequireReason: true})
+	if deleted, err := fs.ThinSnapshots(context.Background(), policy); !isGuardErr(err) || len(deleted) != 0 {
+		t.Fatalf("expected a guard error, got: %v (deleted: %v)", err, deleted)
+	}
+	fs.ClearGuard()
+	var events []string
+	deleted, err := fs.ThinSnapshots(context.Background(), ThinPolicy{
+		Dir: "snaps", Match: "snap.*", Keep: 1,
+		MinUnallocated: 1 << 62, // always triggered
+		PollInterval:   10 * time.Millisecond,
+		OnDelete: func(e ThinEvent) {
+			events = append(events, e.Snapshot)
+		},
+	})
+	if err != ErrNothingToThin {
+		t.Fatalf("expected ErrNothingToThin, got: %v", err)
+	}
+	exp := []string{"snaps/snap.1", "snaps/snap.2"}
+	if !reflect.DeepEqual(deleted, exp) || !reflect.DeepEqual(events, exp) {
+		t.Fatalf("unexpected deletions: %v, events: %v", deleted, events)
+	}
+	if ok, err := IsSubVolume(filepath.Join(dir, "snaps", "snap.3")); err != nil || !ok {
+		t.Fatalf("the last snapshot must be kept: %v", err)
+	}
+}
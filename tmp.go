@@ -0,0 +1,181 @@
+package btrfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	// TempDirName is the directory in a subvolume that holds temporary subvolumes
+	// created by CreateTempSubvolume and TempSnapshot.
+	TempDirName = ".gbtrfs-tmp"
+
+	xattrTempExpires = "user.gbtrfs.expires"
+
+	// tempGracePeriod protects temporary subvolumes that were just created
+	// and don't have the expiration time yet.
+	tempGracePeriod = time.Minute
+)
+
+// TempDir returns the path of the directory with temporary subvolumes.
+func (f *FS) TempDir() string {
+	return filepath.Join(f.f.Name(), TempDirName)
+}
+
+// CreateTempSubvolume creates a subvolume in TempDir, which expires after ttl.
+// The subvolume is named after the prefix with a unique suffix. It returns the path
+// of the subvolume.
+//
+// The caller is expected to delete the subvolume when it's no longer needed; if it fails
+// to do so, for example because of a crash, the subvolume is removed by CleanupExpired.
+func (f *FS) CreateTempSubvolume(prefix string, ttl time.Duration) (string, error) {
+	name, err := f.tempPath(prefix)
+	if err != nil {
+		return "", err
+	}
+	if err = f.CreateSubVolume(name); err != nil {
+		return "", err
+	}
+	path := f.resolve(name)
+	if err = setTempExpires(path, time.Now().Add(ttl)); err != nil {
+		return "", f.abortTemp(name, err)
+	}
+	return path, nil
+}
+
+// TempSnapshot creates a snapshot of a subvolume (relative to f) in TempDir, which expires after ttl.
+// See CreateTempSubvolume.
+func (f *FS) TempSnapshot(subvol, prefix string, ro bool, ttl time.Duration) (string, error) {
+	name, err := f.tempPath(prefix)
+	if err != nil {
+		return "", err
+	}
+	// the expiration time cannot be set on a read-only snapshot, so the flag is set afterwards
+	if err = f.SnapshotSubVolume(subvol, name, false); err != nil {
+		return "", err
+	}
+	path := f.resolve(name)
+	err = setTempExpires(path, time.Now().Add(ttl))
+	if err == nil && ro {
+		err = setReadOnly(path)
+	}
+	if err != nil {
+		return "", f.abortTemp(name, err)
+	}
+	return path, nil
+}
+
+// abortTemp deletes a temporary subvolume that could not be set up, and returns the error
+// that caused it, together with the deletion error, if any.
+func (f *FS) abortTemp(name string, err error) error {
+	if err2 := f.DeleteSubVolume(name); err2 != nil {
+		return fmt.Errorf("%v (cannot delete %s: %v)", err, f.resolve(name), err2)
+	}
+	return err
+}
+
+// tempPath creates TempDir if necessary, and returns a unique name of a temporary subvolume, relative to f.
+func (f *FS) tempPath(prefix string) (string, error) {
+	dir := f.TempDir()
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	name := fmt.Sprintf("%s.%d", prefix, time.Now().UnixNano())
+	if !checkSubVolumeName(name) {
+		return "", fmt.Errorf("invalid subvolume name: %s", name)
+	}
+	return filepath.Join(TempDirName, name), nil
+}
+
+func setReadOnly(path string) error {
+	fs, err := Open(path, false)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	flags, err := fs.GetFlags()
+	if err != nil {
+		return err
+	}
+	return fs.SetFlags(flags | SubvolReadOnly)
+}
+
+func setTempExpires(path string, t time.Time) error {
+	err := syscall.Setxattr(path, xattrTempExpires, []byte(t.UTC().Format(time.RFC3339)), 0)
+	if err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+	return nil
+}
+
+// TempExpires returns the expiration time of a temporary subvolume.
+// It returns ErrNotFound if the subvolume has no expiration time.
+func TempExpires(path string) (time.Time, error) {
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(path, xattrTempExpires, buf)
+	if err == syscall.ENODATA {
+		return time.Time{}, ErrNotFound
+	} else if err != nil {
+		return time.Time{}, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	t, err := time.Parse(time.RFC3339, string(buf[:n]))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiration time of %s: %v", path, err)
+	}
+	return t, nil
+}
+
+// CleanupExpired deletes expired subvolumes from TempDir and returns their paths.
+// Subvolumes without an expiration time are deleted as well, since they were left
+// by a process that crashed while creating them, unless they are very recent.
+//
+// It's safe to call it concurrently with the creation of temporary subvolumes, and it's
+// meant to be called periodically (see "gbtrfs subvolume cleanup-tmp").
+func (f *FS) CleanupExpired() ([]string, error) {
+	dir := f.TempDir()
+	list, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var deleted []string
+	for _, fi := range list {
+		path := filepath.Join(dir, fi.Name())
+		if ok, err := IsSubVolume(path); err != nil || !ok {
+			continue
+		}
+		t, err := TempExpires(path)
+		if err == ErrNotFound {
+			t = fi.ModTime().Add(tempGracePeriod)
+		} else if err != nil {
+			return deleted, err
+		}
+		if now.Before(t) {
+			continue
+		}
+		if err = f.deleteTemp(path); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, path)
+	}
+	return deleted, nil
+}
+
+func (f *FS) deleteTemp(path string) error {
+	rel, err := filepath.Rel(f.f.Name(), path)
+	if err != nil {
+		return err
+	}
+	err = f.DeleteSubVolume(rel)
+	if os.IsNotExist(err) {
+		// deleted by the owner in the meantime
+		err = nil
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+package btrfs
+
+import (
+	"os"
+	"runtime"
+	"sync"
+)
+
+// partsPerWorker is the number of key ranges per worker. Items are rarely distributed
+// evenly across object ids, thus ranges are made smaller than needed, and workers
+// pick them one by one.
+const partsPerWorker = 8
+
+// SetScanWorkers sets the number of goroutines used by whole-filesystem scans
+// (for example, BlockGroups). Zero or negative value uses GOMAXPROCS. The default is 1,
+// which scans trees sequentially.
+//
+// It must be called before the FS is used concurrently.
+func (f *FS) SetScanWorkers(n int) {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	f.scanWorkers = n
+}
+
+// scan is like treeSearch, but uses the number of workers set by SetScanWorkers.
+// Function may be called concurrently, and items are not ordered.
+func (f *FS) scan(sk btrfs_ioctl_search_key, fn func(searchResult) error) error {
+	if f.scanWorkers <= 1 {
+		return treeSearch(f.f, sk, fn)
+	}
+	return treeSearchParallel(f.f, sk, f.scanWorkers, fn)
+}
+
+// firstObjectID returns the object id of the first item in the key range.
+func firstObjectID(mnt *os.File, sk btrfs_ioctl_search_key) (objectID, bool, error) {
+	sk.NrItems = 1
+	out, err := treeSearchRaw(mnt, sk)
+	if err != nil || len(out) == 0 {
+		return 0, false, err
+	}
+	return out[0].ObjectID, true, nil
+}
+
+// lastObjectID returns the object id of the last item in the key range.
+// Tree search can only iterate forward, thus it does a binary search on object ids.
+func lastObjectID(mnt *os.File, sk btrfs_ioctl_search_key, first objectID) (objectID, error) {
+	lo, hi := first, objectID(sk.MaxObjectID)
+	for lo < hi {
+		mid := lo + (hi-lo)/2 + 1
+		probe := sk
+		probe.MinObjectID, probe.MinType, probe.MinOffset = uint64(mid), 0, 0
+		_, ok, err := firstObjectID(mnt, probe)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo, nil
+}
+
+// splitSearchKey partitions the key range into at most n ranges by object id.
+// Internal boundaries cover all types and offsets, thus the union of ranges
+// is exactly the original range.
+func splitSearchKey(sk btrfs_ioctl_search_key, first, last objectID, n int) []btrfs_ioctl_search_key {
+	span := uint64(last - first)
+	if n < 1 {
+		n = 1
+	}
+	if span < maxUint64 && uint64(n) > span+1 {
+		n = int(span + 1)
+	}
+	step := span/uint64(n) + 1
+	out := make([]btrfs_ioctl_search_key, 0, n)
+	for lo := uint64(first); ; lo += step {
+		k := sk
+		if lo != uint64(first) {
+			k.MinObjectID, k.MinType, k.MinOffset = lo, 0, 0
+		}
+		if hi := lo + step - 1; hi < uint64(last) && hi >= lo {
+			k.MaxObjectID, k.MaxType, k.MaxOffset = hi, 255, maxUint64
+			out = append(out, k)
+			continue
+		}
+		out = append(out, k)
+		return out
+	}
+}
+
+// treeSearchParallel iterates over all items in the key range using a given number of workers.
+// The range is partitioned by object ids. Function fn must be safe for concurrent use.
+// The first error stops the search.
+func treeSearchParallel(mnt *os.File, sk btrfs_ioctl_search_key, workers int, fn func(searchResult) error) error {
+	first, ok, err := firstObjectID(mnt, sk)
+	if err != nil || !ok {
+		return err
+	}
+	if objectID(sk.MinObjectID) < first {
+		sk.MinObjectID, sk.MinType, sk.MinOffset = uint64(first), 0, 0
+	}
+	last, err := lastObjectID(mnt, sk, first)
+	if err != nil {
+		return err
+	}
+	if objectID(sk.MaxObjectID) > last {
+		sk.MaxObjectID, sk.MaxType, sk.MaxOffset = uint64(last), 255, maxUint64
+	}
+	parts := splitSearchKey(sk, first, last, workers*partsPerWorker)
+	if len(parts) < workers {
+		workers = len(parts)
+	}
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		ferr error
+	)
+	work := make(chan btrfs_ioctl_search_key)
+	stop := make(chan struct{})
+	setErr := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ferr == nil {
+			ferr = err
+			close(stop)
+		}
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range work {
+				if err := treeSearch(mnt, k, fn); err != nil {
+					setErr(err)
+				}
+			}
+		}()
+	}
+loop:
+	for _, k := range parts {
+		select {
+		case work <- k:
+		case <-stop:
+			break loop
+		}
+	}
+	close(work)
+	wg.Wait()
+	return ferr
+}
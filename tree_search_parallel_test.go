@@ -0,0 +1,34 @@
+package btrfs
+
+import "testing"
+
+func TestSplitSearchKey(t *testing.T) {
+	sk := btrfs_ioctl_search_key{
+		MinObjectID: 10, MinType: 5, MinOffset: 7,
+		MaxObjectID: 1000, MaxType: 6, MaxOffset: 9,
+	}
+	for _, n := range []int{1, 3, 8, 991, 5000} {
+		parts := splitSearchKey(sk, 10, 1000, n)
+		if len(parts) == 0 || len(parts) > n {
+			t.Fatalf("%d: unexpected number of parts: %d", n, len(parts))
+		}
+		first, last := parts[0], parts[len(parts)-1]
+		if first.MinObjectID != 10 || first.MinType != 5 || first.MinOffset != 7 {
+			t.Errorf("%d: unexpected start: %+v", n, first)
+		}
+		if last.MaxObjectID != 1000 || last.MaxType != 6 || last.MaxOffset != 9 {
+			t.Errorf("%d: unexpected end: %+v", n, last)
+		}
+		for i := 1; i < len(parts); i++ {
+			prev, cur := parts[i-1], parts[i]
+			if prev.MaxObjectID+1 != cur.MinObjectID || prev.MaxType != 255 || prev.MaxOffset != maxUint64 ||
+				cur.MinType != 0 || cur.MinOffset != 0 {
+				t.Errorf("%d: gap between parts %d and %d: %+v %+v", n, i-1, i, prev, cur)
+			}
+		}
+	}
+	parts := splitSearchKey(sk, 0, lastFreeObjectid, 4)
+	if len(parts) != 4 || parts[3].MaxObjectID != 1000 {
+		t.Errorf("unexpected parts for a large range: %+v", parts)
+	}
+}
@@ -0,0 +1,163 @@
+package btrfs
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// tuneSuperblock applies offline changes to the superblock of an unmounted single-device filesystem.
+//
+// The device is opened exclusively, so it cannot be mounted concurrently. All superblock copies
+// must be valid and have the same generation as the primary one, otherwise the filesystem was
+// not unmounted cleanly, or a previous update was interrupted. The changed superblock is written
+// to all copies only if fn reports a change. The primary superblock is checked again right before
+// writing, to make sure it was not modified in the meantime.
+func tuneSuperblock(device string, fn func(sb *superblock) (bool, error)) error {
+	f, err := os.OpenFile(device, os.O_RDWR|syscall.O_EXCL, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	primary := superMirrorOffsets[0]
+	sb, err := readSuperblock(f, primary)
+	if err != nil {
+		return fmt.Errorf("cannot read superblock: %v", err)
+	}
+	if err = sb.validate(primary); err != nil {
+		return err
+	}
+	gen := sb.u64(superGenerationOff)
+	for _, off := range superMirrorOffsets[1:] {
+		mirror, err := readSuperblock(f, off)
+		if err != nil {
+			break // device is smaller than this mirror offset
+		}
+		if err = mirror.validate(off); err == errNoSuperblock {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if g := mirror.u64(superGenerationOff); g != gen {
+			return fmt.Errorf("superblock at %d has generation %d, while the primary has %d", off, g, gen)
+		}
+	}
+	switch {
+	case sb.u64(superNumDevicesOff) != 1:
+		return fmt.Errorf("filesystem has %d devices, only single-device filesystems are supported", sb.u64(superNumDevicesOff))
+	case sb.u64(superLogRootOff) != 0:
+		return errors.New("filesystem has a log tree, mount it to replay the log first")
+	}
+	if changed, err := fn(sb); err != nil || !changed {
+		return err
+	}
+	cur, err := readSuperblock(f, primary)
+	if err != nil {
+		return err
+	}
+	if g := cur.u64(superGenerationOff); g != gen {
+		return fmt.Errorf("superblock generation changed from %d to %d", gen, g)
+	}
+	return writeSuperblocks(f, sb)
+}
+
+// ChangeFSID changes the filesystem id (uuid) of an unmounted single-device filesystem,
+// so a cloned image can be mounted alongside its source. If newUUID is zero, a random one is used.
+//
+// Like btrfstune -m, only the superblocks are rewritten: the original id is kept as the
+// metadata uuid, which all the tree blocks refer to, and the metadata_uuid feature is enabled
+// (Linux 5.0+ is required to mount it). Changing the id back to the metadata uuid disables
+// the feature. The filesystem must be unmounted cleanly, since log trees are not updated.
+//
+// Since the kernel remembers scanned devices, a device scan may be needed before mounting.
+func ChangeFSID(device string, newUUID UUID) error {
+	if newUUID.IsZero() {
+		if _, err := rand.Read(newUUID[:]); err != nil {
+			return err
+		}
+		newUUID[6] = newUUID[6]&0x0f | 0x40 // version 4
+		newUUID[8] = newUUID[8]&0x3f | 0x80 // variant 10
+	}
+	return tuneSuperblock(device, func(sb *superblock) (bool, error) {
+		if sb.u64(superFlagsOff)&superFlagSeeding != 0 {
+			return false, errors.New("cannot change fsid of a seed filesystem")
+		}
+		fsid := sb.uuid(superFSIDOff)
+		if fsid == newUUID {
+			return false, nil
+		}
+		incompat := sb.incompat()
+		metaUUID := fsid
+		if incompat&FeatureIncompatMetadataUUID != 0 {
+			metaUUID = sb.uuid(superMetadataUUIDOff)
+		}
+		if newUUID == metaUUID {
+			incompat &^= FeatureIncompatMetadataUUID
+			metaUUID = UUID{}
+		} else {
+			incompat |= FeatureIncompatMetadataUUID
+		}
+		sb.setUUID(superFSIDOff, newUUID)
+		sb.setUUID(superMetadataUUIDOff, metaUUID)
+		sb.setU64(superIncompatOff, uint64(incompat))
+		return true, nil
+	})
+}
+
+// EnableNoHoles enables the no-holes feature on an unmounted filesystem (btrfstune -n),
+// so holes in files are no longer recorded with explicit extent items. It cannot be disabled.
+func EnableNoHoles(device string) error {
+	return tuneSuperblock(device, func(sb *superblock) (bool, error) {
+		incompat := sb.incompat()
+		if incompat&FeatureIncompatNoHoles != 0 {
+			return false, nil
+		}
+		sb.setU64(superIncompatOff, uint64(incompat|FeatureIncompatNoHoles))
+		return true, nil
+	})
+}
+
+// ClearSpaceCache invalidates the free space cache (v1) of an unmounted filesystem, which is
+// the offline step of converting it to the free space tree (v2).
+//
+// Cache inodes are not removed; the kernel discards their contents because the cache generation
+// no longer matches. The free space tree itself is built by the kernel on the next read-write
+// mount with -o space_cache=v2. It does nothing if the free space tree is already enabled.
+func ClearSpaceCache(device string) error {
+	return tuneSuperblock(device, func(sb *superblock) (bool, error) {
+		if FeatureFlags(sb.u64(superCompatROOff))&FeatureCompatROFreeSpaceTree != 0 {
+			return false, nil
+		}
+		if sb.u64(superCacheGenOff) == maxUint64 {
+			return false, nil
+		}
+		sb.setU64(superCacheGenOff, maxUint64)
+		return true, nil
+	})
+}
+
+// SetSeeding sets or clears the seeding flag of an unmounted filesystem (btrfstune -S).
+//
+// A seed filesystem is mounted read-only, and can be used as a base for new filesystems
+// by adding a writable device to it. Clearing the flag is dangerous if such filesystems exist,
+// since modifying the seed makes them unmountable.
+func SetSeeding(device string, v bool) error {
+	return tuneSuperblock(device, func(sb *superblock) (bool, error) {
+		flags := sb.u64(superFlagsOff)
+		if (flags&superFlagSeeding != 0) == v {
+			return false, nil
+		}
+		if v && sb.incompat()&FeatureIncompatMetadataUUID != 0 {
+			return false, errors.New("cannot set the seeding flag on a filesystem with a changed fsid")
+		}
+		if v {
+			flags |= superFlagSeeding
+		} else {
+			flags &^= superFlagSeeding
+		}
+		sb.setU64(superFlagsOff, flags)
+		return true, nil
+	})
+}
@@ -0,0 +1,135 @@
+package btrfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestImage(t *testing.T) string {
+	f, err := ioutil.TempFile("", "btrfs-image-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = f.Truncate(superMirrorOffsets[1] + superInfoSize); err != nil {
+		t.Fatal(err)
+	}
+	sb := new(superblock)
+	copy(sb[superMagicOff:], superMagic)
+	sb.setUUID(superFSIDOff, UUID{1, 2, 3})
+	sb.setU64(superNumDevicesOff, 1)
+	sb.setU64(superGenerationOff, 5)
+	if err = writeSuperblocks(f, sb); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func readTestSuper(t *testing.T, path string, off int64) *superblock {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sb, err := readSuperblock(f, off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sb.validate(off); err != nil {
+		t.Fatal(err)
+	}
+	return sb
+}
+
+func TestChangeFSID(t *testing.T) {
+	path := newTestImage(t)
+	defer os.Remove(path)
+
+	orig, id := UUID{1, 2, 3}, UUID{4, 5, 6}
+	if err := ChangeFSID(path, id); err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range superMirrorOffsets[:2] {
+		sb := readTestSuper(t, path, off)
+		if got := sb.uuid(superFSIDOff); got != id {
+			t.Fatalf("unexpected fsid: %v", got)
+		} else if got = sb.uuid(superMetadataUUIDOff); got != orig {
+			t.Fatalf("unexpected metadata uuid: %v", got)
+		} else if sb.incompat()&FeatureIncompatMetadataUUID == 0 {
+			t.Fatal("expected metadata_uuid feature")
+		}
+	}
+	// random id keeps the original metadata uuid
+	if err := ChangeFSID(path, UUID{}); err != nil {
+		t.Fatal(err)
+	}
+	sb := readTestSuper(t, path, superMirrorOffsets[0])
+	if got := sb.uuid(superFSIDOff); got == id || got.IsZero() {
+		t.Fatalf("unexpected fsid: %v", got)
+	} else if got = sb.uuid(superMetadataUUIDOff); got != orig {
+		t.Fatalf("unexpected metadata uuid: %v", got)
+	}
+	// changing back disables the feature
+	if err := ChangeFSID(path, orig); err != nil {
+		t.Fatal(err)
+	}
+	sb = readTestSuper(t, path, superMirrorOffsets[0])
+	if got := sb.uuid(superFSIDOff); got != orig {
+		t.Fatalf("unexpected fsid: %v", got)
+	} else if !sb.uuid(superMetadataUUIDOff).IsZero() || sb.incompat()&FeatureIncompatMetadataUUID != 0 {
+		t.Fatal("expected metadata_uuid feature to be disabled")
+	}
+}
+
+func TestTuneSuperblock(t *testing.T) {
+	path := newTestImage(t)
+	defer os.Remove(path)
+
+	if err := EnableNoHoles(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := ClearSpaceCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSeeding(path, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range superMirrorOffsets[:2] {
+		sb := readTestSuper(t, path, off)
+		if sb.incompat()&FeatureIncompatNoHoles == 0 {
+			t.Fatal("expected no-holes feature")
+		} else if sb.u64(superCacheGenOff) != maxUint64 {
+			t.Fatal("expected space cache to be invalidated")
+		} else if sb.u64(superFlagsOff)&superFlagSeeding == 0 {
+			t.Fatal("expected seeding flag")
+		}
+	}
+	if err := ChangeFSID(path, UUID{}); err == nil {
+		t.Fatal("expected fsid change to fail on a seed filesystem")
+	}
+	if err := SetSeeding(path, false); err != nil {
+		t.Fatal(err)
+	}
+	if sb := readTestSuper(t, path, superMirrorOffsets[0]); sb.u64(superFlagsOff)&superFlagSeeding != 0 {
+		t.Fatal("expected seeding flag to be cleared")
+	}
+
+	// mirror with a different generation
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb := readTestSuper(t, path, superMirrorOffsets[1])
+	sb.setU64(superGenerationOff, 4)
+	if err = sb.updateCsum(); err == nil {
+		_, err = f.WriteAt(sb[:], superMirrorOffsets[1])
+	}
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SetSeeding(path, true); err == nil {
+		t.Fatal("expected generation mismatch")
+	}
+}
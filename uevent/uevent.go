@@ -0,0 +1,236 @@
+// Package uevent listens to kernel uevents related to btrfs devices.
+//
+// It allows daemons to react to a device being added to the system, removed from it,
+// or dropping out of a mounted filesystem, without polling device lists.
+package uevent
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/dennwc/btrfs"
+)
+
+// EventType is a type of btrfs device event.
+type EventType int
+
+const (
+	// DeviceAdded is sent when a block device with btrfs superblock appears.
+	DeviceAdded EventType = iota + 1
+	// DeviceRemoved is sent when a btrfs device is removed and its filesystem is not mounted.
+	DeviceRemoved
+	// DeviceMissing is sent when a device of a mounted filesystem is removed.
+	DeviceMissing
+	// FSChanged is sent when the kernel reports a change of a mounted filesystem,
+	// for example when a device is added to or removed from it.
+	FSChanged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case DeviceAdded:
+		return "added"
+	case DeviceRemoved:
+		return "removed"
+	case DeviceMissing:
+		return "missing"
+	case FSChanged:
+		return "changed"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is a btrfs-related device event.
+type Event struct {
+	Type   EventType
+	Device string     // device node, e.g. /dev/sdb; empty for FSChanged
+	FSID   btrfs.FSID // filesystem the device belongs (or belonged) to
+	// Raw is the original kernel uevent.
+	Raw *Uevent
+}
+
+// Uevent is a raw kernel uevent.
+type Uevent struct {
+	Action  string // add, remove, change, etc
+	DevPath string // path in sysfs, relative to /sys
+	Env     map[string]string
+}
+
+// ParseUevent parses a uevent message as sent by the kernel.
+func ParseUevent(p []byte) (*Uevent, error) {
+	fields := bytes.Split(p, []byte{0})
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty uevent")
+	}
+	hdr := string(fields[0])
+	i := strings.IndexByte(hdr, '@')
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid uevent header: %q", hdr)
+	}
+	ev := &Uevent{
+		Action:  hdr[:i],
+		DevPath: hdr[i+1:],
+		Env:     make(map[string]string),
+	}
+	for _, f := range fields[1:] {
+		if kv := string(f); kv != "" {
+			if j := strings.IndexByte(kv, '='); j > 0 {
+				ev.Env[kv[:j]] = kv[j+1:]
+			}
+		}
+	}
+	return ev, nil
+}
+
+const (
+	sysfsBtrfs = "/sys/fs/btrfs"
+	// kernelGroup is the netlink multicast group of uevents sent by the kernel.
+	kernelGroup = 1
+	// uevent messages are limited by the kernel to this size
+	ueventBufSize = 8192
+)
+
+// Listener receives btrfs device events from the kernel.
+type Listener struct {
+	f *os.File
+
+	mu    sync.Mutex
+	known map[string]btrfs.FSID // device node -> fsid
+}
+
+// Listen starts listening for kernel uevents. It requires CAP_NET_ADMIN or root
+// in most configurations.
+func Listen() (*Listener, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: kernelGroup}
+	if err = syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err = syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+	l := &Listener{
+		f:     os.NewFile(uintptr(fd), "uevent"),
+		known: make(map[string]btrfs.FSID),
+	}
+	l.scanKnown()
+	return l, nil
+}
+
+// scanKnown collects devices of mounted filesystems, so their removal can be detected.
+func (l *Listener) scanKnown() {
+	dirs, _ := filepath.Glob(filepath.Join(sysfsBtrfs, "*", "devices", "*"))
+	for _, d := range dirs {
+		u, err := btrfs.ParseUUID(filepath.Base(filepath.Dir(filepath.Dir(d))))
+		if err != nil {
+			continue
+		}
+		l.known["/dev/"+filepath.Base(d)] = btrfs.FSID(u)
+	}
+}
+
+// Close stops the listener. It unblocks pending Next calls.
+func (l *Listener) Close() error {
+	return l.f.Close()
+}
+
+// Next waits for the next btrfs event. Uevents not related to btrfs are skipped.
+func (l *Listener) Next() (*Event, error) {
+	buf := make([]byte, ueventBufSize)
+	for {
+		n, err := l.f.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		u, err := ParseUevent(buf[:n])
+		if err != nil {
+			continue // not a kernel uevent
+		}
+		if ev := l.handle(u); ev != nil {
+			return ev, nil
+		}
+	}
+}
+
+// handle converts a raw uevent to a btrfs event. It returns nil for unrelated events.
+func (l *Listener) handle(u *Uevent) *Event {
+	if strings.HasPrefix(u.DevPath, "/fs/btrfs/") {
+		id, err := btrfs.ParseUUID(filepath.Base(u.DevPath))
+		if err != nil || u.Action != "change" {
+			return nil
+		}
+		return &Event{Type: FSChanged, FSID: btrfs.FSID(id), Raw: u}
+	}
+	if u.Env["SUBSYSTEM"] != "block" || u.Env["DEVNAME"] == "" {
+		return nil
+	}
+	dev := u.Env["DEVNAME"]
+	if !strings.HasPrefix(dev, "/") {
+		dev = "/dev/" + dev
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch u.Action {
+	case "add", "change":
+		fsid, ok, err := probeFSID(dev)
+		if err != nil || !ok {
+			delete(l.known, dev)
+			return nil
+		}
+		_, seen := l.known[dev]
+		l.known[dev] = fsid
+		if seen && u.Action == "change" {
+			return nil
+		}
+		return &Event{Type: DeviceAdded, Device: dev, FSID: fsid, Raw: u}
+	case "remove":
+		fsid, ok := l.known[dev]
+		if !ok {
+			return nil
+		}
+		delete(l.known, dev)
+		typ := DeviceRemoved
+		if _, err := os.Stat(filepath.Join(sysfsBtrfs, btrfs.UUID(fsid).String())); err == nil {
+			typ = DeviceMissing
+		}
+		return &Event{Type: typ, Device: dev, FSID: fsid, Raw: u}
+	}
+	return nil
+}
+
+const (
+	superInfoOffset = 64 * 1024
+	superMagic      = "_BHRfS_M"
+	superFSIDOffset = 0x20
+	superMagicOff   = 0x40
+)
+
+// probeFSID reads the primary superblock of a device and returns the filesystem id,
+// if the device contains btrfs.
+func probeFSID(dev string) (btrfs.FSID, bool, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return btrfs.FSID{}, false, err
+	}
+	defer f.Close()
+	buf := make([]byte, superMagicOff+len(superMagic))
+	if _, err = f.ReadAt(buf, superInfoOffset); err != nil {
+		return btrfs.FSID{}, false, nil
+	}
+	if string(buf[superMagicOff:]) != superMagic {
+		return btrfs.FSID{}, false, nil
+	}
+	var id btrfs.FSID
+	copy(id[:], buf[superFSIDOffset:])
+	return id, true, nil
+}
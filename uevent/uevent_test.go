@@ -0,0 +1,43 @@
+package uevent
+
+import (
+	"testing"
+
+	"github.com/dennwc/btrfs"
+)
+
+func TestParseUevent(t *testing.T) {
+	msg := "remove@/devices/virtual/block/loop0\x00ACTION=remove\x00DEVPATH=/devices/virtual/block/loop0\x00SUBSYSTEM=block\x00DEVNAME=loop0\x00"
+	u, err := ParseUevent([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Action != "remove" || u.DevPath != "/devices/virtual/block/loop0" {
+		t.Fatalf("unexpected header: %+v", u)
+	} else if u.Env["DEVNAME"] != "loop0" || u.Env["SUBSYSTEM"] != "block" {
+		t.Fatalf("unexpected env: %v", u.Env)
+	}
+	if _, err = ParseUevent([]byte("libudev\x00...")); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	fsid := btrfs.FSID{1, 2, 3}
+	l := &Listener{known: map[string]btrfs.FSID{"/dev/loop0": fsid}}
+	ev := l.handle(u)
+	if ev == nil {
+		t.Fatal("expected an event")
+	} else if ev.Device != "/dev/loop0" || ev.FSID != fsid || (ev.Type != DeviceRemoved && ev.Type != DeviceMissing) {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	if ev = l.handle(u); ev != nil {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	u, err = ParseUevent([]byte("change@/fs/btrfs/01020300-0000-0000-0000-000000000000\x00ACTION=change\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev = l.handle(u); ev == nil || ev.Type != FSChanged || ev.FSID != fsid {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+}
@@ -0,0 +1,108 @@
+// Package units formats and parses sizes in bytes, the same way as btrfs-progs does.
+package units
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Mode selects how sizes are rendered.
+type Mode int
+
+const (
+	// IEC uses powers of 1024: KiB, MiB, GiB, etc. This is the default.
+	IEC Mode = iota
+	// SI uses powers of 1000: kB, MB, GB, etc.
+	SI
+	// Raw prints the number of bytes as is.
+	Raw
+)
+
+var (
+	iecSuffixes = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	siSuffixes  = []string{"B", "kB", "MB", "GB", "TB", "PB", "EB"}
+)
+
+// Format renders a size in bytes according to the mode, e.g. "1.50GiB".
+func Format(n uint64, m Mode) string {
+	var (
+		base     uint64
+		suffixes []string
+	)
+	switch m {
+	case Raw:
+		return strconv.FormatUint(n, 10)
+	case SI:
+		base, suffixes = 1000, siSuffixes
+	default:
+		base, suffixes = 1024, iecSuffixes
+	}
+	if n < base {
+		return fmt.Sprintf("%d%s", n, suffixes[0])
+	}
+	i, div := 0, uint64(1)
+	for n/div >= base && i < len(suffixes)-1 {
+		div *= base
+		i++
+	}
+	return fmt.Sprintf("%.2f%s", float64(n)/float64(div), suffixes[i])
+}
+
+// FormatSigned is like Format, but for signed values such as deltas. Positive
+// values are prefixed with a plus sign.
+func FormatSigned(n int64, m Mode) string {
+	if n < 0 {
+		return "-" + Format(uint64(-n), m)
+	}
+	return "+" + Format(uint64(n), m)
+}
+
+// Parse parses a size with an optional suffix. Single letter suffixes (k, m, g, t, p, e)
+// are powers of 1024, as in btrfs-progs; "KiB" and "kB" forms are also accepted.
+func Parse(s string) (uint64, error) {
+	str := strings.TrimSpace(s)
+	i := len(str)
+	for i > 0 && (str[i-1] < '0' || str[i-1] > '9') && str[i-1] != '.' {
+		i--
+	}
+	num, suf := str[:i], strings.ToLower(str[i:])
+	mult := uint64(1)
+	if suf != "" && suf != "b" {
+		base := uint64(1024)
+		switch {
+		case len(suf) == 1:
+		case len(suf) == 2 && suf[1] == 'b':
+			base = 1000
+		case len(suf) == 3 && suf[1:] == "ib":
+		default:
+			return 0, fmt.Errorf("invalid size suffix: %q", s)
+		}
+		p := strings.IndexByte("kmgtpe", suf[0])
+		if p < 0 {
+			return 0, fmt.Errorf("invalid size suffix: %q", s)
+		}
+		for ; p >= 0; p-- {
+			mult *= base
+		}
+	}
+	if strings.IndexByte(num, '.') < 0 {
+		v, err := strconv.ParseUint(num, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid size: %q", s)
+		}
+		if v != 0 && v*mult/v != mult {
+			return 0, fmt.Errorf("size is too large: %q", s)
+		}
+		return v * mult, nil
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	v *= float64(mult)
+	if v >= 1<<64 {
+		return 0, fmt.Errorf("size is too large: %q", s)
+	}
+	return uint64(v), nil
+}
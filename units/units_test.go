@@ -0,0 +1,58 @@
+package units
+
+import "testing"
+
+var formatCases = []struct {
+	n   uint64
+	m   Mode
+	exp string
+}{
+	{0, IEC, "0B"},
+	{1023, IEC, "1023B"},
+	{1024, IEC, "1.00KiB"},
+	{1536 * 1024 * 1024, IEC, "1.50GiB"},
+	{1 << 63, IEC, "8.00EiB"},
+	{999, SI, "999B"},
+	{1500000, SI, "1.50MB"},
+	{1536 * 1024 * 1024, Raw, "1610612736"},
+}
+
+func TestFormat(t *testing.T) {
+	for _, c := range formatCases {
+		if got := Format(c.n, c.m); got != c.exp {
+			t.Errorf("%d (%d): expected %q, got %q", c.n, c.m, c.exp, got)
+		}
+	}
+	if got := FormatSigned(-2048, IEC); got != "-2.00KiB" {
+		t.Errorf("unexpected signed value: %q", got)
+	}
+}
+
+var parseCases = []struct {
+	s   string
+	exp uint64
+}{
+	{"0", 0},
+	{"512", 512},
+	{"10k", 10 * 1024},
+	{"2G", 2 << 30},
+	{"2GiB", 2 << 30},
+	{"2GB", 2000000000},
+	{"1.5m", 1536 * 1024},
+}
+
+func TestParse(t *testing.T) {
+	for _, c := range parseCases {
+		got, err := Parse(c.s)
+		if err != nil {
+			t.Errorf("%q: %v", c.s, err)
+		} else if got != c.exp {
+			t.Errorf("%q: expected %d, got %d", c.s, c.exp, got)
+		}
+	}
+	for _, s := range []string{"", "g", "10x", "10kx", "100e"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
@@ -72,14 +72,14 @@ func spaceUsage(f *os.File) (UsageInfo, error) {
 		return UsageInfo{}, err
 	}
 	var u UsageInfo
-	for i := uint64(0); i <= info.max_id; i++ {
+	for i := uint64(0); i <= info.MaxID; i++ {
 		dev, err := iocDevInfo(f, i, UUID{})
 		if err == syscall.ENODEV {
 			continue
 		} else if err != nil {
 			return UsageInfo{}, err
 		}
-		u.Total += dev.total_bytes
+		u.Total += dev.TotalBytes
 	}
 
 	spaces, err := iocSpaceInfo(f)
@@ -99,6 +99,10 @@ func spaceUsage(f *os.File) (UsageInfo, error) {
 			ratio = 1
 		case bg&blockGroupRaid1 != 0:
 			ratio = 2
+		case bg&blockGroupRaid1C3 != 0:
+			ratio = 3
+		case bg&blockGroupRaid1C4 != 0:
+			ratio = 4
 		case bg&blockGroupRaid5 != 0:
 			ratio = 0
 		case bg&blockGroupRaid6 != 0:
@@ -77,28 +77,70 @@ type searchResult struct {
 
 func treeSearchRaw(mnt *os.File, key btrfs_ioctl_search_key) (out []searchResult, _ error) {
 	args := btrfs_ioctl_search_args{
-		key: key,
+		Key: key,
 	}
 	if err := iocTreeSearch(mnt, &args); err != nil {
 		return nil, err
 	}
-	out = make([]searchResult, 0, args.key.nr_items)
-	buf := args.buf[:]
-	for i := 0; i < int(args.key.nr_items); i++ {
+	out = make([]searchResult, 0, args.Key.NrItems)
+	buf := args.Buf[:]
+	for i := 0; i < int(args.Key.NrItems); i++ {
 		h := (*btrfs_ioctl_search_header)(unsafe.Pointer(&buf[0]))
 		buf = buf[unsafe.Sizeof(btrfs_ioctl_search_header{}):]
 		out = append(out, searchResult{
-			TransID:  h.transid,
-			ObjectID: h.objectid,
-			Offset:   h.offset,
-			Type:     h.typ,
-			Data:     buf[:h.len:h.len], // TODO: reallocate?
+			TransID:  h.TransID,
+			ObjectID: objectID(h.ObjectID),
+			Offset:   h.Offset,
+			Type:     treeKeyType(h.Type),
+			Data:     buf[:h.Len:h.Len], // TODO: reallocate?
 		})
-		buf = buf[h.len:]
+		buf = buf[h.Len:]
 	}
 	return out, nil
 }
 
+// treeSearch iterates over all items in the key range defined by sk and calls fn for each of them.
+// Note that the key range is compared as a whole (objectid, type, offset), thus fn may
+// receive items with types outside of [min_type, max_type].
+func treeSearch(mnt *os.File, sk btrfs_ioctl_search_key, fn func(searchResult) error) error {
+	if sk.NrItems == 0 {
+		sk.NrItems = 4096
+	}
+	nr := sk.NrItems
+	for {
+		sk.NrItems = nr
+		out, err := treeSearchRaw(mnt, sk)
+		if err != nil {
+			return err
+		} else if len(out) == 0 {
+			return nil
+		}
+		for _, r := range out {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		// continue from the key following the last one
+		last := out[len(out)-1]
+		sk.MinObjectID, sk.MinType, sk.MinOffset = uint64(last.ObjectID), uint32(last.Type), last.Offset+1
+		if sk.MinOffset == 0 { // overflow
+			sk.MinType++
+			if sk.MinType > 255 {
+				sk.MinType = 0
+				sk.MinObjectID++
+				if sk.MinObjectID == 0 {
+					return nil
+				}
+			}
+		}
+		if sk.MinObjectID > sk.MaxObjectID ||
+			(sk.MinObjectID == sk.MaxObjectID && sk.MinType > sk.MaxType) ||
+			(sk.MinObjectID == sk.MaxObjectID && sk.MinType == sk.MaxType && sk.MinOffset > sk.MaxOffset) {
+			return nil
+		}
+	}
+}
+
 func stringFromBytes(input []byte) string {
 	if i := bytes.IndexByte(input, 0); i >= 0 {
 		input = input[:i]
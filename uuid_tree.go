@@ -25,15 +25,15 @@ func (id UUID) toKey() (objID objectID, off uint64) {
 func uuidTreeLookupAny(f *os.File, uuid UUID, typ treeKeyType) (objectID, error) {
 	objId, off := uuid.toKey()
 	args := btrfs_ioctl_search_key{
-		tree_id:      uuidTreeObjectid,
-		min_objectid: objId,
-		max_objectid: objId,
-		min_type:     typ,
-		max_type:     typ,
-		min_offset:   off,
-		max_offset:   off,
-		max_transid:  maxUint64,
-		nr_items:     1,
+		TreeID:      uint64(uuidTreeObjectid),
+		MinObjectID: uint64(objId),
+		MaxObjectID: uint64(objId),
+		MinType:     uint32(typ),
+		MaxType:     uint32(typ),
+		MinOffset:   off,
+		MaxOffset:   off,
+		MaxTransID:  maxUint64,
+		NrItems:     1,
 	}
 	res, err := treeSearchRaw(f, args)
 	if err != nil {
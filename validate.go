@@ -0,0 +1,83 @@
+package btrfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// handleIdent identifies the filesystem object an FS was opened at.
+type handleIdent struct {
+	dev, ino uint64
+	fsid     FSID // zero if the handle cannot be used for ioctls, e.g. O_PATH
+}
+
+func identOf(f *os.File) (handleIdent, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return handleIdent{}, &os.PathError{Op: "stat", Path: f.Name(), Err: err}
+	}
+	id := handleIdent{dev: uint64(st.Dev), ino: st.Ino}
+	if info, err := iocFsInfo(f); err == nil {
+		id.fsid = FSID(info.FSID)
+	}
+	return id, nil
+}
+
+// newFS wraps an open subvolume and records its identity for Validate.
+func newFS(f *os.File) *FS {
+	fs := &FS{f: f}
+	if id, err := identOf(f); err == nil {
+		fs.ident = &id
+	}
+	return fs
+}
+
+// Validate checks that the path the FS was opened at still refers to the same filesystem
+// and subvolume as the handle. It returns ErrStaleHandle if the filesystem was unmounted,
+// or if the path was replaced by a different mount or directory since Open.
+//
+// Operations on a stale handle still reach the original filesystem if it's kept alive
+// by the handle (e.g. after a lazy unmount), but not the one currently mounted at the path.
+func (f *FS) Validate() error {
+	if f.ident == nil {
+		return nil
+	}
+	stale := func(reason string) error {
+		return ErrStaleHandle{Path: f.f.Name(), Reason: reason}
+	}
+	cur, err := identOf(f.f)
+	if err != nil {
+		return stale(err.Error())
+	}
+	if f.ident.fsid != (FSID{}) && cur.fsid != f.ident.fsid {
+		return stale("filesystem of the handle is not available")
+	}
+	var st syscall.Stat_t
+	if err = syscall.Stat(f.f.Name(), &st); err != nil {
+		return stale(err.Error())
+	}
+	if uint64(st.Dev) != f.ident.dev {
+		return stale("a different filesystem is mounted at the path")
+	} else if st.Ino != f.ident.ino {
+		return stale("the path refers to a different directory")
+	}
+	return nil
+}
+
+// SetAutoValidate enables calling Validate before each mutating operation (see SetAudit)
+// and before queries of the filesystem state: SubVolumeID, Info, Devices, GetDevStats,
+// ScrubStatus, GetFlags, Sync, ListSubvolumes and Usage. It's useful for long-running
+// processes that keep a handle open while the filesystem may be unmounted or replaced.
+//
+// It must be called before the FS is used concurrently.
+func (f *FS) SetAutoValidate(on bool) {
+	f.autoValidate = on
+}
+
+// revalidate calls Validate if it was enabled with SetAutoValidate.
+func (f *FS) revalidate() error {
+	if !f.autoValidate {
+		return nil
+	}
+	return f.Validate()
+}
@@ -0,0 +1,53 @@
+package btrfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "btrfs-validate-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "mnt")
+	if err = os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a plain directory is enough to check the path, since the fsid is not available
+	fs := newFS(d)
+	defer fs.Close()
+	if err = fs.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(dir, dir+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fs.Validate().(ErrStaleHandle); !ok {
+		t.Fatalf("expected a stale handle, got: %v", fs.Validate())
+	}
+	if err = os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fs.Validate().(ErrStaleHandle); !ok {
+		t.Fatalf("expected a stale handle, got: %v", fs.Validate())
+	}
+	if _, err = fs.SubVolumeID(); err == nil {
+		t.Fatal("expected an error")
+	} else if _, ok := err.(ErrStaleHandle); ok {
+		t.Fatal("unexpected validation without SetAutoValidate")
+	}
+	fs.SetAutoValidate(true)
+	if _, err = fs.SubVolumeID(); err == nil {
+		t.Fatal("expected an error")
+	} else if _, ok := err.(ErrStaleHandle); !ok {
+		t.Fatalf("expected a stale handle, got: %v", err)
+	}
+}
@@ -0,0 +1,511 @@
+package btrfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Offsets of tree block header fields, see struct btrfs_header.
+const (
+	headerCsumOff       = 0x00
+	headerFSIDOff       = 0x20
+	headerBytenrOff     = 0x30
+	headerGenerationOff = 0x50
+	headerNrItemsOff    = 0x60
+	headerLevelOff      = 0x64
+	headerSize          = 0x65
+
+	diskKeySize  = 17
+	itemSize     = diskKeySize + 8 // struct btrfs_item
+	keyPtrSize   = diskKeySize + 16
+	directIOSize = 4096 // alignment of direct reads
+)
+
+// MetadataProblem describes a copy of a tree block that failed verification.
+type MetadataProblem struct {
+	Logical  uint64 // logical address of the tree block
+	Level    int
+	DevID    uint64 // device the copy was read from
+	Physical uint64 // offset of the copy on the device
+	Reason   string
+}
+
+func (p MetadataProblem) String() string {
+	return fmt.Sprintf("tree block %d (level %d) on device %d at %d: %s",
+		p.Logical, p.Level, p.DevID, p.Physical, p.Reason)
+}
+
+// MetadataReport is the result of VerifyMetadataCsums.
+type MetadataReport struct {
+	Total   int // number of tree blocks in the filesystem
+	Checked int // number of tree blocks that were checked
+	Copies  int // number of copies that were read
+	// Skipped is the number of copies that were not read, because the device is missing,
+	// or the profile is not supported (raid5 and raid6).
+	Skipped int
+	// Changed is the number of copies that were not verified, because the tree block
+	// was modified or freed during the check.
+	Changed  int
+	Problems []MetadataProblem
+}
+
+// treeBlockRef is a tree block from the extent tree.
+type treeBlockRef struct {
+	logical uint64
+	level   int
+}
+
+// blockCopy is a location of a copy of a tree block.
+type blockCopy struct {
+	treeBlockRef
+	devid    uint64
+	physical uint64
+}
+
+// chunkStripe is a location of a chunk stripe on a device.
+type chunkStripe struct {
+	devid  uint64
+	offset uint64
+}
+
+// chunk is a mapping of a logical range to devices.
+type chunk struct {
+	start, length uint64
+	stripeLen     uint64
+	typ           blockGroup
+	subStripes    int
+	stripes       []chunkStripe
+}
+
+// copies maps a logical address within the chunk to locations of all its copies.
+// It returns false for unsupported profiles.
+func (c *chunk) copies(logical uint64) ([]chunkStripe, bool) {
+	off := logical - c.start
+	switch profileOf(c.typ) {
+	case ProfileSingle, ProfileDup, ProfileRaid1, ProfileRaid1C3, ProfileRaid1C4:
+		out := make([]chunkStripe, len(c.stripes))
+		for i, s := range c.stripes {
+			out[i] = chunkStripe{devid: s.devid, offset: s.offset + off}
+		}
+		return out, true
+	case ProfileRaid0, ProfileRaid10:
+		if c.stripeLen == 0 {
+			return nil, false
+		}
+		sub := 1
+		if profileOf(c.typ) == ProfileRaid10 {
+			sub = c.subStripes
+		}
+		if sub <= 0 || len(c.stripes)%sub != 0 {
+			return nil, false
+		}
+		factor := uint64(len(c.stripes) / sub)
+		nr, soff := off/c.stripeLen, off%c.stripeLen
+		idx := int(nr%factor) * sub
+		phys := (nr/factor)*c.stripeLen + soff
+		out := make([]chunkStripe, sub)
+		for i := range out {
+			s := c.stripes[idx+i]
+			out[i] = chunkStripe{devid: s.devid, offset: s.offset + phys}
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+// metadataChunks reads the chunk tree and returns metadata and system chunks.
+func (f *FS) metadataChunks() ([]chunk, error) {
+	return f.chunks(blockGroupMetadata | blockGroupSystem)
+}
+
+// chunks reads the chunk tree and returns chunks of given types, ordered by their logical address.
+func (f *FS) chunks(types blockGroup) ([]chunk, error) {
+	var out []chunk
+	err := treeSearch(f.f, btrfs_ioctl_search_key{
+		TreeID:      uint64(chunkTreeObjectid),
+		MinObjectID: uint64(firstChunkTreeObjectid),
+		MaxObjectID: uint64(firstChunkTreeObjectid),
+		MinType:     uint32(chunkItemKey),
+		MaxType:     uint32(chunkItemKey),
+		MaxOffset:   maxUint64,
+		MaxTransID:  maxUint64,
+	}, func(r searchResult) error {
+		if r.Type != chunkItemKey {
+			return nil
+		}
+		c, _, err := parseChunkItem(r.Offset, r.Data)
+		if err != nil {
+			return err
+		} else if c.typ&types == 0 {
+			return nil
+		}
+		out = append(out, c)
+		return nil
+	})
+	return out, err
+}
+
+// parseChunkItem decodes struct btrfs_chunk with its stripes. It returns the size of the item.
+func parseChunkItem(start uint64, data []byte) (chunk, int, error) {
+	if len(data) < 48 {
+		return chunk{}, 0, fmt.Errorf("chunk item is too short: %d", len(data))
+	}
+	c := chunk{
+		start:      start,
+		length:     order.Uint64(data[0:]),
+		stripeLen:  order.Uint64(data[16:]),
+		typ:        blockGroup(order.Uint64(data[24:])),
+		subStripes: int(order.Uint16(data[46:])),
+	}
+	n := int(order.Uint16(data[44:]))
+	size := 48 + 32*n
+	if len(data) < size {
+		return chunk{}, 0, fmt.Errorf("chunk item is too short: %d", len(data))
+	}
+	for i := 0; i < n; i++ {
+		p := data[48+32*i:]
+		c.stripes = append(c.stripes, chunkStripe{devid: order.Uint64(p[0:]), offset: order.Uint64(p[8:])})
+	}
+	return c, size, nil
+}
+
+// treeBlocks lists all tree blocks recorded in the extent tree.
+func (f *FS) treeBlocks() ([]treeBlockRef, error) {
+	var (
+		out []treeBlockRef
+		mu  sync.Mutex
+	)
+	err := f.scan(btrfs_ioctl_search_key{
+		TreeID:      uint64(extentTreeObjectid),
+		MaxObjectID: maxUint64,
+		MinType:     uint32(extentItemKey),
+		MaxType:     uint32(metadataItemKey),
+		MaxOffset:   maxUint64,
+		MaxTransID:  maxUint64,
+	}, func(r searchResult) error {
+		ref, ok := parseTreeBlockRef(r)
+		if !ok {
+			return nil
+		}
+		mu.Lock()
+		out = append(out, ref)
+		mu.Unlock()
+		return nil
+	})
+	return out, err
+}
+
+// parseTreeBlockRef checks if the extent tree item describes a tree block.
+func parseTreeBlockRef(r searchResult) (treeBlockRef, bool) {
+	switch r.Type {
+	case metadataItemKey:
+		// skinny metadata: level is stored in the key offset
+		return treeBlockRef{logical: uint64(r.ObjectID), level: int(r.Offset)}, true
+	case extentItemKey:
+		if len(r.Data) < 24 || order.Uint64(r.Data[16:])&extentFlagTreeBlock == 0 {
+			return treeBlockRef{}, false
+		}
+		level := -1
+		if len(r.Data) >= 24+diskKeySize+1 {
+			level = int(r.Data[24+diskKeySize]) // struct btrfs_tree_block_info
+		}
+		return treeBlockRef{logical: uint64(r.ObjectID), level: level}, true
+	}
+	return treeBlockRef{}, false
+}
+
+// isTreeBlock checks if the logical address is still allocated to a tree block.
+func (f *FS) isTreeBlock(logical uint64) (bool, error) {
+	found := false
+	err := treeSearch(f.f, btrfs_ioctl_search_key{
+		TreeID:      uint64(extentTreeObjectid),
+		MinObjectID: logical,
+		MaxObjectID: logical,
+		MinType:     uint32(extentItemKey),
+		MaxType:     uint32(metadataItemKey),
+		MaxOffset:   maxUint64,
+		MaxTransID:  maxUint64,
+	}, func(r searchResult) error {
+		if _, ok := parseTreeBlockRef(r); ok {
+			found = true
+		}
+		return nil
+	})
+	return found, err
+}
+
+func readDiskKey(p []byte) diskKey {
+	var raw btrfs_disk_key_raw
+	copy(raw[:], p)
+	return raw.Decode()
+}
+
+// keyLess compares keys in the tree order.
+func keyLess(k1, k2 diskKey) bool {
+	if k1.ObjectID != k2.ObjectID {
+		return k1.ObjectID < k2.ObjectID
+	} else if k1.Type != k2.Type {
+		return k1.Type < k2.Type
+	}
+	return k1.Offset < k2.Offset
+}
+
+// childRef is a pointer to a child block, as recorded in a node.
+type childRef struct {
+	parent uint64
+	key    diskKey
+	gen    uint64
+}
+
+// blockSummary is a part of a verified tree block, used for parent-child checks.
+type blockSummary struct {
+	gen      uint64
+	firstKey diskKey
+	empty    bool
+}
+
+// blockVerifier validates the contents of tree blocks.
+type blockVerifier struct {
+	nodeSize uint32
+	csumType uint16
+	metaUUID UUID
+	checkFS  bool // metadata uuid is known
+}
+
+// verify checks a single tree block. It returns a reason of the failure, or an empty string.
+// For valid nodes it calls fn for each child pointer.
+func (v *blockVerifier) verify(ref treeBlockRef, b []byte, fn func(child uint64, c childRef)) (blockSummary, string) {
+	var s blockSummary
+	sum, err := checksum(v.csumType, b[headerFSIDOff:])
+	if err != nil {
+		return s, err.Error()
+	}
+	if !bytes.Equal(b[headerCsumOff:headerCsumOff+len(sum)], sum) {
+		return s, "checksum mismatch"
+	}
+	if got := order.Uint64(b[headerBytenrOff:]); got != ref.logical {
+		return s, fmt.Sprintf("wrong bytenr: %d", got)
+	}
+	if v.checkFS && !bytes.Equal(b[headerFSIDOff:headerFSIDOff+UUIDSize], v.metaUUID[:]) {
+		return s, "wrong fsid"
+	}
+	level := int(b[headerLevelOff])
+	if ref.level >= 0 && level != ref.level {
+		return s, fmt.Sprintf("wrong level: %d", level)
+	}
+	s.gen = order.Uint64(b[headerGenerationOff:])
+	n := int(order.Uint32(b[headerNrItemsOff:]))
+	size := itemSize
+	if level > 0 {
+		size = keyPtrSize
+	}
+	if headerSize+n*size > len(b) {
+		return s, fmt.Sprintf("too many items: %d", n)
+	}
+	s.empty = n == 0
+	var prev diskKey
+	for i := 0; i < n; i++ {
+		p := b[headerSize+i*size:]
+		k := readDiskKey(p)
+		if i == 0 {
+			s.firstKey = k
+		} else if !keyLess(prev, k) {
+			return s, fmt.Sprintf("keys out of order at slot %d", i)
+		}
+		prev = k
+		if level == 0 {
+			off, sz := order.Uint32(p[diskKeySize:]), order.Uint32(p[diskKeySize+4:])
+			if uint64(off)+uint64(sz) > uint64(len(b)-headerSize) {
+				return s, fmt.Sprintf("item %d is out of the block", i)
+			}
+			continue
+		}
+		gen := order.Uint64(p[diskKeySize+8:])
+		if gen > s.gen {
+			return s, fmt.Sprintf("child %d has a newer generation: %d", i, gen)
+		}
+		fn(order.Uint64(p[diskKeySize:]), childRef{parent: ref.logical, key: k, gen: gen})
+	}
+	return s, ""
+}
+
+// alignedBuffer allocates a buffer suitable for direct IO.
+func alignedBuffer(size int) []byte {
+	b := make([]byte, size+directIOSize)
+	off := int(uintptr(unsafe.Pointer(&b[0])) & (directIOSize - 1))
+	if off != 0 {
+		off = directIOSize - off
+	}
+	return b[off : off+size]
+}
+
+// VerifyMetadataCsums reads tree blocks directly from the devices and validates their
+// checksums, headers, key ordering and pointers between parent and child blocks.
+// It is a lightweight sanity check of metadata, which can run on a mounted filesystem.
+// All copies of each block are checked, but unlike scrub, nothing is repaired.
+//
+// Blocks are sampled randomly with a given rate; values outside of (0, 1) check all blocks.
+// Parent-child pointers are verified only if both blocks were sampled. Blocks that are
+// modified during the check are skipped. It requires CAP_SYS_ADMIN.
+func (f *FS) VerifyMetadataCsums(ctx context.Context, sampleRate float64) (*MetadataReport, error) {
+	info, err := iocFsInfo(f.f)
+	if err != nil {
+		return nil, err
+	}
+	v := &blockVerifier{nodeSize: info.NodeSize}
+	if info.Flags&_BTRFS_FS_INFO_FLAG_CSUM_INFO != 0 {
+		v.csumType = info.CsumType
+	}
+	feat, err := f.GetFeatures()
+	if err != nil {
+		return nil, err
+	}
+	if info.Flags&_BTRFS_FS_INFO_FLAG_METADATA_UUID != 0 {
+		v.metaUUID, v.checkFS = UUID(info.MetadataUUID), true
+	} else if feat.Incompatible&FeatureIncompatMetadataUUID == 0 {
+		v.metaUUID, v.checkFS = UUID(info.FSID), true
+	}
+	startGen := uint64(maxUint64)
+	if info.Flags&_BTRFS_FS_INFO_FLAG_GENERATION != 0 {
+		startGen = info.Generation
+	}
+	chunks, err := f.metadataChunks()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read chunk tree: %v", err)
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].start < chunks[j].start })
+	blocks, err := f.treeBlocks()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read extent tree: %v", err)
+	}
+	rep := &MetadataReport{Total: len(blocks)}
+	all := sampleRate <= 0 || sampleRate >= 1
+	var reads []blockCopy
+	for _, ref := range blocks {
+		if !all && rand.Float64() >= sampleRate {
+			continue
+		}
+		rep.Checked++
+		i := sort.Search(len(chunks), func(i int) bool { return chunks[i].start+chunks[i].length > ref.logical })
+		if i >= len(chunks) || chunks[i].start > ref.logical {
+			rep.Problems = append(rep.Problems, MetadataProblem{
+				Logical: ref.logical, Level: ref.level, Reason: "not mapped by any chunk",
+			})
+			continue
+		}
+		copies, ok := chunks[i].copies(ref.logical)
+		if !ok {
+			rep.Skipped++
+			continue
+		}
+		for _, c := range copies {
+			reads = append(reads, blockCopy{treeBlockRef: ref, devid: c.devid, physical: c.offset})
+		}
+	}
+	// read devices sequentially
+	sort.Slice(reads, func(i, j int) bool {
+		if reads[i].devid != reads[j].devid {
+			return reads[i].devid < reads[j].devid
+		}
+		return reads[i].physical < reads[j].physical
+	})
+	var (
+		dev      *os.File
+		devid    uint64
+		buf      = alignedBuffer(int(v.nodeSize))
+		children = make(map[uint64]childRef)
+		sampled  = make(map[uint64]blockSummary)
+	)
+	defer func() {
+		if dev != nil {
+			dev.Close()
+		}
+	}()
+	read := func(c blockCopy) error {
+		_, err := dev.ReadAt(buf, int64(c.physical))
+		return err
+	}
+	for _, c := range reads {
+		if err = ctx.Err(); err != nil {
+			return rep, err
+		}
+		if dev == nil || devid != c.devid {
+			if dev != nil {
+				dev.Close()
+				dev = nil
+			}
+			devid = c.devid
+			di, err := f.GetDevInfo(c.devid)
+			if err == nil && di.Path != "" {
+				dev, err = os.OpenFile(di.Path, os.O_RDONLY|syscall.O_DIRECT, 0)
+			}
+			if dev == nil {
+				rep.Skipped++
+				continue
+			}
+		}
+		rep.Copies++
+		reason := ""
+		if err = read(c); err != nil {
+			reason = err.Error()
+		}
+		var s blockSummary
+		addChild := func(child uint64, r childRef) { children[child] = r }
+		if reason == "" {
+			s, reason = v.verify(c.treeBlockRef, buf, addChild)
+		}
+		if reason != "" {
+			// the block might have been freed or rewritten since the extent tree was read
+			if ok, err := f.isTreeBlock(c.logical); err != nil {
+				return rep, err
+			} else if !ok {
+				rep.Changed++
+				continue
+			}
+			if err = read(c); err == nil {
+				if s, reason = v.verify(c.treeBlockRef, buf, addChild); reason == "" {
+					rep.Changed++
+					sampled[c.logical] = s
+					continue
+				}
+			}
+			rep.Problems = append(rep.Problems, MetadataProblem{
+				Logical: c.logical, Level: c.level, DevID: c.devid, Physical: c.physical, Reason: reason,
+			})
+			continue
+		}
+		if s.gen > startGen {
+			rep.Changed++
+			continue
+		}
+		sampled[c.logical] = s
+	}
+	// check pointers between sampled parents and children
+	for logical, s := range sampled {
+		r, ok := children[logical]
+		if !ok || s.gen > startGen {
+			continue
+		}
+		reason := ""
+		switch {
+		case r.gen != s.gen:
+			reason = fmt.Sprintf("generation %d does not match the parent %d (%d)", s.gen, r.parent, r.gen)
+		case s.empty:
+			reason = fmt.Sprintf("empty block is referenced by the parent %d", r.parent)
+		case s.firstKey != r.key:
+			reason = fmt.Sprintf("first key does not match the parent %d", r.parent)
+		}
+		if reason != "" {
+			rep.Problems = append(rep.Problems, MetadataProblem{Logical: logical, Level: -1, Reason: reason})
+		}
+	}
+	sort.Slice(rep.Problems, func(i, j int) bool { return rep.Problems[i].Logical < rep.Problems[j].Logical })
+	return rep, nil
+}
@@ -0,0 +1,108 @@
+package btrfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChunkCopies(t *testing.T) {
+	const stripe = 64 << 10
+	c := chunk{
+		start: 1 << 30, length: 1 << 30, stripeLen: stripe,
+		typ: blockGroupMetadata | blockGroupRaid10, subStripes: 2,
+		stripes: []chunkStripe{{1, 100 << 20}, {2, 200 << 20}, {3, 300 << 20}, {4, 400 << 20}},
+	}
+	// second stripe: second pair of devices, first row
+	got, ok := c.copies(c.start + stripe + 4096)
+	if !ok {
+		t.Fatal("expected raid10 to be supported")
+	}
+	exp := []chunkStripe{{3, 300<<20 + 4096}, {4, 400<<20 + 4096}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected copies: %v vs %v", got, exp)
+	}
+	// third stripe: first pair of devices, second row
+	got, _ = c.copies(c.start + 2*stripe)
+	exp = []chunkStripe{{1, 100<<20 + stripe}, {2, 200<<20 + stripe}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected copies: %v vs %v", got, exp)
+	}
+	c.typ = blockGroupMetadata | blockGroupDup
+	c.stripes = c.stripes[:2]
+	got, _ = c.copies(c.start + 4096)
+	exp = []chunkStripe{{1, 100<<20 + 4096}, {2, 200<<20 + 4096}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected copies: %v vs %v", got, exp)
+	}
+	c.typ = blockGroupMetadata | blockGroupRaid6
+	if _, ok = c.copies(c.start); ok {
+		t.Fatal("raid6 is not supported")
+	}
+}
+
+func TestBlockVerifier(t *testing.T) {
+	const nodeSize = 4096
+	v := &blockVerifier{nodeSize: nodeSize, metaUUID: UUID{1}, checkFS: true}
+	putKey := func(p []byte, k diskKey) {
+		order.PutUint64(p[0:], k.ObjectID)
+		p[8] = k.Type
+		order.PutUint64(p[9:], k.Offset)
+	}
+	newBlock := func(logical uint64, level int, keys ...diskKey) []byte {
+		b := make([]byte, nodeSize)
+		copy(b[headerFSIDOff:], v.metaUUID[:])
+		order.PutUint64(b[headerBytenrOff:], logical)
+		order.PutUint64(b[headerGenerationOff:], 10)
+		order.PutUint32(b[headerNrItemsOff:], uint32(len(keys)))
+		b[headerLevelOff] = byte(level)
+		for i, k := range keys {
+			if level == 0 {
+				p := b[headerSize+i*itemSize:]
+				putKey(p, k)
+				order.PutUint32(p[diskKeySize:], uint32(nodeSize-headerSize-(i+1)*8))
+				order.PutUint32(p[diskKeySize+4:], 8)
+			} else {
+				p := b[headerSize+i*keyPtrSize:]
+				putKey(p, k)
+				order.PutUint64(p[diskKeySize:], 1<<20+uint64(i)*nodeSize)
+				order.PutUint64(p[diskKeySize+8:], 9)
+			}
+		}
+		sum, _ := checksum(v.csumType, b[headerFSIDOff:])
+		copy(b, sum)
+		return b
+	}
+	k1, k2 := diskKey{ObjectID: 256, Type: 1}, diskKey{ObjectID: 256, Type: 12}
+
+	leaf := newBlock(8192, 0, k1, k2)
+	s, reason := v.verify(treeBlockRef{logical: 8192, level: 0}, leaf, nil)
+	if reason != "" {
+		t.Fatal(reason)
+	} else if s.firstKey != k1 || s.gen != 10 {
+		t.Fatalf("unexpected summary: %+v", s)
+	}
+	if _, reason = v.verify(treeBlockRef{logical: 4096, level: 0}, leaf, nil); reason == "" {
+		t.Fatal("expected wrong bytenr")
+	}
+	leaf[nodeSize-1] ^= 1
+	if _, reason = v.verify(treeBlockRef{logical: 8192, level: 0}, leaf, nil); reason != "checksum mismatch" {
+		t.Fatalf("expected checksum mismatch, got %q", reason)
+	}
+	if _, reason = v.verify(treeBlockRef{logical: 8192, level: 0}, newBlock(8192, 0, k2, k1), nil); reason == "" {
+		t.Fatal("expected keys out of order")
+	}
+
+	var children []uint64
+	node := newBlock(12288, 1, k1, k2)
+	if _, reason = v.verify(treeBlockRef{logical: 12288, level: 1}, node, func(child uint64, r childRef) {
+		if r.parent != 12288 || r.gen != 9 {
+			t.Fatalf("unexpected child ref: %+v", r)
+		}
+		children = append(children, child)
+	}); reason != "" {
+		t.Fatal(reason)
+	}
+	if !reflect.DeepEqual(children, []uint64{1 << 20, 1<<20 + nodeSize}) {
+		t.Fatalf("unexpected children: %v", children)
+	}
+}
@@ -0,0 +1,246 @@
+package btrfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// WatchOp is a kind of file change reported by a Watcher.
+type WatchOp uint32
+
+const (
+	WatchCreate WatchOp = 1 << iota
+	WatchWrite
+	WatchRemove
+	WatchRename
+	WatchAttrib
+	// WatchOverflow is reported when the kernel dropped events, so consumers
+	// should treat the whole subvolume as changed.
+	WatchOverflow
+)
+
+func (op WatchOp) String() string {
+	var names []string
+	for _, v := range []struct {
+		op   WatchOp
+		name string
+	}{
+		{WatchCreate, "create"},
+		{WatchWrite, "write"},
+		{WatchRemove, "remove"},
+		{WatchRename, "rename"},
+		{WatchAttrib, "attrib"},
+		{WatchOverflow, "overflow"},
+	} {
+		if op&v.op != 0 {
+			names = append(names, v.name)
+			op &^= v.op
+		}
+	}
+	if op != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(op)))
+	}
+	return strings.Join(names, "|")
+}
+
+// WatchEvent is a change of a file in a watched subvolume.
+type WatchEvent struct {
+	Path string // absolute path of the file; empty for WatchOverflow
+	Op   WatchOp
+}
+
+const watchMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_DELETE | syscall.IN_DELETE_SELF | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_ATTRIB
+
+// Watcher delivers file change events of a subvolume. It's created by FS.WatchPaths.
+type Watcher struct {
+	// C receives events. It's closed when the context is cancelled or reading fails.
+	C <-chan WatchEvent
+
+	f   *os.File
+	fd  int // calling f.Fd would switch the file to blocking mode
+	dev uint64
+
+	mu    sync.Mutex
+	paths map[int32]string // watch descriptor -> directory or file
+	err   error
+}
+
+// WatchPaths starts watching files and directories of the subvolume for changes.
+// Paths are relative to f; if none are given, the whole subvolume is watched.
+// Directories are watched recursively, including the ones created later, but the watch
+// does not descend into nested subvolumes, since they are separate snapshot units.
+//
+// Events are based on inotify, so only changes made through the mounted filesystem are
+// reported; received streams and snapshots are reported as ordinary file changes.
+// Events are meant to trigger policies like "snapshot after a burst of changes", and
+// can be combined with generation numbers (see SubvolInfo) to find what was changed exactly.
+//
+// The watch stops and C is closed when ctx is cancelled; Err reports why it stopped.
+func (f *FS) WatchPaths(ctx context.Context, paths ...string) (*Watcher, error) {
+	root := f.f.Name()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.f.Fd()), &st); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: root, Err: err}
+	}
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	c := make(chan WatchEvent, 64)
+	w := &Watcher{
+		C:     c,
+		f:     os.NewFile(uintptr(fd), "inotify"),
+		fd:    fd,
+		dev:   uint64(st.Dev),
+		paths: make(map[int32]string),
+	}
+	for _, p := range paths {
+		if err = w.addTree(filepath.Join(root, p)); err != nil {
+			w.f.Close()
+			return nil, err
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.setErr(ctx.Err())
+			w.f.Close()
+		case <-done:
+		}
+	}()
+	go func() {
+		defer close(c)
+		defer close(done)
+		w.run(ctx, c)
+	}()
+	return w, nil
+}
+
+// Err returns the reason the watch stopped. It's only valid after C is closed.
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *Watcher) setErr(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+}
+
+// addTree watches a path and, if it's a directory, all directories under it that belong
+// to the same subvolume.
+func (w *Watcher) addTree(path string) error {
+	return filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p != path {
+				return nil // removed while walking
+			}
+			return err
+		}
+		if p != path && !fi.IsDir() {
+			return nil
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && uint64(st.Dev) != w.dev {
+			// nested subvolumes have a different device number
+			if p == path {
+				return fmt.Errorf("%s is in a different subvolume", path)
+			}
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, p, watchMask)
+		if err != nil {
+			if err == syscall.ENOENT && p != path {
+				return nil
+			}
+			return &os.PathError{Op: "inotify_add_watch", Path: p, Err: err}
+		}
+		w.mu.Lock()
+		w.paths[int32(wd)] = p
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+func (w *Watcher) run(ctx context.Context, c chan<- WatchEvent) {
+	defer w.f.Close()
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			w.setErr(err)
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			if i := strings.IndexByte(string(name), 0); i >= 0 {
+				name = name[:i]
+			}
+			e, ok := w.convert(ev.Wd, ev.Mask, string(name))
+			if !ok {
+				continue
+			}
+			select {
+			case c <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// convert translates an inotify event and updates the watches accordingly.
+func (w *Watcher) convert(wd int32, mask uint32, name string) (WatchEvent, bool) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		return WatchEvent{Op: WatchOverflow}, true
+	}
+	w.mu.Lock()
+	path, ok := w.paths[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.paths, wd)
+	}
+	w.mu.Unlock()
+	if !ok || mask&syscall.IN_IGNORED != 0 {
+		return WatchEvent{}, false
+	}
+	if name != "" {
+		path = filepath.Join(path, name)
+	}
+	e := WatchEvent{Path: path}
+	switch {
+	case mask&syscall.IN_CREATE != 0:
+		e.Op = WatchCreate
+	case mask&(syscall.IN_MODIFY|syscall.IN_CLOSE_WRITE) != 0:
+		e.Op = WatchWrite
+	case mask&(syscall.IN_DELETE|syscall.IN_DELETE_SELF) != 0:
+		e.Op = WatchRemove
+	case mask&(syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO) != 0:
+		e.Op = WatchRename
+	case mask&syscall.IN_ATTRIB != 0:
+		e.Op = WatchAttrib
+	default:
+		return WatchEvent{}, false
+	}
+	if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		// errors are ignored: the directory may be gone already, or be a nested subvolume
+		w.addTree(path)
+	}
+	return e, true
+}
@@ -0,0 +1,74 @@
+package btrfs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dennwc/btrfs/test"
+)
+
+func TestWatchOpString(t *testing.T) {
+	if s := (WatchCreate | WatchWrite).String(); s != "create|write" {
+		t.Fatalf("unexpected string: %q", s)
+	}
+	if s := WatchOp(1 << 10).String(); s != "0x400" {
+		t.Fatalf("unexpected string: %q", s)
+	}
+}
+
+func TestWatchPaths(t *testing.T) {
+	dir, closer := btrfstest.New(t, sizeDef)
+	defer closer()
+	fs, err := Open(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if err = fs.CreateSubVolume("nested"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	w, err := fs.WatchPaths(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(dir, "sub")
+	if err = os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// give the watcher a chance to add the new directory
+	time.Sleep(100 * time.Millisecond)
+	if err = ioutil.WriteFile(filepath.Join(dir, "nested", "skipped"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(sub, "file")
+	if err = ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var ops WatchOp
+	for e := range w.C {
+		if e.Path == filepath.Join(dir, "nested", "skipped") {
+			t.Fatal("unexpected event from a nested subvolume")
+		}
+		if e.Path == file {
+			ops |= e.Op
+			if ops&WatchWrite != 0 {
+				break
+			}
+		}
+	}
+	if ops != WatchCreate|WatchWrite {
+		t.Fatalf("unexpected events: %v (%v)", ops, w.Err())
+	}
+	cancel()
+	for range w.C {
+	}
+	if err = w.Err(); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}